@@ -0,0 +1,324 @@
+package gocryptfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Options configures a filesystem mounted through Mount().
+// The zero value of every field except CipherDir, MountPoint and Password
+// gives the same behavior as the gocryptfs command without the corresponding
+// option.
+type Options struct {
+	// CipherDir is the encrypted directory (the plaintext directory in
+	// reverse mode)
+	CipherDir string
+	// MountPoint is the directory the filesystem is mounted on
+	MountPoint string
+	// Password supplies the password
+	Password PasswordProvider
+	// PasswordAttempts is the number of times Password is asked before
+	// Mount() gives up on a wrong password. Zero means one attempt.
+	PasswordAttempts int
+	// ConfigFile overrides the default location of the config file, like
+	// "-config"
+	ConfigFile string
+	// Reverse mounts an encrypted view of CipherDir, like "-reverse"
+	Reverse bool
+	// ReadOnly mounts the filesystem read-only, like "-ro"
+	ReadOnly bool
+	// AllowOther allows other users to access the filesystem, like
+	// "-allow_other"
+	AllowOther bool
+	// FsName is shown in "df -T", like "-fsname". Defaults to CipherDir.
+	FsName string
+	// KernelCache enables the kernel page cache, like "-kernel_cache"
+	KernelCache bool
+	// SharedStorage makes concurrent access to a shared CipherDir safer,
+	// like "-sharedstorage"
+	SharedStorage bool
+	// SharedStoragePoll is how often the open files are checked for changes
+	// of other mounts with SharedStorage, like "-sharedstorage-poll". 0
+	// disables the checks. Not supported in reverse mode.
+	SharedStoragePoll time.Duration
+	// SyncDir fsyncs the encrypted directory after operations that change
+	// it, like "-syncdir". Not supported in reverse mode.
+	SyncDir bool
+	// MountOptions are passed to the kernel, like "-ko"
+	MountOptions []string
+	// FuseDebug enables the go-fuse debug output, like "-fusedebug"
+	FuseDebug bool
+	// Debug enables the debug messages of this filesystem, like "-d"
+	Debug bool
+	// Quiet suppresses the informational messages of this filesystem, like
+	// "-q"
+	Quiet bool
+	// IdleTimeout unmounts the filesystem after it has been idle for this
+	// long, like "-idle". Not supported in reverse mode.
+	IdleTimeout time.Duration
+
+	// OnMount is called when the filesystem is ready to use, before Mount()
+	// returns
+	OnMount func(mountpoint string)
+	// OnIdleUnmount is called after the filesystem has been unmounted
+	// because of IdleTimeout
+	OnIdleUnmount func()
+	// OnError is called when the filesystem cannot be unmounted after "ctx"
+	// has been canceled
+	OnError func(err error)
+}
+
+// Filesystem is a filesystem mounted through Mount()
+type Filesystem struct {
+	srv        *fuse.Server
+	mountPoint string
+	// done is closed when the filesystem has been unmounted and the keys
+	// have been wiped
+	done chan struct{}
+}
+
+// Mount mounts the gocryptfs filesystem described by "opts" and returns
+// when it is ready to use. Errors are returned, never os.Exit'ed, and
+// neither os.Args nor the command line flags are used.
+//
+// Canceling "ctx" unmounts the filesystem, lazily if it is busy (Linux
+// only). Before the filesystem is mounted, it aborts Mount().
+//
+// Several filesystems, forward and reverse, can be mounted at the same time
+// in one process. They share the log output and its format (package tlog),
+// which Mount does not change. Debug and Quiet only apply to the messages of
+// the file system operations; the other packages, like the crypto code, use
+// the process-wide tlog.Debug and tlog.Info.
+//
+// Unlike the gocryptfs command, Mount does not change the umask of the
+// process. New files get the mode requested by the caller all the same, see
+// fusefrontend.Args.ExactModes.
+func Mount(ctx context.Context, opts Options) (*Filesystem, error) {
+	if opts.CipherDir == "" || opts.MountPoint == "" {
+		return nil, errors.New("CipherDir and MountPoint are required")
+	}
+	if opts.Reverse && opts.IdleTimeout > 0 {
+		return nil, errors.New("IdleTimeout is not supported in reverse mode")
+	}
+	if opts.Password == nil {
+		return nil, errors.New("Password is required")
+	}
+	cipherdir, err := filepath.Abs(opts.CipherDir)
+	if err != nil {
+		return nil, err
+	}
+	if err = isDir(cipherdir); err != nil {
+		return nil, fmt.Errorf("invalid cipherdir: %v", err)
+	}
+	mountpoint, err := filepath.Abs(opts.MountPoint)
+	if err != nil {
+		return nil, err
+	}
+	if err = isDir(mountpoint); err != nil {
+		return nil, fmt.Errorf("invalid mountpoint: %v", err)
+	}
+	config := opts.ConfigFile
+	if config == "" {
+		config = filepath.Join(cipherdir, configfile.ConfDefaultName)
+		if opts.Reverse {
+			config = filepath.Join(cipherdir, configfile.ConfReverseName)
+		}
+	}
+	cf, err := configfile.Load(config)
+	if err != nil {
+		return nil, err
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		return nil, errors.New("FIDO2 filesystems are not supported")
+	}
+	// The tenant directories have keys of their own. Mount() would write
+	// files into them that the tenants cannot decrypt.
+	if cf.IsFeatureFlagSet(configfile.FlagMultiTenant) {
+		return nil, errors.New("filesystems with tenants (-add-tenant) are not supported")
+	}
+	masterkey, err := decryptWithProvider(ctx, cf, opts.Password, opts.PasswordAttempts)
+	if err != nil {
+		return nil, err
+	}
+	rootNode, wipeKeys, err := newAPIRootNode(cipherdir, opts, cf, masterkey)
+	if err != nil {
+		return nil, err
+	}
+	if err = ctx.Err(); err != nil {
+		wipeKeys()
+		return nil, err
+	}
+	// newFuseServer only looks at the options that are set here
+	args := &argContainer{
+		cipherdir:     cipherdir,
+		mountpoint:    mountpoint,
+		reverse:       opts.Reverse,
+		ro:            opts.ReadOnly,
+		allow_other:   opts.AllowOther,
+		fsname:        opts.FsName,
+		sharedstorage: opts.SharedStorage,
+		fusedebug:     opts.FuseDebug,
+	}
+	if len(opts.MountOptions) > 0 {
+		args.ko = strings.Join(opts.MountOptions, ",")
+	}
+	srv, err := newFuseServer(rootNode, args)
+	if err != nil {
+		wipeKeys()
+		return nil, err
+	}
+	f := &Filesystem{
+		srv:        srv,
+		mountPoint: mountpoint,
+		done:       make(chan struct{}),
+	}
+	go func() {
+		srv.Wait()
+		wipeKeys()
+		close(f.done)
+	}()
+	go f.watchContext(ctx, opts.OnError)
+	if opts.IdleTimeout > 0 {
+		go idleMonitor(opts.IdleTimeout, false, rootNode.(*fusefrontend.RootNode), srv, mountpoint,
+			f.done, opts.OnIdleUnmount)
+	}
+	if opts.SharedStorage && opts.SharedStoragePoll > 0 && !opts.Reverse {
+		go rootNode.(*fusefrontend.RootNode).PollSharedStorage(opts.SharedStoragePoll, f.done)
+	}
+	if opts.OnMount != nil {
+		opts.OnMount(mountpoint)
+	}
+	return f, nil
+}
+
+// watchContext unmounts the filesystem when "ctx" is canceled
+func (f *Filesystem) watchContext(ctx context.Context, onError func(error)) {
+	select {
+	case <-f.done:
+		return
+	case <-ctx.Done():
+	}
+	if err := unmountLazy(f.srv, f.mountPoint); err != nil && onError != nil {
+		onError(err)
+	}
+}
+
+// decryptWithProvider decrypts the master key in "cf" with the password from
+// "p". Asks again, up to "attempts" times, if the password is wrong.
+func decryptWithProvider(ctx context.Context, cf *configfile.ConfFile, p PasswordProvider, attempts int) ([]byte, error) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		var pw, masterkey []byte
+		pw, err = p.GetPassword(ctx, attempt)
+		if err != nil {
+			return nil, err
+		}
+		masterkey, err = cf.DecryptMasterKey(pw)
+		for i := range pw {
+			pw[i] = 0
+		}
+		if err == nil {
+			return masterkey, nil
+		}
+		if e, ok := err.(exitcodes.Err); !ok || e.Code() != exitcodes.PasswordIncorrect {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// newAPIRootNode creates the root node for Mount(). It wipes "masterkey".
+func newAPIRootNode(cipherdir string, opts Options, cf *configfile.ConfFile, masterkey []byte) (fs.InodeEmbedder, func(), error) {
+	cryptoBackend := cryptocore.BackendGoGCM
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		cryptoBackend = cryptocore.BackendAESSIV
+	} else if opts.Reverse {
+		return nil, nil, errors.New("AES-SIV is required by reverse mode, but not enabled in the config file")
+	}
+	dirPolicies := cf.IsFeatureFlagSet(configfile.FlagDirPolicy)
+	if dirPolicies && opts.SharedStorage {
+		// NewRootNode would exit
+		return nil, nil, errors.New("directory policies are not supported with SharedStorage")
+	}
+	frontendArgs := fusefrontend.Args{
+		Cipherdir:      cipherdir,
+		PlaintextNames: cf.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+		DirPolicies:    dirPolicies,
+		LongNames:      true,
+		NameMax:        cf.PlainNameMax(),
+		ConfigCustom:   opts.ConfigFile != "",
+		KernelCache:    opts.KernelCache,
+		SharedStorage:  opts.SharedStorage,
+		SyncDir:        opts.SyncDir,
+		// The umask of the process is not changed
+		ExactModes: true,
+		Log:        tlog.NewLoggers(opts.Debug, !opts.Quiet),
+	}
+	cCore := cryptocore.New(masterkey, cryptoBackend, contentenc.DefaultIVBits,
+		cf.IsFeatureFlagSet(configfile.FlagHKDF), false)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false)
+	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames,
+		cf.IsFeatureFlagSet(configfile.FlagRaw64))
+	nameTransform.SetNameMax(frontendArgs.NameMax)
+	var rootNode fs.InodeEmbedder
+	if opts.Reverse {
+		rootNode = fusefrontend_reverse.NewRootNode(frontendArgs, cEnc, nameTransform)
+	} else {
+		rootNode = fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+	}
+	return rootNode, func() { cCore.Wipe() }, nil
+}
+
+// MountPoint returns the absolute path of the mountpoint
+func (f *Filesystem) MountPoint() string {
+	return f.mountPoint
+}
+
+// Wait blocks until the filesystem has been unmounted and the keys have been
+// wiped from memory
+func (f *Filesystem) Wait() {
+	<-f.done
+}
+
+// Unmount unmounts the filesystem and wipes the keys from memory. The
+// keys stay in memory if the unmount fails, for example because the
+// filesystem is busy.
+func (f *Filesystem) Unmount() error {
+	if err := f.srv.Unmount(); err != nil {
+		return err
+	}
+	f.Wait()
+	return nil
+}
+
+// UnmountLazy is Unmount(), but falls back to a lazy unmount if the
+// filesystem is busy (Linux only). The filesystem is then detached
+// immediately and cleaned up when it is no longer busy.
+func (f *Filesystem) UnmountLazy() error {
+	return unmountLazy(f.srv, f.mountPoint)
+}
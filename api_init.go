@@ -0,0 +1,164 @@
+package gocryptfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/fido2"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Option configures InitFilesystem()
+type Option func(*initOptions)
+
+// initOptions is the result of applying all Options
+type initOptions struct {
+	password       PasswordProvider
+	fido2Device    string
+	configFile     string
+	reverse        bool
+	aessiv         bool
+	plaintextNames bool
+	scryptN        int
+	devRandom      bool
+	creator        string
+}
+
+// WithPassword protects the master key with the password from "p", like the
+// gocryptfs command without "-fido2"
+func WithPassword(p PasswordProvider) Option {
+	return func(o *initOptions) { o.password = p }
+}
+
+// WithFIDO2 protects the master key with the FIDO2 token "device", like
+// "-fido2". The user has to interact with the token.
+func WithFIDO2(device string) Option {
+	return func(o *initOptions) { o.fido2Device = device }
+}
+
+// WithConfigFile overrides the default location of the config file, like
+// "-config"
+func WithConfigFile(path string) Option {
+	return func(o *initOptions) { o.configFile = path }
+}
+
+// WithReverse creates a config file for reverse mode, like "-reverse".
+// Implies WithAESSIV.
+func WithReverse() Option {
+	return func(o *initOptions) { o.reverse = true }
+}
+
+// WithAESSIV encrypts file contents using AES-SIV instead of AES-GCM, like
+// "-aessiv"
+func WithAESSIV() Option {
+	return func(o *initOptions) { o.aessiv = true }
+}
+
+// WithPlaintextNames disables file name encryption, like "-plaintextnames"
+func WithPlaintextNames() Option {
+	return func(o *initOptions) { o.plaintextNames = true }
+}
+
+// WithScryptN sets the scrypt cost parameter logN, like "-scryptn"
+func WithScryptN(logN int) Option {
+	return func(o *initOptions) { o.scryptN = logN }
+}
+
+// WithDevRandom generates the master key using /dev/random, like
+// "-devrandom"
+func WithDevRandom() Option {
+	return func(o *initOptions) { o.devRandom = true }
+}
+
+// WithCreator overrides the "Creator" field of the config file, which
+// defaults to the gocryptfs version
+func WithCreator(creator string) Option {
+	return func(o *initOptions) { o.creator = creator }
+}
+
+// InitFilesystem creates a new gocryptfs filesystem in "dir", like
+// "gocryptfs -init". Exactly one of WithPassword and WithFIDO2 is required.
+//
+// Errors are of type exitcodes.Err and carry the exit code the gocryptfs
+// command would have used, see the exitcodes package.
+func InitFilesystem(dir string, opts ...Option) error {
+	o := initOptions{
+		scryptN: configfile.ScryptDefaultLogN,
+		creator: tlog.ProgramName + " " + GitVersion,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if (o.password == nil) == (o.fido2Device == "") {
+		return exitcodes.NewErr("exactly one of WithPassword and WithFIDO2 is required", exitcodes.Usage)
+	}
+	if o.scryptN < 10 {
+		return exitcodes.NewErr("scryptn below 10 is too low to make sense", exitcodes.Usage)
+	}
+	// "-reverse" implies "-aessiv"
+	if o.reverse {
+		o.aessiv = true
+	}
+	cipherdir, err := filepath.Abs(dir)
+	if err != nil {
+		return exitcodes.NewErr(err.Error(), exitcodes.CipherDir)
+	}
+	config := o.configFile
+	if config == "" {
+		config = filepath.Join(cipherdir, configfile.ConfDefaultName)
+		if o.reverse {
+			config = filepath.Join(cipherdir, configfile.ConfReverseName)
+		}
+	}
+	if o.reverse {
+		if err = isDir(cipherdir); err != nil {
+			return exitcodes.NewErr(fmt.Sprintf("invalid cipherdir: %v", err), exitcodes.CipherDir)
+		}
+		if _, err = os.Stat(config); err == nil {
+			return exitcodes.NewErr(fmt.Sprintf("config file %q already exists", config), exitcodes.Init)
+		}
+	} else if err = isEmptyDir(cipherdir); err != nil {
+		return exitcodes.NewErr(fmt.Sprintf("invalid cipherdir: %v", err), exitcodes.CipherDir)
+	}
+	var password, fido2CredentialID, fido2HmacSalt []byte
+	if o.fido2Device != "" {
+		fido2CredentialID, err = fido2.NewCredential(o.fido2Device, filepath.Base(cipherdir))
+		if err != nil {
+			return exitcodes.NewErr(err.Error(), exitcodes.FIDO2Error)
+		}
+		fido2HmacSalt = cryptocore.RandBytes(32)
+		password, err = fido2.HMACSecret(o.fido2Device, fido2CredentialID, fido2HmacSalt)
+		if err != nil {
+			return exitcodes.NewErr(err.Error(), exitcodes.FIDO2Error)
+		}
+	} else {
+		password, err = o.password.GetPassword(context.Background(), 1)
+		if err != nil {
+			return exitcodes.NewErr(err.Error(), exitcodes.ReadPassword)
+		}
+		if len(password) == 0 {
+			return exitcodes.NewErr("password is empty", exitcodes.PasswordEmpty)
+		}
+	}
+	err = configfile.Create(config, password, o.plaintextNames, o.scryptN, o.creator,
+		o.aessiv, o.devRandom, fido2CredentialID, fido2HmacSalt)
+	for i := range password {
+		password[i] = 0
+	}
+	if err != nil {
+		return exitcodes.NewErr(err.Error(), exitcodes.WriteConf)
+	}
+	// Forward mode with filename encryption enabled needs a gocryptfs.diriv
+	// file in the root dir
+	if !o.plaintextNames && !o.reverse {
+		if err = writeRootDirIV(cipherdir); err != nil {
+			return exitcodes.NewErr(err.Error(), exitcodes.Init)
+		}
+	}
+	return nil
+}
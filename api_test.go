@@ -0,0 +1,280 @@
+package gocryptfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// TestMountErrors checks that Mount() returns errors instead of exiting.
+// Successful mounts are tested in tests/.
+func TestMountErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cDir := dir + "/cipher"
+	pDir := dir + "/plain"
+	for _, d := range []string{cDir, pDir} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = configfile.Create(cDir+"/"+configfile.ConfDefaultName, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tenants are not supported
+	tDir := dir + "/tenants"
+	if err := os.Mkdir(tDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	tConf := tDir + "/" + configfile.ConfDefaultName
+	err = configfile.Create(tConf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := configfile.Load(tConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.AddTenant("alice", "alice", make([]byte, 32), []byte("alice"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	pw := StaticPassword
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	errProvider := errors.New("no password for you")
+	testCases := []struct {
+		name string
+		ctx  context.Context
+		opts Options
+	}{
+		{"no mountpoint", context.Background(), Options{CipherDir: cDir, Password: pw("test")}},
+		{"no password", context.Background(), Options{CipherDir: cDir, MountPoint: pDir}},
+		{"missing cipherdir", context.Background(), Options{CipherDir: dir + "/nonexistent", MountPoint: pDir, Password: pw("test")}},
+		{"no config", context.Background(), Options{CipherDir: pDir, MountPoint: pDir, Password: pw("test")}},
+		{"wrong password", context.Background(), Options{CipherDir: cDir, MountPoint: pDir, Password: pw("wrong")}},
+		{"provider error", context.Background(), Options{CipherDir: cDir, MountPoint: pDir,
+			Password: PasswordFunc(func(ctx context.Context, attempt int) ([]byte, error) { return nil, errProvider })}},
+		{"canceled", canceled, Options{CipherDir: cDir, MountPoint: pDir, Password: pw("test")}},
+		{"reverse without AES-SIV", context.Background(), Options{CipherDir: cDir, MountPoint: pDir, Password: pw("test"),
+			ConfigFile: cDir + "/" + configfile.ConfDefaultName, Reverse: true}},
+		{"tenants", context.Background(), Options{CipherDir: tDir, MountPoint: pDir, Password: pw("test")}},
+		{"reverse with IdleTimeout", context.Background(), Options{CipherDir: cDir, MountPoint: pDir, Password: pw("test"),
+			Reverse: true, IdleTimeout: time.Minute}},
+	}
+	for _, tc := range testCases {
+		f, err := Mount(tc.ctx, tc.opts)
+		if err == nil {
+			f.Unmount()
+			t.Errorf("%s: Mount should have failed", tc.name)
+		}
+	}
+}
+
+// TestPasswordAttempts checks that the provider is asked again after a wrong
+// password
+func TestPasswordAttempts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := dir + "/" + configfile.ConfDefaultName
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := configfile.Load(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attempts []int
+	p := PasswordFunc(func(ctx context.Context, attempt int) ([]byte, error) {
+		attempts = append(attempts, attempt)
+		if attempt < 3 {
+			return []byte("wrong"), nil
+		}
+		return []byte("test"), nil
+	})
+	if _, err := decryptWithProvider(context.Background(), cf, p, 2); err == nil {
+		t.Error("two attempts should not be enough")
+	}
+	attempts = nil
+	if _, err := decryptWithProvider(context.Background(), cf, p, 3); err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 3 || attempts[0] != 1 || attempts[2] != 3 {
+		t.Errorf("wrong attempts: %v", attempts)
+	}
+}
+
+func TestSleepOrDone(t *testing.T) {
+	if !sleepOrDone(time.Millisecond, nil) {
+		t.Error("nil channel should never be done")
+	}
+	done := make(chan struct{})
+	close(done)
+	if sleepOrDone(time.Hour, done) {
+		t.Error("closed channel should abort the sleep")
+	}
+}
+
+// TestAPIDirPolicies checks that Mount() sets up directory policies like
+// the gocryptfs command does
+func TestAPIDirPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := dir + "/" + configfile.ConfDefaultName
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := configfile.Load(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.SetFeatureFlag(configfile.FlagDirPolicy)
+	rootNode, wipeKeys, err := newAPIRootNode(dir, Options{}, cf, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wipeKeys()
+	if !rootNode.(*fusefrontend.RootNode).DirPoliciesEnabled() {
+		t.Error("directory policies are not enabled")
+	}
+	if _, _, err := newAPIRootNode(dir, Options{SharedStorage: true}, cf, make([]byte, 32)); err == nil {
+		t.Error("SharedStorage should have been refused")
+	}
+}
+
+// TestAPILoggers checks that Debug and Quiet only apply to the filesystem
+// they were passed for
+func TestAPILoggers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := dir + "/" + configfile.ConfDefaultName
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := configfile.Load(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	oldOut := tlog.Info.Logger.Writer()
+	oldEnabled := tlog.Info.Enabled
+	tlog.Info.Logger.SetOutput(&buf)
+	tlog.Info.Enabled = false
+	defer func() {
+		tlog.Info.Logger.SetOutput(oldOut)
+		tlog.Info.Enabled = oldEnabled
+	}()
+	for _, quiet := range []bool{false, true} {
+		rootNode, wipeKeys, err := newAPIRootNode(dir, Options{Quiet: quiet}, cf, make([]byte, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rn := rootNode.(*fusefrontend.RootNode)
+		if err := rn.Freeze(); err != nil {
+			t.Fatal(err)
+		}
+		rn.Thaw()
+		wipeKeys()
+		if logged := buf.Len() > 0; logged == quiet {
+			t.Errorf("Quiet=%v: wrong output %q", quiet, buf.String())
+		}
+		buf.Reset()
+	}
+}
+
+func TestInitFilesystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Forward mode
+	cDir := dir + "/cipher"
+	if err := os.Mkdir(cDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	err = InitFilesystem(cDir, WithPassword(StaticPassword("test")), WithScryptN(10), WithAESSIV())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := configfile.Load(cDir + "/" + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.DecryptMasterKey([]byte("test")); err != nil {
+		t.Error(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagAESSIV) || cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		t.Errorf("wrong feature flags: %v", cf.FeatureFlags)
+	}
+	if _, err := os.Stat(cDir + "/gocryptfs.diriv"); err != nil {
+		t.Error(err)
+	}
+	// Reverse mode, the directory does not have to be empty
+	err = InitFilesystem(cDir, WithPassword(StaticPassword("test")), WithScryptN(10), WithReverse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err = configfile.Load(cDir + "/" + configfile.ConfReverseName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		t.Error("reverse mode should imply AES-SIV")
+	}
+	// Errors
+	empty := dir + "/empty"
+	if err := os.Mkdir(empty, 0700); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name string
+		dir  string
+		opts []Option
+		code int
+	}{
+		{"no password", empty, nil, exitcodes.Usage},
+		{"password and FIDO2", empty, []Option{WithPassword(StaticPassword("test")), WithFIDO2("/dev/null")}, exitcodes.Usage},
+		{"scryptn too low", empty, []Option{WithPassword(StaticPassword("test")), WithScryptN(5)}, exitcodes.Usage},
+		{"not empty", cDir, []Option{WithPassword(StaticPassword("test")), WithScryptN(10)}, exitcodes.CipherDir},
+		{"reverse config exists", cDir, []Option{WithPassword(StaticPassword("test")), WithScryptN(10), WithReverse()}, exitcodes.Init},
+		{"empty password", empty, []Option{WithPassword(StaticPassword("")), WithScryptN(10)}, exitcodes.PasswordEmpty},
+	}
+	for _, tc := range testCases {
+		err := InitFilesystem(tc.dir, tc.opts...)
+		e, ok := err.(exitcodes.Err)
+		if !ok || e.Code() != tc.code {
+			t.Errorf("%s: want exit code %d, have %v", tc.name, tc.code, err)
+		}
+	}
+	if entries, _ := ioutil.ReadDir(empty); len(entries) != 0 {
+		t.Error("failed InitFilesystem calls should not create files")
+	}
+}
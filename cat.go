@@ -0,0 +1,51 @@
+package gocryptfs
+
+import (
+	"io"
+	"os"
+
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// catFile decrypts the file "-cat PATH" of CIPHERDIR to stdout without
+// mounting the filesystem.
+// This is called when you pass "-cat".
+func catFile(args *argContainer, password string) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-cat is not supported in reverse mode")
+		return exitcodes.Usage
+	}
+	keys := openKeys(args, password)
+	defer keys.Wipe()
+	f, err := keys.OpenFile(args.cipherdir, args.cat)
+	if err != nil {
+		tlog.Fatal.Printf("-cat: %v", err)
+		return exitcodes.Other
+	}
+	defer f.Close()
+	if _, err = io.Copy(os.Stdout, f); err != nil {
+		tlog.Fatal.Printf("-cat: %s: %v", args.cat, err)
+		return exitcodes.Other
+	}
+	return 0
+}
+
+// putFile encrypts stdin into the new file "-put PATH" of CIPHERDIR without
+// mounting the filesystem. The parent directory must already exist.
+// This is called when you pass "-put".
+func putFile(args *argContainer, password string) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-put is not supported in reverse mode")
+		return exitcodes.Usage
+	}
+	keys := openKeys(args, password)
+	defer keys.Wipe()
+	// Like a file created through a mount, the permissions are subject to
+	// the umask
+	if err := keys.WriteFile(args.cipherdir, args.put, os.Stdin, 0666); err != nil {
+		tlog.Fatal.Printf("-put: %v", err)
+		return exitcodes.Other
+	}
+	return 0
+}
@@ -10,47 +10,150 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/HorizonLiu/gocryptfs/internal/audit"
 	"github.com/HorizonLiu/gocryptfs/internal/configfile"
 	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/idmap"
+	"github.com/HorizonLiu/gocryptfs/internal/journal"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/opstats"
+	"github.com/HorizonLiu/gocryptfs/internal/quota"
 	"github.com/HorizonLiu/gocryptfs/internal/stupidgcm"
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+	"github.com/HorizonLiu/gocryptfs/internal/verifylog"
 )
 
+// maxReadahead limits "-readahead" to 16 MiB of plaintext per open file
+const maxReadahead = 4096
+
 // argContainer stores the parsed CLI options and arguments
 type argContainer struct {
 	debug, init, zerokey, fusedebug, openssl, passwd, fg, version,
 	plaintextnames, quiet, nosyslog, wpanic,
 	longnames, allow_other, reverse, aessiv, nonempty, raw64,
-	noprealloc, speed, hkdf, serialize_reads, forcedecode, hh, info,
-	sharedstorage, devrandom, fsck bool
+	noprealloc, speed, hkdf, serialize_reads, forcedecode, hh, info, jsonOutput, dryRun, diff,
+	sharedstorage, devrandom, fsck, repair, idlelock, ignorefiles, one_file_system, verify,
+	exportTar, importTar, du, coalesceWrites, sftpServer, networkStorage, duressPasswd, supervise, dbusService, pamHelper, extpassCleanEnv,
+	watchCipherdir, syncdir, metadata, journal bool
 	// GoCryptAPI options with opposites
 	dev, nodev, suid, nosuid, exec, noexec, rw, ro, kernel_cache, acl bool
 	masterkey, mountpoint, cipherdir, cpuprofile,
-	memprofile, ko, ctlsock, fsname, force_owner, trace, fido2 string
+	memprofile, ko, ctlsock, fsname, volname, force_owner, force_perms, idmap, xattrPolicy, trace, fido2,
+	snapshot, snapshotName, statfs, onSuspend, subdir, ctlsockTokenFile, ctlhttp, ctlhttpCert, ctlhttpKey, debugAddr,
+	verifyJSON, freezeDir, preset, diffPassfile, logFormat, logRedact, auditLog, reloadFile, passwordFrom,
+	verifyMount, metadataNotes, csiEndpoint, csiRoot, csiNodeID,
+	cat, put, serveWebdav, webdavAuth, webdavCert, webdavKey, serve9p, addTenant, removeTenant string
 	// -extpass, -badname, -passfile can be passed multiple times
 	extpass, badname, passfile multipleStrings
+	// -union and -union-passfile can be passed multiple times
+	union, unionPassfile multipleStrings
+	// -ctlsock-allow-uid can be passed multiple times
+	ctlsockAllowUID multipleStrings
+	// -passthrough-dir and -plaintextnames-dir can be passed multiple times
+	passthroughDir, plaintextnamesDir multipleStrings
+	// -tenant can be passed multiple times
+	tenant multipleStrings
+	// -quota can be passed multiple times
+	quota multipleStrings
+	// -idle-ignore can be passed multiple times
+	idleIgnore multipleStrings
+	// "-quota-state"
+	quotaState string
 	// For reverse mode, several ways to specify exclusions. All can be specified multiple times.
-	exclude, excludeWildcard, excludeFrom multipleStrings
+	exclude, excludeWildcard, excludeFrom    multipleStrings
+	include, includeFrom, filter, filterFrom multipleStrings
 	// Configuration file name override
-	config             string
-	notifypid, scryptn int
+	config                                                               string
+	notifypid, scryptn, verifyWorkers, cryptoWorkers, readahead, fdCache int
+	// "-parentpid"
+	parentpid int
+	// "-fsck-workers", "-fsck-checkpoint"
+	fsckWorkers    int
+	fsckCheckpoint string
+	// Named set of options from profiles.toml
+	profile string
+	// Protocol version of the -extpass program
+	extpassProtocol int
+	// File descriptor to read the master key from, or -1
+	masterkeyFd int
+	// Time the -extpass program gets to answer
+	extpassTimeout time.Duration
+	// Maximum failed unlock attempts before "-unlock-lockout" applies
+	unlockLimit int
+	// Longest plaintext file name in bytes, "-name-max"
+	nameMax int
+	// "-max-read-iops", "-max-write-iops"
+	maxReadIOPS, maxWriteIOPS int
+	// "-max-read-mbps", "-max-write-mbps"
+	maxReadMBps, maxWriteMBps float64
 	// Idle time before autounmount
 	idle time.Duration
+	// Lockout after "-unlock-limit" failed unlock attempts
+	unlockLockout time.Duration
+	// How often "-sharedstorage" checks the open files for changes of
+	// other mounts
+	sharedstoragePoll time.Duration
 	// Helper variables that are NOT cli options all start with an underscore
 	// _configCustom is true when the user sets a custom config file name.
 	_configCustom bool
+	// _audit is the opened "-audit-log"
+	_audit *audit.Log
+	// _verifyLog is the opened "-verify-mount" report
+	_verifyLog *verifylog.Log
+	// _journal is the opened "-journal"
+	_journal *journal.Journal
 	// _ctlsockFd stores the control socket file descriptor (ctlsock stores the path)
 	_ctlsockFd net.Listener
+	// _ctlhttpListener is the TCP listener for "-ctlhttp"
+	_ctlhttpListener net.Listener
+	// _debugListener is the TCP listener for "-debug-addr"
+	_debugListener net.Listener
 	// _forceOwner is, if non-nil, a parsed, validated Owner (as opposed to the string above)
 	_forceOwner *fuse.Owner
+	// _forcePerms is the parsed "-force_perms"
+	_forcePerms *fusefrontend.ForcePerms
+	// _idMap is the loaded "-idmap" file
+	_idMap *idmap.Map
+	// _quota holds the parsed "-quota" trees
+	_quota *quota.Quota
+	// _xattrPolicies is the parsed "-xattr-policy"
+	_xattrPolicies fusefrontend.XattrPolicies
 	// _explicitScryptn is true then the user passed "-scryptn=xyz"
 	_explicitScryptn bool
+	// _passedFlags lists the options passed on the command line, reported
+	// through the control socket
+	_passedFlags []string
+	// _reloader applies "-reload-file" on SIGHUP
+	_reloader *reloader
+	// _supervisor mounts again after a lost connection, "-supervise"
+	_supervisor *supervisor
+	// _opStats collects FUSE operation counters for the control socket
+	_opStats *opstats.Stats
+	// _ctlsockUIDs is the parsed "-ctlsock-allow-uid" list
+	_ctlsockUIDs []uint32
+	// _ctlsockToken is the token read from "-ctlsock-token-file"
+	_ctlsockToken string
+	// _passwordProvider supplies the password if gocryptfs is used through
+	// GoCryptAPIWithProvider()
+	_passwordProvider PasswordProvider
+	// _passwordFrom is the parsed "-password-from" source. It is used when
+	// there is no _passwordProvider.
+	_passwordFrom PasswordProvider
+	// _argv is the command line after "-o" processing. It is kept here instead
+	// of in os.Args so GoCryptAPI() can be called several times in one process.
+	_argv []string
+	// _flagSet holds the parsed flags and the positional arguments
+	_flagSet *flag.FlagSet
 }
 
 type multipleStrings []string
@@ -70,8 +173,6 @@ func (s *multipleStrings) Empty() bool {
 	return len(s2) == 0
 }
 
-var flagSet *flag.FlagSet
-
 // prefixOArgs transform options passed via "-o foo,bar" into regular options
 // like "-foo -bar" and prefixes them to the command line.
 // Testcases in TestPrefixOArgs().
@@ -107,65 +208,93 @@ func prefixOArgs(osArgs []string) ([]string, error) {
 	// Start with program name
 	newArgs := []string{osArgs[0]}
 	// Add options from "-o"
+	newArgs = append(newArgs, oOptsToArgs(oOpts, "-o")...)
+	// Add other arguments
+	newArgs = append(newArgs, otherArgs...)
+	return newArgs, nil
+}
+
+// oOptsToArgs turns options like "foo" and "bar=1" into "-foo" and "-bar=1".
+// "source" names where they come from in the error message.
+func oOptsToArgs(oOpts []string, source string) (args []string) {
 	for _, o := range oOpts {
 		if o == "" {
 			continue
 		}
 		if o == "o" || o == "-o" {
-			tlog.Fatal.Printf("You can't pass \"-o\" to \"-o\"")
+			tlog.Fatal.Printf("You can't pass \"-o\" to %s", source)
 			os.Exit(exitcodes.Usage)
 		}
-		newArgs = append(newArgs, "-"+o)
+		args = append(args, "-"+o)
 	}
-	// Add other arguments
-	newArgs = append(newArgs, otherArgs...)
-	return newArgs, nil
+	return args
+}
+
+// profileOpts returns the options of the profile selected by "-profile" in
+// "args" as flags
+func profileOpts(args []string) ([]string, error) {
+	name, err := findProfile(args)
+	if err != nil || name == "" {
+		return nil, err
+	}
+	path, err := profilesPath()
+	if err != nil {
+		return nil, err
+	}
+	return loadProfile(path, name)
+}
+
+// envOptsName is the environment variable that holds default options, in
+// the format of "-o"
+const envOptsName = "GOCRYPTFS_OPTS"
+
+// envOpts returns the options from GOCRYPTFS_OPTS as flags. They go before
+// those of the command line, which win where both set the same flag.
+func envOpts() []string {
+	return oOptsToArgs(strings.Split(os.Getenv(envOptsName), ","), envOptsName)
 }
 
 // 开放gocryptfs API，使之可以利用其进行二次开发
 func parseCliOptsDiy(cliOpts []string) (args argContainer) {
-	var err error
-	// 覆盖命令行请求参数，方便后续操作
-	os.Args, err = prefixOArgs(cliOpts)
+	argv, err := prefixOArgs(cliOpts)
 	if err != nil {
 		tlog.Fatal.Println(err)
 		os.Exit(exitcodes.Usage)
 	}
-	return parseCliOptsBase()
+	return parseCliOptsBase(argv)
 }
 
 // 默认从命令行请求参数中读取
 func parseCliOpts() (args argContainer) {
-	var err error
-	os.Args, err = prefixOArgs(os.Args)
-	if err != nil {
-		tlog.Fatal.Println(err)
-		os.Exit(exitcodes.Usage)
-	}
-	return parseCliOptsBase()
+	return parseCliOptsDiy(os.Args)
 }
 
 // parseCliOpts - parse command line options (i.e. arguments that start with "-")
-func parseCliOptsBase() (args argContainer) {
+// from "argv". argv[0] is the program name.
+func parseCliOptsBase(argv []string) (args argContainer) {
 	var err error
 	var opensslAuto string
 
-	//os.Args, err = prefixOArgs(os.Args)
-	//if err != nil {
-	//	tlog.Fatal.Println(err)
-	//	os.Exit(exitcodes.Usage)
-	//}
-
-	flagSet = flag.NewFlagSet(tlog.ProgramName, flag.ContinueOnError)
+	args._argv = argv
+	flagSet := flag.NewFlagSet(tlog.ProgramName, flag.ContinueOnError)
+	args._flagSet = flagSet
 	flagSet.Usage = func() {}
 	flagSet.BoolVar(&args.debug, "d", false, "")
 	flagSet.BoolVar(&args.debug, "debug", false, "Enable debug output")
 	flagSet.BoolVar(&args.fusedebug, "fusedebug", false, "Enable fuse library debug output")
 	flagSet.BoolVar(&args.init, "init", false, "Initialize encrypted directory")
+	flagSet.BoolVar(&args.dryRun, "dry-run", false, "With -init: print what would be created, without writing anything")
+	flagSet.StringVar(&args.preset, "preset", "", "With -init: paranoid, balanced or fast. Sets -scryptn, -aessiv, -plaintextnames and -devrandom.")
+	flagSet.Var(&args.passthroughDir, "passthrough-dir", "With -init: create this directory with names and contents stored unencrypted. Can be passed multiple times")
+	flagSet.Var(&args.plaintextnamesDir, "plaintextnames-dir", "With -init: create this directory with names stored unencrypted. Can be passed multiple times")
 	flagSet.BoolVar(&args.zerokey, "zerokey", false, "Use all-zero dummy master key")
 	// Tri-state true/false/auto
 	flagSet.StringVar(&opensslAuto, "openssl", "auto", "Use OpenSSL instead of built-in Go crypto")
 	flagSet.BoolVar(&args.passwd, "passwd", false, "Change password")
+	flagSet.BoolVar(&args.duressPasswd, "duress-passwd", false, "Set a password that destroys the master key when it is used")
+	flagSet.StringVar(&args.addTenant, "add-tenant", "", "Create a top-level directory with a master key and password of its own")
+	flagSet.StringVar(&args.removeTenant, "remove-tenant", "", "Delete the key of a tenant directory. Its files cannot be decrypted any more")
+	flagSet.Var(&args.tenant, "tenant", "Unlock the directory of this tenant with its password instead of the whole filesystem. Can be passed multiple times")
 	flagSet.BoolVar(&args.fg, "f", false, "")
 	flagSet.BoolVar(&args.fg, "fg", false, "Stay in the foreground")
 	flagSet.BoolVar(&args.version, "version", false, "Print version and exit")
@@ -173,6 +302,10 @@ func parseCliOptsBase() (args argContainer) {
 	flagSet.BoolVar(&args.quiet, "q", false, "")
 	flagSet.BoolVar(&args.quiet, "quiet", false, "Quiet - silence informational messages")
 	flagSet.BoolVar(&args.nosyslog, "nosyslog", false, "Do not redirect output to syslog when running in the background")
+	flagSet.StringVar(&args.logFormat, "log-format", "text", "Log format: text or json")
+	flagSet.StringVar(&args.logRedact, "log-redact", "off", "Replace file names in log messages by hashes: off, paths or full")
+	flagSet.StringVar(&args.auditLog, "audit-log", "", "Append a record of every file access to this file, or \"syslog\"")
+	flagSet.StringVar(&args.verifyMount, "verify-mount", "", "Mount read-only and write every corrupt block that is read to this file")
 	flagSet.BoolVar(&args.wpanic, "wpanic", false, "When encountering a warning, panic and exit immediately")
 	flagSet.BoolVar(&args.longnames, "longnames", true, "Store names longer than 176 bytes in extra files")
 	flagSet.BoolVar(&args.allow_other, "allow_other", false, "Allow other users to access the filesystem. "+
@@ -185,13 +318,39 @@ func parseCliOptsBase() (args argContainer) {
 	flagSet.BoolVar(&args.speed, "speed", false, "Run crypto speed test")
 	flagSet.BoolVar(&args.hkdf, "hkdf", true, "Use HKDF as an additional key derivation step")
 	flagSet.BoolVar(&args.serialize_reads, "serialize_reads", false, "Try to serialize read operations")
-	flagSet.BoolVar(&args.forcedecode, "forcedecode", false, "Force decode of files even if integrity check fails."+
-		" Requires gocryptfs to be compiled with openssl support and implies -openssl true")
+	flagSet.IntVar(&args.fdCache, "fd-cache", 0, "Keep up to this many backing files open after they have been closed")
+	flagSet.BoolVar(&args.coalesceWrites, "coalesce-writes", false, "Buffer small appends in memory until a block is full")
+	flagSet.IntVar(&args.readahead, "readahead", 0, "Prefetch and decrypt this many blocks after sequential reads")
+	flagSet.StringVar(&args.profile, "profile", "", "Apply the options of this profile from ~/.config/gocryptfs/profiles.toml")
+	flagSet.StringVar(&args.reloadFile, "reload-file", "", "Read options that can change while mounted from this file, again on SIGHUP")
+	flagSet.Float64Var(&args.maxReadMBps, "max-read-mbps", 0, "Limit reads to this many megabytes per second. 0 means unlimited")
+	flagSet.Float64Var(&args.maxWriteMBps, "max-write-mbps", 0, "Limit writes to this many megabytes per second. 0 means unlimited")
+	flagSet.IntVar(&args.maxReadIOPS, "max-read-iops", 0, "Limit read operations per second. 0 means unlimited")
+	flagSet.IntVar(&args.maxWriteIOPS, "max-write-iops", 0, "Limit write operations per second. 0 means unlimited")
+	flagSet.BoolVar(&args.forcedecode, "forcedecode", false, "Force decode of files even if integrity check fails")
 	flagSet.BoolVar(&args.hh, "hh", false, "Show this long help text")
 	flagSet.BoolVar(&args.info, "info", false, "Display information about CIPHERDIR")
+	flagSet.BoolVar(&args.jsonOutput, "json", false, "With -info: print JSON")
 	flagSet.BoolVar(&args.sharedstorage, "sharedstorage", false, "Make concurrent access to a shared CIPHERDIR safer")
+	flagSet.BoolVar(&args.networkStorage, "network-storage", false, "Cache metadata and retry I/O errors for a CIPHERDIR on SMB, NFS or rclone")
+	flagSet.BoolVar(&args.supervise, "supervise", false, "Mount again if the FUSE connection is lost or a request panics")
 	flagSet.BoolVar(&args.devrandom, "devrandom", false, "Use /dev/random for generating master key")
 	flagSet.BoolVar(&args.fsck, "fsck", false, "Run a filesystem check on CIPHERDIR")
+	flagSet.BoolVar(&args.repair, "repair", false, "With -fsck: replace missing gocryptfs.diriv files and clean up orphaned longname files")
+	flagSet.IntVar(&args.fsckWorkers, "fsck-workers", 0, "Number of files -fsck checks in parallel. Default: number of CPUs")
+	flagSet.StringVar(&args.fsckCheckpoint, "fsck-checkpoint", "", "Save the -fsck state to FILE and resume from it")
+	flagSet.BoolVar(&args.verify, "verify", false, "Authenticate every block of every file in CIPHERDIR without mounting")
+	flagSet.BoolVar(&args.exportTar, "export-tar", false, "Write CIPHERDIR (or the encrypted view with -reverse) as a tar stream to stdout")
+	flagSet.BoolVar(&args.importTar, "import-tar", false, "Extract a tar stream from stdin into the empty directory CIPHERDIR")
+	flagSet.BoolVar(&args.diff, "diff", false, "Compare the decrypted trees of two CIPHERDIRs without mounting")
+	flagSet.StringVar(&args.diffPassfile, "diff-passfile", "", "With -diff: read the password of the second CIPHERDIR from FILE")
+	flagSet.BoolVar(&args.du, "du", false, "Report plaintext and ciphertext sizes of the directories in CIPHERDIR")
+	flagSet.BoolVar(&args.sftpServer, "sftp-server", false, "Speak SFTP for the decrypted view of CIPHERDIR on stdin/stdout (sshd subsystem)")
+	flagSet.BoolVar(&args.dbusService, "dbus-service", false, "Offer Mount, Unmount, List and Status on the D-Bus session bus")
+	flagSet.StringVar(&args.csiEndpoint, "csi-endpoint", "", "Run as Kubernetes CSI node plugin on this endpoint (unix://PATH)")
+	flagSet.StringVar(&args.csiRoot, "csi-root", "", "Directory for the CIPHERDIRs of the CSI volumes")
+	flagSet.StringVar(&args.csiNodeID, "csi-node-id", "", "CSI node ID, defaults to the host name")
+	flagSet.BoolVar(&args.pamHelper, "pam-helper", false, "Mount at login and unmount at the last logout, run by pam_exec")
 
 	// GoCryptAPI options with opposites
 	flagSet.BoolVar(&args.dev, "dev", false, "Allow device files")
@@ -206,57 +365,142 @@ func parseCliOptsBase() (args argContainer) {
 	flagSet.BoolVar(&args.acl, "acl", false, "Enforce ACLs")
 
 	flagSet.StringVar(&args.masterkey, "masterkey", "", "GoCryptAPI with explicit master key")
+	flagSet.IntVar(&args.masterkeyFd, "masterkey-fd", -1, "Read the master key from this file descriptor")
 	flagSet.StringVar(&args.cpuprofile, "cpuprofile", "", "Write cpu profile to specified file")
+	flagSet.StringVar(&args.debugAddr, "debug-addr", "", "Serve expvar and pprof on this loopback address, like 127.0.0.1:6060")
 	flagSet.StringVar(&args.memprofile, "memprofile", "", "Write memory profile to specified file")
 	flagSet.StringVar(&args.config, "config", "", "Use specified config file instead of CIPHERDIR/gocryptfs.conf")
 	flagSet.StringVar(&args.ko, "ko", "", "Pass additional options directly to the kernel, comma-separated list")
 	flagSet.StringVar(&args.ctlsock, "ctlsock", "", "Create control socket at specified path")
+	flagSet.StringVar(&args.ctlhttp, "ctlhttp", "", "Serve the control API over HTTP on this address (requires -ctlsock-token-file)")
+	flagSet.StringVar(&args.ctlhttpCert, "ctlhttp-cert", "", "TLS certificate file for -ctlhttp")
+	flagSet.StringVar(&args.ctlhttpKey, "ctlhttp-key", "", "TLS private key file for -ctlhttp")
+	flagSet.StringVar(&args.ctlsockTokenFile, "ctlsock-token-file", "", "Require the token stored in this file on every control socket request")
+	flagSet.Var(&args.ctlsockAllowUID, "ctlsock-allow-uid", "Only allow this user id to connect to the control socket. Can be passed multiple times")
 	flagSet.StringVar(&args.fsname, "fsname", "", "Override the filesystem name")
+	flagSet.StringVar(&args.volname, "volname", "", "Override the volume name shown by the MacOS Finder")
 	flagSet.StringVar(&args.force_owner, "force_owner", "", "uid:gid pair to coerce ownership")
+	flagSet.StringVar(&args.force_perms, "force_perms", "", "Octal FILEMODE:DIRMODE pair, like 0644:0755, to coerce permissions")
+	flagSet.StringVar(&args.xattrPolicy, "xattr-policy", "", "How to store the security.* and trusted.* xattrs, "+
+		"like \"security=passthrough,trusted=deny\". Policies: encrypt, passthrough, deny")
+	flagSet.StringVar(&args.idmap, "idmap", "", "File that maps the uids and gids in CIPHERDIR to the ones shown in the mount")
+	flagSet.Var(&args.quota, "quota", "Limit the plaintext bytes below a directory, like home/alice=10G. Can be passed multiple times")
+	flagSet.StringVar(&args.quotaState, "quota-state", "", "Keep the -quota usage in FILE, so that it is not counted on every mount")
+	flagSet.BoolVar(&args.watchCipherdir, "watch-cipherdir", false, "Show changes made directly in CIPHERDIR or through other mounts right away")
+	flagSet.BoolVar(&args.journal, "journal", false, "Record operations on long names and directories in CIPHERDIR/gocryptfs.journal, to clean up after a crash")
+	flagSet.BoolVar(&args.syncdir, "syncdir", false, "Fsync the encrypted directory after create, rename, unlink and similar operations")
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
 	flagSet.StringVar(&args.fido2, "fido2", "", "Protect the masterkey using a FIDO2 token instead of a password")
+	flagSet.StringVar(&args.snapshot, "snapshot", "", "Snapshot action: create, list or mount")
+	flagSet.StringVar(&args.snapshotName, "snapshot-name", "", "Name of the snapshot to create or mount")
+	flagSet.IntVar(&args.cryptoWorkers, "crypto-workers", 0, "Number of goroutines that encrypt and decrypt large requests. Default: number of CPUs")
+	flagSet.IntVar(&args.verifyWorkers, "verify-workers", 0, "Number of files -verify checks in parallel. Default: number of CPUs")
+	flagSet.StringVar(&args.verifyJSON, "verify-json", "", "Write the -verify report as JSON to FILE (\"-\" for stdout)")
+	flagSet.StringVar(&args.cat, "cat", "", "Decrypt the file at this plaintext path in CIPHERDIR to stdout")
+	flagSet.StringVar(&args.put, "put", "", "Encrypt stdin into a new file at this plaintext path in CIPHERDIR")
+	flagSet.StringVar(&args.serveWebdav, "serve-webdav", "", "Serve the decrypted view of CIPHERDIR over WebDAV on this address, without mounting")
+	flagSet.StringVar(&args.webdavAuth, "webdav-auth", "", "File containing \"user:password\" for HTTP basic authentication of -serve-webdav")
+	flagSet.StringVar(&args.webdavCert, "webdav-cert", "", "TLS certificate file for -serve-webdav")
+	flagSet.StringVar(&args.webdavKey, "webdav-key", "", "TLS private key file for -serve-webdav")
+	flagSet.StringVar(&args.serve9p, "serve-9p", "", "Serve the decrypted view of CIPHERDIR over 9P2000.L on this loopback address or unix:PATH, without mounting")
+	flagSet.StringVar(&args.subdir, "subdir", "", "Only mount the specified plaintext subdirectory of CIPHERDIR")
+	flagSet.StringVar(&args.statfs, "statfs", "plain", "Report free space in plaintext terms (plain) or as-is from CIPHERDIR (raw)")
 
 	// Exclusion options
 	flagSet.Var(&args.exclude, "e", "Alias for -exclude")
-	flagSet.Var(&args.exclude, "exclude", "Exclude relative path from reverse view")
+	flagSet.Var(&args.exclude, "exclude", "Exclude relative path from the view")
 	flagSet.Var(&args.excludeWildcard, "ew", "Alias for -exclude-wildcard")
-	flagSet.Var(&args.excludeWildcard, "exclude-wildcard", "Exclude path from reverse view, supporting wildcards")
+	flagSet.Var(&args.excludeWildcard, "exclude-wildcard", "Exclude path from the view, supporting wildcards")
 	flagSet.Var(&args.excludeFrom, "exclude-from", "File from which to read exclusion patterns (with -exclude-wildcard syntax)")
+	flagSet.Var(&args.include, "include", "Include relative path in the view even if it is excluded")
+	flagSet.Var(&args.includeFrom, "include-from", "File from which to read inclusion patterns (with -exclude-wildcard syntax)")
+	flagSet.Var(&args.filter, "filter", "rsync-style filter rule for the view (\"+ PATTERN\" or \"- PATTERN\"), first match wins")
+	flagSet.Var(&args.filterFrom, "filter-from", "File from which to read rsync-style filter rules")
+	flagSet.BoolVar(&args.ignorefiles, "ignorefiles", false, "Exclude paths listed in .gocryptfsignore files from reverse view")
+	flagSet.BoolVar(&args.one_file_system, "one-file-system", false, "Do not descend into other filesystems in reverse view")
+	flagSet.StringVar(&args.freezeDir, "freeze-dir", "", "Directory for the reflinked copies that keep a frozen reverse view stable")
 
 	// multipleStrings options ([]string)
 	flagSet.Var(&args.extpass, "extpass", "Use external program for the password prompt")
+	flagSet.IntVar(&args.extpassProtocol, "extpass-protocol", 1, "Protocol spoken with the -extpass program: 1 (plain) or 2 (JSON)")
+	flagSet.DurationVar(&args.extpassTimeout, "extpass-timeout", 0, "Kill the -extpass program if it does not answer within this time")
+	flagSet.BoolVar(&args.extpassCleanEnv, "extpass-clean-env", false, "Run the -extpass program with a minimal environment")
 	flagSet.Var(&args.badname, "badname", "Glob pattern invalid file names that should be shown")
 	flagSet.Var(&args.passfile, "passfile", "Read password from file")
+	flagSet.StringVar(&args.passwordFrom, "password-from", "", "Read password from a built-in source: secret-service:ATTRIBUTE=VALUE,...")
+	flagSet.Var(&args.union, "union", "Merge additional CIPHERDIR into the mount (read-only, lower precedence)")
+	flagSet.Var(&args.unionPassfile, "union-passfile", "Read the password of the next -union CIPHERDIR from file")
 
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
+	flagSet.IntVar(&args.parentpid, "parentpid", 0, "Unmount and wipe the keys when the specified process exits")
 	const scryptn = "scryptn"
 	flagSet.IntVar(&args.scryptn, scryptn, configfile.ScryptDefaultLogN, "scrypt cost parameter logN. Possible values: 10-28. "+
 		"A lower value speeds up mounting and reduces its memory needs, but makes the password susceptible to brute-force attacks")
 
+	flagSet.IntVar(&args.unlockLimit, "unlock-limit", 0, "With -init: delay unlock attempts exponentially after a failed one, "+
+		"and refuse them for -unlock-lockout after this many failures")
+	flagSet.DurationVar(&args.unlockLockout, "unlock-lockout", 15*time.Minute, "With -init and -unlock-limit: how long unlocking is refused")
+	flagSet.BoolVar(&args.metadata, "metadata", false, "With -init: store the creation time and host name encrypted in the config file")
+	flagSet.StringVar(&args.metadataNotes, "metadata-notes", "", "With -init: store this text encrypted in the config file. Implies -metadata")
+	flagSet.IntVar(&args.nameMax, "name-max", 0, "With -init: allow file names of up to this many bytes (256-1024) instead of 255")
+	flagSet.DurationVar(&args.sharedstoragePoll, "sharedstorage-poll", 2*time.Second, "With -sharedstorage: how often open files are checked for changes of other mounts, 0 disables")
+
 	flagSet.DurationVar(&args.idle, "i", 0, "Alias for -idle")
 	flagSet.DurationVar(&args.idle, "idle", 0, "Auto-unmount after specified idle duration (ignored in reverse mode). "+
 		"Durations are specified like \"500s\" or \"2h45m\". 0 means stay mounted indefinitely.")
+	flagSet.Var(&args.idleIgnore, "idle-ignore", "Accesses of processes matching this name or executable path pattern do not count "+
+		"as activity for -idle. Can be passed multiple times")
+	flagSet.BoolVar(&args.idlelock, "idlelock", false, "When idle (see -idle), wipe the keys from memory instead of unmounting. "+
+		"Unlock again via -ctlsock.")
+	flagSet.StringVar(&args.onSuspend, "on-suspend", "", "Before the machine sleeps or the session is locked, wipe the keys (lock) "+
+		"or unmount (unmount). Needs systemd-logind.")
 
 	var nofail bool
 	flagSet.BoolVar(&nofail, "nofail", false, "Ignored for /etc/fstab compatibility")
 
 	var dummyString string
 	flagSet.StringVar(&dummyString, "o", "", "For compatibility with mount(1), options can be also passed as a comma-separated list to -o on the end.")
-	// Actual parsing
-	err = flagSet.Parse(os.Args[1:])
+	// Actual parsing. The defaults from GOCRYPTFS_OPTS and "-profile" are
+	// not part of _argv, a child started with it gets them from the
+	// environment and the profiles file again.
+	fullArgv := append([]string{argv[0]}, envOpts()...)
+	profileArgs, err := profileOpts(append(fullArgv[1:len(fullArgv):len(fullArgv)], argv[1:]...))
+	if err != nil {
+		tlog.Fatal.Printf("-profile: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	fullArgv = append(fullArgv, profileArgs...)
+	fullArgv = append(fullArgv, argv[1:]...)
+	err = flagSet.Parse(fullArgv[1:])
 	if err == flag.ErrHelp {
 		helpShort()
 		os.Exit(0)
 	}
 	if err != nil {
-		tlog.Fatal.Printf("Invalid command line: %s. Try '%s -help'.", prettyArgs(), tlog.ProgramName)
+		tlog.Fatal.Printf("Invalid command line: %s. Try '%s -help'.", prettyArgs(fullArgv), tlog.ProgramName)
 		os.Exit(exitcodes.Usage)
 	}
+	// Switch early so everything below is logged in the requested format
+	switch args.logFormat {
+	case "text":
+	case "json":
+		tlog.SwitchToJSON()
+	default:
+		tlog.Fatal.Printf("Invalid -log-format %q, must be text or json", args.logFormat)
+		os.Exit(exitcodes.Usage)
+	}
+	redact, err := tlog.ParseRedact(args.logRedact)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Usage)
+	}
+	tlog.SetRedact(redact)
 	// We want to know if -scryptn was passed explicitly
 	if isFlagPassed(flagSet, scryptn) {
 		args._explicitScryptn = true
 	}
+	args._passedFlags = passedFlags(flagSet)
 	// "-openssl" needs some post-processing
 	if opensslAuto == "auto" {
 		args.openssl = stupidgcm.PreferOpenSSL()
@@ -267,26 +511,16 @@ func parseCliOptsBase() (args argContainer) {
 			os.Exit(exitcodes.Usage)
 		}
 	}
-	// "-forcedecode" only works with openssl. Check compilation and command line parameters
+	// "-forcedecode" works with openssl and with Go's GCM, but not with AES-SIV
 	if args.forcedecode == true {
-		if stupidgcm.BuiltWithoutOpenssl == true {
-			tlog.Fatal.Printf("The -forcedecode flag requires openssl support, but gocryptfs was compiled without it!")
-			os.Exit(exitcodes.Usage)
-		}
 		if args.aessiv == true {
-			tlog.Fatal.Printf("The -forcedecode and -aessiv flags are incompatible because they use different crypto libs (openssl vs native Go)")
+			tlog.Fatal.Printf("The -forcedecode and -aessiv flags are incompatible")
 			os.Exit(exitcodes.Usage)
 		}
 		if args.reverse == true {
 			tlog.Fatal.Printf("The reverse mode and the -forcedecode option are not compatible")
 			os.Exit(exitcodes.Usage)
 		}
-		// Has the user explicitly disabled openssl using "-openssl=false/0"?
-		if !args.openssl && opensslAuto != "auto" {
-			tlog.Fatal.Printf("-forcedecode requires openssl, but is disabled via command-line option")
-			os.Exit(exitcodes.Usage)
-		}
-		args.openssl = true
 
 		// Try to make it harder for the user to shoot himself in the foot.
 		args.ro = true
@@ -297,6 +531,15 @@ func parseCliOptsBase() (args argContainer) {
 		tlog.Fatal.Printf("The options -extpass and -passfile cannot be used at the same time")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.masterkeyFd >= 0 {
+		if args.masterkey != "" {
+			tlog.Fatal.Printf("The options -masterkey and -masterkey-fd cannot be used at the same time")
+			os.Exit(exitcodes.Usage)
+		}
+		// Lets the checks for "-masterkey" below cover "-masterkey-fd",
+		// handleArgsMasterkey() looks at masterkeyFd first
+		args.masterkey = "fd"
+	}
 	if len(args.passfile) != 0 && args.masterkey != "" {
 		tlog.Fatal.Printf("The options -passfile and -masterkey cannot be used at the same time")
 		os.Exit(exitcodes.Usage)
@@ -309,16 +552,364 @@ func parseCliOptsBase() (args argContainer) {
 		tlog.Fatal.Printf("The options -extpass and -fido2 cannot be used at the same time")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.extpassProtocol != 1 && args.extpassProtocol != 2 {
+		tlog.Fatal.Printf("-extpass-protocol must be 1 or 2")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.extpassTimeout < 0 {
+		tlog.Fatal.Printf("-extpass-timeout must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.passwordFrom != "" {
+		if !args.extpass.Empty() || len(args.passfile) != 0 || args.masterkey != "" || args.fido2 != "" {
+			tlog.Fatal.Printf("-password-from cannot be combined with -extpass, -passfile, -masterkey or -fido2")
+			os.Exit(exitcodes.Usage)
+		}
+		args._passwordFrom, err = parsePasswordFrom(args.passwordFrom)
+		if err != nil {
+			tlog.Fatal.Printf("-password-from: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	if args.idle < 0 {
 		tlog.Fatal.Printf("Idle timeout cannot be less than 0")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.parentpid < 0 {
+		tlog.Fatal.Printf("-parentpid cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.parentpid > 0 && syscall.Kill(args.parentpid, 0) == syscall.ESRCH {
+		tlog.Fatal.Printf("-parentpid: process %d does not exist", args.parentpid)
+		os.Exit(exitcodes.Usage)
+	}
+	if len(args.idleIgnore) > 0 {
+		if args.idle == 0 {
+			tlog.Fatal.Printf("-idle-ignore requires -idle")
+			os.Exit(exitcodes.Usage)
+		}
+		if runtime.GOOS != "linux" {
+			tlog.Fatal.Printf("-idle-ignore is only supported on Linux")
+			os.Exit(exitcodes.Usage)
+		}
+		for _, p := range args.idleIgnore {
+			if _, err := filepath.Match(p, ""); err != nil {
+				tlog.Fatal.Printf("-idle-ignore %q: %v", p, err)
+				os.Exit(exitcodes.Usage)
+			}
+		}
+	}
+	if args.idlelock {
+		if args.idle == 0 || args.ctlsock == "" {
+			tlog.Fatal.Printf("-idlelock requires -idle and -ctlsock")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse || args.masterkey != "" || args.zerokey || args.fido2 != "" || !args.union.Empty() {
+			tlog.Fatal.Printf("-idlelock cannot be combined with -reverse, -masterkey, -zerokey, -fido2 or -union")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	switch args.onSuspend {
+	case "", "unmount":
+	case "lock":
+		if args.ctlsock == "" {
+			tlog.Fatal.Printf("-on-suspend lock requires -ctlsock")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse || args.masterkey != "" || args.zerokey || args.fido2 != "" || !args.union.Empty() {
+			tlog.Fatal.Printf("-on-suspend lock cannot be combined with -reverse, -masterkey, -zerokey, -fido2 or -union")
+			os.Exit(exitcodes.Usage)
+		}
+	default:
+		tlog.Fatal.Printf("Invalid \"-on-suspend\" setting %q. Valid settings are: lock, unmount", args.onSuspend)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.xattrPolicy != "" {
+		args._xattrPolicies, err = fusefrontend.ParseXattrPolicies(args.xattrPolicy)
+		if err != nil {
+			tlog.Fatal.Printf("-xattr-policy: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.idmap != "" && (args.force_owner != "" || args.reverse) {
+		tlog.Fatal.Printf("-idmap cannot be combined with -force_owner or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.unlockLimit < 0 {
+		tlog.Fatal.Printf("-unlock-limit must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.unlockLimit > 0 && !args.init {
+		tlog.Fatal.Printf("-unlock-limit requires -init")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.metadataNotes != "" {
+		args.metadata = true
+	}
+	if args.metadata && !args.init {
+		tlog.Fatal.Printf("-metadata and -metadata-notes require -init")
+		os.Exit(exitcodes.Usage)
+	}
+	if isFlagPassed(flagSet, "unlock-lockout") && args.unlockLimit == 0 {
+		tlog.Fatal.Printf("-unlock-lockout requires -unlock-limit")
+		os.Exit(exitcodes.Usage)
+	}
+	if isFlagPassed(flagSet, "sharedstorage-poll") && !args.sharedstorage {
+		tlog.Fatal.Printf("-sharedstorage-poll requires -sharedstorage")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.sharedstoragePoll < 0 {
+		tlog.Fatal.Printf("-sharedstorage-poll must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.unlockLimit > 0 && args.unlockLockout < time.Second {
+		tlog.Fatal.Printf("-unlock-lockout must be at least 1s")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.ctlsockTokenFile != "" && args.ctlsock == "" && args.ctlhttp == "" {
+		tlog.Fatal.Printf("-ctlsock-token-file requires -ctlsock or -ctlhttp")
+		os.Exit(exitcodes.Usage)
+	}
+	if !args.ctlsockAllowUID.Empty() {
+		// The peer uid is only known on the unix socket
+		if args.ctlsock == "" {
+			tlog.Fatal.Printf("-ctlsock-allow-uid requires -ctlsock. It does not apply to -ctlhttp.")
+			os.Exit(exitcodes.Usage)
+		}
+		for _, s := range args.ctlsockAllowUID {
+			uid, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				tlog.Fatal.Printf("Invalid \"-ctlsock-allow-uid\" setting %q: %v", s, err)
+				os.Exit(exitcodes.Usage)
+			}
+			args._ctlsockUIDs = append(args._ctlsockUIDs, uint32(uid))
+		}
+	}
+	if args.ctlhttp != "" && args.ctlsockTokenFile == "" {
+		// Anybody who can reach the port could control the filesystem
+		tlog.Fatal.Printf("-ctlhttp requires -ctlsock-token-file")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.ctlhttpCert == "") != (args.ctlhttpKey == "") {
+		tlog.Fatal.Printf("-ctlhttp-cert and -ctlhttp-key must be passed together")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.ctlhttpCert != "" && args.ctlhttp == "" {
+		tlog.Fatal.Printf("-ctlhttp-cert requires -ctlhttp")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.webdavCert == "") != (args.webdavKey == "") {
+		tlog.Fatal.Printf("-webdav-cert and -webdav-key must be passed together")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.webdavCert != "" || args.webdavAuth != "") && args.serveWebdav == "" {
+		tlog.Fatal.Printf("-webdav-cert and -webdav-auth require -serve-webdav")
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.snapshot {
+	case "", "create", "list":
+	case "mount":
+		if args.snapshotName == "" {
+			tlog.Fatal.Printf("-snapshot mount requires -snapshot-name")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Fatal.Printf("-snapshot mount is not supported in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+	default:
+		tlog.Fatal.Printf("Invalid \"-snapshot\" action %q. Valid actions are: create, list, mount", args.snapshot)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.subdir != "" && args.reverse {
+		tlog.Fatal.Printf("-subdir is not supported in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if !args.union.Empty() {
+		if args.reverse {
+			tlog.Fatal.Printf("-union is not supported in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.subdir != "" {
+			tlog.Fatal.Printf("The options -union and -subdir cannot be used at the same time")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if len(args.unionPassfile) > len(args.union) {
+		tlog.Fatal.Printf("-union-passfile was passed %d times, but -union only %d times",
+			len(args.unionPassfile), len(args.union))
+		os.Exit(exitcodes.Usage)
+	}
+	if args.statfs != "plain" && args.statfs != "raw" {
+		tlog.Fatal.Printf("Invalid \"-statfs\" setting %q. Valid settings are: plain, raw", args.statfs)
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.dryRun || args.preset != "") && !args.init {
+		tlog.Fatal.Printf("-dry-run and -preset require -init")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.preset != "" {
+		if err := applyInitPreset(&args); err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if len(args.passthroughDir)+len(args.plaintextnamesDir) > 0 {
+		if !args.init {
+			tlog.Fatal.Printf("-passthrough-dir and -plaintextnames-dir require -init")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.plaintextnames || args.reverse {
+			tlog.Fatal.Printf("-passthrough-dir and -plaintextnames-dir cannot be combined with -plaintextnames or -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if isFlagPassed(flagSet, "name-max") {
+		if !args.init {
+			tlog.Fatal.Printf("-name-max requires -init")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.plaintextnames || args.reverse || !args.longnames {
+			tlog.Fatal.Printf("-name-max cannot be combined with -plaintextnames, -reverse or -longnames=false")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.nameMax <= nametransform.NameMax || args.nameMax > nametransform.NameMaxLimit {
+			tlog.Fatal.Printf("-name-max must be between %d and %d", nametransform.NameMax+1, nametransform.NameMaxLimit)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if len(args.tenant) > 0 {
+		if countOpFlags(&args) > 0 {
+			tlog.Fatal.Printf("-tenant only works when mounting")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse || args.masterkey != "" || args.zerokey || args.fido2 != "" ||
+			args.subdir != "" || args.idlelock || args.onSuspend == "lock" || !args.union.Empty() {
+			tlog.Fatal.Printf("-tenant cannot be combined with -reverse, -masterkey, -zerokey, -fido2, -subdir, -idlelock, -on-suspend lock or -union")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if len(args.quota) > 0 {
+		if countOpFlags(&args) > 0 {
+			tlog.Fatal.Printf("-quota only works when mounting")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Fatal.Printf("-quota cannot be combined with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+	} else if args.quotaState != "" {
+		tlog.Fatal.Printf("-quota-state requires -quota")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.watchCipherdir {
+		if countOpFlags(&args) > 0 {
+			tlog.Fatal.Printf("-watch-cipherdir only works when mounting")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Fatal.Printf("-watch-cipherdir cannot be combined with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.syncdir {
+		if countOpFlags(&args) > 0 {
+			tlog.Fatal.Printf("-syncdir only works when mounting")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Fatal.Printf("-syncdir cannot be combined with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.journal {
+		if countOpFlags(&args) > 0 {
+			tlog.Fatal.Printf("-journal only works when mounting")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse || args.ro || !args.union.Empty() {
+			tlog.Fatal.Printf("-journal cannot be combined with -reverse, -ro or -union")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.verifyMount != "" {
+		if countOpFlags(&args) > 0 {
+			tlog.Fatal.Printf("-verify-mount only works when mounting")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Fatal.Printf("-verify-mount cannot be combined with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		// -forcedecode returns the corrupt blocks instead of failing
+		if args.forcedecode {
+			tlog.Fatal.Printf("-verify-mount cannot be combined with -forcedecode")
+			os.Exit(exitcodes.Usage)
+		}
+		args.ro = true
+	}
+	if args.repair && !args.fsck {
+		tlog.Fatal.Printf("-repair requires -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.fsckWorkers != 0 || args.fsckCheckpoint != "") && !args.fsck {
+		tlog.Fatal.Printf("-fsck-workers and -fsck-checkpoint require -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fsckWorkers < 0 {
+		tlog.Fatal.Printf("-fsck-workers must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.diffPassfile != "" && !args.diff {
+		tlog.Fatal.Printf("-diff-passfile requires -diff")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.jsonOutput && !args.info {
+		tlog.Fatal.Printf("-json requires -info")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.snapshotName != "" && args.snapshot == "" {
+		tlog.Fatal.Printf("-snapshot-name requires -snapshot")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.verifyJSON != "" || args.verifyWorkers != 0) && !args.verify {
+		tlog.Fatal.Printf("-verify-json and -verify-workers require -verify")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fdCache < 0 {
+		tlog.Fatal.Printf("-fd-cache must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fdCache > 0 && (args.reverse || args.sharedstorage) {
+		tlog.Fatal.Printf("-fd-cache cannot be used with -reverse or -sharedstorage")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.networkStorage && (args.reverse || args.sharedstorage) {
+		tlog.Fatal.Printf("-network-storage cannot be used with -reverse or -sharedstorage")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.maxReadMBps < 0 || args.maxWriteMBps < 0 || args.maxReadIOPS < 0 || args.maxWriteIOPS < 0 {
+		tlog.Fatal.Printf("-max-read-mbps, -max-write-mbps, -max-read-iops and -max-write-iops must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.readahead < 0 || uint64(args.readahead) > maxReadahead {
+		tlog.Fatal.Printf("-readahead must be between 0 and %d", maxReadahead)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.cryptoWorkers < 0 {
+		tlog.Fatal.Printf("-crypto-workers must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.verifyWorkers < 0 {
+		tlog.Fatal.Printf("-verify-workers must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
 	return args
 }
 
 // prettyArgs pretty-prints the command-line arguments.
-func prettyArgs() string {
-	pa := fmt.Sprintf("%v", os.Args)
+func prettyArgs(argv []string) string {
+	pa := fmt.Sprintf("%v", argv)
 	// Get rid of "[" and "]"
 	pa = pa[1 : len(pa)-1]
 	return pa
@@ -333,12 +924,55 @@ func countOpFlags(args *argContainer) int {
 	if args.passwd {
 		count++
 	}
+	if args.duressPasswd {
+		count++
+	}
+	if args.addTenant != "" {
+		count++
+	}
+	if args.removeTenant != "" {
+		count++
+	}
 	if args.init {
 		count++
 	}
 	if args.fsck {
 		count++
 	}
+	if args.verify {
+		count++
+	}
+	if args.exportTar {
+		count++
+	}
+	if args.importTar {
+		count++
+	}
+	if args.diff {
+		count++
+	}
+	if args.du {
+		count++
+	}
+	if args.cat != "" {
+		count++
+	}
+	if args.put != "" {
+		count++
+	}
+	if args.serveWebdav != "" {
+		count++
+	}
+	if args.sftpServer {
+		count++
+	}
+	if args.serve9p != "" {
+		count++
+	}
+	// "-snapshot mount" is a variant of the default mount operation
+	if args.snapshot == "create" || args.snapshot == "list" {
+		count++
+	}
 	return count
 }
 
@@ -353,3 +987,17 @@ func isFlagPassed(flagSet *flag.FlagSet, name string) bool {
 	})
 	return found
 }
+
+// passedFlags returns the flags that were passed on the command line as
+// "name=value" strings, in lexicographical order. The values of flags that
+// may contain secrets are hidden.
+func passedFlags(flagSet *flag.FlagSet) (out []string) {
+	flagSet.Visit(func(f *flag.Flag) {
+		val := f.Value.String()
+		if f.Name == "masterkey" || f.Name == "extpass" {
+			val = "***"
+		}
+		out = append(out, f.Name+"="+val)
+	})
+	return out
+}
@@ -1,8 +1,12 @@
 package gocryptfs
 
 import (
+	"os"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/keychain"
 )
 
 type testcase struct {
@@ -88,3 +92,51 @@ func TestStringSlice(t *testing.T) {
 		t.Errorf("Wrong string representation: want=%q have=%q", want, have)
 	}
 }
+
+// TestParseCliOptsDiy checks that parsing a command line for GoCryptAPI()
+// neither touches os.Args nor shares state between calls
+func TestParseCliOptsDiy(t *testing.T) {
+	osArgs := append([]string(nil), os.Args...)
+	a := parseCliOptsDiy([]string{"gocryptfs", "-o", "ro", "/a", "/b"})
+	b := parseCliOptsDiy([]string{"gocryptfs", "-reverse", "/c", "/d"})
+	if !reflect.DeepEqual(os.Args, osArgs) {
+		t.Errorf("os.Args has been modified: %v", os.Args)
+	}
+	if !a.ro || a.reverse || a._flagSet.Arg(0) != "/a" || a._flagSet.NArg() != 2 {
+		t.Errorf("wrong result for the first command line: %v", a._argv)
+	}
+	if b.ro || !b.reverse || b._flagSet.Arg(0) != "/c" {
+		t.Errorf("wrong result for the second command line: %v", b._argv)
+	}
+}
+
+// TestEnvOpts checks that GOCRYPTFS_OPTS sets defaults that the command line
+// overrides, and that they do not end up in _argv
+func TestEnvOpts(t *testing.T) {
+	os.Setenv(envOptsName, "ro,allow_other,i=10m,,fsname=env")
+	defer os.Unsetenv(envOptsName)
+	a := parseCliOptsDiy([]string{"gocryptfs", "-o", "fsname=cli", "-i", "1h", "/a", "/b"})
+	if !a.ro || !a.allow_other || a.idle != time.Hour || a.fsname != "cli" {
+		t.Errorf("ro=%v allow_other=%v idle=%v fsname=%q", a.ro, a.allow_other, a.idle, a.fsname)
+	}
+	if want := []string{"gocryptfs", "-fsname=cli", "-i", "1h", "/a", "/b"}; !reflect.DeepEqual(a._argv, want) {
+		t.Errorf("_argv=%q", a._argv)
+	}
+	if a._flagSet.NArg() != 2 || a._flagSet.Arg(1) != "/b" {
+		t.Errorf("args: %q", a._flagSet.Args())
+	}
+}
+
+func TestParsePasswordFrom(t *testing.T) {
+	if _, err := parsePasswordFrom("secret-service:service=gocryptfs,account=home"); err != nil {
+		t.Error(err)
+	}
+	if _, err := parsePasswordFrom("keychain:home"); (err == nil) != keychain.Supported {
+		t.Errorf("keychain: %v", err)
+	}
+	for _, s := range []string{"", "secret-service:", "secret-service:account", "keychain:", "wallet:a=b"} {
+		if _, err := parsePasswordFrom(s); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package cryptfile
+
+import (
+	"io"
+
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+)
+
+// PlaintextNames returns true if file names are not encrypted
+// ("-plaintextnames").
+func (k *Keys) PlaintextNames() bool {
+	return k.plaintextNames
+}
+
+// PlainBlockSize returns the number of plaintext bytes in one block
+func (k *Keys) PlainBlockSize() int {
+	return int(k.cEnc.PlainBS())
+}
+
+// PlainSize returns the plaintext size of a ciphertext file of size
+// "cipherSize"
+func (k *Keys) PlainSize(cipherSize int64) int64 {
+	return int64(k.cEnc.CipherSizeToPlainSize(uint64(cipherSize)))
+}
+
+// ReadHeader reads and parses the file header of the ciphertext file "f"
+// and returns the file ID. "f" must not be empty, as empty files have no
+// header.
+func (k *Keys) ReadHeader(f io.ReaderAt) (fileID []byte, err error) {
+	buf := make([]byte, contentenc.HeaderLen)
+	if _, err = f.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+	h, err := contentenc.ParseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	return h.ID, nil
+}
+
+// DecryptBlockAt reads and decrypts block number "blockNo" of the
+// ciphertext file "f" with file ID "fileID". The last block may be shorter
+// than PlainBlockSize(). Reading past the last block returns io.EOF.
+func (k *Keys) DecryptBlockAt(f io.ReaderAt, fileID []byte, blockNo uint64) ([]byte, error) {
+	cBuf := make([]byte, k.cEnc.CipherBS())
+	n, err := f.ReadAt(cBuf, int64(k.cEnc.BlockNoToCipherOff(blockNo)))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, io.EOF
+	}
+	plain, err := k.cEnc.DecryptBlock(cBuf[:n], blockNo, fileID)
+	if err != nil {
+		return nil, err
+	}
+	// DecryptBlock may return a buffer from its pool, copy it
+	return append([]byte(nil), plain...), nil
+}
+
+// DecryptSymlinkTarget decrypts the ciphertext symlink target "cTarget".
+func (k *Keys) DecryptSymlinkTarget(cTarget string) (string, error) {
+	if k.plaintextNames || cTarget == "" {
+		return cTarget, nil
+	}
+	cData, err := k.nameTransform.B64DecodeString(cTarget)
+	if err != nil {
+		return "", err
+	}
+	data, err := k.cEnc.DecryptBlock(cData, 0, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,179 @@
+// Package cryptfile is a Go library that reads and writes files in the
+// gocryptfs on-disk format without mounting the filesystem.
+//
+// Use Open() to get the keys of a filesystem, then NewReader()/NewWriter()
+// to stream file contents, or EncryptFile()/DecryptFile() to convert whole
+// files. File names are converted with EncryptName() and DecryptName().
+//
+// The functions that take a CIPHERDIR access the ciphertext through the
+// Storage interface. A plain path is a local directory, other storage is
+// plugged in with RegisterStorage(). The FUSE frontend does not use
+// Storage, it works on file descriptors of the local CIPHERDIR.
+package cryptfile
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// Keys holds the keys of a gocryptfs filesystem. It is safe for concurrent
+// use.
+type Keys struct {
+	cCore          *cryptocore.CryptoCore
+	cEnc           *contentenc.ContentEnc
+	nameTransform  *nametransform.NameTransform
+	plaintextNames bool
+}
+
+// Open loads the config file "configFile" (usually CIPHERDIR/gocryptfs.conf)
+// and decrypts the master key using "password". Filesystems with tenants
+// or directory policies are not supported.
+func Open(configFile string, password []byte) (*Keys, error) {
+	if len(password) == 0 {
+		return nil, errors.New("empty password")
+	}
+	cf, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFeatures(cf); err != nil {
+		return nil, err
+	}
+	masterkey, err := cf.DecryptMasterKey(password)
+	if err != nil {
+		return nil, err
+	}
+	return newKeys(masterkey, cf), nil
+}
+
+// OpenMasterKey is like Open, but uses the master key "masterkey" instead of
+// the password. The config file is still needed for the feature flags.
+// "masterkey" is overwritten with zeros.
+func OpenMasterKey(configFile string, masterkey []byte) (*Keys, error) {
+	cf, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFeatures(cf); err != nil {
+		return nil, err
+	}
+	if len(masterkey) != cryptocore.KeyLen {
+		return nil, errors.New("wrong master key length")
+	}
+	return newKeys(masterkey, cf), nil
+}
+
+// checkFeatures returns an error if "cf" uses a feature that Keys does not
+// implement. Using the master key anyway would write files that gocryptfs
+// cannot decrypt.
+func checkFeatures(cf *configfile.ConfFile) error {
+	if cf.IsFeatureFlagSet(configfile.FlagMultiTenant) {
+		// The tenant directories are encrypted with keys of their own
+		return errors.New("filesystems with tenants (-add-tenant) are not supported, mount them instead")
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagDirPolicy) {
+		// The directories with a policy are not encrypted, or only their
+		// file contents are
+		return errors.New("filesystems with directory policies are not supported, mount them instead")
+	}
+	return nil
+}
+
+// loadConfig loads the config file "configFile", which may also be in a
+// registered Storage
+func loadConfig(configFile string) (*configfile.ConfFile, error) {
+	if StorageScheme(configFile) == "" {
+		return configfile.Load(configFile)
+	}
+	js, err := ReadStorageFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return configfile.Parse(configFile, js)
+}
+
+// newKeys initializes the crypto backend like the gocryptfs command does.
+// "masterkey" is overwritten with zeros.
+func newKeys(masterkey []byte, cf *configfile.ConfFile) *Keys {
+	backend := cryptocore.BackendGoGCM
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		backend = cryptocore.BackendAESSIV
+	}
+	cCore := cryptocore.New(masterkey, backend, contentenc.DefaultIVBits,
+		cf.IsFeatureFlagSet(configfile.FlagHKDF), false)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	nameTransform := nametransform.New(cCore.EMECipher, true,
+		cf.IsFeatureFlagSet(configfile.FlagRaw64))
+	nameTransform.SetNameMax(cf.PlainNameMax())
+	return &Keys{
+		cCore:          cCore,
+		cEnc:           contentenc.New(cCore, contentenc.DefaultBS, false),
+		nameTransform:  nameTransform,
+		plaintextNames: cf.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+	}
+}
+
+// Wipe overwrites the keys in memory. The Keys object cannot be used
+// afterwards.
+func (k *Keys) Wipe() {
+	k.cCore.Wipe()
+}
+
+// EncryptName encrypts the file name "name" of an entry of a directory whose
+// "gocryptfs.diriv" contains "dirIV" (see ReadDirIV). Names that are too
+// long are returned as "gocryptfs.longname.*". The full encrypted name for
+// the accompanying ".name" file is returned in "longName", which is empty
+// otherwise.
+func (k *Keys) EncryptName(name string, dirIV []byte) (cName string, longName string, err error) {
+	if k.plaintextNames {
+		return name, "", nil
+	}
+	cName, err = k.nameTransform.EncryptAndHashName(name, dirIV)
+	if err != nil {
+		return "", "", err
+	}
+	if nametransform.IsLongContent(cName) {
+		longName = k.nameTransform.EncryptName(name, dirIV)
+	}
+	return cName, longName, nil
+}
+
+// DecryptName decrypts the encrypted file name "cName" of an entry of a
+// directory whose "gocryptfs.diriv" contains "dirIV". For
+// "gocryptfs.longname.*" names, pass the content of the ".name" file.
+func (k *Keys) DecryptName(cName string, dirIV []byte) (string, error) {
+	if k.plaintextNames {
+		return cName, nil
+	}
+	return k.nameTransform.DecryptName(cName, dirIV)
+}
+
+// ReadDirIV reads the "gocryptfs.diriv" file of the ciphertext directory
+// "dir"
+func ReadDirIV(dir string) ([]byte, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return nametransform.ReadDirIVAt(int(f.Fd()))
+}
+
+// readDirIV reads the "gocryptfs.diriv" file of the ciphertext directory
+// "cDir" in "st"
+func readDirIV(st Storage, cDir string) ([]byte, error) {
+	f, err := st.Open(path.Join(cDir, nametransform.DirIVFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return nametransform.ReadDirIVFrom(f)
+}
@@ -0,0 +1,231 @@
+package cryptfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+const exampleFs = "../tests/example_filesystems/v1.3"
+
+// TestExampleFs reads a file of a filesystem that was created by gocryptfs
+// v1.3
+func TestExampleFs(t *testing.T) {
+	k, err := Open(exampleFs+"/gocryptfs.conf", []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Wipe()
+	iv, err := ReadDirIV(exampleFs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := k.DecryptName("mGj2_hdnHe34Sp0iIQUwuw", iv)
+	if err != nil || name != "status.txt" {
+		t.Fatalf("DecryptName: %q %v", name, err)
+	}
+	cName, longName, err := k.EncryptName("status.txt", iv)
+	if err != nil || cName != "mGj2_hdnHe34Sp0iIQUwuw" || longName != "" {
+		t.Errorf("EncryptName: %q %q %v", cName, longName, err)
+	}
+	f, err := os.Open(exampleFs + "/mGj2_hdnHe34Sp0iIQUwuw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(k.NewReader(f))
+	if err != nil || string(content) != "It works!\n" {
+		t.Errorf("content: %q %v", content, err)
+	}
+	// Long name
+	long := "longname_255_" + strings.Repeat("x", 255-len("longname_255_"))
+	cName, longName, err = k.EncryptName(long, iv)
+	if err != nil || cName != "gocryptfs.longname.QhUr5d9FHerwEs--muUs6_80cy6JRp89c1otLwp92Cs" {
+		t.Errorf("EncryptName: %q %v", cName, err)
+	}
+	name, err = k.DecryptName(longName, iv)
+	if err != nil || name != long {
+		t.Errorf("DecryptName of long name: %q %v", name, err)
+	}
+	target, err := k.Readlink(exampleFs, "rel")
+	if err != nil || target != "status.txt" {
+		t.Errorf("Readlink: %q %v", target, err)
+	}
+	if _, err = k.Readlink(exampleFs, "status.txt"); err == nil {
+		t.Error("Readlink of a regular file succeeded")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := dir + "/gocryptfs.conf"
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := Open(conf, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Wipe()
+	for _, size := range []int{0, 1, 4095, 4096, 4097, 3*4096 + 100} {
+		plain := bytes.Repeat([]byte{'a', 'b', 'c'}, size/3+1)[:size]
+		var cipher bytes.Buffer
+		w := k.NewWriter(&cipher)
+		// Write in odd-sized pieces
+		for p := plain; len(p) > 0; {
+			n := 1000
+			if n > len(p) {
+				n = len(p)
+			}
+			w.Write(p[:n])
+			p = p[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if want := k.cEnc.PlainSizeToCipherSize(uint64(size)); uint64(cipher.Len()) != want {
+			t.Errorf("size %d: want ciphertext size %d, have %d", size, want, cipher.Len())
+		}
+		have, err := ioutil.ReadAll(k.NewReader(&cipher))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(have, plain) {
+			t.Errorf("size %d: content mismatch", size)
+		}
+	}
+	// Whole files, and corruption detection
+	src := dir + "/src"
+	if err := ioutil.WriteFile(src, []byte("hello world"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.EncryptFile(src, dir+"/enc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.DecryptFile(dir+"/enc", dir+"/dec"); err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := ioutil.ReadFile(dir + "/dec"); string(have) != "hello world" {
+		t.Errorf("DecryptFile: %q", have)
+	}
+	enc, _ := ioutil.ReadFile(dir + "/enc")
+	enc[len(enc)-1] ^= 1
+	ioutil.WriteFile(dir+"/enc", enc, 0600)
+	if err := k.DecryptFile(dir+"/enc", dir+"/dec2"); err == nil {
+		t.Error("corrupt file should not decrypt")
+	}
+	if _, err := os.Stat(dir + "/dec2"); !os.IsNotExist(err) {
+		t.Error("output of failed DecryptFile should be deleted")
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := dir + "/gocryptfs.conf"
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := Open(conf, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Wipe()
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(int(d.Fd()))
+	d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", 200)
+	for _, p := range []string{"a", "/" + long} {
+		if err := k.WriteFile(dir, p, strings.NewReader(p), 0600); err != nil {
+			t.Fatalf("%q: %v", p, err)
+		}
+		f, err := k.OpenFile(dir, p)
+		if err != nil {
+			t.Fatalf("%q: %v", p, err)
+		}
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil || string(content) != p {
+			t.Errorf("%q: wrong content %q: %v", p, content, err)
+		}
+	}
+	// The long name got its .name file
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 5 {
+		t.Errorf("want 5 entries in %q, have %d", dir, len(entries))
+	}
+	for _, p := range []string{"a", "../a", "missing/a", ""} {
+		if err := k.WriteFile(dir, p, strings.NewReader(""), 0600); err == nil {
+			t.Errorf("WriteFile %q should have failed", p)
+		}
+	}
+	if _, err := k.OpenFile(dir, "missing"); !os.IsNotExist(err) {
+		t.Errorf("OpenFile: want ENOENT, have %v", err)
+	}
+}
+
+// TestUnsupportedFeatures checks that Open and OpenMasterKey refuse config
+// files whose keys or directories Keys cannot handle
+func TestUnsupportedFeatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := dir + "/gocryptfs.conf"
+	testCases := []struct {
+		name  string
+		setup func(cf *configfile.ConfFile) error
+	}{
+		{"tenants", func(cf *configfile.ConfFile) error {
+			return cf.AddTenant("alice", "alice", make([]byte, 32), []byte("alice"), 10)
+		}},
+		{"directory policies", func(cf *configfile.ConfFile) error {
+			cf.SetFeatureFlag(configfile.FlagDirPolicy)
+			return nil
+		}},
+	}
+	for _, tc := range testCases {
+		os.Remove(conf)
+		err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf, err := configfile.Load(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.setup(cf); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.WriteFile(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(conf, []byte("test")); err == nil {
+			t.Errorf("%s: Open should have failed", tc.name)
+		}
+		if _, err := OpenMasterKey(conf, make([]byte, 32)); err == nil {
+			t.Errorf("%s: OpenMasterKey should have failed", tc.name)
+		}
+	}
+}
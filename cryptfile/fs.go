@@ -0,0 +1,282 @@
+//go:build go1.16
+// +build go1.16
+
+package cryptfile
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/lease"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// plainFS is a decrypted, read-only view of a CIPHERDIR
+type plainFS struct {
+	k  *Keys
+	st Storage
+	// err is the error of OpenStorage(), returned by every Open()
+	err error
+}
+
+// NewFS returns a decrypted, read-only view of "cipherdir" that implements
+// fs.FS. Open() returns files that implement io.Seeker and io.ReaderAt, so
+// the result can be passed to http.FS().
+//
+// Symlinks show up in directory listings, but cannot be opened.
+func (k *Keys) NewFS(cipherdir string) fs.FS {
+	st, err := OpenStorage(cipherdir)
+	return &plainFS{k: k, st: st, err: err}
+}
+
+// Open implements fs.FS
+func (pfs *plainFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if pfs.err != nil {
+		return nil, pathError(name, pfs.err)
+	}
+	cPath, err := pfs.k.encryptPath(pfs.st, name)
+	if err != nil {
+		return nil, pathError(name, err)
+	}
+	st, err := pfs.st.Lstat(cPath)
+	if err != nil {
+		return nil, pathError(name, err)
+	}
+	if st.Mode()&os.ModeSymlink != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errSymlink}
+	}
+	info := pfs.plainInfo(path.Base(name), st)
+	if st.IsDir() {
+		return &plainDir{pfs: pfs, cDir: cPath, info: info, dir: name}, nil
+	}
+	f, err := pfs.st.Open(cPath)
+	if err != nil {
+		return nil, pathError(name, err)
+	}
+	pf := &plainFile{k: pfs.k, f: f, info: info}
+	if st.Size() > 0 {
+		pf.fileID, err = pfs.k.ReadHeader(f)
+		if err != nil {
+			f.Close()
+			return nil, pathError(name, err)
+		}
+	}
+	return pf, nil
+}
+
+// pathError returns an *fs.PathError for the plaintext path "name" that does
+// not leak the ciphertext path contained in "err"
+func pathError(name string, err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return &fs.PathError{Op: "open", Path: name, Err: err}
+}
+
+// plainInfo translates the ciphertext file info "st" into a plaintext file
+// info with name "name"
+func (pfs *plainFS) plainInfo(name string, st os.FileInfo) *fileInfo {
+	size := st.Size()
+	if st.Mode().IsRegular() {
+		size = pfs.k.PlainSize(size)
+	}
+	return &fileInfo{
+		name:    name,
+		size:    size,
+		mode:    st.Mode(),
+		modTime: st.ModTime(),
+		sys:     st.Sys(),
+	}
+}
+
+// fileInfo implements fs.FileInfo and fs.DirEntry
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	sys     interface{}
+}
+
+func (fi *fileInfo) Name() string               { return fi.name }
+func (fi *fileInfo) Size() int64                { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode          { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time         { return fi.modTime }
+func (fi *fileInfo) IsDir() bool                { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}           { return fi.sys }
+func (fi *fileInfo) Type() fs.FileMode          { return fi.mode.Type() }
+func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+// plainFile is a decrypted regular file
+type plainFile struct {
+	k      *Keys
+	f      StorageFile
+	info   *fileInfo
+	fileID []byte
+	// off is the offset for Read() and Seek()
+	off int64
+}
+
+func (pf *plainFile) Stat() (fs.FileInfo, error) {
+	return pf.info, nil
+}
+
+func (pf *plainFile) Close() error {
+	return pf.f.Close()
+}
+
+func (pf *plainFile) Read(p []byte) (int, error) {
+	n, err := pf.ReadAt(p, pf.off)
+	pf.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt decrypts the blocks that overlap the range and copies the data.
+func (pf *plainFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+	plainBS := int64(pf.k.PlainBlockSize())
+	n := 0
+	for n < len(p) {
+		if off >= pf.info.size {
+			return n, io.EOF
+		}
+		plain, err := pf.k.DecryptBlockAt(pf.f, pf.fileID, uint64(off/plainBS))
+		if err != nil {
+			return n, err
+		}
+		skip := int(off % plainBS)
+		if skip >= len(plain) {
+			return n, io.EOF
+		}
+		c := copy(p[n:], plain[skip:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+func (pf *plainFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += pf.off
+	case io.SeekEnd:
+		offset += pf.info.size
+	default:
+		return 0, fs.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	pf.off = offset
+	return offset, nil
+}
+
+// plainDir is a decrypted directory
+type plainDir struct {
+	pfs *plainFS
+	// cDir is the ciphertext path in pfs.st
+	cDir string
+	info *fileInfo
+	// dir is the plaintext path
+	dir string
+	// entries holds the entries that have not been returned by ReadDir yet.
+	// nil until the first ReadDir call.
+	entries []fs.DirEntry
+}
+
+func (d *plainDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *plainDir) Close() error {
+	return nil
+}
+
+func (d *plainDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.dir, Err: syscall.EISDIR}
+}
+
+// ReadDir implements fs.ReadDirFile. Entries whose names cannot be
+// decrypted are skipped, like in the gocryptfs mount.
+func (d *plainDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		entries, err := d.readAll()
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+	}
+	if n <= 0 {
+		out := d.entries
+		d.entries = d.entries[len(d.entries):]
+		return out, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	out := d.entries[:n]
+	d.entries = d.entries[n:]
+	return out, nil
+}
+
+// readAll reads and decrypts all directory entries
+func (d *plainDir) readAll() ([]fs.DirEntry, error) {
+	k := d.pfs.k
+	infos, err := d.pfs.st.ReadDir(d.cDir)
+	if err != nil {
+		return nil, pathError(d.dir, err)
+	}
+	var iv []byte
+	if !k.plaintextNames {
+		iv, err = readDirIV(d.pfs.st, d.cDir)
+		if err != nil {
+			return nil, pathError(d.dir, err)
+		}
+	}
+	entries := []fs.DirEntry{}
+	for _, st := range infos {
+		cName := st.Name()
+		if d.dir == "." && cName == configfile.ConfDefaultName {
+			continue
+		}
+		name := cName
+		if !k.plaintextNames {
+			if cName == nametransform.DirIVFilename || lease.IsLeaseFile(cName) || nametransform.IsLongTarget(cName) {
+				continue
+			}
+			switch nametransform.NameType(cName) {
+			case nametransform.LongNameFilename:
+				continue
+			case nametransform.LongNameContent:
+				content, err := readAll(d.pfs.st, path.Join(d.cDir, cName+nametransform.LongNameSuffix))
+				if err != nil {
+					continue
+				}
+				cName = string(content)
+			}
+			name, err = k.DecryptName(cName, iv)
+			if err != nil {
+				continue
+			}
+		}
+		entries = append(entries, d.pfs.plainInfo(name, st))
+	}
+	return entries, nil
+}
@@ -0,0 +1,148 @@
+//go:build go1.16
+// +build go1.16
+
+package cryptfile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// mkCipherDir creates a ciphertext directory "plainName" in the ciphertext
+// directory "cDir" and returns its path
+func mkCipherDir(t *testing.T, k *Keys, cDir string, plainName string) string {
+	iv, err := ReadDirIV(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cName, _, err := k.EncryptName(plainName, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(cDir, cName)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeDirIV(t, dir)
+	return dir
+}
+
+func writeDirIV(t *testing.T, dir string) {
+	iv := make([]byte, nametransform.DirIVLen)
+	rand.Read(iv)
+	if err := ioutil.WriteFile(filepath.Join(dir, nametransform.DirIVFilename), iv, 0400); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mkCipherFile encrypts "content" into the ciphertext directory "cDir" as
+// "plainName"
+func mkCipherFile(t *testing.T, k *Keys, cDir string, plainName string, content []byte) {
+	iv, err := ReadDirIV(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cName, longName, err := k.EncryptName(plainName, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if longName != "" {
+		err = ioutil.WriteFile(filepath.Join(cDir, cName+nametransform.LongNameSuffix), []byte(longName), 0400)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	w := k.NewWriter(&buf)
+	w.Write(content)
+	w.Close()
+	if err := ioutil.WriteFile(filepath.Join(cDir, cName), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptfile_fs_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, configfile.ConfDefaultName)
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := Open(conf, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Wipe()
+	writeDirIV(t, dir)
+
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+	long := strings.Repeat("x", 200)
+	mkCipherFile(t, k, dir, "empty", nil)
+	mkCipherFile(t, k, dir, long, []byte("long"))
+	sub := mkCipherDir(t, k, dir, "sub")
+	mkCipherFile(t, k, sub, "big", big)
+	mkCipherDir(t, k, sub, "emptydir")
+
+	fsys := k.NewFS(dir)
+	if err := fstest.TestFS(fsys, "empty", long, "sub/big", "sub/emptydir"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsys.Open("sub/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Unaligned read across a block boundary
+	buf := make([]byte, 100)
+	n, err := f.(io.ReaderAt).ReadAt(buf, 4090)
+	if err != nil || n != 100 || !bytes.Equal(buf, big[4090:4190]) {
+		t.Errorf("ReadAt: n=%d err=%v", n, err)
+	}
+	n, err = f.(io.ReaderAt).ReadAt(buf, int64(len(big))-10)
+	if err != io.EOF || n != 10 {
+		t.Errorf("ReadAt at the end: n=%d err=%v", n, err)
+	}
+	if _, err := fsys.Open("missing"); !os.IsNotExist(err) {
+		t.Errorf("want ENOENT, have %v", err)
+	}
+	if _, err := fsys.Open("../x"); err == nil {
+		t.Error("invalid path should fail")
+	}
+}
+
+// TestFSExampleFs lists the v1.3 example filesystem, which contains
+// symlinks and a long name
+func TestFSExampleFs(t *testing.T) {
+	k, err := Open(exampleFs+"/gocryptfs.conf", []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Wipe()
+	fsys := k.NewFS(exampleFs)
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("want 4 entries, have %d", len(entries))
+	}
+	content, err := fs.ReadFile(fsys, "status.txt")
+	if err != nil || string(content) != "It works!\n" {
+		t.Errorf("content: %q %v", content, err)
+	}
+}
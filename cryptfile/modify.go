@@ -0,0 +1,350 @@
+package cryptfile
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// tmpPrefix is the prefix of the temporary files of ReplaceFile(). The
+// names cannot be decrypted, so they are hidden in the plaintext view.
+const tmpPrefix = "gocryptfs.tmp."
+
+// ReplaceFile is like WriteFile, but if "plainPath" is an existing regular
+// file, its content is replaced atomically and its permissions are kept.
+func (k *Keys) ReplaceFile(cipherdir string, plainPath string, r io.Reader, perm os.FileMode) error {
+	if err := k.replaceFile(cipherdir, plainPath, r, perm); err != nil {
+		return plainPathError("write", plainPath, err)
+	}
+	return nil
+}
+
+func (k *Keys) replaceFile(cipherdir string, plainPath string, r io.Reader, perm os.FileMode) (err error) {
+	name, err := cleanPath(plainPath)
+	if err != nil {
+		return err
+	}
+	st, err := OpenStorage(cipherdir)
+	if err != nil {
+		return err
+	}
+	cDir, cName, _, err := k.encryptChild(st, name)
+	if err != nil {
+		return err
+	}
+	cPath := path.Join(cDir, cName)
+	fi, err := st.Lstat(cPath)
+	if os.IsNotExist(err) {
+		return k.writeFileTo(st, name, r, perm)
+	} else if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return syscall.EISDIR
+	}
+	tmp, f, err := createTemp(st, cDir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			st.Remove(tmp)
+		}
+	}()
+	if err = st.Chmod(tmp, fi.Mode().Perm()); err != nil {
+		f.Close()
+		return err
+	}
+	if err = k.encryptTo(f, r); err != nil {
+		return err
+	}
+	return st.Rename(tmp, cPath)
+}
+
+// createTemp creates a new temporary file in the ciphertext directory
+// "cDir" of "st", like ioutil.TempFile()
+func createTemp(st Storage, cDir string) (string, io.WriteCloser, error) {
+	for i := 0; ; i++ {
+		tmp := path.Join(cDir, tmpPrefix+hex.EncodeToString(cryptocore.RandBytes(8)))
+		f, err := st.Create(tmp, 0600)
+		if os.IsExist(err) && i < 10 {
+			continue
+		}
+		return tmp, f, err
+	}
+}
+
+// Mkdir creates the directory "plainPath" of the filesystem in "cipherdir",
+// including its "gocryptfs.diriv". The parent directory must exist. Errors
+// are of type *os.PathError and contain the plaintext path.
+func (k *Keys) Mkdir(cipherdir string, plainPath string, perm os.FileMode) error {
+	if err := k.mkdir(cipherdir, plainPath, perm); err != nil {
+		return plainPathError("mkdir", plainPath, err)
+	}
+	return nil
+}
+
+func (k *Keys) mkdir(cipherdir string, plainPath string, perm os.FileMode) (err error) {
+	name, err := cleanPath(plainPath)
+	if err != nil {
+		return err
+	}
+	st, err := OpenStorage(cipherdir)
+	if err != nil {
+		return err
+	}
+	cDir, cName, longName, err := k.encryptChild(st, name)
+	if err != nil {
+		return err
+	}
+	cPath := path.Join(cDir, cName)
+	// We need write access to create gocryptfs.diriv
+	if err = st.Mkdir(cPath, perm|0700); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			st.Remove(path.Join(cPath, nametransform.DirIVFilename))
+			st.Remove(cPath)
+		}
+	}()
+	if !k.plaintextNames {
+		if err = createDirIV(st, cPath); err != nil {
+			return err
+		}
+	}
+	if longName != "" {
+		var created bool
+		if created, err = writeLongName(st, cPath, longName); err != nil {
+			return err
+		}
+		if created {
+			defer func() {
+				if err != nil {
+					st.Remove(cPath + nametransform.LongNameSuffix)
+				}
+			}()
+		}
+	}
+	if perm&0700 != 0700 {
+		return st.Chmod(cPath, perm)
+	}
+	return nil
+}
+
+// createDirIV creates the "gocryptfs.diriv" file in the ciphertext directory
+// "cDir" of "st". Like nametransform.WriteDirIVAt().
+func createDirIV(st Storage, cDir string) (err error) {
+	name := path.Join(cDir, nametransform.DirIVFilename)
+	// gocryptfs.diriv is never modified after creation
+	f, err := st.Create(name, 0400)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(cryptocore.RandBytes(nametransform.DirIVLen))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		st.Remove(name)
+	}
+	return err
+}
+
+// Remove deletes the file, symlink or empty directory "plainPath" of the
+// filesystem in "cipherdir". Errors are of type *os.PathError and contain
+// the plaintext path.
+func (k *Keys) Remove(cipherdir string, plainPath string) error {
+	if err := k.remove(cipherdir, plainPath); err != nil {
+		return plainPathError("remove", plainPath, err)
+	}
+	return nil
+}
+
+func (k *Keys) remove(cipherdir string, plainPath string) error {
+	name, err := cleanPath(plainPath)
+	if err != nil {
+		return err
+	}
+	st, err := OpenStorage(cipherdir)
+	if err != nil {
+		return err
+	}
+	cDir, cName, longName, err := k.encryptChild(st, name)
+	if err != nil {
+		return err
+	}
+	cPath := path.Join(cDir, cName)
+	fi, err := st.Lstat(cPath)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		err = k.rmdir(st, cPath)
+	} else {
+		err = st.Remove(cPath)
+	}
+	if err != nil {
+		return err
+	}
+	if longName != "" {
+		st.Remove(cPath + nametransform.LongNameSuffix)
+	}
+	return nil
+}
+
+// rmdir deletes the ciphertext directory "cPath" of "st" if it is empty in
+// the plaintext view
+func (k *Keys) rmdir(st Storage, cPath string) error {
+	if k.plaintextNames {
+		return st.Remove(cPath)
+	}
+	infos, err := st.ReadDir(cPath)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		// Leftovers of an interrupted ReplaceFile() do not count
+		if n := fi.Name(); n != nametransform.DirIVFilename && !strings.HasPrefix(n, tmpPrefix) {
+			return syscall.ENOTEMPTY
+		}
+	}
+	for _, fi := range infos {
+		if err := st.Remove(path.Join(cPath, fi.Name())); err != nil {
+			return err
+		}
+	}
+	if err := st.Remove(cPath); err != nil {
+		// The directory is still there, it needs a new IV. It is empty, so
+		// the IV does not matter.
+		createDirIV(st, cPath)
+		return err
+	}
+	return nil
+}
+
+// Rename renames "oldPath" to "newPath" in the filesystem in "cipherdir",
+// with the semantics of rename(2). Errors are of type *os.LinkError and
+// contain the plaintext paths.
+func (k *Keys) Rename(cipherdir string, oldPath string, newPath string) error {
+	if err := k.rename(cipherdir, oldPath, newPath); err != nil {
+		if pe, ok := err.(*os.LinkError); ok {
+			err = pe.Err
+		}
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
+
+func (k *Keys) rename(cipherdir string, oldPath string, newPath string) (err error) {
+	oldName, err := cleanPath(oldPath)
+	if err != nil {
+		return err
+	}
+	newName, err := cleanPath(newPath)
+	if err != nil {
+		return err
+	}
+	st, err := OpenStorage(cipherdir)
+	if err != nil {
+		return err
+	}
+	oldDir, oldCName, oldLong, err := k.encryptChild(st, oldName)
+	if err != nil {
+		return err
+	}
+	newDir, newCName, newLong, err := k.encryptChild(st, newName)
+	if err != nil {
+		return err
+	}
+	oldCPath := path.Join(oldDir, oldCName)
+	newCPath := path.Join(newDir, newCName)
+	if oldCPath == newCPath {
+		return nil
+	}
+	if _, err = st.Lstat(oldCPath); err != nil {
+		return err
+	}
+	if newLong != "" {
+		var created bool
+		created, err = writeLongName(st, newCPath, newLong)
+		if err != nil {
+			return err
+		}
+		if created {
+			defer func() {
+				if err != nil {
+					st.Remove(newCPath + nametransform.LongNameSuffix)
+				}
+			}()
+		}
+	}
+	if err = st.Rename(oldCPath, newCPath); err != nil {
+		return err
+	}
+	if oldLong != "" {
+		st.Remove(oldCPath + nametransform.LongNameSuffix)
+	}
+	return nil
+}
+
+// noSymlinkPath returns the Storage of "cipherdir" and the ciphertext path
+// of "plainPath". Symlinks are rejected, as os.Chmod() and os.Chtimes()
+// would follow them.
+func (k *Keys) noSymlinkPath(cipherdir string, plainPath string) (Storage, string, error) {
+	name, err := cleanPath(plainPath)
+	if err != nil {
+		return nil, "", err
+	}
+	st, err := OpenStorage(cipherdir)
+	if err != nil {
+		return nil, "", err
+	}
+	cPath, err := k.encryptPath(st, name)
+	if err != nil {
+		return nil, "", err
+	}
+	fi, err := st.Lstat(cPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil, "", errSymlink
+	}
+	return st, cPath, nil
+}
+
+// Chmod changes the permissions of the file or directory "plainPath" of the
+// filesystem in "cipherdir". Errors are of type *os.PathError and contain
+// the plaintext path.
+func (k *Keys) Chmod(cipherdir string, plainPath string, perm os.FileMode) error {
+	st, cPath, err := k.noSymlinkPath(cipherdir, plainPath)
+	if err == nil {
+		err = st.Chmod(cPath, perm)
+	}
+	if err != nil {
+		return plainPathError("chmod", plainPath, err)
+	}
+	return nil
+}
+
+// Chtimes changes the access and modification times of the file or
+// directory "plainPath" of the filesystem in "cipherdir". Errors are of type
+// *os.PathError and contain the plaintext path.
+func (k *Keys) Chtimes(cipherdir string, plainPath string, atime time.Time, mtime time.Time) error {
+	st, cPath, err := k.noSymlinkPath(cipherdir, plainPath)
+	if err == nil {
+		err = st.Chtimes(cPath, atime, mtime)
+	}
+	if err != nil {
+		return plainPathError("chtimes", plainPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+//go:build go1.16
+// +build go1.16
+
+package cryptfile
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+)
+
+// readPlain returns the content of "plainPath", or the error message
+func readPlain(k *Keys, dir string, plainPath string) string {
+	f, err := k.OpenFile(dir, plainPath)
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err.Error()
+	}
+	return string(content)
+}
+
+func TestModify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptfile_modify_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := dir + "/gocryptfs.conf"
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := Open(conf, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Wipe()
+	if err := createDirIV(LocalStorage(dir), "."); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("y", 200)
+	for _, d := range []string{"d", "d/" + long, long} {
+		if err := k.Mkdir(dir, d, 0755); err != nil {
+			t.Fatalf("Mkdir %q: %v", d, err)
+		}
+	}
+	if err := k.Mkdir(dir, "d", 0755); !os.IsExist(err) {
+		t.Errorf("Mkdir of existing dir: want EEXIST, have %v", err)
+	}
+	if err := k.WriteFile(dir, "d/"+long+"/f", strings.NewReader("one"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.ReplaceFile(dir, "d/"+long+"/f", strings.NewReader("two"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if have := readPlain(k, dir, "d/"+long+"/f"); have != "two" {
+		t.Errorf("after ReplaceFile: %q", have)
+	}
+	if err := k.Chmod(dir, "d/"+long+"/f", 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1600000000, 0)
+	if err := k.Chtimes(dir, "d/"+long+"/f", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := fs.Stat(k.NewFS(dir), "d/"+long+"/f"); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0640 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("after Chmod and Chtimes: mode %v, mtime %v", fi.Mode(), fi.ModTime())
+	}
+	// Rename between directories, from a long name to a short name and back
+	if err := k.Rename(dir, "d/"+long, "e"); err != nil {
+		t.Fatal(err)
+	}
+	if have := readPlain(k, dir, "e/f"); have != "two" {
+		t.Errorf("after Rename: %q", have)
+	}
+	if err := k.Rename(dir, "e/f", "d/"+long); err != nil {
+		t.Fatal(err)
+	}
+	if have := readPlain(k, dir, "d/"+long); have != "two" {
+		t.Errorf("after Rename: %q", have)
+	}
+	if err := k.Remove(dir, "d"); err == nil || !strings.Contains(err.Error(), syscall.ENOTEMPTY.Error()) {
+		t.Errorf("Remove of non-empty dir: want ENOTEMPTY, have %v", err)
+	}
+	for _, p := range []string{"d/" + long, "d", "e", long} {
+		if err := k.Remove(dir, p); err != nil {
+			t.Fatalf("Remove %q: %v", p, err)
+		}
+	}
+	// Only gocryptfs.conf and gocryptfs.diriv are left, no orphaned .name
+	// files
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 2 {
+		for _, e := range entries {
+			t.Log(e.Name())
+		}
+		t.Errorf("want 2 entries in %q, have %d", dir, len(entries))
+	}
+}
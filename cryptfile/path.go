@@ -0,0 +1,261 @@
+package cryptfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+var (
+	errSymlink     = errors.New("symlinks are not supported")
+	errInvalidPath = errors.New("invalid path")
+)
+
+// cleanPath cleans the plaintext path "plainPath", which is relative to the
+// root of the filesystem. A leading slash is allowed, but the path must not
+// point outside of the root. The root itself is ".".
+func cleanPath(plainPath string) (string, error) {
+	clean := path.Clean(strings.TrimLeft(plainPath, "/"))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errInvalidPath
+	}
+	return clean, nil
+}
+
+// encryptPath returns the ciphertext path in "st" of the clean plaintext
+// path "name"
+func (k *Keys) encryptPath(st Storage, name string) (string, error) {
+	cPath := "."
+	if name == "." {
+		return cPath, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		var iv []byte
+		if !k.plaintextNames {
+			var err error
+			iv, err = readDirIV(st, cPath)
+			if err != nil {
+				return "", err
+			}
+		}
+		cName, _, err := k.EncryptName(part, iv)
+		if err != nil {
+			return "", err
+		}
+		cPath = path.Join(cPath, cName)
+	}
+	return cPath, nil
+}
+
+// readCloser decrypts a ciphertext file
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// plainPathError returns an *os.PathError for "plainPath" that does not leak
+// the ciphertext path contained in "err"
+func plainPathError(op string, plainPath string, err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return &os.PathError{Op: op, Path: plainPath, Err: err}
+}
+
+// OpenFile opens the regular file "plainPath" of the filesystem in
+// "cipherdir" and returns a ReadCloser that decrypts it. Errors are of type
+// *os.PathError and contain the plaintext path.
+func (k *Keys) OpenFile(cipherdir string, plainPath string) (io.ReadCloser, error) {
+	rc, err := k.openFile(cipherdir, plainPath)
+	if err != nil {
+		return nil, plainPathError("open", plainPath, err)
+	}
+	return rc, nil
+}
+
+func (k *Keys) openFile(cipherdir string, plainPath string) (io.ReadCloser, error) {
+	name, err := cleanPath(plainPath)
+	if err != nil {
+		return nil, err
+	}
+	st, err := OpenStorage(cipherdir)
+	if err != nil {
+		return nil, err
+	}
+	cPath, err := k.encryptPath(st, name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := st.Lstat(cPath)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil, errSymlink
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, errors.New("not a regular file")
+	}
+	f, err := st.Open(cPath)
+	if err != nil {
+		return nil, err
+	}
+	return readCloser{k.NewReader(f), f}, nil
+}
+
+// Readlink returns the decrypted target of the symlink "plainPath" of the
+// filesystem in "cipherdir". Only local CIPHERDIRs are supported. Errors are
+// of type *os.PathError and contain the plaintext path.
+func (k *Keys) Readlink(cipherdir string, plainPath string) (string, error) {
+	target, err := k.readlink(cipherdir, plainPath)
+	if err != nil {
+		return "", plainPathError("readlink", plainPath, err)
+	}
+	return target, nil
+}
+
+func (k *Keys) readlink(cipherdir string, plainPath string) (string, error) {
+	name, err := cleanPath(plainPath)
+	if err != nil {
+		return "", err
+	}
+	st, err := OpenStorage(cipherdir)
+	if err != nil {
+		return "", err
+	}
+	l, ok := st.(localStorage)
+	if !ok {
+		return "", errSymlink
+	}
+	cPath, err := k.encryptPath(st, name)
+	if err != nil {
+		return "", err
+	}
+	cTarget, err := os.Readlink(l.path(cPath))
+	if err != nil {
+		return "", err
+	}
+	if !k.plaintextNames && nametransform.IsLongTarget(cTarget) {
+		// The target is stored in a gocryptfs.longtarget.* file next to
+		// the symlink
+		content, err := readAll(st, path.Join(path.Dir(cPath), cTarget))
+		if err != nil {
+			return "", err
+		}
+		cTarget = string(content)
+	}
+	return k.DecryptSymlinkTarget(cTarget)
+}
+
+// WriteFile encrypts the content of "r" into the new file "plainPath" of the
+// filesystem in "cipherdir". The parent directory must exist, and
+// "plainPath" must not. On error, nothing is left behind. Errors are of type
+// *os.PathError and contain the plaintext path.
+func (k *Keys) WriteFile(cipherdir string, plainPath string, r io.Reader, perm os.FileMode) error {
+	if err := k.writeFile(cipherdir, plainPath, r, perm); err != nil {
+		return plainPathError("write", plainPath, err)
+	}
+	return nil
+}
+
+func (k *Keys) writeFile(cipherdir string, plainPath string, r io.Reader, perm os.FileMode) (err error) {
+	name, err := cleanPath(plainPath)
+	if err != nil {
+		return err
+	}
+	st, err := OpenStorage(cipherdir)
+	if err != nil {
+		return err
+	}
+	return k.writeFileTo(st, name, r, perm)
+}
+
+// writeFileTo is WriteFile on the Storage "st" with the clean path "name"
+func (k *Keys) writeFileTo(st Storage, name string, r io.Reader, perm os.FileMode) (err error) {
+	cDir, cName, longName, err := k.encryptChild(st, name)
+	if err != nil {
+		return err
+	}
+	cPath := path.Join(cDir, cName)
+	f, err := st.Create(cPath, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			st.Remove(cPath)
+			if longName != "" {
+				st.Remove(cPath + nametransform.LongNameSuffix)
+			}
+		}
+	}()
+	if longName != "" {
+		if _, err = writeLongName(st, cPath, longName); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return k.encryptTo(f, r)
+}
+
+// encryptTo encrypts the content of "r" into "f" and closes "f"
+func (k *Keys) encryptTo(f io.WriteCloser, r io.Reader) (err error) {
+	w := k.NewWriter(f)
+	if _, err = io.Copy(w, r); err == nil {
+		err = w.Close()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// encryptChild returns the ciphertext directory in "st" of the parent of
+// the clean plaintext path "name" and the encrypted last path component.
+// For long names, "longName" is the content of the ".name" file, and empty
+// otherwise.
+func (k *Keys) encryptChild(st Storage, name string) (cDir string, cName string, longName string, err error) {
+	if name == "." {
+		return "", "", "", errInvalidPath
+	}
+	cDir, err = k.encryptPath(st, path.Dir(name))
+	if err != nil {
+		return "", "", "", err
+	}
+	var iv []byte
+	if !k.plaintextNames {
+		if iv, err = readDirIV(st, cDir); err != nil {
+			return "", "", "", err
+		}
+	}
+	cName, longName, err = k.EncryptName(path.Base(name), iv)
+	return cDir, cName, longName, err
+}
+
+// writeLongName writes the ".name" file of the ciphertext path "cPath" in
+// "st". Like nametransform.WriteLongNameAt(), but we already have the
+// encrypted name. An existing ".name" file is kept, as its content only
+// depends on the name and the directory IV. "created" tells if the file was
+// created.
+func writeLongName(st Storage, cPath string, longName string) (created bool, err error) {
+	lPath := cPath + nametransform.LongNameSuffix
+	f, err := st.Create(lPath, 0400)
+	if os.IsExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	_, err = f.Write([]byte(longName))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		st.Remove(lPath)
+		return false, err
+	}
+	return true, nil
+}
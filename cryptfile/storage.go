@@ -0,0 +1,187 @@
+package cryptfile
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage gives access to the ciphertext of a filesystem. By default, the
+// ciphertext is in the local directory CIPHERDIR. Other implementations are
+// registered with RegisterStorage() and used for a CIPHERDIR of the form
+// "scheme://...".
+//
+// Names are slash-separated and relative to the root of the storage, which
+// is ".". Errors should be, or wrap, the syscall.Errno values that a local
+// filesystem returns, like syscall.ENOENT.
+type Storage interface {
+	// Lstat returns the info of "name". Symlinks are not followed.
+	Lstat(name string) (os.FileInfo, error)
+	// Open opens the file "name" for reading
+	Open(name string) (StorageFile, error)
+	// ReadDir returns the info of all entries of the directory "name"
+	ReadDir(name string) ([]os.FileInfo, error)
+	// Create creates the new file "name" for writing, and fails if it
+	// exists. The file must be complete when Close() returns nil.
+	Create(name string, perm os.FileMode) (io.WriteCloser, error)
+	// Mkdir creates the directory "name"
+	Mkdir(name string, perm os.FileMode) error
+	// Remove deletes the file or empty directory "name"
+	Remove(name string) error
+	// Rename renames "oldName" to "newName" with the semantics of
+	// rename(2)
+	Rename(oldName string, newName string) error
+	// Chmod changes the permissions of "name"
+	Chmod(name string, perm os.FileMode) error
+	// Chtimes changes the access and modification times of "name"
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+}
+
+// StorageFile is a ciphertext file opened for reading
+type StorageFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+}
+
+// localStorage is a local directory
+type localStorage string
+
+// LocalStorage returns the Storage for the local directory "dir"
+func LocalStorage(dir string) Storage {
+	return localStorage(dir)
+}
+
+func (l localStorage) path(name string) string {
+	return filepath.Join(string(l), filepath.FromSlash(name))
+}
+
+func (l localStorage) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(l.path(name))
+}
+
+func (l localStorage) Open(name string) (StorageFile, error) {
+	return os.Open(l.path(name))
+}
+
+func (l localStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(l.path(name))
+}
+
+func (l localStorage) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(l.path(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+}
+
+func (l localStorage) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(l.path(name), perm)
+}
+
+func (l localStorage) Remove(name string) error {
+	return os.Remove(l.path(name))
+}
+
+func (l localStorage) Rename(oldName string, newName string) error {
+	return os.Rename(l.path(oldName), l.path(newName))
+}
+
+func (l localStorage) Chmod(name string, perm os.FileMode) error {
+	return os.Chmod(l.path(name), perm)
+}
+
+func (l localStorage) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(l.path(name), atime, mtime)
+}
+
+// storages holds the registered Storage implementations, and the Storage
+// objects that have been opened, so they are only opened once
+var storages struct {
+	sync.Mutex
+	schemes map[string]func(cipherdir string) (Storage, error)
+	opened  map[string]Storage
+}
+
+// RegisterStorage makes a CIPHERDIR of the form "scheme://..." use the
+// Storage returned by "open", which gets the whole CIPHERDIR string.
+func RegisterStorage(scheme string, open func(cipherdir string) (Storage, error)) {
+	storages.Lock()
+	defer storages.Unlock()
+	if storages.schemes == nil {
+		storages.schemes = make(map[string]func(string) (Storage, error))
+	}
+	storages.schemes[scheme] = open
+}
+
+// StorageScheme returns the scheme of "cipherdir", or "" for a local
+// directory
+func StorageScheme(cipherdir string) string {
+	i := strings.Index(cipherdir, "://")
+	if i <= 0 {
+		return ""
+	}
+	for _, c := range cipherdir[:i] {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.') {
+			return ""
+		}
+	}
+	return cipherdir[:i]
+}
+
+// OpenStorage returns the Storage for "cipherdir": the local directory, or
+// the registered Storage for "scheme://..."
+func OpenStorage(cipherdir string) (Storage, error) {
+	scheme := StorageScheme(cipherdir)
+	if scheme == "" {
+		return localStorage(cipherdir), nil
+	}
+	storages.Lock()
+	defer storages.Unlock()
+	if st, ok := storages.opened[cipherdir]; ok {
+		return st, nil
+	}
+	open, ok := storages.schemes[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported storage %q", scheme+"://")
+	}
+	st, err := open(cipherdir)
+	if err != nil {
+		return nil, err
+	}
+	if storages.opened == nil {
+		storages.opened = make(map[string]Storage)
+	}
+	storages.opened[cipherdir] = st
+	return st, nil
+}
+
+// ReadStorageFile reads "file", which is a local path or a path inside a
+// registered Storage, like "s3://bucket/dir/gocryptfs.conf"
+func ReadStorageFile(file string) ([]byte, error) {
+	scheme := StorageScheme(file)
+	if scheme == "" {
+		return ioutil.ReadFile(file)
+	}
+	i := strings.LastIndex(file, "/")
+	if i < len(scheme+"://") {
+		return nil, fmt.Errorf("invalid storage path %q", file)
+	}
+	st, err := OpenStorage(file[:i])
+	if err != nil {
+		return nil, err
+	}
+	return readAll(st, file[i+1:])
+}
+
+// readAll reads the small file "name" in "st"
+func readAll(st Storage, name string) ([]byte, error) {
+	f, err := st.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,85 @@
+//go:build go1.16
+// +build go1.16
+
+package cryptfile
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+)
+
+// countingStorage is a local directory that counts the Create() calls
+type countingStorage struct {
+	Storage
+	creates int
+}
+
+func (c *countingStorage) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	c.creates++
+	return c.Storage.Create(name, perm)
+}
+
+func TestStorageScheme(t *testing.T) {
+	for in, want := range map[string]string{
+		"/tmp/dir":          "",
+		"relative/dir":      "",
+		"s3://bucket/x":     "s3",
+		"my-store+v2://x":   "my-store+v2",
+		"/tmp/a://b":        "",
+		"://x":              "",
+		"UPPER://not-valid": "",
+	} {
+		if have := StorageScheme(in); have != want {
+			t.Errorf("StorageScheme(%q): want %q, have %q", in, want, have)
+		}
+	}
+}
+
+func TestRegisterStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptfile_storage_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := dir + "/gocryptfs.conf"
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := Open(conf, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Wipe()
+	cs := &countingStorage{Storage: LocalStorage(dir)}
+	if err := createDirIV(cs, "."); err != nil {
+		t.Fatal(err)
+	}
+	opens := 0
+	RegisterStorage("counting", func(cipherdir string) (Storage, error) {
+		opens++
+		return cs, nil
+	})
+	cipherdir := "counting://test"
+	if err := k.WriteFile(cipherdir, "f", strings.NewReader("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if have := readPlain(k, cipherdir, "f"); have != "hello" {
+		t.Errorf("OpenFile: %q", have)
+	}
+	// The file is also visible in the local directory
+	if have := readPlain(k, dir, "f"); have != "hello" {
+		t.Errorf("OpenFile on the local directory: %q", have)
+	}
+	if opens != 1 || cs.creates != 2 {
+		t.Errorf("want 1 open and 2 creates (diriv and file), have %d and %d", opens, cs.creates)
+	}
+	if _, err := k.OpenFile("unknown://x", "f"); err == nil || !strings.Contains(err.Error(), "unsupported storage") {
+		t.Errorf("unknown scheme: %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package cryptfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+)
+
+// reader decrypts a ciphertext stream block by block
+type reader struct {
+	k       *Keys
+	r       io.Reader
+	fileID  []byte
+	blockNo uint64
+	// cBuf holds one ciphertext block
+	cBuf []byte
+	// pBuf holds the decrypted data that has not been read yet
+	pBuf []byte
+	err  error
+}
+
+// NewReader returns a Reader that decrypts the gocryptfs-format file read
+// from "r". Corrupt data is reported as an error, never returned.
+func (k *Keys) NewReader(r io.Reader) io.Reader {
+	return &reader{
+		k:    k,
+		r:    r,
+		cBuf: make([]byte, k.cEnc.CipherBS()),
+	}
+}
+
+// Read implements io.Reader
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.pBuf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+	n := copy(p, r.pBuf)
+	r.pBuf = r.pBuf[n:]
+	return n, nil
+}
+
+// fill decrypts the next block into r.pBuf or sets r.err
+func (r *reader) fill() {
+	if r.fileID == nil {
+		buf := make([]byte, contentenc.HeaderLen)
+		_, err := io.ReadFull(r.r, buf)
+		if err == io.EOF {
+			// Empty files have no header
+			r.err = io.EOF
+			return
+		} else if err != nil {
+			r.err = fmt.Errorf("reading header: %v", err)
+			return
+		}
+		h, err := contentenc.ParseHeader(buf)
+		if err != nil {
+			r.err = err
+			return
+		}
+		r.fileID = h.ID
+	}
+	n, err := io.ReadFull(r.r, r.cBuf)
+	if err == io.EOF {
+		r.err = io.EOF
+		return
+	} else if err == io.ErrUnexpectedEOF {
+		// Short last block. Return its data, then EOF.
+		r.err = io.EOF
+	} else if err != nil {
+		r.err = err
+		return
+	}
+	plain, err := r.k.cEnc.DecryptBlock(r.cBuf[:n], r.blockNo, r.fileID)
+	if err != nil {
+		r.err = fmt.Errorf("block #%d: %v", r.blockNo, err)
+		return
+	}
+	// DecryptBlock returns a buffer from its pool, copy it
+	r.pBuf = append(r.pBuf[:0], plain...)
+	r.blockNo++
+}
+
+// writer encrypts a plaintext stream block by block
+type writer struct {
+	k       *Keys
+	w       io.Writer
+	fileID  []byte
+	blockNo uint64
+	// pBuf collects the plaintext of the current block
+	pBuf   []byte
+	closed bool
+}
+
+// NewWriter returns a WriteCloser that encrypts the data written to it into
+// the gocryptfs format and writes it to "w". Close() must be called to
+// write the last block. It does not close "w".
+// Writing nothing produces an empty file, like in gocryptfs.
+func (k *Keys) NewWriter(w io.Writer) io.WriteCloser {
+	return &writer{
+		k:    k,
+		w:    w,
+		pBuf: make([]byte, 0, k.cEnc.PlainBS()),
+	}
+}
+
+// Write implements io.Writer
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write on closed writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.pBuf[len(w.pBuf):cap(w.pBuf)], p)
+		w.pBuf = w.pBuf[:len(w.pBuf)+n]
+		p = p[n:]
+		written += n
+		if len(w.pBuf) == cap(w.pBuf) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush encrypts and writes the current block
+func (w *writer) flush() error {
+	if len(w.pBuf) == 0 {
+		return nil
+	}
+	if w.fileID == nil {
+		h := contentenc.RandomHeader()
+		if _, err := w.w.Write(h.Pack()); err != nil {
+			return err
+		}
+		w.fileID = h.ID
+	}
+	cBlock := w.k.cEnc.EncryptBlock(w.pBuf, w.blockNo, w.fileID)
+	if _, err := w.w.Write(cBlock); err != nil {
+		return err
+	}
+	w.blockNo++
+	w.pBuf = w.pBuf[:0]
+	return nil
+}
+
+// Close writes the last, partial block
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush()
+}
+
+// EncryptFile encrypts the plaintext file "src" into the new file "dst".
+// "dst" gets the permissions of "src".
+func (k *Keys) EncryptFile(src string, dst string) error {
+	return convertFile(src, dst, func(in io.Reader, out io.Writer) error {
+		w := k.NewWriter(out)
+		if _, err := io.Copy(w, in); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// DecryptFile decrypts the ciphertext file "src" into the new file "dst".
+// "dst" gets the permissions of "src". It is deleted if "src" is corrupt.
+func (k *Keys) DecryptFile(src string, dst string) error {
+	return convertFile(src, dst, func(in io.Reader, out io.Writer) error {
+		_, err := io.Copy(out, k.NewReader(in))
+		return err
+	})
+}
+
+// convertFile creates "dst" and calls "conv" to fill it from "src". "dst" is
+// deleted on error.
+func convertFile(src string, dst string, conv func(io.Reader, io.Writer) error) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, st.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := out.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+	return conv(in, out)
+}
@@ -0,0 +1,212 @@
+//go:build go1.24
+// +build go1.24
+
+package gocryptfs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/csisrv"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// csiDriverName is the name the kubelet knows the driver by. It goes into
+// the "driver" field of CSIDriver objects and volumes.
+const csiDriverName = "gocryptfs.github.io"
+
+// csiSecretPassword is the key of the password in the node-publish Secret
+const csiSecretPassword = "password"
+
+// csiEphemeral is set in the volume context of inline ephemeral volumes
+const csiEphemeral = "csi.storage.k8s.io/ephemeral"
+
+// csiMount is a volume that is published at a target path
+type csiMount struct {
+	volumeID  string
+	cipherdir string
+	ephemeral bool
+	fs        *Filesystem
+}
+
+// csiNode implements csisrv.Node. Every volume gets its own CIPHERDIR below
+// "root", which is created and initialized with the password from the
+// Secret on first use.
+type csiNode struct {
+	root string
+	// mu protects "mounts" and serializes Publish and Unpublish
+	mu sync.Mutex
+	// mounts is indexed by the target path
+	mounts map[string]*csiMount
+}
+
+// csiDriver runs the CSI node plugin until SIGINT or SIGTERM. This is called
+// when you pass "-csi-endpoint".
+func csiDriver(args *argContainer) int {
+	if args._flagSet.NArg() > 0 {
+		tlog.Fatal.Printf("-csi-endpoint takes no CIPHERDIR or MOUNTPOINT arguments")
+		return exitcodes.Usage
+	}
+	if args.csiRoot == "" {
+		tlog.Fatal.Printf("-csi-endpoint needs -csi-root")
+		return exitcodes.Usage
+	}
+	root, err := filepath.Abs(args.csiRoot)
+	if err == nil {
+		err = os.MkdirAll(root, 0700)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-csi-root: %v", err)
+		return exitcodes.CipherDir
+	}
+	nodeID := args.csiNodeID
+	if nodeID == "" {
+		if nodeID, err = os.Hostname(); err != nil {
+			tlog.Fatal.Printf("-csi-node-id is not set and the host name is unknown: %v", err)
+			return exitcodes.Usage
+		}
+	}
+	l, err := csisrv.Listen(args.csiEndpoint)
+	if err != nil {
+		tlog.Fatal.Printf("-csi-endpoint: %v", err)
+		return exitcodes.Other
+	}
+	node := &csiNode{root: root, mounts: make(map[string]*csiMount)}
+	srv := &csisrv.Server{
+		Name:    csiDriverName,
+		Version: GitVersion,
+		NodeID:  nodeID,
+		Node:    node,
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		tlog.Info.Printf("-csi-endpoint: got %v, exiting", sig)
+		l.Close()
+	}()
+	tlog.Info.Printf("CSI driver %s serving on %s, volumes in %s", csiDriverName, args.csiEndpoint, root)
+	err = srv.Serve(l)
+	node.unmountAll()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		tlog.Warn.Printf("-csi-endpoint: %v", err)
+	}
+	return 0
+}
+
+// Publish implements csisrv.Node
+func (n *csiNode) Publish(ctx context.Context, req *csisrv.PublishRequest) error {
+	if strings.ContainsAny(req.VolumeID, "/\x00") || req.VolumeID == "." || req.VolumeID == ".." {
+		return csisrv.Errorf(csisrv.CodeInvalidArgument, "invalid volume_id %q", req.VolumeID)
+	}
+	if !filepath.IsAbs(req.TargetPath) {
+		return csisrv.Errorf(csisrv.CodeInvalidArgument, "target_path %q is not absolute", req.TargetPath)
+	}
+	target := filepath.Clean(req.TargetPath)
+	password := req.Secrets[csiSecretPassword]
+	if password == "" {
+		return csisrv.Errorf(csisrv.CodeInvalidArgument, "the node-publish Secret has no %q key", csiSecretPassword)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if m := n.mounts[target]; m != nil {
+		if m.volumeID != req.VolumeID {
+			return csisrv.Errorf(csisrv.CodeFailedPrecondition, "volume %s is already published at %s", m.volumeID, target)
+		}
+		return nil
+	}
+	cipherdir := filepath.Join(n.root, req.VolumeID)
+	if err := n.prepareCipherdir(cipherdir, password); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0750); err != nil {
+		return csisrv.Errorf(csisrv.CodeInternal, "%v", err)
+	}
+	// Not "ctx": Mount() unmounts when its context ends, and that of the
+	// request ends when we return
+	fs, err := Mount(context.Background(), Options{
+		CipherDir:  cipherdir,
+		MountPoint: target,
+		Password:   StaticPassword(password),
+		ReadOnly:   req.Readonly,
+		// The pods run as other users than the driver
+		AllowOther: true,
+		FsName:     "gocryptfs:" + req.VolumeID,
+	})
+	if err != nil {
+		if e, ok := err.(exitcodes.Err); ok && e.Code() == exitcodes.PasswordIncorrect {
+			return csisrv.Errorf(csisrv.CodePermissionDenied, "volume %s: %v", req.VolumeID, err)
+		}
+		return csisrv.Errorf(csisrv.CodeInternal, "volume %s: %v", req.VolumeID, err)
+	}
+	n.mounts[target] = &csiMount{
+		volumeID:  req.VolumeID,
+		cipherdir: cipherdir,
+		ephemeral: req.VolumeContext[csiEphemeral] == "true",
+		fs:        fs,
+	}
+	tlog.Info.Printf("csi: published volume %s at %s", req.VolumeID, target)
+	return nil
+}
+
+// prepareCipherdir creates and initializes "cipherdir" if it does not exist
+// yet
+func (n *csiNode) prepareCipherdir(cipherdir string, password string) error {
+	if _, err := os.Stat(cipherdir); err == nil {
+		return nil
+	}
+	if err := os.Mkdir(cipherdir, 0700); err != nil {
+		return csisrv.Errorf(csisrv.CodeInternal, "%v", err)
+	}
+	err := InitFilesystem(cipherdir, WithPassword(StaticPassword(password)))
+	if err != nil {
+		os.Remove(cipherdir)
+		return csisrv.Errorf(csisrv.CodeInternal, "initializing %s: %v", cipherdir, err)
+	}
+	tlog.Info.Printf("csi: created %s", cipherdir)
+	return nil
+}
+
+// Unpublish implements csisrv.Node
+func (n *csiNode) Unpublish(ctx context.Context, req *csisrv.UnpublishRequest) error {
+	target := filepath.Clean(req.TargetPath)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	m := n.mounts[target]
+	if m != nil {
+		if err := m.fs.UnmountLazy(); err != nil {
+			return csisrv.Errorf(csisrv.CodeInternal, "unmounting %s: %v", target, err)
+		}
+		delete(n.mounts, target)
+		tlog.Info.Printf("csi: unpublished volume %s from %s", m.volumeID, target)
+		if m.ephemeral {
+			// The volume lives as long as the pod
+			if err := os.RemoveAll(m.cipherdir); err != nil {
+				tlog.Warn.Printf("csi: removing %s: %v", m.cipherdir, err)
+			}
+		}
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return csisrv.Errorf(csisrv.CodeInternal, "%v", err)
+	}
+	return nil
+}
+
+// unmountAll unmounts all volumes when the driver stops
+func (n *csiNode) unmountAll() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for target, m := range n.mounts {
+		if err := m.fs.UnmountLazy(); err != nil {
+			tlog.Warn.Printf("csi: cannot unmount %s: %v", target, err)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !go1.24
+// +build !go1.24
+
+package gocryptfs
+
+import (
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// csiDriver needs unencrypted HTTP/2 in net/http, which is new in Go 1.24
+func csiDriver(args *argContainer) int {
+	tlog.Fatal.Printf("-csi-endpoint needs gocryptfs built with Go 1.24 or later")
+	return exitcodes.Usage
+}
@@ -0,0 +1,63 @@
+//go:build go1.24
+// +build go1.24
+
+package gocryptfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/csisrv"
+)
+
+func TestCSINode(t *testing.T) {
+	root, err := ioutil.TempDir("", "csi_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	n := &csiNode{root: root, mounts: make(map[string]*csiMount)}
+	target := filepath.Join(root, "target")
+	secrets := map[string]string{"password": "test"}
+	for _, req := range []*csisrv.PublishRequest{
+		{VolumeID: "..", TargetPath: target, Secrets: secrets},
+		{VolumeID: "a/b", TargetPath: target, Secrets: secrets},
+		{VolumeID: "vol", TargetPath: "relative", Secrets: secrets},
+		{VolumeID: "vol", TargetPath: target},
+	} {
+		err := n.Publish(context.Background(), req)
+		if e, ok := err.(*csisrv.Error); !ok || e.Code != csisrv.CodeInvalidArgument {
+			t.Errorf("%+v: %v", req, err)
+		}
+	}
+
+	cipherdir := filepath.Join(root, "vol")
+	if err := n.prepareCipherdir(cipherdir, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cipherdir, configfile.ConfDefaultName)); err != nil {
+		t.Error(err)
+	}
+	// Existing CIPHERDIRs are used as they are
+	if err := n.prepareCipherdir(cipherdir, "other"); err != nil {
+		t.Error(err)
+	}
+
+	// Unpublishing what was never published removes the target directory
+	if err := os.Mkdir(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Unpublish(context.Background(), &csisrv.UnpublishRequest{VolumeID: "vol", TargetPath: target}); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("target still exists: %v", err)
+	}
+	if err := n.Unpublish(context.Background(), &csisrv.UnpublishRequest{VolumeID: "vol", TargetPath: target}); err != nil {
+		t.Errorf("second Unpublish: %v", err)
+	}
+}
@@ -31,8 +31,16 @@ func New(socketPath string) (*CtlSock, error) {
 }
 
 // Query sends a request to the control socket returns the response.
+// If req.Version is not set, the request is sent as ProtocolVersion.
 func (c *CtlSock) Query(req *RequestStruct) (*ResponseStruct, error) {
-	c.Conn.SetDeadline(time.Now().Add(time.Second))
+	if req.Version == 0 {
+		r := *req
+		r.Version = ProtocolVersion
+		req = &r
+	}
+	// ChangePassword runs scrypt twice, which takes a few seconds with
+	// high cost parameters
+	c.Conn.SetDeadline(time.Now().Add(10 * time.Second))
 	msg, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
@@ -41,14 +49,13 @@ func (c *CtlSock) Query(req *RequestStruct) (*ResponseStruct, error) {
 	if err != nil {
 		return nil, err
 	}
-	buf := make([]byte, 5000)
-	n, err := c.Conn.Read(buf)
+	// Responses like the list of open files can be larger than a single
+	// read, so let the decoder read until the JSON object is complete.
+	var resp ResponseStruct
+	err = json.NewDecoder(c.Conn).Decode(&resp)
 	if err != nil {
 		return nil, err
 	}
-	buf = buf[:n]
-	var resp ResponseStruct
-	json.Unmarshal(buf, &resp)
 	if resp.ErrNo != 0 {
 		return nil, &resp
 	}
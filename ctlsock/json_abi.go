@@ -1,12 +1,143 @@
 package ctlsock
 
+// ProtocolVersion is the version of the control socket protocol implemented
+// by this package. Version 1 is the original protocol that had no version
+// field.
+const ProtocolVersion = 2
+
+// Values of ResponseStruct.ErrCode
+const (
+	// ErrCodeErrno means that ErrNo contains the error number
+	ErrCodeErrno = "Errno"
+	// ErrCodeUnknown means that the error has no error number
+	ErrCodeUnknown = "Unknown"
+	// ErrCodeBadRequest means that the request was not valid JSON
+	ErrCodeBadRequest = "BadRequest"
+	// ErrCodeAmbiguous means that the request contained more than one command
+	ErrCodeAmbiguous = "Ambiguous"
+	// ErrCodeEmptyInput means that the request contained no command or an
+	// empty path
+	ErrCodeEmptyInput = "EmptyInput"
+	// ErrCodeUnauthorized means that the token was wrong or that the user
+	// is not allowed to use the socket
+	ErrCodeUnauthorized = "Unauthorized"
+	// ErrCodeUnsupportedVersion means that the server does not speak the
+	// requested protocol version. ResponseStruct.Version contains the
+	// version it does speak.
+	ErrCodeUnsupportedVersion = "UnsupportedVersion"
+)
+
 // RequestStruct is sent by a client (encoded as JSON).
 // You cannot perform both encryption and decryption in the same request.
+// Stats, Latency, OpenFiles, FlushCaches, FDCache and MountOptions can be
+// combined with each other, but not with the other fields.
 type RequestStruct struct {
+	// Version is the protocol version the client speaks. Zero means 1.
+	// A request that contains only the version returns the server version
+	// and can be used for negotiation.
+	Version int
+	// Token authenticates the client if the server has been started with
+	// "-ctlsock-token-file".
+	Token string
 	// EncryptPath is the path that should be encrypted.
 	EncryptPath string
 	// DecryptPath is the path that should be decrypted.
 	DecryptPath string
+	// Unlock is the password used to unlock a filesystem whose keys have been
+	// wiped by "-idlelock". Cannot be combined with the other fields.
+	Unlock string
+	// Freeze makes a reverse mount present a consistent, unchanging view of
+	// all files until Thaw is sent, which needs "-freeze-dir". A forward
+	// mount blocks all modifications instead, and thaws by itself after a
+	// minute unless Freeze is sent again.
+	// Cannot be combined with the other fields.
+	Freeze bool
+	// Thaw ends a freeze
+	Thaw bool
+	// Reload re-reads "-reload-file" and the files of "-exclude-from" and
+	// friends, like SIGHUP does. Cannot be combined with the other fields.
+	Reload bool
+	// Stats requests per-operation counters and latencies in
+	// ResponseStruct.Stats.
+	Stats bool
+	// Latency requests the latency distribution of each operation in
+	// ResponseStruct.Latency.
+	Latency bool
+	// OpenFiles requests the plaintext paths of the currently open files in
+	// ResponseStruct.OpenFiles.
+	OpenFiles bool
+	// FlushCaches drops the internal caches of the filesystem.
+	FlushCaches bool
+	// FDCache requests the counters of the backing file descriptor cache
+	// ("-fd-cache") in ResponseStruct.FDCache.
+	FDCache bool
+	// MountOptions requests the command line options the filesystem was
+	// mounted with in ResponseStruct.MountOptions.
+	MountOptions bool
+	// ChangePassword changes the password from Password to NewPassword.
+	ChangePassword bool
+	// RewrapStart re-encrypts the master key in the background using
+	// Password, a new scrypt salt and, if not zero, the cost parameter
+	// ScryptN. The password and the master key stay the same.
+	RewrapStart bool
+	// RewrapStatus requests the state of the last rewrap in
+	// ResponseStruct.RewrapStatus.
+	RewrapStatus bool
+	// Password is the current password, used by ChangePassword and
+	// RewrapStart
+	Password string
+	// NewPassword is used by ChangePassword
+	NewPassword string
+	// ScryptN is used by RewrapStart
+	ScryptN int
+	// EncryptPaths is a list of paths that should be encrypted. The results
+	// are returned in ResponseStruct.Results, in the same order.
+	EncryptPaths []string
+	// DecryptPaths is a list of paths that should be decrypted, see
+	// EncryptPaths.
+	DecryptPaths []string
+	// EncryptTree is a plaintext directory. All entries below it are
+	// returned in ResponseStruct.Tree. Use "/" for the root directory.
+	EncryptTree string
+	// DecryptTree is a ciphertext directory, see EncryptTree.
+	DecryptTree string
+	// SetDirPolicy is the plaintext path of an empty directory that gets
+	// the directory policy DirPolicy: "plaintextnames" or "passthrough".
+	// Only for forward mode.
+	SetDirPolicy string
+	// DirPolicy is used by SetDirPolicy
+	DirPolicy string
+	// Remount changes mount options of the running mount: a comma-separated
+	// list of "ro", "rw", "noexec" and "exec". Open files stay open.
+	Remount string
+}
+
+// PathResult is the result of translating one path of
+// RequestStruct.EncryptPaths or DecryptPaths. The fields have the same
+// meaning as in ResponseStruct.
+type PathResult struct {
+	Result   string
+	ErrNo    int32
+	ErrText  string `json:",omitempty"`
+	WarnText string `json:",omitempty"`
+}
+
+// PathPair is an entry of a directory tree, see RequestStruct.EncryptTree.
+type PathPair struct {
+	// Plain is the plaintext path
+	Plain string
+	// Cipher is the ciphertext path
+	Cipher string
+}
+
+// OpStats contains the counters of one FUSE operation, like "READ".
+type OpStats struct {
+	// Count is the number of calls
+	Count uint64
+	// TotalNs is the total time spent in the calls, in nanoseconds
+	TotalNs uint64
+	// MaxNs is the longest time spent in a single call, in nanoseconds
+	MaxNs uint64
 }
 
 // ResponseStruct is sent by the server in response to a request
@@ -23,4 +154,77 @@ type ResponseStruct struct {
 	// WarnText contains warnings that may have been encountered while
 	// processing the message.
 	WarnText string
+	// ErrCode classifies the error, see the ErrCode* constants. Empty on
+	// success.
+	ErrCode string `json:",omitempty"`
+	// Version is the protocol version of the server
+	Version int `json:",omitempty"`
+	// Stats maps FUSE operation names to their counters. Only set on
+	// "Stats" requests.
+	Stats map[string]OpStats `json:",omitempty"`
+	// Latency maps FUSE operation names to their latency histograms. Only
+	// set on "Latency" requests.
+	Latency map[string]LatencyHistogram `json:",omitempty"`
+	// OpenFiles is the sorted list of currently open plaintext paths. Only
+	// set on "OpenFiles" requests.
+	OpenFiles []string `json:",omitempty"`
+	// FDCache describes the backing file descriptor cache. Only set on
+	// "FDCache" requests.
+	FDCache *FDCacheStats `json:",omitempty"`
+	// MountOptions is the list of command line options in "name=value"
+	// form. Only set on "MountOptions" requests.
+	MountOptions []string `json:",omitempty"`
+	// RewrapStatus is "idle", "running", "done" or "failed: " followed by the
+	// error message. Only set on "RewrapStatus" requests.
+	RewrapStatus string `json:",omitempty"`
+	// Results contains one entry per path of an "EncryptPaths" or
+	// "DecryptPaths" request. A failed path does not fail the request.
+	Results []PathResult `json:",omitempty"`
+	// Tree lists all files and directories below the requested directory,
+	// parents before their children. Only set on "EncryptTree" and
+	// "DecryptTree" requests.
+	Tree []PathPair `json:",omitempty"`
+	// TreeTruncated is set if Tree was cut off after 100000 entries. Request
+	// the subdirectories one by one to get the rest.
+	TreeTruncated bool `json:",omitempty"`
+}
+
+// LatencyHistogram is the latency distribution of one FUSE operation since
+// mount. All times are in nanoseconds.
+type LatencyHistogram struct {
+	// Count is the number of calls
+	Count uint64
+	// P50Ns, P90Ns, P99Ns and P999Ns are percentiles. They are the upper
+	// bound of the bucket they fall into, so they can be up to 25% too
+	// high.
+	P50Ns  uint64
+	P90Ns  uint64
+	P99Ns  uint64
+	P999Ns uint64
+	// MaxNs is the longest call
+	MaxNs uint64
+	// Buckets are the non-empty buckets, fastest first
+	Buckets []LatencyBucket
+}
+
+// LatencyBucket counts the calls that took less than UpperNs, but not less
+// than the upper bound of the next faster bucket. Empty buckets are left out,
+// so that bucket is not necessarily in the list.
+type LatencyBucket struct {
+	UpperNs uint64
+	Count   uint64
+}
+
+// FDCacheStats describes the backing file descriptor cache of a mount
+type FDCacheStats struct {
+	// Entries is the number of cached file descriptors
+	Entries int
+	// Capacity is the maximum number of entries, zero if the cache is
+	// disabled
+	Capacity int
+	// Hits and Misses count the lookups since mount
+	Hits   uint64
+	Misses uint64
+	// Evictions counts entries closed because the cache was full
+	Evictions uint64
 }
@@ -0,0 +1,132 @@
+package gocryptfs
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Values reported by the "RewrapStatus" control socket request. A rewrap
+// re-encrypts ("wraps") the master key with a new scrypt salt. It is not a
+// key rotation: the master key, and therefore the encrypted files, stay the
+// same.
+const (
+	rewrapIdle    = "idle"
+	rewrapRunning = "running"
+	rewrapDone    = "done"
+)
+
+// configKeys implements ctlsocksrv.ConfigChanger. It changes the password in
+// the config file of a mounted filesystem. The master key, and therefore the
+// encrypted files, stay the same.
+type configKeys struct {
+	args *argContainer
+	// writeLock serializes all changes to the config file, as
+	// ConfFile.WriteFile() fails if another write is in progress.
+	writeLock sync.Mutex
+	// stateLock protects "rewrapState"
+	stateLock   sync.Mutex
+	rewrapState string
+}
+
+// ChangePassword implements ctlsocksrv.ConfigChanger. It fails with EBUSY
+// while a rewrap is running.
+func (k *configKeys) ChangePassword(oldPw string, newPw string) error {
+	if newPw == "" {
+		return syscall.EINVAL
+	}
+	if k.RewrapStatus() == rewrapRunning {
+		return syscall.EBUSY
+	}
+	err := k.rewrap([]byte(oldPw), []byte(newPw), 0)
+	if err == nil {
+		tlog.Info.Printf("ctlsock: password changed")
+	}
+	return err
+}
+
+// RewrapStart implements ctlsocksrv.ConfigChanger. It re-encrypts the master
+// key with a new scrypt salt in the background, using cost parameter logN if
+// it is not zero. The password stays the same.
+func (k *configKeys) RewrapStart(password string, logN int) error {
+	if logN != 0 && (logN < 10 || logN > 28) {
+		return syscall.EINVAL
+	}
+	k.stateLock.Lock()
+	defer k.stateLock.Unlock()
+	if k.rewrapState == rewrapRunning {
+		return syscall.EBUSY
+	}
+	k.rewrapState = rewrapRunning
+	go func() {
+		state := rewrapDone
+		pw := []byte(password)
+		if err := k.rewrap(pw, pw, logN); err != nil {
+			state = "failed: " + err.Error()
+		}
+		tlog.Info.Printf("ctlsock: rewrap %s", state)
+		k.stateLock.Lock()
+		k.rewrapState = state
+		k.stateLock.Unlock()
+	}()
+	return nil
+}
+
+// RewrapStatus implements ctlsocksrv.ConfigChanger
+func (k *configKeys) RewrapStatus() string {
+	k.stateLock.Lock()
+	defer k.stateLock.Unlock()
+	if k.rewrapState == "" {
+		return rewrapIdle
+	}
+	return k.rewrapState
+}
+
+// rewrap decrypts the master key using "oldPw" and encrypts it using "newPw"
+// and a fresh scrypt salt. The config file is replaced atomically. The old
+// config file is kept as a ".bak" file, replacing an older backup.
+// logN = 0 keeps the current scrypt cost.
+func (k *configKeys) rewrap(oldPw []byte, newPw []byte, logN int) error {
+	k.writeLock.Lock()
+	defer k.writeLock.Unlock()
+	cf, err := configfile.Load(k.args.config)
+	if err != nil {
+		return err
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		return syscall.ENOTSUP
+	}
+	masterkey, err := cf.DecryptMasterKey(oldPw)
+	if err != nil {
+		return syscall.EACCES
+	}
+	defer func() {
+		for i := range masterkey {
+			masterkey[i] = 0
+		}
+	}()
+	// Like "-passwd", which checks this in main()
+	if cf.IsDuressPassword(newPw) {
+		return errors.New("the new password must differ from the duress password")
+	}
+	if logN == 0 {
+		logN = cf.ScryptObject.LogN()
+	}
+	cf.EncryptKey(masterkey, newPw, logN)
+	// WriteFile() renames the new file over the old one, so the hard link
+	// keeps the old content
+	bak := k.args.config + ".bak"
+	if err := os.Remove(bak); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(k.args.config, bak); err != nil {
+		tlog.Warn.Printf("ctlsock: could not create backup file: %v", err)
+		return err
+	}
+	tlog.Info.Printf("ctlsock: a copy of the old config file has been created at %q", bak)
+	return cf.WriteFile()
+}
@@ -0,0 +1,72 @@
+package gocryptfs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+)
+
+func TestConfigKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlsock_config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := dir + "/gocryptfs.conf"
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &configKeys{args: &argContainer{config: conf}}
+	if err := k.ChangePassword("wrong", "new"); err != syscall.EACCES {
+		t.Errorf("wrong password: want EACCES, have %v", err)
+	}
+	if err := k.ChangePassword("test", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := configfile.LoadAndDecrypt(conf, []byte("new")); err != nil {
+		t.Errorf("new password does not work: %v", err)
+	}
+	if _, _, err := configfile.LoadAndDecrypt(conf+".bak", []byte("test")); err != nil {
+		t.Errorf("backup does not have the old password: %v", err)
+	}
+	if s := k.RewrapStatus(); s != rewrapIdle {
+		t.Errorf("want status %q, have %q", rewrapIdle, s)
+	}
+	if err := k.RewrapStart("new", 5); err != syscall.EINVAL {
+		t.Errorf("scryptn=5: want EINVAL, have %v", err)
+	}
+	if err := k.RewrapStart("new", 11); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; k.RewrapStatus() == rewrapRunning && i < 100; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if s := k.RewrapStatus(); s != rewrapDone {
+		t.Fatalf("want status %q, have %q", rewrapDone, s)
+	}
+	_, cf, err := configfile.LoadAndDecrypt(conf, []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.ScryptObject.LogN() != 11 {
+		t.Errorf("want LogN=11, have %d", cf.ScryptObject.LogN())
+	}
+	// The duress password must not become the real password
+	if err := cf.SetDuressPassword([]byte("duress"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.ChangePassword("new", "duress"); err == nil {
+		t.Error("changing the password to the duress password should fail")
+	}
+	if _, _, err := configfile.LoadAndDecrypt(conf, []byte("new")); err != nil {
+		t.Errorf("password has changed: %v", err)
+	}
+}
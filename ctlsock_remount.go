@@ -0,0 +1,38 @@
+package gocryptfs
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/HorizonLiu/gocryptfs/internal/ctlsocksrv"
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// remount applies the "Remount" control socket request to the running
+// mount. "ro" and "rw" are handled by the filesystem, so they work without
+// privileges and keep open files open. "noexec" and "exec" change the flag
+// of the kernel mount, which needs CAP_SYS_ADMIN.
+func remount(args *argContainer, rootNode fs.InodeEmbedder, opts ctlsocksrv.RemountOptions) error {
+	rn, forward := rootNode.(*fusefrontend.RootNode)
+	if opts.ReadOnly != nil && !*opts.ReadOnly {
+		// The kernel enforces "-ro", and reverse mounts are always
+		// read-only
+		if args.ro || args.reverse {
+			return syscall.EROFS
+		}
+	}
+	if opts.Noexec != nil {
+		if err := syscallcompat.SetMountNoexec(args.mountpoint, *opts.Noexec); err != nil {
+			tlog.Warn.Printf("ctlsock: remount: setting noexec=%v failed: %v", *opts.Noexec, err)
+			return err
+		}
+		tlog.Info.Printf("ctlsock: remount: noexec=%v", *opts.Noexec)
+	}
+	if opts.ReadOnly != nil && forward {
+		return rn.SetReadOnly(*opts.ReadOnly)
+	}
+	return nil
+}
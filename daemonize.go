@@ -23,11 +23,11 @@ func exitOnUsr1() {
 	}()
 }
 
-// forkChild - execute ourselves once again, this time with the "-fg" flag, and
-// wait for SIGUSR1 or child exit.
+// forkChild - execute ourselves once again with the command line "argv", this
+// time with the "-fg" flag, and wait for SIGUSR1 or child exit.
 // This is a workaround for the missing true fork function in Go.
-func forkChild() int {
-	name := os.Args[0]
+func forkChild(argv []string) int {
+	name := argv[0]
 	// Use the full path to our executable if we can get if from /proc.
 	buf := make([]byte, syscallcompat.PATH_MAX)
 	n, err := syscall.Readlink("/proc/self/exe", buf)
@@ -36,8 +36,10 @@ func forkChild() int {
 		tlog.Debug.Printf("forkChild: readlink worked: %q", name)
 	}
 	newArgs := []string{"-fg", fmt.Sprintf("-notifypid=%d", os.Getpid())}
-	newArgs = append(newArgs, os.Args[1:]...)
+	newArgs = append(newArgs, argv[1:]...)
 	c := exec.Command(name, newArgs...)
+	// Keep our program name, the mount helper is detected by it
+	c.Args[0] = argv[0]
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
 	c.Stdin = os.Stdin
@@ -0,0 +1,453 @@
+package gocryptfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/dbus"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Name, object and interface of the "-dbus-service" on the session bus
+const (
+	dbusServiceName  = "io.github.gocryptfs.Manager1"
+	dbusServicePath  = "/io/github/gocryptfs/Manager1"
+	dbusServiceIface = "io.github.gocryptfs.Manager1"
+)
+
+// Errors returned by the service
+const (
+	dbusErrorFailed      = dbusServiceIface + ".Error.Failed"
+	dbusErrorNotMounted  = dbusServiceIface + ".Error.NotMounted"
+	dbusErrorBusy        = dbusServiceIface + ".Error.Busy"
+	dbusErrorInvalidArgs = "org.freedesktop.DBus.Error.InvalidArgs"
+	dbusErrorUnknown     = "org.freedesktop.DBus.Error.UnknownMethod"
+)
+
+// Mount states, as returned by Status and List and sent in StateChanged
+const (
+	stateMounting   = "mounting"
+	stateMounted    = "mounted"
+	stateUnmounting = "unmounting"
+	stateUnmounted  = "unmounted"
+)
+
+const dbusIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="` + dbusServiceIface + `">
+    <method name="Mount">
+      <arg name="cipherdir" type="s" direction="in"/>
+      <arg name="mountpoint" type="s" direction="in"/>
+      <arg name="password" type="s" direction="in"/>
+      <arg name="options" type="a{ss}" direction="in"/>
+    </method>
+    <method name="Unmount">
+      <arg name="mountpoint" type="s" direction="in"/>
+    </method>
+    <method name="List">
+      <arg name="mounts" type="a(sss)" direction="out"/>
+    </method>
+    <method name="Status">
+      <arg name="mountpoint" type="s" direction="in"/>
+      <arg name="status" type="a{ss}" direction="out"/>
+    </method>
+    <signal name="StateChanged">
+      <arg name="mountpoint" type="s"/>
+      <arg name="state" type="s"/>
+    </signal>
+  </interface>
+  <interface name="org.freedesktop.DBus.Introspectable">
+    <method name="Introspect">
+      <arg name="xml" type="s" direction="out"/>
+    </method>
+  </interface>
+  <interface name="org.freedesktop.DBus.Peer">
+    <method name="Ping"/>
+  </interface>
+</node>
+`
+
+// dbusMount is a filesystem that has been mounted through the service
+type dbusMount struct {
+	cipherdir string
+	reverse   bool
+	ro        bool
+	state     string
+	fs        *Filesystem
+}
+
+// dbusService implements "-dbus-service". It mounts filesystems in-process
+// through Mount(), so they go away when the service stops.
+type dbusService struct {
+	conn *dbus.Conn
+	// mu protects "mounts"
+	mu sync.Mutex
+	// mounts is indexed by the absolute mountpoint
+	mounts map[string]*dbusMount
+}
+
+// serveDBus runs the "-dbus-service" until the bus connection is lost or it
+// gets SIGINT or SIGTERM. Returns the exit code.
+func serveDBus(args *argContainer) int {
+	if args._flagSet.NArg() > 0 {
+		tlog.Fatal.Printf("-dbus-service takes no CIPHERDIR or MOUNTPOINT arguments")
+		return exitcodes.Usage
+	}
+	addr := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	if addr == "" {
+		addr = fmt.Sprintf("unix:path=/run/user/%d/bus", os.Getuid())
+	}
+	conn, err := dbus.Dial(addr)
+	if err != nil {
+		tlog.Fatal.Printf("-dbus-service: %v", err)
+		return exitcodes.Other
+	}
+	if err := requestName(conn, dbusServiceName); err != nil {
+		tlog.Fatal.Printf("-dbus-service: %v", err)
+		conn.Close()
+		return exitcodes.Other
+	}
+	tlog.Info.Printf("-dbus-service: serving %s on the session bus", dbusServiceName)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		tlog.Info.Printf("-dbus-service: got %v, exiting", sig)
+		conn.Close()
+	}()
+	s := &dbusService{conn: conn, mounts: make(map[string]*dbusMount)}
+	err = s.serve()
+	s.unmountAll()
+	if err != nil {
+		tlog.Warn.Printf("-dbus-service: %v", err)
+	}
+	return 0
+}
+
+// requestName makes us the primary owner of the bus name "name"
+func requestName(conn *dbus.Conn, name string) error {
+	// DBUS_NAME_FLAG_DO_NOT_QUEUE
+	const doNotQueue = 4
+	// DBUS_REQUEST_NAME_REPLY_PRIMARY_OWNER
+	const primaryOwner = 1
+	e := &dbus.Encoder{}
+	e.String(name)
+	e.Uint32(doNotQueue)
+	m, err := conn.Call(dbus.Bus, dbus.BusPath, dbus.Bus, "RequestName", "su", e.B)
+	if err != nil {
+		return err
+	}
+	if r := m.BodyDecoder().Uint32(); r != primaryOwner {
+		return fmt.Errorf("the name %s is already taken", name)
+	}
+	return nil
+}
+
+// serve answers method calls until the connection is closed. Every call gets
+// its own goroutine, as mounting takes a while.
+func (s *dbusService) serve() error {
+	for {
+		m, err := s.conn.Read()
+		if err != nil {
+			return err
+		}
+		dbus.CloseFds(m.Fds)
+		m.Fds = nil
+		if m.Type != dbus.TypeMethodCall {
+			continue
+		}
+		go func() {
+			reply := s.handle(m)
+			if reply == nil {
+				return
+			}
+			if err := s.conn.Send(reply); err != nil {
+				tlog.Warn.Printf("-dbus-service: cannot send reply: %v", err)
+			}
+		}()
+	}
+}
+
+// handle answers the method call "m". Returns nil if the caller does not
+// want a reply.
+func (s *dbusService) handle(m *dbus.Message) *dbus.Message {
+	// DBUS_FLAG_NO_REPLY_EXPECTED
+	const noReplyExpected = 1
+	reply := s.dispatch(m)
+	if m.Flags&noReplyExpected != 0 {
+		return nil
+	}
+	return reply
+}
+
+func (s *dbusService) dispatch(m *dbus.Message) *dbus.Message {
+	if m.Path != dbusServicePath {
+		return dbus.ErrorReply(m, "org.freedesktop.DBus.Error.UnknownObject", "no object "+m.Path)
+	}
+	switch m.Interface + "." + m.Member {
+	case "org.freedesktop.DBus.Introspectable.Introspect":
+		e := &dbus.Encoder{}
+		e.String(dbusIntrospection)
+		return dbus.Reply(m, "s", e.B)
+	case "org.freedesktop.DBus.Peer.Ping":
+		return dbus.Reply(m, "", nil)
+	case dbusServiceIface + ".Mount", ".Mount":
+		return s.mount(m)
+	case dbusServiceIface + ".Unmount", ".Unmount":
+		return s.unmount(m)
+	case dbusServiceIface + ".List", ".List":
+		return s.list(m)
+	case dbusServiceIface + ".Status", ".Status":
+		return s.status(m)
+	}
+	return dbus.ErrorReply(m, dbusErrorUnknown, fmt.Sprintf("unknown method %s.%s", m.Interface, m.Member))
+}
+
+// mount implements Mount(s cipherdir, s mountpoint, s password, a{ss} options)
+func (s *dbusService) mount(m *dbus.Message) *dbus.Message {
+	if m.Sig != "sssa{ss}" {
+		return dbus.ErrorReply(m, dbusErrorInvalidArgs, "want arguments of type sssa{ss}")
+	}
+	d := m.BodyDecoder()
+	cipherdir := d.String()
+	mountpoint := d.String()
+	password := d.String()
+	options := decodeStringMap(d)
+	if d.Err() != nil {
+		return dbus.ErrorReply(m, dbusErrorInvalidArgs, d.Err().Error())
+	}
+	if !filepath.IsAbs(cipherdir) || !filepath.IsAbs(mountpoint) {
+		return dbus.ErrorReply(m, dbusErrorInvalidArgs, "cipherdir and mountpoint must be absolute paths")
+	}
+	mountpoint = filepath.Clean(mountpoint)
+	opts, err := dbusMountOptions(options)
+	if err != nil {
+		return dbus.ErrorReply(m, dbusErrorInvalidArgs, err.Error())
+	}
+	opts.CipherDir = cipherdir
+	opts.MountPoint = mountpoint
+	if password != "" {
+		opts.Password = StaticPassword(password)
+	} else if opts.Password == nil {
+		return dbus.ErrorReply(m, dbusErrorInvalidArgs, "need a password or the password-from option")
+	}
+
+	s.mu.Lock()
+	if _, ok := s.mounts[mountpoint]; ok {
+		s.mu.Unlock()
+		return dbus.ErrorReply(m, dbusErrorBusy, mountpoint+" is already in use")
+	}
+	mnt := &dbusMount{
+		cipherdir: cipherdir,
+		reverse:   opts.Reverse,
+		ro:        opts.ReadOnly,
+		state:     stateMounting,
+	}
+	s.mounts[mountpoint] = mnt
+	s.mu.Unlock()
+	s.stateChanged(mountpoint, stateMounting)
+
+	fs, err := Mount(context.Background(), opts)
+	if err != nil {
+		s.mu.Lock()
+		delete(s.mounts, mountpoint)
+		s.mu.Unlock()
+		s.stateChanged(mountpoint, stateUnmounted)
+		return dbus.ErrorReply(m, dbusErrorFailed, err.Error())
+	}
+	s.mu.Lock()
+	mnt.fs = fs
+	mnt.state = stateMounted
+	s.mu.Unlock()
+	tlog.Info.Printf("-dbus-service: mounted %s on %s", cipherdir, mountpoint)
+	s.stateChanged(mountpoint, stateMounted)
+	// Also catches unmounts from the outside and by -idle
+	go func() {
+		fs.Wait()
+		s.mu.Lock()
+		delete(s.mounts, mountpoint)
+		s.mu.Unlock()
+		tlog.Info.Printf("-dbus-service: unmounted %s", mountpoint)
+		s.stateChanged(mountpoint, stateUnmounted)
+	}()
+	return dbus.Reply(m, "", nil)
+}
+
+// dbusMountOptions converts the options of the Mount method
+func dbusMountOptions(options map[string]string) (opts Options, err error) {
+	flags := map[string]*bool{
+		"reverse":       &opts.Reverse,
+		"ro":            &opts.ReadOnly,
+		"allow_other":   &opts.AllowOther,
+		"kernel_cache":  &opts.KernelCache,
+		"sharedstorage": &opts.SharedStorage,
+	}
+	for k, v := range options {
+		if f := flags[k]; f != nil {
+			if *f, err = strconv.ParseBool(v); err != nil {
+				return opts, fmt.Errorf("option %s: %v", k, err)
+			}
+			continue
+		}
+		switch k {
+		case "config":
+			opts.ConfigFile = v
+		case "fsname":
+			opts.FsName = v
+		case "ko":
+			opts.MountOptions = strings.Split(v, ",")
+		case "idle":
+			if opts.IdleTimeout, err = time.ParseDuration(v); err != nil {
+				return opts, fmt.Errorf("option idle: %v", err)
+			}
+		case "password-from":
+			if opts.Password, err = parsePasswordFrom(v); err != nil {
+				return opts, fmt.Errorf("option password-from: %v", err)
+			}
+		default:
+			return opts, fmt.Errorf("unknown option %q", k)
+		}
+	}
+	return opts, nil
+}
+
+// unmount implements Unmount(s mountpoint)
+func (s *dbusService) unmount(m *dbus.Message) *dbus.Message {
+	if m.Sig != "s" {
+		return dbus.ErrorReply(m, dbusErrorInvalidArgs, "want an argument of type s")
+	}
+	mountpoint := filepath.Clean(m.BodyDecoder().String())
+	s.mu.Lock()
+	mnt := s.mounts[mountpoint]
+	if mnt == nil || mnt.state != stateMounted {
+		s.mu.Unlock()
+		return dbus.ErrorReply(m, dbusErrorNotMounted, mountpoint+" is not mounted")
+	}
+	mnt.state = stateUnmounting
+	s.mu.Unlock()
+	s.stateChanged(mountpoint, stateUnmounting)
+	if err := mnt.fs.Unmount(); err != nil {
+		s.mu.Lock()
+		mnt.state = stateMounted
+		s.mu.Unlock()
+		s.stateChanged(mountpoint, stateMounted)
+		return dbus.ErrorReply(m, dbusErrorBusy, err.Error())
+	}
+	return dbus.Reply(m, "", nil)
+}
+
+// list implements List() a(sss), the mountpoint, CIPHERDIR and state of all
+// mounts
+func (s *dbusService) list(m *dbus.Message) *dbus.Message {
+	s.mu.Lock()
+	mountpoints := make([]string, 0, len(s.mounts))
+	for mp := range s.mounts {
+		mountpoints = append(mountpoints, mp)
+	}
+	sort.Strings(mountpoints)
+	e := &dbus.Encoder{}
+	e.Array(8, func() {
+		for _, mp := range mountpoints {
+			e.Align(8)
+			e.String(mp)
+			e.String(s.mounts[mp].cipherdir)
+			e.String(s.mounts[mp].state)
+		}
+	})
+	s.mu.Unlock()
+	return dbus.Reply(m, "a(sss)", e.B)
+}
+
+// status implements Status(s mountpoint) a{ss}. An unknown mountpoint is
+// "unmounted".
+func (s *dbusService) status(m *dbus.Message) *dbus.Message {
+	if m.Sig != "s" {
+		return dbus.ErrorReply(m, dbusErrorInvalidArgs, "want an argument of type s")
+	}
+	mountpoint := filepath.Clean(m.BodyDecoder().String())
+	status := map[string]string{"state": stateUnmounted}
+	s.mu.Lock()
+	if mnt := s.mounts[mountpoint]; mnt != nil {
+		status["state"] = mnt.state
+		status["cipherdir"] = mnt.cipherdir
+		status["reverse"] = strconv.FormatBool(mnt.reverse)
+		status["ro"] = strconv.FormatBool(mnt.ro)
+	}
+	s.mu.Unlock()
+	e := &dbus.Encoder{}
+	encodeStringMap(e, status)
+	return dbus.Reply(m, "a{ss}", e.B)
+}
+
+// stateChanged sends the StateChanged(s mountpoint, s state) signal
+func (s *dbusService) stateChanged(mountpoint, state string) {
+	e := &dbus.Encoder{}
+	e.String(mountpoint)
+	e.String(state)
+	err := s.conn.Send(&dbus.Message{
+		Type:      dbus.TypeSignal,
+		Path:      dbusServicePath,
+		Interface: dbusServiceIface,
+		Member:    "StateChanged",
+		Sig:       "ss",
+		Body:      e.B,
+	})
+	if err != nil {
+		tlog.Warn.Printf("-dbus-service: cannot send StateChanged: %v", err)
+	}
+}
+
+// unmountAll unmounts everything when the service stops, lazily if busy
+func (s *dbusService) unmountAll() {
+	s.mu.Lock()
+	var filesystems []*Filesystem
+	for _, mnt := range s.mounts {
+		if mnt.fs != nil {
+			filesystems = append(filesystems, mnt.fs)
+		}
+	}
+	s.mu.Unlock()
+	for _, fs := range filesystems {
+		if err := fs.UnmountLazy(); err != nil {
+			tlog.Warn.Printf("-dbus-service: cannot unmount %s: %v", fs.MountPoint(), err)
+		}
+	}
+}
+
+// decodeStringMap decodes an a{ss}
+func decodeStringMap(d *dbus.Decoder) map[string]string {
+	res := make(map[string]string)
+	d.Array(8, func() {
+		d.Align(8)
+		k := d.String()
+		res[k] = d.String()
+	})
+	return res
+}
+
+// encodeStringMap encodes an a{ss}, sorted by key
+func encodeStringMap(e *dbus.Encoder, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	e.Array(8, func() {
+		for _, k := range keys {
+			e.Align(8)
+			e.String(k)
+			e.String(m[k])
+		}
+	})
+}
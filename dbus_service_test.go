@@ -0,0 +1,186 @@
+package gocryptfs
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/dbus"
+)
+
+// newTestDBusService starts a dbusService on a connection to a fake bus and
+// returns the bus end of the connection
+func newTestDBusService(t *testing.T) (bus *dbus.Conn, cleanup func()) {
+	dir, err := ioutil.TempDir("", "dbus_service_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := dir + "/bus"
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *dbus.Conn, 1)
+	go func() {
+		uc, err := l.AcceptUnix()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c, err := dbus.Accept(uc)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// Hello
+		m, err := c.Read()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		e := &dbus.Encoder{}
+		e.String(":1.1")
+		c.Send(dbus.Reply(m, "s", e.B))
+		accepted <- c
+	}()
+	conn, err := dbus.Dial("unix:path=" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus = <-accepted
+	s := &dbusService{conn: conn, mounts: make(map[string]*dbusMount)}
+	go s.serve()
+	return bus, func() {
+		conn.Close()
+		bus.Close()
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// callService calls "member" and returns the reply and the signals that
+// came before it
+func callService(t *testing.T, bus *dbus.Conn, member, sig string, body []byte) (reply *dbus.Message, signals []string) {
+	call := dbus.MethodCall(dbusServiceName, dbusServicePath, dbusServiceIface, member, sig, body)
+	if err := bus.Send(call); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := bus.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Type == dbus.TypeSignal {
+			d := m.BodyDecoder()
+			mp := d.String()
+			signals = append(signals, mp+" "+d.String())
+			continue
+		}
+		if m.ReplySerial == call.Serial {
+			return m, signals
+		}
+	}
+}
+
+func TestDBusService(t *testing.T) {
+	bus, cleanup := newTestDBusService(t)
+	defer cleanup()
+
+	m, _ := callService(t, bus, "List", "", nil)
+	if m.Type != dbus.TypeMethodReturn || m.Sig != "a(sss)" {
+		t.Fatalf("List: %v %q", m.AsError(), m.Sig)
+	}
+	if n := m.BodyDecoder().Uint32(); n != 0 {
+		t.Errorf("List: %d bytes of mounts", n)
+	}
+
+	e := &dbus.Encoder{}
+	e.String("/nonexistent")
+	m, _ = callService(t, bus, "Status", "s", e.B)
+	d := m.BodyDecoder()
+	if have := decodeStringMap(d); !reflect.DeepEqual(have, map[string]string{"state": stateUnmounted}) {
+		t.Errorf("Status: %v %v", have, d.Err())
+	}
+
+	m, _ = callService(t, bus, "Unmount", "s", e.B)
+	if m.ErrName != dbusErrorNotMounted {
+		t.Errorf("Unmount: %v", m.AsError())
+	}
+
+	mount := func(cipherdir, mountpoint string, options map[string]string) (*dbus.Message, []string) {
+		e := &dbus.Encoder{}
+		e.String(cipherdir)
+		e.String(mountpoint)
+		e.String("test")
+		encodeStringMap(e, options)
+		return callService(t, bus, "Mount", "sssa{ss}", e.B)
+	}
+	m, _ = mount("relative", "/mnt", nil)
+	if m.ErrName != dbusErrorInvalidArgs {
+		t.Errorf("relative path: %v", m.AsError())
+	}
+	m, _ = mount("/a", "/b", map[string]string{"foo": "bar"})
+	if m.ErrName != dbusErrorInvalidArgs {
+		t.Errorf("unknown option: %v", m.AsError())
+	}
+	m, signals := mount("/nonexistent", "/nonexistent2", nil)
+	if m.ErrName != dbusErrorFailed {
+		t.Errorf("nonexistent cipherdir: %v", m.AsError())
+	}
+	want := []string{"/nonexistent2 " + stateMounting, "/nonexistent2 " + stateUnmounted}
+	if !reflect.DeepEqual(signals, want) {
+		t.Errorf("signals: want %v, have %v", want, signals)
+	}
+
+	m, _ = callService(t, bus, "Frobnicate", "", nil)
+	if m.ErrName != dbusErrorUnknown {
+		t.Errorf("Frobnicate: %v", m.AsError())
+	}
+
+	call := dbus.MethodCall(dbusServiceName, dbusServicePath, "org.freedesktop.DBus.Introspectable", "Introspect", "", nil)
+	bus.Send(call)
+	m, err := bus.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xml := m.BodyDecoder().String(); !strings.Contains(xml, `<signal name="StateChanged">`) {
+		t.Errorf("Introspect: %q", xml)
+	}
+}
+
+func TestDBusMountOptions(t *testing.T) {
+	opts, err := dbusMountOptions(map[string]string{
+		"reverse": "true",
+		"ro":      "1",
+		"idle":    "10m",
+		"ko":      "noexec,nosuid",
+		"config":  "/etc/gocryptfs.conf",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Options{
+		Reverse:      true,
+		ReadOnly:     true,
+		IdleTimeout:  10 * time.Minute,
+		MountOptions: []string{"noexec", "nosuid"},
+		ConfigFile:   "/etc/gocryptfs.conf",
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("want %+v, have %+v", want, opts)
+	}
+	for _, o := range []map[string]string{
+		{"ro": "maybe"},
+		{"idle": "10"},
+		{"password-from": "foo"},
+		{"nonempty": "true"},
+	} {
+		if _, err := dbusMountOptions(o); err == nil {
+			t.Errorf("%v was accepted", o)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package gocryptfs
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/HorizonLiu/gocryptfs/ctlsock"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/opstats"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// listenDebug opens the listener for "-debug-addr". Profiles and internal
+// state must not leave the machine, so only loopback addresses are allowed.
+func listenDebug(addr string) net.Listener {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		tlog.Fatal.Printf("debug-addr: %v", err)
+		os.Exit(exitcodes.Profiler)
+	}
+	if a, ok := l.Addr().(*net.TCPAddr); !ok || !a.IP.IsLoopback() {
+		l.Close()
+		tlog.Fatal.Printf("debug-addr: refusing to listen on non-loopback address %v", l.Addr())
+		os.Exit(exitcodes.Usage)
+	}
+	return l
+}
+
+// debugState is the "gocryptfs" variable on /debug/vars
+type debugState struct {
+	// Mount is only set in forward mode
+	Mount *fusefrontend.DebugVars `json:",omitempty"`
+	// Ops are the FUSE operation counters, Latency their latency
+	// distribution
+	Ops     map[string]ctlsock.OpStats
+	Latency map[string]ctlsock.LatencyHistogram
+}
+
+// serveDebug serves expvar on /debug/vars and the pprof profiles on
+// /debug/pprof/ until "l" is closed. Besides the standard variables,
+// /debug/vars contains the internal state of "topFs" and the counters in
+// "stats". The command line is left out, it may contain a password.
+func serveDebug(l net.Listener, topFs fs.InodeEmbedder, stats *opstats.Stats) {
+	rn, _ := topFs.(*fusefrontend.RootNode)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		var state debugState
+		if rn != nil {
+			v := rn.DebugVars()
+			state.Mount = &v
+		}
+		state.Ops = stats.Snapshot()
+		state.Latency = stats.Latency()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n")
+		expvar.Do(func(kv expvar.KeyValue) {
+			if kv.Key == "cmdline" {
+				return
+			}
+			fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+		})
+		s, _ := json.Marshal(state)
+		fmt.Fprintf(w, "%q: %s\n}\n", "gocryptfs", s)
+	})
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	tlog.Info.Printf("debug-addr: serving /debug/vars and /debug/pprof/ on %v", l.Addr())
+	err := http.Serve(l, mux)
+	tlog.Debug.Printf("debug-addr: %v", err)
+}
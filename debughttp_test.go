@@ -0,0 +1,45 @@
+package gocryptfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/opstats"
+)
+
+func TestServeDebug(t *testing.T) {
+	l := listenDebug("127.0.0.1:0")
+	defer l.Close()
+	stats := opstats.New()
+	stats.Add("READ", time.Millisecond)
+	go serveDebug(l, nil, stats)
+	resp, err := http.Get("http://" + l.Addr().String() + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(content, &vars); err != nil {
+		t.Fatalf("%v: %s", err, content)
+	}
+	if _, ok := vars["cmdline"]; ok {
+		t.Error("cmdline is published")
+	}
+	if _, ok := vars["memstats"]; !ok {
+		t.Error("memstats is missing")
+	}
+	var state debugState
+	if err := json.Unmarshal(vars["gocryptfs"], &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Mount != nil || state.Ops["READ"].Count != 1 {
+		t.Errorf("wrong state: %+v", state)
+	}
+}
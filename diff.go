@@ -0,0 +1,256 @@
+//go:build go1.16
+// +build go1.16
+
+package gocryptfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// diffSide is one of the two CIPHERDIRs that "-diff" compares
+type diffSide struct {
+	cipherdir string
+	keys      *cryptfile.Keys
+	fsys      fs.FS
+	// entries maps the plaintext paths to their type and size
+	entries map[string]fs.FileInfo
+}
+
+// diffChange is a difference that "-diff" found
+type diffChange struct {
+	// Kind is "added", "removed" or "changed"
+	Kind string
+	Path string
+	// Detail tells what changed
+	Detail string
+}
+
+// diffDirs compares the decrypted trees of CIPHERDIR and the second argument
+// and prints the differences. DIR_B is unlocked with its own
+// gocryptfs.conf, and with the password of CIPHERDIR unless
+// "-diff-passfile" is set.
+// This is called when you pass "-diff".
+func diffDirs(args *argContainer, password string) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-diff is not supported in reverse mode")
+		return exitcodes.Usage
+	}
+	argsB := *args
+	argsB.cipherdir = args._flagSet.Arg(1)
+	if cryptfile.StorageScheme(argsB.cipherdir) != "" {
+		argsB.config = argsB.cipherdir + "/" + configfile.ConfDefaultName
+	} else {
+		argsB.cipherdir, _ = filepath.Abs(argsB.cipherdir)
+		if err := isDir(argsB.cipherdir); err != nil {
+			tlog.Fatal.Printf("Invalid DIR_B: %v", err)
+			return exitcodes.CipherDir
+		}
+		argsB.config = filepath.Join(argsB.cipherdir, configfile.ConfDefaultName)
+	}
+	keysA := openKeys(args, password)
+	defer keysA.Wipe()
+	keysB := keysA
+	if !args.zerokey && args.masterkey == "" && !sameFile(args.config, argsB.config) {
+		if args.diffPassfile != "" {
+			argsB.passfile = multipleStrings{args.diffPassfile}
+			argsB.extpass = nil
+			argsB._passwordProvider = nil
+			password = ""
+		}
+		tlog.Info.Printf("Unlocking %s", argsB.cipherdir)
+		keysB = openKeys(&argsB, password)
+		defer keysB.Wipe()
+	}
+	a := &diffSide{cipherdir: args.cipherdir, keys: keysA, fsys: keysA.NewFS(args.cipherdir)}
+	b := &diffSide{cipherdir: argsB.cipherdir, keys: keysB, fsys: keysB.NewFS(argsB.cipherdir)}
+	errs := a.list() + b.list()
+	changes, n := diffTrees(a, b)
+	errs += n
+	var added, removed, changed int
+	for _, c := range changes {
+		switch c.Kind {
+		case "added":
+			added++
+		case "removed":
+			removed++
+		default:
+			changed++
+		}
+		if c.Detail != "" {
+			fmt.Printf("%-8s %s (%s)\n", c.Kind, c.Path, c.Detail)
+		} else {
+			fmt.Printf("%-8s %s\n", c.Kind, c.Path)
+		}
+	}
+	tlog.Info.Printf("%d added, %d removed, %d changed, %d errors", added, removed, changed, errs)
+	if errs > 0 {
+		return exitcodes.Other
+	}
+	if len(changes) > 0 {
+		return exitcodes.DiffFound
+	}
+	return 0
+}
+
+// sameFile returns true if the files "a" and "b" have the same content.
+// Copies of a CIPHERDIR share the master key then, and it is only
+// decrypted once.
+func sameFile(a string, b string) bool {
+	ca, errA := cryptfile.ReadStorageFile(a)
+	cb, errB := cryptfile.ReadStorageFile(b)
+	return errA == nil && errB == nil && bytes.Equal(ca, cb)
+}
+
+// list walks the tree and fills s.entries. Returns the number of errors,
+// which are printed as warnings.
+func (s *diffSide) list() (errs int) {
+	s.entries = make(map[string]fs.FileInfo)
+	fs.WalkDir(s.fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			tlog.Warn.Printf("%s: %v", s.cipherdir, err)
+			errs++
+			return nil
+		}
+		if path == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			tlog.Warn.Printf("%s: %s: %v", s.cipherdir, path, err)
+			errs++
+			return nil
+		}
+		s.entries[path] = info
+		return nil
+	})
+	return errs
+}
+
+// diffTrees compares the listed trees "a" and "b". Directories that only
+// exist on one side are reported without their contents. Returns the
+// changes sorted by path and the number of errors.
+func diffTrees(a *diffSide, b *diffSide) (changes []diffChange, errs int) {
+	var paths []string
+	for p := range a.entries {
+		paths = append(paths, p)
+	}
+	for p := range b.entries {
+		if _, ok := a.entries[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	// skip is a directory that only exists on one side
+	skip := ""
+	for _, p := range paths {
+		if skip != "" && strings.HasPrefix(p, skip+"/") {
+			continue
+		}
+		ea, inA := a.entries[p]
+		eb, inB := b.entries[p]
+		if !inA || !inB {
+			kind, e := "added", eb
+			if !inB {
+				kind, e = "removed", ea
+			}
+			if e.IsDir() {
+				skip = p
+			}
+			changes = append(changes, diffChange{Kind: kind, Path: p})
+			continue
+		}
+		detail, err := diffEntry(a, b, p, ea, eb)
+		if err != nil {
+			tlog.Warn.Printf("%s: %v", p, err)
+			errs++
+			continue
+		}
+		if detail != "" {
+			changes = append(changes, diffChange{Kind: "changed", Path: p, Detail: detail})
+		}
+	}
+	return changes, errs
+}
+
+// diffEntry compares the path "p", which exists on both sides, and
+// describes the difference. Returns "" if there is none.
+func diffEntry(a *diffSide, b *diffSide, p string, ea fs.FileInfo, eb fs.FileInfo) (string, error) {
+	ta, tb := ea.Mode().Type(), eb.Mode().Type()
+	if ta != tb {
+		return fmt.Sprintf("%s -> %s", diffTypeName(ta), diffTypeName(tb)), nil
+	}
+	switch {
+	case ea.Mode().IsRegular():
+		if ea.Size() != eb.Size() {
+			return fmt.Sprintf("size %d -> %d", ea.Size(), eb.Size()), nil
+		}
+		ha, err := diffHash(a.fsys, p)
+		if err != nil {
+			return "", err
+		}
+		hb, err := diffHash(b.fsys, p)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(ha, hb) {
+			return "content", nil
+		}
+	case ta == fs.ModeSymlink:
+		la, err := a.keys.Readlink(a.cipherdir, p)
+		if err != nil {
+			return "", err
+		}
+		lb, err := b.keys.Readlink(b.cipherdir, p)
+		if err != nil {
+			return "", err
+		}
+		if la != lb {
+			return fmt.Sprintf("target %q -> %q", la, lb), nil
+		}
+	}
+	return "", nil
+}
+
+// diffHash returns the SHA256 of the plaintext of "p"
+func diffHash(fsys fs.FS, p string) ([]byte, error) {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func diffTypeName(t fs.FileMode) string {
+	switch t {
+	case 0:
+		return "file"
+	case fs.ModeDir:
+		return "directory"
+	case fs.ModeSymlink:
+		return "symlink"
+	case fs.ModeNamedPipe:
+		return "fifo"
+	case fs.ModeSocket:
+		return "socket"
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+		return "device"
+	}
+	return t.String()
+}
@@ -0,0 +1,104 @@
+//go:build go1.16
+// +build go1.16
+
+package gocryptfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+)
+
+// newDiffSide creates a CIPHERDIR below "dir" with its own password and
+// the directories and files in "tree". Directories end in "/".
+func newDiffSide(t *testing.T, dir string, password string, tree map[string]string) *diffSide {
+	mkdirIV(t, dir)
+	conf := filepath.Join(dir, configfile.ConfDefaultName)
+	err := configfile.Create(conf, []byte(password), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := cryptfile.Open(conf, []byte(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for p := range tree {
+		paths = append(paths, p)
+	}
+	// Parents first
+	sort.Strings(paths)
+	for _, p := range paths {
+		if strings.HasSuffix(p, "/") {
+			err = k.Mkdir(dir, strings.TrimSuffix(p, "/"), 0700)
+		} else {
+			err = k.WriteFile(dir, p, strings.NewReader(tree[p]), 0600)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+	}
+	s := &diffSide{cipherdir: dir, keys: k, fsys: k.NewFS(dir)}
+	if errs := s.list(); errs != 0 {
+		t.Fatalf("%d errors listing %s", errs, dir)
+	}
+	return s
+}
+
+func TestDiffTrees(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := newDiffSide(t, dir+"/a", "test", map[string]string{
+		"same":       "hello",
+		"size":       "hello",
+		"content":    "hello",
+		"removed":    "x",
+		"gone/":      "",
+		"gone/child": "x",
+		"kind":       "x",
+		"dir/":       "",
+		"dir/nested": "1",
+	})
+	defer a.keys.Wipe()
+	b := newDiffSide(t, dir+"/b", "other", map[string]string{
+		"same":       "hello",
+		"size":       "hello!",
+		"content":    "jello",
+		"kind/":      "",
+		"new/":       "",
+		"new/child":  "x",
+		"dir/":       "",
+		"dir/nested": "2",
+	})
+	defer b.keys.Wipe()
+	changes, errs := diffTrees(a, b)
+	if errs != 0 {
+		t.Errorf("%d errors", errs)
+	}
+	want := []diffChange{
+		{"changed", "content", "content"},
+		{"changed", "dir/nested", "content"},
+		{"removed", "gone", ""},
+		{"changed", "kind", "file -> directory"},
+		{"added", "new", ""},
+		{"removed", "removed", ""},
+		{"changed", "size", "size 5 -> 6"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("want %v\nhave %v", want, changes)
+	}
+	// A tree does not differ from itself
+	if changes, _ := diffTrees(a, a); len(changes) != 0 {
+		t.Errorf("diff with itself: %v", changes)
+	}
+}
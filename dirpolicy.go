@@ -0,0 +1,116 @@
+package gocryptfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/ctlsocksrv"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// initDirPolicies creates the directories of "-passthrough-dir" and
+// "-plaintextnames-dir" in the new CIPHERDIR and enables the "DirPolicy"
+// feature flag
+func initDirPolicies(args *argContainer, keys *cryptfile.Keys) error {
+	for _, p := range args.passthroughDir {
+		if err := mkdirPolicy(args.cipherdir, keys, p, nametransform.DirPolicyPassthrough); err != nil {
+			return fmt.Errorf("-passthrough-dir %q: %v", p, err)
+		}
+	}
+	for _, p := range args.plaintextnamesDir {
+		if err := mkdirPolicy(args.cipherdir, keys, p, nametransform.DirPolicyPlaintextNames); err != nil {
+			return fmt.Errorf("-plaintextnames-dir %q: %v", p, err)
+		}
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		return err
+	}
+	cf.SetFeatureFlag(configfile.FlagDirPolicy)
+	return cf.WriteFile()
+}
+
+// mkdirPolicy creates the directory "plainPath" with the directory policy
+// "policy". Missing parent directories are created as normal encrypted
+// directories.
+func mkdirPolicy(cipherdir string, keys *cryptfile.Keys, plainPath string, policy string) error {
+	clean := ctlsocksrv.SanitizePath(plainPath)
+	if clean == "" {
+		return syscall.EINVAL
+	}
+	dir := cipherdir
+	parts := strings.Split(clean, "/")
+	for i, name := range parts {
+		iv, err := cryptfile.ReadDirIV(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("policies cannot be nested")
+			}
+			return err
+		}
+		cName, longName, err := keys.EncryptName(name, iv)
+		if err != nil {
+			return err
+		}
+		if longName != "" {
+			return syscall.ENAMETOOLONG
+		}
+		dir = filepath.Join(dir, cName)
+		last := i == len(parts)-1
+		err = os.Mkdir(dir, 0755)
+		if os.IsExist(err) && !last {
+			continue
+		} else if err != nil {
+			return err
+		}
+		fd, err := syscall.Open(dir, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		if last {
+			err = nametransform.WriteDirPolicyAt(fd, policy)
+		} else {
+			err = nametransform.WriteDirIVAt(fd)
+		}
+		syscall.Close(fd)
+		if err != nil {
+			return err
+		}
+	}
+	tlog.Info.Printf("Created %s directory %q", policy, clean)
+	return nil
+}
+
+// enableDirPolicies sets the "DirPolicy" feature flag in the config file of
+// a mounted filesystem, so that older versions of gocryptfs refuse to mount
+// it instead of failing on the policy directories. "k" is nil if the
+// filesystem has no config file.
+func (k *configKeys) enableDirPolicies() error {
+	if k == nil {
+		return syscall.ENOTSUP
+	}
+	k.writeLock.Lock()
+	defer k.writeLock.Unlock()
+	cf, err := configfile.Load(k.args.config)
+	if err != nil {
+		return err
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		return syscall.ENOTSUP
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagDirPolicy) {
+		return nil
+	}
+	cf.SetFeatureFlag(configfile.FlagDirPolicy)
+	if err := cf.WriteFile(); err != nil {
+		return err
+	}
+	tlog.Info.Printf("ctlsock: enabled feature flag %q", "DirPolicy")
+	return nil
+}
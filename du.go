@@ -0,0 +1,201 @@
+package gocryptfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/lease"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// duStats are the apparent sizes and entry counts of a directory tree
+type duStats struct {
+	// PlainBytes is the plaintext size of the regular files
+	PlainBytes int64
+	// CipherBytes is the ciphertext size of the regular files
+	CipherBytes int64
+	// MetaBytes is the size of the gocryptfs.diriv, gocryptfs.longname.*.name
+	// and config files, which have no plaintext counterpart
+	MetaBytes int64
+	Files     int
+	Dirs      int
+	Symlinks  int
+	DirIVs    int
+	LongNames int
+}
+
+func (s *duStats) add(o *duStats) {
+	s.PlainBytes += o.PlainBytes
+	s.CipherBytes += o.CipherBytes
+	s.MetaBytes += o.MetaBytes
+	s.Files += o.Files
+	s.Dirs += o.Dirs
+	s.Symlinks += o.Symlinks
+	s.DirIVs += o.DirIVs
+	s.LongNames += o.LongNames
+}
+
+// overhead returns the size of the ciphertext tree relative to the plaintext
+// tree, in percent
+func (s *duStats) overhead() float64 {
+	if s.PlainBytes == 0 {
+		return 0
+	}
+	return float64(s.CipherBytes+s.MetaBytes-s.PlainBytes) * 100 / float64(s.PlainBytes)
+}
+
+// duDir are the totals of a directory, including its subdirectories
+type duDir struct {
+	// Path is the plaintext path, "." for the root directory
+	Path string
+	duStats
+}
+
+// duWalker collects the per-directory totals of a CIPHERDIR
+type duWalker struct {
+	keys *cryptfile.Keys
+	dirs []duDir
+	// Inode numbers of hard-linked files that we have already counted
+	seenInodes map[uint64]struct{}
+}
+
+// diskUsage walks "cipherdir" and returns the totals of each directory, the
+// root directory first and the others sorted by plaintext path. Directories
+// that cannot be read are skipped with a warning.
+func diskUsage(cipherdir string, keys *cryptfile.Keys) ([]duDir, error) {
+	w := duWalker{keys: keys, seenInodes: make(map[uint64]struct{})}
+	if _, err := w.dir(cipherdir, ".", true); err != nil {
+		return nil, err
+	}
+	sort.Slice(w.dirs, func(i, j int) bool {
+		pi, pj := w.dirs[i].Path, w.dirs[j].Path
+		// Names like "-x" sort before "."
+		return pi != pj && (pi == "." || (pj != "." && pi < pj))
+	})
+	return w.dirs, nil
+}
+
+// dir walks the ciphertext directory "cDir" with the plaintext path "path"
+// and returns its totals
+func (w *duWalker) dir(cDir string, path string, isRoot bool) (s duStats, err error) {
+	s.Dirs = 1
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		return s, err
+	}
+	var iv []byte
+	if !w.keys.PlaintextNames() {
+		// Without a valid diriv, the names cannot be decrypted and the
+		// ciphertext names are used
+		iv, _ = cryptfile.ReadDirIV(cDir)
+	}
+	for _, e := range entries {
+		cName := e.Name()
+		cPath := filepath.Join(cDir, cName)
+		switch {
+		case isRoot && cName == configfile.ConfDefaultName:
+			s.MetaBytes += e.Size()
+			continue
+		case !w.keys.PlaintextNames() && cName == nametransform.DirIVFilename:
+			s.DirIVs++
+			s.MetaBytes += e.Size()
+			continue
+		case !w.keys.PlaintextNames() && lease.IsLeaseFile(cName):
+			// "-sharedstorage" lease
+			s.MetaBytes += e.Size()
+			continue
+		case !w.keys.PlaintextNames() && nametransform.NameType(cName) == nametransform.LongNameFilename:
+			s.LongNames++
+			s.MetaBytes += e.Size()
+			continue
+		case !w.keys.PlaintextNames() && nametransform.IsLongTarget(cName):
+			// Target of a symlink
+			s.MetaBytes += e.Size()
+			continue
+		}
+		switch {
+		case e.IsDir():
+			name := w.decryptName(cDir, cName, iv)
+			sub, err := w.dir(cPath, filepath.Join(path, name), false)
+			if err != nil {
+				tlog.Warn.Printf("du: skipping %q: %v", filepath.Join(path, name), err)
+			}
+			s.add(&sub)
+		case e.Mode().IsRegular():
+			if st, ok := e.Sys().(*syscall.Stat_t); ok && uint64(st.Nlink) > 1 {
+				if _, seen := w.seenInodes[uint64(st.Ino)]; seen {
+					continue
+				}
+				w.seenInodes[uint64(st.Ino)] = struct{}{}
+			}
+			s.Files++
+			s.CipherBytes += e.Size()
+			s.PlainBytes += w.keys.PlainSize(e.Size())
+		case e.Mode()&os.ModeSymlink != 0:
+			s.Symlinks++
+		}
+	}
+	w.dirs = append(w.dirs, duDir{Path: path, duStats: s})
+	return s, nil
+}
+
+// decryptName returns the plaintext name of the entry "cName" of "cDir", or
+// "cName" if it cannot be decrypted
+func (w *duWalker) decryptName(cDir string, cName string, iv []byte) string {
+	if w.keys.PlaintextNames() {
+		return cName
+	}
+	encName := cName
+	if nametransform.NameType(cName) == nametransform.LongNameContent {
+		content, err := ioutil.ReadFile(filepath.Join(cDir, cName+nametransform.LongNameSuffix))
+		if err != nil {
+			return cName
+		}
+		encName = string(content)
+	}
+	name, err := w.keys.DecryptName(encName, iv)
+	if err != nil {
+		return cName
+	}
+	return name
+}
+
+// du prints the plaintext and ciphertext sizes of each directory of
+// CIPHERDIR and explains where the overhead comes from.
+// This is called when you pass "-du".
+func du(args *argContainer, password string) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-du is not supported in reverse mode")
+		return exitcodes.Usage
+	}
+	keys := openKeys(args, password)
+	defer keys.Wipe()
+	dirs, err := diskUsage(args.cipherdir, keys)
+	if err != nil {
+		tlog.Fatal.Printf("du: %v", err)
+		return exitcodes.CipherDir
+	}
+	fmt.Printf("%10s %10s %9s  %s\n", "PLAIN", "CIPHER", "OVERHEAD", "PATH")
+	for _, d := range dirs {
+		fmt.Printf("%10s %10s %+8.1f%%  %s\n", formatBytes(d.PlainBytes),
+			formatBytes(d.CipherBytes+d.MetaBytes), d.overhead(), d.Path)
+	}
+	// The root directory comes first and contains everything
+	t := dirs[0]
+	fmt.Printf("\n%d files, %d directories, %d symlinks (apparent sizes, hard links counted once)\n",
+		t.Files, t.Dirs, t.Symlinks)
+	fmt.Printf("Plaintext size:  %s\n", formatBytes(t.PlainBytes))
+	fmt.Printf("Ciphertext size: %s (%+.1f%%)\n", formatBytes(t.CipherBytes+t.MetaBytes), t.overhead())
+	fmt.Printf("  file headers and per-block IVs and MACs: %s\n", formatBytes(t.CipherBytes-t.PlainBytes))
+	fmt.Printf("  metadata (%d gocryptfs.diriv files, %d long name files, config file): %s\n",
+		t.DirIVs, t.LongNames, formatBytes(t.MetaBytes))
+	return 0
+}
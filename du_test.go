@@ -0,0 +1,92 @@
+package gocryptfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// mkdirIV creates the directory "dir" with a gocryptfs.diriv file
+func mkdirIV(t *testing.T, dir string) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := nametransform.WriteDirIVAt(int(d.Fd())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "du_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, configfile.ConfDefaultName)
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := cryptfile.Open(conf, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Wipe()
+	mkdirIV(t, dir)
+	iv, err := cryptfile.ReadDirIV(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cName, _, err := k.EncryptName("d", iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkdirIV(t, filepath.Join(dir, cName))
+	files := map[string][]byte{
+		"a":                             bytes.Repeat([]byte("a"), 10000),
+		"d/" + strings.Repeat("l", 200): []byte("long"),
+	}
+	for p, content := range files {
+		if err := k.WriteFile(dir, p, bytes.NewReader(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A hard link is counted once
+	cA, _, _ := k.EncryptName("a", iv)
+	if err := os.Link(filepath.Join(dir, cA), filepath.Join(dir, "hardlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	dirs, err := diskUsage(dir, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 2 || dirs[0].Path != "." || dirs[1].Path != "d" {
+		t.Fatalf("wrong directories: %+v", dirs)
+	}
+	root := dirs[0]
+	if root.PlainBytes != 10004 || root.Files != 2 || root.Dirs != 2 {
+		t.Errorf("wrong root totals: %+v", root)
+	}
+	if root.CipherBytes <= root.PlainBytes {
+		t.Errorf("ciphertext should be larger: %+v", root)
+	}
+	if root.DirIVs != 2 || root.LongNames != 1 || dirs[1].DirIVs != 1 || dirs[1].LongNames != 1 {
+		t.Errorf("wrong metadata counts: %+v %+v", root, dirs[1])
+	}
+	if dirs[1].PlainBytes != 4 {
+		t.Errorf("wrong totals of d: %+v", dirs[1])
+	}
+}
@@ -8,12 +8,18 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	fscklib "github.com/HorizonLiu/gocryptfs/fsck"
 	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
 	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
 	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
@@ -28,23 +34,89 @@ type fsckObj struct {
 	corruptList []string
 	// List of skipped files
 	skippedList []string
+	// List of repaired directories and files ("-repair")
+	repairedList []string
+	// repair missing gocryptfs.diriv files and orphaned longname files?
+	repair bool
 	// Protects corruptList
 	listLock sync.Mutex
-	// stop a running watchMitigatedCorruptions thread
+	// watchLock protects watchKind, watchPath and inFlight
+	watchLock sync.Mutex
+	// watchKind and watchPath tell watchMitigatedCorruptions() what the
+	// directory walker is doing
+	watchKind int
+	watchPath string
+	// inFlight maps the inode numbers of the files the workers are reading
+	// to their paths
+	inFlight map[uint64]string
+	// watchBarrier makes sure that watchMitigatedCorruptions() has handled
+	// all corruptions reported during a call, see watchEnd()
+	watchBarrier chan struct{}
+	// stop the watchMitigatedCorruptions thread
 	watchDone chan struct{}
-	// Inode numbers of hard-linked files (Nlink > 1) that we have already checked
+	// Inode numbers of hard-linked files (Nlink > 1) that we have already
+	// checked. Only used by the directory walker.
 	seenInodes map[uint64]struct{}
+	// jobs passes regular files from the directory walker to the workers
+	jobs chan fsckJob
+	// checked and bytes count the checked entries and plaintext bytes.
+	// Accessed atomically.
+	checked int64
+	bytes   int64
+	// progress is nil with "-q"
+	progress *progressLine
+	// watermark finds the path up to which everything has been checked
+	watermark walkWatermark
+	// resumeDone is the "Done" path of the checkpoint we resume from
+	resumeDone string
 	// abort the running fsck operation? Checked in a few long-running loops.
-	abort bool
+	// Accessed atomically.
+	abort int32
 }
 
+// fsckJob is a regular file that a worker should read
+type fsckJob struct {
+	relPath string
+	ino     uint64
+	// n is the number of the entry in walk order
+	n uint64
+}
+
+// What the directory walker is doing, for watchMitigatedCorruptions()
+const (
+	watchNone = iota
+	watchOpenDir
+	watchListXAttr
+)
+
+// inoMask keeps the inode number of the backing file, which
+// fusefrontend reports for corrupt files, from the inode number in the
+// mount. See the inomap package.
+const inoMask = 1<<48 - 1
+
 func runsAsRoot() bool {
 	return syscall.Geteuid() == 0
 }
 
+func (ck *fsckObj) aborted() bool {
+	return atomic.LoadInt32(&ck.abort) != 0
+}
+
 func (ck *fsckObj) markCorrupt(path string) {
 	ck.listLock.Lock()
+	defer ck.listLock.Unlock()
+	// A broken longname file is also reported when the directory is read
+	for _, p := range ck.corruptList {
+		if p == path {
+			return
+		}
+	}
 	ck.corruptList = append(ck.corruptList, path)
+}
+
+func (ck *fsckObj) markRepaired(path string) {
+	ck.listLock.Lock()
+	ck.repairedList = append(ck.repairedList, path)
 	ck.listLock.Unlock()
 }
 
@@ -54,31 +126,190 @@ func (ck *fsckObj) markSkipped(path string) {
 	ck.listLock.Unlock()
 }
 
+// updateProgress passes the counters to the progress line, if any
+func (ck *fsckObj) updateProgress(relPath string) {
+	if ck.progress == nil {
+		return
+	}
+	ck.progress.update(fscklib.Progress{
+		Path:    relPath,
+		Checked: int(atomic.LoadInt64(&ck.checked)),
+		Bytes:   atomic.LoadInt64(&ck.bytes),
+	})
+}
+
+// finish marks entry "n" in walk order, "relPath", as checked
+func (ck *fsckObj) finish(n uint64, relPath string) {
+	atomic.AddInt64(&ck.checked, 1)
+	ck.watermark.finish(n, relPath)
+	ck.updateProgress(relPath)
+}
+
+// checkpoint returns the state to save for "-fsck-checkpoint"
+func (ck *fsckObj) checkpoint(cipherdir string) *fsckCheckpoint {
+	ck.listLock.Lock()
+	defer ck.listLock.Unlock()
+	return &fsckCheckpoint{
+		Cipherdir: cipherdir,
+		Done:      ck.watermark.get(),
+		Checked:   atomic.LoadInt64(&ck.checked),
+		Bytes:     atomic.LoadInt64(&ck.bytes),
+		Corrupt:   append([]string(nil), ck.corruptList...),
+		Skipped:   append([]string(nil), ck.skippedList...),
+		Repaired:  append([]string(nil), ck.repairedList...),
+	}
+}
+
+// resume restores the state from checkpoint "c"
+func (ck *fsckObj) resume(c *fsckCheckpoint) {
+	ck.resumeDone = c.Done
+	ck.watermark.done = c.Done
+	ck.checked = c.Checked
+	ck.bytes = c.Bytes
+	ck.corruptList = c.Corrupt
+	ck.skippedList = c.Skipped
+	ck.repairedList = c.Repaired
+}
+
+// fsckLostFound is where "-repair" moves the entries that cannot be
+// decrypted any more
+const fsckLostFound = "lost+found"
+
+// dirIV checks the gocryptfs.diriv of "relPath" and, with "-repair",
+// replaces it if it is broken. Returns false if the directory cannot be
+// read.
+func (ck *fsckObj) dirIV(relPath string) bool {
+	problem, err := ck.rootNode.CheckDirIV(relPath)
+	if err != nil || problem == "" {
+		// Errors are reported when the directory is opened
+		return true
+	}
+	fmt.Printf("fsck: dir %q: %s\n", relPath, problem)
+	if !ck.repair {
+		ck.markCorrupt(relPath)
+		return false
+	}
+	moved, err := ck.rootNode.RepairDirIV(relPath, fsckLostFound)
+	if err != nil {
+		fmt.Printf("fsck: repairing dir %q failed: %v\n", relPath, err)
+		ck.markCorrupt(relPath)
+		return false
+	}
+	for _, m := range moved {
+		fmt.Printf("fsck: moved undecryptable entry to %q\n", m)
+	}
+	ck.markRepaired(relPath)
+	return true
+}
+
+// longNames cross-checks the gocryptfs.longname.* files of "relPath"
+// against their ".name" files and, with "-repair", deletes the orphans and
+// moves the content files whose name is lost to lost+found.
+func (ck *fsckObj) longNames(relPath string) {
+	problems, err := ck.rootNode.CheckLongNames(relPath)
+	if err != nil {
+		// Reported when the directory is opened
+		return
+	}
+	for _, p := range problems {
+		cPath := filepath.Join(relPath, p.CName)
+		fmt.Printf("fsck: dir %q: %q: %s\n", relPath, p.CName, p.Problem)
+		if !ck.repair {
+			ck.markCorrupt(cPath)
+			continue
+		}
+		done, err := ck.rootNode.RepairLongName(relPath, p, fsckLostFound)
+		if err != nil {
+			fmt.Printf("fsck: repairing %q failed: %v\n", cPath, err)
+			ck.markCorrupt(cPath)
+			continue
+		}
+		fmt.Printf("fsck: %q: %s\n", cPath, done)
+		ck.markRepaired(cPath)
+	}
+}
+
 func (ck *fsckObj) abs(relPath string) (absPath string) {
 	return filepath.Join(ck.mnt, relPath)
 }
 
-// Watch for mitigated corruptions that occur during OpenDir()
-func (ck *fsckObj) watchMitigatedCorruptionsOpenDir(path string) {
+// watchMitigatedCorruptions reads the corruptions that fusefrontend
+// mitigated transparently and attributes them to the file a worker is
+// reading, or to what the directory walker is doing.
+func (ck *fsckObj) watchMitigatedCorruptions() {
 	for {
 		select {
 		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt entry in dir %q: %q\n", path, item)
-			ck.markCorrupt(filepath.Join(path, item))
+			ck.mitigatedCorruption(item)
+		case <-ck.watchBarrier:
 		case <-ck.watchDone:
 			return
 		}
 	}
 }
 
+func (ck *fsckObj) mitigatedCorruption(item string) {
+	ck.watchLock.Lock()
+	kind, path := ck.watchKind, ck.watchPath
+	var file string
+	if ino, err := strconv.ParseUint(item, 10, 64); err == nil {
+		file = ck.inFlight[ino&inoMask]
+		if file == "" && len(ck.inFlight) == 1 && kind == watchNone {
+			for _, f := range ck.inFlight {
+				file = f
+			}
+		}
+	}
+	ck.watchLock.Unlock()
+	switch {
+	case file != "":
+		fmt.Printf("fsck: corrupt file %q (inode %s)\n", file, item)
+		ck.markCorrupt(file)
+	case kind == watchOpenDir:
+		fmt.Printf("fsck: corrupt entry in dir %q: %q\n", path, item)
+		ck.markCorrupt(filepath.Join(path, item))
+	case kind == watchListXAttr:
+		fmt.Printf("fsck: corrupt xattr name on file %q: %q\n", path, item)
+		ck.markCorrupt(path + " xattr:" + item)
+	default:
+		fmt.Printf("fsck: corrupt file (inode %s)\n", item)
+		ck.markCorrupt("inode " + item)
+	}
+}
+
+// watchStart tells watchMitigatedCorruptions() that the directory walker
+// calls OpenDir() or ListXAttr() on "relPath"
+func (ck *fsckObj) watchStart(kind int, relPath string) {
+	ck.watchLock.Lock()
+	ck.watchKind, ck.watchPath = kind, relPath
+	ck.watchLock.Unlock()
+}
+
+// watchEnd is called when the call is done. Reporting a corruption blocks
+// until watchMitigatedCorruptions() has received it, so once it has also
+// received from watchBarrier, it has handled everything reported during
+// the call.
+func (ck *fsckObj) watchEnd() {
+	ck.watchBarrier <- struct{}{}
+	ck.watchLock.Lock()
+	ck.watchKind, ck.watchPath = watchNone, ""
+	ck.watchLock.Unlock()
+}
+
 // Recursively check dir for corruption
 func (ck *fsckObj) dir(relPath string) {
-	tlog.Debug.Printf("ck.dir %q\n", relPath)
+	tlog.Debug.Printf("ck.dir %q\n", tlog.PlainName(relPath))
+	n := ck.watermark.start()
+	if !ck.dirIV(relPath) {
+		ck.finish(n, relPath)
+		return
+	}
+	ck.longNames(relPath)
 	ck.xattrs(relPath)
 	// Run OpenDir and catch transparently mitigated corruptions
-	go ck.watchMitigatedCorruptionsOpenDir(relPath)
+	ck.watchStart(watchOpenDir, relPath)
 	f, err := os.Open(ck.abs(relPath))
-	ck.watchDone <- struct{}{}
+	ck.watchEnd()
 	if err != nil {
 		fmt.Printf("fsck: error opening dir %q: %v\n", relPath, err)
 		if err == os.ErrPermission && !runsAsRoot() {
@@ -86,39 +317,58 @@ func (ck *fsckObj) dir(relPath string) {
 		} else {
 			ck.markCorrupt(relPath)
 		}
+		ck.finish(n, relPath)
 		return
 	}
-	go ck.watchMitigatedCorruptionsOpenDir(relPath)
+	ck.watchStart(watchOpenDir, relPath)
 	entries, err := f.Readdirnames(0)
-	ck.watchDone <- struct{}{}
+	ck.watchEnd()
+	f.Close()
+	ck.finish(n, relPath)
 	if err != nil {
 		fmt.Printf("fsck: error reading dir %q: %v\n", relPath, err)
 		ck.markCorrupt(relPath)
 		return
 	}
+	// Sorted, so that "-fsck-checkpoint" can tell which entries are done
+	sort.Strings(entries)
 	for _, entry := range entries {
-		if ck.abort {
+		if ck.aborted() {
 			return
 		}
 		if entry == "." || entry == ".." {
 			continue
 		}
 		nextPath := filepath.Join(relPath, entry)
+		if relPath == "" && ck.rootNode.IsLockedTenant(entry) {
+			if !fsckSkipDone(nextPath, true, ck.resumeDone) {
+				fmt.Printf("fsck: skipping locked tenant %q\n", entry)
+				ck.markSkipped(nextPath)
+			}
+			continue
+		}
 		var st syscall.Stat_t
 		err := syscall.Lstat(ck.abs(nextPath), &st)
 		if err != nil {
-			ck.markCorrupt(filepath.Join(relPath, entry))
+			if !fsckSkipDone(nextPath, false, ck.resumeDone) {
+				ck.markCorrupt(filepath.Join(relPath, entry))
+			}
 			continue
 		}
 		filetype := st.Mode & syscall.S_IFMT
+		if fsckSkipDone(nextPath, filetype == syscall.S_IFDIR, ck.resumeDone) {
+			continue
+		}
 		//fmt.Printf("  %q %x\n", entry.Name, entry.Mode)
 		switch filetype {
 		case syscall.S_IFDIR:
 			ck.dir(nextPath)
 		case syscall.S_IFREG:
-			ck.file(nextPath)
+			ck.file(nextPath, &st)
 		case syscall.S_IFLNK:
+			n := ck.watermark.start()
 			ck.symlink(nextPath)
+			ck.finish(n, nextPath)
 		case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFBLK, syscall.S_IFCHR:
 			// nothing to check
 		default:
@@ -135,38 +385,37 @@ func (ck *fsckObj) symlink(relPath string) {
 	}
 }
 
-// Watch for mitigated corruptions that occur during Read()
-func (ck *fsckObj) watchMitigatedCorruptionsRead(path string) {
-	for {
-		select {
-		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt file %q (inode %s)\n", path, item)
-			ck.markCorrupt(path)
-		case <-ck.watchDone:
-			return
-		}
-	}
-}
-
-// Check file for corruption
-func (ck *fsckObj) file(relPath string) {
-	tlog.Debug.Printf("ck.file %q\n", relPath)
-	var st syscall.Stat_t
-	err := syscall.Lstat(ck.abs(relPath), &st)
-	if err != nil {
-		ck.markCorrupt(relPath)
-		fmt.Printf("fsck: error stating file %q: %v\n", relPath, err)
-		return
-	}
+// file checks the xattrs of the regular file "relPath" and passes it to the
+// workers to read its content
+func (ck *fsckObj) file(relPath string, st *syscall.Stat_t) {
+	tlog.Debug.Printf("ck.file %q\n", tlog.PlainName(relPath))
 	if st.Nlink > 1 {
 		// Due to hard links, we may have already checked this file.
 		if _, ok := ck.seenInodes[st.Ino]; ok {
-			tlog.Debug.Printf("ck.file : skipping %q (inode number %d already seen)\n", relPath, st.Ino)
+			tlog.Debug.Printf("ck.file : skipping %q (inode number %d already seen)\n", tlog.PlainName(relPath), st.Ino)
 			return
 		}
 		ck.seenInodes[st.Ino] = struct{}{}
 	}
+	n := ck.watermark.start()
 	ck.xattrs(relPath)
+	ck.jobs <- fsckJob{relPath: relPath, ino: st.Ino, n: n}
+}
+
+// fileContent reads through the whole file. Called by the workers.
+func (ck *fsckObj) fileContent(j fsckJob) {
+	relPath := j.relPath
+	defer ck.finish(j.n, relPath)
+	// Catch transparently mitigated corruptions
+	ck.watchLock.Lock()
+	ck.inFlight[j.ino&inoMask] = relPath
+	ck.watchLock.Unlock()
+	defer func() {
+		ck.watchBarrier <- struct{}{}
+		ck.watchLock.Lock()
+		delete(ck.inFlight, j.ino&inoMask)
+		ck.watchLock.Unlock()
+	}()
 	f, err := os.Open(ck.abs(relPath))
 	if err != nil {
 		fmt.Printf("fsck: error opening file %q: %v\n", relPath, err)
@@ -182,11 +431,8 @@ func (ck *fsckObj) file(relPath string) {
 	allZero := make([]byte, fuse.MAX_KERNEL_WRITE)
 	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
 	var off int64
-	// Read() through the whole file and catch transparently mitigated corruptions
-	go ck.watchMitigatedCorruptionsRead(relPath)
-	defer func() { ck.watchDone <- struct{}{} }()
 	for {
-		if ck.abort {
+		if ck.aborted() {
 			return
 		}
 		tlog.Debug.Printf("ck.file: read %d bytes from offset %d\n", len(buf), off)
@@ -198,9 +444,12 @@ func (ck *fsckObj) file(relPath string) {
 		}
 		// EOF
 		if err == io.EOF {
+			atomic.AddInt64(&ck.bytes, int64(n))
 			return
 		}
 		off += int64(n)
+		atomic.AddInt64(&ck.bytes, int64(n))
+		ck.updateProgress(relPath)
 		// If we seem to be in the middle of a file hole, try to skip to the next
 		// data section.
 		data := buf[:n]
@@ -209,31 +458,19 @@ func (ck *fsckObj) file(relPath string) {
 			const SEEK_DATA = 3
 			nextOff, err := syscall.Seek(int(f.Fd()), off, SEEK_DATA)
 			if err == nil {
+				atomic.AddInt64(&ck.bytes, nextOff-off)
 				off = nextOff
 			}
 		}
 	}
 }
 
-// Watch for mitigated corruptions that occur during ListXAttr()
-func (ck *fsckObj) watchMitigatedCorruptionsListXAttr(path string) {
-	for {
-		select {
-		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt xattr name on file %q: %q\n", path, item)
-			ck.markCorrupt(path + " xattr:" + item)
-		case <-ck.watchDone:
-			return
-		}
-	}
-}
-
 // Check xattrs on file/dir at path
 func (ck *fsckObj) xattrs(relPath string) {
 	// Run ListXAttr() and catch transparently mitigated corruptions
-	go ck.watchMitigatedCorruptionsListXAttr(relPath)
+	ck.watchStart(watchListXAttr, relPath)
 	attrs, err := syscallcompat.Llistxattr(ck.abs(relPath))
-	ck.watchDone <- struct{}{}
+	ck.watchEnd()
 	if err != nil {
 		fmt.Printf("fsck: error listing xattrs on %q: %v\n", relPath, err)
 		ck.markCorrupt(relPath)
@@ -253,12 +490,25 @@ func (ck *fsckObj) xattrs(relPath string) {
 	}
 }
 
+// fsckCheckpointInterval is how often "-fsck-checkpoint" is saved
+const fsckCheckpointInterval = 10 * time.Second
+
 // entrypoint from main()
 func fsck(args *argContainer, password string) (exitcode int) {
 	if args.reverse {
 		tlog.Fatal.Printf("Running -fsck with -reverse is not supported")
 		os.Exit(exitcodes.Usage)
 	}
+	cipherdir, _ := filepath.Abs(args.cipherdir)
+	var resumeFrom *fsckCheckpoint
+	if args.fsckCheckpoint != "" {
+		var err error
+		resumeFrom, err = loadFsckCheckpoint(args.fsckCheckpoint, cipherdir)
+		if err != nil {
+			tlog.Fatal.Printf("fsck: cannot resume: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	args.allow_other = false
 	var err error
 	args.mountpoint, err = ioutil.TempDir("", "gocryptfs.fsck.")
@@ -270,16 +520,32 @@ func fsck(args *argContainer, password string) (exitcode int) {
 	rn := pfs.(*fusefrontend.RootNode)
 	rn.MitigatedCorruptions = make(chan string)
 	ck := fsckObj{
-		mnt:        args.mountpoint,
-		rootNode:   rn,
-		watchDone:  make(chan struct{}),
-		seenInodes: make(map[uint64]struct{}),
+		mnt:          args.mountpoint,
+		rootNode:     rn,
+		inFlight:     make(map[uint64]string),
+		watchBarrier: make(chan struct{}),
+		watchDone:    make(chan struct{}),
+		seenInodes:   make(map[uint64]struct{}),
+		jobs:         make(chan fsckJob),
+		repair:       args.repair,
+	}
+	if resumeFrom != nil {
+		ck.resume(resumeFrom)
+		tlog.Info.Printf("fsck: resuming after %q", resumeFrom.Done)
 	}
 	if args.quiet {
 		// go-fuse throws a lot of these:
 		//   writer: Write/Writev failed, err: 2=no such file or directory. opcode: INTERRUPT
 		// This is ugly and causes failures in xfstests. Hide them away in syslog.
 		tlog.SwitchLoggerToSyslog()
+	} else {
+		ck.progress = newProgressLine("fsck", 0)
+		ck.progress.resumeAt(fscklib.Progress{Checked: int(ck.checked), Bytes: ck.bytes})
+		// Counting takes a while on big filesystems, start checking in the
+		// meantime
+		go func() {
+			ck.progress.setTotal(plaintextSize(args.cipherdir, rn.PlainSize, false))
+		}()
 	}
 	// GoCryptAPI
 	srv := initGoFuse(pfs, args)
@@ -287,9 +553,10 @@ func fsck(args *argContainer, password string) (exitcode int) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	signal.Notify(ch, syscall.SIGTERM)
+	defer signal.Stop(ch)
 	go func() {
 		<-ch
-		ck.abort = true
+		atomic.StoreInt32(&ck.abort, 1)
 	}()
 	defer func() {
 		err = srv.Unmount()
@@ -297,16 +564,74 @@ func fsck(args *argContainer, password string) (exitcode int) {
 			tlog.Warn.Printf("failed to unmount %q: %v", ck.mnt, err)
 		}
 	}()
+	go ck.watchMitigatedCorruptions()
+	workers := args.fsckWorkers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range ck.jobs {
+				ck.fileContent(j)
+			}
+		}()
+	}
+	// "-fsck-checkpoint"
+	saveDone := make(chan struct{})
+	if args.fsckCheckpoint != "" {
+		go func() {
+			t := time.NewTicker(fsckCheckpointInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					if err := ck.checkpoint(cipherdir).save(args.fsckCheckpoint); err != nil {
+						tlog.Warn.Printf("fsck: saving checkpoint: %v", err)
+					}
+				case <-saveDone:
+					return
+				}
+			}
+		}()
+	}
 	// Recursively check the root dir
-	ck.dir("")
+	if !fsckSkipDone("", true, ck.resumeDone) {
+		ck.dir("")
+	}
+	close(ck.jobs)
+	wg.Wait()
+	close(saveDone)
+	close(ck.watchDone)
+	if ck.progress != nil {
+		ck.progress.stop()
+	}
 	// Report results
 	wipeKeys()
-	if ck.abort {
+	if ck.aborted() {
+		if args.fsckCheckpoint != "" {
+			if err := ck.checkpoint(cipherdir).save(args.fsckCheckpoint); err != nil {
+				tlog.Warn.Printf("fsck: saving checkpoint: %v", err)
+			} else {
+				tlog.Info.Printf("fsck: aborted, run again with the same -fsck-checkpoint to resume")
+				return exitcodes.Other
+			}
+		}
 		tlog.Info.Printf("fsck: aborted")
 		return exitcodes.Other
 	}
+	if args.fsckCheckpoint != "" {
+		os.Remove(args.fsckCheckpoint)
+	}
+	if len(ck.repairedList) > 0 {
+		fmt.Printf("fsck: repaired %d problems, check %q\n", len(ck.repairedList), fsckLostFound)
+	}
 	if len(ck.corruptList) == 0 && len(ck.skippedList) == 0 {
-		tlog.Info.Printf("fsck summary: no problems found\n")
+		if len(ck.repairedList) == 0 {
+			tlog.Info.Printf("fsck summary: no problems found\n")
+		}
 		return 0
 	}
 	if len(ck.skippedList) > 0 {
@@ -0,0 +1,372 @@
+// Package fsck checks a gocryptfs filesystem for corruption and returns the
+// result as a Report.
+//
+// Unlike "gocryptfs -fsck", which mounts the filesystem and reads it through
+// FUSE, this package works directly on the ciphertext. It needs neither FUSE
+// nor root and can tell which blocks of a file are corrupt. Extended
+// attributes are not checked.
+package fsck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/journal"
+	"github.com/HorizonLiu/gocryptfs/internal/lease"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// Options configures Check()
+type Options struct {
+	// Progress, if not nil, is called before each file, directory or symlink
+	// is checked, and every few MiB while a file is read. Calls never
+	// overlap.
+	Progress func(p Progress)
+	// Workers is the number of files that are checked in parallel. Zero
+	// means one.
+	Workers int
+}
+
+// Progress describes the entry Check() is working on
+type Progress struct {
+	// Path is the plaintext path, relative to the root of the filesystem
+	Path string
+	// Checked is the number of entries that have been checked so far
+	Checked int
+	// Bytes is the number of plaintext bytes that have been verified so far
+	Bytes int64
+}
+
+// progressBlocks is the number of blocks between two Progress calls while a
+// file is read
+const progressBlocks = 256
+
+// BlockRange is a range of block numbers, "First" and "Last" included.
+// Block "n" contains the plaintext bytes starting at
+// n * cryptfile.Keys.PlainBlockSize().
+type BlockRange struct {
+	First uint64
+	Last  uint64
+}
+
+// FileError describes a corrupt file, directory or symlink
+type FileError struct {
+	// Path is the plaintext path, relative to the root of the filesystem.
+	// If the name could not be decrypted, the last element is the ciphertext
+	// name.
+	Path string
+	// CipherPath is the ciphertext path, relative to CIPHERDIR
+	CipherPath string
+	// Err describes the problem. For files with corrupt blocks, it is the
+	// error of the first corrupt block.
+	Err error
+	// CorruptBlocks lists the blocks that failed to decrypt
+	CorruptBlocks []BlockRange
+}
+
+func (e FileError) Error() string {
+	return fmt.Sprintf("%s (%s): %v", e.Path, e.CipherPath, e.Err)
+}
+
+// MarshalJSON encodes Err as its error message
+func (e FileError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Path          string
+		CipherPath    string
+		Err           string
+		CorruptBlocks []BlockRange `json:",omitempty"`
+	}{e.Path, e.CipherPath, e.Err.Error(), e.CorruptBlocks})
+}
+
+// Report is the result of Check()
+type Report struct {
+	// Files, Dirs and Symlinks count the checked entries. Hard-linked files
+	// are counted once.
+	Files    int
+	Dirs     int
+	Symlinks int
+	// Errors lists the corrupt entries
+	Errors []FileError
+	// OrphanedLongNames lists the ciphertext paths, relative to CIPHERDIR,
+	// of "gocryptfs.longname.*.name" files whose file is missing
+	OrphanedLongNames []string
+	// Skipped lists the plaintext paths that could not be checked because
+	// of missing permissions
+	Skipped []string
+}
+
+// OK returns true if no problems were found
+func (r *Report) OK() bool {
+	return len(r.Errors) == 0 && len(r.OrphanedLongNames) == 0 && len(r.Skipped) == 0
+}
+
+type checker struct {
+	ctx       context.Context
+	keys      *cryptfile.Keys
+	cipherdir string
+	opts      Options
+	// mu protects report and serializes the Progress calls
+	mu     sync.Mutex
+	report Report
+	// bytes is the number of plaintext bytes verified so far. Accessed
+	// atomically.
+	bytes int64
+	// Inode numbers of hard-linked files (Nlink > 1) that we have already checked.
+	// Only used by the directory walker.
+	seenInodes map[uint64]struct{}
+	// jobs passes regular files from the directory walker to the workers
+	jobs chan fileJob
+}
+
+// fileJob is a regular file that should be checked
+type fileJob struct {
+	path  string
+	cPath string
+	size  int64
+}
+
+// Check checks the forward-mode filesystem in "cipherdir" using "keys".
+// The lists in the report are sorted by ciphertext path.
+// Canceling "ctx" stops the check and returns the partial report together
+// with ctx.Err().
+func Check(ctx context.Context, cipherdir string, keys *cryptfile.Keys, opts Options) (*Report, error) {
+	ck := checker{
+		ctx:        ctx,
+		keys:       keys,
+		cipherdir:  cipherdir,
+		opts:       opts,
+		seenInodes: make(map[uint64]struct{}),
+	}
+	if _, err := os.Stat(cipherdir); err != nil {
+		return nil, err
+	}
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	ck.jobs = make(chan fileJob)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range ck.jobs {
+				ck.file(j.path, j.cPath, j.size)
+			}
+		}()
+	}
+	ck.dir("", "")
+	close(ck.jobs)
+	wg.Wait()
+	// The workers finish in random order
+	r := &ck.report
+	sort.Slice(r.Errors, func(i, j int) bool { return r.Errors[i].CipherPath < r.Errors[j].CipherPath })
+	sort.Strings(r.OrphanedLongNames)
+	sort.Strings(r.Skipped)
+	return r, ctx.Err()
+}
+
+// progress calls the Progress callback, if any. If "count" is not nil, it
+// is incremented first.
+func (ck *checker) progress(path string, count *int) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if count != nil {
+		*count++
+	}
+	if ck.opts.Progress != nil {
+		ck.opts.Progress(Progress{
+			Path:    path,
+			Checked: ck.report.Files + ck.report.Dirs + ck.report.Symlinks,
+			Bytes:   atomic.LoadInt64(&ck.bytes),
+		})
+	}
+}
+
+func (ck *checker) markCorrupt(path string, cPath string, err error) {
+	ck.addError(FileError{Path: path, CipherPath: cPath, Err: err})
+}
+
+func (ck *checker) addError(e FileError) {
+	ck.mu.Lock()
+	ck.report.Errors = append(ck.report.Errors, e)
+	ck.mu.Unlock()
+}
+
+// markOpenError records an error opening "path". Permission errors mean that
+// the entry has been skipped.
+func (ck *checker) markOpenError(path string, cPath string, err error) {
+	if os.IsPermission(err) && syscall.Geteuid() != 0 {
+		ck.mu.Lock()
+		ck.report.Skipped = append(ck.report.Skipped, path)
+		ck.mu.Unlock()
+		return
+	}
+	ck.markCorrupt(path, cPath, err)
+}
+
+// dir recursively checks the directory "path" (ciphertext path "cPath")
+func (ck *checker) dir(path string, cPath string) {
+	ck.progress(path, &ck.report.Dirs)
+	cDir := filepath.Join(ck.cipherdir, cPath)
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		ck.markOpenError(path, cPath, err)
+		return
+	}
+	var iv []byte
+	if !ck.keys.PlaintextNames() {
+		iv, err = cryptfile.ReadDirIV(cDir)
+		if err != nil {
+			ck.markCorrupt(path, cPath, fmt.Errorf("reading %s: %v", nametransform.DirIVFilename, err))
+			return
+		}
+	}
+	names := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = struct{}{}
+	}
+	for _, e := range entries {
+		if ck.ctx.Err() != nil {
+			return
+		}
+		cName := e.Name()
+		if cPath == "" && (cName == configfile.ConfDefaultName || cName == journal.FileName) {
+			continue
+		}
+		nextCPath := filepath.Join(cPath, cName)
+		name := cName
+		if !ck.keys.PlaintextNames() {
+			// "-sharedstorage" lease files are not part of the filesystem
+			if cName == nametransform.DirIVFilename || lease.IsLeaseFile(cName) {
+				continue
+			}
+			// Read together with their symlinks
+			if nametransform.IsLongTarget(cName) {
+				continue
+			}
+			encName := cName
+			switch nametransform.NameType(cName) {
+			case nametransform.LongNameFilename:
+				if _, ok := names[nametransform.RemoveLongNameSuffix(cName)]; !ok {
+					ck.mu.Lock()
+					ck.report.OrphanedLongNames = append(ck.report.OrphanedLongNames, nextCPath)
+					ck.mu.Unlock()
+				}
+				continue
+			case nametransform.LongNameContent:
+				content, err := ioutil.ReadFile(filepath.Join(cDir, cName+nametransform.LongNameSuffix))
+				if err != nil {
+					ck.markCorrupt(filepath.Join(path, cName), nextCPath, err)
+					continue
+				}
+				encName = string(content)
+			}
+			name, err = ck.keys.DecryptName(encName, iv)
+			if err != nil {
+				ck.markCorrupt(filepath.Join(path, cName), nextCPath, fmt.Errorf("bad file name: %v", err))
+				continue
+			}
+		}
+		nextPath := filepath.Join(path, name)
+		switch {
+		case e.IsDir():
+			ck.dir(nextPath, nextCPath)
+		case e.Mode().IsRegular():
+			if st, ok := e.Sys().(*syscall.Stat_t); ok && uint64(st.Nlink) > 1 {
+				// Due to hard links, we may have already checked this file.
+				if _, seen := ck.seenInodes[uint64(st.Ino)]; seen {
+					continue
+				}
+				ck.seenInodes[uint64(st.Ino)] = struct{}{}
+			}
+			ck.jobs <- fileJob{path: nextPath, cPath: nextCPath, size: e.Size()}
+		case e.Mode()&os.ModeSymlink != 0:
+			ck.symlink(nextPath, nextCPath)
+		}
+	}
+}
+
+func (ck *checker) symlink(path string, cPath string) {
+	ck.progress(path, &ck.report.Symlinks)
+	cTarget, err := os.Readlink(filepath.Join(ck.cipherdir, cPath))
+	if err != nil {
+		ck.markOpenError(path, cPath, err)
+		return
+	}
+	if !ck.keys.PlaintextNames() && nametransform.IsLongTarget(cTarget) {
+		content, err := ioutil.ReadFile(filepath.Join(ck.cipherdir, filepath.Dir(cPath), cTarget))
+		if err != nil {
+			ck.markCorrupt(path, cPath, fmt.Errorf("reading long target: %v", err))
+			return
+		}
+		cTarget = string(content)
+	}
+	if _, err = ck.keys.DecryptSymlinkTarget(cTarget); err != nil {
+		ck.markCorrupt(path, cPath, fmt.Errorf("bad symlink target: %v", err))
+	}
+}
+
+// file decrypts all blocks of the regular file "path". Called by the
+// workers.
+func (ck *checker) file(path string, cPath string, size int64) {
+	ck.progress(path, &ck.report.Files)
+	if size == 0 || ck.ctx.Err() != nil {
+		return
+	}
+	f, err := os.Open(filepath.Join(ck.cipherdir, cPath))
+	if err != nil {
+		ck.markOpenError(path, cPath, err)
+		return
+	}
+	defer f.Close()
+	fileID, err := ck.keys.ReadHeader(f)
+	if err != nil {
+		ck.markCorrupt(path, cPath, fmt.Errorf("bad header: %v", err))
+		return
+	}
+	var firstErr error
+	var ranges []BlockRange
+	for blockNo := uint64(0); ; blockNo++ {
+		if ck.ctx.Err() != nil {
+			return
+		}
+		if blockNo > 0 && blockNo%progressBlocks == 0 {
+			ck.progress(path, nil)
+		}
+		plain, err := ck.keys.DecryptBlockAt(f, fileID, blockNo)
+		if err == io.EOF {
+			break
+		} else if err == nil {
+			atomic.AddInt64(&ck.bytes, int64(len(plain)))
+			continue
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("block #%d: %v", blockNo, err)
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].Last+1 == blockNo {
+			ranges[n-1].Last = blockNo
+		} else {
+			ranges = append(ranges, BlockRange{First: blockNo, Last: blockNo})
+		}
+	}
+	if firstErr != nil {
+		ck.addError(FileError{
+			Path:          path,
+			CipherPath:    cPath,
+			Err:           firstErr,
+			CorruptBlocks: ranges,
+		})
+	}
+}
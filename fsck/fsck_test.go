@@ -0,0 +1,163 @@
+package fsck
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// writeFile encrypts "content" into the ciphertext directory "cDir" as
+// "name" and returns the ciphertext path
+func writeFile(t *testing.T, k *cryptfile.Keys, cDir string, name string, content []byte) string {
+	iv, err := cryptfile.ReadDirIV(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cName, longName, err := k.EncryptName(name, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if longName != "" {
+		err = ioutil.WriteFile(filepath.Join(cDir, cName+nametransform.LongNameSuffix), []byte(longName), 0400)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	w := k.NewWriter(&buf)
+	w.Write(content)
+	w.Close()
+	cPath := filepath.Join(cDir, cName)
+	if err := ioutil.WriteFile(cPath, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cPath
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsck_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, configfile.ConfDefaultName)
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := cryptfile.Open(conf, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Wipe()
+	iv := make([]byte, nametransform.DirIVLen)
+	rand.Read(iv)
+	if err := ioutil.WriteFile(filepath.Join(dir, nametransform.DirIVFilename), iv, 0400); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, k, dir, "good", []byte("hello"))
+	writeFile(t, k, dir, strings.Repeat("x", 200), []byte("long"))
+	// Blocks #1, #2 and #4 of 6 are corrupt
+	bs := k.PlainBlockSize()
+	bad := writeFile(t, k, dir, "bad", make([]byte, 5*bs+100))
+	cData, err := ioutil.ReadFile(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 18 bytes file header, 16 bytes IV and 16 bytes GCM tag per block
+	cBS := bs + 32
+	for _, b := range []int{1, 2, 4} {
+		cData[18+b*cBS+20] ^= 1
+	}
+	if err := ioutil.WriteFile(bad, cData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "not-a-valid-name"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	orphan := "gocryptfs.longname.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA.name"
+	if err := ioutil.WriteFile(filepath.Join(dir, orphan), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []string
+	opts := Options{Progress: func(p Progress) { seen = append(seen, p.Path) }}
+	r, err := Check(context.Background(), dir, k, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.OK() {
+		t.Fatal("report should not be OK")
+	}
+	if r.Files != 3 || r.Dirs != 1 {
+		t.Errorf("wrong counts: files=%d dirs=%d", r.Files, r.Dirs)
+	}
+	if len(seen) != 4 {
+		t.Errorf("wrong number of progress calls: %v", seen)
+	}
+	if len(r.OrphanedLongNames) != 1 || r.OrphanedLongNames[0] != orphan {
+		t.Errorf("OrphanedLongNames: %v", r.OrphanedLongNames)
+	}
+	if len(r.Errors) != 2 {
+		t.Fatalf("want 2 errors, have %v", r.Errors)
+	}
+	for _, e := range r.Errors {
+		switch e.Path {
+		case "bad":
+			want := []BlockRange{{1, 2}, {4, 4}}
+			if len(e.CorruptBlocks) != 2 || e.CorruptBlocks[0] != want[0] || e.CorruptBlocks[1] != want[1] {
+				t.Errorf("CorruptBlocks: want %v, have %v", want, e.CorruptBlocks)
+			}
+		case "not-a-valid-name":
+		default:
+			t.Errorf("unexpected error: %v", e)
+		}
+	}
+
+	// Parallel workers find the same problems
+	r2, err := Check(context.Background(), dir, k, Options{Workers: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.Files != r.Files || len(r2.Errors) != len(r.Errors) {
+		t.Errorf("Workers=4: different report: %+v", r2)
+	}
+	js, err := json.Marshal(r)
+	if err != nil || !strings.Contains(string(js), `"CorruptBlocks":[{"First":1,"Last":2}`) {
+		t.Errorf("json: %s %v", js, err)
+	}
+
+	// Canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Check(ctx, dir, k, Options{}); err != context.Canceled {
+		t.Errorf("want context.Canceled, have %v", err)
+	}
+}
+
+// TestExampleFs checks a filesystem that was created by gocryptfs v1.3
+func TestExampleFs(t *testing.T) {
+	const exampleFs = "../tests/example_filesystems/v1.3"
+	k, err := cryptfile.Open(exampleFs+"/gocryptfs.conf", []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Wipe()
+	r, err := Check(context.Background(), exampleFs, k, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() || r.Files != 2 || r.Symlinks != 2 {
+		t.Errorf("unexpected report: %+v", r)
+	}
+}
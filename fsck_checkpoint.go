@@ -0,0 +1,146 @@
+package gocryptfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// fsckCheckpoint is what "-fsck-checkpoint" stores to resume an interrupted
+// check
+type fsckCheckpoint struct {
+	// Cipherdir is the absolute path of the checked CIPHERDIR
+	Cipherdir string
+	// Done is the path up to which, in walk order, everything has been
+	// checked
+	Done string
+	// Checked and Bytes are shown in the progress line
+	Checked int64
+	Bytes   int64
+	// The problems found so far
+	Corrupt  []string `json:",omitempty"`
+	Skipped  []string `json:",omitempty"`
+	Repaired []string `json:",omitempty"`
+}
+
+// loadFsckCheckpoint reads the checkpoint file "path". Returns nil if it
+// does not exist yet.
+func loadFsckCheckpoint(path string, cipherdir string) (*fsckCheckpoint, error) {
+	js, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var c fsckCheckpoint
+	if err := json.Unmarshal(js, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if c.Cipherdir != cipherdir {
+		return nil, fmt.Errorf("%s belongs to %q, not to %q", path, c.Cipherdir, cipherdir)
+	}
+	return &c, nil
+}
+
+// save writes the checkpoint to "path". The old file is replaced
+// atomically, so an interruption leaves a usable checkpoint behind.
+func (c *fsckCheckpoint) save(path string) error {
+	js, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(js, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// walkOrderLess returns true if the directory walker of "-fsck" reaches
+// "a" before "b". It visits the entries depth-first, sorted by name, and a
+// directory before its contents.
+func walkOrderLess(a string, b string) bool {
+	if a == b {
+		return false
+	}
+	if a == "" {
+		return true
+	}
+	if b == "" {
+		return false
+	}
+	as := strings.Split(a, "/")
+	bs := strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// fsckSkipDone returns true if "path" has already been checked before the
+// check was interrupted, that is, it comes before "done" in walk order.
+// Directories that contain unchecked entries are not skipped.
+func fsckSkipDone(path string, isDir bool, done string) bool {
+	if path != done && !walkOrderLess(path, done) {
+		return false
+	}
+	if isDir && (path == "" || strings.HasPrefix(done, path+"/")) {
+		return false
+	}
+	return true
+}
+
+// walkWatermark finds the path up to which everything has been checked.
+// The walker numbers the entries in walk order, but the files finish in any
+// order because several workers check them.
+type walkWatermark struct {
+	mu sync.Mutex
+	// next is the number the next entry gets
+	next uint64
+	// low is the number of the first entry that has not finished
+	low uint64
+	// finished holds the entries >= low that have finished
+	finished map[uint64]string
+	// done is the path of entry low-1
+	done string
+}
+
+// start numbers the next entry in walk order
+func (w *walkWatermark) start() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := w.next
+	w.next++
+	return n
+}
+
+// finish marks the entry "n" with path "path" as checked
+func (w *walkWatermark) finish(n uint64, path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.finished == nil {
+		w.finished = make(map[uint64]string)
+	}
+	w.finished[n] = path
+	for {
+		p, ok := w.finished[w.low]
+		if !ok {
+			return
+		}
+		delete(w.finished, w.low)
+		w.done = p
+		w.low++
+	}
+}
+
+// get returns the path up to which everything has been checked
+func (w *walkWatermark) get() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.done
+}
@@ -0,0 +1,110 @@
+package gocryptfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWalkOrderLess(t *testing.T) {
+	// In walk order
+	paths := []string{"", "a", "a/b", "a/b/c", "a/c", "a.txt", "b", "b/a"}
+	for i := range paths {
+		for j := range paths {
+			if got := walkOrderLess(paths[i], paths[j]); got != (i < j) {
+				t.Errorf("walkOrderLess(%q, %q) = %v", paths[i], paths[j], got)
+			}
+		}
+	}
+	shuffled := []string{"b/a", "a.txt", "a/c", "", "a/b/c", "b", "a", "a/b"}
+	sort.Slice(shuffled, func(i, j int) bool { return walkOrderLess(shuffled[i], shuffled[j]) })
+	if !reflect.DeepEqual(shuffled, paths) {
+		t.Errorf("wrong order: %q", shuffled)
+	}
+}
+
+func TestFsckSkipDone(t *testing.T) {
+	testCases := []struct {
+		path  string
+		isDir bool
+		skip  bool
+	}{
+		{"", true, false},
+		{"a", false, true},
+		// Contains unchecked entries
+		{"d", true, false},
+		{"d/a", false, true},
+		{"d/a", true, true},
+		{"d/b", false, true},
+		{"d/c", false, false},
+		{"e", true, false},
+		{"e", false, false},
+	}
+	for _, tc := range testCases {
+		if got := fsckSkipDone(tc.path, tc.isDir, "d/b"); got != tc.skip {
+			t.Errorf("fsckSkipDone(%q, %v) = %v", tc.path, tc.isDir, got)
+		}
+	}
+	// Nothing has been checked yet
+	if fsckSkipDone("a", false, "") || fsckSkipDone("", true, "") {
+		t.Error("skipped entries of a new check")
+	}
+}
+
+func TestWalkWatermark(t *testing.T) {
+	var w walkWatermark
+	w.done = "resumed"
+	var n [4]uint64
+	for i := range n {
+		n[i] = w.start()
+	}
+	w.finish(n[1], "b")
+	w.finish(n[2], "c")
+	if got := w.get(); got != "resumed" {
+		t.Errorf("entry 0 is still running, got %q", got)
+	}
+	w.finish(n[0], "a")
+	if got := w.get(); got != "c" {
+		t.Errorf("want %q, got %q", "c", got)
+	}
+	w.finish(n[3], "d")
+	if got := w.get(); got != "d" {
+		t.Errorf("want %q, got %q", "d", got)
+	}
+}
+
+func TestFsckCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsck_checkpoint_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+	c, err := loadFsckCheckpoint(path, "/cipherdir")
+	if c != nil || err != nil {
+		t.Fatalf("missing checkpoint: %v, %v", c, err)
+	}
+	c = &fsckCheckpoint{
+		Cipherdir: "/cipherdir",
+		Done:      "a/b",
+		Checked:   3,
+		Bytes:     12345,
+		Corrupt:   []string{"a/a"},
+	}
+	if err = c.save(path); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := loadFsckCheckpoint(path, "/cipherdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, c2) {
+		t.Errorf("want %v, got %v", c, c2)
+	}
+	if _, err = loadFsckCheckpoint(path, "/other"); err == nil {
+		t.Error("checkpoint of another CIPHERDIR was accepted")
+	}
+}
@@ -2,5 +2,11 @@ package gocryptfs
 
 // 对外提供的gocrypt的API
 func GoCryptAPI(cmd []string, password string) {
-	doMain(cmd, password)
+	doMain(cmd, password, nil)
+}
+
+// GoCryptAPIWithProvider is GoCryptAPI, but gets the password from
+// "provider" when it is needed.
+func GoCryptAPIWithProvider(cmd []string, provider PasswordProvider) {
+	doMain(cmd, "", provider)
 }
@@ -1,6 +1,7 @@
 package gocryptfs
 
 import (
+	"flag"
 	"fmt"
 
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
@@ -39,6 +40,7 @@ Common Options (use -hh to show all):
   -q, -quiet         Silence informational messages
   -reverse           Enable reverse mode
   -ro                GoCryptAPI read-only
+  -snapshot          Create, list or mount snapshots of CIPHERDIR
   -speed             Run crypto speed test
   -version           Print version information
   --                 Stop option parsing
@@ -46,7 +48,7 @@ Common Options (use -hh to show all):
 }
 
 // helpLong gets only displayed on "-hh"
-func helpLong() {
+func helpLong(flagSet *flag.FlagSet) {
 	printVersion()
 	fmt.Printf("\n")
 	fmt.Printf(tUsage)
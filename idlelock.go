@@ -0,0 +1,77 @@
+package gocryptfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// idleLockKeys implements fusefrontend.KeyManager for "-idlelock".
+// The ciphers are wiped and restored in place, so the content and filename
+// encryption helpers that reference them stay valid.
+type idleLockKeys struct {
+	args          *argContainer
+	cCore         *cryptocore.CryptoCore
+	nameTransform *nametransform.NameTransform
+	// keyHash identifies the master key the filesystem was mounted with,
+	// without keeping the key in memory. It is an HMAC with the random key
+	// "salt", so it cannot be compared with other mounts.
+	salt    []byte
+	keyHash []byte
+}
+
+// newIdleLockKeys returns the KeyManager for the filesystem mounted with
+// "masterkey", which is not modified
+func newIdleLockKeys(args *argContainer, masterkey []byte, cCore *cryptocore.CryptoCore,
+	nameTransform *nametransform.NameTransform) *idleLockKeys {
+	k := &idleLockKeys{
+		args:          args,
+		cCore:         cCore,
+		nameTransform: nameTransform,
+		salt:          cryptocore.RandBytes(32),
+	}
+	k.keyHash = k.hash(masterkey)
+	return k
+}
+
+func (k *idleLockKeys) hash(masterkey []byte) []byte {
+	h := hmac.New(sha256.New, k.salt)
+	h.Write(masterkey)
+	return h.Sum(nil)
+}
+
+// WipeKeys implements fusefrontend.KeyManager
+func (k *idleLockKeys) WipeKeys() {
+	k.nameTransform.SetEMECipher(nil)
+	k.cCore.Wipe()
+}
+
+// RestoreKeys implements fusefrontend.KeyManager. It decrypts the masterkey
+// from the config file using "password". The config file may have been
+// replaced since the filesystem was mounted, so the key must be the one the
+// filesystem was mounted with.
+func (k *idleLockKeys) RestoreKeys(password string) error {
+	cf, err := configfile.Load(k.args.config)
+	if err != nil {
+		return err
+	}
+	masterkey, err := cf.DecryptMasterKey([]byte(password))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range masterkey {
+			masterkey[i] = 0
+		}
+	}()
+	if !hmac.Equal(k.hash(masterkey), k.keyHash) {
+		return errors.New("the config file does not have the master key of the mounted filesystem")
+	}
+	k.cCore.Rekey(masterkey, k.args.hkdf, k.args.forcedecode)
+	k.nameTransform.SetEMECipher(k.cCore.EMECipher)
+	return nil
+}
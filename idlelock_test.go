@@ -0,0 +1,52 @@
+package gocryptfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// TestIdleLockKeys checks that unlocking only accepts the master key the
+// filesystem was mounted with
+func TestIdleLockKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idlelock_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := dir + "/gocryptfs.conf"
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey, _, err := configfile.LoadAndDecrypt(conf, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := &argContainer{config: conf}
+	cCore := cryptocore.New(masterkey, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, false, false)
+	nameTransform := nametransform.New(cCore.EMECipher, true, false)
+	k := newIdleLockKeys(args, masterkey, cCore, nameTransform)
+	k.WipeKeys()
+	if err := k.RestoreKeys("wrong"); err == nil {
+		t.Error("wrong password accepted")
+	}
+	if err := k.RestoreKeys("test"); err != nil {
+		t.Fatal(err)
+	}
+	// Another config file with the same password, but a different key
+	k.WipeKeys()
+	os.Remove(conf)
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.RestoreKeys("test"); err == nil {
+		t.Error("the master key of a replaced config file was accepted")
+	}
+}
@@ -9,14 +9,68 @@ import (
 
 	"github.com/HorizonLiu/gocryptfs/internal/configfile"
 	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
 	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
 )
 
-// info pretty-prints the contents of the config file at "filename" for human
-// consumption, stripping out sensitive data.
+// infoJSON is what "-info -json" prints. The key names follow the config file.
+type infoJSON struct {
+	Creator      string
+	Version      uint16
+	FeatureFlags []string
+	// Cipher is the content encryption, "AES-GCM-256" or "AES-SIV-512"
+	Cipher string
+	// FilenameEncryption is "EME" or "none" with -plaintextnames
+	FilenameEncryption string
+	// FilenameEncoding is "base64url" or "base64url-raw" with Raw64. Empty
+	// with -plaintextnames.
+	FilenameEncoding string `json:",omitempty"`
+	KDF              infoKDF
+	FIDO2            bool
+	Duress           bool
+	UnlockLimit      *configfile.UnlockLimitParams `json:",omitempty"`
+	// NameMax is the longest plaintext file name in bytes
+	NameMax int
+	// Tenants are the names of the directories with keys of their own
+	Tenants []string `json:",omitempty"`
+	// EncryptedMetadata is true if the config file contains metadata.
+	// Metadata is its content if a password was passed.
+	EncryptedMetadata bool
+	Metadata          *configfile.Metadata `json:",omitempty"`
+	// PlainBlockSize and CipherBlockSize are in bytes
+	PlainBlockSize  int
+	CipherBlockSize int
+	Overhead        infoOverhead
+}
+
+// infoKDF describes the password hashing, without the salt
+type infoKDF struct {
+	Algorithm string
+	N         int
+	R         int
+	P         int
+	KeyLen    int
+	SaltLen   int
+}
+
+// infoOverhead is the space the encryption takes, in bytes
+type infoOverhead struct {
+	// FileHeader is at the start of every non-empty file
+	FileHeader int
+	// BlockIV and BlockTag are added to every block
+	BlockIV  int
+	BlockTag int
+}
+
+// info pretty-prints the contents of the config file for human consumption,
+// stripping out sensitive data. With "-json", the same information and the
+// derived sizes are printed as JSON. If the config file contains metadata
+// and a password or master key was passed, the metadata is decrypted and
+// printed as well.
 // This is called when you pass the "-info" option.
-func info(filename string) {
+func info(args *argContainer, password string) {
+	filename := args.config
 	// Read from disk
 	js, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -34,6 +88,17 @@ func info(filename string) {
 		tlog.Fatal.Printf("Unsupported on-disk format %d", cf.Version)
 		os.Exit(exitcodes.LoadConf)
 	}
+	var m *configfile.Metadata
+	if cf.EncryptedMetadata != nil && infoCanUnlock(args, password) {
+		m = infoMetadata(args, password)
+	}
+	if args.jsonOutput {
+		i := infoFromConf(&cf)
+		i.Metadata = m
+		out, _ := json.MarshalIndent(i, "", "\t")
+		fmt.Println(string(out))
+		return
+	}
 	// Pretty-print
 	fmt.Printf("Creator:      %s\n", cf.Creator)
 	fmt.Printf("FeatureFlags: %s\n", strings.Join(cf.FeatureFlags, " "))
@@ -41,4 +106,97 @@ func info(filename string) {
 	s := cf.ScryptObject
 	fmt.Printf("ScryptObject: Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
 		len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+	if cf.NameMax > 0 {
+		fmt.Printf("NameMax:      %d\n", cf.NameMax)
+	}
+	for _, t := range cf.Tenants {
+		fmt.Printf("Tenant:       %s\n", t.Name)
+	}
+	if m != nil {
+		fmt.Printf("Created:      %s\n", m.Created)
+		fmt.Printf("Host:         %s\n", m.Host)
+		if m.Notes != "" {
+			fmt.Printf("Notes:        %s\n", m.Notes)
+		}
+	} else if cf.EncryptedMetadata != nil {
+		fmt.Printf("Metadata:     %dB, pass the password to show it\n", len(cf.EncryptedMetadata))
+	}
+}
+
+// infoCanUnlock returns true if a password or master key was passed to
+// "-info"
+func infoCanUnlock(args *argContainer, password string) bool {
+	return password != "" || args._passwordProvider != nil || !args.extpass.Empty() ||
+		len(args.passfile) != 0 || args.masterkey != "" || args.masterkeyFd >= 0 || args.fido2 != ""
+}
+
+// infoMetadata unlocks the config file and decrypts the metadata.
+// Calls os.Exit on errors.
+func infoMetadata(args *argContainer, password string) *configfile.Metadata {
+	if args.jsonOutput {
+		// Keep "Decrypting master key" out of the JSON on stdout
+		tlog.Info.Enabled = false
+	}
+	masterkey, cf, err := loadConfig(args, password)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	m, err := cf.Metadata(masterkey)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	return m
+}
+
+// infoFromConf collects what "-info -json" prints
+func infoFromConf(cf *configfile.ConfFile) infoJSON {
+	ivLen := contentenc.DefaultIVBits / 8
+	i := infoJSON{
+		Creator:            cf.Creator,
+		Version:            cf.Version,
+		FeatureFlags:       cf.FeatureFlags,
+		Cipher:             "AES-GCM-256",
+		FilenameEncryption: "EME",
+		FilenameEncoding:   "base64url",
+		KDF: infoKDF{
+			Algorithm: "scrypt",
+			N:         cf.ScryptObject.N,
+			R:         cf.ScryptObject.R,
+			P:         cf.ScryptObject.P,
+			KeyLen:    cf.ScryptObject.KeyLen,
+			SaltLen:   len(cf.ScryptObject.Salt),
+		},
+		FIDO2:             cf.IsFeatureFlagSet(configfile.FlagFIDO2),
+		Duress:            cf.Duress != nil,
+		UnlockLimit:       cf.UnlockLimit,
+		EncryptedMetadata: cf.EncryptedMetadata != nil,
+		NameMax:           cf.PlainNameMax(),
+		PlainBlockSize:    contentenc.DefaultBS,
+		CipherBlockSize:   contentenc.DefaultBS + ivLen + cryptocore.AuthTagLen,
+		Overhead: infoOverhead{
+			FileHeader: contentenc.HeaderLen,
+			BlockIV:    ivLen,
+			BlockTag:   cryptocore.AuthTagLen,
+		},
+	}
+	for _, t := range cf.Tenants {
+		i.Tenants = append(i.Tenants, t.Name)
+	}
+	if i.FeatureFlags == nil {
+		i.FeatureFlags = []string{}
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		i.Cipher = "AES-SIV-512"
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		i.FilenameEncryption = "none"
+		i.FilenameEncoding = ""
+	} else if cf.IsFeatureFlagSet(configfile.FlagRaw64) {
+		i.FilenameEncoding = "base64url-raw"
+	}
+	return i
 }
@@ -0,0 +1,44 @@
+package gocryptfs
+
+import (
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+)
+
+func TestInfoFromConf(t *testing.T) {
+	cf := configfile.ConfFile{
+		Version:      2,
+		FeatureFlags: []string{"GCMIV128", "HKDF", "DirIV", "EMENames", "LongNames", "Raw64"},
+		ScryptObject: configfile.ScryptKDF{Salt: make([]byte, 32), N: 65536, R: 8, P: 1, KeyLen: 32},
+	}
+	i := infoFromConf(&cf)
+	if i.Cipher != "AES-GCM-256" || i.FilenameEncoding != "base64url-raw" || i.FIDO2 || i.Duress {
+		t.Errorf("%+v", i)
+	}
+	if i.KDF.SaltLen != 32 || i.KDF.N != 65536 {
+		t.Errorf("%+v", i.KDF)
+	}
+	if i.CipherBlockSize != 4128 || i.Overhead.FileHeader != 18 {
+		t.Errorf("CipherBlockSize=%d Overhead=%+v", i.CipherBlockSize, i.Overhead)
+	}
+	if i.Tenants != nil {
+		t.Errorf("Tenants=%v", i.Tenants)
+	}
+	if i.EncryptedMetadata || i.Metadata != nil {
+		t.Errorf("EncryptedMetadata=%v Metadata=%v", i.EncryptedMetadata, i.Metadata)
+	}
+	cf.EncryptedMetadata = make([]byte, 64)
+	if i = infoFromConf(&cf); !i.EncryptedMetadata {
+		t.Error("EncryptedMetadata not set")
+	}
+	cf.Tenants = []configfile.TenantParams{{Name: "alice"}}
+	if i = infoFromConf(&cf); len(i.Tenants) != 1 || i.Tenants[0] != "alice" {
+		t.Errorf("Tenants=%v", i.Tenants)
+	}
+	cf.FeatureFlags = []string{"AESSIV", "PlaintextNames"}
+	i = infoFromConf(&cf)
+	if i.Cipher != "AES-SIV-512" || i.FilenameEncryption != "none" || i.FilenameEncoding != "" {
+		t.Errorf("%+v", i)
+	}
+}
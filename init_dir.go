@@ -1,17 +1,21 @@
 package gocryptfs
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
 	"github.com/HorizonLiu/gocryptfs/internal/configfile"
 	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
 	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
 	"github.com/HorizonLiu/gocryptfs/internal/fido2"
+	"github.com/HorizonLiu/gocryptfs/internal/keychain"
 	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
 	"github.com/HorizonLiu/gocryptfs/internal/readpassword"
 	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
@@ -47,6 +51,148 @@ func isDir(dir string) error {
 	return nil
 }
 
+// writeRootDirIV creates the gocryptfs.diriv file in "cipherdir"
+func writeRootDirIV(cipherdir string) error {
+	// Open cipherdir (following symlinks)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	return nametransform.WriteDirIVAt(dirfd)
+}
+
+// setUnlockLimit stores "-unlock-limit" and "-unlock-lockout" in the
+// freshly created config file
+func setUnlockLimit(args *argContainer) error {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		return err
+	}
+	if err := cf.SetUnlockLimit(args.unlockLimit, args.unlockLockout); err != nil {
+		return err
+	}
+	return cf.WriteFile()
+}
+
+// setNameMax stores "-name-max" in the new config file
+func setNameMax(args *argContainer) error {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		return err
+	}
+	if err := cf.SetNameMax(args.nameMax); err != nil {
+		return err
+	}
+	return cf.WriteFile()
+}
+
+// setMetadata stores the creation time, the host name and "-metadata-notes"
+// encrypted in the new config file
+func setMetadata(args *argContainer, password []byte) error {
+	masterkey, cf, err := configfile.LoadAndDecrypt(args.config, password)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range masterkey {
+			masterkey[i] = 0
+		}
+	}()
+	host, err := os.Hostname()
+	if err != nil {
+		tlog.Warn.Printf("metadata: %v", err)
+	}
+	m := configfile.Metadata{
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Host:    host,
+		Notes:   args.metadataNotes,
+	}
+	if err := cf.SetMetadata(masterkey, m); err != nil {
+		return err
+	}
+	return cf.WriteFile()
+}
+
+// initPreset is a set of "-init" options selected by "-preset"
+type initPreset struct {
+	scryptn        int
+	aessiv         bool
+	plaintextnames bool
+	devrandom      bool
+}
+
+// initPresets are the values "-preset" accepts
+var initPresets = map[string]initPreset{
+	// 512 MiB of memory for scrypt. AES-SIV survives nonce reuse, for
+	// example after a VM snapshot is restored.
+	"paranoid": {scryptn: 19, aessiv: true, devrandom: true},
+	// The defaults
+	"balanced": {scryptn: configfile.ScryptDefaultLogN},
+	// For scratch space and caches, where the file names are no secret
+	"fast": {scryptn: 12, plaintextnames: true},
+}
+
+// applyInitPreset sets the options of "-preset" that were not passed
+// explicitly
+func applyInitPreset(args *argContainer) error {
+	p, ok := initPresets[args.preset]
+	if !ok {
+		return fmt.Errorf("unknown -preset %q, valid presets are: paranoid, balanced, fast", args.preset)
+	}
+	if !isFlagPassed(args._flagSet, "scryptn") {
+		args.scryptn = p.scryptn
+	}
+	if !isFlagPassed(args._flagSet, "aessiv") {
+		args.aessiv = p.aessiv
+	}
+	if !isFlagPassed(args._flagSet, "plaintextnames") {
+		args.plaintextnames = p.plaintextnames
+	}
+	if !isFlagPassed(args._flagSet, "devrandom") {
+		args.devrandom = p.devrandom
+	}
+	return nil
+}
+
+// initDryRun prints what "-init" would create, and how long unlocking takes
+// with the chosen scrypt cost. Nothing is written.
+func initDryRun(args *argContainer) {
+	flags := configfile.CreateFeatureFlags(args.plaintextnames, args.aessiv, args.fido2 != "")
+	if len(args.passthroughDir)+len(args.plaintextnamesDir) > 0 {
+		flags = append(flags, "DirPolicy")
+	}
+	i := infoFromConf(&configfile.ConfFile{FeatureFlags: flags})
+	fmt.Printf("Config file:  %s\n", args.config)
+	if !args.plaintextnames && !args.reverse {
+		fmt.Printf("Root DirIV:   %s\n", filepath.Join(args.cipherdir, nametransform.DirIVFilename))
+	}
+	for _, p := range args.passthroughDir {
+		fmt.Printf("Passthrough:  %s\n", p)
+	}
+	for _, p := range args.plaintextnamesDir {
+		fmt.Printf("Plain names:  %s\n", p)
+	}
+	fmt.Printf("FeatureFlags: %s\n", strings.Join(flags, " "))
+	fmt.Printf("Cipher:       %s\n", i.Cipher)
+	if args.fido2 != "" {
+		fmt.Printf("Password:     FIDO2 token %s\n", args.fido2)
+	}
+	kdf := configfile.NewScryptKDF(args.scryptn)
+	fmt.Printf("ScryptObject: N=%d R=%d P=%d KeyLen=%d, %d MiB of memory\n",
+		kdf.N, kdf.R, kdf.P, kdf.KeyLen, 128*kdf.R*kdf.N>>20)
+	if args.unlockLimit > 0 {
+		fmt.Printf("UnlockLimit:  %d failures, then %v lockout\n", args.unlockLimit, args.unlockLockout)
+	}
+	start := time.Now()
+	key := kdf.DeriveKey(cryptocore.RandBytes(16))
+	for i := range key {
+		key[i] = 0
+	}
+	fmt.Printf("Unlock time:  %.2fs on this machine\n", time.Since(start).Seconds())
+	tlog.Info.Printf("Dry run, nothing has been written.")
+}
+
 // initDir handles "gocryptfs -init". It prepares a directory for use as a
 // gocryptfs storage directory.
 // In forward mode, this means creating the gocryptfs.conf and gocryptfs.diriv
@@ -68,10 +214,16 @@ func initDir(args *argContainer) {
 			os.Exit(exitcodes.CipherDir)
 		}
 	}
+	if args.dryRun {
+		initDryRun(args)
+		return
+	}
 	// Choose password for config file
 	if args.extpass.Empty() && args.fido2 == "" {
 		tlog.Info.Printf("Choose a password for protecting your files.")
 	}
+	// Keys for "-passthrough-dir" and "-plaintextnames-dir"
+	var keys *cryptfile.Keys
 	{
 		var password []byte
 		var fido2CredentialID, fido2HmacSalt []byte
@@ -79,6 +231,8 @@ func initDir(args *argContainer) {
 			fido2CredentialID = fido2.Register(args.fido2, filepath.Base(args.cipherdir))
 			fido2HmacSalt = cryptocore.RandBytes(32)
 			password = fido2.Secret(args.fido2, fido2CredentialID, fido2HmacSalt)
+		} else if store, ok := args._passwordFrom.(passwordStore); ok {
+			password = storedPassword(store)
 		} else {
 			// normal password entry
 			password = readpassword.Twice([]string(args.extpass), []string(args.passfile))
@@ -92,6 +246,32 @@ func initDir(args *argContainer) {
 			tlog.Fatal.Println(err)
 			os.Exit(exitcodes.WriteConf)
 		}
+		if args.nameMax > 0 {
+			if err := setNameMax(args); err != nil {
+				tlog.Fatal.Println(err)
+				os.Exit(exitcodes.WriteConf)
+			}
+		}
+		// Before -unlock-limit, which counts the unlock as an attempt
+		if args.metadata {
+			if err := setMetadata(args, password); err != nil {
+				tlog.Fatal.Println(err)
+				os.Exit(exitcodes.WriteConf)
+			}
+		}
+		if args.unlockLimit > 0 {
+			if err := setUnlockLimit(args); err != nil {
+				tlog.Fatal.Println(err)
+				os.Exit(exitcodes.WriteConf)
+			}
+		}
+		if len(args.passthroughDir)+len(args.plaintextnamesDir) > 0 {
+			keys, err = cryptfile.Open(args.config, password)
+			if err != nil {
+				tlog.Fatal.Println(err)
+				os.Exit(exitcodes.Init)
+			}
+		}
 		for i := range password {
 			password[i] = 0
 		}
@@ -100,12 +280,14 @@ func initDir(args *argContainer) {
 	// Forward mode with filename encryption enabled needs a gocryptfs.diriv file
 	// in the root dir
 	if !args.plaintextnames && !args.reverse {
-		// Open cipherdir (following symlinks)
-		dirfd, err := syscall.Open(args.cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
-		if err == nil {
-			err = nametransform.WriteDirIVAt(dirfd)
-			syscall.Close(dirfd)
+		if err := writeRootDirIV(args.cipherdir); err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.Init)
 		}
+	}
+	if keys != nil {
+		err = initDirPolicies(args, keys)
+		keys.Wipe()
 		if err != nil {
 			tlog.Fatal.Println(err)
 			os.Exit(exitcodes.Init)
@@ -132,3 +314,25 @@ func initDir(args *argContainer) {
 	tlog.Info.Printf(tlog.ColorGrey+"You can now mount it using: %s%s %s MOUNTPOINT"+tlog.ColorReset,
 		tlog.ProgramName, mountArgs, friendlyPath)
 }
+
+// storedPassword returns the password for a new filesystem from "-password-from
+// keychain:ITEM". If the item does not exist yet, the password is read from the
+// terminal and saved in it. Calls os.Exit on errors.
+func storedPassword(store passwordStore) []byte {
+	password, err := store.GetPassword(context.Background(), 1)
+	if err == nil {
+		tlog.Info.Printf("Using the password from the Keychain")
+		return password
+	}
+	if err != keychain.ErrNotFound {
+		tlog.Fatal.Printf("Cannot get password: %v", err)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	password = readpassword.Twice(nil, nil)
+	if err := store.StorePassword(password); err != nil {
+		tlog.Fatal.Printf("Cannot store password: %v", err)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	tlog.Info.Printf("The password has been stored in the Keychain")
+	return password
+}
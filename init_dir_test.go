@@ -0,0 +1,43 @@
+package gocryptfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyInitPreset(t *testing.T) {
+	a := parseCliOptsDiy([]string{"gocryptfs", "-init", "-preset", "paranoid", "-scryptn", "17", "/a"})
+	if a.scryptn != 17 || !a.aessiv || a.plaintextnames || !a.devrandom {
+		t.Errorf("paranoid: scryptn=%d aessiv=%v plaintextnames=%v devrandom=%v",
+			a.scryptn, a.aessiv, a.plaintextnames, a.devrandom)
+	}
+	a = parseCliOptsDiy([]string{"gocryptfs", "-init", "-preset=fast", "/a"})
+	if a.scryptn != 12 || a.aessiv || !a.plaintextnames {
+		t.Errorf("fast: scryptn=%d aessiv=%v plaintextnames=%v", a.scryptn, a.aessiv, a.plaintextnames)
+	}
+	a.preset = "nonsense"
+	if err := applyInitPreset(&a); err == nil {
+		t.Error("unknown preset was accepted")
+	}
+}
+
+func TestInitDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "init_dir_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := parseCliOptsDiy([]string{"gocryptfs", "-init", "-dry-run", "-scryptn=10", dir})
+	a.cipherdir = dir
+	a.config = filepath.Join(dir, "gocryptfs.conf")
+	initDir(&a)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("dry run created %s", entries[0].Name())
+	}
+}
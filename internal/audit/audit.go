@@ -0,0 +1,92 @@
+// Package audit writes the "-audit-log": one JSON record per access to a
+// plaintext file, for environments that must be able to tell who accessed
+// which file.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Syslog is the "-audit-log" value that sends the records to syslog
+// (facility authpriv) instead of a file
+const Syslog = "syslog"
+
+// Record is one audited operation
+type Record struct {
+	Time string `json:"time"`
+	// Op is "open", "create", "unlink", "rmdir" or "rename"
+	Op string `json:"op"`
+	// Path is the plaintext path relative to the mountpoint
+	Path string `json:"path"`
+	// NewPath is the new plaintext path on "rename"
+	NewPath string `json:"new_path,omitempty"`
+	// Flags are the open(2) flags on "open" and "create"
+	Flags uint32 `json:"flags,omitempty"`
+	// UID, GID and PID of the calling process
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+	PID uint32 `json:"pid"`
+	// Errno is the result, 0 on success
+	Errno int `json:"errno"`
+}
+
+// Log writes audit records
+type Log struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+	// failed is set after the first write error, so the warning is printed
+	// only once
+	failed bool
+}
+
+// Open opens the audit log "path" for appending, creating it with mode 0600
+// if needed, or connects to syslog if "path" is Syslog.
+func Open(path string) (*Log, error) {
+	if path == Syslog {
+		w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, tlog.ProgramName+"-audit")
+		if err != nil {
+			return nil, err
+		}
+		return &Log{w: w}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|syscall.O_CLOEXEC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{w: f}, nil
+}
+
+// Write appends "r" to the log. The time is filled in.
+func (l *Log) Write(r Record) {
+	r.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	b, err := json.Marshal(r)
+	if err != nil {
+		tlog.Warn.Printf("audit: %v", err)
+		return
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// One write call per record, so O_APPEND keeps records from several
+	// processes intact
+	_, err = l.w.Write(b)
+	if err != nil && !l.failed {
+		tlog.Warn.Printf("audit: cannot write log: %v", err)
+	}
+	l.failed = err != nil
+}
+
+// Close closes the log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
@@ -0,0 +1,59 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/audit.log"
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write(Record{Op: "open", Path: "a/b", UID: 1000, PID: 42})
+	l.Write(Record{Op: "rename", Path: "a/b", NewPath: "c", Errno: 2})
+	l.Close()
+	// Reopening appends
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write(Record{Op: "unlink", Path: "c"})
+	l.Close()
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, want 0600", st.Mode())
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var have []Record
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r Record
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("%q: %v", s.Text(), err)
+		}
+		if r.Time == "" {
+			t.Errorf("time not set: %q", s.Text())
+		}
+		have = append(have, r)
+	}
+	if len(have) != 3 || have[0].UID != 1000 || have[1].NewPath != "c" || have[1].Errno != 2 || have[2].Op != "unlink" {
+		t.Errorf("wrong records: %+v", have)
+	}
+}
@@ -57,6 +57,21 @@ type ConfFile struct {
 	FeatureFlags []string
 	// FIDO2 parameters
 	FIDO2 FIDO2Params
+	// Duress is set if a duress password has been configured using
+	// "-duress-passwd"
+	Duress *DuressParams `json:",omitempty"`
+	// UnlockLimit is set if failed unlock attempts are rate limited, see
+	// "-unlock-limit"
+	UnlockLimit *UnlockLimitParams `json:",omitempty"`
+	// Tenants holds the key slots of the top-level directories that have
+	// master keys of their own, see "-add-tenant"
+	Tenants []TenantParams `json:",omitempty"`
+	// NameMax is the longest plaintext file name in bytes if it was raised
+	// above 255 with "-name-max"
+	NameMax int `json:",omitempty"`
+	// EncryptedMetadata holds the Metadata, encrypted with a key derived
+	// from the master key, see "-metadata"
+	EncryptedMetadata []byte `json:",omitempty"`
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
 }
@@ -76,6 +91,26 @@ func randBytesDevRandom(n int) []byte {
 	return b
 }
 
+// CreateFeatureFlags returns the feature flags that Create() sets
+func CreateFeatureFlags(plaintextNames bool, aessiv bool, fido2 bool) []string {
+	flags := []string{knownFlags[FlagGCMIV128], knownFlags[FlagHKDF]}
+	if plaintextNames {
+		flags = append(flags, knownFlags[FlagPlaintextNames])
+	} else {
+		flags = append(flags, knownFlags[FlagDirIV])
+		flags = append(flags, knownFlags[FlagEMENames])
+		flags = append(flags, knownFlags[FlagLongNames])
+		flags = append(flags, knownFlags[FlagRaw64])
+	}
+	if aessiv {
+		flags = append(flags, knownFlags[FlagAESSIV])
+	}
+	if fido2 {
+		flags = append(flags, knownFlags[FlagFIDO2])
+	}
+	return flags
+}
+
 // Create - create a new config with a random key encrypted with
 // "password" and write it to "filename".
 // Uses scrypt with cost parameter logN.
@@ -87,21 +122,8 @@ func Create(filename string, password []byte, plaintextNames bool,
 	cf.Version = contentenc.CurrentVersion
 
 	// Set feature flags
-	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagGCMIV128])
-	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagHKDF])
-	if plaintextNames {
-		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPlaintextNames])
-	} else {
-		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIV])
-		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagEMENames])
-		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNames])
-		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagRaw64])
-	}
-	if aessiv {
-		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagAESSIV])
-	}
+	cf.FeatureFlags = CreateFeatureFlags(plaintextNames, aessiv, len(fido2CredentialID) > 0)
 	if len(fido2CredentialID) > 0 {
-		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagFIDO2])
 		cf.FIDO2.CredentialID = fido2CredentialID
 		cf.FIDO2.HMACSalt = fido2HmacSalt
 	}
@@ -157,20 +179,26 @@ func LoadAndDecrypt(filename string, password []byte) ([]byte, *ConfFile, error)
 
 // Load loads and parses the config file at "filename".
 func Load(filename string) (*ConfFile, error) {
-	var cf ConfFile
-	cf.filename = filename
-
 	// Read from disk
 	js, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	return Parse(filename, js)
+}
+
+// Parse parses the contents "js" of the config file. "filename" is where
+// WriteFile() will write the config file to.
+func Parse(filename string, js []byte) (*ConfFile, error) {
+	var cf ConfFile
+	cf.filename = filename
+
 	if len(js) == 0 {
 		return nil, fmt.Errorf("Config file is empty")
 	}
 
 	// Unmarshal
-	err = json.Unmarshal(js, &cf)
+	err := json.Unmarshal(js, &cf)
 	if err != nil {
 		tlog.Warn.Printf("Failed to unmarshal config file")
 		return nil, err
@@ -216,13 +244,60 @@ func Load(filename string) (*ConfFile, error) {
 		return nil, exitcodes.NewErr("Deprecated filesystem", exitcodes.DeprecatedFS)
 	}
 
+	// Reject weak scrypt parameters here so that DecryptMasterKey() does not
+	// have to exit
+	if err := cf.ScryptObject.validateParams(); err != nil {
+		return nil, exitcodes.NewErr(err.Error(), exitcodes.ScryptParams)
+	}
+	if cf.Duress != nil {
+		if err := cf.Duress.ScryptObject.validateParams(); err != nil {
+			return nil, exitcodes.NewErr(err.Error(), exitcodes.ScryptParams)
+		}
+	}
+	if cf.UnlockLimit != nil {
+		if err := cf.UnlockLimit.validate(); err != nil {
+			return nil, exitcodes.NewErr(err.Error(), exitcodes.LoadConf)
+		}
+	}
+	if err := cf.validateNameMax(); err != nil {
+		return nil, exitcodes.NewErr(err.Error(), exitcodes.LoadConf)
+	}
+	for i := range cf.Tenants {
+		if err := cf.Tenants[i].ScryptObject.validateParams(); err != nil {
+			return nil, exitcodes.NewErr(err.Error(), exitcodes.ScryptParams)
+		}
+	}
+
 	// All good
 	return &cf, nil
 }
 
 // DecryptMasterKey decrypts the masterkey stored in cf.EncryptedKey using
-// password.
+// password. If "password" is the duress password, the encrypted master key
+// is destroyed, and the error is the same as for a wrong password. With
+// cf.UnlockLimit set, the password is not even tried while too many
+// attempts have failed recently.
 func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err error) {
+	done, err := cf.beginUnlock()
+	if err != nil {
+		return nil, err
+	}
+	masterkey, err = cf.decryptMasterKey(password)
+	if err != nil {
+		if cf.IsDuressPassword(password) {
+			cf.destroyKey()
+		}
+		done(false)
+		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
+		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+	}
+	done(true)
+	return masterkey, nil
+}
+
+// decryptMasterKey is DecryptMasterKey without the duress password check
+// and without logging
+func (cf *ConfFile) decryptMasterKey(password []byte) (masterkey []byte, err error) {
 	// Generate derived key from password
 	scryptHash := cf.ScryptObject.DeriveKey(password)
 
@@ -230,9 +305,7 @@ func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err err
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
 
-	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
 	masterkey, err = ce.DecryptBlock(cf.EncryptedKey, 0, nil)
-	tlog.Warn.Enabled = true
 
 	// Purge scrypt-derived key
 	for i := range scryptHash {
@@ -242,11 +315,7 @@ func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err err
 	ce.Wipe()
 	ce = nil
 
-	if err != nil {
-		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
-		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
-	}
-	return masterkey, nil
+	return masterkey, err
 }
 
 // EncryptKey - encrypt "key" using an scrypt hash generated from "password"
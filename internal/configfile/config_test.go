@@ -1,10 +1,14 @@
 package configfile
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
 )
 
@@ -145,3 +149,340 @@ func TestIsFeatureFlagKnown(t *testing.T) {
 		t.Errorf("flag %q should be NOT known", f)
 	}
 }
+
+func TestDuressPassword(t *testing.T) {
+	const fn = "config_test/tmp.conf"
+	err := Create(fn, testPw, false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetDuressPassword(testPw, 10); err == nil {
+		t.Error("the password was accepted as the duress password")
+	}
+	duressPw := []byte("duress")
+	if err := c.SetDuressPassword(duressPw, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	// A wrong password changes nothing
+	if _, _, err := LoadAndDecrypt(fn, []byte("wrong")); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+	if _, _, err := LoadAndDecrypt(fn, testPw); err != nil {
+		t.Fatal(err)
+	}
+	// The duress password looks like a wrong password, but destroys the key
+	_, _, err = LoadAndDecrypt(fn, duressPw)
+	if _, _, err2 := LoadAndDecrypt(fn, []byte("wrong")); err == nil || err.Error() != err2.Error() {
+		t.Errorf("duress password: err=%v, want %v", err, err2)
+	}
+	c, err = Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Duress != nil {
+		t.Error("duress password is still set")
+	}
+	if _, err := c.DecryptMasterKey(testPw); err == nil {
+		t.Error("the master key has not been destroyed")
+	}
+}
+
+// TestDuressPasswordReadOnly checks that the duress password still looks
+// like a wrong password if the config file cannot be written. The key
+// survives in that case.
+func TestDuressPasswordReadOnly(t *testing.T) {
+	const fn = "config_test/tmp.conf"
+	err := Create(fn, testPw, false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duressPw := []byte("duress")
+	if err := c.SetDuressPassword(duressPw, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	// A directory in place of the temporary file makes WriteFile() fail,
+	// even for root
+	if err := os.Mkdir(fn+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fn + ".tmp")
+	_, _, err = LoadAndDecrypt(fn, duressPw)
+	if e, ok := err.(exitcodes.Err); !ok || e.Code() != exitcodes.PasswordIncorrect {
+		t.Errorf("duress password: want a wrong password error, have %v", err)
+	}
+	if _, _, err := LoadAndDecrypt(fn, testPw); err != nil {
+		t.Errorf("the key on disk should have survived: %v", err)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	const fn = "config_test/tmp.conf"
+	err := Create(fn, testPw, false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{0x42}, 32)
+	tenantPw := []byte("tenant")
+	for _, name := range []string{"", "..", "a/b"} {
+		if err := c.AddTenant(name, "x", key, tenantPw, 10); err == nil {
+			t.Errorf("invalid name %q accepted", name)
+		}
+	}
+	if err := c.AddTenant("alice", "xyz", key, tenantPw, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddTenant("alice", "xyz", key, tenantPw, 10); err == nil {
+		t.Error("duplicate tenant accepted")
+	}
+	if !c.IsFeatureFlagSet(FlagMultiTenant) {
+		t.Error("MultiTenant flag not set")
+	}
+	if err := c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	c, err = Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DecryptTenantKey("alice", testPw); err == nil {
+		t.Error("main password unlocked the tenant key")
+	}
+	key2, err := c.DecryptTenantKey("alice", tenantPw)
+	if err != nil || !bytes.Equal(key, key2) {
+		t.Errorf("key=%x err=%v", key2, err)
+	}
+	if _, err := c.DecryptTenantKey("bob", tenantPw); err == nil {
+		t.Error("unknown tenant accepted")
+	}
+	if err := c.RemoveTenant("alice"); err != nil || c.Tenant("alice") != nil {
+		t.Errorf("RemoveTenant: %v", err)
+	}
+}
+
+func TestUnlockLimit(t *testing.T) {
+	const fn = "config_test/tmp.conf"
+	err := Create(fn, testPw, false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fn + unlockStateSuffix)
+	defer os.Remove(fn + unlockStateSuffix + ".lock")
+	c, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetUnlockLimit(3, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+	try := func(pw []byte) int {
+		_, _, err := LoadAndDecrypt(fn, pw)
+		if e, ok := err.(exitcodes.Err); ok {
+			return e.Code()
+		}
+		return 0
+	}
+	wrong := []byte("wrong")
+	if c := try(wrong); c != exitcodes.PasswordIncorrect {
+		t.Fatalf("first attempt: exit code %d", c)
+	}
+	// Even the right password is refused during the delay
+	if c := try(testPw); c != exitcodes.UnlockLimit {
+		t.Fatalf("attempt during the delay: exit code %d", c)
+	}
+	now = now.Add(time.Second)
+	if c := try(wrong); c != exitcodes.PasswordIncorrect {
+		t.Fatalf("attempt after 1s: exit code %d", c)
+	}
+	now = now.Add(time.Second)
+	if c := try(wrong); c != exitcodes.UnlockLimit {
+		t.Fatalf("the delay has not doubled: exit code %d", c)
+	}
+	now = now.Add(time.Second)
+	if c := try(wrong); c != exitcodes.PasswordIncorrect {
+		t.Fatalf("attempt after 2s: exit code %d", c)
+	}
+	// Three failures: locked out for a minute
+	now = now.Add(30 * time.Second)
+	if c := try(testPw); c != exitcodes.UnlockLimit {
+		t.Fatalf("attempt during the lockout: exit code %d", c)
+	}
+	now = now.Add(30 * time.Second)
+	if c := try(testPw); c != 0 {
+		t.Fatalf("attempt after the lockout: exit code %d", c)
+	}
+	if _, err := os.Stat(fn + unlockStateSuffix); !os.IsNotExist(err) {
+		t.Errorf("state file has not been removed: %v", err)
+	}
+	// An attempt counts as failed while the password is being checked, so a
+	// parallel attempt has to wait
+	c, err = Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := c.beginUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := c.readUnlockState(); s.Failures != 1 {
+		t.Errorf("attempt in progress has not been counted: %+v", s)
+	}
+	if c := try(testPw); c != exitcodes.UnlockLimit {
+		t.Errorf("parallel attempt: exit code %d", c)
+	}
+	done(true)
+	if _, err := os.Stat(fn + unlockStateSuffix); !os.IsNotExist(err) {
+		t.Errorf("state file has not been removed: %v", err)
+	}
+}
+
+// TestUnlockLimitReadOnly checks that the unlock limit does not lock out
+// the user if its state cannot be stored
+func TestUnlockLimitReadOnly(t *testing.T) {
+	const fn = "config_test/tmp.conf"
+	err := Create(fn, testPw, false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetUnlockLimit(3, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	// Directories in place of the files make creating them fail, even for
+	// root
+	for _, suffix := range []string{".lock", ".tmp"} {
+		if err := os.Mkdir(fn+unlockStateSuffix+suffix, 0700); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(fn + unlockStateSuffix + suffix)
+	}
+	if _, _, err := LoadAndDecrypt(fn, []byte("wrong")); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+	if _, _, err := LoadAndDecrypt(fn, testPw); err != nil {
+		t.Errorf("unlock failed: %v", err)
+	}
+	if _, err := os.Stat(fn + unlockStateSuffix); !os.IsNotExist(err) {
+		t.Errorf("state file has been written: %v", err)
+	}
+}
+
+func TestNameMax(t *testing.T) {
+	const fn = "config_test/tmp.conf"
+	err := Create(fn, testPw, false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := c.PlainNameMax(); n != 255 {
+		t.Errorf("default: want 255, got %d", n)
+	}
+	if err := c.SetNameMax(2000); err == nil {
+		t.Error("a limit over 1024 was accepted")
+	}
+	if err := c.SetNameMax(1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	c, err = Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagNameMax) || c.PlainNameMax() != 1000 {
+		t.Errorf("NameMax was not stored: %d", c.PlainNameMax())
+	}
+	// Old versions must not mount the filesystem without knowing the limit
+	c.FeatureFlags = c.FeatureFlags[:len(c.FeatureFlags)-1]
+	if err := c.validateNameMax(); err == nil {
+		t.Error("NameMax without feature flag was accepted")
+	}
+	err = Create(fn, testPw, true, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetNameMax(1000); err == nil {
+		t.Error("NameMax was accepted with plaintext names")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	const fn = "config_test/tmp.conf"
+	err := Create(fn, testPw, false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := c.Metadata(key); m != nil || err != nil {
+		t.Errorf("new config file: %v, %v", m, err)
+	}
+	want := Metadata{Created: "2021-05-08T15:16:21Z", Host: "host1", Notes: "backup of /home"}
+	if err := c.SetMetadata(key, want); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	js, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(js, []byte("host1")) {
+		t.Error("metadata is stored in plaintext")
+	}
+	c, err = Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.Metadata(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *m != want {
+		t.Errorf("want %v, got %v", want, *m)
+	}
+	wrongKey := make([]byte, len(key))
+	if _, err := c.Metadata(wrongKey); err == nil {
+		t.Error("decrypting with the wrong key succeeded")
+	}
+}
@@ -0,0 +1,70 @@
+package configfile
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// DuressParams holds the hash of the duress password. Unlocking the
+// filesystem with the duress password destroys the encrypted master key.
+type DuressParams struct {
+	// ScryptObject derives the key that is hashed into Hash. It has its
+	// own salt.
+	ScryptObject ScryptKDF
+	// Hash is the SHA256 of the scrypt-derived key
+	Hash []byte
+}
+
+// SetDuressPassword makes "password" the duress password. It must not be
+// the password that unlocks the master key.
+func (cf *ConfFile) SetDuressPassword(password []byte, logN int) error {
+	if len(password) == 0 {
+		return errors.New("the duress password must not be empty")
+	}
+	if masterkey, err := cf.decryptMasterKey(password); err == nil {
+		for i := range masterkey {
+			masterkey[i] = 0
+		}
+		return errors.New("the duress password must differ from the password")
+	}
+	d := &DuressParams{ScryptObject: NewScryptKDF(logN)}
+	d.Hash = d.hash(password)
+	cf.Duress = d
+	return nil
+}
+
+// IsDuressPassword tells if "password" is the duress password
+func (cf *ConfFile) IsDuressPassword(password []byte) bool {
+	if cf.Duress == nil {
+		return false
+	}
+	return hmac.Equal(cf.Duress.hash(password), cf.Duress.Hash)
+}
+
+func (d *DuressParams) hash(password []byte) []byte {
+	k := d.ScryptObject.DeriveKey(password)
+	h := sha256.Sum256(k)
+	for i := range k {
+		k[i] = 0
+	}
+	return h[:]
+}
+
+// destroyKey replaces the encrypted master key with random bytes of the
+// same length and removes the duress password, so the config file looks
+// like it has a password we do not know. The caller must look like it has
+// just seen a wrong password, so a failure is only logged. If the config
+// file cannot be written, for example on a read-only medium, the key on
+// disk survives. Copies of the config file are not touched either.
+func (cf *ConfFile) destroyKey() {
+	cf.EncryptedKey = cryptocore.RandBytes(len(cf.EncryptedKey))
+	cf.Duress = nil
+	if err := cf.WriteFile(); err != nil {
+		// Does not mention the duress password, somebody may be watching
+		tlog.Warn.Printf("Could not write the config file: %v", err)
+	}
+}
@@ -28,6 +28,16 @@ const (
 	// FlagFIDO2 means that "-fido2" was used when creating the filesystem.
 	// The masterkey is protected using a FIDO2 token instead of a password.
 	FlagFIDO2
+	// FlagDirPolicy means that some directories may have a
+	// "gocryptfs.dirpolicy" file instead of "gocryptfs.diriv". Their contents
+	// are stored with plaintext names or completely unencrypted.
+	FlagDirPolicy
+	// FlagMultiTenant means that some top-level directories are encrypted
+	// with master keys of their own, stored in ConfFile.Tenants.
+	FlagMultiTenant
+	// FlagNameMax means that plaintext file names may be longer than 255
+	// bytes, up to ConfFile.NameMax.
+	FlagNameMax
 )
 
 // knownFlags stores the known feature flags and their string representation
@@ -41,6 +51,9 @@ var knownFlags = map[flagIota]string{
 	FlagRaw64:          "Raw64",
 	FlagHKDF:           "HKDF",
 	FlagFIDO2:          "FIDO2",
+	FlagDirPolicy:      "DirPolicy",
+	FlagMultiTenant:    "MultiTenant",
+	FlagNameMax:        "NameMax",
 }
 
 // Filesystems that do not have these feature flags set are deprecated.
@@ -76,3 +89,10 @@ func (cf *ConfFile) IsFeatureFlagSet(flagWant flagIota) bool {
 	}
 	return false
 }
+
+// SetFeatureFlag enables the feature flag "flag" if it is not set yet
+func (cf *ConfFile) SetFeatureFlag(flag flagIota) {
+	if !cf.IsFeatureFlagSet(flag) {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[flag])
+	}
+}
@@ -0,0 +1,67 @@
+package configfile
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+)
+
+// hkdfInfoMetadata is the HKDF "info" for the key that encrypts
+// EncryptedMetadata
+const hkdfInfoMetadata = "gocryptfs.conf metadata encryption"
+
+// Metadata describes where a filesystem comes from. It is stored encrypted
+// with a key derived from the master key, so only who can unlock the
+// filesystem can read it.
+type Metadata struct {
+	// Created is the creation time in RFC 3339 format
+	Created string
+	// Host is the host name of the machine the filesystem was created on
+	Host string
+	// Notes is free-form text, see "-metadata-notes"
+	Notes string `json:",omitempty"`
+}
+
+// SetMetadata encrypts "m" using "masterkey". Call WriteFile() to store it.
+func (cf *ConfFile) SetMetadata(masterkey []byte, m Metadata) error {
+	js, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	ce := getMetadataEncrypter(masterkey)
+	cf.EncryptedMetadata = ce.EncryptBlock(js, 0, nil)
+	ce.Wipe()
+	return nil
+}
+
+// Metadata decrypts the metadata using "masterkey". Returns nil if the
+// config file has none.
+func (cf *ConfFile) Metadata(masterkey []byte) (*Metadata, error) {
+	if cf.EncryptedMetadata == nil {
+		return nil, nil
+	}
+	ce := getMetadataEncrypter(masterkey)
+	js, err := ce.DecryptBlock(cf.EncryptedMetadata, 0, nil)
+	ce.Wipe()
+	if err != nil {
+		return nil, fmt.Errorf("decrypting metadata: %v", err)
+	}
+	var m Metadata
+	if err := json.Unmarshal(js, &m); err != nil {
+		return nil, fmt.Errorf("decoding metadata: %v", err)
+	}
+	return &m, nil
+}
+
+// getMetadataEncrypter returns the ContentEnc for EncryptedMetadata. Its
+// key is not used for anything else.
+func getMetadataEncrypter(masterkey []byte) *contentenc.ContentEnc {
+	key := cryptocore.DeriveKey(masterkey, hkdfInfoMetadata)
+	ce := getKeyEncrypter(key, true)
+	for i := range key {
+		key[i] = 0
+	}
+	return ce
+}
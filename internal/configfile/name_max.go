@@ -0,0 +1,49 @@
+package configfile
+
+import (
+	"fmt"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// SetNameMax allows plaintext file names of up to "nameMax" bytes. Names
+// over 255 bytes do not fit into the backing filesystem even unencrypted,
+// so their encrypted form is always stored in a gocryptfs.longname.*.name
+// file. This needs filename encryption.
+func (cf *ConfFile) SetNameMax(nameMax int) error {
+	if cf.IsFeatureFlagSet(FlagPlaintextNames) {
+		return fmt.Errorf("NameMax: not possible with plaintext names")
+	}
+	if nameMax > nametransform.NameMaxLimit {
+		return fmt.Errorf("NameMax: %d is over the limit of %d", nameMax, nametransform.NameMaxLimit)
+	}
+	if nameMax <= nametransform.NameMax {
+		cf.NameMax = 0
+		return nil
+	}
+	cf.NameMax = nameMax
+	cf.SetFeatureFlag(FlagNameMax)
+	return nil
+}
+
+// PlainNameMax returns the longest plaintext file name in bytes.
+func (cf *ConfFile) PlainNameMax() int {
+	if cf.NameMax == 0 {
+		return nametransform.NameMax
+	}
+	return cf.NameMax
+}
+
+func (cf *ConfFile) validateNameMax() error {
+	if cf.NameMax == 0 {
+		return nil
+	}
+	if !cf.IsFeatureFlagSet(FlagNameMax) {
+		return fmt.Errorf("NameMax is set, but feature flag %q is not", knownFlags[FlagNameMax])
+	}
+	if cf.NameMax <= nametransform.NameMax || cf.NameMax > nametransform.NameMaxLimit {
+		return fmt.Errorf("NameMax: %d is out of range %d-%d",
+			cf.NameMax, nametransform.NameMax+1, nametransform.NameMaxLimit)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package configfile
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// TenantParams is the key slot of a top-level directory that is encrypted
+// with a master key of its own. The master key is encrypted with the
+// password of the tenant, like ConfFile.EncryptedKey.
+type TenantParams struct {
+	// Name is the plaintext name of the directory
+	Name string
+	// Dir is the name of the backing directory in CIPHERDIR
+	Dir string
+	// EncryptedKey holds the encrypted master key of the tenant
+	EncryptedKey []byte
+	// ScryptObject stores the parameters for hashing the tenant password
+	ScryptObject ScryptKDF
+}
+
+// Tenant returns the key slot of tenant "name", or nil
+func (cf *ConfFile) Tenant(name string) *TenantParams {
+	for i := range cf.Tenants {
+		if cf.Tenants[i].Name == name {
+			return &cf.Tenants[i]
+		}
+	}
+	return nil
+}
+
+// AddTenant stores "key", encrypted with "password", as the master key of
+// the top-level directory "name", whose backing directory is "dir". Sets
+// the "MultiTenant" feature flag. Call WriteFile() to store it.
+func (cf *ConfFile) AddTenant(name string, dir string, key []byte, password []byte, logN int) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid tenant name %q", name)
+	}
+	if len(password) == 0 {
+		return fmt.Errorf("the tenant password must not be empty")
+	}
+	if cf.Tenant(name) != nil {
+		return fmt.Errorf("tenant %q already exists", name)
+	}
+	t := TenantParams{
+		Name:         name,
+		Dir:          dir,
+		ScryptObject: NewScryptKDF(logN),
+	}
+	scryptHash := t.ScryptObject.DeriveKey(password)
+	ce := getKeyEncrypter(scryptHash, cf.IsFeatureFlagSet(FlagHKDF))
+	t.EncryptedKey = ce.EncryptBlock(key, 0, nil)
+	for i := range scryptHash {
+		scryptHash[i] = 0
+	}
+	ce.Wipe()
+	cf.Tenants = append(cf.Tenants, t)
+	cf.SetFeatureFlag(FlagMultiTenant)
+	return nil
+}
+
+// RemoveTenant deletes the key slot of tenant "name". The files of the
+// tenant cannot be decrypted any more. Call WriteFile() to store it.
+func (cf *ConfFile) RemoveTenant(name string) error {
+	for i := range cf.Tenants {
+		if cf.Tenants[i].Name == name {
+			cf.Tenants = append(cf.Tenants[:i], cf.Tenants[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("tenant %q does not exist", name)
+}
+
+// DecryptTenantKey decrypts the master key of tenant "name" using
+// "password". Subject to cf.UnlockLimit like DecryptMasterKey().
+func (cf *ConfFile) DecryptTenantKey(name string, password []byte) (masterkey []byte, err error) {
+	t := cf.Tenant(name)
+	if t == nil {
+		return nil, exitcodes.NewErr(fmt.Sprintf("tenant %q does not exist", name), exitcodes.Usage)
+	}
+	done, err := cf.beginUnlock()
+	if err != nil {
+		return nil, err
+	}
+	scryptHash := t.ScryptObject.DeriveKey(password)
+	ce := getKeyEncrypter(scryptHash, cf.IsFeatureFlagSet(FlagHKDF))
+	masterkey, err = ce.DecryptBlock(t.EncryptedKey, 0, nil)
+	for i := range scryptHash {
+		scryptHash[i] = 0
+	}
+	ce.Wipe()
+	if err != nil {
+		done(false)
+		tlog.Warn.Printf("failed to unlock the key of tenant %q: %s", name, err.Error())
+		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+	}
+	done(true)
+	return masterkey, nil
+}
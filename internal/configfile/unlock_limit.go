@@ -0,0 +1,178 @@
+package configfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// UnlockLimitParams slows down online brute-force attacks, like guessing
+// the password through the control socket. After the first failed attempt,
+// the next one is only allowed after 1s, then 2s, 4s, ... After MaxFailures
+// failed attempts in a row, unlocking is refused for LockoutSeconds.
+//
+// The failed attempts are counted in a state file next to the config file
+// (see unlockStateSuffix). Every attempt counts as failed until the password
+// turned out to be right, so parallel attempts cannot get around the limit.
+// Somebody who can delete that file can also copy the config file and attack
+// it offline, where only scrypt helps.
+type UnlockLimitParams struct {
+	MaxFailures    int
+	LockoutSeconds int
+}
+
+// unlockStateSuffix is appended to the config file name to get the name of
+// the state file
+const unlockStateSuffix = ".failures"
+
+// unlockState is the content of the state file
+type unlockState struct {
+	// Failures is the number of failed attempts since the last success
+	Failures int
+	// Last is the time of the last failed attempt
+	Last time.Time
+}
+
+// timeNow is time.Now, except in tests
+var timeNow = time.Now
+
+// SetUnlockLimit enables rate limiting of failed unlock attempts. Call
+// WriteFile() to store it.
+func (cf *ConfFile) SetUnlockLimit(maxFailures int, lockout time.Duration) error {
+	p := &UnlockLimitParams{MaxFailures: maxFailures, LockoutSeconds: int(lockout / time.Second)}
+	if err := p.validate(); err != nil {
+		return err
+	}
+	cf.UnlockLimit = p
+	return nil
+}
+
+func (p *UnlockLimitParams) validate() error {
+	if p.MaxFailures < 1 {
+		return errors.New("UnlockLimit: MaxFailures must be at least 1")
+	}
+	if p.LockoutSeconds < 1 {
+		return errors.New("UnlockLimit: LockoutSeconds must be at least 1")
+	}
+	return nil
+}
+
+// delay is how long to wait after the last of "failures" failed attempts
+func (p *UnlockLimitParams) delay(failures int) time.Duration {
+	lockout := time.Duration(p.LockoutSeconds) * time.Second
+	if failures == 0 {
+		return 0
+	}
+	if failures >= p.MaxFailures || failures > 30 {
+		return lockout
+	}
+	if d := time.Second << uint(failures-1); d < lockout {
+		return d
+	}
+	return lockout
+}
+
+func (cf *ConfFile) unlockStatePath() string {
+	return cf.filename + unlockStateSuffix
+}
+
+// readUnlockState returns the zero state if the state file does not exist
+// or cannot be read
+func (cf *ConfFile) readUnlockState() (s unlockState) {
+	js, err := ioutil.ReadFile(cf.unlockStatePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			tlog.Warn.Printf("UnlockLimit: %v", err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(js, &s); err != nil {
+		tlog.Warn.Printf("UnlockLimit: %s: %v", cf.unlockStatePath(), err)
+	}
+	return s
+}
+
+// lockUnlockState takes an exclusive lock that serializes access to the
+// state file between processes. The state file itself cannot be locked as
+// it is replaced on every write. Call the returned function to unlock.
+func (cf *ConfFile) lockUnlockState() (unlock func(), err error) {
+	f, err := os.OpenFile(cf.unlockStatePath()+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Closing the file releases the lock
+	return func() { f.Close() }, nil
+}
+
+// writeUnlockState atomically replaces the state file
+func (cf *ConfFile) writeUnlockState(s unlockState) error {
+	js, _ := json.Marshal(s)
+	tmp := cf.unlockStatePath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, js, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cf.unlockStatePath())
+}
+
+// beginUnlock returns an error if the next attempt is not allowed yet.
+// Otherwise, it counts the attempt as failed before the caller even tries
+// the password, so that parallel attempts see it. Call the returned function
+// with the outcome, a success resets the count.
+//
+// If the state cannot be locked or written, for example because the config
+// file is on a read-only medium, the attempt is allowed with a warning.
+// Failing would make the filesystem impossible to mount.
+func (cf *ConfFile) beginUnlock() (done func(success bool), err error) {
+	if cf.UnlockLimit == nil || cf.UnlockLimit.MaxFailures == 0 {
+		// No state file, no lock file
+		return func(bool) {}, nil
+	}
+	unlock, err := cf.lockUnlockState()
+	if err != nil {
+		tlog.Warn.Printf("UnlockLimit: cannot lock the state file, parallel attempts are not counted: %v", err)
+		unlock = func() {}
+	}
+	defer unlock()
+	s := cf.readUnlockState()
+	now := timeNow()
+	until := s.Last.Add(cf.UnlockLimit.delay(s.Failures))
+	if now.Before(until) {
+		wait := until.Sub(now).Round(time.Second)
+		if wait < time.Second {
+			wait = time.Second
+		}
+		msg := fmt.Sprintf("%d failed unlock attempts, try again in %v", s.Failures, wait)
+		return nil, exitcodes.NewErr(msg, exitcodes.UnlockLimit)
+	}
+	s.Failures++
+	s.Last = now
+	if err := cf.writeUnlockState(s); err != nil {
+		tlog.Warn.Printf("UnlockLimit: cannot count the attempt: %v", err)
+	}
+	return cf.endUnlock, nil
+}
+
+// endUnlock resets the count of failed attempts after a successful one
+func (cf *ConfFile) endUnlock(success bool) {
+	if !success {
+		return
+	}
+	// beginUnlock has already warned if the lock cannot be taken
+	if unlock, err := cf.lockUnlockState(); err == nil {
+		defer unlock()
+	}
+	if err := os.Remove(cf.unlockStatePath()); err != nil && !os.IsNotExist(err) {
+		tlog.Warn.Printf("UnlockLimit: %v", err)
+	}
+}
@@ -9,23 +9,35 @@ import (
 type bPool struct {
 	sync.Pool
 	sliceLen int
+	// wipe is set for pools that hold plaintext. Slices are overwritten with
+	// zeros when they are returned, so plaintext does not linger in memory.
+	wipe bool
 }
 
-func newBPool(sliceLen int) bPool {
+func newBPool(sliceLen int, wipe bool) bPool {
 	return bPool{
 		Pool: sync.Pool{
 			New: func() interface{} { return make([]byte, sliceLen) },
 		},
 		sliceLen: sliceLen,
+		wipe:     wipe,
 	}
 }
 
 // Put grows the slice "s" to its maximum capacity and puts it into the pool.
+// For wiping pools, this also means that Get() always returns a slice full
+// of zeros.
 func (b *bPool) Put(s []byte) {
 	s = s[:cap(s)]
 	if len(s) != b.sliceLen {
 		log.Panicf("wrong len=%d, want=%d", len(s), b.sliceLen)
 	}
+	if b.wipe {
+		// Compiled to a memclr call
+		for i := range s {
+			s[i] = 0
+		}
+	}
 	b.Pool.Put(s)
 }
 
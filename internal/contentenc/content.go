@@ -7,8 +7,6 @@ import (
 	"encoding/hex"
 	"errors"
 	"log"
-	"runtime"
-	"sync"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
@@ -61,7 +59,8 @@ type ContentEnc struct {
 	cBlockPool bPool
 	// Plaintext block pool. Always returns plainBS-sized byte slices
 	// (usually 4096 bytes).
-	pBlockPool bPool
+	// Used by Write() for the read-modify-write of partial blocks.
+	PBlockPool bPool
 	// Ciphertext request data pool. Always returns byte slices of size
 	// fuse.MAX_KERNEL_WRITE + encryption overhead.
 	// Used by Read() to temporarily store the ciphertext as it is read from
@@ -69,6 +68,8 @@ type ContentEnc struct {
 	CReqPool bPool
 	// Plaintext request data pool. Slice have size fuse.MAX_KERNEL_WRITE.
 	PReqPool bPool
+	// workers encrypt and decrypt large requests in parallel
+	workers *workerPool
 }
 
 // New returns an initialized ContentEnc instance.
@@ -91,10 +92,11 @@ func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEn
 		allZeroBlock: make([]byte, cipherBS),
 		allZeroNonce: make([]byte, cc.IVLen),
 		forceDecode:  forceDecode,
-		cBlockPool:   newBPool(int(cipherBS)),
-		CReqPool:     newBPool(cReqSize),
-		pBlockPool:   newBPool(int(plainBS)),
-		PReqPool:     newBPool(pReqSize),
+		cBlockPool:   newBPool(int(cipherBS), false),
+		CReqPool:     newBPool(cReqSize, false),
+		PBlockPool:   newBPool(int(plainBS), true),
+		PReqPool:     newBPool(pReqSize, true),
+		workers:      newWorkerPool(0),
 	}
 	return c
 }
@@ -109,26 +111,39 @@ func (be *ContentEnc) CipherBS() uint64 {
 	return be.cipherBS
 }
 
-// DecryptBlocks decrypts a number of blocks
+// DecryptBlocks decrypts a number of blocks. Large requests are decrypted
+// in parallel, see SetWorkers().
 func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, fileID []byte) ([]byte, error) {
-	cBuf := bytes.NewBuffer(ciphertext)
+	cBS := int(be.cipherBS)
+	n := (len(ciphertext) + cBS - 1) / cBS
+	pBlocks := make([][]byte, n)
+	errs := make([]error, n)
+	be.workers.run(n, func(low, high int) {
+		for i := low; i < high; i++ {
+			end := (i + 1) * cBS
+			if end > len(ciphertext) {
+				end = len(ciphertext)
+			}
+			pBlocks[i], errs[i] = be.DecryptBlock(ciphertext[i*cBS:end], firstBlockNo+uint64(i), fileID)
+		}
+	})
 	var err error
 	pBuf := bytes.NewBuffer(be.PReqPool.Get()[:0])
-	blockNo := firstBlockNo
-	for cBuf.Len() > 0 {
-		cBlock := cBuf.Next(int(be.cipherBS))
-		var pBlock []byte
-		pBlock, err = be.DecryptBlock(cBlock, blockNo, fileID)
+	for i, pBlock := range pBlocks {
+		err = errs[i]
 		if err != nil {
 			if be.forceDecode && err == stupidgcm.ErrAuth {
-				tlog.Warn.Printf("DecryptBlocks: authentication failure in block #%d, overridden by forcedecode", firstBlockNo)
+				tlog.Warn.Printf("DecryptBlocks: authentication failure in block #%d, overridden by forcedecode", firstBlockNo+uint64(i))
 			} else {
 				break
 			}
 		}
 		pBuf.Write(pBlock)
-		be.pBlockPool.Put(pBlock)
-		blockNo++
+	}
+	for _, pBlock := range pBlocks {
+		if pBlock != nil {
+			be.PBlockPool.Put(pBlock)
+		}
 	}
 	return pBuf.Bytes(), err
 }
@@ -164,7 +179,8 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 	// All-zero block?
 	if bytes.Equal(ciphertext, be.allZeroBlock) {
 		tlog.Debug.Printf("DecryptBlock: file hole encountered")
-		return make([]byte, be.plainBS), nil
+		// Slices from the plaintext pools are wiped, i.e. all-zero
+		return be.PBlockPool.Get(), nil
 	}
 
 	if len(ciphertext) < be.cryptoCore.IVLen {
@@ -184,7 +200,7 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 	ciphertext = ciphertext[be.cryptoCore.IVLen:]
 
 	// Decrypt
-	plaintext := be.pBlockPool.Get()
+	plaintext := be.PBlockPool.Get()
 	plaintext = plaintext[:0]
 	aData := concatAD(blockNo, fileID)
 	plaintext, err := be.cryptoCore.AEADCipher.Open(plaintext, nonce, ciphertext, aData)
@@ -195,57 +211,25 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 		if be.forceDecode && err == stupidgcm.ErrAuth {
 			return plaintext, err
 		}
+		// Go's GCM only fails on authentication failures
+		if be.forceDecode && be.cryptoCore.AEADBackend == cryptocore.BackendGoGCM {
+			return be.forceDecryptGoGCM(nonce, ciphertext)
+		}
 		return nil, err
 	}
 
 	return plaintext, nil
 }
 
-// At some point, splitting the ciphertext into more groups will not improve
-// performance, as spawning goroutines comes at a cost.
-// 2 seems to work ok for now.
-const encryptMaxSplit = 2
-
-// encryptBlocksParallel splits the plaintext into parts and encrypts them
-// in parallel.
-func (be *ContentEnc) encryptBlocksParallel(plaintextBlocks [][]byte, ciphertextBlocks [][]byte, firstBlockNo uint64, fileID []byte) {
-	ncpu := runtime.NumCPU()
-	if ncpu > encryptMaxSplit {
-		ncpu = encryptMaxSplit
-	}
-	groupSize := len(plaintextBlocks) / ncpu
-	var wg sync.WaitGroup
-	for i := 0; i < ncpu; i++ {
-		wg.Add(1)
-		go func(i int) {
-			low := i * groupSize
-			high := (i + 1) * groupSize
-			if i == ncpu-1 {
-				// Last part picks up any left-over blocks
-				//
-				// The last part could run in the original goroutine, but
-				// doing that complicates the code, and, surprisingly,
-				// incurs a 1 % performance penalty.
-				high = len(plaintextBlocks)
-			}
-			be.doEncryptBlocks(plaintextBlocks[low:high], ciphertextBlocks[low:high], firstBlockNo+uint64(low), fileID)
-			wg.Done()
-		}(i)
-	}
-	wg.Wait()
-}
-
 // EncryptBlocks is like EncryptBlock but takes multiple plaintext blocks.
 // Returns a byte slice from CReqPool - so don't forget to return it
 // to the pool.
 func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) []byte {
 	ciphertextBlocks := make([][]byte, len(plaintextBlocks))
 	// For large writes, we parallelize encryption.
-	if len(plaintextBlocks) >= 32 && runtime.NumCPU() >= 2 {
-		be.encryptBlocksParallel(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID)
-	} else {
-		be.doEncryptBlocks(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID)
-	}
+	be.workers.run(len(plaintextBlocks), func(low, high int) {
+		be.doEncryptBlocks(plaintextBlocks[low:high], ciphertextBlocks[low:high], firstBlockNo+uint64(low), fileID)
+	})
 	// Concatenate ciphertext into a single byte array.
 	tmp := be.CReqPool.Get()
 	out := bytes.NewBuffer(tmp[:0])
@@ -314,6 +298,10 @@ func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []
 
 // MergeBlocks - Merge newData into oldData at offset
 // New block may be bigger than both newData and oldData
+//
+// If oldData has a capacity of at least one block (for example, because
+// it comes from PBlockPool), the merge happens in place and the result
+// shares its memory.
 func (be *ContentEnc) MergeBlocks(oldData []byte, newData []byte, offset int) []byte {
 	// Fastpath for small-file creation
 	if len(oldData) == 0 && offset == 0 {
@@ -321,10 +309,19 @@ func (be *ContentEnc) MergeBlocks(oldData []byte, newData []byte, offset int) []
 	}
 
 	// Make block of maximum size
-	out := make([]byte, be.plainBS)
-
-	// Copy old and new data into it
-	copy(out, oldData)
+	var out []byte
+	if uint64(cap(oldData)) >= be.plainBS {
+		out = oldData[:be.plainBS]
+		// Zero the gap between old and new data, it becomes a hole
+		for i := len(oldData); i < offset; i++ {
+			out[i] = 0
+		}
+	} else {
+		out = make([]byte, be.plainBS)
+		// Copy old data into it
+		copy(out, oldData)
+	}
+	// Copy new data into it
 	l := len(newData)
 	copy(out[offset:offset+l], newData)
 
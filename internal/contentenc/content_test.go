@@ -1,9 +1,11 @@
 package contentenc
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/stupidgcm"
 )
 
 type testRange struct {
@@ -94,3 +96,111 @@ func TestBlockNo(t *testing.T) {
 		t.Errorf("actual: %d", b)
 	}
 }
+
+// TestParallelBlocks checks that splitting large requests across workers
+// gives the same result as processing them in one goroutine.
+func TestParallelBlocks(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	serial := New(cc, DefaultBS, false)
+	serial.SetWorkers(1)
+	parallel := New(cc, DefaultBS, false)
+	parallel.SetWorkers(4)
+	fileID := make([]byte, 16)
+	// 37 full blocks and a partial one
+	pBlocks := make([][]byte, 38)
+	for i := range pBlocks {
+		pBlocks[i] = bytes.Repeat([]byte{byte(i)}, DefaultBS)
+	}
+	pBlocks[37] = pBlocks[37][:100]
+	want := bytes.Join(pBlocks, nil)
+	c1 := serial.EncryptBlocks(pBlocks, 5, fileID)
+	c2 := parallel.EncryptBlocks(pBlocks, 5, fileID)
+	if len(c1) != len(c2) {
+		t.Fatalf("ciphertext length differs: %d vs %d", len(c1), len(c2))
+	}
+	// Each side must be able to decrypt what the other one encrypted
+	for _, tc := range []struct {
+		dec *ContentEnc
+		c   []byte
+	}{{parallel, c1}, {serial, c2}} {
+		p, err := tc.dec.DecryptBlocks(tc.c, 5, fileID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, want) {
+			t.Error("plaintext differs")
+		}
+	}
+	// Decryption stops at the first corrupt block
+	c1[20*int(serial.CipherBS())+30] ^= 1
+	p, err := parallel.DecryptBlocks(c1, 5, fileID)
+	if err == nil {
+		t.Error("corruption was not detected")
+	}
+	if len(p) != 20*DefaultBS {
+		t.Errorf("want %d bytes before the corrupt block, have %d", 20*DefaultBS, len(p))
+	}
+}
+
+// TestPlaintextPoolWipe checks that plaintext buffers are wiped when they
+// go back into the pool.
+func TestPlaintextPoolWipe(t *testing.T) {
+	p := newBPool(100, true)
+	s := p.Get()
+	for i := range s {
+		s[i] = 0xaa
+	}
+	p.Put(s[:10])
+	if !bytes.Equal(s, make([]byte, 100)) {
+		t.Error("slice was not wiped")
+	}
+}
+
+func TestMergeBlocks(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false)
+	old := []byte("0123456789")
+	want := []byte("0123ab6789")
+	if have := f.MergeBlocks(old, []byte("ab"), 4); !bytes.Equal(have, want) {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	// In place, with stale data behind the old data that must become a hole
+	buf := f.PBlockPool.Get()
+	copy(buf, "0123456789xxxx")
+	have := f.MergeBlocks(buf[:10], []byte("ab"), 12)
+	want = []byte("0123456789\x00\x00ab")
+	if !bytes.Equal(have, want) {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	if &have[0] != &buf[0] {
+		t.Error("merge did not happen in place")
+	}
+}
+
+// TestForceDecodeGoGCM flips a bit in a block encrypted with Go's GCM and
+// checks that "forceDecode" returns the plaintext with the same bit flipped.
+func TestForceDecodeGoGCM(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, true)
+	f := New(cc, DefaultBS, true)
+	fileID := make([]byte, headerIDLen)
+	plaintext := bytes.Repeat([]byte("0123456789"), 100)
+	ciphertext := f.EncryptBlock(plaintext, 3, fileID)
+	ciphertext[cc.IVLen+5] ^= 0x01
+	have, err := f.DecryptBlock(ciphertext, 3, fileID)
+	if err != stupidgcm.ErrAuth {
+		t.Fatalf("want ErrAuth, got %v", err)
+	}
+	want := append([]byte{}, plaintext...)
+	want[5] ^= 0x01
+	if !bytes.Equal(have, want) {
+		t.Errorf("wrong plaintext %q", have)
+	}
+	// Without forceDecode, the block is rejected
+	f = New(cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false), DefaultBS, false)
+	if have, err = f.DecryptBlock(ciphertext, 3, fileID); err == nil || have != nil {
+		t.Errorf("corrupt block was accepted")
+	}
+}
@@ -0,0 +1,30 @@
+package contentenc
+
+import (
+	"github.com/HorizonLiu/gocryptfs/internal/stupidgcm"
+)
+
+// forceDecryptGoGCM decrypts a block that failed authentication with Go's
+// GCM implementation, for "-forcedecode". stupidgcm does this itself, but
+// crypto/cipher does not hand out the plaintext of a corrupt block.
+//
+// GCM encrypts with AES-CTR, starting at a counter that is derived from the
+// nonce. Sealing all-zero bytes with the same nonce yields the keystream,
+// XORing it with the ciphertext the plaintext. "ciphertext" is without nonce,
+// but with the authentication tag.
+//
+// Returns a slice from PBlockPool and stupidgcm.ErrAuth, like stupidgcm
+// with forceDecode set.
+func (be *ContentEnc) forceDecryptGoGCM(nonce []byte, ciphertext []byte) ([]byte, error) {
+	aead := be.cryptoCore.AEADCipher
+	if len(ciphertext) < aead.Overhead() {
+		return nil, stupidgcm.ErrAuth
+	}
+	ciphertext = ciphertext[:len(ciphertext)-aead.Overhead()]
+	keystream := aead.Seal(nil, nonce, make([]byte, len(ciphertext)), nil)
+	plaintext := be.PBlockPool.Get()[:len(ciphertext)]
+	for i := range plaintext {
+		plaintext[i] = ciphertext[i] ^ keystream[i]
+	}
+	return plaintext, stupidgcm.ErrAuth
+}
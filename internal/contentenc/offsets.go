@@ -139,6 +139,27 @@ func (be *ContentEnc) ExplodeCipherRange(offset uint64, length uint64) []IntraBl
 	return blocks
 }
 
+// CipherSpaceToPlainSpace calculates how many bytes of plaintext fit into
+// `cipherSpace` bytes of space on the backing filesystem, when stored as a
+// single file.
+//
+// Unlike CipherSizeToPlainSize, every cipherSpace value is legal. This is
+// used to report free space in plaintext terms.
+func (be *ContentEnc) CipherSpaceToPlainSpace(cipherSpace uint64) uint64 {
+	if cipherSpace <= HeaderLen {
+		return 0
+	}
+	cipherSpace -= HeaderLen
+	plainSpace := cipherSpace / be.cipherBS * be.plainBS
+	// A partial block still holds some plaintext if it is larger than the
+	// overhead
+	rest := cipherSpace % be.cipherBS
+	if rest > be.BlockOverhead() {
+		plainSpace += rest - be.BlockOverhead()
+	}
+	return plainSpace
+}
+
 // BlockOverhead returns the per-block overhead.
 func (be *ContentEnc) BlockOverhead() uint64 {
 	return be.cipherBS - be.plainBS
@@ -51,3 +51,22 @@ func TestSizeToSize(t *testing.T) {
 		fmt.Printf("%d\t%d\t%d\t%d\n", x, yTable[x][0], yTable[x][1], yTable[x][2])
 	}
 }
+
+// TestCipherSpaceToPlainSpace checks that the plaintext size we report for
+// a given amount of free space actually fits into it, and that one more byte
+// would not.
+func TestCipherSpaceToPlainSpace(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	ce := New(cc, DefaultBS, false)
+
+	for x := uint64(0); x < 10000; x++ {
+		p := ce.CipherSpaceToPlainSpace(x)
+		if ce.PlainSizeToCipherSize(p) > x {
+			t.Fatalf("space %d: plaintext size %d does not fit", x, p)
+		}
+		if ce.PlainSizeToCipherSize(p+1) <= x {
+			t.Fatalf("space %d: plaintext size %d+1 would still fit", x, p)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package contentenc
+
+import (
+	"runtime"
+	"sync"
+)
+
+// minBlocksPerWorker is the smallest number of blocks that is worth handing
+// to another goroutine. Smaller requests are processed by the caller alone.
+const minBlocksPerWorker = 16
+
+// workerPool limits the number of goroutines that encrypt and decrypt
+// blocks in parallel. It is shared by all requests of one filesystem.
+type workerPool struct {
+	// n is the number of block groups a request is split into at most
+	n int
+	// slots holds one token per goroutine that may run in addition to the
+	// callers
+	slots chan struct{}
+}
+
+func newWorkerPool(n int) *workerPool {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	return &workerPool{
+		n:     n,
+		slots: make(chan struct{}, n-1),
+	}
+}
+
+// SetWorkers sets the number of goroutines that encrypt or decrypt the
+// blocks of large requests in parallel. 0 means one per CPU, 1 disables
+// parallel processing. Must be called before the first request.
+func (be *ContentEnc) SetWorkers(n int) {
+	be.workers = newWorkerPool(n)
+}
+
+// run splits "nBlocks" blocks into groups and calls f(low, high) for each
+// group, in parallel if enough workers are free. Returns when all groups
+// are done.
+func (p *workerPool) run(nBlocks int, f func(low, high int)) {
+	parts := nBlocks / minBlocksPerWorker
+	if parts > p.n {
+		parts = p.n
+	}
+	if parts < 2 {
+		f(0, nBlocks)
+		return
+	}
+	groupSize := nBlocks / parts
+	var wg sync.WaitGroup
+	for i := 0; i < parts; i++ {
+		low := i * groupSize
+		high := low + groupSize
+		if i == parts-1 {
+			// Last part picks up any left-over blocks and runs in the
+			// calling goroutine
+			f(low, nBlocks)
+			break
+		}
+		select {
+		case p.slots <- struct{}{}:
+			wg.Add(1)
+			go func() {
+				f(low, high)
+				<-p.slots
+				wg.Done()
+			}()
+		default:
+			// All workers are busy with other requests
+			f(low, high)
+		}
+	}
+	wg.Wait()
+}
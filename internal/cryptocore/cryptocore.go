@@ -155,6 +155,10 @@ type wiper interface {
 // This is not bulletproof due to possible GC copies, but
 // still raises to bar for extracting the key.
 func (c *CryptoCore) Wipe() {
+	if c.AEADCipher == nil {
+		// Already wiped
+		return
+	}
 	be := c.AEADBackend
 	if be == BackendOpenSSL || be == BackendAESSIV {
 		tlog.Debug.Printf("CryptoCore.Wipe: Wiping AEADBackend %d key", be)
@@ -171,3 +175,13 @@ func (c *CryptoCore) Wipe() {
 	c.EMECipher = nil
 	runtime.GC()
 }
+
+// Rekey derives fresh ciphers from "key" and installs them in place of the
+// current ones. It is used to restore the keys after Wipe() without
+// invalidating the references that other objects hold to "c".
+// The backend and IV length stay the same.
+func (c *CryptoCore) Rekey(key []byte, useHKDF bool, forceDecode bool) {
+	n := New(key, c.AEADBackend, c.IVLen*8, useHKDF, forceDecode)
+	c.EMECipher = n.EMECipher
+	c.AEADCipher = n.AEADCipher
+}
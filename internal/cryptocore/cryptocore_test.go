@@ -39,3 +39,27 @@ func TestNewPanic(t *testing.T) {
 	key := make([]byte, 16)
 	New(key, BackendOpenSSL, 128, true, false)
 }
+
+// After Wipe, Rekey must restore working ciphers, and double Wipe must not
+// crash.
+func TestWipeRekey(t *testing.T) {
+	key := make([]byte, 32)
+	for _, be := range []AEADTypeEnum{BackendGoGCM, BackendAESSIV} {
+		c := New(key, be, 128, true, false)
+		nonce := make([]byte, c.IVLen)
+		ct := c.AEADCipher.Seal(nil, nonce, []byte("hello"), nil)
+		c.Wipe()
+		c.Wipe()
+		if c.AEADCipher != nil || c.EMECipher != nil {
+			t.Fatalf("backend %d: ciphers not wiped", be)
+		}
+		c.Rekey(key, true, false)
+		pt, err := c.AEADCipher.Open(nil, nonce, ct, nil)
+		if err != nil || string(pt) != "hello" {
+			t.Errorf("backend %d: decryption after Rekey failed: %v", be, err)
+		}
+		if c.EMECipher == nil {
+			t.Errorf("backend %d: EMECipher not restored", be)
+		}
+	}
+}
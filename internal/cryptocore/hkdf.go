@@ -27,3 +27,10 @@ func hkdfDerive(masterkey []byte, info string, outLen int) (out []byte) {
 	}
 	return out
 }
+
+// DeriveKey derives a KeyLen-byte key for "info" from "masterkey" using
+// HKDF. It is for data outside of the filesystem that needs a key of its
+// own, like the metadata in the config file.
+func DeriveKey(masterkey []byte, info string) []byte {
+	return hkdfDerive(masterkey, info, KeyLen)
+}
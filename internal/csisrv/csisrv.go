@@ -0,0 +1,198 @@
+//go:build go1.24
+// +build go1.24
+
+// Package csisrv implements the node side of the Container Storage Interface
+// (CSI), the gRPC API that Kubernetes uses to mount volumes. Only the
+// Identity service and the Node calls for volumes without a staging step are
+// implemented. gRPC runs over unencrypted HTTP/2, which net/http supports
+// since Go 1.24, and the few protobuf messages are coded by hand.
+// ( https://github.com/container-storage-interface/spec/blob/master/spec.md )
+package csisrv
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// gRPC status codes
+const (
+	CodeInvalidArgument    = 3
+	CodeNotFound           = 5
+	CodePermissionDenied   = 7
+	CodeFailedPrecondition = 9
+	CodeUnimplemented      = 12
+	CodeInternal           = 13
+)
+
+// Error is an error with a gRPC status code
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf returns an *Error with the status code "code"
+func Errorf(code int, format string, a ...interface{}) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Node does the actual work of the Node service
+type Node interface {
+	// Publish mounts the volume at req.TargetPath. It must succeed if the
+	// volume is already mounted there.
+	Publish(ctx context.Context, req *PublishRequest) error
+	// Unpublish unmounts req.TargetPath and removes it. It must succeed if
+	// nothing is mounted there.
+	Unpublish(ctx context.Context, req *UnpublishRequest) error
+}
+
+// Server answers the CSI calls of the kubelet
+type Server struct {
+	// Name is the driver name, like "gocryptfs.csi.example.com"
+	Name string
+	// Version is the vendor version
+	Version string
+	// NodeID identifies this node, usually the host name
+	NodeID string
+	Node   Node
+}
+
+// maxMessageSize limits the size of a request. CSI requests are small.
+const maxMessageSize = 4 * 1024 * 1024
+
+// Listen creates the listener for a CSI endpoint like
+// "unix:///csi/csi.sock". A stale socket file is removed first.
+func Listen(endpoint string) (net.Listener, error) {
+	path := endpoint
+	if strings.HasPrefix(endpoint, "unix:") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		path = u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+	} else if strings.Contains(endpoint, "://") {
+		return nil, fmt.Errorf("unsupported endpoint %q, want unix://PATH", endpoint)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// Serve answers gRPC requests on "l" until it is closed
+func (s *Server) Serve(l net.Listener) error {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{
+		Handler:   s,
+		Protocols: &protocols,
+	}
+	return srv.Serve(l)
+}
+
+// ServeHTTP implements http.Handler. Every request is one unary gRPC call.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	req, err := readMessage(r.Body)
+	var resp []byte
+	if err == nil {
+		resp, err = s.call(r.Context(), r.URL.Path, req)
+	}
+	if err != nil {
+		e, ok := err.(*Error)
+		if !ok {
+			e = &Error{Code: CodeInternal, Message: err.Error()}
+		}
+		tlog.Warn.Printf("csi: %s: %s", r.URL.Path, e.Message)
+		w.Header().Set("Grpc-Status", strconv.Itoa(e.Code))
+		w.Header().Set("Grpc-Message", url.PathEscape(e.Message))
+		return
+	}
+	frame := make([]byte, 5, 5+len(resp))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+	w.Write(append(frame, resp...))
+	w.Header().Set("Grpc-Status", "0")
+}
+
+// readMessage reads the single length-prefixed message of a unary call
+func readMessage(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, Errorf(CodeInvalidArgument, "reading request: %v", err)
+	}
+	if hdr[0] != 0 {
+		return nil, Errorf(CodeUnimplemented, "compressed requests are not supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxMessageSize {
+		return nil, Errorf(CodeInvalidArgument, "request too large: %d bytes", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, Errorf(CodeInvalidArgument, "reading request: %v", err)
+	}
+	return msg, nil
+}
+
+// call runs the method "method" ("/csi.v1.Service/Method") with the
+// marshaled request "req" and returns the marshaled response
+func (s *Server) call(ctx context.Context, method string, req []byte) ([]byte, error) {
+	switch method {
+	case "/csi.v1.Identity/GetPluginInfo":
+		var resp []byte
+		resp = appendString(resp, 1, s.Name)
+		resp = appendString(resp, 2, s.Version)
+		return resp, nil
+	case "/csi.v1.Identity/GetPluginCapabilities":
+		// No controller service, so no capabilities
+		return nil, nil
+	case "/csi.v1.Identity/Probe":
+		// ready = google.protobuf.BoolValue{value: true}
+		return appendBytes(nil, 1, appendVarint(nil, 1, 1)), nil
+	case "/csi.v1.Node/NodeGetCapabilities":
+		// No STAGE_UNSTAGE_VOLUME, so NodePublishVolume is called directly
+		return nil, nil
+	case "/csi.v1.Node/NodeGetInfo":
+		return appendString(nil, 1, s.NodeID), nil
+	case "/csi.v1.Node/NodePublishVolume":
+		r, err := parsePublishRequest(req)
+		if err != nil {
+			return nil, Errorf(CodeInvalidArgument, "%v", err)
+		}
+		if r.VolumeID == "" || r.TargetPath == "" {
+			return nil, Errorf(CodeInvalidArgument, "volume_id and target_path are required")
+		}
+		return nil, s.Node.Publish(ctx, r)
+	case "/csi.v1.Node/NodeUnpublishVolume":
+		r, err := parseUnpublishRequest(req)
+		if err != nil {
+			return nil, Errorf(CodeInvalidArgument, "%v", err)
+		}
+		if r.VolumeID == "" || r.TargetPath == "" {
+			return nil, Errorf(CodeInvalidArgument, "volume_id and target_path are required")
+		}
+		return nil, s.Node.Unpublish(ctx, r)
+	}
+	return nil, Errorf(CodeUnimplemented, "method %s is not implemented", method)
+}
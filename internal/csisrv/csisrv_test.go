@@ -0,0 +1,141 @@
+//go:build go1.24
+// +build go1.24
+
+package csisrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type testNode struct {
+	published   *PublishRequest
+	unpublished *UnpublishRequest
+}
+
+func (n *testNode) Publish(ctx context.Context, req *PublishRequest) error {
+	if req.Secrets["password"] == "" {
+		return Errorf(CodeInvalidArgument, "no password")
+	}
+	n.published = req
+	return nil
+}
+
+func (n *testNode) Unpublish(ctx context.Context, req *UnpublishRequest) error {
+	n.unpublished = req
+	return nil
+}
+
+// grpcCall calls "method" on the server at "sock" like a gRPC client would
+// and returns the response message and the status code
+func grpcCall(t *testing.T, sock string, method string, req []byte) ([]byte, int) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{
+		Protocols: &protocols,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+	frame := make([]byte, 5)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(req)))
+	resp, err := client.Post("http://localhost"+method, "application/grpc", bytes.NewReader(append(frame, req...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("%s: protocol %s", method, resp.Proto)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		// Trailers-Only response
+		status = resp.Header.Get("Grpc-Status")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		t.Fatalf("%s: grpc-status %q", method, status)
+	}
+	if len(body) == 0 {
+		return nil, code
+	}
+	if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:])) != len(body)-5 {
+		t.Fatalf("%s: bad response frame %x", method, body)
+	}
+	return body[5:], code
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csisrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "csi.sock")
+	l, err := Listen("unix://" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	node := &testNode{}
+	srv := &Server{Name: "gocryptfs.example.com", Version: "v1", NodeID: "node1", Node: node}
+	go srv.Serve(l)
+
+	resp, code := grpcCall(t, sock, "/csi.v1.Identity/GetPluginInfo", nil)
+	want := appendString(appendString(nil, 1, "gocryptfs.example.com"), 2, "v1")
+	if code != 0 || !bytes.Equal(resp, want) {
+		t.Errorf("GetPluginInfo: %d %x", code, resp)
+	}
+	resp, code = grpcCall(t, sock, "/csi.v1.Node/NodeGetInfo", nil)
+	if code != 0 || !bytes.Equal(resp, appendString(nil, 1, "node1")) {
+		t.Errorf("NodeGetInfo: %d %x", code, resp)
+	}
+	if _, code = grpcCall(t, sock, "/csi.v1.Controller/CreateVolume", nil); code != CodeUnimplemented {
+		t.Errorf("CreateVolume: %d", code)
+	}
+
+	var req []byte
+	req = appendString(req, publishVolumeID, "vol1")
+	req = appendString(req, publishTargetPath, "/var/lib/kubelet/pods/x/mount")
+	if _, code = grpcCall(t, sock, "/csi.v1.Node/NodePublishVolume", req); code != CodeInvalidArgument {
+		t.Errorf("NodePublishVolume without password: %d", code)
+	}
+	req = appendVarint(req, publishReadonly, 1)
+	req = appendMap(req, publishSecrets, map[string]string{"password": "test"})
+	req = appendMap(req, publishVolumeContext, map[string]string{"csi.storage.k8s.io/ephemeral": "true"})
+	if _, code = grpcCall(t, sock, "/csi.v1.Node/NodePublishVolume", req); code != 0 {
+		t.Errorf("NodePublishVolume: %d", code)
+	}
+	wantReq := &PublishRequest{
+		VolumeID:      "vol1",
+		TargetPath:    "/var/lib/kubelet/pods/x/mount",
+		Readonly:      true,
+		Secrets:       map[string]string{"password": "test"},
+		VolumeContext: map[string]string{"csi.storage.k8s.io/ephemeral": "true"},
+	}
+	if !reflect.DeepEqual(node.published, wantReq) {
+		t.Errorf("want %+v, have %+v", wantReq, node.published)
+	}
+
+	req = appendString(nil, unpublishVolumeID, "vol1")
+	req = appendString(req, unpublishTargetPath, "/mnt")
+	if _, code = grpcCall(t, sock, "/csi.v1.Node/NodeUnpublishVolume", req); code != 0 {
+		t.Errorf("NodeUnpublishVolume: %d", code)
+	}
+	if *node.unpublished != (UnpublishRequest{VolumeID: "vol1", TargetPath: "/mnt"}) {
+		t.Errorf("unpublished %+v", node.unpublished)
+	}
+}
@@ -0,0 +1,220 @@
+package csisrv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Protocol buffer wire types
+const (
+	wireVarint = 0
+	wire64     = 1
+	wireBytes  = 2
+	wire32     = 5
+)
+
+var errTruncated = errors.New("csisrv: truncated protobuf message")
+
+// protoField is one field of a protobuf message. "val" is set for varint and
+// fixed-size fields, "b" for length-delimited ones.
+type protoField struct {
+	num  int
+	wire int
+	val  uint64
+	b    []byte
+}
+
+// parseProto splits a protobuf message into its fields
+func parseProto(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errTruncated
+		}
+		b = b[n:]
+		f := protoField{num: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case wireVarint:
+			f.val, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errTruncated
+			}
+			b = b[n:]
+		case wire64:
+			if len(b) < 8 {
+				return nil, errTruncated
+			}
+			f.val = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wire32:
+			if len(b) < 4 {
+				return nil, errTruncated
+			}
+			f.val = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, errTruncated
+			}
+			f.b = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			return nil, fmt.Errorf("csisrv: unsupported protobuf wire type %d", f.wire)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// parseMapEntry parses an entry of a map<string, string>
+func parseMapEntry(b []byte) (key, value string, err error) {
+	fields, err := parseProto(b)
+	if err != nil {
+		return "", "", err
+	}
+	for _, f := range fields {
+		switch {
+		case f.num == 1 && f.wire == wireBytes:
+			key = string(f.b)
+		case f.num == 2 && f.wire == wireBytes:
+			value = string(f.b)
+		}
+	}
+	return key, value, nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendKey(b []byte, num int, wire int) []byte {
+	return appendUvarint(b, uint64(num)<<3|uint64(wire))
+}
+
+// appendBytes appends a length-delimited field: a string, bytes or an
+// embedded message
+func appendBytes(b []byte, num int, v []byte) []byte {
+	b = appendKey(b, num, wireBytes)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendString appends a string field. Empty strings are the default and
+// are left out.
+func appendString(b []byte, num int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return appendBytes(b, num, []byte(v))
+}
+
+// appendVarint appends an integer, enum or bool field. Zero is the default
+// and is left out.
+func appendVarint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendKey(b, num, wireVarint)
+	return appendUvarint(b, v)
+}
+
+// appendMap appends a map<string, string>, sorted by key
+func appendMap(b []byte, num int, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, m[k])
+		b = appendBytes(b, num, entry)
+	}
+	return b
+}
+
+// PublishRequest is the part of a NodePublishVolumeRequest that gocryptfs
+// uses
+type PublishRequest struct {
+	VolumeID   string
+	TargetPath string
+	Readonly   bool
+	// Secrets come from the Secret referenced by the StorageClass or the
+	// inline volume ("csi.storage.k8s.io/node-publish-secret-name")
+	Secrets       map[string]string
+	VolumeContext map[string]string
+}
+
+// UnpublishRequest is a NodeUnpublishVolumeRequest
+type UnpublishRequest struct {
+	VolumeID   string
+	TargetPath string
+}
+
+// Field numbers from csi.proto, version 1
+const (
+	publishVolumeID      = 1
+	publishTargetPath    = 4
+	publishReadonly      = 6
+	publishSecrets       = 7
+	publishVolumeContext = 8
+
+	unpublishVolumeID   = 1
+	unpublishTargetPath = 2
+)
+
+func parsePublishRequest(b []byte) (*PublishRequest, error) {
+	fields, err := parseProto(b)
+	if err != nil {
+		return nil, err
+	}
+	req := &PublishRequest{
+		Secrets:       make(map[string]string),
+		VolumeContext: make(map[string]string),
+	}
+	for _, f := range fields {
+		switch {
+		case f.num == publishVolumeID && f.wire == wireBytes:
+			req.VolumeID = string(f.b)
+		case f.num == publishTargetPath && f.wire == wireBytes:
+			req.TargetPath = string(f.b)
+		case f.num == publishReadonly && f.wire == wireVarint:
+			req.Readonly = f.val != 0
+		case (f.num == publishSecrets || f.num == publishVolumeContext) && f.wire == wireBytes:
+			k, v, err := parseMapEntry(f.b)
+			if err != nil {
+				return nil, err
+			}
+			if f.num == publishSecrets {
+				req.Secrets[k] = v
+			} else {
+				req.VolumeContext[k] = v
+			}
+		}
+	}
+	return req, nil
+}
+
+func parseUnpublishRequest(b []byte) (*UnpublishRequest, error) {
+	fields, err := parseProto(b)
+	if err != nil {
+		return nil, err
+	}
+	req := &UnpublishRequest{}
+	for _, f := range fields {
+		switch {
+		case f.num == unpublishVolumeID && f.wire == wireBytes:
+			req.VolumeID = string(f.b)
+		case f.num == unpublishTargetPath && f.wire == wireBytes:
+			req.TargetPath = string(f.b)
+		}
+	}
+	return req, nil
+}
@@ -0,0 +1,51 @@
+package csisrv
+
+import (
+	"testing"
+)
+
+func TestParseProto(t *testing.T) {
+	var b []byte
+	// ends holds the offsets where a field ends, where cutting the message
+	// is not an error
+	ends := make(map[int]bool)
+	b = appendString(b, 1, "vol")
+	ends[len(b)] = true
+	b = appendVarint(b, 6, 1)
+	ends[len(b)] = true
+	b = appendVarint(b, 9, 300)
+	ends[len(b)] = true
+	b = appendMap(b, 7, map[string]string{"a": "1"})
+	ends[len(b)] = true
+	b = appendMap(b, 7, map[string]string{"b": "2"})
+	fields, err := parseProto(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 5 {
+		t.Fatalf("%d fields", len(fields))
+	}
+	if f := fields[0]; f.num != 1 || f.wire != wireBytes || string(f.b) != "vol" {
+		t.Errorf("field 0: %+v", f)
+	}
+	if f := fields[2]; f.num != 9 || f.wire != wireVarint || f.val != 300 {
+		t.Errorf("field 2: %+v", f)
+	}
+	if k, v, err := parseMapEntry(fields[3].b); k != "a" || v != "1" || err != nil {
+		t.Errorf("map entry: %q %q %v", k, v, err)
+	}
+	for i := 1; i < len(b); i++ {
+		if _, err := parseProto(b[:i]); (err == nil) != ends[i] {
+			t.Errorf("cut at %d: %v", i, err)
+		}
+	}
+}
+
+func TestAppendMap(t *testing.T) {
+	var want []byte
+	want = appendMap(want, 7, map[string]string{"a": "1"})
+	want = appendMap(want, 7, map[string]string{"b": "2"})
+	if have := appendMap(nil, 7, map[string]string{"b": "2", "a": "1"}); string(have) != string(want) {
+		t.Errorf("entries are not sorted: %x", have)
+	}
+}
@@ -3,8 +3,8 @@
 package ctlsocksrv
 
 import (
+	"crypto/subtle"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -12,6 +12,7 @@ import (
 	"syscall"
 
 	"github.com/HorizonLiu/gocryptfs/ctlsock"
+	"github.com/HorizonLiu/gocryptfs/internal/opstats"
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
 )
 
@@ -21,16 +22,105 @@ type Interface interface {
 	DecryptPath(string) (string, error)
 }
 
+// Unlocker is implemented by filesystems that support "-idlelock"
+type Unlocker interface {
+	Unlock(password string) error
+}
+
+// Freezer is implemented by filesystems that can present a frozen view for
+// consistent backups (reverse mode)
+type Freezer interface {
+	Freeze() error
+	Thaw() error
+}
+
+// OpenFilesLister is implemented by filesystems that can list their open
+// files
+type OpenFilesLister interface {
+	OpenFiles() []string
+}
+
+// CacheFlusher is implemented by filesystems that have internal caches
+type CacheFlusher interface {
+	FlushCaches()
+}
+
+// FDCacheReporter is implemented by filesystems that cache backing file
+// descriptors
+type FDCacheReporter interface {
+	FDCacheStats() *ctlsock.FDCacheStats
+}
+
+// ConfigChanger changes the password in the config file of a mounted
+// filesystem
+type ConfigChanger interface {
+	ChangePassword(oldPw string, newPw string) error
+	RewrapStart(password string, logN int) error
+	RewrapStatus() string
+}
+
+// TreeWalker is implemented by filesystems that can translate a whole
+// directory tree in one go
+type TreeWalker interface {
+	// WalkTree returns the plaintext and ciphertext paths of the entries
+	// below the plaintext directory "plainDir". It stops after "max" entries
+	// and returns truncated=true.
+	WalkTree(plainDir string, max int) (tree []ctlsock.PathPair, truncated bool, err error)
+}
+
+// MountInfo contains information about the mount that is not known to the
+// filesystem itself, and the access control settings of the socket.
+type MountInfo struct {
+	// Stats collects the FUSE operation counters. May be nil.
+	Stats *opstats.Stats
+	// Options is the list of command line options, see
+	// ctlsock.ResponseStruct.MountOptions.
+	Options []string
+	// Config is nil if the filesystem has no config file (like with
+	// "-masterkey") or uses FIDO2.
+	Config ConfigChanger
+	// Token must be sent with every request if it is not empty,
+	// "-ctlsock-token-file"
+	Token string
+	// AllowUIDs lists the users that may connect. Everybody who can open the
+	// socket may connect if it is empty, "-ctlsock-allow-uid"
+	AllowUIDs []uint32
+	// Reload applies changed runtime options. May be nil.
+	Reload func() error
+	// SetDirPolicy gives an empty directory a directory policy. May be nil.
+	SetDirPolicy func(path string, policy string) error
+	// Remount applies the mount options of a "Remount" request, which have
+	// been checked by ParseRemount. May be nil.
+	Remount func(opts RemountOptions) error
+}
+
+// protoError is an error in the use of the protocol, as opposed to an error
+// from the filesystem
+type protoError struct {
+	code string
+	text string
+}
+
+func (e *protoError) Error() string {
+	return e.text
+}
+
+func newProtoError(code string, text string) error {
+	return &protoError{code: code, text: text}
+}
+
 type ctlSockHandler struct {
 	fs     Interface
+	info   MountInfo
 	socket *net.UnixListener
 }
 
 // Serve serves incoming connections on "sock". This call blocks so you
 // probably want to run it in a new goroutine.
-func Serve(sock net.Listener, fs Interface) {
+func Serve(sock net.Listener, fs Interface, info MountInfo) {
 	handler := ctlSockHandler{
 		fs:     fs,
+		info:   info,
 		socket: sock.(*net.UnixListener),
 	}
 	handler.acceptLoop()
@@ -50,105 +140,341 @@ func (ch *ctlSockHandler) acceptLoop() {
 	}
 }
 
-// ReadBufSize is the size of the request read buffer.
-// The longest possible path is 4096 bytes on Linux and 1024 on Mac OS X so
-// 5000 bytes should be enough to hold the whole JSON request. This
-// assumes that the path does not contain too many characters that had to be
-// be escaped in JSON (for example, a null byte blows up to "\u0000").
+// MaxRequestSize is the maximum size of a request. A single path is at most
+// 4096 bytes on Linux and 1024 on Mac OS X, but "EncryptPaths" and
+// "DecryptPaths" requests can contain many paths.
 // We abort the connection if the request is bigger than this.
-const ReadBufSize = 5000
+const MaxRequestSize = 1024 * 1024
 
 // handleConnection reads and parses JSON requests from "conn"
 func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
-	buf := make([]byte, ReadBufSize)
+	defer conn.Close()
+	if !ch.peerAllowed(conn) {
+		sendMsg(conn, newResponse(newProtoError(ctlsock.ErrCodeUnauthorized, "Unauthorized"), "", ""))
+		return
+	}
+	// Requests can be bigger than a single read, so let the decoder read
+	// until the JSON object is complete
+	lr := &io.LimitedReader{R: conn}
+	dec := json.NewDecoder(lr)
 	for {
-		n, err := conn.Read(buf)
+		lr.N = MaxRequestSize
+		var in ctlsock.RequestStruct
+		err := dec.Decode(&in)
 		if err == io.EOF {
-			conn.Close()
 			return
-		} else if err != nil {
-			tlog.Warn.Printf("ctlsock: Read error: %#v", err)
-			conn.Close()
+		} else if lr.N <= 0 {
+			tlog.Warn.Printf("ctlsock: request too big (max = %d bytes)", MaxRequestSize)
 			return
-		}
-		if n == ReadBufSize {
-			tlog.Warn.Printf("ctlsock: request too big (max = %d bytes)", ReadBufSize-1)
-			conn.Close()
+		} else if _, ok := err.(net.Error); ok {
+			tlog.Warn.Printf("ctlsock: Read error: %#v", err)
 			return
-		}
-		data := buf[:n]
-		var in ctlsock.RequestStruct
-		err = json.Unmarshal(data, &in)
-		if err != nil {
+		} else if err != nil {
+			// We cannot find the start of the next request after a syntax
+			// error, so report the error and close the connection
 			tlog.Warn.Printf("ctlsock: JSON Unmarshal error: %#v", err)
-			err = errors.New("JSON Unmarshal error: " + err.Error())
-			sendResponse(conn, err, "", "")
-			continue
+			err = newProtoError(ctlsock.ErrCodeBadRequest, "JSON Unmarshal error: "+err.Error())
+			sendMsg(conn, newResponse(err, "", ""))
+			return
 		}
-		ch.handleRequest(&in, conn)
+		sendMsg(conn, ch.handleRequest(&in))
 	}
 }
 
 // handleRequest handles an already-unmarshaled JSON request
-func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct) *ctlsock.ResponseStruct {
 	var err error
-	var inPath, outPath, clean, warnText string
-	// You cannot perform both decryption and encryption in one request
-	if in.DecryptPath != "" && in.EncryptPath != "" {
-		err = errors.New("Ambiguous")
-		sendResponse(conn, err, "", "")
-		return
+	if in.Version > ctlsock.ProtocolVersion {
+		err = newProtoError(ctlsock.ErrCodeUnsupportedVersion,
+			fmt.Sprintf("Unsupported protocol version %d", in.Version))
+		return newResponse(err, "", "")
+	}
+	if ch.info.Token != "" && subtle.ConstantTimeCompare([]byte(in.Token), []byte(ch.info.Token)) != 1 {
+		tlog.Warn.Printf("ctlsock: rejected request with wrong token")
+		err = newProtoError(ctlsock.ErrCodeUnauthorized, "Unauthorized")
+		return newResponse(err, "", "")
+	}
+	// A request that only contains the version is used for negotiation
+	if countCommands(in) == 0 && in.Version > 0 {
+		return newResponse(nil, "", "")
+	}
+	// You cannot perform more than one command (like both decryption and
+	// encryption) in one request
+	if countCommands(in) > 1 {
+		err = newProtoError(ctlsock.ErrCodeAmbiguous, "Ambiguous")
+		return newResponse(err, "", "")
+	}
+	if in.Unlock != "" {
+		if u, ok := ch.fs.(Unlocker); ok {
+			err = u.Unlock(in.Unlock)
+		} else {
+			err = syscall.ENOTSUP
+		}
+		return newResponse(err, "", "")
+	}
+	if in.Freeze || in.Thaw {
+		if f, ok := ch.fs.(Freezer); !ok {
+			err = syscall.ENOTSUP
+		} else if in.Freeze {
+			err = f.Freeze()
+		} else {
+			err = f.Thaw()
+		}
+		return newResponse(err, "", "")
+	}
+	if in.Reload {
+		if ch.info.Reload == nil {
+			return newResponse(syscall.ENOTSUP, "", "")
+		}
+		return newResponse(ch.info.Reload(), "", "")
+	}
+	if in.SetDirPolicy != "" {
+		if ch.info.SetDirPolicy == nil {
+			return newResponse(syscall.ENOTSUP, "", "")
+		}
+		clean := SanitizePath(in.SetDirPolicy)
+		if clean == "" {
+			err = newProtoError(ctlsock.ErrCodeEmptyInput, "Empty input after canonicalization")
+			return newResponse(err, "", "")
+		}
+		return newResponse(ch.info.SetDirPolicy(clean, in.DirPolicy), "", "")
+	}
+	if in.Remount != "" {
+		if ch.info.Remount == nil {
+			return newResponse(syscall.ENOTSUP, "", "")
+		}
+		opts, err := ParseRemount(in.Remount)
+		if err != nil {
+			return newResponse(newProtoError(ctlsock.ErrCodeBadRequest, err.Error()), "", "")
+		}
+		return newResponse(ch.info.Remount(opts), "", "")
+	}
+	if in.ChangePassword || in.RewrapStart || in.RewrapStatus {
+		return ch.handleConfigRequest(in)
+	}
+	if isInfoRequest(in) {
+		return ch.handleInfoRequest(in)
+	}
+	if in.EncryptPaths != nil || in.DecryptPaths != nil {
+		return ch.handleBatchRequest(in)
+	}
+	if in.EncryptTree != "" || in.DecryptTree != "" {
+		return ch.handleTreeRequest(in)
 	}
 	// Neither encryption nor encryption has been requested, makes no sense
 	if in.DecryptPath == "" && in.EncryptPath == "" {
-		err = errors.New("Empty input")
-		sendResponse(conn, err, "", "")
-		return
+		err = newProtoError(ctlsock.ErrCodeEmptyInput, "Empty input")
+		return newResponse(err, "", "")
 	}
-	// Canonicalize input path
+	var outPath, warnText string
 	if in.EncryptPath != "" {
-		inPath = in.EncryptPath
+		outPath, warnText, err = ch.translate(in.EncryptPath, true)
 	} else {
-		inPath = in.DecryptPath
+		outPath, warnText, err = ch.translate(in.DecryptPath, false)
 	}
-	clean = SanitizePath(inPath)
+	return newResponse(err, outPath, warnText)
+}
+
+// translate canonicalizes "inPath" and encrypts or decrypts it
+func (ch *ctlSockHandler) translate(inPath string, encrypt bool) (outPath string, warnText string, err error) {
+	clean := SanitizePath(inPath)
 	// Warn if a non-canonical path was passed
 	if inPath != clean {
 		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", inPath, clean)
 	}
 	// Error out if the canonical path is now empty
 	if clean == "" {
-		err = errors.New("Empty input after canonicalization")
-		sendResponse(conn, err, "", warnText)
-		return
+		err = newProtoError(ctlsock.ErrCodeEmptyInput, "Empty input after canonicalization")
+		return "", warnText, err
 	}
 	// Actual encrypt or decrypt operation
-	if in.EncryptPath != "" {
+	if encrypt {
 		outPath, err = ch.fs.EncryptPath(clean)
 	} else {
 		outPath, err = ch.fs.DecryptPath(clean)
 	}
-	sendResponse(conn, err, outPath, warnText)
+	return outPath, warnText, err
+}
+
+// handleBatchRequest handles the EncryptPaths and DecryptPaths requests.
+// Errors are reported per path.
+func (ch *ctlSockHandler) handleBatchRequest(in *ctlsock.RequestStruct) *ctlsock.ResponseStruct {
+	paths, encrypt := in.DecryptPaths, false
+	if in.EncryptPaths != nil {
+		paths, encrypt = in.EncryptPaths, true
+	}
+	msg := &ctlsock.ResponseStruct{
+		Results: make([]ctlsock.PathResult, len(paths)),
+	}
+	for i, p := range paths {
+		outPath, warnText, err := ch.translate(p, encrypt)
+		r := newResponse(err, outPath, warnText)
+		msg.Results[i] = ctlsock.PathResult{
+			Result:   r.Result,
+			ErrNo:    r.ErrNo,
+			ErrText:  r.ErrText,
+			WarnText: r.WarnText,
+		}
+	}
+	return msg
+}
+
+// maxTreeEntries limits the size of EncryptTree and DecryptTree responses.
+// The forward mode holds the key lock during the walk.
+const maxTreeEntries = 100000
+
+// handleTreeRequest handles the EncryptTree and DecryptTree requests
+func (ch *ctlSockHandler) handleTreeRequest(in *ctlsock.RequestStruct) *ctlsock.ResponseStruct {
+	w, ok := ch.fs.(TreeWalker)
+	if !ok {
+		return newResponse(syscall.ENOTSUP, "", "")
+	}
+	// Unlike the single path requests, the root directory is allowed here
+	plainDir := SanitizePath(in.EncryptTree)
+	if in.DecryptTree != "" {
+		var err error
+		plainDir, err = ch.fs.DecryptPath(SanitizePath(in.DecryptTree))
+		if err != nil {
+			return newResponse(err, "", "")
+		}
+	}
+	tree, truncated, err := w.WalkTree(plainDir, maxTreeEntries)
+	if err != nil {
+		return newResponse(err, "", "")
+	}
+	return &ctlsock.ResponseStruct{Tree: tree, TreeTruncated: truncated}
+}
+
+// peerAllowed checks the user id of the peer against "-ctlsock-allow-uid"
+func (ch *ctlSockHandler) peerAllowed(conn *net.UnixConn) bool {
+	if len(ch.info.AllowUIDs) == 0 {
+		return true
+	}
+	uid, err := peerUID(conn)
+	if err != nil {
+		tlog.Warn.Printf("ctlsock: cannot get peer credentials: %v", err)
+		return false
+	}
+	for _, u := range ch.info.AllowUIDs {
+		if u == uid {
+			return true
+		}
+	}
+	tlog.Warn.Printf("ctlsock: rejected connection from uid %d", uid)
+	return false
 }
 
-// sendResponse sends a JSON response message
-func sendResponse(conn *net.UnixConn, err error, result string, warnText string) {
-	msg := ctlsock.ResponseStruct{
+// isInfoRequest returns true if one of the fields that can be combined with
+// each other is set
+func isInfoRequest(in *ctlsock.RequestStruct) bool {
+	return in.Stats || in.Latency || in.OpenFiles || in.FlushCaches || in.FDCache || in.MountOptions
+}
+
+// countCommands returns the number of mutually exclusive commands in "in"
+func countCommands(in *ctlsock.RequestStruct) (n int) {
+	for _, set := range []bool{in.EncryptPath != "", in.DecryptPath != "",
+		in.Unlock != "", in.Freeze, in.Thaw, in.Reload, isInfoRequest(in),
+		in.ChangePassword, in.RewrapStart, in.RewrapStatus,
+		in.EncryptPaths != nil, in.DecryptPaths != nil,
+		in.EncryptTree != "", in.DecryptTree != "", in.SetDirPolicy != "",
+		in.Remount != ""} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// handleConfigRequest handles the ChangePassword, RewrapStart and RewrapStatus
+// requests
+func (ch *ctlSockHandler) handleConfigRequest(in *ctlsock.RequestStruct) *ctlsock.ResponseStruct {
+	c := ch.info.Config
+	if c == nil {
+		return newResponse(syscall.ENOTSUP, "", "")
+	}
+	var err error
+	if in.ChangePassword {
+		err = c.ChangePassword(in.Password, in.NewPassword)
+	} else if in.RewrapStart {
+		err = c.RewrapStart(in.Password, in.ScryptN)
+	} else {
+		return &ctlsock.ResponseStruct{RewrapStatus: c.RewrapStatus()}
+	}
+	return newResponse(err, "", "")
+}
+
+// handleInfoRequest handles the Stats, Latency, OpenFiles, FlushCaches, FDCache
+// and MountOptions requests
+func (ch *ctlSockHandler) handleInfoRequest(in *ctlsock.RequestStruct) *ctlsock.ResponseStruct {
+	var msg ctlsock.ResponseStruct
+	if in.FlushCaches {
+		f, ok := ch.fs.(CacheFlusher)
+		if !ok {
+			return newResponse(syscall.ENOTSUP, "", "")
+		}
+		f.FlushCaches()
+	}
+	if in.Stats {
+		if ch.info.Stats == nil {
+			return newResponse(syscall.ENOTSUP, "", "")
+		}
+		msg.Stats = ch.info.Stats.Snapshot()
+	}
+	if in.Latency {
+		if ch.info.Stats == nil {
+			return newResponse(syscall.ENOTSUP, "", "")
+		}
+		msg.Latency = ch.info.Stats.Latency()
+	}
+	if in.OpenFiles {
+		l, ok := ch.fs.(OpenFilesLister)
+		if !ok {
+			return newResponse(syscall.ENOTSUP, "", "")
+		}
+		msg.OpenFiles = l.OpenFiles()
+	}
+	if in.FDCache {
+		r, ok := ch.fs.(FDCacheReporter)
+		if !ok {
+			return newResponse(syscall.ENOTSUP, "", "")
+		}
+		msg.FDCache = r.FDCacheStats()
+	}
+	if in.MountOptions {
+		msg.MountOptions = ch.info.Options
+	}
+	return &msg
+}
+
+// newResponse returns a response message for "err"
+func newResponse(err error, result string, warnText string) *ctlsock.ResponseStruct {
+	msg := &ctlsock.ResponseStruct{
 		Result:   result,
 		WarnText: warnText,
 	}
 	if err != nil {
 		msg.ErrText = err.Error()
 		msg.ErrNo = -1
+		msg.ErrCode = ctlsock.ErrCodeUnknown
 		// Try to extract the actual error number
 		if pe, ok := err.(*os.PathError); ok {
 			if se, ok := pe.Err.(syscall.Errno); ok {
 				msg.ErrNo = int32(se)
+				msg.ErrCode = ctlsock.ErrCodeErrno
 			}
-		} else if err == syscall.ENOENT {
-			msg.ErrNo = int32(syscall.ENOENT)
+		} else if se, ok := err.(syscall.Errno); ok {
+			msg.ErrNo = int32(se)
+			msg.ErrCode = ctlsock.ErrCodeErrno
+		} else if pe, ok := err.(*protoError); ok {
+			msg.ErrCode = pe.code
 		}
 	}
+	return msg
+}
+
+// sendMsg sends "msg", encoded as JSON
+func sendMsg(conn *net.UnixConn, msg *ctlsock.ResponseStruct) {
+	msg.Version = ctlsock.ProtocolVersion
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Marshal failed: %v", err)
@@ -0,0 +1,243 @@
+package ctlsocksrv
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/ctlsock"
+)
+
+func TestCountCommands(t *testing.T) {
+	testCases := []struct {
+		in   ctlsock.RequestStruct
+		want int
+	}{
+		{ctlsock.RequestStruct{}, 0},
+		{ctlsock.RequestStruct{EncryptPath: "a"}, 1},
+		{ctlsock.RequestStruct{EncryptPath: "a", DecryptPath: "b"}, 2},
+		{ctlsock.RequestStruct{Stats: true, Latency: true, OpenFiles: true, FlushCaches: true, FDCache: true, MountOptions: true}, 1},
+		{ctlsock.RequestStruct{Stats: true, Unlock: "pw"}, 2},
+		{ctlsock.RequestStruct{Freeze: true, Thaw: true}, 2},
+		{ctlsock.RequestStruct{Reload: true, Stats: true}, 2},
+		{ctlsock.RequestStruct{SetDirPolicy: "a", DirPolicy: "passthrough"}, 1},
+		{ctlsock.RequestStruct{Remount: "ro", Freeze: true}, 2},
+	}
+	for i, tc := range testCases {
+		if have := countCommands(&tc.in); have != tc.want {
+			t.Errorf("case %d: want %d, have %d", i, tc.want, have)
+		}
+	}
+}
+
+type fakeFS struct{}
+
+func (f *fakeFS) EncryptPath(p string) (string, error) {
+	return "enc-" + p, nil
+}
+
+func (f *fakeFS) DecryptPath(p string) (string, error) {
+	return "", syscall.ENOENT
+}
+
+// serveTest starts a control socket server with "info" and returns the
+// socket path and a cleanup function
+func serveTest(t *testing.T, info MountInfo) (string, func()) {
+	dir, err := ioutil.TempDir("", "ctlsock_serve_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockPath := dir + "/sock"
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go Serve(sock, &fakeFS{}, info)
+	return sockPath, func() {
+		sock.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func query(t *testing.T, sockPath string, req ctlsock.RequestStruct) *ctlsock.ResponseStruct {
+	c, err := ctlsock.New(sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	resp, err := c.Query(&req)
+	if err != nil {
+		if r, ok := err.(*ctlsock.ResponseStruct); ok {
+			return r
+		}
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestProtocol(t *testing.T) {
+	sockPath, cleanup := serveTest(t, MountInfo{Token: "secret"})
+	defer cleanup()
+	testCases := []struct {
+		req     ctlsock.RequestStruct
+		errCode string
+	}{
+		{ctlsock.RequestStruct{Token: "secret"}, ""},
+		{ctlsock.RequestStruct{Token: "secret", EncryptPath: "foo"}, ""},
+		{ctlsock.RequestStruct{Token: "wrong", EncryptPath: "foo"}, ctlsock.ErrCodeUnauthorized},
+		{ctlsock.RequestStruct{EncryptPath: "foo"}, ctlsock.ErrCodeUnauthorized},
+		{ctlsock.RequestStruct{Token: "secret", Version: 99}, ctlsock.ErrCodeUnsupportedVersion},
+		{ctlsock.RequestStruct{Token: "secret", EncryptPath: "a", DecryptPath: "b"}, ctlsock.ErrCodeAmbiguous},
+		{ctlsock.RequestStruct{Token: "secret", EncryptPath: "/"}, ctlsock.ErrCodeEmptyInput},
+		{ctlsock.RequestStruct{Token: "secret", DecryptPath: "foo"}, ctlsock.ErrCodeErrno},
+	}
+	for i, tc := range testCases {
+		resp := query(t, sockPath, tc.req)
+		if resp.ErrCode != tc.errCode {
+			t.Errorf("case %d: want ErrCode %q, have %+v", i, tc.errCode, resp)
+		}
+		if resp.Version != ctlsock.ProtocolVersion {
+			t.Errorf("case %d: wrong version %d", i, resp.Version)
+		}
+	}
+}
+
+func TestAllowUIDs(t *testing.T) {
+	uid := uint32(os.Getuid())
+	sockPath, cleanup := serveTest(t, MountInfo{AllowUIDs: []uint32{uid}})
+	defer cleanup()
+	resp := query(t, sockPath, ctlsock.RequestStruct{EncryptPath: "foo"})
+	if runtime.GOOS == "darwin" {
+		// peerUID is not implemented, connections are rejected
+		if resp.ErrCode != ctlsock.ErrCodeUnauthorized {
+			t.Errorf("want Unauthorized, have %+v", resp)
+		}
+		return
+	}
+	if resp.ErrCode != "" || resp.Result != "enc-foo" {
+		t.Errorf("own uid should be allowed: %+v", resp)
+	}
+	sockPath, cleanup2 := serveTest(t, MountInfo{AllowUIDs: []uint32{uid + 1}})
+	defer cleanup2()
+	resp = query(t, sockPath, ctlsock.RequestStruct{EncryptPath: "foo"})
+	if resp.ErrCode != ctlsock.ErrCodeUnauthorized {
+		t.Errorf("want Unauthorized, have %+v", resp)
+	}
+}
+
+func TestReload(t *testing.T) {
+	sockPath, cleanup := serveTest(t, MountInfo{})
+	defer cleanup()
+	resp := query(t, sockPath, ctlsock.RequestStruct{Reload: true})
+	if resp.ErrNo != int32(syscall.ENOTSUP) {
+		t.Errorf("without Reload func: %+v", resp)
+	}
+	n := 0
+	sockPath, cleanup2 := serveTest(t, MountInfo{Reload: func() error {
+		n++
+		return nil
+	}})
+	defer cleanup2()
+	resp = query(t, sockPath, ctlsock.RequestStruct{Reload: true})
+	if resp.ErrCode != "" || resp.ErrNo != 0 || n != 1 {
+		t.Errorf("n=%d, %+v", n, resp)
+	}
+}
+
+func TestSetDirPolicy(t *testing.T) {
+	sockPath, cleanup := serveTest(t, MountInfo{})
+	defer cleanup()
+	req := ctlsock.RequestStruct{SetDirPolicy: "/pub/", DirPolicy: "passthrough"}
+	resp := query(t, sockPath, req)
+	if resp.ErrNo != int32(syscall.ENOTSUP) {
+		t.Errorf("without SetDirPolicy func: %+v", resp)
+	}
+	var path, policy string
+	sockPath, cleanup2 := serveTest(t, MountInfo{SetDirPolicy: func(p string, pol string) error {
+		path, policy = p, pol
+		return nil
+	}})
+	defer cleanup2()
+	resp = query(t, sockPath, req)
+	if resp.ErrCode != "" || resp.ErrNo != 0 || path != "pub" || policy != "passthrough" {
+		t.Errorf("path=%q policy=%q, %+v", path, policy, resp)
+	}
+	resp = query(t, sockPath, ctlsock.RequestStruct{SetDirPolicy: "/", DirPolicy: "passthrough"})
+	if resp.ErrCode != ctlsock.ErrCodeEmptyInput {
+		t.Errorf("root directory: %+v", resp)
+	}
+}
+
+func (f *fakeFS) WalkTree(plainDir string, max int) ([]ctlsock.PathPair, bool, error) {
+	if plainDir != "" {
+		return nil, false, syscall.ENOENT
+	}
+	return []ctlsock.PathPair{{Plain: "a", Cipher: "enc-a"}}, false, nil
+}
+
+func TestBatchAndTree(t *testing.T) {
+	sockPath, cleanup := serveTest(t, MountInfo{})
+	defer cleanup()
+	resp := query(t, sockPath, ctlsock.RequestStruct{EncryptPaths: []string{"a", "/b/", ""}})
+	if resp.ErrCode != "" || len(resp.Results) != 3 {
+		t.Fatalf("%+v", resp)
+	}
+	if resp.Results[0].Result != "enc-a" || resp.Results[0].ErrNo != 0 {
+		t.Errorf("result 0: %+v", resp.Results[0])
+	}
+	if resp.Results[1].Result != "enc-b" || resp.Results[1].WarnText == "" {
+		t.Errorf("result 1: %+v", resp.Results[1])
+	}
+	if resp.Results[2].ErrNo != -1 {
+		t.Errorf("result 2: %+v", resp.Results[2])
+	}
+	resp = query(t, sockPath, ctlsock.RequestStruct{DecryptPaths: []string{"x"}})
+	if len(resp.Results) != 1 || resp.Results[0].ErrNo != int32(syscall.ENOENT) {
+		t.Errorf("%+v", resp)
+	}
+	resp = query(t, sockPath, ctlsock.RequestStruct{EncryptTree: "/"})
+	if resp.ErrCode != "" || len(resp.Tree) != 1 || resp.Tree[0].Cipher != "enc-a" {
+		t.Errorf("%+v", resp)
+	}
+	resp = query(t, sockPath, ctlsock.RequestStruct{EncryptTree: "/", EncryptPaths: []string{"a"}})
+	if resp.ErrCode != ctlsock.ErrCodeAmbiguous {
+		t.Errorf("%+v", resp)
+	}
+	// Bigger than a single read
+	var many []string
+	for i := 0; i < 2000; i++ {
+		many = append(many, "some/long/path/name")
+	}
+	resp = query(t, sockPath, ctlsock.RequestStruct{EncryptPaths: many})
+	if len(resp.Results) != len(many) {
+		t.Errorf("want %d results, have %d", len(many), len(resp.Results))
+	}
+}
+
+func TestRemount(t *testing.T) {
+	sockPath, cleanup := serveTest(t, MountInfo{})
+	defer cleanup()
+	resp := query(t, sockPath, ctlsock.RequestStruct{Remount: "ro"})
+	if resp.ErrNo != int32(syscall.ENOTSUP) {
+		t.Errorf("without Remount func: %+v", resp)
+	}
+	var have RemountOptions
+	sockPath, cleanup2 := serveTest(t, MountInfo{Remount: func(opts RemountOptions) error {
+		have = opts
+		return nil
+	}})
+	defer cleanup2()
+	resp = query(t, sockPath, ctlsock.RequestStruct{Remount: "ro, noexec"})
+	if resp.ErrCode != "" || have.ReadOnly == nil || !*have.ReadOnly || have.Noexec == nil || !*have.Noexec {
+		t.Errorf("have=%+v, %+v", have, resp)
+	}
+	for _, bad := range []string{"ro,rw", "nosuid", "ro,"} {
+		resp = query(t, sockPath, ctlsock.RequestStruct{Remount: bad})
+		if resp.ErrCode != ctlsock.ErrCodeBadRequest {
+			t.Errorf("%q: %+v", bad, resp)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package ctlsocksrv
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/ctlsock"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// httpHandler serves the control operations over HTTP ("-ctlhttp").
+// The API is described in Documentation/ctlhttp-openapi.yaml.
+//
+// "POST /v1/request" takes a ctlsock.RequestStruct and returns a
+// ctlsock.ResponseStruct, exactly like the control socket. The GET endpoints
+// are shortcuts for the read-only requests.
+type httpHandler struct {
+	ch *ctlSockHandler
+}
+
+// Timeouts of the HTTP server, so clients cannot tie up connections forever
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpReadTimeout       = 30 * time.Second
+	// EncryptTree responses can be large
+	httpWriteTimeout = 2 * time.Minute
+	httpIdleTimeout  = 2 * time.Minute
+)
+
+// ServeHTTPAPI serves the control operations over HTTP on "l". This call
+// blocks so you probably want to run it in a new goroutine.
+func ServeHTTPAPI(l net.Listener, fs Interface, info MountInfo) {
+	srv := &http.Server{
+		Handler:           &httpHandler{ch: &ctlSockHandler{fs: fs, info: info}},
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	err := srv.Serve(l)
+	// Serve always returns an error, usually "use of closed network
+	// connection" on exit
+	tlog.Info.Printf("ctlhttp: Serve: %v", err)
+}
+
+// getRequests maps the GET endpoints to the requests they perform
+var getRequests = map[string]ctlsock.RequestStruct{
+	"/v1/version":      {},
+	"/v1/stats":        {Stats: true},
+	"/v1/latency":      {Latency: true},
+	"/v1/openfiles":    {OpenFiles: true},
+	"/v1/fdcache":      {FDCache: true},
+	"/v1/mountoptions": {MountOptions: true},
+	"/v1/rewrapstatus": {RewrapStatus: true},
+}
+
+// ServeHTTP implements http.Handler
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var in ctlsock.RequestStruct
+	if req, ok := getRequests[r.URL.Path]; ok {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		in = req
+		in.Version = ctlsock.ProtocolVersion
+	} else if r.URL.Path == "/v1/request" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body := http.MaxBytesReader(w, r.Body, MaxRequestSize)
+		if err := json.NewDecoder(body).Decode(&in); err != nil {
+			err = newProtoError(ctlsock.ErrCodeBadRequest, "JSON Unmarshal error: "+err.Error())
+			writeHTTPResponse(w, newResponse(err, "", ""))
+			return
+		}
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+	// The token can also be passed as "Authorization: Bearer TOKEN"
+	if in.Token == "" {
+		in.Token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	writeHTTPResponse(w, h.ch.handleRequest(&in))
+}
+
+// writeHTTPResponse sends "msg" as JSON with a matching HTTP status code
+func writeHTTPResponse(w http.ResponseWriter, msg *ctlsock.ResponseStruct) {
+	msg.Version = ctlsock.ProtocolVersion
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(msg))
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		tlog.Warn.Printf("ctlhttp: Write failed: %v", err)
+	}
+}
+
+// httpStatus returns the HTTP status code for the response "msg"
+func httpStatus(msg *ctlsock.ResponseStruct) int {
+	switch msg.ErrCode {
+	case "":
+		return http.StatusOK
+	case ctlsock.ErrCodeBadRequest, ctlsock.ErrCodeAmbiguous, ctlsock.ErrCodeEmptyInput,
+		ctlsock.ErrCodeUnsupportedVersion:
+		return http.StatusBadRequest
+	case ctlsock.ErrCodeUnauthorized:
+		return http.StatusUnauthorized
+	case ctlsock.ErrCodeErrno:
+		switch syscall.Errno(msg.ErrNo) {
+		case syscall.ENOENT:
+			return http.StatusNotFound
+		case syscall.EACCES, syscall.EPERM:
+			return http.StatusForbidden
+		case syscall.EBUSY:
+			return http.StatusConflict
+		case syscall.ENOTSUP:
+			return http.StatusNotImplemented
+		case syscall.EINVAL:
+			return http.StatusBadRequest
+		}
+	}
+	return http.StatusInternalServerError
+}
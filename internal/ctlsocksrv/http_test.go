@@ -0,0 +1,62 @@
+package ctlsocksrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/ctlsock"
+)
+
+func TestHTTPAPI(t *testing.T) {
+	h := &httpHandler{ch: &ctlSockHandler{fs: &fakeFS{}, info: MountInfo{Token: "secret"}}}
+	testCases := []struct {
+		method string
+		path   string
+		auth   string
+		body   string
+		status int
+		result string
+	}{
+		{"POST", "/v1/request", "", `{"Token":"secret","EncryptPath":"foo"}`, http.StatusOK, "enc-foo"},
+		{"POST", "/v1/request", "Bearer secret", `{"EncryptPath":"foo"}`, http.StatusOK, "enc-foo"},
+		{"POST", "/v1/request", "Bearer wrong", `{"EncryptPath":"foo"}`, http.StatusUnauthorized, ""},
+		{"POST", "/v1/request", "", `{"EncryptPath":"foo"}`, http.StatusUnauthorized, ""},
+		{"POST", "/v1/request", "Bearer secret", `{"DecryptPath":"foo"}`, http.StatusNotFound, ""},
+		{"POST", "/v1/request", "Bearer secret", `{"EncryptPath":"a","DecryptPath":"b"}`, http.StatusBadRequest, ""},
+		{"POST", "/v1/request", "Bearer secret", `{"EncryptPath":`, http.StatusBadRequest, ""},
+		{"GET", "/v1/version", "Bearer secret", "", http.StatusOK, ""},
+		{"GET", "/v1/version", "", "", http.StatusUnauthorized, ""},
+		{"GET", "/v1/request", "Bearer secret", "", http.StatusMethodNotAllowed, ""},
+		{"POST", "/v1/version", "Bearer secret", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "/v1/nonexistent", "Bearer secret", "", http.StatusNotFound, ""},
+	}
+	for i, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("case %d: want status %d, have %d: %s", i, tc.status, rec.Code, rec.Body.String())
+			continue
+		}
+		if rec.Header().Get("Content-Type") != "application/json" {
+			continue
+		}
+		var resp ctlsock.ResponseStruct
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		if resp.Result != tc.result {
+			t.Errorf("case %d: want result %q, have %q", i, tc.result, resp.Result)
+		}
+		if resp.Version != ctlsock.ProtocolVersion {
+			t.Errorf("case %d: wrong version %d", i, resp.Version)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package ctlsocksrv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RemountOptions are the changes requested by ctlsock.RequestStruct.Remount.
+// A nil field stays as it is.
+type RemountOptions struct {
+	// ReadOnly is set by "ro" and cleared by "rw"
+	ReadOnly *bool
+	// Noexec is set by "noexec" and cleared by "exec"
+	Noexec *bool
+}
+
+// ParseRemount parses a comma-separated list of "ro", "rw", "noexec" and
+// "exec". Conflicting options like "ro,rw" are rejected.
+func ParseRemount(s string) (opts RemountOptions, err error) {
+	set := func(field **bool, v bool, name string) error {
+		if *field != nil && **field != v {
+			return fmt.Errorf("conflicting option %q", name)
+		}
+		*field = &v
+		return nil
+	}
+	for _, o := range strings.Split(s, ",") {
+		o = strings.TrimSpace(o)
+		switch o {
+		case "ro":
+			err = set(&opts.ReadOnly, true, o)
+		case "rw":
+			err = set(&opts.ReadOnly, false, o)
+		case "noexec":
+			err = set(&opts.Noexec, true, o)
+		case "exec":
+			err = set(&opts.Noexec, false, o)
+		default:
+			err = fmt.Errorf("unknown option %q", o)
+		}
+		if err != nil {
+			return RemountOptions{}, err
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,439 @@
+//go:build go1.16
+// +build go1.16
+
+// Package davsrv serves the decrypted view of a CIPHERDIR over WebDAV
+// ("-serve-webdav"), without FUSE.
+//
+// It implements WebDAV class 1 (RFC 4918) on top of the cryptfile package.
+// There are no locks (class 2), so clients that insist on locking, like the
+// MacOS Finder, mount it read-only. Dead properties are not stored, PROPPATCH
+// fails for every property.
+package davsrv
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Handler is an http.Handler that serves a CIPHERDIR over WebDAV
+type Handler struct {
+	keys      *cryptfile.Keys
+	cipherdir string
+	fsys      fs.FS
+	readOnly  bool
+	// HTTP basic auth credentials. No authentication if user is empty.
+	user     string
+	password string
+}
+
+// New returns a Handler for "cipherdir" using "keys". With "readOnly", all
+// modifications are rejected with 403 Forbidden.
+func New(keys *cryptfile.Keys, cipherdir string, readOnly bool) *Handler {
+	return &Handler{
+		keys:      keys,
+		cipherdir: cipherdir,
+		fsys:      keys.NewFS(cipherdir),
+		readOnly:  readOnly,
+	}
+}
+
+// SetBasicAuth requires HTTP basic authentication with "user" and "password"
+// on every request
+func (h *Handler) SetBasicAuth(user string, password string) {
+	h.user = user
+	h.password = password
+}
+
+// checkAuth returns true if the request carries the right credentials, or
+// if no authentication is required
+func (h *Handler) checkAuth(r *http.Request) bool {
+	if h.user == "" {
+		return true
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	// Compare both in any case, so the timing does not tell which one is
+	// wrong
+	u := subtle.ConstantTimeCompare([]byte(user), []byte(h.user))
+	p := subtle.ConstantTimeCompare([]byte(password), []byte(h.password))
+	return u&p == 1
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.checkAuth(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gocryptfs"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name, ok := plainName(r.URL.Path)
+	if !ok {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	var status int
+	var err error
+	switch r.Method {
+	case http.MethodOptions:
+		status = h.handleOptions(w)
+	case http.MethodGet, http.MethodHead:
+		status, err = h.handleGet(w, r, name)
+	case "PROPFIND":
+		status, err = h.handlePropfind(w, r, name)
+	case "PROPPATCH":
+		status, err = h.handleProppatch(w, r, name)
+	case http.MethodPut, http.MethodDelete, "MKCOL", "COPY", "MOVE":
+		if h.readOnly {
+			status = http.StatusForbidden
+			break
+		}
+		switch r.Method {
+		case http.MethodPut:
+			status, err = h.handlePut(r, name)
+		case http.MethodDelete:
+			status, err = h.handleDelete(name)
+		case "MKCOL":
+			status, err = h.handleMkcol(r, name)
+		default:
+			status, err = h.handleCopyMove(r, name)
+		}
+	default:
+		status = http.StatusMethodNotAllowed
+	}
+	if err != nil {
+		tlog.Debug.Printf("webdav: %s %q: %v", r.Method, tlog.PlainName(name), err)
+		if status == 0 {
+			status = errStatus(err)
+		}
+	}
+	// Handlers that wrote a response return 0
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+// plainName converts the URL path "p" to a path for fs.FS. The root is ".".
+func plainName(p string) (string, bool) {
+	name := strings.Trim(path.Clean("/"+p), "/")
+	if name == "" {
+		return ".", true
+	}
+	return name, fs.ValidPath(name)
+}
+
+// errStatus maps "err" to an HTTP status code
+func errStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, fs.ErrExist), errors.Is(err, syscall.ENOTEMPTY),
+		errors.Is(err, syscall.ENOTDIR), errors.Is(err, syscall.EISDIR):
+		return http.StatusConflict
+	case errors.Is(err, syscall.ENOSPC):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, syscall.ENAMETOOLONG), errors.Is(err, fs.ErrInvalid):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func (h *Handler) handleOptions(w http.ResponseWriter) int {
+	allow := "OPTIONS, GET, HEAD, PROPFIND, PROPPATCH"
+	if !h.readOnly {
+		allow += ", PUT, DELETE, MKCOL, COPY, MOVE"
+	}
+	w.Header().Set("Allow", allow)
+	w.Header().Set("DAV", "1")
+	// Makes Windows use WebDAV instead of FrontPage extensions
+	w.Header().Set("MS-Author-Via", "DAV")
+	w.WriteHeader(http.StatusOK)
+	return 0
+}
+
+func (h *Handler) handleGet(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	f, err := h.fsys.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.IsDir() {
+		return http.StatusMethodNotAllowed, nil
+	}
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		return http.StatusInternalServerError, nil
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), rs)
+	return 0, nil
+}
+
+// stat returns the plaintext file info of "name"
+func (h *Handler) stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(h.fsys, name)
+}
+
+// checkParent returns 409 Conflict if the parent directory of "name" does
+// not exist, as RFC 4918 requires for PUT, MKCOL, COPY and MOVE
+func (h *Handler) checkParent(name string) (int, error) {
+	fi, err := h.stat(path.Dir(name))
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !fi.IsDir()) {
+		return http.StatusConflict, nil
+	}
+	return 0, err
+}
+
+func (h *Handler) handlePut(r *http.Request, name string) (int, error) {
+	if name == "." {
+		return http.StatusMethodNotAllowed, nil
+	}
+	if status, err := h.checkParent(name); status != 0 || err != nil {
+		return status, err
+	}
+	_, err := h.stat(name)
+	created := errors.Is(err, fs.ErrNotExist)
+	// Like a file created through a mount, the permissions are subject to
+	// the umask
+	if err := h.keys.ReplaceFile(h.cipherdir, name, r.Body, 0666); err != nil {
+		return 0, err
+	}
+	if created {
+		return http.StatusCreated, nil
+	}
+	return http.StatusNoContent, nil
+}
+
+func (h *Handler) handleMkcol(r *http.Request, name string) (int, error) {
+	// MKCOL with a body is not defined
+	if r.ContentLength > 0 {
+		return http.StatusUnsupportedMediaType, nil
+	}
+	if _, err := h.stat(name); err == nil {
+		return http.StatusMethodNotAllowed, nil
+	}
+	if status, err := h.checkParent(name); status != 0 || err != nil {
+		return status, err
+	}
+	if err := h.keys.Mkdir(h.cipherdir, name, 0777); err != nil {
+		return 0, err
+	}
+	return http.StatusCreated, nil
+}
+
+func (h *Handler) handleDelete(name string) (int, error) {
+	if name == "." {
+		return http.StatusForbidden, nil
+	}
+	if err := h.removeAll(name); err != nil {
+		return 0, err
+	}
+	return http.StatusNoContent, nil
+}
+
+// removeAll deletes "name" and everything below it
+func (h *Handler) removeAll(name string) error {
+	fi, err := h.lstat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		entries, err := fs.ReadDir(h.fsys, name)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := h.removeAll(path.Join(name, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return h.keys.Remove(h.cipherdir, name)
+}
+
+// lstat is like stat, but also works for symlinks, which cannot be opened
+func (h *Handler) lstat(name string) (fs.FileInfo, error) {
+	fi, err := h.stat(name)
+	if err == nil || name == "." || errors.Is(err, fs.ErrNotExist) {
+		return fi, err
+	}
+	entries, err2 := fs.ReadDir(h.fsys, path.Dir(name))
+	if err2 != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Name() == path.Base(name) {
+			return e.Info()
+		}
+	}
+	return nil, err
+}
+
+// destination returns the plaintext path of the "Destination" header of "r"
+func destination(r *http.Request) (string, bool) {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Path == "" {
+		return "", false
+	}
+	if u.Host != "" && u.Host != r.Host {
+		return "", false
+	}
+	return plainName(u.Path)
+}
+
+func (h *Handler) handleCopyMove(r *http.Request, name string) (int, error) {
+	dst, ok := destination(r)
+	if !ok {
+		return http.StatusBadRequest, nil
+	}
+	if name == "." || dst == "." {
+		return http.StatusForbidden, nil
+	}
+	if dst == name || strings.HasPrefix(dst, name+"/") {
+		return http.StatusForbidden, nil
+	}
+	src, err := h.lstat(name)
+	if err != nil {
+		return 0, err
+	}
+	if status, err := h.checkParent(dst); status != 0 || err != nil {
+		return status, err
+	}
+	created := true
+	if fi, err := h.lstat(dst); err == nil {
+		if r.Header.Get("Overwrite") == "F" {
+			return http.StatusPreconditionFailed, nil
+		}
+		created = false
+		// rename(2) replaces files atomically. Everything else has to go
+		// first.
+		if r.Method != "MOVE" || src.IsDir() || fi.IsDir() {
+			if err := h.removeAll(dst); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if r.Method == "MOVE" {
+		err = h.keys.Rename(h.cipherdir, name, dst)
+	} else {
+		depthZero := r.Header.Get("Depth") == "0"
+		err = h.copyAll(name, dst, depthZero)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if created {
+		return http.StatusCreated, nil
+	}
+	return http.StatusNoContent, nil
+}
+
+// copyAll copies "src" to "dst". Directories are copied with their content,
+// unless "depthZero" is set. File contents are re-encrypted, so the copy
+// gets a new file ID. Symlinks are skipped.
+func (h *Handler) copyAll(src string, dst string, depthZero bool) error {
+	fi, err := h.lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case fi.IsDir():
+		if err := h.keys.Mkdir(h.cipherdir, dst, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		if depthZero {
+			return nil
+		}
+		entries, err := fs.ReadDir(h.fsys, src)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := h.copyAll(path.Join(src, e.Name()), path.Join(dst, e.Name()), false); err != nil {
+				return err
+			}
+		}
+		return nil
+	case fi.Mode().IsRegular():
+		f, err := h.fsys.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return h.keys.WriteFile(h.cipherdir, dst, f, fi.Mode().Perm())
+	}
+	tlog.Debug.Printf("webdav: COPY: skipping %q", tlog.PlainName(src))
+	return nil
+}
+
+// maxBodySize limits the XML bodies of PROPFIND and PROPPATCH
+const maxBodySize = 1 << 20
+
+func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	depth := r.Header.Get("Depth")
+	if depth == "" || depth == "infinity" {
+		// Allowed by RFC 4918 section 9.1, and protects against walking
+		// the whole tree
+		return http.StatusForbidden, nil
+	}
+	if depth != "0" && depth != "1" {
+		return http.StatusBadRequest, nil
+	}
+	props, err := parsePropfind(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+	fi, err := h.stat(name)
+	if err != nil {
+		return 0, err
+	}
+	ms := newMultistatus(w)
+	ms.propResponse(name, fi, props)
+	if depth == "1" && fi.IsDir() {
+		entries, err := fs.ReadDir(h.fsys, name)
+		if err != nil {
+			return 0, err
+		}
+		for _, e := range entries {
+			// Only files and directories can be represented in WebDAV
+			if !e.IsDir() && !e.Type().IsRegular() {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			ms.propResponse(path.Join(name, e.Name()), info, props)
+		}
+	}
+	return 0, ms.close()
+}
+
+func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	props, err := parseProppatch(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+	if _, err := h.stat(name); err != nil {
+		return 0, err
+	}
+	ms := newMultistatus(w)
+	ms.forbiddenResponse(name, props)
+	return 0, ms.close()
+}
@@ -0,0 +1,149 @@
+//go:build go1.16
+// +build go1.16
+
+package davsrv
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// newTestHandler creates a CIPHERDIR and returns a Handler for it
+func newTestHandler(t *testing.T, readOnly bool) (*Handler, func()) {
+	dir, err := ioutil.TempDir("", "davsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := dir + "/gocryptfs.conf"
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(int(d.Fd()))
+	d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := cryptfile.Open(conf, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(k, dir, readOnly), func() {
+		k.Wipe()
+		os.RemoveAll(dir)
+	}
+}
+
+// do sends a request to "srv" and returns the status code and the body
+func do(t *testing.T, srv *httptest.Server, method string, p string, body string, hdr ...string) (int, string) {
+	req, err := http.NewRequest(method, srv.URL+p, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(hdr); i += 2 {
+		req.Header.Set(hdr[i], hdr[i+1])
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	content, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(content)
+}
+
+func TestWebdav(t *testing.T) {
+	h, cleanup := newTestHandler(t, false)
+	defer cleanup()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	steps := []struct {
+		method string
+		path   string
+		body   string
+		hdr    []string
+		status int
+	}{
+		{"MKCOL", "/dir", "", nil, http.StatusCreated},
+		{"MKCOL", "/dir", "", nil, http.StatusMethodNotAllowed},
+		{"MKCOL", "/missing/dir", "", nil, http.StatusConflict},
+		{"PUT", "/dir/a%20b.txt", "hello", nil, http.StatusCreated},
+		{"PUT", "/dir/a%20b.txt", "hello world", nil, http.StatusNoContent},
+		{"PUT", "/missing/x", "", nil, http.StatusConflict},
+		{"COPY", "/dir", "", []string{"Destination", srv.URL + "/copy"}, http.StatusCreated},
+		{"MOVE", "/copy/a%20b.txt", "", []string{"Destination", srv.URL + "/moved.txt"}, http.StatusCreated},
+		{"MOVE", "/dir/a%20b.txt", "", []string{"Destination", srv.URL + "/moved.txt", "Overwrite", "F"}, http.StatusPreconditionFailed},
+		{"GET", "/nothing", "", nil, http.StatusNotFound},
+		{"PROPFIND", "/", "", []string{"Depth", "infinity"}, http.StatusForbidden},
+	}
+	for _, s := range steps {
+		if status, body := do(t, srv, s.method, s.path, s.body, s.hdr...); status != s.status {
+			t.Fatalf("%s %s: want %d, have %d: %s", s.method, s.path, s.status, status, body)
+		}
+	}
+	if _, body := do(t, srv, "GET", "/moved.txt", ""); body != "hello world" {
+		t.Errorf("GET: %q", body)
+	}
+	if _, body := do(t, srv, "GET", "/moved.txt", "", "Range", "bytes=6-"); body != "world" {
+		t.Errorf("GET with Range: %q", body)
+	}
+	status, body := do(t, srv, "PROPFIND", "/dir/", "", "Depth", "1")
+	if status != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND: %d", status)
+	}
+	for _, want := range []string{"<D:href>/dir/</D:href>", "<D:collection/>",
+		"<D:href>/dir/a%20b.txt</D:href>", "<D:getcontentlength>11</D:getcontentlength>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("PROPFIND: %q is missing in %s", want, body)
+		}
+	}
+	// Unknown properties are reported as 404
+	propfind := `<?xml version="1.0"?><propfind xmlns="DAV:" xmlns:x="urn:x"><prop><getcontentlength/><x:foo/></prop></propfind>`
+	_, body = do(t, srv, "PROPFIND", "/moved.txt", propfind, "Depth", "0")
+	if !strings.Contains(body, "<D:getcontentlength>11</D:getcontentlength>") ||
+		!strings.Contains(body, `<X:foo xmlns:X="urn:x"/></D:prop><D:status>HTTP/1.1 404 Not Found`) {
+		t.Errorf("PROPFIND with prop: %s", body)
+	}
+	// DELETE is recursive
+	if status, _ := do(t, srv, "DELETE", "/dir", ""); status != http.StatusNoContent {
+		t.Errorf("DELETE: %d", status)
+	}
+	if status, _ := do(t, srv, "DELETE", "/copy", ""); status != http.StatusNoContent {
+		t.Errorf("DELETE: %d", status)
+	}
+	_, body = do(t, srv, "PROPFIND", "/", "", "Depth", "1")
+	if strings.Count(body, "<D:response>") != 2 || !strings.Contains(body, "/moved.txt") {
+		t.Errorf("PROPFIND after DELETE: %s", body)
+	}
+}
+
+func TestWebdavAuthReadOnly(t *testing.T) {
+	h, cleanup := newTestHandler(t, true)
+	defer cleanup()
+	h.SetBasicAuth("user", "secret")
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	if status, _ := do(t, srv, "PROPFIND", "/", "", "Depth", "0"); status != http.StatusUnauthorized {
+		t.Errorf("without credentials: want 401, have %d", status)
+	}
+	auth := "Basic dXNlcjpzZWNyZXQ=" // user:secret
+	if status, _ := do(t, srv, "PROPFIND", "/", "", "Depth", "0", "Authorization", auth); status != http.StatusMultiStatus {
+		t.Errorf("with credentials: want 207, have %d", status)
+	}
+	if status, _ := do(t, srv, "PUT", "/f", "x", "Authorization", auth); status != http.StatusForbidden {
+		t.Errorf("PUT on read-only: want 403, have %d", status)
+	}
+}
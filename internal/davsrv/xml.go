@@ -0,0 +1,263 @@
+//go:build go1.16
+// +build go1.16
+
+package davsrv
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// davNS is the XML namespace of WebDAV
+const davNS = "DAV:"
+
+var errBadXML = errors.New("invalid XML body")
+
+// parseBody parses the XML body of PROPFIND or PROPPATCH. "root" is the
+// expected root element in the DAV: namespace. Returns the local names of the
+// DAV: elements directly below the root in "top", and the names of all
+// properties inside of DAV:prop elements in "props". An empty body gives no
+// error, and nothing in "top".
+func parseBody(r io.Reader, root string) (top []string, props []xml.Name, err error) {
+	d := xml.NewDecoder(r)
+	depth := 0
+	// propDepth is the depth of the DAV:prop element we are in, or zero
+	propDepth := 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, errBadXML
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case depth == 1:
+				if t.Name.Space != davNS || t.Name.Local != root {
+					return nil, nil, errBadXML
+				}
+			case depth == 2 && t.Name.Space == davNS:
+				top = append(top, t.Name.Local)
+			}
+			if propDepth != 0 && depth == propDepth+1 {
+				props = append(props, t.Name)
+			} else if propDepth == 0 && t.Name.Space == davNS && t.Name.Local == "prop" {
+				propDepth = depth
+			}
+		case xml.EndElement:
+			if depth == propDepth {
+				propDepth = 0
+			}
+			depth--
+		}
+	}
+	if depth != 0 {
+		return nil, nil, errBadXML
+	}
+	return top, props, nil
+}
+
+// propRequest is what a PROPFIND asks for
+type propRequest struct {
+	// names only, no values
+	propname bool
+	// all live properties. Also set for an empty body.
+	allprop bool
+	// the properties to return if neither propname nor allprop are set
+	names []xml.Name
+}
+
+func parsePropfind(r io.Reader) (req propRequest, err error) {
+	top, props, err := parseBody(r, "propfind")
+	if err != nil {
+		return req, err
+	}
+	for _, t := range top {
+		switch t {
+		case "propname":
+			req.propname = true
+		case "allprop":
+			req.allprop = true
+		}
+	}
+	req.names = props
+	if !req.propname && len(props) == 0 {
+		req.allprop = true
+	}
+	return req, nil
+}
+
+func parseProppatch(r io.Reader) ([]xml.Name, error) {
+	top, props, err := parseBody(r, "propertyupdate")
+	if err != nil {
+		return nil, err
+	}
+	if len(top) == 0 {
+		return nil, errBadXML
+	}
+	return props, nil
+}
+
+// liveProps are the properties we support, in the order they are reported
+var liveProps = []string{"resourcetype", "displayname", "getcontentlength",
+	"getcontenttype", "getlastmodified", "getetag"}
+
+// liveProp returns the XML content of the property "prop" of the file "fi",
+// and false if the file does not have it
+func liveProp(fi fs.FileInfo, prop string) (string, bool) {
+	switch prop {
+	case "resourcetype":
+		if fi.IsDir() {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "displayname":
+		return escape(fi.Name()), true
+	case "getcontentlength":
+		if fi.IsDir() {
+			return "", false
+		}
+		return fmt.Sprint(fi.Size()), true
+	case "getcontenttype":
+		if fi.IsDir() {
+			return "", false
+		}
+		ctype := mime.TypeByExtension(path.Ext(fi.Name()))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		return escape(ctype), true
+	case "getlastmodified":
+		return fi.ModTime().UTC().Format(http.TimeFormat), true
+	case "getetag":
+		if fi.IsDir() {
+			return "", false
+		}
+		return fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size()), true
+	}
+	return "", false
+}
+
+// multistatus writes a 207 Multi-Status response
+type multistatus struct {
+	w   *bufio.Writer
+	err error
+}
+
+func newMultistatus(w http.ResponseWriter) *multistatus {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	ms := &multistatus{w: bufio.NewWriter(w)}
+	ms.printf(`<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">` + "\n")
+	return ms
+}
+
+func (ms *multistatus) printf(format string, a ...interface{}) {
+	if ms.err == nil {
+		_, ms.err = fmt.Fprintf(ms.w, format, a...)
+	}
+}
+
+// close finishes the response and returns the first write error
+func (ms *multistatus) close() error {
+	ms.printf("</D:multistatus>\n")
+	if ms.err == nil {
+		ms.err = ms.w.Flush()
+	}
+	return ms.err
+}
+
+// href returns the escaped URL path of the plaintext path "name".
+// Directories get a trailing slash.
+func href(name string, isDir bool) string {
+	p := "/"
+	if name != "." {
+		p += name
+		if isDir {
+			p += "/"
+		}
+	}
+	return escape((&url.URL{Path: p}).EscapedPath())
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// emptyElement returns an empty XML element called "n"
+func emptyElement(n xml.Name) string {
+	if n.Space == davNS {
+		return "<D:" + n.Local + "/>"
+	}
+	return fmt.Sprintf(`<X:%s xmlns:X="%s"/>`, n.Local, escape(n.Space))
+}
+
+// propstat writes a propstat element with the properties in "props" and the
+// HTTP status "status"
+func (ms *multistatus) propstat(props []string, status int) {
+	if len(props) == 0 {
+		return
+	}
+	ms.printf("<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 %d %s</D:status></D:propstat>",
+		strings.Join(props, ""), status, http.StatusText(status))
+}
+
+// propResponse writes the response element for "name" with info "fi"
+func (ms *multistatus) propResponse(name string, fi fs.FileInfo, req propRequest) {
+	ms.printf("<D:response><D:href>%s</D:href>", href(name, fi.IsDir()))
+	var found, missing []string
+	switch {
+	case req.propname:
+		for _, p := range liveProps {
+			if _, ok := liveProp(fi, p); ok {
+				found = append(found, "<D:"+p+"/>")
+			}
+		}
+	case req.allprop:
+		for _, p := range liveProps {
+			if v, ok := liveProp(fi, p); ok {
+				found = append(found, fmt.Sprintf("<D:%s>%s</D:%s>", p, v, p))
+			}
+		}
+	default:
+		for _, n := range req.names {
+			if n.Space == davNS {
+				if v, ok := liveProp(fi, n.Local); ok {
+					found = append(found, fmt.Sprintf("<D:%s>%s</D:%s>", n.Local, v, n.Local))
+					continue
+				}
+			}
+			missing = append(missing, emptyElement(n))
+		}
+	}
+	ms.propstat(found, http.StatusOK)
+	ms.propstat(missing, http.StatusNotFound)
+	ms.printf("</D:response>\n")
+}
+
+// forbiddenResponse writes the response element for "name" that rejects
+// changing any of "props"
+func (ms *multistatus) forbiddenResponse(name string, props []xml.Name) {
+	var elems []string
+	for _, n := range props {
+		elems = append(elems, emptyElement(n))
+	}
+	// href() only uses isDir for the trailing slash, which clients ignore
+	// when comparing
+	ms.printf("<D:response><D:href>%s</D:href>", href(name, false))
+	ms.propstat(elems, http.StatusForbidden)
+	ms.printf("</D:response>\n")
+}
@@ -0,0 +1,646 @@
+// Package dbus implements the small part of the D-Bus wire protocol that
+// gocryptfs needs to talk to logind and to the Secret Service, and to offer
+// its own service on the session bus ("-dbus-service"): method calls,
+// replies, signals, the basic types, arrays, structs, variants and the
+// passing of file descriptors.
+// ( https://dbus.freedesktop.org/doc/dbus-specification.html )
+package dbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Message types
+const (
+	TypeMethodCall   = 1
+	TypeMethodReturn = 2
+	TypeError        = 3
+	TypeSignal       = 4
+)
+
+// Header field codes
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSender      = 7
+	fieldSignature   = 8
+	fieldUnixFds     = 9
+)
+
+// maxMessageSize is the limit of the D-Bus specification
+const maxMessageSize = 128 * 1024 * 1024
+
+// Bus is the name, object path and interface of the message bus itself
+const Bus = "org.freedesktop.DBus"
+
+// BusPath is the object path of the message bus
+const BusPath = "/org/freedesktop/DBus"
+
+// Message is a D-Bus message. The body is kept marshaled.
+type Message struct {
+	Type        byte
+	Flags       byte
+	Serial      uint32
+	Path        string
+	Interface   string
+	Member      string
+	ErrName     string
+	ReplySerial uint32
+	Dest        string
+	Sender      string
+	Sig         string
+	Body        []byte
+	// Order is the byte order of the body
+	Order binary.ByteOrder
+	// Fds are the file descriptors that come with the message
+	Fds []int
+}
+
+// MethodCall returns a method call message. "body" is marshaled according
+// to "sig".
+func MethodCall(dest, path, iface, member, sig string, body []byte) *Message {
+	return &Message{
+		Type:      TypeMethodCall,
+		Path:      path,
+		Interface: iface,
+		Member:    member,
+		Dest:      dest,
+		Sig:       sig,
+		Body:      body,
+	}
+}
+
+// Reply returns the reply to the method call "call"
+func Reply(call *Message, sig string, body []byte) *Message {
+	return &Message{
+		Type:        TypeMethodReturn,
+		ReplySerial: call.Serial,
+		Dest:        call.Sender,
+		Sig:         sig,
+		Body:        body,
+	}
+}
+
+// ErrorReply returns the error "name" with the message "text" as the reply to
+// the method call "call"
+func ErrorReply(call *Message, name, text string) *Message {
+	e := &Encoder{}
+	e.String(text)
+	return &Message{
+		Type:        TypeError,
+		ErrName:     name,
+		ReplySerial: call.Serial,
+		Dest:        call.Sender,
+		Sig:         "s",
+		Body:        e.B,
+	}
+}
+
+// Encoder marshals values with the alignment rules of D-Bus. Offsets are
+// relative to the start of "B", which must be the start of the message or
+// of the body.
+type Encoder struct {
+	B []byte
+}
+
+// Align pads to a multiple of "n" bytes
+func (e *Encoder) Align(n int) {
+	for len(e.B)%n != 0 {
+		e.B = append(e.B, 0)
+	}
+}
+
+// Byte also marshals booleans
+func (e *Encoder) Byte(v byte) {
+	e.B = append(e.B, v)
+}
+
+// Uint32 also marshals booleans and file descriptor indexes
+func (e *Encoder) Uint32(v uint32) {
+	e.Align(4)
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	e.B = append(e.B, buf[:]...)
+}
+
+// String also marshals object paths
+func (e *Encoder) String(v string) {
+	e.Uint32(uint32(len(v)))
+	e.B = append(e.B, v...)
+	e.B = append(e.B, 0)
+}
+
+// Signature marshals a type signature
+func (e *Encoder) Signature(v string) {
+	e.Byte(byte(len(v)))
+	e.B = append(e.B, v...)
+	e.B = append(e.B, 0)
+}
+
+// Bytes marshals a byte array ("ay")
+func (e *Encoder) Bytes(v []byte) {
+	e.Uint32(uint32(len(v)))
+	e.B = append(e.B, v...)
+}
+
+// Array marshals an array. "align" is the alignment of the element type,
+// 8 for structs and dict entries. "elems" marshals the elements.
+func (e *Encoder) Array(align int, elems func()) {
+	e.Uint32(0)
+	lenPos := len(e.B) - 4
+	e.Align(align)
+	start := len(e.B)
+	elems()
+	binary.LittleEndian.PutUint32(e.B[lenPos:], uint32(len(e.B)-start))
+}
+
+// Marshal returns the wire format of "m". We always send little-endian.
+func (m *Message) Marshal() []byte {
+	e := &Encoder{}
+	e.Byte('l')
+	e.Byte(m.Type)
+	e.Byte(m.Flags)
+	e.Byte(1)
+	e.Uint32(uint32(len(m.Body)))
+	e.Uint32(m.Serial)
+	// The array length is filled in below
+	e.Uint32(0)
+	start := len(e.B)
+	field := func(code byte, sig string, v string) {
+		e.Align(8)
+		e.Byte(code)
+		e.Signature(sig)
+		if sig == "g" {
+			e.Signature(v)
+		} else {
+			e.String(v)
+		}
+	}
+	if m.Path != "" {
+		field(fieldPath, "o", m.Path)
+	}
+	if m.Interface != "" {
+		field(fieldInterface, "s", m.Interface)
+	}
+	if m.Member != "" {
+		field(fieldMember, "s", m.Member)
+	}
+	if m.ErrName != "" {
+		field(fieldErrorName, "s", m.ErrName)
+	}
+	if m.ReplySerial != 0 {
+		e.Align(8)
+		e.Byte(fieldReplySerial)
+		e.Signature("u")
+		e.Uint32(m.ReplySerial)
+	}
+	if m.Dest != "" {
+		field(fieldDestination, "s", m.Dest)
+	}
+	if m.Sig != "" {
+		field(fieldSignature, "g", m.Sig)
+	}
+	if len(m.Fds) > 0 {
+		e.Align(8)
+		e.Byte(fieldUnixFds)
+		e.Signature("u")
+		e.Uint32(uint32(len(m.Fds)))
+	}
+	binary.LittleEndian.PutUint32(e.B[12:], uint32(len(e.B)-start))
+	e.Align(8)
+	return append(e.B, m.Body...)
+}
+
+var errShort = errors.New("dbus: message too short")
+
+// Decoder unmarshals values. Offsets are relative to the start of "b".
+// After an error, all methods return zero values and Err() returns the
+// error.
+type Decoder struct {
+	b     []byte
+	off   int
+	order binary.ByteOrder
+	err   error
+}
+
+// NewDecoder returns a decoder for "b", which must be the start of a
+// message or of a body
+func NewDecoder(b []byte, order binary.ByteOrder) *Decoder {
+	return &Decoder{b: b, order: order}
+}
+
+// Err returns the first error that happened while decoding
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Align skips the padding to a multiple of "n" bytes
+func (d *Decoder) Align(n int) {
+	for d.off%n != 0 {
+		d.off++
+	}
+}
+
+func (d *Decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || d.off+n > len(d.b) {
+		d.err = errShort
+		return nil
+	}
+	v := d.b[d.off : d.off+n]
+	d.off += n
+	return v
+}
+
+// Byte unmarshals a byte
+func (d *Decoder) Byte() byte {
+	if v := d.next(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+// Uint32 also unmarshals booleans and file descriptor indexes
+func (d *Decoder) Uint32() uint32 {
+	d.Align(4)
+	if v := d.next(4); v != nil {
+		return d.order.Uint32(v)
+	}
+	return 0
+}
+
+// String also unmarshals object paths
+func (d *Decoder) String() string {
+	n := d.Uint32()
+	v := d.next(int(n) + 1)
+	if v == nil {
+		return ""
+	}
+	return string(v[:n])
+}
+
+// Signature unmarshals a type signature
+func (d *Decoder) Signature() string {
+	n := d.Byte()
+	v := d.next(int(n) + 1)
+	if v == nil {
+		return ""
+	}
+	return string(v[:n])
+}
+
+// Bytes unmarshals a byte array ("ay"). The result is a copy.
+func (d *Decoder) Bytes() []byte {
+	n := d.Uint32()
+	v := d.next(int(n))
+	if v == nil {
+		return nil
+	}
+	return append([]byte{}, v...)
+}
+
+// Array unmarshals an array. "align" is the alignment of the element type.
+// "elem" is called once for each element and must unmarshal it.
+func (d *Decoder) Array(align int, elem func()) {
+	n := int(d.Uint32())
+	d.Align(align)
+	end := d.off + n
+	if d.err == nil && (n > maxMessageSize || end > len(d.b)) {
+		d.err = errShort
+	}
+	for d.err == nil && d.off < end {
+		elem()
+	}
+}
+
+// Strings unmarshals an array of strings or object paths ("as", "ao")
+func (d *Decoder) Strings() (v []string) {
+	d.Array(4, func() {
+		v = append(v, d.String())
+	})
+	return v
+}
+
+// unmarshal parses the message "b"
+func unmarshal(b []byte) (*Message, error) {
+	m := &Message{}
+	switch b[0] {
+	case 'l':
+		m.Order = binary.LittleEndian
+	case 'B':
+		m.Order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("dbus: invalid byte order %q", b[0])
+	}
+	d := NewDecoder(b, m.Order)
+	d.next(1)
+	m.Type = d.Byte()
+	m.Flags = d.Byte()
+	d.Byte()
+	bodyLen := d.Uint32()
+	m.Serial = d.Uint32()
+	fieldsEnd := int(d.Uint32()) + d.off
+	for d.err == nil && d.off < fieldsEnd {
+		d.Align(8)
+		code := d.Byte()
+		sig := d.Signature()
+		var s string
+		var u uint32
+		switch sig {
+		case "s", "o":
+			s = d.String()
+		case "g":
+			s = d.Signature()
+		case "u":
+			u = d.Uint32()
+		default:
+			return nil, fmt.Errorf("dbus: unsupported header field type %q", sig)
+		}
+		switch code {
+		case fieldPath:
+			m.Path = s
+		case fieldInterface:
+			m.Interface = s
+		case fieldMember:
+			m.Member = s
+		case fieldErrorName:
+			m.ErrName = s
+		case fieldReplySerial:
+			m.ReplySerial = u
+		case fieldDestination:
+			m.Dest = s
+		case fieldSender:
+			m.Sender = s
+		case fieldSignature:
+			m.Sig = s
+		case fieldUnixFds:
+			m.Fds = make([]int, u)
+		}
+	}
+	d.Align(8)
+	m.Body = d.next(int(bodyLen))
+	if d.err != nil {
+		return nil, d.err
+	}
+	return m, nil
+}
+
+// BodyDecoder returns a decoder for the body of "m"
+func (m *Message) BodyDecoder() *Decoder {
+	return NewDecoder(m.Body, m.Order)
+}
+
+// Conn is a connection to a message bus
+type Conn struct {
+	c *net.UnixConn
+	// buf holds received bytes that have not been consumed yet
+	buf []byte
+	// fds holds received file descriptors that have not been assigned to a
+	// message yet
+	fds []int
+	// wmu serializes Send(), which may be called from several goroutines
+	wmu        sync.Mutex
+	lastSerial uint32
+}
+
+// Dial connects to the bus at "addr" ("unix:path=..." or
+// "unix:abstract=..."), authenticates and says Hello
+func Dial(addr string) (*Conn, error) {
+	var path string
+	switch {
+	case strings.HasPrefix(addr, "unix:path="):
+		path = addr[len("unix:path="):]
+	case strings.HasPrefix(addr, "unix:abstract="):
+		path = "@" + addr[len("unix:abstract="):]
+	default:
+		return nil, fmt.Errorf("dbus: unsupported address %q", addr)
+	}
+	if i := strings.IndexByte(path, ','); i >= 0 {
+		path = path[:i]
+	}
+	c, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	bc := &Conn{c: c}
+	if err := bc.auth(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, err := bc.Call(Bus, BusPath, Bus, "Hello", "", nil); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return bc, nil
+}
+
+// Accept does the bus side of the authentication on "uc". Used by tests
+// that play the bus. The Hello call has to be answered by the caller.
+func Accept(uc *net.UnixConn) (*Conn, error) {
+	c := &Conn{c: uc}
+	if err := c.fill(1); err != nil {
+		return nil, err
+	}
+	// Skip the nul byte
+	c.buf = c.buf[1:]
+	for _, reply := range []string{"OK 0123456789abcdef\r\n", "AGREE_UNIX_FD\r\n", ""} {
+		if _, err := c.readLine(); err != nil {
+			return nil, err
+		}
+		if _, err := uc.Write([]byte(reply)); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// auth does the EXTERNAL authentication, which relies on the uid the bus
+// sees on the socket, and enables file descriptor passing
+func (c *Conn) auth() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := c.c.Write([]byte("\x00AUTH EXTERNAL " + uid + "\r\n")); err != nil {
+		return err
+	}
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(line, []byte("OK ")) {
+		return fmt.Errorf("dbus: authentication failed: %q", line)
+	}
+	if _, err := c.c.Write([]byte("NEGOTIATE_UNIX_FD\r\n")); err != nil {
+		return err
+	}
+	line, err = c.readLine()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(line, []byte("AGREE_UNIX_FD")) {
+		return fmt.Errorf("dbus: no file descriptor passing: %q", line)
+	}
+	_, err = c.c.Write([]byte("BEGIN\r\n"))
+	return err
+}
+
+// fill reads from the socket until at least "n" bytes are buffered
+func (c *Conn) fill(n int) error {
+	b := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(16*4))
+	for len(c.buf) < n {
+		bn, oobn, _, _, err := c.c.ReadMsgUnix(b, oob)
+		if oobn > 0 {
+			msgs, _ := syscall.ParseSocketControlMessage(oob[:oobn])
+			for i := range msgs {
+				fds, _ := syscall.ParseUnixRights(&msgs[i])
+				c.fds = append(c.fds, fds...)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		c.buf = append(c.buf, b[:bn]...)
+		if bn == 0 && oobn == 0 {
+			return errors.New("dbus: connection closed")
+		}
+	}
+	return nil
+}
+
+// readLine reads a line of the authentication protocol
+func (c *Conn) readLine() ([]byte, error) {
+	for {
+		if i := bytes.Index(c.buf, []byte("\r\n")); i >= 0 {
+			line := c.buf[:i]
+			c.buf = c.buf[i+2:]
+			return line, nil
+		}
+		if len(c.buf) > 4096 {
+			return nil, errors.New("dbus: authentication line too long")
+		}
+		if err := c.fill(len(c.buf) + 1); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Read reads the next message. The caller owns the file descriptors that
+// come with it.
+func (c *Conn) Read() (*Message, error) {
+	if err := c.fill(16); err != nil {
+		return nil, err
+	}
+	order := binary.ByteOrder(binary.LittleEndian)
+	if c.buf[0] == 'B' {
+		order = binary.BigEndian
+	}
+	fieldsLen := int(order.Uint32(c.buf[12:]))
+	bodyLen := int(order.Uint32(c.buf[4:]))
+	hdrLen := 16 + fieldsLen
+	hdrLen += (8 - hdrLen%8) % 8
+	if fieldsLen > maxMessageSize || bodyLen > maxMessageSize {
+		return nil, errors.New("dbus: message too big")
+	}
+	if err := c.fill(hdrLen + bodyLen); err != nil {
+		return nil, err
+	}
+	b := c.buf[:hdrLen+bodyLen]
+	c.buf = c.buf[hdrLen+bodyLen:]
+	m, err := unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Fds) > len(c.fds) {
+		return nil, errors.New("dbus: missing file descriptors")
+	}
+	copy(m.Fds, c.fds)
+	c.fds = c.fds[len(m.Fds):]
+	return m, nil
+}
+
+// Send assigns the next serial to "m" and sends it, together with its file
+// descriptors
+func (c *Conn) Send(m *Message) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.lastSerial++
+	m.Serial = c.lastSerial
+	var oob []byte
+	if len(m.Fds) > 0 {
+		oob = syscall.UnixRights(m.Fds...)
+	}
+	_, _, err := c.c.WriteMsgUnix(m.Marshal(), oob, nil)
+	return err
+}
+
+// Call sends a method call and waits for the reply. Other messages that
+// arrive in the meantime are dropped.
+func (c *Conn) Call(dest, path, iface, member, sig string, body []byte) (*Message, error) {
+	call := MethodCall(dest, path, iface, member, sig, body)
+	if err := c.Send(call); err != nil {
+		return nil, err
+	}
+	for {
+		m, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if m.ReplySerial != call.Serial {
+			CloseFds(m.Fds)
+			continue
+		}
+		if err := m.AsError(); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+}
+
+// AsError returns the error of an error reply, nil for other messages
+func (m *Message) AsError() error {
+	if m.Type != TypeError {
+		return nil
+	}
+	CloseFds(m.Fds)
+	msg := ""
+	if m.Sig != "" && m.Sig[0] == 's' {
+		msg = m.BodyDecoder().String()
+	}
+	return fmt.Errorf("dbus: %s: %s", m.ErrName, msg)
+}
+
+// AddMatch asks the bus to send us the signals that match "rule"
+func (c *Conn) AddMatch(rule string) error {
+	e := &Encoder{}
+	e.String(rule)
+	_, err := c.Call(Bus, BusPath, Bus, "AddMatch", "s", e.B)
+	return err
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	CloseFds(c.fds)
+	return c.c.Close()
+}
+
+// CloseFds closes the file descriptors that came with a message
+func CloseFds(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
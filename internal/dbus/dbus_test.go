@@ -0,0 +1,59 @@
+package dbus
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	e := &Encoder{}
+	// a{ss}
+	e.Array(8, func() {
+		for _, kv := range [][2]string{{"a", "1"}, {"bb", "22"}} {
+			e.Align(8)
+			e.String(kv[0])
+			e.String(kv[1])
+		}
+	})
+	// ao
+	e.Array(4, func() {
+		e.String("/x")
+		e.String("/y/z")
+	})
+	e.Bytes([]byte("secret"))
+	in := MethodCall("org.example", "/org/example", "org.example.I", "M", "a{ss}aoay", e.B)
+	in.Serial = 7
+	out, err := unmarshal(in.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Serial != 7 || out.Dest != in.Dest || out.Path != in.Path || out.Interface != in.Interface ||
+		out.Member != in.Member || out.Sig != in.Sig {
+		t.Errorf("header mismatch: %+v", out)
+	}
+	d := out.BodyDecoder()
+	dict := map[string]string{}
+	d.Array(8, func() {
+		d.Align(8)
+		k := d.String()
+		dict[k] = d.String()
+	})
+	if !reflect.DeepEqual(dict, map[string]string{"a": "1", "bb": "22"}) {
+		t.Errorf("dict: %v", dict)
+	}
+	if paths := d.Strings(); !reflect.DeepEqual(paths, []string{"/x", "/y/z"}) {
+		t.Errorf("paths: %v", paths)
+	}
+	if b := d.Bytes(); !bytes.Equal(b, []byte("secret")) {
+		t.Errorf("bytes: %q", b)
+	}
+	if d.Err() != nil {
+		t.Error(d.Err())
+	}
+	// Reading past the end is an error, not a panic
+	_ = d.String()
+	if d.Err() == nil {
+		t.Error("no error at the end of the body")
+	}
+}
@@ -72,6 +72,14 @@ const (
 	DevNull = 30
 	// FIDO2Error - an error was encountered while interacting with a FIDO2 token
 	FIDO2Error = 31
+	// Snapshot - creating, listing or finding a snapshot failed
+	Snapshot = 32
+	// Tar - exporting or importing a tar stream failed
+	Tar = 33
+	// UnlockLimit - unlocking was refused because of too many failed attempts
+	UnlockLimit = 34
+	// DiffFound means that "-diff" found differences
+	DiffFound = 35
 )
 
 // Err wraps an error with an associated numeric exit code
@@ -88,6 +96,11 @@ func NewErr(msg string, code int) Err {
 	}
 }
 
+// Code returns the numeric exit code
+func (e Err) Code() int {
+	return e.code
+}
+
 // Exit extracts the numeric exit code from "err" (if available) and exits the
 // application.
 func Exit(err error) {
@@ -54,25 +54,42 @@ func callFidoCommand(command fidoCommand, device string, stdin []string) ([]stri
 
 // Register registers a credential using a FIDO2 token
 func Register(device string, userName string) (credentialID []byte) {
+	credentialID, err := NewCredential(device, userName)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.FIDO2Error)
+	}
+	return credentialID
+}
+
+// NewCredential is Register() but returns an error instead of exiting
+func NewCredential(device string, userName string) (credentialID []byte, err error) {
 	tlog.Info.Printf("FIDO2 Register: interact with your device ...")
 	cdh := base64.StdEncoding.EncodeToString(cryptocore.RandBytes(32))
 	userID := base64.StdEncoding.EncodeToString(cryptocore.RandBytes(32))
 	stdin := []string{cdh, relyingPartyID, userName, userID}
 	out, err := callFidoCommand(cred, device, stdin)
 	if err != nil {
-		tlog.Fatal.Println(err)
-		os.Exit(exitcodes.FIDO2Error)
+		return nil, err
 	}
-	credentialID, err = base64.StdEncoding.DecodeString(out[4])
+	if len(out) < 5 {
+		return nil, fmt.Errorf("fido2-cred: short output")
+	}
+	return base64.StdEncoding.DecodeString(out[4])
+}
+
+// Secret generates a HMAC secret using a FIDO2 token
+func Secret(device string, credentialID []byte, salt []byte) (secret []byte) {
+	secret, err := HMACSecret(device, credentialID, salt)
 	if err != nil {
 		tlog.Fatal.Println(err)
 		os.Exit(exitcodes.FIDO2Error)
 	}
-	return credentialID
+	return secret
 }
 
-// Secret generates a HMAC secret using a FIDO2 token
-func Secret(device string, credentialID []byte, salt []byte) (secret []byte) {
+// HMACSecret is Secret() but returns an error instead of exiting
+func HMACSecret(device string, credentialID []byte, salt []byte) (secret []byte, err error) {
 	tlog.Info.Printf("FIDO2 Secret: interact with your device ...")
 	cdh := base64.StdEncoding.EncodeToString(cryptocore.RandBytes(32))
 	crid := base64.StdEncoding.EncodeToString(credentialID)
@@ -84,27 +101,26 @@ func Secret(device string, credentialID []byte, salt []byte) (secret []byte) {
 		// if that fails, let's assert with PIN
 		out, err = callFidoCommand(assertWithPIN, device, stdin)
 		if err != nil {
-			tlog.Fatal.Println(err)
-			os.Exit(exitcodes.FIDO2Error)
+			return nil, err
 		}
 	}
+	if len(out) < 5 {
+		return nil, fmt.Errorf("fido2-assert: short output")
+	}
 	secret, err = base64.StdEncoding.DecodeString(out[4])
 	if err != nil {
-		tlog.Fatal.Println(err)
-		os.Exit(exitcodes.FIDO2Error)
+		return nil, err
 	}
 
 	// sanity checks
 	secretLen := len(secret)
 	if secretLen < 32 {
-		tlog.Fatal.Printf("FIDO2 HMACSecret too short (%d)!\n", secretLen)
-		os.Exit(exitcodes.FIDO2Error)
+		return nil, fmt.Errorf("FIDO2 HMACSecret too short (%d)", secretLen)
 	}
 	zero := make([]byte, secretLen)
 	if bytes.Equal(zero, secret) {
-		tlog.Fatal.Printf("FIDO2 HMACSecret is all zero!")
-		os.Exit(exitcodes.FIDO2Error)
+		return nil, fmt.Errorf("FIDO2 HMACSecret is all zero")
 	}
 
-	return secret
+	return secret, nil
 }
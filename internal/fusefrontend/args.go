@@ -1,9 +1,38 @@
 package fusefrontend
 
 import (
+	"syscall"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/audit"
+	"github.com/HorizonLiu/gocryptfs/internal/idmap"
+	"github.com/HorizonLiu/gocryptfs/internal/journal"
+	"github.com/HorizonLiu/gocryptfs/internal/quota"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+	"github.com/HorizonLiu/gocryptfs/internal/verifylog"
 )
 
+// ForcePerms are the permission bits (07777) that "-force_perms" presents
+// and gives new files. Dir applies to directories, File to everything else
+// except symlinks, which always have 0777.
+type ForcePerms struct {
+	File uint32
+	Dir  uint32
+}
+
+// Apply replaces the permission bits in "mode" (type bits included)
+func (p *ForcePerms) Apply(mode uint32) uint32 {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFLNK:
+		return mode
+	case syscall.S_IFDIR:
+		return mode&^07777 | p.Dir
+	default:
+		return mode&^07777 | p.File
+	}
+}
+
 // Args is a container for arguments that are passed from main() to fusefrontend
 type Args struct {
 	// Cipherdir is the backing storage directory (absolute path).
@@ -11,6 +40,16 @@ type Args struct {
 	Cipherdir      string
 	PlaintextNames bool
 	LongNames      bool
+	// NameMax is the longest plaintext name in bytes that statfs reports if
+	// it is not 0. The name transform enforces it.
+	NameMax int
+	// DirPolicies is set if the filesystem may contain directories with a
+	// "gocryptfs.dirpolicy" marker (feature flag "DirPolicy")
+	DirPolicies bool
+	// TenantsOnly is set if the keys of the root directory are not known
+	// because only tenants have been unlocked ("-tenant"). Only the tenant
+	// directories can be accessed.
+	TenantsOnly bool
 	// Should we chown a file after it has been created?
 	// This only makes sense if (1) allow_other is set and (2) we run as root.
 	PreserveOwner bool
@@ -20,6 +59,25 @@ type Args struct {
 	// PreserveOwner if the underlying filesystem acting as backing store
 	// enforces ownership itself.
 	ForceOwner *fuse.Owner
+	// ForcePerms replaces the permission bits of all files and directories,
+	// "-force_perms". May be nil.
+	ForcePerms *ForcePerms
+	// XattrPolicies says how the "security." and "trusted." xattrs are
+	// stored, "-xattr-policy". Forward mode encrypts them by default,
+	// reverse mode hides them.
+	XattrPolicies XattrPolicies
+	// IDMap translates the owners in CIPHERDIR to the owners shown in the
+	// mount and back, "-idmap". May be nil.
+	IDMap *idmap.Map
+	// Audit receives a record for every open, create, unlink, rmdir and
+	// rename, enabled via cli flag "-audit-log". May be nil.
+	Audit *audit.Log
+	// VerifyLog receives every corrupt file header and block found while
+	// reading, "-verify-mount". May be nil.
+	VerifyLog *verifylog.Log
+	// Journal records multi-step name operations before they start,
+	// "-journal". May be nil.
+	Journal *journal.Journal
 	// ConfigCustom is true when the user select a non-default config file
 	// location. If it is false, reverse mode maps ".gocryptfs.reverse.conf"
 	// to "gocryptfs.conf" in the plaintext dir.
@@ -28,6 +86,15 @@ type Args struct {
 	NoPrealloc bool
 	// Try to serialize read operations, "-serialize_reads"
 	SerializeReads bool
+	// Number of backing file descriptors to keep open after the file has
+	// been closed, "-fd-cache". 0 disables the cache.
+	FDCache int
+	// Buffer small appends in memory until a block is full,
+	// "-coalesce-writes"
+	CoalesceWrites bool
+	// Number of blocks to prefetch after sequential reads, "-readahead".
+	// 0 disables prefetching.
+	Readahead int
 	// Force decode even if integrity check fails (openSSL only)
 	ForceDecode bool
 	// Exclude is a list of paths to make inaccessible, starting match at
@@ -39,6 +106,26 @@ type Args struct {
 	// ExcludeFrom is a list of files from which to read exclusion patterns
 	// (with wildcard syntax)
 	ExcludeFrom []string
+	// Include is a list of paths to keep accessible even if they match an
+	// exclusion, starting match at the filesystem root
+	Include []string
+	// IncludeFrom is a list of files from which to read inclusion patterns
+	// (with wildcard syntax)
+	IncludeFrom []string
+	// Filter is a list of rsync-style filter rules ("+ PATTERN" or
+	// "- PATTERN"). The first matching rule wins.
+	Filter []string
+	// FilterFrom is a list of files from which to read filter rules
+	FilterFrom []string
+	// IgnoreFiles enables per-directory ".gocryptfsignore" files in reverse
+	// mode, "-ignorefiles"
+	IgnoreFiles bool
+	// OneFileSystem hides the contents of directories that belong to a
+	// different filesystem than Cipherdir in reverse mode, "-one-file-system"
+	OneFileSystem bool
+	// FreezeDir is where a reverse mount keeps the reflinked copies of the
+	// plaintext files while it is frozen, "-freeze-dir"
+	FreezeDir string
 	// Suid is true if the filesystem has been mounted with the "-suid" flag.
 	// If it is false, we can ignore the GETXATTR "security.capability" calls,
 	// which are a performance problem for writes. See
@@ -46,7 +133,34 @@ type Args struct {
 	Suid bool
 	// Enable the FUSE kernel_cache option
 	KernelCache bool
-	// SharedStorage disables caching & hard link tracking,
+	// ExactModes chmods new files, directories and device nodes to the
+	// requested mode. The kernel has already applied the umask of the
+	// caller, so this is only needed if the umask of our process is not
+	// zero. Set by the library API, which must not change the umask.
+	ExactModes bool
+	// SharedStorage disables caching & hard link tracking and serializes
+	// directory modifications through lease files,
 	// enabled via cli flag "-sharedstorage"
 	SharedStorage bool
+	// NetworkStorage retries backing storage operations that fail with EIO
+	// or ESTALE and ignores unsupported fsync, "-network-storage"
+	NetworkStorage bool
+	// StatfsRaw passes through the block counts of the backing filesystem
+	// instead of converting them to plaintext terms, "-statfs=raw"
+	StatfsRaw bool
+	// Quota limits the plaintext bytes below some directories, "-quota".
+	// May be nil.
+	Quota *quota.Quota
+	// WatchCipherdir forwards changes made directly in CIPHERDIR to the
+	// kernel, "-watch-cipherdir"
+	WatchCipherdir bool
+	// SyncDir fsyncs the ciphertext directory after operations that change
+	// it, "-syncdir"
+	SyncDir bool
+	// IdleIgnore lists the process name patterns whose requests do not
+	// count as activity for "-idle", "-idle-ignore"
+	IdleIgnore []string
+	// Log are the Debug and Info loggers of this mount. nil means the
+	// process-wide tlog.Debug and tlog.Info.
+	Log *tlog.Loggers
 }
@@ -0,0 +1,153 @@
+package fusefrontend
+
+// Forwarding of changes made directly in CIPHERDIR, enabled via cli flag
+// "-watch-cipherdir"
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// watchOp says what has happened to a backing directory entry
+type watchOp int
+
+const (
+	// watchCreated: created, or moved into the directory
+	watchCreated watchOp = iota
+	// watchDeleted: deleted, or moved out of the directory
+	watchDeleted
+	// watchWritten: a file that was open for writing has been closed
+	watchWritten
+	// watchAttr: the metadata has changed
+	watchAttr
+)
+
+// watchNotifier invalidates what the kernel has cached. Tests record the
+// calls instead.
+type watchNotifier interface {
+	entry(dir *fs.Inode, name string)
+	delete(dir *fs.Inode, name string, child *fs.Inode)
+	content(child *fs.Inode, attrOnly bool)
+}
+
+// kernelNotifier is the watchNotifier of the mounted filesystem. The kernel
+// returns ENOENT for entries it does not have cached, which is not an error
+// here.
+type kernelNotifier struct {
+	log *tlog.Loggers
+}
+
+func (k kernelNotifier) entry(dir *fs.Inode, name string) {
+	if errno := dir.NotifyEntry(name); errno != 0 && errno != syscall.ENOENT {
+		k.log.Debug.Printf("watch: NotifyEntry %q: %v", tlog.PlainName(name), errno)
+	}
+}
+
+func (k kernelNotifier) delete(dir *fs.Inode, name string, child *fs.Inode) {
+	if errno := dir.NotifyDelete(name, child); errno != 0 && errno != syscall.ENOENT {
+		k.log.Debug.Printf("watch: NotifyDelete %q: %v", tlog.PlainName(name), errno)
+	}
+}
+
+func (k kernelNotifier) content(child *fs.Inode, attrOnly bool) {
+	// A negative offset only invalidates the attributes, length 0 means
+	// the whole file
+	off := int64(0)
+	if attrOnly {
+		off = -1
+	}
+	if errno := child.NotifyContent(off, 0); errno != 0 && errno != syscall.ENOENT {
+		k.log.Debug.Printf("watch: NotifyContent: %v", errno)
+	}
+}
+
+// watchApply tells "notify" what the kernel has to forget after "op"
+// happened to the backing entry "cName" of the directory "dir"
+func (rn *RootNode) watchApply(notify watchNotifier, dir *Node, cName string, op watchOp) {
+	name, child, ok := rn.watchName(dir, cName)
+	if !ok {
+		return
+	}
+	inode := dir.EmbeddedInode()
+	switch op {
+	case watchCreated:
+		notify.entry(inode, name)
+	case watchDeleted:
+		if child != nil {
+			// Also sends inotify events to the watchers of the mount
+			notify.delete(inode, name, child)
+		} else {
+			notify.entry(inode, name)
+		}
+	case watchWritten, watchAttr:
+		// Entries the kernel does not know have nothing cached
+		if child != nil {
+			notify.content(child, op == watchAttr)
+		}
+	}
+}
+
+// watchName returns the plaintext name of the backing entry "cName" of the
+// directory "dir", and its inode if the kernel knows it. Returns ok=false
+// for internal files like gocryptfs.diriv and for names that cannot be
+// decrypted.
+//
+// Symlink-safe through prepareAtSyscall() and Openat().
+func (rn *RootNode) watchName(dir *Node, cName string) (name string, child *fs.Inode, ok bool) {
+	isRoot := dir.IsRoot()
+	if rn.isInternalName(cName, dir.dirMode(), isRoot) {
+		return "", nil, false
+	}
+	if isRoot && len(rn.tenants) > 0 {
+		if idx := rn.tenantByCName(cName); idx != 0 {
+			name = rn.tenants[idx-1].Name
+			return name, dir.GetChild(name), true
+		}
+	}
+	if rn.args.PlaintextNames || dir.dirMode() != modeEncrypted {
+		return cName, dir.GetChild(cName), true
+	}
+	nt := dir.nameTransformer()
+	if nt == nil || dir.keysUnknown() || !rn.rlockKeys() {
+		return "", nil, false
+	}
+	defer rn.keyLock.RUnlock()
+	dirfd, dirCName, errno := dir.prepareAtSyscall("")
+	if errno != 0 {
+		return "", nil, false
+	}
+	defer syscall.Close(dirfd)
+	fd, err := syscallcompat.Openat(dirfd, dirCName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", nil, false
+	}
+	defer syscall.Close(fd)
+	iv, err := nametransform.ReadDirIVAt(fd)
+	if err != nil {
+		return "", nil, false
+	}
+	// The entries the kernel knows are found by encrypting their names.
+	// This also works after a deletion, when the longname file is gone.
+	for childName, ch := range dir.Children() {
+		if c, err := nt.EncryptAndHashName(childName, iv); err == nil && c == cName {
+			return childName, ch, true
+		}
+	}
+	cNameLong := cName
+	if nametransform.NameType(cName) == nametransform.LongNameContent {
+		cNameLong, err = nametransform.ReadLongNameAt(fd, cName)
+		if err != nil {
+			return "", nil, false
+		}
+	}
+	name, err = nt.DecryptName(cNameLong, iv)
+	if err != nil {
+		return "", nil, false
+	}
+	return name, nil, true
+}
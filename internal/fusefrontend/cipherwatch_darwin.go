@@ -0,0 +1,22 @@
+package fusefrontend
+
+import (
+	"errors"
+
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// cipherWatcher is not implemented on Darwin, which has no inotify
+type cipherWatcher struct{}
+
+func newCipherWatcher(log *tlog.Loggers) (*cipherWatcher, error) {
+	return nil, errors.New("-watch-cipherdir is not supported on this platform")
+}
+
+// StartWatch is a no-op on Darwin
+func (rn *RootNode) StartWatch() {}
+
+// StopWatch is a no-op on Darwin
+func (rn *RootNode) StopWatch() {}
+
+func (rn *RootNode) watchDir(n *Node, dirfd int, cName string) {}
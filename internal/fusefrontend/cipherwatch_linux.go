@@ -0,0 +1,213 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// watchMask are the inotify events that change what the kernel may have
+// cached. IN_EXCL_UNLINK: files that are open through the mount stay open
+// after an unlink, but their events do not matter anymore.
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_CLOSE_WRITE | unix.IN_ATTRIB | unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW | unix.IN_EXCL_UNLINK
+
+// cipherWatcher watches the backing directories of the directories the
+// kernel knows, using inotify
+type cipherWatcher struct {
+	// fd is the inotify instance, and file reads from it. The fd is
+	// nonblocking so that closing the file interrupts a Read().
+	fd   int
+	file *os.File
+	// notify is a kernelNotifier outside of tests
+	notify watchNotifier
+	// mu protects the maps and "closed"
+	mu sync.Mutex
+	// dirs maps the watch descriptors to the directories
+	dirs map[int32]*Node
+	// wds is the reverse of dirs
+	wds    map[*Node]int32
+	closed bool
+}
+
+func newCipherWatcher(log *tlog.Loggers) (*cipherWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &cipherWatcher{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		notify: kernelNotifier{log: log},
+		dirs:   make(map[int32]*Node),
+		wds:    make(map[*Node]int32),
+	}, nil
+}
+
+// StartWatch starts forwarding the changes made directly in CIPHERDIR,
+// "-watch-cipherdir". Must be called after the filesystem has been mounted,
+// the kernel cannot be notified before.
+func (rn *RootNode) StartWatch() {
+	if rn.watcher == nil {
+		return
+	}
+	dirfd, cName, errno := rn.prepareAtSyscall("")
+	if errno != 0 {
+		tlog.Warn.Printf("watch: cannot watch the root directory: %v", errno)
+	} else {
+		rn.watchDir(&rn.Node, dirfd, cName)
+		syscall.Close(dirfd)
+	}
+	go rn.watchLoop()
+}
+
+// StopWatch stops what StartWatch() has started
+func (rn *RootNode) StopWatch() {
+	w := rn.watcher
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		w.file.Close()
+	}
+}
+
+// watchDir starts watching the backing directory "cName" in "dirfd" of the
+// directory "n", unless it is watched already.
+//
+// Symlink-safe: inotify wants a path, which is resolved through "dirfd",
+// and IN_DONT_FOLLOW covers the last component.
+func (rn *RootNode) watchDir(n *Node, dirfd int, cName string) {
+	w := rn.watcher
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.wds[n]; ok || w.closed {
+		return
+	}
+	path := fmt.Sprintf("/proc/self/fd/%d/%s", dirfd, cName)
+	wd, err := unix.InotifyAddWatch(w.fd, path, watchMask)
+	if err == syscall.ENOSPC {
+		// fs.inotify.max_user_watches is reached. Make room by dropping the
+		// directories the kernel has forgotten.
+		w.prune()
+		wd, err = unix.InotifyAddWatch(w.fd, path, watchMask)
+	}
+	if err != nil {
+		rn.log.Debug.Printf("watch: cannot watch %q: %v", tlog.CipherName(cName), err)
+		return
+	}
+	// The same directory is found again under a new inode with
+	// "-sharedstorage"
+	if old, ok := w.dirs[int32(wd)]; ok {
+		delete(w.wds, old)
+	}
+	w.dirs[int32(wd)] = n
+	w.wds[n] = int32(wd)
+}
+
+// prune removes the watches of the directories the kernel has forgotten.
+// The caller must hold w.mu.
+func (w *cipherWatcher) prune() {
+	for wd, n := range w.dirs {
+		if n.Forgotten() {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+			delete(w.wds, n)
+		}
+	}
+}
+
+// watchLoop reads the inotify events until StopWatch() is called
+func (rn *RootNode) watchLoop() {
+	w := rn.watcher
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			// Closed by StopWatch()
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + unix.SizeofInotifyEvent
+			off = start + int(ev.Len)
+			if off > n {
+				break
+			}
+			// The name is padded with NUL bytes
+			cName := strings.TrimRight(string(buf[start:off]), "\x00")
+			rn.watchEvent(ev.Wd, ev.Mask, cName)
+		}
+	}
+}
+
+// watchEvent handles the inotify event "mask" for the entry "cName" of the
+// directory watched as "wd"
+func (rn *RootNode) watchEvent(wd int32, mask uint32, cName string) {
+	w := rn.watcher
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		tlog.Warn.Printf("watch: inotify queue overflow, invalidating all entries")
+		w.invalidateAll()
+		return
+	}
+	w.mu.Lock()
+	dir := w.dirs[wd]
+	if dir != nil && (mask&unix.IN_IGNORED != 0 || dir.Forgotten()) {
+		// The directory has been deleted, or the kernel does not need it
+		// anymore
+		if mask&unix.IN_IGNORED == 0 {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+		}
+		delete(w.dirs, wd)
+		delete(w.wds, dir)
+		dir = nil
+	}
+	w.mu.Unlock()
+	if dir == nil || cName == "" {
+		return
+	}
+	var op watchOp
+	switch {
+	case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		op = watchCreated
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		op = watchDeleted
+	case mask&unix.IN_CLOSE_WRITE != 0:
+		op = watchWritten
+	case mask&unix.IN_ATTRIB != 0:
+		op = watchAttr
+	default:
+		return
+	}
+	rn.watchApply(w.notify, dir, cName, op)
+}
+
+// invalidateAll makes the kernel look up all entries of the watched
+// directories again, after events have been lost
+func (w *cipherWatcher) invalidateAll() {
+	w.mu.Lock()
+	dirs := make([]*Node, 0, len(w.dirs))
+	for _, n := range w.dirs {
+		dirs = append(dirs, n)
+	}
+	w.mu.Unlock()
+	for _, n := range dirs {
+		inode := n.EmbeddedInode()
+		for name := range inode.Children() {
+			w.notify.entry(inode, name)
+		}
+	}
+}
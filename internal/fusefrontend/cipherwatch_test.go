@@ -0,0 +1,112 @@
+package fusefrontend
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// recordNotifier records the calls as strings
+type recordNotifier []string
+
+func (r *recordNotifier) entry(dir *fs.Inode, name string) {
+	*r = append(*r, "entry "+name)
+}
+
+func (r *recordNotifier) delete(dir *fs.Inode, name string, child *fs.Inode) {
+	*r = append(*r, fmt.Sprintf("delete %s %v", name, child != nil))
+}
+
+func (r *recordNotifier) content(child *fs.Inode, attrOnly bool) {
+	*r = append(*r, fmt.Sprintf("content %v", attrOnly))
+}
+
+func TestWatchApply(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "cipherwatch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	if err = nametransform.WriteDirIVAt(dirfd); err != nil {
+		t.Fatal(err)
+	}
+	iv, err := nametransform.ReadDirIVAt(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	ctx := context.Background()
+	var out fuse.EntryOut
+	// Known to the kernel
+	inode, fh, _, errno := rn.Create(ctx, "known", syscall.O_RDWR, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(ctx)
+	rn.AddChild("known", inode, false)
+	// Created behind our back
+	longName := strings.Repeat("x", 200)
+	cNames := make(map[string]string)
+	for _, name := range []string{"known", "external", longName} {
+		cNames[name], err = rn.nameTransform.EncryptAndHashName(name, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(cipherdir, cNames["external"]), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = rn.nameTransform.WriteLongNameAt(dirfd, cNames[longName], longName); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		cName string
+		op    watchOp
+		want  []string
+	}{
+		{cNames["external"], watchCreated, []string{"entry external"}},
+		{cNames[longName], watchCreated, []string{"entry " + longName}},
+		{cNames["known"], watchAttr, []string{"content true"}},
+		{cNames["known"], watchWritten, []string{"content false"}},
+		// Nothing cached
+		{cNames["external"], watchWritten, nil},
+		{cNames["external"], watchDeleted, []string{"entry external"}},
+		// Internal files
+		{nametransform.DirIVFilename, watchCreated, nil},
+		{cNames[longName] + nametransform.LongNameSuffix, watchCreated, nil},
+		{"not-encrypted", watchCreated, nil},
+	}
+	for _, tc := range testCases {
+		var rec recordNotifier
+		rn.watchApply(&rec, &rn.Node, tc.cName, tc.op)
+		if !reflect.DeepEqual([]string(rec), tc.want) {
+			t.Errorf("%q, op %d: want %q, got %q", tc.cName, tc.op, tc.want, rec)
+		}
+	}
+	// The name of a deleted entry is found through the kernel's inode
+	if err = syscall.Unlink(filepath.Join(cipherdir, cNames["known"])); err != nil {
+		t.Fatal(err)
+	}
+	var rec recordNotifier
+	rn.watchApply(&rec, &rn.Node, cNames["known"], watchDeleted)
+	if want := []string{"delete known true"}; !reflect.DeepEqual([]string(rec), want) {
+		t.Errorf("want %q, got %q", want, rec)
+	}
+}
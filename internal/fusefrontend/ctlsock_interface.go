@@ -1,24 +1,39 @@
 package fusefrontend
 
 import (
+	"errors"
 	"fmt"
 	"path"
 	"path/filepath"
 	"strings"
 	"syscall"
 
+	"github.com/HorizonLiu/gocryptfs/ctlsock"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
 	"github.com/HorizonLiu/gocryptfs/internal/ctlsocksrv"
+	"github.com/HorizonLiu/gocryptfs/internal/journal"
+	"github.com/HorizonLiu/gocryptfs/internal/lease"
 	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
 	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
 )
 
 var _ ctlsocksrv.Interface = &RootNode{} // Verify that interface is implemented.
+var _ ctlsocksrv.TreeWalker = &RootNode{}
 
 // EncryptPath implements ctlsock.Backend
 //
 // Symlink-safe through openBackingDir().
 func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
+	if !rn.rlockKeys() {
+		return "", syscall.EACCES
+	}
+	defer rn.keyLock.RUnlock()
+	return rn.encryptPath(plainPath)
+}
+
+// encryptPath is EncryptPath without the key lock
+func (rn *RootNode) encryptPath(plainPath string) (string, error) {
 	if plainPath == "" {
 		// Empty string gets encrypted as empty string
 		return plainPath, nil
@@ -40,7 +55,7 @@ func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
 		syscall.Close(dirfd)
 		cPath = filepath.Join(cPath, cName)
 	}
-	tlog.Debug.Printf("encryptPath '%s' -> '%s'", plainPath, cPath)
+	rn.log.Debug.Printf("encryptPath '%s' -> '%s'", tlog.PlainName(plainPath), tlog.CipherName(cPath))
 	return cPath, nil
 }
 
@@ -49,6 +64,10 @@ func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
 // DecryptPath is symlink-safe because openBackingDir() and decryptPathAt()
 // are symlink-safe.
 func (rn *RootNode) DecryptPath(cipherPath string) (plainPath string, err error) {
+	if !rn.rlockKeys() {
+		return "", syscall.EACCES
+	}
+	defer rn.keyLock.RUnlock()
 	dirfd, _, err := rn.openBackingDir("")
 	if err != nil {
 		return "", err
@@ -66,24 +85,53 @@ func (rn *RootNode) decryptPathAt(dirfd int, cipherPath string) (plainPath strin
 	}
 	parts := strings.Split(cipherPath, "/")
 	wd := dirfd
+	// "-subdir" may point into a directory policy
+	mode := rn.dirMode()
+	nameTransform := rn.nameTransform
 	for i, part := range parts {
-		dirIV, err := nametransform.ReadDirIVAt(wd)
-		if err != nil {
-			fmt.Printf("ReadDirIV: %v\n", err)
-			return "", err
+		name := part
+		// The top-level directory of a tenant has a fixed name, and the
+		// tenant has keys of its own
+		tenantDir := false
+		if i == 0 {
+			if idx := rn.tenantByCName(part); idx != 0 {
+				t := rn.tenants[idx-1]
+				if t.nameTransform == nil && len(parts) > 1 {
+					return "", syscall.EACCES
+				}
+				name = t.Name
+				nameTransform = t.nameTransform
+				tenantDir = true
+			} else if rn.args.TenantsOnly {
+				return "", syscall.EACCES
+			}
+		}
+		var dirIV []byte
+		if mode == modeEncrypted && !tenantDir {
+			dirIV, err = nametransform.ReadDirIVAt(wd)
+			if err == syscall.ENOENT && rn.DirPoliciesEnabled() {
+				// Names below a directory policy are not encrypted
+				mode = rn.dirModeAt(wd)
+			}
 		}
-		longPart := part
-		if nametransform.IsLongContent(part) {
-			longPart, err = nametransform.ReadLongNameAt(wd, part)
+		if mode == modeEncrypted && !tenantDir {
 			if err != nil {
-				fmt.Printf("ReadLongName: %v\n", err)
+				fmt.Printf("ReadDirIV: %v\n", err)
+				return "", err
+			}
+			longPart := part
+			if nametransform.IsLongContent(part) {
+				longPart, err = nametransform.ReadLongNameAt(wd, part)
+				if err != nil {
+					fmt.Printf("ReadLongName: %v\n", err)
+					return "", err
+				}
+			}
+			name, err = nameTransform.DecryptName(longPart, dirIV)
+			if err != nil {
+				fmt.Printf("DecryptName: %v\n", err)
 				return "", err
 			}
-		}
-		name, err := rn.nameTransform.DecryptName(longPart, dirIV)
-		if err != nil {
-			fmt.Printf("DecryptName: %v\n", err)
-			return "", err
 		}
 		plainPath = path.Join(plainPath, name)
 		// Last path component? We are done.
@@ -103,3 +151,173 @@ func (rn *RootNode) decryptPathAt(dirfd int, cipherPath string) (plainPath strin
 
 	return plainPath, nil
 }
+
+// errTreeFull stops walkDir() when the maximum number of entries is reached
+var errTreeFull = errors.New("tree is full")
+
+// WalkTree implements ctlsocksrv.TreeWalker
+//
+// Symlink-safe through openBackingDir() and Openat() with O_NOFOLLOW.
+func (rn *RootNode) WalkTree(plainDir string, max int) (tree []ctlsock.PathPair, truncated bool, err error) {
+	if !rn.rlockKeys() {
+		return nil, false, syscall.EACCES
+	}
+	defer rn.keyLock.RUnlock()
+	if plainDir != "" && rn.isExcludedPlain(plainDir) {
+		return nil, false, syscall.EPERM
+	}
+	cipherDir, err := rn.encryptPath(plainDir)
+	if err != nil {
+		return nil, false, err
+	}
+	parentDirFd, cName, mode, err := rn.openBackingDirMode(plainDir)
+	if err != nil {
+		return nil, false, err
+	}
+	fd, err := syscallcompat.Openat(parentDirFd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	syscall.Close(parentDirFd)
+	if err != nil {
+		return nil, false, err
+	}
+	nameTransform := rn.nameTransform
+	if idx := rn.tenantByName(strings.SplitN(plainDir, "/", 2)[0]); idx != 0 {
+		nameTransform = rn.tenants[idx-1].nameTransform
+	}
+	err = rn.walkDir(fd, plainDir, cipherDir, mode, nameTransform, max, &tree)
+	if err == errTreeFull {
+		return tree, true, nil
+	}
+	return tree, false, err
+}
+
+// walkDir appends the entries of the ciphertext directory "fd" and its
+// subdirectories to "tree" and closes "fd". "mode" is the dirMode of the
+// parent directory, "nameTransform" decrypts the names in "fd". The
+// filtering matches Readdir().
+func (rn *RootNode) walkDir(fd int, plainDir string, cipherDir string, mode dirMode, nameTransform nametransform.NameTransformer, max int, tree *[]ctlsock.PathPair) error {
+	defer syscall.Close(fd)
+	entries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		return err
+	}
+	var iv []byte
+	if !rn.args.PlaintextNames && mode == modeEncrypted {
+		iv, err = nametransform.ReadDirIVAt(fd)
+		if err == syscall.ENOENT && rn.DirPoliciesEnabled() {
+			mode = rn.dirModeAt(fd)
+		}
+		if mode == modeEncrypted && err != nil {
+			return err
+		}
+	}
+	plaintextNames := rn.args.PlaintextNames || mode != modeEncrypted
+	for _, e := range entries {
+		cName := e.Name
+		if cipherDir == "" && (cName == configfile.ConfDefaultName || cName == journal.FileName) {
+			continue
+		}
+		name := cName
+		// Tenant directories are listed even if they are locked, but only
+		// the unlocked ones are walked
+		if plainDir == "" && len(rn.tenants) > 0 {
+			if idx := rn.tenantByCName(cName); idx != 0 {
+				t := rn.tenants[idx-1]
+				p := ctlsock.PathPair{Plain: t.Name, Cipher: cName}
+				if rn.isExcludedPlain(p.Plain) {
+					continue
+				}
+				if len(*tree) >= max {
+					return errTreeFull
+				}
+				*tree = append(*tree, p)
+				if t.nameTransform == nil {
+					continue
+				}
+				fd2, err := syscallcompat.Openat(fd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+				if err != nil {
+					return err
+				}
+				if err := rn.walkDir(fd2, p.Plain, p.Cipher, mode, t.nameTransform, max, tree); err != nil {
+					return err
+				}
+				continue
+			} else if rn.args.TenantsOnly {
+				continue
+			}
+		}
+		if plaintextNames && !rn.args.PlaintextNames &&
+			(cName == nametransform.DirIVFilename || cName == nametransform.DirPolicyFilename) {
+			continue
+		}
+		if !plaintextNames {
+			if cName == nametransform.DirIVFilename || lease.IsLeaseFile(cName) || nametransform.IsLongTarget(cName) {
+				continue
+			}
+			cNameLong := cName
+			isLong := nametransform.LongNameNone
+			if rn.args.LongNames {
+				isLong = nametransform.NameType(cName)
+			}
+			if isLong == nametransform.LongNameFilename {
+				continue
+			} else if isLong == nametransform.LongNameContent {
+				cNameLong, err = nametransform.ReadLongNameAt(fd, cName)
+				if err != nil {
+					tlog.Warn.Printf("WalkTree %q: invalid entry %q: Could not read .name: %v",
+						tlog.CipherName(cipherDir), tlog.CipherName(cName), err)
+					continue
+				}
+			}
+			name, err = nameTransform.DecryptName(cNameLong, iv)
+			if err != nil {
+				tlog.Warn.Printf("WalkTree %q: invalid entry %q: %v", tlog.CipherName(cipherDir), tlog.CipherName(cName), err)
+				continue
+			}
+		}
+		p := ctlsock.PathPair{
+			Plain:  path.Join(plainDir, name),
+			Cipher: path.Join(cipherDir, cName),
+		}
+		if rn.isExcludedPlain(p.Plain) {
+			continue
+		}
+		if len(*tree) >= max {
+			return errTreeFull
+		}
+		*tree = append(*tree, p)
+		if e.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			continue
+		}
+		fd2, err := syscallcompat.Openat(fd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		if err := rn.walkDir(fd2, p.Plain, p.Cipher, mode, nameTransform, max, tree); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenFiles implements ctlsocksrv.OpenFilesLister. Returns the plaintext
+// paths of all open files.
+func (rn *RootNode) OpenFiles() []string {
+	return rn.openFiles.List()
+}
+
+// FlushCaches implements ctlsocksrv.CacheFlusher
+func (rn *RootNode) FlushCaches() {
+	rn.dirCache.Clear()
+	if rn.fdCache != nil {
+		rn.fdCache.clear()
+	}
+}
+
+// FDCacheStats implements ctlsocksrv.FDCacheReporter. All counters are zero
+// if "-fd-cache" is off.
+func (rn *RootNode) FDCacheStats() *ctlsock.FDCacheStats {
+	if rn.fdCache == nil {
+		return &ctlsock.FDCacheStats{}
+	}
+	return rn.fdCache.stats()
+}
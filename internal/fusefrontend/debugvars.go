@@ -0,0 +1,41 @@
+package fusefrontend
+
+import (
+	"github.com/HorizonLiu/gocryptfs/ctlsock"
+)
+
+// DebugVars is the internal state of a mount that is published on the
+// debug endpoint ("-debug-addr").
+type DebugVars struct {
+	// OpenFiles is the number of open inodes, OpenHandles the number of
+	// open file handles. Several handles can share one inode.
+	OpenFiles   int
+	OpenHandles int
+	// DirCacheEntries is the number of directories in the dirIV cache, out
+	// of DirCacheSize
+	DirCacheEntries int
+	DirCacheSize    int
+	// DirCacheLookups and DirCacheHits count the dirIV cache lookups since
+	// mount
+	DirCacheLookups uint64
+	DirCacheHits    uint64
+	// FDCache describes the backing file descriptor cache ("-fd-cache")
+	FDCache *ctlsock.FDCacheStats
+	// Locked is set while the keys are wiped ("-idlelock")
+	Locked bool
+}
+
+// DebugVars returns the current internal state of "rn"
+func (rn *RootNode) DebugVars() DebugVars {
+	entries, lookups, hits := rn.dirCache.counters()
+	return DebugVars{
+		OpenFiles:       rn.CountOpenFiles(),
+		OpenHandles:     len(rn.openFiles.Handles()),
+		DirCacheEntries: entries,
+		DirCacheSize:    dirCacheSize,
+		DirCacheLookups: lookups,
+		DirCacheHits:    hits,
+		FDCache:         rn.FDCacheStats(),
+		Locked:          rn.IsLocked(),
+	}
+}
@@ -57,7 +57,7 @@ type dirCache struct {
 	// On the first Lookup(), the expire thread is started, and this flag is set
 	// to true.
 	expireThreadRunning bool
-	// Hit rate stats. Evaluated and reset by the expire thread.
+	// Hit rate stats since mount, for "-debug-addr"
 	lookups uint64
 	hits    uint64
 }
@@ -109,9 +109,7 @@ func (d *dirCache) Store(node *Node, fd int, iv []byte) {
 func (d *dirCache) Lookup(node *Node) (fd int, iv []byte) {
 	d.Lock()
 	defer d.Unlock()
-	if enableStats {
-		d.lookups++
-	}
+	d.lookups++
 	var e *dirCacheEntry
 	for i := range d.entries {
 		e = &d.entries[i]
@@ -136,9 +134,7 @@ func (d *dirCache) Lookup(node *Node) (fd int, iv []byte) {
 		d.dbg("dirCache.Lookup %p miss\n", node)
 		return -1, nil
 	}
-	if enableStats {
-		d.hits++
-	}
+	d.hits++
 	if fd <= 0 || len(iv) != nametransform.DirIVLen {
 		log.Panicf("Lookup sanity check failed: fd=%d len=%d", fd, len(iv))
 	}
@@ -155,23 +151,30 @@ func (d *dirCache) expireThread() {
 	}
 }
 
-// stats prints hit rate statistics and resets the counters. No-op if
-// enableStats == false.
+// stats prints hit rate statistics. No-op if enableStats == false.
 func (d *dirCache) stats() {
 	if !enableStats {
 		return
 	}
-	d.Lock()
-	lookups := d.lookups
-	hits := d.hits
-	d.lookups = 0
-	d.hits = 0
-	d.Unlock()
+	_, lookups, hits := d.counters()
 	if lookups > 0 {
 		fmt.Printf("dirCache: hits=%3d lookups=%3d, rate=%3d%%\n", hits, lookups, (hits*100)/lookups)
 	}
 }
 
+// counters returns the number of filled entries and the lookups and hits
+// since mount
+func (d *dirCache) counters() (entries int, lookups uint64, hits uint64) {
+	d.Lock()
+	defer d.Unlock()
+	for i := range d.entries {
+		if d.entries[i].fd > 0 {
+			entries++
+		}
+	}
+	return entries, d.lookups, d.hits
+}
+
 // dbg prints a debug message. Usually disabled.
 func (d *dirCache) dbg(format string, a ...interface{}) {
 	if enableDebugMessages {
@@ -0,0 +1,251 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/HorizonLiu/gocryptfs/internal/lease"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// openEncryptedDir opens the backing directory of "plainPath" for reading.
+// Returns -1 if the names of its entries are not encrypted, which means that
+// it has no gocryptfs.diriv.
+func (rn *RootNode) openEncryptedDir(plainPath string) (fd int, err error) {
+	if rn.args.PlaintextNames {
+		return -1, nil
+	}
+	parentDirFd, cName, mode, err := rn.openBackingDirMode(plainPath)
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(parentDirFd)
+	if rn.childDirMode(mode, parentDirFd, cName) != modeEncrypted {
+		return -1, nil
+	}
+	return syscallcompat.Openat(parentDirFd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+}
+
+// CheckDirIV checks the gocryptfs.diriv file of the directory "plainPath".
+// Returns a description of the problem, or "" if the file is fine or the
+// directory does not need one (plaintextnames, directory policies).
+// Used by "-fsck".
+func (rn *RootNode) CheckDirIV(plainPath string) (problem string, err error) {
+	if !rn.rlockKeys() {
+		return "", syscall.EACCES
+	}
+	defer rn.keyLock.RUnlock()
+	fd, err := rn.openEncryptedDir(plainPath)
+	if err != nil || fd < 0 {
+		return "", err
+	}
+	defer syscall.Close(fd)
+	var st unix.Stat_t
+	err = syscallcompat.Fstatat(fd, nametransform.DirIVFilename, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err == syscall.ENOENT {
+		return nametransform.DirIVFilename + " is missing", nil
+	} else if err != nil {
+		return "", err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nametransform.DirIVFilename + " is not a regular file", nil
+	}
+	if st.Size != nametransform.DirIVLen {
+		return fmt.Sprintf("%s has the wrong size (%d bytes)", nametransform.DirIVFilename, st.Size), nil
+	}
+	if _, err := nametransform.ReadDirIVAt(fd); err != nil {
+		return fmt.Sprintf("%s is invalid: %v", nametransform.DirIVFilename, err), nil
+	}
+	return "", nil
+}
+
+// pathTenant returns the index+1 of the tenant that "plainPath" belongs to,
+// or 0
+func (rn *RootNode) pathTenant(plainPath string) uint32 {
+	return rn.tenantByName(strings.SplitN(plainPath, "/", 2)[0])
+}
+
+// pathNameTransform returns the name encryption helper for the entries of
+// the directory "plainPath"
+func (rn *RootNode) pathNameTransform(plainPath string) nametransform.NameTransformer {
+	if idx := rn.pathTenant(plainPath); idx != 0 {
+		return rn.tenants[idx-1].nameTransform
+	}
+	return rn.nameTransform
+}
+
+// lostFoundPath returns the path of the directory "lostFoundName" that
+// takes the entries of "plainPath" that cannot be decrypted any more: in the
+// root directory, or in the tenant directory that contains "plainPath", as
+// the file contents are encrypted with the key of the tenant.
+func (rn *RootNode) lostFoundPath(plainPath string, lostFoundName string) string {
+	if idx := rn.pathTenant(plainPath); idx != 0 {
+		return rn.tenants[idx-1].Name + "/" + lostFoundName
+	}
+	return lostFoundName
+}
+
+// RepairDirIV replaces the missing or broken gocryptfs.diriv of the
+// directory "plainPath" with a new one. The names of its entries were
+// encrypted with the old one and cannot be decrypted any more, so the
+// entries are moved to the directory "lostFoundName" (see lostFoundPath),
+// which is created if needed. The entries are named like "-badname" shows
+// them: the encrypted name plus " GOCRYPTFS_BAD_NAME". File contents and
+// subdirectories are still readable. Returns the new paths.
+func (rn *RootNode) RepairDirIV(plainPath string, lostFoundName string) (moved []string, err error) {
+	if rn.args.PlaintextNames {
+		return nil, syscall.ENOTSUP
+	}
+	lostFound := rn.lostFoundPath(plainPath, lostFoundName)
+	if !rn.rlockKeys() {
+		return nil, syscall.EACCES
+	}
+	defer rn.keyLock.RUnlock()
+	fd, err := rn.openEncryptedDir(plainPath)
+	if err != nil {
+		return nil, err
+	}
+	if fd < 0 {
+		return nil, syscall.EINVAL
+	}
+	defer syscall.Close(fd)
+	rn.dirIVLock.Lock()
+	defer rn.dirIVLock.Unlock()
+	entries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		return nil, err
+	}
+	err = syscallcompat.Unlinkat(fd, nametransform.DirIVFilename, 0)
+	if err != nil && err != syscall.ENOENT {
+		return nil, err
+	}
+	if err = nametransform.WriteDirIVAt(fd); err != nil {
+		return nil, err
+	}
+	rn.dirCache.Clear()
+	rn.log.Info.Printf("RepairDirIV %q: new %s", tlog.PlainName(plainPath), nametransform.DirIVFilename)
+
+	lfFd, err := rn.mkdirLostFound(lostFound)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(lfFd)
+	lfIV, err := nametransform.ReadDirIVAt(lfFd)
+	if err != nil {
+		return nil, err
+	}
+	nameTransform := rn.pathNameTransform(lostFound)
+	for _, e := range entries {
+		cName := e.Name
+		if cName == "." || cName == ".." || lease.IsLeaseFile(cName) {
+			continue
+		}
+		// gocryptfs.diriv, gocryptfs.conf and the like. The ".name" files
+		// are handled together with their content file.
+		if strings.HasPrefix(cName, "gocryptfs.") && !nametransform.IsLongContent(cName) {
+			continue
+		}
+		// The names of the tenant directories are stored in the config file
+		if plainPath == "" && rn.tenantByCName(cName) != 0 {
+			continue
+		}
+		newName, err := rn.moveToLostFound(fd, cName, lfFd, lfIV, nameTransform)
+		if err != nil {
+			tlog.Warn.Printf("RepairDirIV: cannot move %q: %v", cName, err)
+			continue
+		}
+		if nametransform.IsLongContent(cName) {
+			syscallcompat.Unlinkat(fd, cName+nametransform.LongNameSuffix, 0)
+		}
+		moved = append(moved, filepath.Join(lostFound, newName))
+	}
+	rn.dirCache.Clear()
+	return moved, nil
+}
+
+// mkdirLostFound opens the encrypted directory "lostFound", creating it if
+// it does not exist yet. Only its parent has to exist.
+func (rn *RootNode) mkdirLostFound(lostFound string) (fd int, err error) {
+	parentDirFd, cName, mode, err := rn.openBackingDirMode(lostFound)
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(parentDirFd)
+	if mode != modeEncrypted || rn.childDirMode(mode, parentDirFd, cName) != modeEncrypted {
+		return -1, syscall.EINVAL
+	}
+	err = syscallcompat.Mkdirat(parentDirFd, cName, 0700)
+	if err == syscall.EEXIST {
+		return syscallcompat.Openat(parentDirFd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	} else if err != nil {
+		return -1, err
+	}
+	fd, err = syscallcompat.Openat(parentDirFd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err == nil {
+		err = nametransform.WriteDirIVAt(fd)
+	}
+	if err == nil && nametransform.IsLongContent(cName) {
+		err = rn.pathNameTransform(nametransform.Dir(lostFound)).WriteLongNameAt(parentDirFd, cName, lostFound)
+	}
+	if err != nil {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+		syscallcompat.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// moveToLostFound moves the entry "cName" of "dirfd" to the lost+found
+// directory "lfFd", whose gocryptfs.diriv contains "lfIV". Returns the
+// plaintext name it got there.
+func (rn *RootNode) moveToLostFound(dirfd int, cName string, lfFd int, lfIV []byte,
+	nameTransform nametransform.NameTransformer) (string, error) {
+	base := cName
+	if max := nametransform.NameMax - len(nametransform.BadnameSuffix) - 4; len(base) > max {
+		base = base[:max]
+	}
+	for i := 0; i < 100; i++ {
+		newName := base + nametransform.BadnameSuffix
+		if i > 0 {
+			newName = fmt.Sprintf("%s.%d%s", base, i, nametransform.BadnameSuffix)
+		}
+		newCName, err := nameTransform.EncryptAndHashName(newName, lfIV)
+		if err != nil {
+			return "", err
+		}
+		if nametransform.IsLongContent(newCName) {
+			err = nameTransform.WriteLongNameAt(lfFd, newCName, newName)
+			if err == syscall.EEXIST {
+				continue
+			} else if err != nil {
+				return "", err
+			}
+		}
+		// A symlink takes its long target file along
+		m, errno := prepareLongTargetMove(dirfd, cName, lfFd)
+		if errno != 0 {
+			return "", errno
+		}
+		err = syscallcompat.Renameat2(dirfd, cName, lfFd, newCName, syscallcompat.RENAME_NOREPLACE)
+		if err == nil {
+			m.moved()
+			return newName, nil
+		}
+		m.undo()
+		if nametransform.IsLongContent(newCName) {
+			nametransform.DeleteLongNameAt(lfFd, newCName)
+		}
+		if err != syscall.EEXIST {
+			return "", err
+		}
+	}
+	return "", syscall.EEXIST
+}
@@ -0,0 +1,129 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+func TestRepairDirIV(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "diriv_repair_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	var out fuse.EntryOut
+	if _, errno := rn.Mkdir(ctx, "dir", 0700, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	dirInode, errno := rn.Lookup(ctx, "dir", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("dir", dirInode, false)
+	dir := dirInode.Operations().(*Node)
+	_, fh, _, errno := dir.Create(ctx, "file", syscall.O_RDWR, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	if _, errno = f.Write(ctx, []byte("hello"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.Release(ctx)
+	if _, errno = dir.Mkdir(ctx, "sub", 0700, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	if problem, err := rn.CheckDirIV("dir"); problem != "" || err != nil {
+		t.Fatalf("intact dir: %q, %v", problem, err)
+	}
+	cDir, err := rn.EncryptPath("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(cipherdir, cDir, nametransform.DirIVFilename)); err != nil {
+		t.Fatal(err)
+	}
+	rn.dirCache.Clear()
+	if problem, err := rn.CheckDirIV("dir"); !strings.Contains(problem, "missing") || err != nil {
+		t.Fatalf("missing diriv: %q, %v", problem, err)
+	}
+	moved, err := rn.RepairDirIV("dir", "lost+found")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 2 {
+		t.Fatalf("wrong moved list: %v", moved)
+	}
+	for _, m := range moved {
+		if !strings.HasPrefix(m, "lost+found/") || !strings.HasSuffix(m, nametransform.BadnameSuffix) {
+			t.Errorf("wrong new path %q", m)
+		}
+	}
+	if problem, err := rn.CheckDirIV("dir"); problem != "" || err != nil {
+		t.Errorf("repaired dir: %q, %v", problem, err)
+	}
+	if names := listNames(t, dir); len(names) != 0 {
+		t.Errorf("repaired dir is not empty: %v", names)
+	}
+	// The file content can still be decrypted
+	lfInode, errno := rn.Lookup(ctx, "lost+found", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("lost+found", lfInode, false)
+	lf := lfInode.Operations().(*Node)
+	if names := listNames(t, lf); len(names) != 2 {
+		t.Errorf("wrong lost+found listing: %v", names)
+	}
+	var found bool
+	for _, m := range moved {
+		name := filepath.Base(m)
+		inode, errno := lf.Lookup(ctx, name, &out)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		if out.Attr.Mode&syscall.S_IFMT != syscall.S_IFREG {
+			continue
+		}
+		lf.AddChild(name, inode, false)
+		fh, _, errno := inode.Operations().(*Node).Open(ctx, syscall.O_RDONLY)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		buf := make([]byte, 10)
+		res, errno := fh.(*File).Read(ctx, buf, 0)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		data, _ := res.Bytes(buf)
+		if string(data) != "hello" {
+			t.Errorf("wrong content %q", data)
+		}
+		fh.(*File).Release(ctx)
+		found = true
+	}
+	if !found {
+		t.Error("file not found in lost+found")
+	}
+}
@@ -0,0 +1,198 @@
+package fusefrontend
+
+import (
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/HorizonLiu/gocryptfs/internal/lease"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// dirMode says how the entries of a directory are stored in CIPHERDIR. A
+// directory with a "gocryptfs.dirpolicy" marker and everything below it
+// uses the mode of the policy. Everything else is encrypted.
+type dirMode uint32
+
+const (
+	// modeEncrypted: names, symlink targets and contents are encrypted
+	modeEncrypted dirMode = iota
+	// modePlaintextNames: like "-plaintextnames", only the contents are
+	// encrypted
+	modePlaintextNames
+	// modePassthrough: nothing is encrypted
+	modePassthrough
+)
+
+// dirModeFromPolicy converts the content of a "gocryptfs.dirpolicy" file
+func dirModeFromPolicy(policy string) dirMode {
+	if policy == nametransform.DirPolicyPassthrough {
+		return modePassthrough
+	}
+	return modePlaintextNames
+}
+
+// dirMode returns the mode of the entries of directory "n". For other node
+// types, it returns the mode of the directory that contains them.
+func (n *Node) dirMode() dirMode {
+	return dirMode(atomic.LoadUint32(&n.mode))
+}
+
+func (n *Node) setDirMode(m dirMode) {
+	atomic.StoreUint32(&n.mode, uint32(m))
+}
+
+// plaintextNames returns true if the names of the entries of "n" are not
+// encrypted, either because of "-plaintextnames" or because of a
+// directory policy.
+func (n *Node) plaintextNames() bool {
+	return n.rootNode().args.PlaintextNames || n.dirMode() != modeEncrypted
+}
+
+// isReservedName returns true if "name" cannot be used in directory "n". The
+// marker files decide how a directory is stored, so a user must not be
+// able to create them where names are not encrypted.
+func (n *Node) isReservedName(name string) bool {
+	if n.rootNode().args.PlaintextNames || n.dirMode() == modeEncrypted {
+		return false
+	}
+	return name == nametransform.DirIVFilename || name == nametransform.DirPolicyFilename
+}
+
+// DirPoliciesEnabled returns true if the filesystem may contain directory
+// policies (feature flag "DirPolicy")
+func (rn *RootNode) DirPoliciesEnabled() bool {
+	return atomic.LoadUint32(&rn.dirPolicies) != 0
+}
+
+// childDirMode returns the mode of the entries of the directory "cName" in
+// "dirfd", which is an entry of a directory with mode "parent".
+// Only a directory in an encrypted directory can have a policy of its own.
+func (rn *RootNode) childDirMode(parent dirMode, dirfd int, cName string) dirMode {
+	if parent != modeEncrypted || !rn.DirPoliciesEnabled() || rn.args.PlaintextNames {
+		return parent
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	if err != nil {
+		return parent
+	}
+	defer syscall.Close(fd)
+	return rn.dirModeAt(fd)
+}
+
+// dirModeAt returns the mode of the entries of the encrypted or policy
+// root directory opened as "fd"
+func (rn *RootNode) dirModeAt(fd int) dirMode {
+	policy, err := nametransform.ReadDirPolicyAt(fd)
+	if err == syscall.ENOENT {
+		return modeEncrypted
+	} else if err != nil {
+		// Accessing the entries fails without a gocryptfs.diriv
+		tlog.Warn.Printf("%s: %v", nametransform.DirPolicyFilename, err)
+		return modeEncrypted
+	}
+	return dirModeFromPolicy(policy)
+}
+
+// SetDirPolicy turns the empty encrypted directory "plainPath" into a policy
+// root. "policy" is one of the nametransform.DirPolicy* constants. If
+// directory policies are not enabled yet, "enable" is called to set the
+// "DirPolicy" feature flag in the config file first.
+//
+// Symlink-safe through openBackingDir() and Openat().
+func (rn *RootNode) SetDirPolicy(plainPath string, policy string, enable func() error) error {
+	if !nametransform.IsValidDirPolicy(policy) || plainPath == "" {
+		return syscall.EINVAL
+	}
+	if rn.args.PlaintextNames || rn.args.SharedStorage {
+		return syscall.ENOTSUP
+	}
+	if !rn.rlockKeys() {
+		return syscall.EACCES
+	}
+	defer rn.keyLock.RUnlock()
+	if rn.isExcludedPlain(plainPath) {
+		return syscall.EPERM
+	}
+	parentDirFd, cName, mode, err := rn.openBackingDirMode(plainPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(parentDirFd)
+	if mode != modeEncrypted {
+		// Policies cannot be nested
+		return syscall.EEXIST
+	}
+	if !rn.DirPoliciesEnabled() {
+		if err := enable(); err != nil {
+			return err
+		}
+		atomic.StoreUint32(&rn.dirPolicies, 1)
+	}
+	fd, err := syscallcompat.Openat(parentDirFd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	// Keep readers from seeing the directory without a gocryptfs.diriv
+	rn.dirIVLock.Lock()
+	defer rn.dirIVLock.Unlock()
+	entries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name == nametransform.DirPolicyFilename {
+			return syscall.EEXIST
+		}
+		if e.Name != nametransform.DirIVFilename && !lease.IsLeaseFile(e.Name) {
+			return syscall.ENOTEMPTY
+		}
+	}
+	if err := nametransform.WriteDirPolicyAt(fd, policy); err != nil {
+		return err
+	}
+	// As long as gocryptfs.diriv exists, the directory is still encrypted
+	if err := syscallcompat.Unlinkat(fd, nametransform.DirIVFilename, 0); err != nil {
+		syscallcompat.Unlinkat(fd, nametransform.DirPolicyFilename, 0)
+		return err
+	}
+	// The cached gocryptfs.diriv is gone
+	rn.dirCache.Clear()
+	if inode := rn.findInode(plainPath); inode != nil {
+		toNode(inode.Operations()).setDirMode(dirModeFromPolicy(policy))
+	}
+	rn.log.Info.Printf("SetDirPolicy %q: %s", tlog.PlainName(plainPath), policy)
+	return nil
+}
+
+// findInode returns the inode of "plainPath" if the kernel knows it, or nil
+func (rn *RootNode) findInode(plainPath string) *fs.Inode {
+	inode := rn.EmbeddedInode()
+	for _, name := range strings.Split(plainPath, "/") {
+		inode = inode.GetChild(name)
+		if inode == nil {
+			return nil
+		}
+	}
+	return inode
+}
+
+// policyMarker returns the name of the file that makes the directory "fd"
+// decryptable: gocryptfs.dirpolicy for a policy root, gocryptfs.diriv
+// otherwise. Used by Rmdir(), which has to move it out of the way.
+func (rn *RootNode) policyMarker(fd int) string {
+	if rn.DirPoliciesEnabled() {
+		var st unix.Stat_t
+		if syscallcompat.Fstatat(fd, nametransform.DirPolicyFilename, &st, unix.AT_SYMLINK_NOFOLLOW) == nil {
+			return nametransform.DirPolicyFilename
+		}
+	}
+	return nametransform.DirIVFilename
+}
@@ -0,0 +1,110 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+func TestSetDirPolicy(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "dirpolicy_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	var out fuse.EntryOut
+	if _, errno := rn.Mkdir(ctx, "pub", 0700, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	enabled := 0
+	enable := func() error {
+		enabled++
+		return nil
+	}
+	if err = rn.SetDirPolicy("pub", "bogus", enable); err != syscall.EINVAL {
+		t.Errorf("invalid policy: want EINVAL, got %v", err)
+	}
+	if err = rn.SetDirPolicy("pub", nametransform.DirPolicyPassthrough, enable); err != nil {
+		t.Fatal(err)
+	}
+	if enabled != 1 || !rn.DirPoliciesEnabled() {
+		t.Errorf("feature flag not enabled: enabled=%d", enabled)
+	}
+	if err = rn.SetDirPolicy("pub", nametransform.DirPolicyPassthrough, enable); err != syscall.EEXIST {
+		t.Errorf("second call: want EEXIST, got %v", err)
+	}
+	if enabled != 1 {
+		t.Errorf("enable called again: enabled=%d", enabled)
+	}
+
+	pubInode, errno := rn.Lookup(ctx, "pub", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("pub", pubInode, false)
+	pub := pubInode.Operations().(*Node)
+	if pub.dirMode() != modePassthrough {
+		t.Fatalf("wrong mode %d", pub.dirMode())
+	}
+	// Names and contents are stored as-is
+	_, fh, _, errno := pub.Create(ctx, "hello.txt", syscall.O_RDWR, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	pf := fh.(*passthroughFile)
+	if _, errno = pf.Write(ctx, []byte("hello"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	pf.Release(ctx)
+	matches, _ := filepath.Glob(filepath.Join(cipherdir, "*", "hello.txt"))
+	if len(matches) != 1 {
+		t.Fatalf("backing file not found: %v", matches)
+	}
+	content, err := ioutil.ReadFile(matches[0])
+	if err != nil || string(content) != "hello" {
+		t.Errorf("backing file content %q, err=%v", content, err)
+	}
+	// The marker files are reserved
+	if _, _, _, errno = pub.Create(ctx, nametransform.DirPolicyFilename, syscall.O_RDWR, 0600, &out); errno != syscall.EPERM {
+		t.Errorf("reserved name: want EPERM, got %v", errno)
+	}
+	// Policies cannot be nested
+	if _, errno = pub.Mkdir(ctx, "sub", 0700, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if err = rn.SetDirPolicy("pub/sub", nametransform.DirPolicyPlaintextNames, enable); err != syscall.EEXIST {
+		t.Errorf("nested: want EEXIST, got %v", err)
+	}
+	// Moving files between encrypted and plaintext directories would need
+	// re-encryption
+	if errno = pub.Rename(ctx, "hello.txt", rn, "hello.txt", 0); errno != syscall.EXDEV {
+		t.Errorf("rename: want EXDEV, got %v", errno)
+	}
+	if errno = pub.Rmdir(ctx, "sub"); errno != 0 {
+		t.Errorf("rmdir sub: %v", errno)
+	}
+	if errno = pub.Unlink(ctx, "hello.txt"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno = rn.Rmdir(ctx, "pub"); errno != 0 {
+		t.Errorf("rmdir pub: %v", errno)
+	}
+}
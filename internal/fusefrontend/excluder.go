@@ -0,0 +1,167 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/sabhiram/go-gitignore"
+)
+
+// CompileExcluder creates an object to check if plaintext paths are excluded
+// by the -exclude, -include and -filter options in "args". Returns nil if
+// there are no patterns, for example if all filter rules are comments.
+func CompileExcluder(args Args) (excluder ignore.IgnoreParser, err error) {
+	patterns, includes, err := getExclusionPatterns(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) > 0 {
+		compiled, err := ignore.CompileIgnoreLines(patterns...)
+		if err != nil {
+			return nil, fmt.Errorf("Error compiling exclusion rules: %v", err)
+		}
+		excluder = compiled
+		if parents := includeParents(includes); len(parents) > 0 {
+			excluder = &parentKeeper{IgnoreParser: compiled, parents: parents}
+		}
+	}
+	rules, err := getFilterRules(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) > 0 {
+		excluder = &filterList{rules: rules, next: excluder}
+	}
+	return excluder, nil
+}
+
+// isExcludedPlain finds out if the plaintext path "pPath" is excluded
+func (rn *RootNode) isExcludedPlain(pPath string) bool {
+	excluder := rn.getExcluder()
+	return excluder != nil && excluder.MatchesPath(pPath)
+}
+
+// getExcluder returns the current excluder, nil if nothing is excluded
+func (rn *RootNode) getExcluder() ignore.IgnoreParser {
+	rn.excluderLock.RLock()
+	defer rn.excluderLock.RUnlock()
+	return rn.excluder
+}
+
+// getExclusionPatters prepares a list of patterns to be excluded.
+// Patterns passed in the -exclude command line option are prefixed
+// with a leading '/' to preserve backwards compatibility (before
+// wildcard matching was implemented, exclusions always were matched
+// against the full path).
+//
+// The gitignore matcher lets the last matching pattern win, and a leading "!"
+// turns a pattern into an inclusion. So the inclusions are appended after the
+// exclusions.
+//
+// Also returns the inclusion patterns, see includeParents().
+func getExclusionPatterns(args Args) (patterns []string, includes []string, err error) {
+	patterns = make([]string, len(args.Exclude)+len(args.ExcludeWildcard))
+	// add -exclude
+	for i, p := range args.Exclude {
+		patterns[i] = "/" + p
+	}
+	// add -exclude-wildcard
+	copy(patterns[len(args.Exclude):], args.ExcludeWildcard)
+	// add -exclude-from
+	for _, file := range args.ExcludeFrom {
+		lines, err := getLines(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error reading exclusion patterns: %q", err)
+		}
+		patterns = append(patterns, lines...)
+	}
+	// add -include
+	for _, p := range args.Include {
+		includes = append(includes, "/"+p)
+	}
+	// add -include-from
+	for _, file := range args.IncludeFrom {
+		lines, err := getLines(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error reading inclusion patterns: %q", err)
+		}
+		for _, l := range lines {
+			if l != "" {
+				includes = append(includes, l)
+			}
+		}
+	}
+	for _, p := range includes {
+		patterns = append(patterns, "!"+p)
+	}
+	return patterns, includes, nil
+}
+
+// getFilterRules reads the -filter and -filter-from rules
+func getFilterRules(args Args) ([]filterRule, error) {
+	lines := append([]string{}, args.Filter...)
+	for _, file := range args.FilterFrom {
+		l, err := getLines(file)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading filter rules: %q", err)
+		}
+		lines = append(lines, l...)
+	}
+	rules, err := parseFilterRules(lines)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing filter rules: %v", err)
+	}
+	return rules, nil
+}
+
+// includeParents returns the set of directories that lead to the included
+// paths. They must stay visible even if they are excluded (usually by a
+// catch-all exclusion), or the included trees could not be reached.
+//
+// Only the literal leading components of anchored patterns (starting with
+// "/") can be determined: "/a/b/*.txt" yields "a" and "a/b".
+func includeParents(includes []string) map[string]bool {
+	parents := make(map[string]bool)
+	for _, inc := range includes {
+		if !strings.HasPrefix(inc, "/") {
+			continue
+		}
+		parts := strings.Split(strings.Trim(inc, "/"), "/")
+		// The last component is the included item itself, unless it is a
+		// wildcard
+		n := len(parts) - 1
+		for i, part := range parts {
+			if strings.ContainsAny(part, "*?[\\") {
+				n = i
+				break
+			}
+		}
+		for i := 1; i <= n; i++ {
+			parents[strings.Join(parts[:i], "/")] = true
+		}
+	}
+	return parents
+}
+
+// parentKeeper never excludes the directories in "parents"
+type parentKeeper struct {
+	ignore.IgnoreParser
+	parents map[string]bool
+}
+
+func (p *parentKeeper) MatchesPath(path string) bool {
+	if p.parents[path] {
+		return false
+	}
+	return p.IgnoreParser.MatchesPath(path)
+}
+
+// getLines reads a file and splits it into lines
+func getLines(file string) ([]string, error) {
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(buffer), "\n"), nil
+}
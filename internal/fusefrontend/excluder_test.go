@@ -0,0 +1,152 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+func TestShouldPrefixExcludeValuesWithSlash(t *testing.T) {
+	var args Args
+	args.Exclude = []string{"file1", "dir1/file2.txt"}
+	args.ExcludeWildcard = []string{"*~", "build/*.o"}
+
+	expected := []string{"/file1", "/dir1/file2.txt", "*~", "build/*.o"}
+
+	patterns, _, err := getExclusionPatterns(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("expected %q, got %q", expected, patterns)
+	}
+}
+
+func TestShouldReadExcludePatternsFromFiles(t *testing.T) {
+	tmpfile1, err := ioutil.TempFile("", "excludetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclude1 := tmpfile1.Name()
+	defer os.Remove(exclude1)
+	defer tmpfile1.Close()
+
+	tmpfile2, err := ioutil.TempFile("", "excludetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclude2 := tmpfile2.Name()
+	defer os.Remove(exclude2)
+	defer tmpfile2.Close()
+
+	tmpfile1.WriteString("file1.1\n")
+	tmpfile1.WriteString("file1.2\n")
+	tmpfile2.WriteString("file2.1\n")
+	tmpfile2.WriteString("file2.2\n")
+
+	var args Args
+	args.ExcludeWildcard = []string{"cmdline1"}
+	args.ExcludeFrom = []string{exclude1, exclude2}
+
+	// An empty string is returned for the last empty line
+	// It's ignored when the patterns are actually compiled
+	expected := []string{"cmdline1", "file1.1", "file1.2", "", "file2.1", "file2.2", ""}
+
+	patterns, _, err := getExclusionPatterns(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("expected %q, got %q", expected, patterns)
+	}
+}
+
+func TestInvalidFilterRule(t *testing.T) {
+	for _, r := range []string{"exclude foo", "* foo", "- [abc", "- /"} {
+		if _, err := parseFilterRules([]string{r}); err == nil {
+			t.Errorf("invalid rule %q was accepted", r)
+		}
+	}
+}
+
+func TestExcludeForward(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "excluder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	var out fuse.EntryOut
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	for _, name := range []string{"a", "secret.txt"} {
+		_, fh, _, errno := rn.Create(ctx, name, syscall.O_RDWR, 0600, &out)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		fh.(*File).Release(ctx)
+	}
+	if _, errno := rn.Mkdir(ctx, "d", 0700, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	args := Args{Cipherdir: cipherdir, Exclude: []string{"d"}, ExcludeWildcard: []string{"*.txt"}}
+	rn2 := newTestFS(args)
+	if _, errno := rn2.Lookup(ctx, "a", &out); errno != 0 {
+		t.Errorf("a: %v", errno)
+	}
+	for _, name := range []string{"secret.txt", "d", "missing.txt"} {
+		if _, errno := rn2.Lookup(ctx, name, &out); errno != syscall.EPERM {
+			t.Errorf("%s: want EPERM, got %v", name, errno)
+		}
+	}
+	if _, _, _, errno := rn2.Create(ctx, "new.txt", syscall.O_RDWR, 0600, &out); errno != syscall.EPERM {
+		t.Errorf("Create: want EPERM, got %v", errno)
+	}
+	if errno := rn2.Rename(ctx, "a", rn2, "a.txt", 0); errno != syscall.EPERM {
+		t.Errorf("Rename: want EPERM, got %v", errno)
+	}
+	ds, errno := rn2.Readdir(ctx)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	var names []string
+	for ds.HasNext() {
+		e, _ := ds.Next()
+		if e.Name != "." && e.Name != ".." {
+			names = append(names, e.Name)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"a"}) {
+		t.Errorf("Readdir: want [a], got %v", names)
+	}
+	tree, _, err := rn2.WalkTree("", 100)
+	if err != nil || len(tree) != 1 || tree[0].Plain != "a" {
+		t.Errorf("WalkTree: %v %v", tree, err)
+	}
+
+	// Reload without the rules makes everything visible again
+	args.Exclude = nil
+	args.ExcludeWildcard = nil
+	if err := rn2.Reload(args); err != nil {
+		t.Fatal(err)
+	}
+	if _, errno := rn2.Lookup(ctx, "secret.txt", &out); errno != 0 {
+		t.Errorf("secret.txt after Reload: %v", errno)
+	}
+}
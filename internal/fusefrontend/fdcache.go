@@ -0,0 +1,147 @@
+package fusefrontend
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/HorizonLiu/gocryptfs/ctlsock"
+	"github.com/HorizonLiu/gocryptfs/internal/inomap"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// fdCache keeps the backing files of released file handles open, so that
+// opening the same file again does not need an open(2) and close(2) on the
+// CIPHERDIR. Enabled via cli flag "-fd-cache".
+//
+// Entries are identified by inode and open flags. Open() stats the backing
+// file first, so a cached fd is only used if the path still points to the
+// same inode. Unlink() and Rename() evict the files they delete so that
+// their disk space is freed.
+type fdCache struct {
+	sync.Mutex
+	// Maximum number of entries
+	capacity int
+	// Least recently used entry at the back
+	lru *list.List
+	// Maps keys to elements of "lru"
+	entries map[fdCacheKey]*list.Element
+	// Statistics for the control socket
+	hits, misses, evictions uint64
+}
+
+type fdCacheKey struct {
+	qi    inomap.QIno
+	flags int
+}
+
+type fdCacheEntry struct {
+	key fdCacheKey
+	fd  *os.File
+}
+
+func newFdCache(capacity int) *fdCache {
+	return &fdCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[fdCacheKey]*list.Element),
+	}
+}
+
+// get takes the fd for "key" out of the cache. Returns nil on a miss.
+func (c *fdCache) get(key fdCacheKey) *os.File {
+	c.Lock()
+	defer c.Unlock()
+	el := c.entries[key]
+	if el == nil {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.Remove(el)
+	delete(c.entries, key)
+	return el.Value.(*fdCacheEntry).fd
+}
+
+// put stores "fd" in the cache. The cache takes ownership of the fd and
+// closes the least recently used entry if it is full.
+func (c *fdCache) put(key fdCacheKey, fd *os.File) {
+	c.Lock()
+	defer c.Unlock()
+	if el := c.entries[key]; el != nil {
+		// Two handles of the same file were open. Keep the newer fd.
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&fdCacheEntry{key: key, fd: fd})
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// remove closes the fd of "el" and deletes it. The caller must hold the lock.
+func (c *fdCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*fdCacheEntry)
+	delete(c.entries, e.key)
+	if err := e.fd.Close(); err != nil {
+		tlog.Warn.Printf("fdCache: Close failed: %v", err)
+	}
+}
+
+// evict closes all cached fds of the inode "qi"
+func (c *fdCache) evict(qi inomap.QIno) {
+	c.Lock()
+	defer c.Unlock()
+	var next *list.Element
+	for el := c.lru.Front(); el != nil; el = next {
+		next = el.Next()
+		if el.Value.(*fdCacheEntry).key.qi == qi {
+			c.remove(el)
+		}
+	}
+}
+
+// evictAt evicts the file "cName" in the directory "dirfd", if it exists
+func (c *fdCache) evictAt(dirfd int, cName string) {
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return
+	}
+	c.evict(inomap.QInoFromStat(st))
+}
+
+// clear closes all cached fds
+func (c *fdCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// resize changes the capacity and closes the entries that no longer fit
+func (c *fdCache) resize(capacity int) {
+	c.Lock()
+	defer c.Unlock()
+	c.capacity = capacity
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *fdCache) stats() *ctlsock.FDCacheStats {
+	c.Lock()
+	defer c.Unlock()
+	return &ctlsock.FDCacheStats{
+		Entries:   c.lru.Len(),
+		Capacity:  c.capacity,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
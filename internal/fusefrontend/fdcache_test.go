@@ -0,0 +1,80 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/inomap"
+)
+
+func TestFdCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fdcache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	open := func(name string) (*os.File, fdCacheKey) {
+		f, err := os.Create(dir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var st syscall.Stat_t
+		if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+			t.Fatal(err)
+		}
+		return f, fdCacheKey{qi: inomap.QInoFromStat(&st), flags: syscall.O_RDWR}
+	}
+	c := newFdCache(2)
+	a, ka := open("a")
+	b, kb := open("b")
+	c.put(ka, a)
+	c.put(kb, b)
+	if c.get(fdCacheKey{qi: ka.qi, flags: syscall.O_RDONLY}) != nil {
+		t.Error("hit with different flags")
+	}
+	if c.get(ka) != a {
+		t.Fatal("miss for a")
+	}
+	// Cache is LRU ordered: b is older than a now
+	c.put(ka, a)
+	cf, kc := open("c")
+	c.put(kc, cf)
+	if c.get(kb) != nil {
+		t.Error("b should have been evicted")
+	}
+	if _, err := b.Stat(); err == nil {
+		t.Error("evicted fd is still open")
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	c.evictAt(int(d.Fd()), "c")
+	if c.get(kc) != nil {
+		t.Error("c should have been evicted")
+	}
+	s := c.stats()
+	if s.Entries != 1 || s.Capacity != 2 || s.Hits != 1 || s.Misses != 3 || s.Evictions != 1 {
+		t.Errorf("wrong stats: %+v", s)
+	}
+	c.clear()
+	if _, err := a.Stat(); err == nil {
+		t.Error("clear did not close a")
+	}
+	// Shrinking closes the least recently used entries
+	a2, _ := open("a")
+	b2, _ := open("b")
+	c.put(ka, a2)
+	c.put(kb, b2)
+	c.resize(1)
+	if _, err := a2.Stat(); err == nil {
+		t.Error("resize did not close a")
+	}
+	if s := c.stats(); s.Entries != 1 || s.Capacity != 1 {
+		t.Errorf("wrong stats after resize: %+v", s)
+	}
+	c.clear()
+}
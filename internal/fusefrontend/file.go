@@ -11,6 +11,7 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
@@ -19,6 +20,7 @@ import (
 	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
 	"github.com/HorizonLiu/gocryptfs/internal/inomap"
 	"github.com/HorizonLiu/gocryptfs/internal/openfiletable"
+	"github.com/HorizonLiu/gocryptfs/internal/quota"
 	"github.com/HorizonLiu/gocryptfs/internal/serialize_reads"
 	"github.com/HorizonLiu/gocryptfs/internal/stupidgcm"
 	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
@@ -51,6 +53,24 @@ type File struct {
 	lastOpCount uint64
 	// Parent filesystem
 	rootNode *RootNode
+	// Prefetch state for sequential reads, nil if "-readahead" is off
+	readahead *readahead
+	// Appends not written to disk yet, see "-coalesce-writes". Protected by
+	// ContentLock.
+	appendBuf *appendBuffer
+	// Release() hands the fd to the fdCache under this key if "cacheable"
+	// is set
+	cacheKey  fdCacheKey
+	cacheable bool
+	// quota are the "-quota" trees the file belongs to
+	quota []*quota.Tree
+	// inode is the inode the kernel has opened, for invalidating its pages
+	// after another mount has changed the file. May be nil.
+	inode *fs.Inode
+	// sharedSeen and sharedOps are the state of the backing file at the last
+	// "-sharedstorage" poll, see sharedChanged()
+	sharedSeen sharedStat
+	sharedOps  uint64
 }
 
 // NewFile returns a new go-fuse File instance based on an already-open file
@@ -59,24 +79,35 @@ type File struct {
 //
 // `cName` is only used for error logging and may be left blank.
 func NewFile(fd int, cName string, rn *RootNode) (f *File, st *syscall.Stat_t, errno syscall.Errno) {
+	return newFile(os.NewFile(uintptr(fd), cName), rn, rn.contentEnc)
+}
+
+// newFile is like NewFile, but takes an *os.File, for example one from the
+// fdCache, and the content encryption helper "ce" of the directory that
+// contains the file.
+func newFile(osFile *os.File, rn *RootNode, ce *contentenc.ContentEnc) (f *File, st *syscall.Stat_t, errno syscall.Errno) {
 	// Need device number and inode number for openfiletable locking
 	st = &syscall.Stat_t{}
-	if err := syscall.Fstat(fd, st); err != nil {
+	if err := syscall.Fstat(int(osFile.Fd()), st); err != nil {
 		errno = fs.ToErrno(err)
 		return
 	}
 	qi := inomap.QInoFromStat(st)
-	e := openfiletable.Register(qi)
-
-	osFile := os.NewFile(uintptr(fd), cName)
+	e := rn.fileTable.Register(qi)
 
 	f = &File{
 		fd:             osFile,
-		contentEnc:     rn.contentEnc,
+		contentEnc:     ce,
 		qIno:           qi,
 		fileTableEntry: e,
 		rootNode:       rn,
 	}
+	if ra := atomic.LoadInt32(&rn.readahead); ra > 0 {
+		f.readahead = newReadahead(uint64(ra) * ce.PlainBS())
+	}
+	if rn.args.SharedStorage {
+		f.initShared()
+	}
 	return f, st, 0
 }
 
@@ -93,7 +124,11 @@ func (f *File) readFileID() ([]byte, error) {
 	// This makes File ID poisoning more difficult.
 	readLen := contentenc.HeaderLen + 1
 	buf := make([]byte, readLen)
-	n, err := f.fd.ReadAt(buf, 0)
+	var n int
+	err := f.rootNode.retry("readFileID", func() (err error) {
+		n, err = f.fd.ReadAt(buf, 0)
+		return err
+	})
 	if err != nil {
 		if err == io.EOF && n != 0 {
 			tlog.Warn.Printf("readFileID %d: incomplete file, got %d instead of %d bytes",
@@ -110,6 +145,16 @@ func (f *File) readFileID() ([]byte, error) {
 	return h.ID, nil
 }
 
+// invalidateSharedID drops the cached file ID in "-sharedstorage" mode.
+// Another machine may have truncated the file and written a new header, so
+// the header is read again for every operation.
+// The caller must hold IDLock or ContentLock.
+func (f *File) invalidateSharedID() {
+	if f.rootNode.args.SharedStorage {
+		f.fileTableEntry.ID = nil
+	}
+}
+
 // createHeader creates a new random header and writes it to disk.
 // Returns the new file ID.
 // The caller must hold fileIDLock.Lock().
@@ -127,7 +172,10 @@ func (f *File) createHeader() (fileID []byte, err error) {
 		}
 	}
 	// Actually write header
-	_, err = f.fd.WriteAt(buf, 0)
+	err = f.rootNode.retry("createHeader", func() error {
+		_, err := f.fd.WriteAt(buf, 0)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -147,6 +195,7 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 	// Get the file ID, either from the open file table, or from disk.
 	var fileID []byte
 	f.fileTableEntry.IDLock.Lock()
+	f.invalidateSharedID()
 	if f.fileTableEntry.ID != nil {
 		// Use the cached value in the file table
 		fileID = f.fileTableEntry.ID
@@ -164,8 +213,11 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 			n, _ := f.fd.ReadAt(buf, 0)
 			buf = buf[:n]
 			hexdump := hex.EncodeToString(buf)
-			tlog.Warn.Printf("doRead %d: corrupt header: %v\nFile hexdump (%d bytes): %s",
-				f.qIno.Ino, err, n, hexdump)
+			tlog.Warn.PrintfWith(tlog.Fields{"op": "READ", "ino": f.qIno.Ino, "errno": syscall.EIO},
+				"doRead %d: corrupt header: %v\nFile hexdump (%d bytes): %s", f.qIno.Ino, err, n, hexdump)
+			if vl := f.rootNode.args.VerifyLog; vl != nil {
+				vl.Header(f.rootNode.openFiles.Path(f), err)
+			}
 			return nil, syscall.EIO
 		}
 		// Save into the file table
@@ -179,30 +231,35 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 	blocks := f.contentEnc.ExplodePlainRange(off, length)
 	alignedOffset, alignedLength := blocks[0].JointCiphertextRange(blocks)
 	skip := blocks[0].Skip
-	tlog.Debug.Printf("doRead: off=%d len=%d -> off=%d len=%d skip=%d\n",
+	f.rootNode.log.Debug.Printf("doRead: off=%d len=%d -> off=%d len=%d skip=%d\n",
 		off, length, alignedOffset, alignedLength, skip)
 
-	ciphertext := f.rootNode.contentEnc.CReqPool.Get()
+	ciphertext := f.contentEnc.CReqPool.Get()
 	ciphertext = ciphertext[:int(alignedLength)]
-	n, err := f.fd.ReadAt(ciphertext, int64(alignedOffset))
+	var n int
+	err := f.rootNode.retry("doRead", func() (err error) {
+		n, err = f.fd.ReadAt(ciphertext, int64(alignedOffset))
+		return err
+	})
 	if err != nil && err != io.EOF {
 		tlog.Warn.Printf("read: ReadAt: %s", err.Error())
+		f.contentEnc.CReqPool.Put(ciphertext)
 		return nil, fs.ToErrno(err)
 	}
 	// The ReadAt came back empty. We can skip all the decryption and return early.
 	if n == 0 {
-		f.rootNode.contentEnc.CReqPool.Put(ciphertext)
+		f.contentEnc.CReqPool.Put(ciphertext)
 		return dst, 0
 	}
 	// Truncate ciphertext buffer down to actually read bytes
 	ciphertext = ciphertext[0:n]
 
 	firstBlockNo := blocks[0].BlockNo
-	tlog.Debug.Printf("ReadAt offset=%d bytes (%d blocks), want=%d, got=%d", alignedOffset, firstBlockNo, alignedLength, n)
+	f.rootNode.log.Debug.Printf("ReadAt offset=%d bytes (%d blocks), want=%d, got=%d", alignedOffset, firstBlockNo, alignedLength, n)
 
 	// Decrypt it
 	plaintext, err := f.contentEnc.DecryptBlocks(ciphertext, firstBlockNo, fileID)
-	f.rootNode.contentEnc.CReqPool.Put(ciphertext)
+	f.contentEnc.CReqPool.Put(ciphertext)
 	if err != nil {
 		if f.rootNode.args.ForceDecode && err == stupidgcm.ErrAuth {
 			// We do not have the information which block was corrupt here anymore,
@@ -211,7 +268,12 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 				f.qIno.Ino, off, length)
 		} else {
 			curruptBlockNo := firstBlockNo + f.contentEnc.PlainOffToBlockNo(uint64(len(plaintext)))
-			tlog.Warn.Printf("doRead %d: corrupt block #%d: %v", f.qIno.Ino, curruptBlockNo, err)
+			tlog.Warn.PrintfWith(tlog.Fields{"op": "READ", "ino": f.qIno.Ino, "errno": syscall.EIO},
+				"doRead %d: corrupt block #%d: %v", f.qIno.Ino, curruptBlockNo, err)
+			if vl := f.rootNode.args.VerifyLog; vl != nil {
+				vl.Block(f.rootNode.openFiles.Path(f), curruptBlockNo, err)
+			}
+			f.contentEnc.PReqPool.Put(plaintext)
 			return nil, syscall.EIO
 		}
 	}
@@ -228,7 +290,7 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 	// else: out stays empty, file was smaller than the requested offset
 
 	out = append(dst, out...)
-	f.rootNode.contentEnc.PReqPool.Put(plaintext)
+	f.contentEnc.PReqPool.Put(plaintext)
 
 	return out, 0
 }
@@ -240,13 +302,29 @@ func (f *File) Read(ctx context.Context, buf []byte, off int64) (resultData fuse
 		tlog.Warn.Printf("Read: rejecting oversized request with EMSGSIZE, len=%d", len(buf))
 		return nil, syscall.EMSGSIZE
 	}
+	if f.readahead != nil {
+		// The prefetch takes the locks below, wait for it first
+		f.readahead.wait()
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
+	if f.rootNode.args.CoalesceWrites {
+		if errno := syncPending(f.fileTableEntry); errno != 0 {
+			return nil, errno
+		}
+	}
 
 	f.fileTableEntry.ContentLock.RLock()
 	defer f.fileTableEntry.ContentLock.RUnlock()
 
-	tlog.Debug.Printf("ino%d: FUSE Read: offset=%d length=%d", f.qIno.Ino, off, len(buf))
+	f.rootNode.log.Debug.Printf("ino%d: FUSE Read: offset=%d length=%d", f.qIno.Ino, off, len(buf))
+	if f.readahead != nil {
+		if out, ok := f.readFromBuffer(buf[:0], uint64(off), uint64(len(buf))); ok {
+			f.rootNode.log.Debug.Printf("ino%d: Read: returning %d prefetched bytes", f.qIno.Ino, len(out))
+			f.startReadahead(uint64(off), uint64(len(out)))
+			return fuse.ReadResultData(out), 0
+		}
+	}
 	if f.rootNode.args.SerializeReads {
 		serialize_reads.Wait(off, len(buf))
 	}
@@ -257,7 +335,10 @@ func (f *File) Read(ctx context.Context, buf []byte, off int64) (resultData fuse
 	if errno != 0 {
 		return nil, errno
 	}
-	tlog.Debug.Printf("ino%d: Read: errno=%d, returning %d bytes", f.qIno.Ino, errno, len(out))
+	f.rootNode.log.Debug.Printf("ino%d: Read: errno=%d, returning %d bytes", f.qIno.Ino, errno, len(out))
+	if f.readahead != nil {
+		f.startReadahead(uint64(off), uint64(len(out)))
+	}
 	return fuse.ReadResultData(out), errno
 }
 
@@ -276,6 +357,7 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 	var fileID []byte
 	// The caller has exclusively locked ContentLock, which blocks all other
 	// readers and writers. No need to take IDLock.
+	f.invalidateSharedID()
 	if f.fileTableEntry.ID != nil {
 		fileID = f.fileTableEntry.ID
 	} else {
@@ -296,21 +378,36 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 	dataBuf := bytes.NewBuffer(data)
 	blocks := f.contentEnc.ExplodePlainRange(uint64(off), uint64(len(data)))
 	toEncrypt := make([][]byte, len(blocks))
+	// At most the first and the last block are partial
+	var rmwBufs [2][]byte
+	defer func() {
+		for _, buf := range rmwBufs {
+			if buf != nil {
+				f.contentEnc.PBlockPool.Put(buf)
+			}
+		}
+	}()
 	for i, b := range blocks {
 		blockData := dataBuf.Next(int(b.Length))
 		// Incomplete block -> Read-Modify-Write
 		if b.IsPartial() {
-			// Read
-			oldData, errno := f.doRead(nil, b.BlockPlainOff(), f.contentEnc.PlainBS())
+			// Read into a pooled block, MergeBlocks() then works in place
+			buf := f.contentEnc.PBlockPool.Get()
+			if rmwBufs[0] == nil {
+				rmwBufs[0] = buf
+			} else {
+				rmwBufs[1] = buf
+			}
+			oldData, errno := f.doRead(buf[:0], b.BlockPlainOff(), f.contentEnc.PlainBS())
 			if errno != 0 {
 				tlog.Warn.Printf("ino%d fh%d: RMW read failed: errno=%d", f.qIno.Ino, f.intFd(), errno)
 				return 0, errno
 			}
 			// Modify
 			blockData = f.contentEnc.MergeBlocks(oldData, blockData, int(b.Skip))
-			tlog.Debug.Printf("len(oldData)=%d len(blockData)=%d", len(oldData), len(blockData))
+			f.rootNode.log.Debug.Printf("len(oldData)=%d len(blockData)=%d", len(oldData), len(blockData))
 		}
-		tlog.Debug.Printf("ino%d: Writing %d bytes to block #%d",
+		f.rootNode.log.Debug.Printf("ino%d: Writing %d bytes to block #%d",
 			f.qIno.Ino, len(blockData), b.BlockNo)
 		// Write into the to-encrypt list
 		toEncrypt[i] = blockData
@@ -339,12 +436,15 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 		}
 	}
 	// Write
-	_, err = f.fd.WriteAt(ciphertext, cOff)
+	err = f.rootNode.retry("doWrite", func() error {
+		_, err := f.fd.WriteAt(ciphertext, cOff)
+		return err
+	})
 	// Return memory to CReqPool
-	f.rootNode.contentEnc.CReqPool.Put(ciphertext)
+	f.contentEnc.CReqPool.Put(ciphertext)
 	if err != nil {
-		tlog.Warn.Printf("ino%d fh%d: doWrite: WriteAt off=%d len=%d failed: %v",
-			f.qIno.Ino, f.intFd(), cOff, len(ciphertext), err)
+		tlog.Warn.PrintfWith(tlog.Fields{"op": "WRITE", "ino": f.qIno.Ino, "errno": fs.ToErrno(err)},
+			"ino%d fh%d: doWrite: WriteAt off=%d len=%d failed: %v", f.qIno.Ino, f.intFd(), cOff, len(ciphertext), err)
 		return 0, fs.ToErrno(err)
 	}
 	return uint32(len(data)), 0
@@ -356,14 +456,14 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 // Stat() call is very expensive.
 // The caller must "wlock.lock(f.devIno.ino)" otherwise this check would be racy.
 func (f *File) isConsecutiveWrite(off int64) bool {
-	opCount := openfiletable.WriteOpCount()
+	opCount := f.rootNode.fileTable.WriteOpCount()
 	return opCount == f.lastOpCount+1 && off == f.lastWrittenOffset+1
 }
 
 // Write - FUSE call
 //
 // If the write creates a hole, pads the file to the next block boundary.
-func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+func (f *File) Write(ctx context.Context, data []byte, off int64) (n uint32, errno syscall.Errno) {
 	if len(data) > fuse.MAX_KERNEL_WRITE {
 		// This would crash us due to our fixed-size buffer pool
 		tlog.Warn.Printf("Write: rejecting oversized request with EMSGSIZE, len=%d", len(data))
@@ -378,7 +478,22 @@ func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, sysca
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
-	tlog.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
+	f.rootNode.log.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
+	// "-quota"
+	delta, errno := f.quotaResize(uint64(off)+uint64(len(data)), false)
+	if errno != 0 {
+		return 0, errno
+	}
+	defer func() {
+		if errno != 0 {
+			f.rootNode.uncharge(f.quota, delta)
+		}
+	}()
+	if f.rootNode.args.CoalesceWrites {
+		if n, ok, errno := f.coalesceWrite(data, off); ok {
+			return n, errno
+		}
+	}
 	// If the write creates a file hole, we have to zero-pad the last block.
 	// But if the write directly follows an earlier write, it cannot create a
 	// hole, and we can save one Stat() call.
@@ -388,9 +503,9 @@ func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, sysca
 			return 0, errno
 		}
 	}
-	n, errno := f.doWrite(data, off)
+	n, errno = f.doWrite(data, off)
 	if errno != 0 {
-		f.lastOpCount = openfiletable.WriteOpCount()
+		f.lastOpCount = f.rootNode.fileTable.WriteOpCount()
 		f.lastWrittenOffset = off + int64(len(data)) - 1
 	}
 	return n, errno
@@ -398,12 +513,37 @@ func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, sysca
 
 // Release - FUSE call, close file
 func (f *File) Release(ctx context.Context) syscall.Errno {
+	// Writing out buffered appends needs the keys. Release is not gated by
+	// LockGate(), and if the filesystem is locked, Lock() has written them
+	// out already.
+	if f.rootNode.args.CoalesceWrites && f.rootNode.rlockKeys() {
+		defer f.rootNode.keyLock.RUnlock()
+	}
 	f.fdLock.Lock()
 	if f.released {
 		log.Panicf("ino%d fh%d: double release", f.qIno.Ino, f.intFd())
 	}
 	f.released = true
-	openfiletable.Unregister(f.qIno)
+	if f.readahead != nil {
+		f.readahead.release()
+	}
+	if f.appendBuf != nil {
+		// Errors have been reported by Flush() already, if the
+		// application cared to close() the file
+		f.fileTableEntry.ContentLock.Lock()
+		if f.appendBuf != nil {
+			f.FlushPending()
+		}
+		f.fileTableEntry.ContentLock.Unlock()
+	}
+	f.rootNode.fileTable.Unregister(f.qIno)
+	f.rootNode.openFiles.Unregister(f)
+	f.rootNode.idleClosed(f)
+	if f.cacheable {
+		f.rootNode.fdCache.put(f.cacheKey, f.fd)
+		f.fdLock.Unlock()
+		return 0
+	}
 	err := f.fd.Close()
 	f.fdLock.Unlock()
 	return fs.ToErrno(err)
@@ -411,9 +551,18 @@ func (f *File) Release(ctx context.Context) syscall.Errno {
 
 // Flush - FUSE call
 func (f *File) Flush(ctx context.Context) syscall.Errno {
+	// Not gated by LockGate(), see Release()
+	if f.rootNode.args.CoalesceWrites && f.rootNode.rlockKeys() {
+		defer f.rootNode.keyLock.RUnlock()
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
+	if f.rootNode.args.CoalesceWrites {
+		if errno := syncPending(f.fileTableEntry); errno != 0 {
+			return errno
+		}
+	}
 	err := syscallcompat.Flush(f.intFd())
 	return fs.ToErrno(err)
 }
@@ -423,7 +572,19 @@ func (f *File) Fsync(ctx context.Context, flags uint32) (errno syscall.Errno) {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
-	return fs.ToErrno(syscall.Fsync(f.intFd()))
+	if f.rootNode.args.CoalesceWrites {
+		if errno := syncPending(f.fileTableEntry); errno != 0 {
+			return errno
+		}
+	}
+	err := f.rootNode.retry("Fsync", func() error {
+		return syscall.Fsync(f.intFd())
+	})
+	if err != nil && f.rootNode.args.NetworkStorage && isFsyncUnsupported(err) {
+		f.rootNode.log.Debug.Printf("Fsync: ignoring %v", err)
+		return 0
+	}
+	return fs.ToErrno(err)
 }
 
 // Getattr FUSE call (like stat)
@@ -431,7 +592,12 @@ func (f *File) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
-	tlog.Debug.Printf("file.GetAttr()")
+	f.rootNode.log.Debug.Printf("file.GetAttr()")
+	if f.rootNode.args.CoalesceWrites {
+		if errno := syncPending(f.fileTableEntry); errno != 0 {
+			return errno
+		}
+	}
 	st := syscall.Stat_t{}
 	err := syscall.Fstat(f.intFd(), &st)
 	if err != nil {
@@ -440,9 +606,7 @@ func (f *File) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno {
 	f.rootNode.inoMap.TranslateStat(&st)
 	a.FromStat(&st)
 	a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
-	if f.rootNode.args.ForceOwner != nil {
-		a.Owner = *f.rootNode.args.ForceOwner
-	}
+	f.rootNode.presentAttr(&a.Attr)
 
 	return 0
 }
@@ -37,10 +37,10 @@ var allocateWarnOnce sync.Once
 // complicated and hard to get right.
 //
 // Other modes (hole punching, zeroing) are not supported.
-func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
+func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) (errno syscall.Errno) {
 	if mode != FALLOC_DEFAULT && mode != FALLOC_FL_KEEP_SIZE {
 		f := func() {
-			tlog.Info.Printf("fallocate: only mode 0 (default) and 1 (keep size) are supported")
+			f.rootNode.log.Info.Printf("fallocate: only mode 0 (default) and 1 (keep size) are supported")
 		}
 		allocateWarnOnce.Do(f)
 		return syscall.EOPNOTSUPP
@@ -53,6 +53,22 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	if errno := flushPending(f.fileTableEntry); errno != 0 {
+		return errno
+	}
+	// "-quota". FALLOC_FL_KEEP_SIZE does not change the size.
+	if mode == FALLOC_DEFAULT {
+		var delta int64
+		delta, errno = f.quotaResize(off+sz, false)
+		if errno != 0 {
+			return errno
+		}
+		defer func() {
+			if errno != 0 {
+				f.rootNode.uncharge(f.quota, delta)
+			}
+		}()
+	}
 
 	blocks := f.contentEnc.ExplodePlainRange(off, sz)
 	firstBlock := blocks[0]
@@ -65,7 +81,7 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 	cipherSz := lastBlock.BlockCipherOff() - cipherOff +
 		f.contentEnc.BlockOverhead() + lastBlock.Skip + lastBlock.Length
 	err := syscallcompat.Fallocate(f.intFd(), FALLOC_FL_KEEP_SIZE, int64(cipherOff), int64(cipherSz))
-	tlog.Debug.Printf("Allocate off=%d sz=%d mode=%x cipherOff=%d cipherSz=%d\n",
+	f.rootNode.log.Debug.Printf("Allocate off=%d sz=%d mode=%x cipherOff=%d cipherSz=%d\n",
 		off, sz, mode, cipherOff, cipherSz)
 	if err != nil {
 		return fs.ToErrno(err)
@@ -94,6 +110,16 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 
 // truncate - called from Setattr.
 func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
+	// "-quota"
+	delta, errno := f.quotaResize(newSize, true)
+	if errno != 0 {
+		return errno
+	}
+	defer func() {
+		if errno != 0 {
+			f.rootNode.uncharge(f.quota, delta)
+		}
+	}()
 	var err error
 	// Common case first: Truncate to zero
 	if newSize == 0 {
@@ -115,7 +141,7 @@ func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
 
 	oldB := float32(oldSize) / float32(f.contentEnc.PlainBS())
 	newB := float32(newSize) / float32(f.contentEnc.PlainBS())
-	tlog.Debug.Printf("ino%d: FUSE Truncate from %.2f to %.2f blocks (%d to %d bytes)", f.qIno.Ino, oldB, newB, oldSize, newSize)
+	f.rootNode.log.Debug.Printf("ino%d: FUSE Truncate from %.2f to %.2f blocks (%d to %d bytes)", f.qIno.Ino, oldB, newB, oldSize, newSize)
 
 	// File size stays the same - nothing to do
 	if newSize == oldSize {
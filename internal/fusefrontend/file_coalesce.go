@@ -0,0 +1,195 @@
+package fusefrontend
+
+// Write coalescing for small appends, enabled via cli flag "-coalesce-writes"
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/HorizonLiu/gocryptfs/internal/openfiletable"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// coalesceDelay is the time after which buffered appends are written out
+// even if nobody asks for them
+const coalesceDelay = time.Second
+
+// appendBuffer holds the last, partial block of a file whose appends have
+// not been written to disk yet.
+type appendBuffer struct {
+	// Plaintext offset of "data", always block-aligned
+	off uint64
+	// Content of the block. Slice from PBlockPool, shorter than a block.
+	data []byte
+	// Writes the buffer out after coalesceDelay
+	timer *time.Timer
+}
+
+// coalesceWrite buffers writes that append less than a block to the file.
+// Returns ok=false if "data" has to go through the normal write path. In
+// that case, buffered appends on this inode have been written out.
+//
+// The caller must hold ContentLock exclusively.
+func (f *File) coalesceWrite(data []byte, off int64) (n uint32, ok bool, errno syscall.Errno) {
+	bs := f.contentEnc.PlainBS()
+	e := f.fileTableEntry
+	b := f.appendBuf
+	if b == nil || e.Pending != f || uint64(off) != b.off+uint64(len(b.data)) || uint64(len(data)) >= bs {
+		if errno = flushPending(e); errno != 0 {
+			return 0, true, errno
+		}
+		if uint64(len(data)) >= bs {
+			return 0, false, 0
+		}
+		// Freeze() has written out all buffers, and a new one would be
+		// missing from the snapshot. Writes only get here while frozen if
+		// they do not go through FreezeGate().
+		if f.rootNode.isFrozen() {
+			return 0, false, 0
+		}
+		plainSize, err := f.statPlainSize()
+		if err != nil {
+			return 0, true, fs.ToErrno(err)
+		}
+		if uint64(off) != plainSize {
+			// Not an append
+			return 0, false, 0
+		}
+		// Start with the current content of the last block
+		blockOff := plainSize - plainSize%bs
+		buf := f.contentEnc.PBlockPool.Get()
+		head, errno := f.doRead(buf[:0], blockOff, plainSize-blockOff)
+		if errno != 0 {
+			f.contentEnc.PBlockPool.Put(buf)
+			return 0, true, errno
+		}
+		// doRead returns nil for an empty file, otherwise "head" lives in "buf"
+		b = &appendBuffer{off: blockOff, data: buf[:len(head)]}
+		b.timer = time.AfterFunc(coalesceDelay, f.flushTimer)
+		f.appendBuf = b
+		e.Pending = f
+	}
+	room := int(bs) - len(b.data)
+	if len(data) < room {
+		b.data = append(b.data, data...)
+		return uint32(len(data)), true, 0
+	}
+	// The block is complete, write it out and keep the rest
+	b.data = append(b.data, data[:room]...)
+	if _, errno = f.doWrite(b.data, int64(b.off)); errno != 0 {
+		f.dropAppendBuffer()
+		return 0, true, errno
+	}
+	b.off += bs
+	b.data = append(b.data[:0], data[room:]...)
+	return uint32(len(data)), true, 0
+}
+
+// FlushPending writes the buffered appends of this file handle to disk.
+// Implements openfiletable.PendingWriter.
+//
+// The caller must hold ContentLock exclusively, and keyLock via rlockKeys()
+// or Lock(). Returns EACCES if the keys have been wiped.
+func (f *File) FlushPending() syscall.Errno {
+	b := f.appendBuf
+	// dropAppendBuffer() wipes the data, write it first
+	defer f.dropAppendBuffer()
+	if len(b.data) == 0 {
+		return 0
+	}
+	if f.rootNode.locked {
+		tlog.Warn.Printf("ino%d fh%d: filesystem is locked, dropping %d bytes of buffered appends",
+			f.qIno.Ino, f.intFd(), len(b.data))
+		return syscall.EACCES
+	}
+	_, errno := f.doWrite(b.data, int64(b.off))
+	if errno != 0 {
+		tlog.Warn.Printf("ino%d fh%d: writing buffered appends at off=%d len=%d failed: %v",
+			f.qIno.Ino, f.intFd(), b.off, len(b.data), errno)
+	}
+	return errno
+}
+
+// dropAppendBuffer discards the append buffer. The caller must hold
+// ContentLock exclusively.
+func (f *File) dropAppendBuffer() {
+	b := f.appendBuf
+	b.timer.Stop()
+	f.contentEnc.PBlockPool.Put(b.data)
+	f.appendBuf = nil
+	f.fileTableEntry.Pending = nil
+}
+
+// flushTimer writes out buffered appends that have been sitting around for
+// coalesceDelay. It takes the locks in the same order as a FUSE write going
+// through LockGate() and FreezeGate().
+func (f *File) flushTimer() {
+	rn := f.rootNode
+	if !rn.rlockKeys() {
+		// Lock() has written out all buffers before wiping the keys
+		return
+	}
+	defer rn.keyLock.RUnlock()
+	if !rn.enterWrite() {
+		// SetReadOnly() has written out all buffers
+		return
+	}
+	defer rn.leaveWrite()
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return
+	}
+	e := f.fileTableEntry
+	e.ContentLock.Lock()
+	defer e.ContentLock.Unlock()
+	if e.Pending == f {
+		f.FlushPending()
+	}
+}
+
+// flushPending writes out data buffered by any file handle of the inode.
+// The caller must hold ContentLock exclusively.
+func flushPending(e *openfiletable.Entry) syscall.Errno {
+	if e.Pending == nil {
+		return 0
+	}
+	return e.Pending.FlushPending()
+}
+
+// syncPending is like flushPending, but takes ContentLock itself. Called
+// before operations that look at the file content or size.
+func syncPending(e *openfiletable.Entry) syscall.Errno {
+	e.ContentLock.RLock()
+	p := e.Pending
+	e.ContentLock.RUnlock()
+	if p == nil {
+		return 0
+	}
+	e.ContentLock.Lock()
+	defer e.ContentLock.Unlock()
+	return flushPending(e)
+}
+
+// flushAllPendingIfCoalescing calls flushAllPending() if "-coalesce-writes"
+// is on
+func (rn *RootNode) flushAllPendingIfCoalescing() syscall.Errno {
+	if !rn.args.CoalesceWrites {
+		return 0
+	}
+	return rn.flushAllPending()
+}
+
+// flushAllPending writes out the buffered appends of all open files. The
+// caller must make sure the keys stay in memory.
+func (rn *RootNode) flushAllPending() syscall.Errno {
+	var errno syscall.Errno
+	for _, e := range rn.fileTable.Entries() {
+		if err := syncPending(e); err != 0 {
+			errno = err
+		}
+	}
+	return errno
+}
@@ -0,0 +1,91 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestCoalesceWrites(t *testing.T) {
+	rn := newTestFS(Args{CoalesceWrites: true})
+	f, cleanup := newTestFile(t, rn)
+	defer cleanup()
+	size := func() uint64 {
+		sz, err := f.statPlainSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sz
+	}
+	// 100-byte appends, 50 of them cross one block boundary
+	var want []byte
+	for i := 0; i < 50; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 100)
+		if _, errno := f.Write(nil, data, int64(len(want))); errno != 0 {
+			t.Fatal(errno)
+		}
+		want = append(want, data...)
+	}
+	if f.appendBuf == nil {
+		t.Fatal("appends were not buffered")
+	}
+	// Only the full blocks are on disk
+	if sz := size(); sz != 4096 {
+		t.Errorf("want 4096 bytes on disk, have %d", sz)
+	}
+	// Reading writes out the rest
+	res, errno := f.Read(nil, make([]byte, 10000), 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	have, _ := res.Bytes(nil)
+	if !bytes.Equal(have, want) {
+		t.Error("content mismatch")
+	}
+	if f.appendBuf != nil || size() != uint64(len(want)) {
+		t.Error("Read did not write out the buffer")
+	}
+	// Buffered appends also show up after the timer
+	if _, errno := f.Write(nil, []byte("xyz"), int64(len(want))); errno != 0 {
+		t.Fatal(errno)
+	}
+	if size() != uint64(len(want)) {
+		t.Error("append was not buffered")
+	}
+	time.Sleep(coalesceDelay + 500*time.Millisecond)
+	if size() != uint64(len(want)+3) {
+		t.Error("timer did not write out the buffer")
+	}
+	// Non-append writes go straight to disk
+	if _, errno := f.Write(nil, []byte("abc"), 10); errno != 0 {
+		t.Fatal(errno)
+	}
+	if f.appendBuf != nil {
+		t.Error("overwrite was buffered")
+	}
+	if errno := f.Fsync(nil, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+}
+
+// The flush timer waits for the freeze gate like a FUSE write does
+func TestCoalesceTimerGate(t *testing.T) {
+	rn := newTestFS(Args{CoalesceWrites: true})
+	f, cleanup := newTestFile(t, rn)
+	defer cleanup()
+	if _, errno := f.Write(nil, []byte("abc"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	// Block modifications without writing out the buffer, like a freeze
+	// that started after the append would
+	rn.freeze.writeLock.Lock()
+	time.Sleep(coalesceDelay + 500*time.Millisecond)
+	if sz, _ := f.statPlainSize(); sz != 0 {
+		t.Errorf("timer wrote %d bytes while blocked", sz)
+	}
+	rn.freeze.writeLock.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	if sz, _ := f.statPlainSize(); sz != 3 {
+		t.Errorf("want 3 bytes after unblocking, have %d", sz)
+	}
+}
@@ -52,7 +52,7 @@ func (f *File) zeroPad(plainSize uint64) syscall.Errno {
 	}
 	missing := f.contentEnc.PlainBS() - lastBlockLen
 	pad := make([]byte, missing)
-	tlog.Debug.Printf("zeroPad: Writing %d bytes\n", missing)
+	f.rootNode.log.Debug.Printf("zeroPad: Writing %d bytes\n", missing)
 	_, errno := f.doWrite(pad, int64(plainSize))
 	return errno
 }
@@ -81,6 +81,11 @@ func (f *File) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, sy
 		return MinusOne, syscall.ENOSYS
 	}
 
+	if f.rootNode.args.CoalesceWrites {
+		if errno := syncPending(f.fileTableEntry); errno != 0 {
+			return MinusOne, errno
+		}
+	}
 	// We will need the file size
 	var st syscall.Stat_t
 	err := syscall.Fstat(f.intFd(), &st)
@@ -95,12 +100,12 @@ func (f *File) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, sy
 	}
 
 	// man lseek: offset beyond end of file -> ENXIO
-	if f.rootNode.contentEnc.PlainOffToCipherOff(off) >= uint64(fileSize) {
+	if f.contentEnc.PlainOffToCipherOff(off) >= uint64(fileSize) {
 		return MinusOne, syscall.ENXIO
 	}
 
 	// Round down to start of block:
-	cipherOff := f.rootNode.contentEnc.BlockNoToCipherOff(f.rootNode.contentEnc.PlainOffToBlockNo(off))
+	cipherOff := f.contentEnc.BlockNoToCipherOff(f.contentEnc.PlainOffToBlockNo(off))
 	newCipherOff, err := syscall.Seek(f.intFd(), int64(cipherOff), int(whence))
 	if err != nil {
 		return MinusOne, fs.ToErrno(err)
@@ -117,12 +122,12 @@ func (f *File) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, sy
 			return MinusOne, fs.ToErrno(err)
 		}
 		if newCipherOff == fi.Size() {
-			return f.rootNode.contentEnc.CipherSizeToPlainSize(uint64(newCipherOff)), 0
+			return f.contentEnc.CipherSizeToPlainSize(uint64(newCipherOff)), 0
 		}
 	}
 	// syscall.Seek gave us the beginning of the next ext4 data/hole section.
 	// The next gocryptfs data/hole block starts at the next block boundary,
 	// so we have to round up:
-	newBlockNo := f.rootNode.contentEnc.CipherOffToBlockNo(uint64(newCipherOff) + f.rootNode.contentEnc.CipherBS() - 1)
-	return f.rootNode.contentEnc.BlockNoToPlainOff(newBlockNo), 0
+	newBlockNo := f.contentEnc.CipherOffToBlockNo(uint64(newCipherOff) + f.contentEnc.CipherBS() - 1)
+	return f.contentEnc.BlockNoToPlainOff(newBlockNo), 0
 }
@@ -0,0 +1,245 @@
+package fusefrontend
+
+// FUSE operations on files below a "passthrough" directory policy. Their
+// contents are stored in plaintext, so all calls go straight to the
+// backing file.
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/quota"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+)
+
+var _ = (fs.FileGetattrer)((*passthroughFile)(nil))
+var _ = (fs.FileSetattrer)((*passthroughFile)(nil))
+var _ = (fs.FileReleaser)((*passthroughFile)(nil))
+var _ = (fs.FileReader)((*passthroughFile)(nil))
+var _ = (fs.FileWriter)((*passthroughFile)(nil))
+var _ = (fs.FileFsyncer)((*passthroughFile)(nil))
+var _ = (fs.FileFlusher)((*passthroughFile)(nil))
+var _ = (fs.FileAllocater)((*passthroughFile)(nil))
+var _ = (fs.FileLseeker)((*passthroughFile)(nil))
+
+// passthroughFile is an open file below a "passthrough" directory policy
+type passthroughFile struct {
+	fd *os.File
+	// fdLock and released work like in File
+	fdLock   sync.RWMutex
+	released bool
+	rootNode *RootNode
+	// quota works like in File
+	quota []*quota.Tree
+}
+
+// newPassthroughFile wraps the open backing file "fd" and returns its
+// attributes like NewFile()
+func newPassthroughFile(fd int, cName string, rn *RootNode) (*passthroughFile, *syscall.Stat_t, syscall.Errno) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, nil, fs.ToErrno(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		syscall.Close(fd)
+		return nil, nil, syscall.EINVAL
+	}
+	f := &passthroughFile{
+		fd:       os.NewFile(uintptr(fd), cName),
+		rootNode: rn,
+	}
+	return f, &st, 0
+}
+
+func (f *passthroughFile) intFd() int {
+	return int(f.fd.Fd())
+}
+
+// Read - FUSE call
+func (f *passthroughFile) Read(ctx context.Context, buf []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return nil, syscall.EBADF
+	}
+	n, err := syscall.Pread(f.intFd(), buf, off)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return fuse.ReadResultData(buf[:n]), 0
+}
+
+// Write - FUSE call
+func (f *passthroughFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return 0, syscall.EBADF
+	}
+	var n int
+	errno := f.quotaDo(uint64(off)+uint64(len(data)), false, func() (err error) {
+		n, err = syscall.Pwrite(f.intFd(), data, off)
+		return err
+	})
+	return uint32(n), errno
+}
+
+// Release - FUSE call, close file
+func (f *passthroughFile) Release(ctx context.Context) syscall.Errno {
+	f.fdLock.Lock()
+	defer f.fdLock.Unlock()
+	if f.released {
+		return syscall.EBADF
+	}
+	f.released = true
+	f.rootNode.openFiles.Unregister(f)
+	f.rootNode.idleClosed(f)
+	return fs.ToErrno(f.fd.Close())
+}
+
+// Flush - FUSE call
+func (f *passthroughFile) Flush(ctx context.Context) syscall.Errno {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return syscall.EBADF
+	}
+	return fs.ToErrno(syscallcompat.Flush(f.intFd()))
+}
+
+// Fsync - FUSE call
+func (f *passthroughFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return syscall.EBADF
+	}
+	return fs.ToErrno(syscall.Fsync(f.intFd()))
+}
+
+// Getattr - FUSE call (like stat)
+func (f *passthroughFile) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.intFd(), &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	f.rootNode.inoMap.TranslateStat(&st)
+	a.FromStat(&st)
+	f.rootNode.presentAttr(&a.Attr)
+	return 0
+}
+
+// Setattr - FUSE call. Called for chmod, truncate, utimens, ...
+func (f *passthroughFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if errno := f.setAttr(in); errno != 0 {
+		return errno
+	}
+	return f.Getattr(ctx, out)
+}
+
+func (f *passthroughFile) setAttr(in *fuse.SetAttrIn) syscall.Errno {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return syscall.EBADF
+	}
+	if mode, ok := in.GetMode(); ok {
+		if err := syscall.Fchmod(f.intFd(), mode); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	if uid, gid := f.rootNode.hostOwner(in); uid != -1 || gid != -1 {
+		if err := syscall.Fchown(f.intFd(), uid, gid); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	mtime, mok := in.GetMTime()
+	atime, aok := in.GetATime()
+	if mok || aok {
+		ap := &atime
+		mp := &mtime
+		if !aok {
+			ap = nil
+		}
+		if !mok {
+			mp = nil
+		}
+		if err := syscallcompat.FutimesNano(f.intFd(), ap, mp); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	if sz, ok := in.GetSize(); ok {
+		errno := f.quotaDo(sz, true, func() error {
+			return syscall.Ftruncate(f.intFd(), int64(sz))
+		})
+		if errno != 0 {
+			return errno
+		}
+	}
+	return 0
+}
+
+// Allocate - FUSE call for fallocate(2)
+func (f *passthroughFile) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return syscall.EBADF
+	}
+	newSize := off + sz
+	if mode&FALLOC_FL_KEEP_SIZE != 0 {
+		// Only allocates disk space
+		newSize = 0
+	}
+	return f.quotaDo(newSize, false, func() error {
+		return syscallcompat.Fallocate(f.intFd(), mode, int64(off), int64(sz))
+	})
+}
+
+// Lseek - FUSE call for SEEK_DATA and SEEK_HOLE
+func (f *passthroughFile) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return 0, syscall.EBADF
+	}
+	n, err := unix.Seek(f.intFd(), int64(off), int(whence))
+	return uint64(n), fs.ToErrno(err)
+}
+
+// passthroughOpenFlags is mangleOpenFlags() for passthrough files. No
+// read-modify-write cycles are needed, so the flags stay mostly unchanged.
+func passthroughOpenFlags(flags uint32) int {
+	newFlags := int(flags) &^ (syscall.O_CREAT | syscall.O_APPEND)
+	return newFlags | syscall.O_NOFOLLOW
+}
+
+// openPassthrough is Open() for files below a "passthrough" directory policy
+func (n *Node) openPassthrough(dirfd int, cName string, flags uint32) (fs.FileHandle, syscall.Errno) {
+	rn := n.rootNode()
+	var fd int
+	err := rn.retry("Open", func() (err error) {
+		fd, err = syscallcompat.Openat(dirfd, cName, passthroughOpenFlags(flags), 0)
+		return err
+	})
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	f, _, errno := newPassthroughFile(fd, cName, rn)
+	if errno != 0 {
+		return nil, errno
+	}
+	f.quota = n.quotaTrees()
+	rn.openFiles.Register(f, n.Path)
+	return f, 0
+}
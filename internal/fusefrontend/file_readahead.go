@@ -0,0 +1,191 @@
+package fusefrontend
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// readahead prefetches and decrypts the data following a sequential read in
+// the background, enabled via cli flag "-readahead".
+type readahead struct {
+	// Size of the prefetch window in bytes
+	size uint64
+	// mu protects all fields below
+	mu sync.Mutex
+	// Where the next read starts if the access is sequential
+	nextOff uint64
+	// Prefetched plaintext starting at bufOff
+	buf    []byte
+	bufOff uint64
+	// The prefetch hit the end of the file
+	eof bool
+	// WriteOpCount() at the time "buf" was filled. Any write since then
+	// invalidates the buffer.
+	opCount uint64
+	// Buffer the running prefetch fills. Swapped with "buf" when done.
+	spare []byte
+	// Closed when the running prefetch is done, nil if there is none
+	done chan struct{}
+}
+
+func newReadahead(size uint64) *readahead {
+	return &readahead{size: size}
+}
+
+// wait blocks until the running prefetch is done. Must be called without
+// holding fdLock or ContentLock, as the prefetch takes both.
+func (ra *readahead) wait() {
+	ra.mu.Lock()
+	done := ra.done
+	ra.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// readFromBuffer appends the plaintext at "off" to "dst" if it is in the
+// prefetch buffer and still valid. The caller must hold ContentLock.
+func (f *File) readFromBuffer(dst []byte, off uint64, length uint64) ([]byte, bool) {
+	ra := f.readahead
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.buf == nil || ra.opCount != f.rootNode.fileTable.WriteOpCount() {
+		return nil, false
+	}
+	bufEnd := ra.bufOff + uint64(len(ra.buf))
+	if off < ra.bufOff || off > bufEnd {
+		return nil, false
+	}
+	end := off + length
+	if end > bufEnd {
+		if !ra.eof {
+			return nil, false
+		}
+		// Short read at the end of the file
+		end = bufEnd
+	}
+	ra.nextOff = end
+	return append(dst, ra.buf[off-ra.bufOff:end-ra.bufOff]...), true
+}
+
+// startReadahead is called after a read of "length" bytes at "off" was
+// served. If the access looks sequential and the prefetch buffer runs low,
+// it starts a prefetch at the end of the read.
+func (f *File) startReadahead(off uint64, length uint64) {
+	ra := f.readahead
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	sequential := off == ra.nextOff
+	end := off + length
+	ra.nextOff = end
+	if !sequential || ra.done != nil {
+		return
+	}
+	valid := ra.buf != nil && ra.opCount == f.rootNode.fileTable.WriteOpCount()
+	if valid && end >= ra.bufOff {
+		if ra.eof {
+			// Nothing left to prefetch
+			return
+		}
+		// Do not start a new prefetch as long as more than half of the
+		// window is left
+		if end+ra.size/2 < ra.bufOff+uint64(len(ra.buf)) {
+			return
+		}
+	}
+	ra.done = make(chan struct{})
+	go f.prefetch(end, ra.done)
+}
+
+// prefetch reads and decrypts "ra.size" bytes at "off" into the spare
+// buffer and makes it the current prefetch buffer.
+//
+// It does not take the keys: Read() waits for the prefetch while holding
+// them, and taking them again would deadlock with a waiting Lock(). Lock()
+// waits for the prefetch instead.
+func (f *File) prefetch(off uint64, done chan struct{}) {
+	ra := f.readahead
+	defer func() {
+		ra.mu.Lock()
+		ra.done = nil
+		ra.mu.Unlock()
+		close(done)
+	}()
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return
+	}
+	if f.rootNode.args.CoalesceWrites && syncPending(f.fileTableEntry) != 0 {
+		return
+	}
+	f.fileTableEntry.ContentLock.RLock()
+	defer f.fileTableEntry.ContentLock.RUnlock()
+	opCount := f.rootNode.fileTable.WriteOpCount()
+	// Nobody else touches the spare buffer while the prefetch runs
+	if uint64(cap(ra.spare)) < ra.size {
+		ra.spare = make([]byte, ra.size)
+	}
+	buf := ra.spare[:0]
+	eof := false
+	for uint64(len(buf)) < ra.size {
+		length := ra.size - uint64(len(buf))
+		if length > fuse.MAX_KERNEL_WRITE {
+			length = fuse.MAX_KERNEL_WRITE
+		}
+		have := len(buf)
+		var errno syscall.Errno
+		buf, errno = f.doRead(buf, off+uint64(have), length)
+		if errno != 0 {
+			f.rootNode.log.Debug.Printf("ino%d: prefetch at off=%d failed: errno=%d", f.qIno.Ino, off, errno)
+			wipe(buf)
+			ra.mu.Lock()
+			ra.spare = buf
+			ra.mu.Unlock()
+			return
+		}
+		if uint64(len(buf)-have) < length {
+			eof = true
+			break
+		}
+	}
+	ra.mu.Lock()
+	wipe(ra.buf)
+	ra.spare = ra.buf
+	ra.buf = buf
+	ra.bufOff = off
+	ra.eof = eof
+	ra.opCount = opCount
+	ra.mu.Unlock()
+}
+
+// release wipes the prefetched plaintext. Called by Release() while holding
+// fdLock exclusively. A prefetch that is still waiting for fdLock sees
+// "released" and leaves the buffers alone.
+func (ra *readahead) release() {
+	ra.mu.Lock()
+	wipe(ra.buf)
+	wipe(ra.spare)
+	ra.buf = nil
+	ra.spare = nil
+	ra.mu.Unlock()
+}
+
+// drop wipes the prefetched plaintext. Called by Lock() after wait().
+func (ra *readahead) drop() {
+	ra.mu.Lock()
+	wipe(ra.buf)
+	ra.spare = ra.buf
+	ra.buf = nil
+	ra.mu.Unlock()
+}
+
+// wipe overwrites "b" with zeros up to its capacity
+func wipe(b []byte) {
+	b = b[:cap(b)]
+	for i := range b {
+		b[i] = 0
+	}
+}
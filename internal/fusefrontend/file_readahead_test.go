@@ -0,0 +1,98 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// newTestFile creates a temporary backing file and opens it via NewFile().
+// The returned function releases and deletes it.
+func newTestFile(t *testing.T, rn *RootNode) (*File, func()) {
+	tmp, err := ioutil.TempFile("", "fusefrontend_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(tmp.Fd()))
+	tmp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _, errno := NewFile(fd, tmp.Name(), rn)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	return f, func() {
+		f.Release(nil)
+		os.Remove(tmp.Name())
+	}
+}
+
+func TestReadahead(t *testing.T) {
+	rn := newTestFS(Args{Readahead: 4})
+	f, cleanup := newTestFile(t, rn)
+	defer cleanup()
+	// 10 blocks and a bit
+	data := make([]byte, 10*4096+100)
+	for i := range data {
+		data[i] = byte(i / 4096)
+	}
+	if _, errno := f.Write(nil, data, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	read := func(off, length int) []byte {
+		res, errno := f.Read(nil, make([]byte, length), int64(off))
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		out, _ := res.Bytes(nil)
+		return out
+	}
+	// Read the file sequentially in 1000-byte pieces
+	var have []byte
+	for off := 0; off < len(data)+1000; off += 1000 {
+		have = append(have, read(off, 1000)...)
+	}
+	if !bytes.Equal(have, data) {
+		t.Fatal("content mismatch")
+	}
+	f.readahead.wait()
+	if f.readahead.buf == nil {
+		t.Error("nothing was prefetched")
+	}
+	// Sequential read again, then overwrite the prefetched range
+	read(0, 1000)
+	read(1000, 1000)
+	f.readahead.wait()
+	if _, ok := f.readFromBuffer(nil, 2000, 1000); !ok {
+		t.Error("next read is not served from the prefetch buffer")
+	}
+	if _, errno := f.Write(nil, []byte("xyz"), 2000); errno != 0 {
+		t.Fatal(errno)
+	}
+	if have := read(2000, 3); string(have) != "xyz" {
+		t.Errorf("stale prefetched data: %q", have)
+	}
+}
+
+// Lock() waits for a running prefetch and drops the prefetched plaintext
+func TestReadaheadLock(t *testing.T) {
+	rn := newTestFS(Args{Readahead: 4})
+	rn.SetKeyManager(&testKeyManager{})
+	f, cleanup := newTestFile(t, rn)
+	defer cleanup()
+	rn.openFiles.Register(f, func() string { return "foo" })
+	if _, errno := f.Write(nil, make([]byte, 8*4096), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.startReadahead(0, 4096)
+	rn.Lock()
+	ra := f.readahead
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.done != nil || ra.buf != nil {
+		t.Error("prefetch survived Lock")
+	}
+}
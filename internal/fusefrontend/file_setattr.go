@@ -28,6 +28,9 @@ func (f *File) setAttr(ctx context.Context, in *fuse.SetAttrIn) (errno syscall.E
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	if errno := flushPending(f.fileTableEntry); errno != 0 {
+		return errno
+	}
 
 	// fchmod(2)
 	if mode, ok := in.GetMode(); ok {
@@ -38,18 +41,7 @@ func (f *File) setAttr(ctx context.Context, in *fuse.SetAttrIn) (errno syscall.E
 	}
 
 	// fchown(2)
-	uid32, uOk := in.GetUID()
-	gid32, gOk := in.GetGID()
-	if uOk || gOk {
-		uid := -1
-		gid := -1
-
-		if uOk {
-			uid = int(uid32)
-		}
-		if gOk {
-			gid = int(gid32)
-		}
+	if uid, gid := f.rootNode.hostOwner(in); uid != -1 || gid != -1 {
 		errno = fs.ToErrno(syscall.Fchown(f.intFd(), uid, gid))
 		if errno != 0 {
 			return errno
@@ -0,0 +1,160 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sabhiram/go-gitignore"
+)
+
+// rsync-style filter rules for "-filter" and "-filter-from".
+//
+// Unlike the gitignore patterns of "-exclude" and "-include", the rules are
+// checked in order and the first matching rule decides. As in rsync, a rule
+// matches a path only, not what is below it, and an excluded directory hides
+// everything inside it. So "+ /src" followed by "- *" shows the directory
+// "src" but none of its contents. Use "+ /src/***" to include the whole tree.
+//
+// Pattern syntax:
+//
+//	/foo   anchored at the root of the filesystem
+//	foo    matches "foo" at any depth
+//	*      any part of a name, not "/"
+//	**     anything, including "/"
+//	dir/***  "dir" and everything below it
+//	?      a single character, not "/"
+//	[a-z]  a character class
+//
+// A trailing "/" is accepted but does not restrict the rule to directories.
+
+// filterRule is a parsed "+ PATTERN" or "- PATTERN" rule
+type filterRule struct {
+	include bool
+	re      *regexp.Regexp
+}
+
+// parseFilterRules parses rsync-style filter rules. Empty lines and lines
+// starting with "#" are ignored.
+func parseFilterRules(lines []string) (rules []filterRule, err error) {
+	for _, l := range lines {
+		r := strings.TrimSpace(l)
+		if r == "" || r[0] == '#' {
+			continue
+		}
+		if len(r) < 3 || r[1] != ' ' {
+			return nil, fmt.Errorf("invalid rule %q", l)
+		}
+		var rule filterRule
+		switch r[0] {
+		case '+':
+			rule.include = true
+		case '-':
+		default:
+			return nil, fmt.Errorf("invalid rule %q: must start with \"+ \" or \"- \"", l)
+		}
+		rule.re, err = filterRegexp(strings.TrimSpace(r[2:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", l, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// filterRegexp converts a filter pattern to a regular expression that
+// matches relative paths like "a/b/c".
+func filterRegexp(pattern string) (*regexp.Regexp, error) {
+	p := strings.TrimRight(pattern, "/")
+	if strings.HasSuffix(pattern, "/***") {
+		p = strings.TrimSuffix(pattern, "/***")
+	}
+	anchored := strings.HasPrefix(p, "/")
+	p = strings.TrimLeft(p, "/")
+	if p == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	var b strings.Builder
+	if anchored {
+		b.WriteString("^")
+	} else {
+		b.WriteString("(^|/)")
+	}
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			if i+1 < len(p) && p[i+1] == '*' {
+				b.WriteString(".*")
+				for i+1 < len(p) && p[i+1] == '*' {
+					i++
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(p[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := p[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(p) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if strings.HasSuffix(pattern, "/***") {
+		b.WriteString("(/.*)?")
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// filterList applies the filter rules. Paths that no rule matches are passed
+// on to "next", which handles "-exclude" and "-include", and may be nil.
+type filterList struct {
+	rules []filterRule
+	next  ignore.IgnoreParser
+}
+
+// match returns the decision of the first rule that matches "path", and
+// false as the second value if there is none.
+func (f *filterList) match(path string) (exclude bool, ok bool) {
+	for _, r := range f.rules {
+		if r.re.MatchString(path) {
+			return !r.include, true
+		}
+	}
+	return false, false
+}
+
+func (f *filterList) MatchesPath(path string) bool {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		// The root directory is never excluded
+		return false
+	}
+	// An excluded directory hides its contents
+	for i := 0; i < len(path); i++ {
+		if path[i] != '/' {
+			continue
+		}
+		if exclude, ok := f.match(path[:i]); ok && exclude {
+			return true
+		}
+	}
+	if exclude, ok := f.match(path); ok {
+		return exclude
+	}
+	return f.next != nil && f.next.MatchesPath(path)
+}
@@ -0,0 +1,89 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+func TestForcePerms(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "forceperms_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldUmask := syscall.Umask(0)
+	defer syscall.Umask(oldUmask)
+	rn := newTestFS(Args{Cipherdir: cipherdir, ForcePerms: &ForcePerms{File: 0640, Dir: 0750}})
+	ctx := context.Background()
+	var out fuse.EntryOut
+	backingPerms := func(name string) uint32 {
+		cName, err := rn.EncryptPath(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(filepath.Join(cipherdir, cName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uint32(fi.Mode().Perm())
+	}
+
+	_, fh, _, errno := rn.Create(ctx, "file", syscall.O_RDWR, 0666, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(ctx)
+	if m := out.Attr.Mode & 07777; m != 0640 {
+		t.Errorf("file: presented %#o", m)
+	}
+	if m := backingPerms("file"); m != 0640 {
+		t.Errorf("file: created with %#o", m)
+	}
+	inode, errno := rn.Mkdir(ctx, "dir", 0777, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if m := out.Attr.Mode & 07777; m != 0750 {
+		t.Errorf("dir: presented %#o", m)
+	}
+	if m := backingPerms("dir"); m != 0750 {
+		t.Errorf("dir: created with %#o", m)
+	}
+	// chmod changes the backing directory, but not what is presented
+	rn.AddChild("dir", inode, false)
+	dir := inode.Operations().(*Node)
+	var attrOut fuse.AttrOut
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_MODE, Mode: 0700}}
+	if errno = dir.Setattr(ctx, nil, in, &attrOut); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno = dir.Getattr(ctx, nil, &attrOut); errno != 0 {
+		t.Fatal(errno)
+	}
+	if m := attrOut.Attr.Mode & 07777; m != 0750 {
+		t.Errorf("dir after chmod: presented %#o", m)
+	}
+	if _, errno = rn.Symlink(ctx, "file", "link", &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if m := out.Attr.Mode & 07777; m != 0777 {
+		t.Errorf("symlink: presented %#o", m)
+	}
+}
@@ -0,0 +1,335 @@
+package fusefrontend
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Consistent CIPHERDIR for snapshots ("freeze").
+//
+// While frozen, all operations that modify the CIPHERDIR block until the
+// filesystem is thawed, so "-snapshot create" can copy a consistent state.
+// Reads keep working. Modifications that are already running when Freeze is
+// called finish first.
+//
+// A freeze ends automatically after freezeTimeout, so a snapshot tool that
+// crashed cannot block all writers forever. Sending Freeze again while frozen
+// restarts the timeout.
+//
+// The control socket can also make the filesystem read-only ("Remount"),
+// which uses the same gate: modifications fail with EROFS instead of
+// blocking, until it is switched back.
+
+// freezeTimeout is how long a freeze lasts without being renewed
+const freezeTimeout = time.Minute
+
+type freezeState struct {
+	// writeLock is read-locked by modifying operations and write-locked while
+	// frozen
+	writeLock sync.RWMutex
+	// mu protects the fields below
+	mu     sync.Mutex
+	frozen bool
+	// deadline is when the freeze ends if it is not renewed
+	deadline time.Time
+	// gen is incremented on each Freeze that is not a renewal, so the timer of
+	// an earlier freeze cannot end a later one
+	gen uint64
+	// readOnly makes all modifications fail with EROFS, see SetReadOnly().
+	// Only changed while writeLock is write-locked.
+	readOnly bool
+	// frozenFlag mirrors "frozen" for coalesceWrite(), which cannot take
+	// "mu" while it holds ContentLock. Accessed atomically.
+	frozenFlag int32
+}
+
+// Freeze blocks all modifications of the CIPHERDIR until Thaw() is called or
+// the freeze times out. Called via the control socket.
+func (rn *RootNode) Freeze() error {
+	f := &rn.freeze
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.frozen {
+		f.deadline = time.Now().Add(freezeTimeout)
+		return nil
+	}
+	// The keys are taken before writeLock, like LockGate() does. If the
+	// filesystem is locked, Lock() has written out all buffers.
+	keys := rn.rlockKeys()
+	// Waits for running modifications
+	f.writeLock.Lock()
+	// Appends buffered in memory would be missing from a snapshot
+	if keys {
+		errno := rn.flushAllPendingIfCoalescing()
+		rn.keyLock.RUnlock()
+		if errno != 0 {
+			f.writeLock.Unlock()
+			return errno
+		}
+	}
+	f.frozen = true
+	atomic.StoreInt32(&f.frozenFlag, 1)
+	f.deadline = time.Now().Add(freezeTimeout)
+	f.gen++
+	gen := f.gen
+	time.AfterFunc(freezeTimeout, func() { rn.freezeTimer(gen) })
+	rn.log.Info.Printf("Freeze: modifications are blocked")
+	return nil
+}
+
+// freezeTimer ends the freeze "gen" if it has not been renewed
+func (rn *RootNode) freezeTimer(gen uint64) {
+	f := &rn.freeze
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.frozen || f.gen != gen {
+		return
+	}
+	if left := time.Until(f.deadline); left > 0 {
+		time.AfterFunc(left, func() { rn.freezeTimer(gen) })
+		return
+	}
+	f.frozen = false
+	atomic.StoreInt32(&f.frozenFlag, 0)
+	f.writeLock.Unlock()
+	tlog.Warn.Printf("Freeze: not renewed for %v, modifications are allowed again", freezeTimeout)
+}
+
+// Thaw ends the freeze. Returns EINVAL if the filesystem is not frozen, for
+// example because the freeze has timed out.
+func (rn *RootNode) Thaw() error {
+	f := &rn.freeze
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.frozen {
+		return syscall.EINVAL
+	}
+	f.frozen = false
+	atomic.StoreInt32(&f.frozenFlag, 0)
+	f.writeLock.Unlock()
+	rn.log.Info.Printf("Thaw: modifications are allowed again")
+	return nil
+}
+
+// SetReadOnly makes all modifications fail with EROFS, or allows them again.
+// Files stay open, but writing to them fails too. Called via the control
+// socket ("Remount").
+func (rn *RootNode) SetReadOnly(ro bool) error {
+	f := &rn.freeze
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.readOnly == ro {
+		return nil
+	}
+	// While frozen, writeLock is already write-locked and Freeze() has
+	// written out all buffered appends
+	if !f.frozen {
+		// Keys before writeLock, see Freeze()
+		keys := rn.rlockKeys()
+		// Waits for running modifications
+		f.writeLock.Lock()
+		defer f.writeLock.Unlock()
+		if keys {
+			var errno syscall.Errno
+			if ro {
+				errno = rn.flushAllPendingIfCoalescing()
+			}
+			rn.keyLock.RUnlock()
+			if errno != 0 {
+				return errno
+			}
+		}
+	}
+	f.readOnly = ro
+	if ro {
+		rn.log.Info.Printf("Remount: modifications fail with EROFS")
+	} else {
+		rn.log.Info.Printf("Remount: modifications are allowed again")
+	}
+	return nil
+}
+
+// isFrozen returns true between Freeze() and Thaw()
+func (rn *RootNode) isFrozen() bool {
+	return atomic.LoadInt32(&rn.freeze.frozenFlag) != 0
+}
+
+// ReadOnly returns true if SetReadOnly(true) is in effect
+func (rn *RootNode) ReadOnly() bool {
+	f := &rn.freeze
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readOnly
+}
+
+// FreezeGate wraps the raw filesystem "raw" created from "rn" so that all
+// operations that modify the CIPHERDIR block while the filesystem is frozen,
+// and fail while it is read-only.
+//
+// Flush, Fsync and Release pass. The only modification they make is writing
+// out appends buffered by "-coalesce-writes", and Freeze() and SetReadOnly()
+// write those out first. The flush timer goes through the same lock.
+func (rn *RootNode) FreezeGate(raw fuse.RawFileSystem) fuse.RawFileSystem {
+	return &freezeGate{RawFileSystem: raw, rn: rn}
+}
+
+type freezeGate struct {
+	fuse.RawFileSystem
+	rn *RootNode
+}
+
+// enterWrite waits until the filesystem is not frozen. It returns false if
+// the filesystem is read-only. Call leaveWrite() when it returned true.
+func (rn *RootNode) enterWrite() bool {
+	f := &rn.freeze
+	f.writeLock.RLock()
+	if f.readOnly {
+		f.writeLock.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (rn *RootNode) leaveWrite() {
+	rn.freeze.writeLock.RUnlock()
+}
+
+func (g *freezeGate) enter() bool {
+	return g.rn.enterWrite()
+}
+
+func (g *freezeGate) leave() {
+	g.rn.leaveWrite()
+}
+
+func (g *freezeGate) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if !g.enter() {
+		return fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (g *freezeGate) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !g.enter() {
+		return fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (g *freezeGate) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !g.enter() {
+		return fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (g *freezeGate) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if !g.enter() {
+		return fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (g *freezeGate) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if !g.enter() {
+		return fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (g *freezeGate) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if !g.enter() {
+		return fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (g *freezeGate) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	if !g.enter() {
+		return fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (g *freezeGate) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	if !g.enter() {
+		return fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (g *freezeGate) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	if !g.enter() {
+		return fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (g *freezeGate) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	if !g.enter() {
+		return fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (g *freezeGate) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	if !g.enter() {
+		return fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.Create(cancel, input, name, out)
+}
+
+// Open only modifies the file with O_TRUNC. Opening for writing fails when
+// read-only, like on a read-only mount.
+func (g *freezeGate) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if input.Flags&syscall.O_TRUNC != 0 {
+		if !g.enter() {
+			return fuse.Status(syscall.EROFS)
+		}
+		defer g.leave()
+	} else if input.Flags&syscall.O_ACCMODE != syscall.O_RDONLY && g.rn.ReadOnly() {
+		return fuse.Status(syscall.EROFS)
+	}
+	return g.RawFileSystem.Open(cancel, input, out)
+}
+
+func (g *freezeGate) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	if !g.enter() {
+		return 0, fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.Write(cancel, input, data)
+}
+
+func (g *freezeGate) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	if !g.enter() {
+		return 0, fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.CopyFileRange(cancel, input)
+}
+
+func (g *freezeGate) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
+	if !g.enter() {
+		return fuse.Status(syscall.EROFS)
+	}
+	defer g.leave()
+	return g.RawFileSystem.Fallocate(cancel, input)
+}
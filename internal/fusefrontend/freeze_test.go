@@ -0,0 +1,154 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestFreeze(t *testing.T) {
+	rn := newTestFS(Args{})
+	gate := rn.FreezeGate(fuse.NewDefaultRawFileSystem())
+	if err := rn.Thaw(); err != syscall.EINVAL {
+		t.Errorf("Thaw without Freeze: want EINVAL, got %v", err)
+	}
+	if err := rn.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	// Renewing is allowed
+	if err := rn.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan fuse.Status)
+	go func() {
+		done <- gate.Mkdir(nil, &fuse.MkdirIn{}, "foo", &fuse.EntryOut{})
+	}()
+	// Reads pass
+	var out fuse.EntryOut
+	if st := gate.Lookup(nil, &fuse.InHeader{}, "foo", &out); st != fuse.ENOSYS {
+		t.Errorf("frozen Lookup: want ENOSYS, got %v", st)
+	}
+	select {
+	case <-done:
+		t.Fatal("Mkdir was not blocked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := rn.Thaw(); err != nil {
+		t.Fatal(err)
+	}
+	if st := <-done; st != fuse.ENOSYS {
+		t.Errorf("thawed Mkdir: want ENOSYS, got %v", st)
+	}
+}
+
+func TestFreezeTimer(t *testing.T) {
+	rn := newTestFS(Args{})
+	if err := rn.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	// A renewed freeze survives the first timer
+	rn.freeze.mu.Lock()
+	rn.freeze.deadline = time.Now().Add(time.Hour)
+	gen := rn.freeze.gen
+	rn.freeze.mu.Unlock()
+	rn.freezeTimer(gen)
+	// The timer of an earlier freeze does nothing
+	rn.freezeTimer(gen - 1)
+	if !rn.freeze.frozen {
+		t.Fatal("freeze ended early")
+	}
+	rn.freeze.mu.Lock()
+	rn.freeze.deadline = time.Now()
+	rn.freeze.mu.Unlock()
+	rn.freezeTimer(gen)
+	if err := rn.Thaw(); err != syscall.EINVAL {
+		t.Errorf("expired freeze: want EINVAL, got %v", err)
+	}
+}
+
+func TestSetReadOnly(t *testing.T) {
+	rn := newTestFS(Args{})
+	gate := rn.FreezeGate(fuse.NewDefaultRawFileSystem())
+	if err := rn.SetReadOnly(true); err != nil {
+		t.Fatal(err)
+	}
+	if st := gate.Mkdir(nil, &fuse.MkdirIn{}, "foo", &fuse.EntryOut{}); st != fuse.Status(syscall.EROFS) {
+		t.Errorf("read-only Mkdir: want EROFS, got %v", st)
+	}
+	if _, st := gate.Write(nil, &fuse.WriteIn{}, nil); st != fuse.Status(syscall.EROFS) {
+		t.Errorf("read-only Write: want EROFS, got %v", st)
+	}
+	var open fuse.OpenOut
+	if st := gate.Open(nil, &fuse.OpenIn{Flags: syscall.O_WRONLY}, &open); st != fuse.Status(syscall.EROFS) {
+		t.Errorf("read-only Open for writing: want EROFS, got %v", st)
+	}
+	if st := gate.Open(nil, &fuse.OpenIn{Flags: syscall.O_RDONLY}, &open); st == fuse.Status(syscall.EROFS) {
+		t.Errorf("read-only Open for reading: got %v", st)
+	}
+	// Works while frozen, and stays in effect after the thaw
+	if err := rn.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rn.SetReadOnly(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := rn.SetReadOnly(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := rn.Thaw(); err != nil {
+		t.Fatal(err)
+	}
+	if !rn.ReadOnly() {
+		t.Error("read-only flag lost")
+	}
+	if err := rn.SetReadOnly(false); err != nil {
+		t.Fatal(err)
+	}
+	if st := gate.Mkdir(nil, &fuse.MkdirIn{}, "foo", &fuse.EntryOut{}); st != fuse.ENOSYS {
+		t.Errorf("read-write Mkdir: want ENOSYS, got %v", st)
+	}
+}
+
+// Freeze() writes out buffered appends, and no new ones are buffered until
+// Thaw()
+func TestFreezeCoalesce(t *testing.T) {
+	rn := newTestFS(Args{CoalesceWrites: true})
+	f, cleanup := newTestFile(t, rn)
+	defer cleanup()
+	size := func() uint64 {
+		sz, err := f.statPlainSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sz
+	}
+	if _, errno := f.Write(nil, []byte("abc"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if f.appendBuf == nil {
+		t.Fatal("append was not buffered")
+	}
+	if err := rn.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	if f.appendBuf != nil || size() != 3 {
+		t.Error("Freeze did not write out the buffer")
+	}
+	if _, errno := f.Write(nil, []byte("def"), 3); errno != 0 {
+		t.Fatal(errno)
+	}
+	if f.appendBuf != nil {
+		t.Error("append was buffered while frozen")
+	}
+	if err := rn.Thaw(); err != nil {
+		t.Fatal(err)
+	}
+	if _, errno := f.Write(nil, []byte("ghi"), 6); errno != 0 {
+		t.Fatal(errno)
+	}
+	if f.appendBuf == nil {
+		t.Error("append was not buffered after Thaw")
+	}
+}
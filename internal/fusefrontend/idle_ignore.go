@@ -0,0 +1,353 @@
+package fusefrontend
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Idle exemptions ("-idle-ignore").
+//
+// Requests from processes that match one of the patterns do not reset the
+// idle timer of "-idle", and files they have open do not keep the filesystem
+// busy. This way, an indexer or a monitoring agent does not keep the
+// filesystem mounted or unlocked forever. A pattern without a slash is
+// matched against the process name (/proc/PID/comm), a pattern with a slash
+// against the path of the executable (/proc/PID/exe).
+//
+// Requests that the kernel sends on its own have PID 0. They follow
+// earlier requests of some process, so they do not count either.
+
+// idleIgnoreTTL is how long the result of a process lookup is cached. PIDs
+// are reused, so the cache must not live forever.
+const idleIgnoreTTL = 10 * time.Second
+
+type idleIgnore struct {
+	patterns []string
+	// mu protects the fields below
+	mu sync.Mutex
+	// cache maps PIDs to match results, it is emptied after idleIgnoreTTL
+	cache      map[uint32]bool
+	cacheStart time.Time
+	// files are the open file handles of matching processes
+	files map[interface{}]struct{}
+}
+
+func newIdleIgnore(patterns []string) *idleIgnore {
+	return &idleIgnore{
+		patterns: patterns,
+		cache:    make(map[uint32]bool),
+		files:    make(map[interface{}]struct{}),
+	}
+}
+
+// match returns true if the process "pid" matches one of the patterns
+func (ii *idleIgnore) match(pid uint32) bool {
+	if pid == 0 {
+		return true
+	}
+	ii.mu.Lock()
+	defer ii.mu.Unlock()
+	if time.Since(ii.cacheStart) > idleIgnoreTTL {
+		ii.cache = make(map[uint32]bool)
+		ii.cacheStart = time.Now()
+	}
+	if m, ok := ii.cache[pid]; ok {
+		return m
+	}
+	m := matchProcess(pid, ii.patterns)
+	ii.cache[pid] = m
+	return m
+}
+
+// matchProcess looks up the name and executable of process "pid" and
+// matches them against "patterns". A process that is gone does not match.
+func matchProcess(pid uint32, patterns []string) bool {
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return false
+	}
+	name := strings.TrimSuffix(string(comm), "\n")
+	// Only readable for processes of the same user, or as root
+	exe, _ := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	for _, p := range patterns {
+		subject := name
+		if strings.Contains(p, "/") {
+			if exe == "" {
+				continue
+			}
+			subject = exe
+		}
+		if m, _ := filepath.Match(p, subject); m {
+			return true
+		}
+	}
+	return false
+}
+
+// idleTouch resets the idle marker unless the request comes from an ignored
+// process
+func (rn *RootNode) idleTouch(header *fuse.InHeader) {
+	if rn.idleIgnore == nil || !rn.idleIgnore.match(header.Caller.Pid) {
+		atomic.StoreUint32(&rn.IsIdle, 0)
+	}
+}
+
+// idleOpened remembers the file handle "fh" if it was opened by an ignored
+// process
+func (rn *RootNode) idleOpened(ctx context.Context, fh interface{}) {
+	ii := rn.idleIgnore
+	if ii == nil {
+		return
+	}
+	if ctx == nil {
+		return
+	}
+	if caller, ok := fuse.FromContext(ctx); ok && !ii.match(caller.Pid) {
+		return
+	}
+	ii.mu.Lock()
+	ii.files[fh] = struct{}{}
+	ii.mu.Unlock()
+}
+
+// idleClosed forgets the file handle "fh"
+func (rn *RootNode) idleClosed(fh interface{}) {
+	ii := rn.idleIgnore
+	if ii == nil {
+		return
+	}
+	ii.mu.Lock()
+	delete(ii.files, fh)
+	ii.mu.Unlock()
+}
+
+// CountActiveOpenFiles returns the number of open files that keep the
+// filesystem from becoming idle. Without "-idle-ignore", that is every open
+// file. Files of ignored processes still count while they have buffered
+// appends or a prefetch running, which need the keys in the background.
+func (rn *RootNode) CountActiveOpenFiles() int {
+	ii := rn.idleIgnore
+	if ii == nil {
+		return rn.CountOpenFiles()
+	}
+	n := 0
+	var ignored []*File
+	ii.mu.Lock()
+	for _, fh := range rn.openFiles.Handles() {
+		if _, ok := ii.files[fh]; !ok {
+			n++
+		} else if f, ok := fh.(*File); ok {
+			ignored = append(ignored, f)
+		}
+	}
+	ii.mu.Unlock()
+	// busy() takes ContentLock, do not hold ii.mu meanwhile
+	for _, f := range ignored {
+		if f.busy() {
+			n++
+		}
+	}
+	return n
+}
+
+// busy returns true if "f" has appends buffered by "-coalesce-writes" or a
+// readahead prefetch running
+func (f *File) busy() bool {
+	if ra := f.readahead; ra != nil {
+		ra.mu.Lock()
+		running := ra.done != nil
+		ra.mu.Unlock()
+		if running {
+			return true
+		}
+	}
+	e := f.fileTableEntry
+	e.ContentLock.RLock()
+	defer e.ContentLock.RUnlock()
+	return e.Pending == f
+}
+
+// IdleGate wraps the raw filesystem "raw" created from "rn" so that requests
+// reset the idle marker according to "-idle-ignore".
+func (rn *RootNode) IdleGate(raw fuse.RawFileSystem) fuse.RawFileSystem {
+	return &idleGate{RawFileSystem: raw, rn: rn}
+}
+
+type idleGate struct {
+	fuse.RawFileSystem
+	rn *RootNode
+}
+
+func (g *idleGate) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	g.rn.idleTouch(header)
+	return g.RawFileSystem.Lookup(cancel, header, name, out)
+}
+
+func (g *idleGate) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.GetAttr(cancel, input, out)
+}
+
+func (g *idleGate) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (g *idleGate) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (g *idleGate) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (g *idleGate) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	g.rn.idleTouch(header)
+	return g.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (g *idleGate) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	g.rn.idleTouch(header)
+	return g.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (g *idleGate) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (g *idleGate) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (g *idleGate) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	g.rn.idleTouch(header)
+	return g.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (g *idleGate) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
+	g.rn.idleTouch(header)
+	return g.RawFileSystem.Readlink(cancel, header)
+}
+
+func (g *idleGate) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.Access(cancel, input)
+}
+
+func (g *idleGate) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	g.rn.idleTouch(header)
+	return g.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+}
+
+func (g *idleGate) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	g.rn.idleTouch(header)
+	return g.RawFileSystem.ListXAttr(cancel, header, dest)
+}
+
+func (g *idleGate) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (g *idleGate) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	g.rn.idleTouch(header)
+	return g.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (g *idleGate) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.Create(cancel, input, name, out)
+}
+
+func (g *idleGate) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.Open(cancel, input, out)
+}
+
+func (g *idleGate) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.Read(cancel, input, buf)
+}
+
+func (g *idleGate) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
+	g.rn.idleTouch(&in.InHeader)
+	return g.RawFileSystem.Lseek(cancel, in, out)
+}
+
+func (g *idleGate) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.GetLk(cancel, input, out)
+}
+
+func (g *idleGate) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.SetLk(cancel, input)
+}
+
+func (g *idleGate) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.SetLkw(cancel, input)
+}
+
+func (g *idleGate) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.Write(cancel, input, data)
+}
+
+func (g *idleGate) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.CopyFileRange(cancel, input)
+}
+
+func (g *idleGate) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.Flush(cancel, input)
+}
+
+func (g *idleGate) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.Fsync(cancel, input)
+}
+
+func (g *idleGate) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.Fallocate(cancel, input)
+}
+
+func (g *idleGate) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.OpenDir(cancel, input, out)
+}
+
+func (g *idleGate) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.ReadDir(cancel, input, out)
+}
+
+func (g *idleGate) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.ReadDirPlus(cancel, input, out)
+}
+
+func (g *idleGate) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	g.rn.idleTouch(&input.InHeader)
+	return g.RawFileSystem.FsyncDir(cancel, input)
+}
+
+func (g *idleGate) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	g.rn.idleTouch(input)
+	return g.RawFileSystem.StatFs(cancel, input, out)
+}
@@ -0,0 +1,116 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// noSuchPid is above the maximum PID on Linux
+const noSuchPid = 1 << 23
+
+func TestMatchProcess(t *testing.T) {
+	comm, err := ioutil.ReadFile("/proc/self/comm")
+	if err != nil {
+		t.Skip(err)
+	}
+	name := strings.TrimSuffix(string(comm), "\n")
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := uint32(os.Getpid())
+	testCases := []struct {
+		patterns []string
+		pid      uint32
+		want     bool
+	}{
+		{[]string{name}, pid, true},
+		{[]string{"foo", name[:1] + "*"}, pid, true},
+		{[]string{filepath.Dir(exe) + "/*"}, pid, true},
+		{[]string{"foo", "/foo/*"}, pid, false},
+		{[]string{"*"}, noSuchPid, false},
+	}
+	for i, tc := range testCases {
+		if have := matchProcess(tc.pid, tc.patterns); have != tc.want {
+			t.Errorf("case %d: want %v, have %v", i, tc.want, have)
+		}
+	}
+}
+
+func TestIdleIgnore(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "idle_ignore_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rn := newTestFS(Args{Cipherdir: cipherdir, IdleIgnore: []string{"*"}, CoalesceWrites: true})
+	gate := rn.IdleGate(fuse.NewDefaultRawFileSystem())
+	touched := func(pid uint32) bool {
+		atomic.StoreUint32(&rn.IsIdle, 1)
+		gate.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{Caller: fuse.Caller{Pid: pid}}}, &fuse.AttrOut{})
+		return atomic.LoadUint32(&rn.IsIdle) == 0
+	}
+	if touched(uint32(os.Getpid())) || touched(0) {
+		t.Error("ignored process reset the idle marker")
+	}
+	if !touched(noSuchPid) {
+		t.Error("other process did not reset the idle marker")
+	}
+	// Files of ignored processes do not keep the filesystem busy
+	var out fuse.EntryOut
+	ignored := fuse.NewContext(context.Background(), &fuse.Caller{Pid: uint32(os.Getpid())})
+	other := fuse.NewContext(context.Background(), &fuse.Caller{Pid: noSuchPid})
+	_, fh1, _, errno := rn.Create(ignored, "a", syscall.O_RDWR, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	_, fh2, _, errno := rn.Create(other, "b", syscall.O_RDWR, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if n := rn.CountActiveOpenFiles(); n != 1 {
+		t.Errorf("want 1 active open file, have %d", n)
+	}
+	fh2.(*File).Release(other)
+	if n := rn.CountActiveOpenFiles(); n != 0 {
+		t.Errorf("want 0 active open files, have %d", n)
+	}
+	// Buffered appends keep the file active, Lock() would have to write
+	// them out
+	f1 := fh1.(*File)
+	if _, errno := f1.Write(ignored, []byte("abc"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if n := rn.CountActiveOpenFiles(); n != 1 {
+		t.Errorf("want 1 active open file with buffered appends, have %d", n)
+	}
+	if errno := f1.Flush(ignored); errno != 0 {
+		t.Fatal(errno)
+	}
+	if n := rn.CountActiveOpenFiles(); n != 0 {
+		t.Errorf("want 0 active open files after Flush, have %d", n)
+	}
+	fh1.(*File).Release(ignored)
+	if n := len(rn.idleIgnore.files); n != 0 {
+		t.Errorf("%d released files still tracked", n)
+	}
+}
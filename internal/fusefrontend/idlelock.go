@@ -0,0 +1,389 @@
+package fusefrontend
+
+import (
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// KeyManager drops and restores the encryption keys for "-idlelock".
+type KeyManager interface {
+	// WipeKeys removes the keys from memory.
+	WipeKeys()
+	// RestoreKeys re-derives the keys from the password. Must return an error
+	// if the password is wrong.
+	RestoreKeys(password string) error
+}
+
+// SetKeyManager enables Lock() and Unlock(). Must be called before the
+// filesystem is mounted.
+func (rn *RootNode) SetKeyManager(km KeyManager) {
+	rn.keyManager = km
+}
+
+// Lock wipes the encryption keys from memory. Until Unlock() is called, all
+// filesystem operations that pass through LockGate() fail with EACCES.
+//
+// Waits for running operations to finish, including readahead prefetches
+// started by earlier reads. Prefetched plaintext is dropped. Appends buffered
+// by "-coalesce-writes" are written out first, no timer or Release() can do it
+// without the keys.
+//
+// Afterwards, the kernel is asked to drop the file contents, attributes and
+// names it has cached, so they cannot be read from the locked filesystem.
+func (rn *RootNode) Lock() {
+	rn.keyLock.Lock()
+	if rn.locked || rn.keyManager == nil {
+		rn.keyLock.Unlock()
+		return
+	}
+	if errno := rn.flushAllPendingIfCoalescing(); errno != 0 {
+		// The buffers are gone either way
+		tlog.Warn.Printf("Lock: writing buffered appends failed: %v", errno)
+	}
+	// No new prefetch can start, they are started by Read(), which goes
+	// through LockGate()
+	for _, fh := range rn.openFiles.Handles() {
+		if f, ok := fh.(*File); ok && f.readahead != nil {
+			f.readahead.wait()
+			f.readahead.drop()
+		}
+	}
+	rn.keyManager.WipeKeys()
+	rn.locked = true
+	rn.keyLock.Unlock()
+	rn.log.Info.Printf("Filesystem locked, keys have been wiped from memory")
+	// Not under keyLock: the kernel waits for pages that a read has locked,
+	// and the read may be waiting for keyLock in LockGate()
+	rn.dropKernelCaches()
+}
+
+// dropKernelCaches asks the kernel to forget everything it has cached below
+// the root directory. Names that are in use, like the working directory of
+// a process, stay. Does nothing until LockGate() has seen the filesystem
+// being mounted.
+func (rn *RootNode) dropKernelCaches() {
+	if atomic.LoadInt32(&rn.lockNotify) == 0 {
+		return
+	}
+	var walk func(dir *fs.Inode)
+	walk = func(dir *fs.Inode) {
+		for name, child := range dir.Children() {
+			if child.IsDir() {
+				walk(child)
+			} else if errno := child.NotifyContent(0, 0); errno != 0 && errno != syscall.ENOENT {
+				rn.log.Debug.Printf("Lock: NotifyContent: %v", errno)
+			}
+			if errno := dir.NotifyEntry(name); errno != 0 && errno != syscall.ENOENT {
+				rn.log.Debug.Printf("Lock: NotifyEntry: %v", errno)
+			}
+		}
+		// Attributes and the readdir cache
+		if errno := dir.NotifyContent(0, 0); errno != 0 && errno != syscall.ENOENT {
+			rn.log.Debug.Printf("Lock: NotifyContent: %v", errno)
+		}
+	}
+	walk(rn.EmbeddedInode())
+}
+
+// Unlock restores the encryption keys using "password" and makes the
+// filesystem accessible again. Returns EACCES if the password is wrong.
+func (rn *RootNode) Unlock(password string) error {
+	rn.keyLock.Lock()
+	defer rn.keyLock.Unlock()
+	if !rn.locked {
+		return nil
+	}
+	if rn.keyManager == nil {
+		return syscall.ENOTSUP
+	}
+	if err := rn.keyManager.RestoreKeys(password); err != nil {
+		tlog.Warn.Printf("Unlock failed: %v", err)
+		return syscall.EACCES
+	}
+	rn.locked = false
+	rn.log.Info.Printf("Filesystem unlocked")
+	return nil
+}
+
+// IsLocked returns true if the keys have been wiped by Lock().
+func (rn *RootNode) IsLocked() bool {
+	rn.keyLock.RLock()
+	defer rn.keyLock.RUnlock()
+	return rn.locked
+}
+
+// rlockKeys makes sure the keys stay in memory until the caller calls
+// rn.keyLock.RUnlock(). Returns false (and does not hold the lock) if the
+// filesystem is locked.
+//
+// Must be called before taking fdLock or ContentLock, because Lock() takes
+// ContentLock while it holds keyLock.
+func (rn *RootNode) rlockKeys() bool {
+	rn.keyLock.RLock()
+	if rn.locked {
+		rn.keyLock.RUnlock()
+		return false
+	}
+	return true
+}
+
+// LockGate wraps the raw filesystem "raw" created from "rn" so that all
+// operations fail with EACCES while the filesystem is locked.
+//
+// The check cannot be done in the Node methods alone because the go-fuse
+// bridge also calls into open files. Operations that must not fail (Forget,
+// Release, Flush) or that may block indefinitely (the file locking calls) are
+// passed through. Release and Flush take the keys themselves when they write
+// out buffered appends.
+func (rn *RootNode) LockGate(raw fuse.RawFileSystem) fuse.RawFileSystem {
+	return &lockGate{RawFileSystem: raw, rn: rn}
+}
+
+type lockGate struct {
+	fuse.RawFileSystem
+	rn *RootNode
+}
+
+// Init is called by the FUSE server. From then on, the inodes can send
+// notifications to the kernel.
+func (g *lockGate) Init(srv *fuse.Server) {
+	g.RawFileSystem.Init(srv)
+	atomic.StoreInt32(&g.rn.lockNotify, 1)
+}
+
+func (g *lockGate) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Lookup(cancel, header, name, out)
+}
+
+func (g *lockGate) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.GetAttr(cancel, input, out)
+}
+
+func (g *lockGate) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (g *lockGate) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (g *lockGate) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (g *lockGate) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (g *lockGate) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (g *lockGate) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (g *lockGate) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (g *lockGate) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (g *lockGate) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
+	if !g.rn.rlockKeys() {
+		return nil, fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Readlink(cancel, header)
+}
+
+func (g *lockGate) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Access(cancel, input)
+}
+
+func (g *lockGate) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	if !g.rn.rlockKeys() {
+		return 0, fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+}
+
+func (g *lockGate) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	if !g.rn.rlockKeys() {
+		return 0, fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.ListXAttr(cancel, header, dest)
+}
+
+func (g *lockGate) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (g *lockGate) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (g *lockGate) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Create(cancel, input, name, out)
+}
+
+func (g *lockGate) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Open(cancel, input, out)
+}
+
+func (g *lockGate) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	if !g.rn.rlockKeys() {
+		return nil, fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Read(cancel, input, buf)
+}
+
+func (g *lockGate) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Lseek(cancel, in, out)
+}
+
+func (g *lockGate) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	if !g.rn.rlockKeys() {
+		return 0, fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Write(cancel, input, data)
+}
+
+func (g *lockGate) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	if !g.rn.rlockKeys() {
+		return 0, fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.CopyFileRange(cancel, input)
+}
+
+func (g *lockGate) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Fsync(cancel, input)
+}
+
+func (g *lockGate) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.Fallocate(cancel, input)
+}
+
+func (g *lockGate) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.OpenDir(cancel, input, out)
+}
+
+func (g *lockGate) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.ReadDir(cancel, input, out)
+}
+
+func (g *lockGate) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.ReadDirPlus(cancel, input, out)
+}
+
+func (g *lockGate) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.FsyncDir(cancel, input)
+}
+
+func (g *lockGate) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	if !g.rn.rlockKeys() {
+		return fuse.EACCES
+	}
+	defer g.rn.keyLock.RUnlock()
+	return g.RawFileSystem.StatFs(cancel, input, out)
+}
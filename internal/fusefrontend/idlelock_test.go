@@ -0,0 +1,118 @@
+package fusefrontend
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+type testKeyManager struct {
+	wiped bool
+}
+
+func (k *testKeyManager) WipeKeys() {
+	k.wiped = true
+}
+
+func (k *testKeyManager) RestoreKeys(password string) error {
+	if password != "test" {
+		return errors.New("wrong password")
+	}
+	k.wiped = false
+	return nil
+}
+
+func TestIdleLock(t *testing.T) {
+	rn := newTestFS(Args{})
+	km := &testKeyManager{}
+	rn.SetKeyManager(km)
+	gate := rn.LockGate(fuse.NewDefaultRawFileSystem())
+	var out fuse.EntryOut
+	// The default raw filesystem returns ENOSYS for everything
+	if st := gate.Lookup(nil, &fuse.InHeader{}, "foo", &out); st != fuse.ENOSYS {
+		t.Errorf("unlocked: want ENOSYS, got %v", st)
+	}
+
+	rn.Lock()
+	if !km.wiped || !rn.IsLocked() {
+		t.Fatal("Lock did not wipe the keys")
+	}
+	if st := gate.Lookup(nil, &fuse.InHeader{}, "foo", &out); st != fuse.EACCES {
+		t.Errorf("locked: want EACCES, got %v", st)
+	}
+	if _, err := rn.EncryptPath("foo"); err != syscall.EACCES {
+		t.Errorf("locked EncryptPath: want EACCES, got %v", err)
+	}
+
+	if err := rn.Unlock("wrong"); err != syscall.EACCES {
+		t.Errorf("wrong password: want EACCES, got %v", err)
+	}
+	if !rn.IsLocked() {
+		t.Fatal("wrong password unlocked the filesystem")
+	}
+	if err := rn.Unlock("test"); err != nil {
+		t.Fatal(err)
+	}
+	if km.wiped || rn.IsLocked() {
+		t.Fatal("Unlock did not restore the keys")
+	}
+	if st := gate.Lookup(nil, &fuse.InHeader{}, "foo", &out); st != fuse.ENOSYS {
+		t.Errorf("unlocked again: want ENOSYS, got %v", st)
+	}
+}
+
+// cipherKeyManager wipes the real ciphers, like the key manager of
+// "-idlelock" does
+type cipherKeyManager struct {
+	cCore *cryptocore.CryptoCore
+}
+
+func (k *cipherKeyManager) WipeKeys() {
+	k.cCore.Wipe()
+}
+
+func (k *cipherKeyManager) RestoreKeys(password string) error {
+	return errors.New("not implemented")
+}
+
+// Lock() must write out buffered appends before the keys are gone. The flush
+// timer, Flush and Release must not touch the wiped ciphers afterwards.
+func TestIdleLockCoalesce(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false)
+	rn := NewRootNode(Args{CoalesceWrites: true}, cEnc, nametransform.New(cCore.EMECipher, true, true))
+	rn.SetKeyManager(&cipherKeyManager{cCore: cCore})
+	f, cleanup := newTestFile(t, rn)
+	defer cleanup()
+	if _, errno := f.Write(nil, []byte("abc"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if f.appendBuf == nil {
+		t.Fatal("append was not buffered")
+	}
+	rn.Lock()
+	if f.appendBuf != nil {
+		t.Error("Lock did not write out the buffer")
+	}
+	// Would panic with a nil cipher if the timer was still armed
+	time.Sleep(coalesceDelay + 500*time.Millisecond)
+	if errno := f.Flush(nil); errno != 0 {
+		t.Errorf("Flush: %v", errno)
+	}
+	st, err := os.Stat(f.fd.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(cEnc.PlainSizeToCipherSize(3)); st.Size() != want {
+		t.Errorf("want %d bytes on disk, have %d", want, st.Size())
+	}
+}
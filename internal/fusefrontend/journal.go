@@ -0,0 +1,23 @@
+package fusefrontend
+
+import (
+	"github.com/HorizonLiu/gocryptfs/internal/journal"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// journalBegin records the intent to run "op" on "cName" in "dirfd" with
+// "-journal". Call the returned function, which is never nil, when the
+// operation is finished.
+// A failure to write the journal is logged, but does not stop the operation.
+func (rn *RootNode) journalBegin(dirfd int, op journal.Op, cName string, tmp string) func() {
+	j := rn.args.Journal
+	if j == nil {
+		return func() {}
+	}
+	done, err := j.BeginAt(dirfd, journal.Intent{Op: op, Name: cName, Tmp: tmp})
+	if err != nil {
+		tlog.Warn.Printf("journal: %v", err)
+		return func() {}
+	}
+	return done
+}
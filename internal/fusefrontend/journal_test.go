@@ -0,0 +1,87 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/journal"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// TestJournal runs the operations that write "-journal" records. A record
+// that cannot be written logs a warning, which panics here. The journal is
+// empty when no operation is running.
+func TestJournal(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "journal_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := journal.Open(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	tlog.Warn.Wpanic = true
+	defer func() { tlog.Warn.Wpanic = false }()
+
+	rn := newTestFS(Args{Cipherdir: cipherdir, LongNames: true, Journal: j})
+	ctx := context.Background()
+	var out fuse.EntryOut
+	long := strings.Repeat("l", 200)
+	inode, errno := rn.Mkdir(ctx, "d"+long, 0700, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("d"+long, inode, false)
+	dir := inode.Operations().(*Node)
+	_, fh, _, errno := rn.Create(ctx, "f"+long, syscall.O_RDWR, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(ctx)
+	if errno = rn.Rename(ctx, "f"+long, dir, "g"+long, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno = dir.Unlink(ctx, "g"+long); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno = rn.Rmdir(ctx, "d"+long); errno != 0 {
+		t.Fatal(errno)
+	}
+	st, err := os.Stat(filepath.Join(cipherdir, journal.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != 0 {
+		t.Errorf("journal has %d bytes left", st.Size())
+	}
+	// The journal does not show up in the mount
+	ds, errno := rn.Readdir(ctx)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	for ds.HasNext() {
+		e, _ := ds.Next()
+		if e.Name != "." && e.Name != ".." {
+			t.Errorf("unexpected entry %q", e.Name)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package fusefrontend
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/HorizonLiu/gocryptfs/internal/lease"
+)
+
+// leaseDir takes the "-sharedstorage" lease on the backing directory "dirfd"
+// (see package lease). It is a no-op without "-sharedstorage" and with
+// "-plaintextnames", where there are no companion files to protect.
+// The caller must call "release" when done.
+func (rn *RootNode) leaseDir(dirfd int) (release func(), errno syscall.Errno) {
+	if !rn.args.SharedStorage || rn.args.PlaintextNames {
+		return func() {}, 0
+	}
+	release, err := lease.Acquire(dirfd)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return release, 0
+}
+
+// leaseDirs is like leaseDir, but for two directories, which may be the same.
+// The leases are always taken in inode number order so two machines renaming
+// in opposite directions cannot deadlock.
+func (rn *RootNode) leaseDirs(dirfd1 int, dirfd2 int) (release func(), errno syscall.Errno) {
+	if !rn.args.SharedStorage || rn.args.PlaintextNames {
+		return func() {}, 0
+	}
+	var st1, st2 syscall.Stat_t
+	if err := syscall.Fstat(dirfd1, &st1); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	if err := syscall.Fstat(dirfd2, &st2); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	if st1.Dev == st2.Dev && st1.Ino == st2.Ino {
+		return rn.leaseDir(dirfd1)
+	}
+	if st2.Ino < st1.Ino {
+		dirfd1, dirfd2 = dirfd2, dirfd1
+	}
+	release1, errno := rn.leaseDir(dirfd1)
+	if errno != 0 {
+		return nil, errno
+	}
+	release2, errno := rn.leaseDir(dirfd2)
+	if errno != 0 {
+		release1()
+		return nil, errno
+	}
+	return func() {
+		release2()
+		release1()
+	}, 0
+}
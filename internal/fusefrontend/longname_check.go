@@ -0,0 +1,124 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// LongNameProblem is an inconsistent gocryptfs.longname.* file found by
+// CheckLongNames
+type LongNameProblem struct {
+	// CName is the name of the file in the backing directory
+	CName string
+	// Problem describes what is wrong
+	Problem string
+	// orphan is set for a ".name" file without content file
+	orphan bool
+}
+
+// CheckLongNames cross-checks the gocryptfs.longname.* content files of the
+// directory "plainPath" against their ".name" companions. It finds content
+// files whose ".name" file is missing, unreadable or belongs to another
+// name, and ".name" files without content file. Interrupted renames leave
+// these behind. Used by "-fsck".
+func (rn *RootNode) CheckLongNames(plainPath string) ([]LongNameProblem, error) {
+	if !rn.args.LongNames {
+		return nil, nil
+	}
+	if !rn.rlockKeys() {
+		return nil, syscall.EACCES
+	}
+	defer rn.keyLock.RUnlock()
+	fd, err := rn.openEncryptedDir(plainPath)
+	if err != nil || fd < 0 {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	entries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		names[e.Name] = struct{}{}
+	}
+	nameTransform := rn.pathNameTransform(plainPath)
+	var problems []LongNameProblem
+	for _, e := range entries {
+		switch nametransform.NameType(e.Name) {
+		case nametransform.LongNameFilename:
+			if _, ok := names[nametransform.RemoveLongNameSuffix(e.Name)]; !ok {
+				problems = append(problems, LongNameProblem{
+					CName:   e.Name,
+					Problem: "orphaned " + nametransform.LongNameSuffix + " file without content file",
+					orphan:  true,
+				})
+			}
+		case nametransform.LongNameContent:
+			var problem string
+			if _, ok := names[e.Name+nametransform.LongNameSuffix]; !ok {
+				problem = nametransform.LongNameSuffix + " file is missing"
+			} else if cNameLong, err := nametransform.ReadLongNameAt(fd, e.Name); err != nil {
+				problem = fmt.Sprintf("%s file is unreadable: %v", nametransform.LongNameSuffix, err)
+			} else if nameTransform.HashLongName(cNameLong) != e.Name {
+				problem = nametransform.LongNameSuffix + " file belongs to another name"
+			}
+			if problem != "" {
+				problems = append(problems, LongNameProblem{CName: e.Name, Problem: problem})
+			}
+		}
+	}
+	return problems, nil
+}
+
+// RepairLongName fixes a problem found by CheckLongNames in the directory
+// "plainPath". Orphaned ".name" files are deleted. The name of a content
+// file without a valid ".name" file is lost, so it is moved to
+// "lostFoundName" like RepairDirIV does, and the invalid ".name" file is
+// deleted. Returns what has been done.
+func (rn *RootNode) RepairLongName(plainPath string, p LongNameProblem, lostFoundName string) (string, error) {
+	if !rn.rlockKeys() {
+		return "", syscall.EACCES
+	}
+	defer rn.keyLock.RUnlock()
+	fd, err := rn.openEncryptedDir(plainPath)
+	if err != nil {
+		return "", err
+	}
+	if fd < 0 {
+		return "", syscall.EINVAL
+	}
+	defer syscall.Close(fd)
+	if p.orphan {
+		if err := syscallcompat.Unlinkat(fd, p.CName, 0); err != nil {
+			return "", err
+		}
+		rn.log.Info.Printf("RepairLongName %q: deleted %q", tlog.PlainName(plainPath), p.CName)
+		return "deleted", nil
+	}
+	lostFound := rn.lostFoundPath(plainPath, lostFoundName)
+	lfFd, err := rn.mkdirLostFound(lostFound)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(lfFd)
+	lfIV, err := nametransform.ReadDirIVAt(lfFd)
+	if err != nil {
+		return "", err
+	}
+	newName, err := rn.moveToLostFound(fd, p.CName, lfFd, lfIV, rn.pathNameTransform(lostFound))
+	if err != nil {
+		return "", err
+	}
+	err = syscallcompat.Unlinkat(fd, p.CName+nametransform.LongNameSuffix, 0)
+	if err != nil && err != syscall.ENOENT {
+		tlog.Warn.Printf("RepairLongName: %v", err)
+	}
+	newPath := lostFound + "/" + newName
+	rn.log.Info.Printf("RepairLongName %q: moved %q to %q", tlog.PlainName(plainPath), p.CName, tlog.PlainName(newPath))
+	return fmt.Sprintf("moved to %q", newPath), nil
+}
@@ -0,0 +1,102 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+func TestCheckLongNames(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "longname_check_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rn := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	var out fuse.EntryOut
+	var cNames []string
+	for _, c := range []string{"a", "b", "c"} {
+		name := strings.Repeat(c, 200)
+		_, fh, _, errno := rn.Create(ctx, name, syscall.O_RDWR, 0600, &out)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		fh.(*File).Release(ctx)
+		cName, err := rn.EncryptPath(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cNames = append(cNames, cName)
+	}
+	if problems, err := rn.CheckLongNames(""); len(problems) != 0 || err != nil {
+		t.Fatalf("intact dir: %v, %v", problems, err)
+	}
+	// "a" lost its .name file, "b" has the .name file of "c", and "c" left
+	// an orphaned .name file behind
+	abs := func(cName string) string {
+		return filepath.Join(cipherdir, cName)
+	}
+	if err = os.Remove(abs(cNames[0] + nametransform.LongNameSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(abs(cNames[1] + nametransform.LongNameSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Link(abs(cNames[2]+nametransform.LongNameSuffix), abs(cNames[1]+nametransform.LongNameSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(abs(cNames[2])); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := rn.CheckLongNames("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 3 {
+		t.Fatalf("want 3 problems, got %v", problems)
+	}
+	for _, p := range problems {
+		done, err := rn.RepairLongName("", p, "lost+found")
+		if err != nil {
+			t.Fatalf("%q: %v", p.CName, err)
+		}
+		if p.orphan != (done == "deleted") {
+			t.Errorf("%q: %s", p.CName, done)
+		}
+	}
+	if problems, err := rn.CheckLongNames(""); len(problems) != 0 || err != nil {
+		t.Errorf("repaired dir: %v, %v", problems, err)
+	}
+	for _, cName := range cNames {
+		if _, err := os.Lstat(abs(cName)); !os.IsNotExist(err) {
+			t.Errorf("%q is still there: %v", cName, err)
+		}
+	}
+	lfInode, errno := rn.Lookup(ctx, "lost+found", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("lost+found", lfInode, false)
+	names := listNames(t, lfInode.Operations().(*Node))
+	if len(names) != 2 {
+		t.Errorf("wrong lost+found listing: %v", names)
+	}
+}
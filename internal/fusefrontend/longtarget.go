@@ -0,0 +1,132 @@
+package fusefrontend
+
+// Symlinks whose encrypted target is too long for a symlink point to a
+// gocryptfs.longtarget.* file in the same directory that stores the target.
+// The file is hard-linked into every directory that has a link to the
+// symlink, and deleted with the last link in its directory.
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// symlinkAt creates the symlink "cName" in "dirfd" that points to the
+// encrypted target "cTarget". Targets that do not fit into a symlink are
+// stored in a long target file if "-longnames" is on.
+//
+// Symlink-safe through SymlinkatUser().
+func (n *Node) symlinkAt(cTarget string, dirfd int, cName string, ctx *fuse.Context) error {
+	rn := n.rootNode()
+	if len(cTarget) <= nametransform.MaxSymlinkTarget {
+		err := syscallcompat.SymlinkatUser(cTarget, dirfd, cName, ctx)
+		// The backing filesystem may have a lower limit
+		if err != syscall.ENAMETOOLONG || n.plaintextNames() || !rn.args.LongNames {
+			return err
+		}
+	} else if n.plaintextNames() || !rn.args.LongNames {
+		return syscall.ENAMETOOLONG
+	}
+	lt, err := nametransform.WriteLongTargetAt(dirfd, cTarget)
+	if err != nil {
+		return err
+	}
+	rn.syncEntry(dirfd, lt)
+	rn.syncDir(dirfd)
+	err = syscallcompat.SymlinkatUser(lt, dirfd, cName, ctx)
+	if err != nil {
+		nametransform.DeleteLongTargetAt(dirfd, lt)
+	}
+	return err
+}
+
+// readLongTarget returns the encrypted target stored in the long target
+// file "cTarget" points to, or "cTarget" itself
+func readLongTarget(dirfd int, cTarget string) (string, error) {
+	if !nametransform.IsLongTarget(cTarget) {
+		return cTarget, nil
+	}
+	return nametransform.ReadLongTargetAt(dirfd, cTarget)
+}
+
+// longTargetAt returns the long target file of the symlink "cName" in
+// "dirfd", and the link count of the symlink. Returns "" if "cName" is not a
+// symlink with a long target file.
+//
+// Symlink-safe through Fstatat() and Readlinkat().
+func longTargetAt(dirfd int, cName string) (lt string, nlink uint64) {
+	var st unix.Stat_t
+	if err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return "", 0
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		return "", 0
+	}
+	cTarget, err := syscallcompat.Readlinkat(dirfd, cName)
+	if err != nil || !nametransform.IsLongTarget(cTarget) {
+		return "", 0
+	}
+	return cTarget, uint64(st.Nlink)
+}
+
+// longTargetMove takes the long target file along when a symlink gets a
+// link in another directory
+type longTargetMove struct {
+	fromFd, toFd int
+	// lt is the long target file, nlink the link count of the symlink
+	lt    string
+	nlink uint64
+	// created is set if the link in "toFd" is new
+	created bool
+}
+
+// prepareLongTargetMove links the long target file of the symlink "cName"
+// in "fromFd" into "toFd". Returns nil if there is nothing to do.
+//
+// Symlink-safe through Linkat().
+func prepareLongTargetMove(fromFd int, cName string, toFd int) (*longTargetMove, syscall.Errno) {
+	lt, nlink := longTargetAt(fromFd, cName)
+	if lt == "" || sameDir(fromFd, toFd) {
+		return nil, 0
+	}
+	m := &longTargetMove{fromFd: fromFd, toFd: toFd, lt: lt, nlink: nlink}
+	err := syscallcompat.Linkat(fromFd, lt, toFd, lt, 0)
+	// Another link to the symlink may have brought it already
+	if err == nil {
+		m.created = true
+	} else if err != syscall.EEXIST {
+		tlog.Warn.Printf("longTargetMove: %v", err)
+		return nil, syscall.EIO
+	}
+	return m, 0
+}
+
+// moved finishes the move after the symlink has left "fromFd": the last
+// link in that directory takes the long target file with it
+func (m *longTargetMove) moved() {
+	if m != nil && m.nlink == 1 {
+		nametransform.DeleteLongTargetAt(m.fromFd, m.lt)
+	}
+}
+
+// undo removes the link that prepareLongTargetMove() has created
+func (m *longTargetMove) undo() {
+	if m != nil && m.created {
+		nametransform.DeleteLongTargetAt(m.toFd, m.lt)
+	}
+}
+
+// sameDir returns true if "fd1" and "fd2" are the same directory
+func sameDir(fd1 int, fd2 int) bool {
+	var st1, st2 syscall.Stat_t
+	if syscall.Fstat(fd1, &st1) != nil || syscall.Fstat(fd2, &st2) != nil {
+		return false
+	}
+	return st1.Dev == st2.Dev && st1.Ino == st2.Ino
+}
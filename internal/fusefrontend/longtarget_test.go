@@ -0,0 +1,119 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// countLongTargets returns the number of long target files in "dir"
+func countLongTargets(t *testing.T, dir string) int {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, e := range entries {
+		if nametransform.IsLongTarget(e.Name()) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLongSymlinkTarget(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "longtarget_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rn := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	ctx := context.Background()
+	var out fuse.EntryOut
+	inode, errno := rn.Mkdir(ctx, "dir", 0700, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("dir", inode, false)
+	dir := inode.Operations().(*Node)
+	cDirName, err := rn.EncryptPath("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cDir := filepath.Join(cipherdir, cDirName)
+
+	target := "/" + strings.Repeat("x", 4000)
+	inode, errno = rn.Symlink(ctx, target, "link", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("link", inode, false)
+	if got, errno := inode.Operations().(*Node).Readlink(ctx); errno != 0 || string(got) != target {
+		t.Errorf("Readlink: %d bytes, %v", len(got), errno)
+	}
+	if out.Attr.Size != uint64(len(target)) {
+		t.Errorf("want size %d, got %d", len(target), out.Attr.Size)
+	}
+	if n := countLongTargets(t, cipherdir); n != 1 {
+		t.Fatalf("want 1 long target file, got %d", n)
+	}
+	// Short targets are stored in the symlink
+	if _, errno = rn.Symlink(ctx, "short", "short", &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if n := countLongTargets(t, cipherdir); n != 1 {
+		t.Errorf("want 1 long target file, got %d", n)
+	}
+	// A hard link in another directory needs a copy
+	if _, errno = dir.Link(ctx, inode.Operations(), "link2", &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if n := countLongTargets(t, cDir); n != 1 {
+		t.Errorf("link: want 1 long target file in dir, got %d", n)
+	}
+	if errno = dir.Unlink(ctx, "link2"); errno != 0 {
+		t.Fatal(errno)
+	}
+	// Not the last link, so the file stays
+	if n := countLongTargets(t, cDir); n != 1 {
+		t.Errorf("unlink: want 1 long target file in dir, got %d", n)
+	}
+	// The file moves along
+	if errno = rn.Rename(ctx, "link", dir, "moved", 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if n := countLongTargets(t, cipherdir); n != 0 {
+		t.Errorf("rename: want 0 long target files in the root, got %d", n)
+	}
+	inode, errno = dir.Lookup(ctx, "moved", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	dir.AddChild("moved", inode, false)
+	if got, errno := inode.Operations().(*Node).Readlink(ctx); errno != 0 || string(got) != target {
+		t.Errorf("Readlink after rename: %d bytes, %v", len(got), errno)
+	}
+	if errno = dir.Unlink(ctx, "moved"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if n := countLongTargets(t, cDir); n != 0 {
+		t.Errorf("unlink: want 0 long target files in dir, got %d", n)
+	}
+}
@@ -0,0 +1,45 @@
+package fusefrontend
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// SMB, NFS and rclone mounts sometimes fail an operation with EIO or
+// ESTALE that succeeds when it is repeated a moment later, for example
+// after a reconnect. With "-network-storage", we retry these.
+const (
+	networkRetries    = 3
+	networkRetryDelay = 100 * time.Millisecond
+)
+
+// isTransient returns true for errors that network filesystems return
+// spuriously
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ESTALE)
+}
+
+// retry calls "op" and, with "-network-storage", calls it again with
+// increasing delays as long as it fails with a transient error. "op" must
+// be safe to repeat.
+func (rn *RootNode) retry(what string, op func() error) error {
+	err := op()
+	if !rn.args.NetworkStorage {
+		return err
+	}
+	for i := 0; i < networkRetries && isTransient(err); i++ {
+		rn.log.Debug.Printf("%s: %v, retrying", what, err)
+		time.Sleep(networkRetryDelay << uint(i))
+		err = op()
+	}
+	return err
+}
+
+// isFsyncUnsupported returns true for the errors that network filesystems
+// return when they cannot fsync. The data is on its way to the server
+// anyway, so "-network-storage" reports success.
+func isFsyncUnsupported(err error) bool {
+	return errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSYS) ||
+		errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP)
+}
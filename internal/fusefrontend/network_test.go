@@ -0,0 +1,40 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+func TestRetry(t *testing.T) {
+	failures := func(n int, errno syscall.Errno) (func() error, *int) {
+		calls := 0
+		return func() error {
+			calls++
+			if calls <= n {
+				return &os.PathError{Op: "read", Path: "x", Err: errno}
+			}
+			return nil
+		}, &calls
+	}
+	rn := &RootNode{args: Args{NetworkStorage: true}, log: tlog.ProcessLoggers()}
+	op, calls := failures(2, syscall.ESTALE)
+	if err := rn.retry("test", op); err != nil || *calls != 3 {
+		t.Errorf("ESTALE: err=%v after %d calls", err, *calls)
+	}
+	op, calls = failures(1, syscall.ENOENT)
+	if err := rn.retry("test", op); err == nil || *calls != 1 {
+		t.Errorf("ENOENT must not be retried: err=%v after %d calls", err, *calls)
+	}
+	op, calls = failures(networkRetries+1, syscall.EIO)
+	if err := rn.retry("test", op); err == nil || *calls != networkRetries+1 {
+		t.Errorf("persistent EIO: err=%v after %d calls", err, *calls)
+	}
+	rn.args.NetworkStorage = false
+	op, calls = failures(1, syscall.EIO)
+	if err := rn.retry("test", op); err == nil || *calls != 1 {
+		t.Errorf("without -network-storage: err=%v after %d calls", err, *calls)
+	}
+}
@@ -2,6 +2,7 @@ package fusefrontend
 
 import (
 	"context"
+	"path/filepath"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -9,7 +10,10 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/HorizonLiu/gocryptfs/internal/inomap"
+	"github.com/HorizonLiu/gocryptfs/internal/journal"
 	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/quota"
 	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
 )
@@ -18,6 +22,14 @@ import (
 // in a gocryptfs mount.
 type Node struct {
 	fs.Inode
+	// mode is the dirMode of the directory, or of the directory that
+	// contains the file. Accessed atomically because SetDirPolicy() can
+	// change it.
+	mode uint32
+	// tenantIdx is the index+1 of the tenant whose keys are used for the
+	// directory, or for the directory that contains the file. 0 means the
+	// keys of the root directory. Accessed atomically like "mode".
+	tenantIdx uint32
 }
 
 // Lookup - FUSE call for discovering a file.
@@ -29,13 +41,25 @@ func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (ch
 	defer syscall.Close(dirfd)
 
 	// Get device number and inode number into `st`
-	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	var st *syscall.Stat_t
+	err := n.rootNode().retry("Lookup", func() (err error) {
+		st, err = syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+		return err
+	})
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
 
 	// Create new inode and fill `out`
 	ch = n.newChild(ctx, st, out)
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		child := toNode(ch.Operations())
+		child.setDirMode(n.rootNode().childDirMode(n.dirMode(), dirfd, cName))
+		if n.IsRoot() {
+			child.setTenant(n.rootNode().tenantByName(name))
+		}
+		n.rootNode().watchDir(child, dirfd, cName)
+	}
 
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
 	n.translateSize(dirfd, cName, &out.Attr)
@@ -58,22 +82,36 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 	}
 	defer syscall.Close(dirfd)
 
-	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	rn := n.rootNode()
+	var st *syscall.Stat_t
+	err := rn.retry("Getattr", func() (err error) {
+		st, err = syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+		return err
+	})
 	if err != nil {
 		return fs.ToErrno(err)
 	}
+	// Buffered appends change the size
+	if rn.args.CoalesceWrites {
+		if e := rn.fileTable.Lookup(inomap.QInoFromStat(st)); e != nil {
+			if errno = syncPending(e); errno != 0 {
+				return errno
+			}
+			st, err = syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+			if err != nil {
+				return fs.ToErrno(err)
+			}
+		}
+	}
 
 	// Fix inode number
-	rn := n.rootNode()
 	rn.inoMap.TranslateStat(st)
 	out.Attr.FromStat(st)
 
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
 	n.translateSize(dirfd, cName, &out.Attr)
 
-	if rn.args.ForceOwner != nil {
-		out.Owner = *rn.args.ForceOwner
-	}
+	rn.presentAttr(&out.Attr)
 	return 0
 }
 
@@ -81,19 +119,53 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 //
 // Symlink-safe through use of Unlinkat().
 func (n *Node) Unlink(ctx context.Context, name string) (errno syscall.Errno) {
+	if n.rootNode().args.Audit != nil {
+		defer n.audit(ctx, "unlink", filepath.Join(n.Path(), name), "", 0, &errno)
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
+	release, errno := n.rootNode().leaseDir(dirfd)
+	if errno != 0 {
+		return
+	}
+	defer release()
 
+	// Cached fds would keep the file's disk space allocated
+	rn := n.rootNode()
+	if rn.fdCache != nil {
+		rn.fdCache.evictAt(dirfd, cName)
+	}
+	// "-quota"
+	trees := n.childQuotaTrees(name)
+	var freed int64
+	if len(trees) > 0 {
+		freed = n.quotaFreed(dirfd, cName, false)
+	}
+	// The long target file of a symlink goes with its last link
+	var lt string
+	var nlink uint64
+	if !n.plaintextNames() {
+		lt, nlink = longTargetAt(dirfd, cName)
+	}
+	if !n.plaintextNames() && nametransform.IsLongContent(cName) {
+		defer rn.journalBegin(dirfd, journal.OpLongName, cName, "")()
+	}
 	// Delete content
 	err := syscallcompat.Unlinkat(dirfd, cName, 0)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
+	rn.uncharge(trees, freed)
+	// "-syncdir": the entry must be gone before the files it needs
+	rn.syncDir(dirfd)
+	if lt != "" && nlink == 1 {
+		nametransform.DeleteLongTargetAt(dirfd, lt)
+	}
 	// Delete ".name" file
-	if !n.rootNode().args.PlaintextNames && nametransform.IsLongContent(cName) {
+	if !n.plaintextNames() && nametransform.IsLongContent(cName) {
 		err = nametransform.DeleteLongNameAt(dirfd, cName)
 		if err != nil {
 			tlog.Warn.Printf("Unlink: could not delete .name file: %v", err)
@@ -119,8 +191,7 @@ func (n *Node) Readlink(ctx context.Context) (out []byte, errno syscall.Errno) {
 func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) (errno syscall.Errno) {
 	// Use the fd if the kernel gave us one
 	if f != nil {
-		f2 := f.(*File)
-		return f2.Setattr(ctx, in, out)
+		return f.(fs.FileSetattrer).Setattr(ctx, in, out)
 	}
 
 	dirfd, cName, errno := n.prepareAtSyscall("")
@@ -142,18 +213,7 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 	}
 
 	// chown(2)
-	uid32, uOk := in.GetUID()
-	gid32, gOk := in.GetGID()
-	if uOk || gOk {
-		uid := -1
-		gid := -1
-
-		if uOk {
-			uid = int(uid32)
-		}
-		if gOk {
-			gid = int(gid32)
-		}
+	if uid, gid := n.rootNode().hostOwner(in); uid != -1 || gid != -1 {
 		errno = fs.ToErrno(syscallcompat.Fchownat(dirfd, cName, uid, gid, unix.AT_SYMLINK_NOFOLLOW))
 		if errno != 0 {
 			return errno
@@ -185,8 +245,17 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 		if errno != 0 {
 			return errno
 		}
+		if pf, ok := f.(*passthroughFile); ok {
+			defer pf.Release(ctx)
+			return pf.Setattr(ctx, &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: sz}}, out)
+		}
 		f2 := f.(*File)
 		defer f2.Release(ctx)
+		if rn := n.rootNode(); rn.args.CoalesceWrites {
+			if errno = syncPending(f2.fileTableEntry); errno != 0 {
+				return errno
+			}
+		}
 		errno = syscall.Errno(f2.truncate(sz))
 		if errno != 0 {
 			return errno
@@ -199,15 +268,25 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 
 // StatFs - FUSE call. Returns information about the filesystem.
 //
+// Unless "-statfs=raw" was passed, the block counts are converted to
+// plaintext terms, so that applications checking for free space do not
+// over-commit.
+//
 // Symlink-safe because the path is ignored.
 func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
-	p := n.rootNode().args.Cipherdir
+	rn := n.rootNode()
 	var st syscall.Statfs_t
-	err := syscall.Statfs(p, &st)
+	err := syscall.Statfs(rn.args.Cipherdir, &st)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
 	out.FromStatfsT(&st)
+	if !rn.args.StatfsRaw {
+		rn.statfsToPlain(out)
+	}
+	if rn.args.NameMax > 0 && !rn.args.PlaintextNames {
+		out.NameLen = uint32(rn.args.NameMax)
+	}
 	return 0
 }
 
@@ -220,18 +299,25 @@ func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *f
 		return
 	}
 	defer syscall.Close(dirfd)
+	release, errno := n.rootNode().leaseDir(dirfd)
+	if errno != 0 {
+		return
+	}
+	defer release()
 
 	// Make sure context is nil if we don't want to preserve the owner
 	rn := n.rootNode()
 	if !rn.args.PreserveOwner {
 		ctx = nil
 	}
+	mode = rn.createMode(mode, false)
 
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	var err error
-	ctx2 := toFuseCtx(ctx)
-	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
-		err := rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+	ctx2 := rn.toFuseCtx(ctx)
+	if !n.plaintextNames() && nametransform.IsLongContent(cName) {
+		defer rn.journalBegin(dirfd, journal.OpLongName, cName, "")()
+		err := n.writeLongName(dirfd, cName, name)
 		if err != nil {
 			errno = fs.ToErrno(err)
 			return
@@ -249,6 +335,12 @@ func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *f
 		errno = fs.ToErrno(err)
 		return
 	}
+	rn.syncDir(dirfd)
+	if rn.args.ExactModes {
+		if err = syscallcompat.FchmodatNofollow(dirfd, cName, mode&07777); err != nil {
+			tlog.Warn.Printf("Mknod %q: Fchmod %#o failed: %v", tlog.CipherName(cName), mode&07777, err)
+		}
+	}
 
 	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
 	if err != nil {
@@ -264,11 +356,25 @@ func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *f
 //
 // Symlink-safe through use of Linkat().
 func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	// The contents are stored differently below a directory policy, and
+	// tenants have keys of their own
+	if toNode(target).dirMode() != n.dirMode() || toNode(target).tenant() != n.tenant() {
+		return nil, syscall.EXDEV
+	}
+	// The bytes of the file are charged to the quotas of the old name
+	if !quota.SameTrees(toNode(target).quotaTrees(), n.childQuotaTrees(name)) {
+		return nil, syscall.EXDEV
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
+	release, errno := n.rootNode().leaseDir(dirfd)
+	if errno != 0 {
+		return
+	}
+	defer release()
 
 	n2 := toNode(target)
 	dirfd2, cName2, errno := n2.prepareAtSyscall("")
@@ -277,12 +383,23 @@ func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, o
 	}
 	defer syscall.Close(dirfd2)
 
+	// A symlink needs its long target file in the new directory
+	var m *longTargetMove
+	if !n.plaintextNames() {
+		if m, errno = prepareLongTargetMove(dirfd2, cName2, dirfd); errno != 0 {
+			return
+		}
+		if m != nil {
+			n.rootNode().syncDir(dirfd)
+		}
+	}
 	// Handle long file name (except in PlaintextNames mode)
-	rn := n.rootNode()
 	var err error
-	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
-		err = rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+	if !n.plaintextNames() && nametransform.IsLongContent(cName) {
+		defer n.rootNode().journalBegin(dirfd, journal.OpLongName, cName, "")()
+		err = n.writeLongName(dirfd, cName, name)
 		if err != nil {
+			m.undo()
 			errno = fs.ToErrno(err)
 			return
 		}
@@ -296,9 +413,11 @@ func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, o
 		err = syscallcompat.Linkat(dirfd2, cName2, dirfd, cName, 0)
 	}
 	if err != nil {
+		m.undo()
 		errno = fs.ToErrno(err)
 		return
 	}
+	n.rootNode().syncDir(dirfd)
 
 	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
 	if err != nil {
@@ -318,6 +437,11 @@ func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.Entry
 		return
 	}
 	defer syscall.Close(dirfd)
+	release, errno := n.rootNode().leaseDir(dirfd)
+	if errno != 0 {
+		return
+	}
+	defer release()
 
 	// Make sure context is nil if we don't want to preserve the owner
 	rn := n.rootNode()
@@ -326,28 +450,34 @@ func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.Entry
 	}
 
 	cTarget := target
-	if !rn.args.PlaintextNames {
+	if !n.plaintextNames() {
 		// Symlinks are encrypted like file contents (GCM) and base64-encoded
-		cTarget = rn.encryptSymlinkTarget(target)
+		cTarget = n.encryptSymlinkTarget(target)
 	}
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	var err error
-	ctx2 := toFuseCtx(ctx)
-	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
-		err = rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+	ctx2 := rn.toFuseCtx(ctx)
+	if !n.plaintextNames() && nametransform.IsLongContent(cName) {
+		defer rn.journalBegin(dirfd, journal.OpLongName, cName, "")()
+		err = n.writeLongName(dirfd, cName, name)
 		if err != nil {
 			errno = fs.ToErrno(err)
 			return
 		}
 		// Create "gocryptfs.longfile." symlink
-		err = syscallcompat.SymlinkatUser(cTarget, dirfd, cName, ctx2)
+		err = n.symlinkAt(cTarget, dirfd, cName, ctx2)
 		if err != nil {
 			nametransform.DeleteLongNameAt(dirfd, cName)
 		}
 	} else {
 		// Create symlink
-		err = syscallcompat.SymlinkatUser(cTarget, dirfd, cName, ctx2)
+		err = n.symlinkAt(cTarget, dirfd, cName, ctx2)
 	}
+	if err != nil {
+		errno = fs.ToErrno(err)
+		return
+	}
+	rn.syncDir(dirfd)
 
 	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
 	if err != nil {
@@ -355,25 +485,28 @@ func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.Entry
 		return
 	}
 	inode = n.newChild(ctx, st, out)
+	// Report the plaintext size, not the size of the symlink target or of
+	// the long target file name
+	out.Attr.Size = uint64(len(target))
 	return inode, 0
 }
 
 // xfstests generic/013 now also exercises RENAME_EXCHANGE and RENAME_WHITEOUT,
 // uncovering lots of problems with longnames
 //
-// Reject those flags with syscall.EINVAL.
+// Reject unsupported flags with syscall.EINVAL.
 // If we can handle the flags, this function returns 0.
 func rejectRenameFlags(flags uint32) syscall.Errno {
 	// Normal rename, we can handle that
 	if flags == 0 {
 		return 0
 	}
-	// We also can handle RENAME_NOREPLACE
-	if flags == syscallcompat.RENAME_NOREPLACE {
+	// We also can handle RENAME_NOREPLACE and RENAME_EXCHANGE
+	// (but not both at once, which the kernel rejects anyway)
+	if flags == syscallcompat.RENAME_NOREPLACE || flags == syscallcompat.RENAME_EXCHANGE {
 		return 0
 	}
-	// We cannot handle RENAME_EXCHANGE and RENAME_WHITEOUT yet.
-	// Needs extra code for .name files.
+	// We cannot handle RENAME_WHITEOUT yet.
 	return syscall.EINVAL
 }
 
@@ -382,9 +515,26 @@ func rejectRenameFlags(flags uint32) syscall.Errno {
 //
 // Symlink-safe through Renameat().
 func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) (errno syscall.Errno) {
+	if n.rootNode().args.Audit != nil {
+		defer n.audit(ctx, "rename", filepath.Join(n.Path(), name),
+			filepath.Join(toNode(newParent).Path(), newName), 0, &errno)
+	}
 	if errno = rejectRenameFlags(flags); errno != 0 {
 		return errno
 	}
+	// Entries cannot move in or out of a directory policy or a tenant
+	if toNode(newParent).dirMode() != n.dirMode() || toNode(newParent).tenant() != n.tenant() {
+		return syscall.EXDEV
+	}
+	if n.isTenantRoot(name) || toNode(newParent).isTenantRoot(newName) {
+		return syscall.EPERM
+	}
+	// Like between XFS project quotas. "mv" copies the files instead, which
+	// charges them to the new quota.
+	trees := n.childQuotaTrees(name)
+	if !quota.SameTrees(trees, toNode(newParent).childQuotaTrees(newName)) {
+		return syscall.EXDEV
+	}
 
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
@@ -399,27 +549,98 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 	}
 	defer syscall.Close(dirfd2)
 
-	// Easy case.
 	rn := n.rootNode()
-	if rn.args.PlaintextNames {
-		return fs.ToErrno(syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags)))
+	release, errno := rn.leaseDirs(dirfd, dirfd2)
+	if errno != 0 {
+		return
+	}
+	defer release()
+	// A file that is replaced by the rename must not stay open in the cache
+	if rn.fdCache != nil {
+		rn.fdCache.evictAt(dirfd2, cName2)
+	}
+	// The bytes of a file that is replaced are freed
+	if len(trees) > 0 && flags&syscallcompat.RENAME_EXCHANGE == 0 {
+		freed := n2.quotaFreed(dirfd2, cName2, false)
+		defer func() {
+			if errno == 0 {
+				rn.uncharge(trees, freed)
+			}
+		}()
+	}
+
+	// Easy case.
+	if n.plaintextNames() {
+		err := syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
+		if err == nil {
+			rn.syncDir(dirfd2)
+			rn.syncDir(dirfd)
+		}
+		return fs.ToErrno(err)
+	}
+	// Exchange: both names already exist and keep existing, only the files
+	// behind them are swapped. The .name files belong to the names, so they
+	// are still correct afterwards and must not be touched.
+	// Directories carry their own gocryptfs.diriv, so their contents stay
+	// decryptable in the new location as well.
+	// Symlinks take their long target files along.
+	if flags&syscallcompat.RENAME_EXCHANGE != 0 {
+		m, errno := prepareLongTargetMove(dirfd, cName, dirfd2)
+		if errno != 0 {
+			return errno
+		}
+		m2, errno := prepareLongTargetMove(dirfd2, cName2, dirfd)
+		if errno != 0 {
+			m.undo()
+			return errno
+		}
+		if m != nil || m2 != nil {
+			rn.syncDir(dirfd2)
+			rn.syncDir(dirfd)
+		}
+		rn.log.Debug.Printf("Renameat2 RENAME_EXCHANGE %d/%s <-> %d/%s\n", dirfd, tlog.CipherName(cName), dirfd2, tlog.CipherName(cName2))
+		err := syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
+		if err != nil {
+			m.undo()
+			m2.undo()
+			return fs.ToErrno(err)
+		}
+		rn.syncDir(dirfd2)
+		rn.syncDir(dirfd)
+		m.moved()
+		m2.moved()
+		return 0
+	}
+	// A symlink that is replaced leaves its long target file behind
+	replacedLt, replacedNlink := longTargetAt(dirfd2, cName2)
+	m, errno := prepareLongTargetMove(dirfd, cName, dirfd2)
+	if errno != 0 {
+		return errno
+	}
+	if m != nil {
+		rn.syncDir(dirfd2)
 	}
 	// Long destination file name: create .name file
 	nameFileAlreadyThere := false
 	var err error
 	if nametransform.IsLongContent(cName2) {
-		err = rn.nameTransform.WriteLongNameAt(dirfd2, cName2, newName)
+		defer rn.journalBegin(dirfd2, journal.OpLongName, cName2, "")()
+		err = n.writeLongName(dirfd2, cName2, newName)
 		// Failure to write the .name file is expected when the target path already
 		// exists. Since hashes are pretty unique, there is no need to modify the
 		// .name file in this case, and we ignore the error.
 		if err == syscall.EEXIST {
 			nameFileAlreadyThere = true
 		} else if err != nil {
+			m.undo()
 			return fs.ToErrno(err)
 		}
 	}
+	if nametransform.IsLongContent(cName) {
+		defer rn.journalBegin(dirfd, journal.OpLongName, cName, "")()
+	}
 	// Actual rename
-	tlog.Debug.Printf("Renameat %d/%s -> %d/%s\n", dirfd, cName, dirfd2, cName2)
+	rn.log.Debug.Printf("Renameat %d/%s -> %d/%s\n", dirfd, tlog.CipherName(cName), dirfd2, tlog.CipherName(cName2))
 	err = syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
 	if (flags&syscallcompat.RENAME_NOREPLACE == 0) && (err == syscall.ENOTEMPTY || err == syscall.EEXIST) {
 		// If an empty directory is overwritten we will always get an error as
@@ -427,7 +648,7 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 		// Interestingly, ext4 returns ENOTEMPTY while xfs returns EEXIST.
 		// We handle that by trying to fs.Rmdir() the target directory and trying
 		// again.
-		tlog.Debug.Printf("Rename: Handling ENOTEMPTY")
+		rn.log.Debug.Printf("Rename: Handling ENOTEMPTY")
 		if n2.Rmdir(ctx, newName) == 0 {
 			err = syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
 		}
@@ -437,10 +658,17 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 			// Roll back .name creation unless the .name file was already there
 			nametransform.DeleteLongNameAt(dirfd2, cName2)
 		}
+		m.undo()
 		return fs.ToErrno(err)
 	}
+	rn.syncDir(dirfd2)
+	rn.syncDir(dirfd)
 	if nametransform.IsLongContent(cName) {
 		nametransform.DeleteLongNameAt(dirfd, cName)
 	}
+	m.moved()
+	if replacedLt != "" && replacedNlink == 1 && (m == nil || replacedLt != m.lt) {
+		nametransform.DeleteLongTargetAt(dirfd2, replacedLt)
+	}
 	return 0
 }
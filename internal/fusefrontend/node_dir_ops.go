@@ -15,6 +15,8 @@ import (
 
 	"github.com/HorizonLiu/gocryptfs/internal/configfile"
 	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/journal"
+	"github.com/HorizonLiu/gocryptfs/internal/lease"
 	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
 	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
@@ -42,6 +44,7 @@ func (n *Node) mkdirWithIv(dirfd int, cName string, mode uint32, context *fuse.C
 	// from seeing it.
 	rn.dirIVLock.Lock()
 	defer rn.dirIVLock.Unlock()
+	defer rn.journalBegin(dirfd, journal.OpMkdir, cName, "")()
 	err := syscallcompat.MkdiratUser(dirfd, cName, mode, context)
 	if err != nil {
 		return err
@@ -50,6 +53,10 @@ func (n *Node) mkdirWithIv(dirfd int, cName string, mode uint32, context *fuse.C
 	if err == nil {
 		// Create gocryptfs.diriv
 		err = nametransform.WriteDirIVAt(dirfd2)
+		if err == nil {
+			rn.syncEntry(dirfd2, nametransform.DirIVFilename)
+			rn.syncDir(dirfd2)
+		}
 		syscall.Close(dirfd2)
 	}
 	if err != nil {
@@ -71,19 +78,36 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 		return nil, errno
 	}
 	defer syscall.Close(dirfd)
+	release, errno := n.rootNode().leaseDir(dirfd)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer release()
 
 	rn := n.rootNode()
 	var context *fuse.Context
 	if rn.args.PreserveOwner {
-		context = toFuseCtx(ctx)
+		context = rn.toFuseCtx(ctx)
 	}
+	mode = rn.createMode(mode, true)
 
 	var st syscall.Stat_t
-	if rn.args.PlaintextNames {
+	if n.plaintextNames() {
 		err := syscallcompat.MkdiratUser(dirfd, cName, mode, context)
 		if err != nil {
 			return nil, fs.ToErrno(err)
 		}
+		if rn.args.ExactModes {
+			// Preserve SGID bit if it was set due to inheritance, see below
+			var ust unix.Stat_t
+			err = syscallcompat.Fstatat(dirfd, cName, &ust, unix.AT_SYMLINK_NOFOLLOW)
+			if err == nil {
+				err = syscallcompat.FchmodatNofollow(dirfd, cName, uint32(ust.Mode&07000)|mode&0777)
+			}
+			if err != nil {
+				tlog.Warn.Printf("Mkdir %q: Fchmod %#o failed: %v", tlog.CipherName(cName), mode, err)
+			}
+		}
 		var ust unix.Stat_t
 		err = syscallcompat.Fstatat(dirfd, cName, &ust, unix.AT_SYMLINK_NOFOLLOW)
 		if err != nil {
@@ -100,7 +124,8 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 		// Handle long file name
 		if nametransform.IsLongContent(cName) {
 			// Create ".name"
-			err := rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+			defer rn.journalBegin(dirfd, journal.OpLongName, cName, "")()
+			err := n.writeLongName(dirfd, cName, name)
 			if err != nil {
 				return nil, fs.ToErrno(err)
 			}
@@ -121,30 +146,32 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 		fd, err := syscallcompat.Openat(dirfd, cName,
 			syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 		if err != nil {
-			tlog.Warn.Printf("Mkdir %q: Openat failed: %v", cName, err)
+			tlog.Warn.Printf("Mkdir %q: Openat failed: %v", tlog.CipherName(cName), err)
 			return nil, fs.ToErrno(err)
 		}
 		defer syscall.Close(fd)
 
 		err = syscall.Fstat(fd, &st)
 		if err != nil {
-			tlog.Warn.Printf("Mkdir %q: Fstat failed: %v", cName, err)
+			tlog.Warn.Printf("Mkdir %q: Fstat failed: %v", tlog.CipherName(cName), err)
 			return nil, fs.ToErrno(err)
 		}
 
 		// Fix permissions
-		if origMode != mode {
+		if origMode != mode || rn.args.ExactModes {
 			// Preserve SGID bit if it was set due to inheritance.
-			origMode = uint32(st.Mode&^0777) | origMode
+			origMode = uint32(st.Mode&^0777) | origMode&0777
 			err = syscall.Fchmod(fd, origMode)
 			if err != nil {
-				tlog.Warn.Printf("Mkdir %q: Fchmod %#o -> %#o failed: %v", cName, mode, origMode, err)
+				tlog.Warn.Printf("Mkdir %q: Fchmod %#o -> %#o failed: %v", tlog.CipherName(cName), mode, origMode, err)
 			}
 		}
 	}
 
+	rn.syncDir(dirfd)
 	// Create child node
 	ch := n.newChild(ctx, &st, out)
+	rn.watchDir(toNode(ch.Operations()), dirfd, cName)
 
 	return ch, 0
 }
@@ -170,29 +197,44 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
-	// Get DirIV (stays nil if PlaintextNames is used)
+	// Get DirIV (stays nil if PlaintextNames or a directory policy is used)
 	var cachedIV []byte
 	rn := n.rootNode()
-	if !rn.args.PlaintextNames {
+	plaintextNames := n.plaintextNames()
+	if !plaintextNames {
 		// Read the DirIV from disk
 		cachedIV, err = nametransform.ReadDirIVAt(fd)
 		if err != nil {
-			tlog.Warn.Printf("OpenDir %q: could not read %s: %v", cDirName, nametransform.DirIVFilename, err)
+			tlog.Warn.Printf("OpenDir %q: could not read %s: %v", tlog.CipherName(cDirName), nametransform.DirIVFilename, err)
 			return nil, syscall.EIO
 		}
 	}
 	// Decrypted directory entries
 	var plain []fuse.DirEntry
+	// Only set if there are exclusion rules
+	var plainDir string
+	excluder := rn.getExcluder()
+	if excluder != nil {
+		plainDir = n.Path()
+	}
 	// Add "." and ".."
 	plain = append(plain, specialEntries...)
 	// Filter and decrypt filenames
 	for i := range cipherEntries {
 		cName := cipherEntries[i].Name
-		if n.IsRoot() && cName == configfile.ConfDefaultName {
-			// silently ignore "gocryptfs.conf" in the top level dir
+		if n.IsRoot() && (cName == configfile.ConfDefaultName || cName == journal.FileName) {
+			// silently ignore "gocryptfs.conf" and "gocryptfs.journal" in
+			// the top level dir
 			continue
 		}
-		if rn.args.PlaintextNames {
+		if plaintextNames {
+			if n.isReservedName(cName) {
+				// silently ignore the marker files below a directory policy
+				continue
+			}
+			if excluder != nil && excluder.MatchesPath(filepath.Join(plainDir, cName)) {
+				continue
+			}
 			plain = append(plain, cipherEntries[i])
 			continue
 		}
@@ -200,6 +242,28 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 			// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
 			continue
 		}
+		if lease.IsLeaseFile(cName) {
+			// silently ignore "-sharedstorage" lease files
+			continue
+		}
+		if nametransform.IsLongTarget(cName) {
+			// ignore "gocryptfs.longtarget.*"
+			continue
+		}
+		if n.IsRoot() && len(rn.tenants) > 0 {
+			// Tenant directories are listed even if they are locked
+			if idx := rn.tenantByCName(cName); idx != 0 {
+				name := rn.tenants[idx-1].Name
+				if excluder == nil || !excluder.MatchesPath(filepath.Join(plainDir, name)) {
+					cipherEntries[i].Name = name
+					plain = append(plain, cipherEntries[i])
+				}
+				continue
+			}
+			if rn.args.TenantsOnly {
+				continue
+			}
+		}
 		// Handle long file name
 		isLong := nametransform.LongNameNone
 		if rn.args.LongNames {
@@ -209,7 +273,7 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 			cNameLong, err := nametransform.ReadLongNameAt(fd, cName)
 			if err != nil {
 				tlog.Warn.Printf("OpenDir %q: invalid entry %q: Could not read .name: %v",
-					cDirName, cName, err)
+					tlog.CipherName(cDirName), tlog.CipherName(cName), err)
 				rn.reportMitigatedCorruption(cName)
 				continue
 			}
@@ -218,13 +282,16 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 			// ignore "gocryptfs.longname.*.name"
 			continue
 		}
-		name, err := rn.nameTransform.DecryptName(cName, cachedIV)
+		name, err := n.nameTransformer().DecryptName(cName, cachedIV)
 		if err != nil {
 			tlog.Warn.Printf("OpenDir %q: invalid entry %q: %v",
-				cDirName, cName, err)
+				tlog.CipherName(cDirName), tlog.CipherName(cName), err)
 			rn.reportMitigatedCorruption(cName)
 			continue
 		}
+		if excluder != nil && excluder.MatchesPath(filepath.Join(plainDir, name)) {
+			continue
+		}
 		// Override the ciphertext name with the plaintext name but reuse the rest
 		// of the structure
 		cipherEntries[i].Name = name
@@ -240,14 +307,28 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
 	rn := n.rootNode()
 	p := filepath.Join(n.Path(), name)
+	if rn.args.Audit != nil {
+		defer n.audit(ctx, "rmdir", p, "", 0, &code)
+	}
+	if n.isTenantRoot(name) {
+		return syscall.EPERM
+	}
 	parentDirFd, cName, err := rn.openBackingDir(p)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
 	defer syscall.Close(parentDirFd)
-	if rn.args.PlaintextNames {
+	release, code := rn.leaseDir(parentDirFd)
+	if code != 0 {
+		return code
+	}
+	defer release()
+	if n.plaintextNames() {
 		// Unlinkat with AT_REMOVEDIR is equivalent to Rmdir
 		err = unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
+		if err == nil {
+			rn.syncDir(parentDirFd)
+		}
 		return fs.ToErrno(err)
 	}
 	// Unless we are running as root, we need read, write and execute permissions
@@ -261,13 +342,13 @@ func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
 			return fs.ToErrno(err)
 		}
 		if st.Mode&0700 != 0700 {
-			tlog.Debug.Printf("Rmdir: permWorkaround")
+			rn.log.Debug.Printf("Rmdir: permWorkaround")
 			permWorkaround = true
 			// This cast is needed on Darwin, where st.Mode is uint16.
 			origMode = uint32(st.Mode)
 			err = syscallcompat.FchmodatNofollow(parentDirFd, cName, origMode|0700)
 			if err != nil {
-				tlog.Debug.Printf("Rmdir: permWorkaround: chmod failed: %v", err)
+				rn.log.Debug.Printf("Rmdir: permWorkaround: chmod failed: %v", err)
 				return fs.ToErrno(err)
 			}
 		}
@@ -275,7 +356,7 @@ func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
 	dirfd, err := syscallcompat.Openat(parentDirFd, cName,
 		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
-		tlog.Debug.Printf("Rmdir: Open: %v", err)
+		rn.log.Debug.Printf("Rmdir: Open: %v", err)
 		return fs.ToErrno(err)
 	}
 	defer syscall.Close(dirfd)
@@ -291,12 +372,17 @@ func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
 			}
 		}()
 	}
+	// A machine that crashed while holding the lease on the directory
+	// would keep it from ever becoming empty
+	if rn.args.SharedStorage {
+		lease.RemoveStale(dirfd)
+	}
 retry:
 	// Check directory contents
 	children, err := syscallcompat.Getdents(dirfd)
 	if err == io.EOF {
 		// The directory is empty
-		tlog.Warn.Printf("Rmdir: %q: %s is missing", cName, nametransform.DirIVFilename)
+		tlog.Warn.Printf("Rmdir: %q: %s is missing", tlog.CipherName(cName), nametransform.DirIVFilename)
 		err = unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
 		return fs.ToErrno(err)
 	}
@@ -320,18 +406,22 @@ retry:
 	if len(children) > 1 {
 		return fs.ToErrno(syscall.ENOTEMPTY)
 	}
+	// A policy root has gocryptfs.dirpolicy instead, which needs the same
+	// dance
+	marker := rn.policyMarker(dirfd)
 	// Move "gocryptfs.diriv" to the parent dir as "gocryptfs.diriv.rmdir.XYZ"
-	tmpName := fmt.Sprintf("%s.rmdir.%d", nametransform.DirIVFilename, cryptocore.RandUint64())
-	tlog.Debug.Printf("Rmdir: Renaming %s to %s", nametransform.DirIVFilename, tmpName)
+	tmpName := fmt.Sprintf("%s.rmdir.%d", marker, cryptocore.RandUint64())
+	rn.log.Debug.Printf("Rmdir: Renaming %s to %s", marker, tmpName)
 	// The directory is in an inconsistent state between rename and rmdir.
 	// Protect against concurrent readers.
 	rn.dirIVLock.Lock()
 	defer rn.dirIVLock.Unlock()
-	err = syscallcompat.Renameat(dirfd, nametransform.DirIVFilename,
+	defer rn.journalBegin(parentDirFd, journal.OpRmdir, cName, tmpName)()
+	err = syscallcompat.Renameat(dirfd, marker,
 		parentDirFd, tmpName)
 	if err != nil {
 		tlog.Warn.Printf("Rmdir: Renaming %s to %s failed: %v",
-			nametransform.DirIVFilename, tmpName, err)
+			marker, tmpName, err)
 		return fs.ToErrno(err)
 	}
 	// Actual Rmdir
@@ -340,12 +430,13 @@ retry:
 		// This can happen if another file in the directory was created in the
 		// meantime, undo the rename
 		err2 := syscallcompat.Renameat(parentDirFd, tmpName,
-			dirfd, nametransform.DirIVFilename)
+			dirfd, marker)
 		if err2 != nil {
 			tlog.Warn.Printf("Rmdir: Rename rollback failed: %v", err2)
 		}
 		return fs.ToErrno(err)
 	}
+	rn.syncDir(parentDirFd)
 	// Delete "gocryptfs.diriv.rmdir.XYZ"
 	err = syscallcompat.Unlinkat(parentDirFd, tmpName, 0)
 	if err != nil {
@@ -11,13 +11,15 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/HorizonLiu/gocryptfs/internal/audit"
 	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
 	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
 )
 
 // toFuseCtx tries to extract a fuse.Context from a generic context.Context.
-func toFuseCtx(ctx context.Context) (ctx2 *fuse.Context) {
+// The caller is mapped to the owner in CIPHERDIR according to "-idmap".
+func (rn *RootNode) toFuseCtx(ctx context.Context) (ctx2 *fuse.Context) {
 	if ctx == nil {
 		return nil
 	}
@@ -25,10 +27,57 @@ func toFuseCtx(ctx context.Context) (ctx2 *fuse.Context) {
 		ctx2 = &fuse.Context{
 			Caller: *caller,
 		}
+		if rn.args.IDMap != nil {
+			ctx2.Uid, ctx2.Gid = rn.args.IDMap.ToHost(ctx2.Uid, ctx2.Gid)
+		}
 	}
 	return ctx2
 }
 
+// presentAttr applies "-force_owner" or "-idmap" to the owner in "a", and
+// "-force_perms" to the mode
+func (rn *RootNode) presentAttr(a *fuse.Attr) {
+	if rn.args.ForceOwner != nil {
+		a.Owner = *rn.args.ForceOwner
+	} else if rn.args.IDMap != nil {
+		a.Uid, a.Gid = rn.args.IDMap.ToPresented(a.Uid, a.Gid)
+	}
+	if rn.args.ForcePerms != nil {
+		a.Mode = rn.args.ForcePerms.Apply(a.Mode)
+	}
+}
+
+// createMode returns the mode for a new file, or directory if "dir" is set:
+// "-force_perms" replaces the permission bits that the caller asked for.
+func (rn *RootNode) createMode(mode uint32, dir bool) uint32 {
+	p := rn.args.ForcePerms
+	if p == nil {
+		return mode
+	}
+	if dir {
+		return mode&^07777 | p.Dir
+	}
+	return mode&^07777 | p.File
+}
+
+// hostOwner maps the uid and gid of a chown(2) call to the owner in
+// CIPHERDIR. -1 means "do not change" and stays -1.
+func (rn *RootNode) hostOwner(in *fuse.SetAttrIn) (uid int, gid int) {
+	uid, gid = -1, -1
+	uid32, uOk := in.GetUID()
+	gid32, gOk := in.GetGID()
+	if rn.args.IDMap != nil {
+		uid32, gid32 = rn.args.IDMap.ToHost(uid32, gid32)
+	}
+	if uOk {
+		uid = int(uid32)
+	}
+	if gOk {
+		gid = int(gid32)
+	}
+	return uid, gid
+}
+
 // toNode casts a generic fs.InodeEmbedder into *Node. Also handles *RootNode
 // by return rn.Node.
 func toNode(op fs.InodeEmbedder) *Node {
@@ -44,14 +93,18 @@ func (n *Node) readlink(dirfd int, cName string) (out []byte, errno syscall.Errn
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
-	rn := n.rootNode()
-	if rn.args.PlaintextNames {
+	if n.plaintextNames() {
 		return []byte(cTarget), 0
 	}
+	cTarget, err = readLongTarget(dirfd, cTarget)
+	if err != nil {
+		tlog.Warn.Printf("Readlink %q: reading long target failed: %v", tlog.CipherName(cName), err)
+		return nil, syscall.EIO
+	}
 	// Symlinks are encrypted like file contents (GCM) and base64-encoded
-	target, err := rn.decryptSymlinkTarget(cTarget)
+	target, err := n.decryptSymlinkTarget(cTarget)
 	if err != nil {
-		tlog.Warn.Printf("Readlink %q: decrypting target failed: %v", cName, err)
+		tlog.Warn.Printf("Readlink %q: decrypting target failed: %v", tlog.CipherName(cName), err)
 		return nil, syscall.EIO
 	}
 	return []byte(target), 0
@@ -60,8 +113,10 @@ func (n *Node) readlink(dirfd int, cName string) (out []byte, errno syscall.Errn
 // translateSize translates the ciphertext size in `out` into plaintext size.
 func (n *Node) translateSize(dirfd int, cName string, out *fuse.Attr) {
 	if out.IsRegular() {
-		rn := n.rootNode()
-		out.Size = rn.contentEnc.CipherSizeToPlainSize(out.Size)
+		if n.dirMode() == modePassthrough {
+			return
+		}
+		out.Size = n.contentEncoder().CipherSizeToPlainSize(out.Size)
 	} else if out.IsSymlink() {
 		target, _ := n.readlink(dirfd, cName)
 		out.Size = uint64(len(target))
@@ -89,8 +144,38 @@ func (n *Node) rootNode() *RootNode {
 func (n *Node) prepareAtSyscall(child string) (dirfd int, cName string, errno syscall.Errno) {
 	rn := n.rootNode()
 	// all filesystem operations go through prepareAtSyscall(), so this is a
-	// good place to reset the idle marker.
-	atomic.StoreUint32(&rn.IsIdle, 0)
+	// good place to reset the idle marker. With "-idle-ignore", IdleGate()
+	// does it, because it knows the calling process.
+	if rn.idleIgnore == nil {
+		atomic.StoreUint32(&rn.IsIdle, 0)
+	}
+
+	// Excluded paths cannot be accessed or created. Checked before the
+	// cache lookup, which skips the slowpath.
+	if child != "" {
+		if excluder := rn.getExcluder(); excluder != nil && excluder.MatchesPath(filepath.Join(n.Path(), child)) {
+			return -1, "", syscall.EPERM
+		}
+		if n.isReservedName(child) {
+			return -1, "", syscall.EPERM
+		}
+	}
+
+	// Tenant directories are not encrypted with the keys of the root
+	// directory
+	if child != "" && n.IsRoot() {
+		idx, tenantCName, errno := rn.tenantAt(child)
+		if errno != 0 {
+			return -1, "", errno
+		}
+		if idx != 0 {
+			dirfd, _, err := rn.openBackingDir("")
+			if err != nil {
+				return -1, "", fs.ToErrno(err)
+			}
+			return dirfd, tenantCName, 0
+		}
+	}
 
 	// root node itself is special
 	if child == "" && n.IsRoot() {
@@ -114,12 +199,15 @@ func (n *Node) prepareAtSyscall(child string) (dirfd int, cName string, errno sy
 
 	// Cache lookup
 	// TODO make it work for plaintextnames as well?
-	cacheable := (!rn.args.PlaintextNames)
+	// With -sharedstorage, another machine may replace the directory (and its
+	// gocryptfs.diriv) at any time, so cached IVs cannot be trusted.
+	// Directories with a policy have no IV to cache.
+	cacheable := (!rn.args.PlaintextNames && !rn.args.SharedStorage && n.dirMode() == modeEncrypted)
 	if cacheable {
 		var iv []byte
 		dirfd, iv = rn.dirCache.Lookup(n)
 		if dirfd > 0 {
-			cName, err := rn.nameTransform.EncryptAndHashName(child, iv)
+			cName, err := n.nameTransformer().EncryptAndHashName(child, iv)
 			if err != nil {
 				return -1, "", fs.ToErrno(err)
 			}
@@ -164,12 +252,34 @@ func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.Entry
 	// (or set to zero in case of `-sharestorage`)
 	rn.inoMap.TranslateStat(st)
 	out.Attr.FromStat(st)
+	rn.presentAttr(&out.Attr)
 	// Create child node
 	id := fs.StableAttr{
 		Mode: uint32(st.Mode),
 		Gen:  1,
 		Ino:  st.Ino,
 	}
-	node := &Node{}
+	// Entries share the mode and the keys of their directory. A directory
+	// with a policy of its own and the tenant directories are set up by
+	// Lookup().
+	node := &Node{mode: uint32(n.dirMode()), tenantIdx: n.tenant()}
 	return n.NewInode(ctx, node, id)
 }
+
+// audit writes a record to the "-audit-log". Meant to be deferred, so
+// "errno" is the result of the operation.
+func (n *Node) audit(ctx context.Context, op string, path string, newPath string, flags uint32, errno *syscall.Errno) {
+	r := audit.Record{
+		Op:      op,
+		Path:    path,
+		NewPath: newPath,
+		Flags:   flags,
+		Errno:   int(*errno),
+	}
+	if caller, ok := fuse.FromContext(ctx); ok {
+		r.UID = caller.Uid
+		r.GID = caller.Gid
+		r.PID = caller.Pid
+	}
+	n.rootNode().args.Audit.Write(r)
+}
@@ -2,20 +2,47 @@ package fusefrontend
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"syscall"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/HorizonLiu/gocryptfs/internal/inomap"
+	"github.com/HorizonLiu/gocryptfs/internal/journal"
 	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
 	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
 )
 
+// openFinish creates the file handle for Open() if the fdCache is enabled.
+// The fd goes back into the cache on Release().
+func (n *Node) openFinish(osFile *os.File, key fdCacheKey, fuseFlags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	rn := n.rootNode()
+	f, st, errno := newFile(osFile, rn, n.contentEncoder())
+	if errno != 0 {
+		osFile.Close()
+		return nil, 0, errno
+	}
+	// The file may have been replaced between Fstatat() and Openat()
+	f.cacheable = inomap.QInoFromStat(st) == key.qi
+	f.cacheKey = key
+	f.quota = n.quotaTrees()
+	f.inode = n.EmbeddedInode()
+	rn.openFiles.Register(f, n.Path)
+	return f, fuseFlags, 0
+}
+
 // Open - FUSE call. Open already-existing file.
 //
 // Symlink-safe through Openat().
 func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if n.rootNode().args.Audit != nil {
+		defer n.audit(ctx, "open", n.Path(), "", flags, &errno)
+	}
 	dirfd, cName, errno := n.prepareAtSyscall("")
 	if errno != 0 {
 		return
@@ -23,23 +50,70 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 	defer syscall.Close(dirfd)
 
 	rn := n.rootNode()
+	defer func() {
+		if errno == 0 {
+			rn.idleOpened(ctx, fh)
+		}
+	}()
 	newFlags := rn.mangleOpenFlags(flags)
 	// Taking this lock makes sure we don't race openWriteOnlyFile()
 	rn.openWriteOnlyLock.RLock()
 	defer rn.openWriteOnlyLock.RUnlock()
 
-	if rn.args.KernelCache {
+	// With -sharedstorage, the page cache must be dropped on open so writes
+	// from other machines show up
+	if rn.args.KernelCache && !rn.args.SharedStorage {
 		fuseFlags = fuse.FOPEN_KEEP_CACHE
 	}
+	// O_TRUNC frees the bytes of the file, see "-quota"
+	if trees := n.quotaTrees(); len(trees) > 0 && flags&syscall.O_TRUNC != 0 {
+		freed := n.quotaFreed(dirfd, cName, true)
+		defer func() {
+			if errno == 0 {
+				rn.uncharge(trees, freed)
+			}
+		}()
+	}
+	if n.dirMode() == modePassthrough {
+		fh, errno = n.openPassthrough(dirfd, cName, flags)
+		return fh, fuseFlags, errno
+	}
 
+	// Buffered appends must hit the disk before O_TRUNC throws them away,
+	// otherwise they would be written after the truncation
+	if rn.args.CoalesceWrites && newFlags&syscall.O_TRUNC != 0 {
+		if st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+			if e := rn.fileTable.Lookup(inomap.QInoFromStat(st)); e != nil {
+				if errno = syncPending(e); errno != 0 {
+					return
+				}
+			}
+		}
+	}
+	// Reuse a cached fd of the same file. With O_TRUNC, the open itself
+	// modifies the file and has to happen.
+	var cacheKey *fdCacheKey
+	if rn.fdCache != nil && newFlags&syscall.O_TRUNC == 0 {
+		st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+		if err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFREG {
+			cacheKey = &fdCacheKey{qi: inomap.QInoFromStat(st), flags: newFlags}
+			if osFile := rn.fdCache.get(*cacheKey); osFile != nil {
+				return n.openFinish(osFile, *cacheKey, fuseFlags)
+			}
+		}
+	}
 	// Open backing file
-	fd, err := syscallcompat.Openat(dirfd, cName, newFlags, 0)
+	var fd int
+	err := rn.retry("Open", func() (err error) {
+		fd, err = syscallcompat.Openat(dirfd, cName, newFlags, 0)
+		return err
+	})
 	// Handle a few specific errors
 	if err != nil {
 		if err == syscall.EMFILE {
 			var lim syscall.Rlimit
 			syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim)
-			tlog.Warn.Printf("Open %q: too many open files. Current \"ulimit -n\": %d", cName, lim.Cur)
+			tlog.Warn.Printf("Open %q: too many open files. Current \"ulimit -n\": %d", tlog.CipherName(cName), lim.Cur)
 		}
 		if err == syscall.EACCES && (int(flags)&syscall.O_ACCMODE) == syscall.O_WRONLY {
 			fd, err = rn.openWriteOnlyFile(dirfd, cName, newFlags)
@@ -50,33 +124,62 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		errno = fs.ToErrno(err)
 		return
 	}
-	fh, _, errno = NewFile(fd, cName, rn)
-	return fh, fuseFlags, errno
+	if cacheKey != nil {
+		return n.openFinish(os.NewFile(uintptr(fd), cName), *cacheKey, fuseFlags)
+	}
+	f, _, errno := newFile(os.NewFile(uintptr(fd), cName), rn, n.contentEncoder())
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	f.quota = n.quotaTrees()
+	f.inode = n.EmbeddedInode()
+	rn.openFiles.Register(f, n.Path)
+	return f, fuseFlags, 0
 }
 
 // Create - FUSE call. Creates a new file.
 //
 // Symlink-safe through the use of Openat().
 func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if n.rootNode().args.Audit != nil {
+		defer n.audit(ctx, "create", filepath.Join(n.Path(), name), "", flags, &errno)
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
+	release, errno := n.rootNode().leaseDir(dirfd)
+	if errno != 0 {
+		return
+	}
+	defer release()
 
 	var err error
 	fd := -1
-	// Make sure context is nil if we don't want to preserve the owner
 	rn := n.rootNode()
+	// ctx is cleared below
+	defer func(ctx context.Context) {
+		if errno == 0 {
+			rn.idleOpened(ctx, fh)
+		}
+	}(ctx)
+	// Make sure context is nil if we don't want to preserve the owner
 	if !rn.args.PreserveOwner {
 		ctx = nil
 	}
+	mode = rn.createMode(mode, false)
 	newFlags := rn.mangleOpenFlags(flags)
+	passthrough := n.dirMode() == modePassthrough
+	if passthrough {
+		newFlags = passthroughOpenFlags(flags)
+	}
 	// Handle long file name
-	ctx2 := toFuseCtx(ctx)
-	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
+	ctx2 := rn.toFuseCtx(ctx)
+	if !n.plaintextNames() && nametransform.IsLongContent(cName) {
 		// Create ".name"
-		err = rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+		defer rn.journalBegin(dirfd, journal.OpLongName, cName, "")()
+		err = n.writeLongName(dirfd, cName, name)
 		if err != nil {
 			return nil, nil, 0, fs.ToErrno(err)
 		}
@@ -94,15 +197,41 @@ func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint3
 		if err == syscall.EMFILE {
 			var lim syscall.Rlimit
 			syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim)
-			tlog.Warn.Printf("Create %q: too many open files. Current \"ulimit -n\": %d", cName, lim.Cur)
+			tlog.Warn.Printf("Create %q: too many open files. Current \"ulimit -n\": %d", tlog.CipherName(cName), lim.Cur)
 		}
 		return nil, nil, 0, fs.ToErrno(err)
 	}
+	rn.syncDir(dirfd)
+	if rn.args.ExactModes {
+		if err = syscall.Fchmod(fd, mode&07777); err != nil {
+			tlog.Warn.Printf("Create %q: Fchmod %#o failed: %v", tlog.CipherName(cName), mode&07777, err)
+		}
+	}
 
-	fh, st, errno := NewFile(fd, cName, rn)
+	var st *syscall.Stat_t
+	if passthrough {
+		var pf *passthroughFile
+		pf, st, errno = newPassthroughFile(fd, cName, rn)
+		if pf != nil {
+			pf.quota = n.childQuotaTrees(name)
+			fh = pf
+		}
+	} else {
+		var f *File
+		f, st, errno = newFile(os.NewFile(uintptr(fd), cName), rn, n.contentEncoder())
+		if f != nil {
+			f.quota = n.childQuotaTrees(name)
+			fh = f
+		}
+	}
 	if errno != 0 {
 		return
 	}
 	inode = n.newChild(ctx, st, out)
+	if f, ok := fh.(*File); ok {
+		f.inode = inode
+	}
+	root := n.Root()
+	rn.openFiles.Register(fh, func() string { return inode.Path(root) })
 	return inode, fh, fuseFlags, errno
 }
@@ -47,8 +47,12 @@ func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 		return 0, syscall.EOPNOTSUPP
 	}
 	var data []byte
-	// ACLs are passed through without encryption
-	if isAcl(attr) {
+	policy := rn.args.XattrPolicies.Lookup(attr, XattrEncrypt)
+	if policy == XattrDeny {
+		return 0, syscall.EOPNOTSUPP
+	}
+	// ACLs and "-xattr-policy" passthrough namespaces are not encrypted
+	if isAcl(attr) || policy == XattrPassthrough {
 		var errno syscall.Errno
 		data, errno = n.getXAttr(attr)
 		if errno != 0 {
@@ -56,13 +60,16 @@ func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 		}
 	} else {
 		// encrypted user xattr
-		cAttr := rn.encryptXattrName(attr)
+		if n.keysUnknown() {
+			return minus1, syscall.EACCES
+		}
+		cAttr := n.encryptXattrName(attr)
 		cData, errno := n.getXAttr(cAttr)
 		if errno != 0 {
 			return 0, errno
 		}
 		var err error
-		data, err = rn.decryptXattrValue(cData)
+		data, err = n.decryptXattrValue(cData)
 		if err != nil {
 			tlog.Warn.Printf("GetXAttr: %v", err)
 			return minus1, syscall.EIO
@@ -86,13 +93,19 @@ func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uin
 	rn := n.rootNode()
 	flags = uint32(filterXattrSetFlags(int(flags)))
 
-	// ACLs are passed through without encryption
-	if isAcl(attr) {
+	policy := rn.args.XattrPolicies.Lookup(attr, XattrEncrypt)
+	if policy == XattrDeny {
+		return syscall.EOPNOTSUPP
+	}
+	// ACLs and "-xattr-policy" passthrough namespaces are not encrypted
+	if isAcl(attr) || policy == XattrPassthrough {
 		return n.setXAttr(attr, data, flags)
 	}
-
-	cAttr := rn.encryptXattrName(attr)
-	cData := rn.encryptXattrValue(data)
+	if n.keysUnknown() {
+		return syscall.EACCES
+	}
+	cAttr := n.encryptXattrName(attr)
+	cData := n.encryptXattrValue(data)
 	return n.setXAttr(cAttr, cData, flags)
 }
 
@@ -102,12 +115,18 @@ func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uin
 func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
 	rn := n.rootNode()
 
-	// ACLs are passed through without encryption
-	if isAcl(attr) {
+	policy := rn.args.XattrPolicies.Lookup(attr, XattrEncrypt)
+	if policy == XattrDeny {
+		return syscall.EOPNOTSUPP
+	}
+	// ACLs and "-xattr-policy" passthrough namespaces are not encrypted
+	if isAcl(attr) || policy == XattrPassthrough {
 		return n.removeXAttr(attr)
 	}
-
-	cAttr := rn.encryptXattrName(attr)
+	if n.keysUnknown() {
+		return syscall.EACCES
+	}
+	cAttr := n.encryptXattrName(attr)
 	return n.removeXAttr(cAttr)
 }
 
@@ -122,15 +141,15 @@ func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 	rn := n.rootNode()
 	var buf bytes.Buffer
 	for _, curName := range cNames {
-		// ACLs are passed through without encryption
-		if isAcl(curName) {
+		// ACLs and "-xattr-policy" passthrough namespaces are not encrypted
+		if isAcl(curName) || rn.args.XattrPolicies.Lookup(curName, XattrEncrypt) == XattrPassthrough {
 			buf.WriteString(curName + "\000")
 			continue
 		}
-		if !strings.HasPrefix(curName, xattrStorePrefix) {
+		if !strings.HasPrefix(curName, xattrStorePrefix) || n.keysUnknown() {
 			continue
 		}
-		name, err := rn.decryptXattrName(curName)
+		name, err := n.decryptXattrName(curName)
 		if err != nil {
 			tlog.Warn.Printf("ListXAttr: invalid xattr name %q: %v", curName, err)
 			rn.reportMitigatedCorruption(curName)
@@ -142,6 +161,11 @@ func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 			rn.reportMitigatedCorruption(curName)
 			continue
 		}
+		// Stored before "-xattr-policy" was changed. Getxattr could not
+		// read it.
+		if rn.args.XattrPolicies.Lookup(name, XattrEncrypt) != XattrEncrypt {
+			continue
+		}
 		buf.WriteString(name + "\000")
 	}
 	// Caller passes size zero to find out how large their buffer should be
@@ -54,7 +54,7 @@ func (n *Node) setXAttr(cAttr string, cData []byte, flags uint32) (errno syscall
 		fd, err = syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NONBLOCK, 0)
 	}
 	if err != nil {
-		fs.ToErrno(err)
+		return fs.ToErrno(err)
 	}
 	defer syscall.Close(fd)
 
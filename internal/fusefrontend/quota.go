@@ -0,0 +1,242 @@
+package fusefrontend
+
+// Quotas per plaintext subtree, enabled via cli flag "-quota"
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/journal"
+	"github.com/HorizonLiu/gocryptfs/internal/lease"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/quota"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// quotaTrees returns the quota trees that contain "n", nil if there are
+// none
+func (n *Node) quotaTrees() []*quota.Tree {
+	rn := n.rootNode()
+	if rn.args.Quota == nil {
+		return nil
+	}
+	return rn.args.Quota.Match(n.Path())
+}
+
+// childQuotaTrees returns the quota trees that contain the entry "name"
+// of directory "n"
+func (n *Node) childQuotaTrees(name string) []*quota.Tree {
+	rn := n.rootNode()
+	if rn.args.Quota == nil {
+		return nil
+	}
+	return rn.args.Quota.Match(filepath.Join(n.Path(), name))
+}
+
+// chargeResize charges a file growing from "oldSize" to "newSize"
+// plaintext bytes to "trees". Returns EDQUOT if that would exceed a limit.
+// A shrinking file is only credited if "shrink" is set, writes never
+// shrink a file. The returned delta has to be credited back with
+// uncharge() if the operation fails.
+func (rn *RootNode) chargeResize(trees []*quota.Tree, oldSize uint64, newSize uint64, shrink bool) (int64, syscall.Errno) {
+	delta := int64(newSize) - int64(oldSize)
+	if len(trees) == 0 || delta == 0 || (delta < 0 && !shrink) {
+		return 0, 0
+	}
+	if !rn.args.Quota.Charge(trees, delta) {
+		return 0, syscall.EDQUOT
+	}
+	return delta, 0
+}
+
+// uncharge credits back what chargeResize() has charged
+func (rn *RootNode) uncharge(trees []*quota.Tree, delta int64) {
+	if delta != 0 {
+		rn.args.Quota.Charge(trees, -delta)
+	}
+}
+
+// quotaResize charges the file growing to "newSize" plaintext bytes, see
+// chargeResize(). The caller must hold ContentLock exclusively.
+func (f *File) quotaResize(newSize uint64, shrink bool) (int64, syscall.Errno) {
+	if len(f.quota) == 0 {
+		return 0, 0
+	}
+	oldSize, err := f.statPlainSize()
+	if err != nil {
+		return 0, syscall.EIO
+	}
+	// Appends that "-coalesce-writes" has not written yet
+	if p, ok := f.fileTableEntry.Pending.(*File); ok && p.appendBuf != nil {
+		if end := p.appendBuf.off + uint64(len(p.appendBuf.data)); end > oldSize {
+			oldSize = end
+		}
+	}
+	return f.rootNode.chargeResize(f.quota, oldSize, newSize, shrink)
+}
+
+// quotaDo runs "op", which resizes the passthrough file to "newSize" bytes,
+// and charges that like File.quotaResize() does. The plaintext size is the
+// size of the backing file.
+func (f *passthroughFile) quotaDo(newSize uint64, shrink bool, op func() error) syscall.Errno {
+	if len(f.quota) == 0 {
+		return fs.ToErrno(op())
+	}
+	rn := f.rootNode
+	rn.quotaLock.Lock()
+	defer rn.quotaLock.Unlock()
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.intFd(), &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	delta, errno := rn.chargeResize(f.quota, uint64(st.Size), newSize, shrink)
+	if errno != 0 {
+		return errno
+	}
+	if err := op(); err != nil {
+		rn.uncharge(f.quota, delta)
+		return fs.ToErrno(err)
+	}
+	return 0
+}
+
+// quotaFreed returns the plaintext bytes that are freed when the entry
+// "cName" of "dirfd", which is the directory "n" or contains "n", is
+// deleted or replaced. Only the last link of a regular file frees its
+// bytes, but "truncate" frees them anyway.
+func (n *Node) quotaFreed(dirfd int, cName string, truncate bool) int64 {
+	var st unix.Stat_t
+	if err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return 0
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG || (st.Nlink > 1 && !truncate) {
+		return 0
+	}
+	return int64(n.rootNode().quotaPlainSize(n.dirMode(), uint64(st.Size)))
+}
+
+// quotaPlainSize converts the size of a backing file in a directory with
+// mode "mode" to the plaintext size
+func (rn *RootNode) quotaPlainSize(mode dirMode, size uint64) uint64 {
+	if mode == modePassthrough {
+		return size
+	}
+	return rn.contentEnc.CipherSizeToPlainSize(size)
+}
+
+// CountQuotas sets the usage of the "-quota" trees. The usage from a clean
+// state file is used as is, the other trees are counted. Must be called
+// before the filesystem is mounted.
+func (rn *RootNode) CountQuotas() error {
+	q := rn.args.Quota
+	for _, t := range q.Trees() {
+		if used, ok := q.Saved(t); ok {
+			q.SetUsed(t, used)
+			continue
+		}
+		used, err := rn.countUsage(t.Path)
+		if err != nil {
+			return fmt.Errorf("counting %q: %v", t.Path, err)
+		}
+		rn.log.Debug.Printf("CountQuotas %q: %d bytes", tlog.PlainName(t.Path), used)
+		q.SetUsed(t, used)
+	}
+	return nil
+}
+
+// countUsage returns the plaintext size of the regular files below the
+// directory "plainPath". A directory that does not exist yet is empty.
+//
+// Symlink-safe through openBackingDirMode() and Openat().
+func (rn *RootNode) countUsage(plainPath string) (uint64, error) {
+	if !rn.rlockKeys() {
+		return 0, syscall.EACCES
+	}
+	defer rn.keyLock.RUnlock()
+	parentDirFd, cName, mode, err := rn.openBackingDirMode(plainPath)
+	if err == syscall.ENOENT {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(parentDirFd)
+	mode = rn.childDirMode(mode, parentDirFd, cName)
+	fd, err := syscallcompat.Openat(parentDirFd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err == syscall.ENOENT {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	// Hard-linked files are only counted once
+	seen := make(map[uint64]struct{})
+	return rn.countDir(fd, mode, plainPath == "", seen)
+}
+
+// countDir adds up the plaintext sizes of the regular files in the
+// directory "fd" and its subdirectories. Closes "fd".
+func (rn *RootNode) countDir(fd int, mode dirMode, isRoot bool, seen map[uint64]struct{}) (uint64, error) {
+	defer syscall.Close(fd)
+	entries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		return 0, err
+	}
+	var used uint64
+	for _, e := range entries {
+		if rn.isInternalName(e.Name, mode, isRoot) {
+			continue
+		}
+		var st unix.Stat_t
+		err := syscallcompat.Fstatat(fd, e.Name, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err == syscall.ENOENT {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		switch st.Mode & syscall.S_IFMT {
+		case syscall.S_IFREG:
+			if st.Nlink > 1 {
+				if _, ok := seen[st.Ino]; ok {
+					continue
+				}
+				seen[st.Ino] = struct{}{}
+			}
+			used += rn.quotaPlainSize(mode, uint64(st.Size))
+		case syscall.S_IFDIR:
+			childMode := rn.childDirMode(mode, fd, e.Name)
+			childFd, err := syscallcompat.Openat(fd, e.Name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+			if err != nil {
+				return 0, err
+			}
+			n, err := rn.countDir(childFd, childMode, false, seen)
+			if err != nil {
+				return 0, err
+			}
+			used += n
+		}
+	}
+	return used, nil
+}
+
+// isInternalName returns true if the backing file "cName" in a directory
+// with mode "mode" is not a plaintext file, like gocryptfs.diriv
+func (rn *RootNode) isInternalName(cName string, mode dirMode, isRoot bool) bool {
+	if isRoot && (cName == configfile.ConfDefaultName || cName == journal.FileName) || lease.IsLeaseFile(cName) {
+		return true
+	}
+	if rn.args.PlaintextNames {
+		return false
+	}
+	if mode != modeEncrypted {
+		// The marker files below a directory policy
+		return cName == nametransform.DirIVFilename || cName == nametransform.DirPolicyFilename
+	}
+	return cName == nametransform.DirIVFilename || nametransform.NameType(cName) == nametransform.LongNameFilename ||
+		nametransform.IsLongTarget(cName)
+}
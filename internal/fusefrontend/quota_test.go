@@ -0,0 +1,103 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/quota"
+)
+
+func TestQuota(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "quota_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	q, _ := quota.New("")
+	q.Add("limited", 10000)
+	rn := newTestFS(Args{Cipherdir: cipherdir, Quota: q})
+	var out fuse.EntryOut
+	var dirs []*Node
+	for _, name := range []string{"limited", "other"} {
+		if _, errno := rn.Mkdir(ctx, name, 0700, &out); errno != 0 {
+			t.Fatal(errno)
+		}
+		inode, errno := rn.Lookup(ctx, name, &out)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		rn.AddChild(name, inode, false)
+		dirs = append(dirs, inode.Operations().(*Node))
+	}
+	limited, other := dirs[0], dirs[1]
+	tree := q.Trees()[0]
+	create := func(dir *Node, name string) *File {
+		inode, fh, _, errno := dir.Create(ctx, name, syscall.O_RDWR, 0600, &out)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		dir.AddChild(name, inode, false)
+		return fh.(*File)
+	}
+
+	f := create(limited, "file")
+	if _, errno := f.Write(ctx, make([]byte, 6000), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	// Overwriting does not use more space
+	if _, errno := f.Write(ctx, make([]byte, 6000), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno := f.Write(ctx, make([]byte, 5000), 6000); errno != syscall.EDQUOT {
+		t.Errorf("want EDQUOT, got %v", errno)
+	}
+	if used := q.Used(tree); used != 6000 {
+		t.Errorf("want 6000, got %d", used)
+	}
+	if errno := f.truncate(1000); errno != 0 {
+		t.Fatal(errno)
+	}
+	if used := q.Used(tree); used != 1000 {
+		t.Errorf("want 1000 after truncate, got %d", used)
+	}
+	f.Release(ctx)
+	// Other directories are not limited
+	f2 := create(other, "file")
+	if _, errno := f2.Write(ctx, make([]byte, 20000), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	f2.Release(ctx)
+	if errno := limited.Rename(ctx, "file", other, "file2", 0); errno != syscall.EXDEV {
+		t.Errorf("rename out of the quota: want EXDEV, got %v", errno)
+	}
+	if errno := limited.Rename(ctx, "file", limited, "file2", 0); errno != 0 {
+		t.Errorf("rename within the quota: %v", errno)
+	}
+	// Counting gives the same result
+	used, err := rn.countUsage("limited")
+	if err != nil || used != 1000 {
+		t.Errorf("countUsage: want 1000, got %d, %v", used, err)
+	}
+	if errno := limited.Unlink(ctx, "file2"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if used := q.Used(tree); used != 0 {
+		t.Errorf("want 0 after unlink, got %d", used)
+	}
+}
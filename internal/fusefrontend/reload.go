@@ -0,0 +1,32 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Reload applies the options of "args" that can change while mounted,
+// "-fd-cache", "-readahead" and the exclusion rules. Files that are already
+// open keep their readahead setting, and excluded files that are already
+// open stay accessible through their handles. Everything else in "args" is
+// ignored.
+func (rn *RootNode) Reload(args Args) error {
+	if args.FDCache < 0 || args.Readahead < 0 {
+		return fmt.Errorf("negative cache size")
+	}
+	if rn.fdCache == nil && args.FDCache > 0 {
+		return fmt.Errorf("-fd-cache can only be enabled at mount time")
+	}
+	excluder, err := CompileExcluder(args)
+	if err != nil {
+		return err
+	}
+	rn.excluderLock.Lock()
+	rn.excluder = excluder
+	rn.excluderLock.Unlock()
+	if rn.fdCache != nil {
+		rn.fdCache.resize(args.FDCache)
+	}
+	atomic.StoreInt32(&rn.readahead, int32(args.Readahead))
+	return nil
+}
@@ -0,0 +1,74 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+)
+
+// TestRenameExchangeLongnames swaps a file with a long name and a file with
+// a short name and checks that both names still resolve to the swapped
+// contents.
+func TestRenameExchangeLongnames(t *testing.T) {
+	if syscallcompat.RENAME_EXCHANGE == 0 {
+		t.Skip("RENAME_EXCHANGE not supported on this platform")
+	}
+	cipherdir, err := ioutil.TempDir("", "rename_exchange_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rn := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	ctx := context.Background()
+	long := strings.Repeat("l", 200)
+	short := "s"
+	create := func(name string, content string) {
+		var out fuse.EntryOut
+		_, fh, _, errno := rn.Create(ctx, name, syscall.O_RDWR, 0600, &out)
+		if errno != 0 {
+			t.Fatalf("Create %q: %v", name, errno)
+		}
+		f := fh.(*File)
+		if _, errno = f.Write(ctx, []byte(content), 0); errno != 0 {
+			t.Fatal(errno)
+		}
+		f.Release(ctx)
+	}
+	create(long, "long")
+	create(short, "short!")
+
+	errno := rn.Rename(ctx, long, rn, short, syscallcompat.RENAME_EXCHANGE)
+	if errno == syscall.EINVAL || errno == syscall.ENOSYS {
+		t.Skip("backing filesystem does not support RENAME_EXCHANGE")
+	}
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	// Sizes tell us which content is behind which name now
+	for name, size := range map[string]uint64{long: 6, short: 4} {
+		var out fuse.EntryOut
+		if _, errno = rn.Lookup(ctx, name, &out); errno != 0 {
+			t.Fatalf("Lookup %q after exchange: %v", name, errno)
+		}
+		if out.Size != size {
+			t.Errorf("%q: want size %d, got %d", name[:1], size, out.Size)
+		}
+	}
+}
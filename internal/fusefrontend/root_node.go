@@ -1,6 +1,7 @@
 package fusefrontend
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"strings"
@@ -8,10 +9,19 @@ import (
 	"syscall"
 	"time"
 
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/sabhiram/go-gitignore"
+
 	"github.com/HorizonLiu/gocryptfs/internal/configfile"
 	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
 	"github.com/HorizonLiu/gocryptfs/internal/inomap"
 	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/openfiletable"
+	"github.com/HorizonLiu/gocryptfs/internal/openpaths"
 	"github.com/HorizonLiu/gocryptfs/internal/serialize_reads"
 	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
@@ -47,38 +57,179 @@ type RootNode struct {
 	// When -idle was used when mounting, idleMonitor() sets it to 1
 	// periodically.
 	IsIdle uint32
+	// idleIgnore decides which requests reset IsIdle, nil if every request
+	// does ("-idle-ignore")
+	idleIgnore *idleIgnore
+	// log are the Debug and Info loggers of this mount, see Args.Log
+	log *tlog.Loggers
 	// dirCache caches directory fds
 	dirCache dirCache
+	// fdCache keeps the backing files of released handles open, nil if
+	// "-fd-cache" is off
+	fdCache *fdCache
 	// inoMap translates inode numbers from different devices to unique inode
 	// numbers.
 	inoMap inomap.TranslateStater
+	// keyLock is write-locked by Lock() and Unlock() and read-locked while
+	// operations that need the keys are running
+	keyLock sync.RWMutex
+	// locked is set while the keys are wiped ("-idlelock")
+	locked bool
+	// keyManager wipes and restores the keys for Lock() and Unlock()
+	keyManager KeyManager
+	// lockNotify is set by LockGate() when the FUSE server starts. Only then
+	// can Lock() ask the kernel to drop its caches.
+	lockNotify int32
+	// openFiles tracks the paths of open files for the control socket
+	openFiles openpaths.Registry
+	// fileTable holds the file IDs and write locks of the open files
+	fileTable *openfiletable.Table
+	// freeze blocks modifications while a snapshot is taken
+	freeze freezeState
+	// readahead is the "-readahead" block count. Accessed atomically
+	// because Reload() can change it.
+	readahead int32
+	// excluder checks the "-exclude", "-include" and "-filter" rules, nil if
+	// nothing is excluded. Protected by excluderLock because Reload() can
+	// replace it.
+	excluder     ignore.IgnoreParser
+	excluderLock sync.RWMutex
+	// dirPolicies is set if directory policies are enabled. Accessed
+	// atomically because SetDirPolicy() can enable them at runtime.
+	dirPolicies uint32
+	// tenants are the top-level directories with keys of their own. The
+	// index+1 is stored in Node.tenantIdx.
+	tenants []*Tenant
+	// quotaLock serializes the size changes of passthrough files while
+	// "-quota" is active. Encrypted files use ContentLock.
+	quotaLock sync.Mutex
+	// watcher watches the backing directories, nil if "-watch-cipherdir"
+	// is off
+	watcher *cipherWatcher
 }
 
 func NewRootNode(args Args, c *contentenc.ContentEnc, n nametransform.NameTransformer) *RootNode {
 	if args.SerializeReads {
 		serialize_reads.InitSerializer()
 	}
-	if len(args.Exclude) > 0 {
-		tlog.Warn.Printf("Forward mode does not support -exclude")
+	if args.IgnoreFiles {
+		tlog.Warn.Printf("Forward mode does not support -ignorefiles")
 	}
 	rn := &RootNode{
 		args:          args,
 		nameTransform: n,
 		contentEnc:    c,
 		inoMap:        inomap.New(),
+		log:           args.Log,
+		fileTable:     openfiletable.New(),
+		readahead:     int32(args.Readahead),
+	}
+	if rn.log == nil {
+		rn.log = tlog.ProcessLoggers()
 	}
 	// In `-sharedstorage` mode we always set the inode number to zero.
 	// This makes go-fuse generate a new inode number for each lookup.
 	if args.SharedStorage {
 		rn.inoMap = &inomap.TranslateStatZero{}
 	}
+	if args.FDCache > 0 {
+		rn.fdCache = newFdCache(args.FDCache)
+	}
+	if len(args.IdleIgnore) > 0 {
+		rn.idleIgnore = newIdleIgnore(args.IdleIgnore)
+	}
+	if args.DirPolicies {
+		if args.SharedStorage {
+			tlog.Fatal.Printf("Directory policies are not supported with -sharedstorage")
+			os.Exit(exitcodes.Usage)
+		}
+		rn.dirPolicies = 1
+	}
+	if args.WatchCipherdir {
+		w, err := newCipherWatcher(rn.log)
+		if err != nil {
+			tlog.Fatal.Printf("-watch-cipherdir: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		rn.watcher = w
+	}
+	excluder, err := CompileExcluder(args)
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.ExcludeError)
+	}
+	rn.excluder = excluder
 	return rn
 }
 
+// CountOpenFiles returns the number of files that are currently open on this
+// filesystem
+func (rn *RootNode) CountOpenFiles() int {
+	return rn.fileTable.CountOpenFiles()
+}
+
+// PlainSize returns the plaintext size of an encrypted file that is
+// "cipherSize" bytes long. Used to estimate how long "-fsck" takes.
+func (rn *RootNode) PlainSize(cipherSize int64) int64 {
+	return int64(rn.contentEnc.CipherSizeToPlainSize(uint64(cipherSize)))
+}
+
+// ReleaseOpenFiles releases all open files. Used after the FUSE connection
+// was lost, because the kernel will not send Release for them anymore.
+func (rn *RootNode) ReleaseOpenFiles() {
+	for _, fh := range rn.openFiles.Handles() {
+		fh.(fs.FileReleaser).Release(context.Background())
+	}
+}
+
+// MountSubdir makes the plaintext directory "relPath" the root of the
+// filesystem. Everything outside of it becomes inaccessible.
+// Must be called before the filesystem is mounted.
+//
+// This works because every directory has its own gocryptfs.diriv, so the
+// encrypted subdirectory can be used like a CIPHERDIR of its own.
+//
+// Symlink-safe through openBackingDir() and Fstatat().
+func (rn *RootNode) MountSubdir(relPath string) error {
+	cPath, err := rn.EncryptPath(relPath)
+	if err != nil {
+		return err
+	}
+	dirfd, cName, mode, err := rn.openBackingDirMode(relPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return syscall.ENOTDIR
+	}
+	rn.log.Debug.Printf("MountSubdir %q -> %q", tlog.PlainName(relPath), tlog.CipherName(cPath))
+	// A subdirectory in or of a policy root has no gocryptfs.diriv
+	rn.setDirMode(rn.childDirMode(mode, dirfd, cName))
+	rn.args.Cipherdir = filepath.Join(rn.args.Cipherdir, cPath)
+	// Tenants are top-level directories of the original CIPHERDIR. A
+	// subdirectory of a tenant cannot be mounted because it is locked.
+	rn.tenants = nil
+	return nil
+}
+
 // main.doMount() calls this after unmount
 func (rn *RootNode) AfterUnmount() {
 	// print stats before we exit
 	rn.dirCache.stats()
+	if rn.fdCache != nil {
+		rn.fdCache.clear()
+	}
+	if rn.args.Quota != nil {
+		// The usage cannot change anymore, mark the state file clean
+		if err := rn.args.Quota.Save(true); err != nil {
+			tlog.Warn.Printf("quota: %v", err)
+		}
+	}
 }
 
 // mangleOpenFlags is used by Create() and Open() to convert the open flags the user
@@ -131,7 +282,7 @@ func (rn *RootNode) isFiltered(path string) bool {
 	}
 	// gocryptfs.conf in the root directory is forbidden
 	if path == configfile.ConfDefaultName {
-		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
+		rn.log.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
 			configfile.ConfDefaultName)
 		return true
 	}
@@ -145,15 +296,15 @@ func (rn *RootNode) isFiltered(path string) bool {
 // The empty string decrypts to the empty string.
 //
 // This function does not do any I/O and is hence symlink-safe.
-func (rn *RootNode) decryptSymlinkTarget(cData64 string) (string, error) {
+func (n *Node) decryptSymlinkTarget(cData64 string) (string, error) {
 	if cData64 == "" {
 		return "", nil
 	}
-	cData, err := rn.nameTransform.B64DecodeString(cData64)
+	cData, err := n.nameTransformer().B64DecodeString(cData64)
 	if err != nil {
 		return "", err
 	}
-	data, err := rn.contentEnc.DecryptBlock([]byte(cData), 0, nil)
+	data, err := n.contentEncoder().DecryptBlock([]byte(cData), 0, nil)
 	if err != nil {
 		return "", err
 	}
@@ -217,38 +368,82 @@ func (rn *RootNode) openWriteOnlyFile(dirfd int, cName string, newFlags int) (rw
 //
 // Retries on EINTR.
 func (rn *RootNode) openBackingDir(relPath string) (dirfd int, cName string, err error) {
+	dirfd, cName, _, err = rn.openBackingDirMode(relPath)
+	return dirfd, cName, err
+}
+
+// openBackingDirMode is openBackingDir that also returns the dirMode of the
+// directory that contains "relPath". The names below a directory policy
+// are not encrypted.
+func (rn *RootNode) openBackingDirMode(relPath string) (dirfd int, cName string, mode dirMode, err error) {
 	dirRelPath := nametransform.Dir(relPath)
 	// With PlaintextNames, we don't need to read DirIVs. Easy.
 	if rn.args.PlaintextNames {
 		dirfd, err = syscallcompat.OpenDirNofollow(rn.args.Cipherdir, dirRelPath)
 		if err != nil {
-			return -1, "", err
+			return -1, "", 0, err
 		}
 		// If relPath is empty, cName is ".".
 		cName = filepath.Base(relPath)
-		return dirfd, cName, nil
+		return dirfd, cName, modeEncrypted, nil
 	}
 	// Open cipherdir (following symlinks)
 	dirfd, err = syscallcompat.Open(rn.args.Cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
 	if err != nil {
-		return -1, "", err
+		return -1, "", 0, err
 	}
+	// "-subdir" may point into a directory policy
+	mode = rn.dirMode()
 	// If relPath is empty, cName is ".".
 	if relPath == "" {
-		return dirfd, ".", nil
+		return dirfd, ".", mode, nil
 	}
 	// Walk the directory tree
 	parts := strings.Split(relPath, "/")
+	nameTransform := rn.nameTransform
 	for i, name := range parts {
-		iv, err := nametransform.ReadDirIVAt(dirfd)
-		if err != nil {
-			syscall.Close(dirfd)
-			return -1, "", err
+		if i == 0 {
+			idx, tenantCName, errno := rn.tenantAt(name)
+			if errno != 0 {
+				syscall.Close(dirfd)
+				return -1, "", 0, errno
+			}
+			if idx != 0 {
+				// The name of a tenant directory is not derived from the
+				// keys we have
+				nameTransform = rn.tenants[idx-1].nameTransform
+				if len(parts) == 1 {
+					return dirfd, tenantCName, mode, nil
+				}
+				dirfd2, err := syscallcompat.Openat(dirfd, tenantCName, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+				syscall.Close(dirfd)
+				if err != nil {
+					return -1, "", 0, err
+				}
+				dirfd = dirfd2
+				continue
+			}
 		}
-		cName, err = rn.nameTransform.EncryptAndHashName(name, iv)
-		if err != nil {
-			syscall.Close(dirfd)
-			return -1, "", err
+		if mode == modeEncrypted {
+			iv, err := nametransform.ReadDirIVAt(dirfd)
+			if err == syscall.ENOENT && rn.DirPoliciesEnabled() {
+				// A policy root has gocryptfs.dirpolicy instead
+				mode = rn.dirModeAt(dirfd)
+			}
+			if mode == modeEncrypted {
+				if err != nil {
+					syscall.Close(dirfd)
+					return -1, "", 0, err
+				}
+				cName, err = nameTransform.EncryptAndHashName(name, iv)
+				if err != nil {
+					syscall.Close(dirfd)
+					return -1, "", 0, err
+				}
+			}
+		}
+		if mode != modeEncrypted {
+			cName = name
 		}
 		// Last part? We are done.
 		if i == len(parts)-1 {
@@ -258,11 +453,11 @@ func (rn *RootNode) openBackingDir(relPath string) (dirfd int, cName string, err
 		dirfd2, err := syscallcompat.Openat(dirfd, cName, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
 		syscall.Close(dirfd)
 		if err != nil {
-			return -1, "", err
+			return -1, "", 0, err
 		}
 		dirfd = dirfd2
 	}
-	return dirfd, cName, nil
+	return dirfd, cName, mode, nil
 }
 
 // encryptSymlinkTarget: "data" is encrypted like file contents (GCM)
@@ -270,12 +465,12 @@ func (rn *RootNode) openBackingDir(relPath string) (dirfd int, cName string, err
 // The empty string encrypts to the empty string.
 //
 // Symlink-safe because it does not do any I/O.
-func (rn *RootNode) encryptSymlinkTarget(data string) (cData64 string) {
+func (n *Node) encryptSymlinkTarget(data string) (cData64 string) {
 	if data == "" {
 		return ""
 	}
-	cData := rn.contentEnc.EncryptBlock([]byte(data), 0, nil)
-	cData64 = rn.nameTransform.B64EncodeToString(cData)
+	cData := n.contentEncoder().EncryptBlock([]byte(data), 0, nil)
+	cData64 = n.nameTransformer().B64EncodeToString(cData)
 	return cData64
 }
 
@@ -283,50 +478,54 @@ func (rn *RootNode) encryptSymlinkTarget(data string) (cData64 string) {
 // The data is encrypted like a file content block, but without binding it to
 // a file location (block number and file id are set to zero).
 // Special case: an empty value is encrypted to an empty value.
-func (rn *RootNode) encryptXattrValue(data []byte) (cData []byte) {
+func (n *Node) encryptXattrValue(data []byte) (cData []byte) {
 	if len(data) == 0 {
 		return []byte{}
 	}
-	return rn.contentEnc.EncryptBlock(data, 0, nil)
+	return n.contentEncoder().EncryptBlock(data, 0, nil)
 }
 
 // decryptXattrValue decrypts the xattr value "cData".
-func (rn *RootNode) decryptXattrValue(cData []byte) (data []byte, err error) {
+func (n *Node) decryptXattrValue(cData []byte) (data []byte, err error) {
 	if len(cData) == 0 {
 		return []byte{}, nil
 	}
-	data, err1 := rn.contentEnc.DecryptBlock([]byte(cData), 0, nil)
+	ce := n.contentEncoder()
+	data, err1 := ce.DecryptBlock([]byte(cData), 0, nil)
 	if err1 == nil {
 		return data, nil
 	}
 	// This backward compatibility is needed to support old
 	// file systems having xattr values base64-encoded.
-	cData, err2 := rn.nameTransform.B64DecodeString(string(cData))
+	cData, err2 := n.nameTransformer().B64DecodeString(string(cData))
 	if err2 != nil {
 		// Looks like the value was not base64-encoded, but just corrupt.
 		// Return the original decryption error: err1
 		return nil, err1
 	}
-	return rn.contentEnc.DecryptBlock([]byte(cData), 0, nil)
+	return ce.DecryptBlock([]byte(cData), 0, nil)
 }
 
 // encryptXattrName transforms "user.foo" to "user.gocryptfs.a5sAd4XAa47f5as6dAf"
-func (rn *RootNode) encryptXattrName(attr string) (cAttr string) {
-	// xattr names are encrypted like file names, but with a fixed IV.
-	cAttr = xattrStorePrefix + rn.nameTransform.EncryptName(attr, xattrNameIV)
-	return cAttr
+func (n *Node) encryptXattrName(attr string) (cAttr string) {
+	return EncryptXattrName(n.nameTransformer(), attr)
 }
 
-func (rn *RootNode) decryptXattrName(cAttr string) (attr string, err error) {
-	// Reject anything that does not start with "user.gocryptfs."
-	if !strings.HasPrefix(cAttr, xattrStorePrefix) {
-		return "", syscall.EINVAL
-	}
-	// Strip "user.gocryptfs." prefix
-	cAttr = cAttr[len(xattrStorePrefix):]
-	attr, err = rn.nameTransform.DecryptName(cAttr, xattrNameIV)
-	if err != nil {
-		return "", err
+func (n *Node) decryptXattrName(cAttr string) (attr string, err error) {
+	return DecryptXattrName(n.nameTransformer(), cAttr)
+}
+
+// statfsToPlain converts the block counts in "out" from ciphertext to
+// plaintext terms. The total size shrinks by the per-block overhead, and the
+// free space is the largest plaintext file that still fits, including its
+// header.
+func (rn *RootNode) statfsToPlain(out *fuse.StatfsOut) {
+	bsize := uint64(out.Bsize)
+	if bsize == 0 {
+		return
 	}
-	return attr, nil
+	ce := rn.contentEnc
+	out.Blocks = out.Blocks * ce.PlainBS() / ce.CipherBS()
+	out.Bfree = ce.CipherSpaceToPlainSpace(out.Bfree*bsize) / bsize
+	out.Bavail = ce.CipherSpaceToPlainSpace(out.Bavail*bsize) / bsize
 }
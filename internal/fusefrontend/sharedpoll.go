@@ -0,0 +1,118 @@
+package fusefrontend
+
+// Polling of the open files for changes made by other mounts, enabled via
+// cli flags "-sharedstorage" and "-sharedstorage-poll"
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sharedStat is what the polling compares to notice a change of the backing
+// file
+type sharedStat struct {
+	size  int64
+	mtime unix.Timespec
+	ctime unix.Timespec
+}
+
+func sharedStatOf(st *unix.Stat_t) sharedStat {
+	return sharedStat{size: st.Size, mtime: st.Mtim, ctime: st.Ctim}
+}
+
+// PollSharedStorage checks the open files every "interval" until "done" is
+// closed. Files that another mount has changed are dropped from the page
+// cache, and their handles forget the cached file ID and prefetched data.
+//
+// Directory entries and attributes are not cached with "-sharedstorage".
+// Open files are different: the kernel keeps their pages, and the handles
+// keep their own state.
+func (rn *RootNode) PollSharedStorage(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			rn.pollShared()
+		}
+	}
+}
+
+// pollShared checks all open files once
+func (rn *RootNode) pollShared() {
+	for _, fh := range rn.openFiles.Handles() {
+		f, ok := fh.(*File)
+		if !ok {
+			continue
+		}
+		if f.sharedChanged() {
+			f.invalidateShared()
+		}
+	}
+}
+
+// initShared records the state of the backing file when it is opened
+func (f *File) initShared() {
+	var ust unix.Stat_t
+	if err := unix.Fstat(f.intFd(), &ust); err != nil {
+		return
+	}
+	f.sharedSeen = sharedStatOf(&ust)
+	f.sharedOps = f.fileTableEntry.WriteOps()
+}
+
+// sharedChanged returns true if the backing file has changed since the last
+// poll, and the change did not come through this mount. A change of our own
+// that races with one of another mount hides the latter, concurrent writes
+// from several mounts are not safe anyway.
+//
+// Only called by the polling goroutine, which owns "sharedSeen" and
+// "sharedOps".
+func (f *File) sharedChanged() bool {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return false
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(f.intFd(), &st); err != nil {
+		return false
+	}
+	// Read after Fstat: every local change takes ContentLock before it
+	// touches the file, so the count includes whatever Fstat has seen
+	ops := f.fileTableEntry.WriteOps()
+	seen := sharedStatOf(&st)
+	changed := seen != f.sharedSeen && ops == f.sharedOps
+	f.sharedSeen = seen
+	f.sharedOps = ops
+	return changed
+}
+
+// invalidateShared makes this handle and the kernel forget what they have
+// cached about the file after another mount has changed it
+func (f *File) invalidateShared() {
+	f.rootNode.log.Debug.Printf("ino%d: changed by another mount, invalidating", f.qIno.Ino)
+	f.fdLock.RLock()
+	if !f.released {
+		// Taking the lock invalidates the prefetched data and the
+		// consecutive-write tracking, like a local write does
+		f.fileTableEntry.ContentLock.Lock()
+		f.fileTableEntry.ID = nil
+		f.fileTableEntry.ContentLock.Unlock()
+		// Not a change of the other mount
+		f.sharedOps = f.fileTableEntry.WriteOps()
+	}
+	f.fdLock.RUnlock()
+	if f.inode == nil {
+		return
+	}
+	// Drops the cached pages and attributes. ENOENT means the kernel has
+	// nothing cached.
+	if errno := f.inode.NotifyContent(0, 0); errno != 0 && errno != syscall.ENOENT {
+		f.rootNode.log.Debug.Printf("ino%d: NotifyContent: %v", f.qIno.Ino, errno)
+	}
+}
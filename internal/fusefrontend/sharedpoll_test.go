@@ -0,0 +1,69 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+func TestSharedChanged(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "sharedpoll_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rn := newTestFS(Args{Cipherdir: cipherdir, SharedStorage: true})
+	ctx := context.Background()
+	var out fuse.EntryOut
+	_, fh, _, errno := rn.Create(ctx, "file", syscall.O_RDWR, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	defer f.Release(ctx)
+	// The kernel cannot be notified without a mount
+	f.inode = nil
+	if f.sharedChanged() {
+		t.Error("unchanged file was reported")
+	}
+	// Our own writes do not count
+	if _, errno := f.Write(ctx, make([]byte, 100), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if f.sharedChanged() {
+		t.Error("local write was reported")
+	}
+	// Like another mount, without ContentLock
+	if _, err := syscall.Pwrite(f.intFd(), make([]byte, 10), 5000); err != nil {
+		t.Fatal(err)
+	}
+	if !f.sharedChanged() {
+		t.Fatal("remote write was not reported")
+	}
+	if f.sharedChanged() {
+		t.Error("remote write was reported twice")
+	}
+	f.fileTableEntry.ID = []byte("stale")
+	f.invalidateShared()
+	if f.fileTableEntry.ID != nil {
+		t.Error("file ID was not dropped")
+	}
+	if f.sharedChanged() {
+		t.Error("invalidation was reported as a change")
+	}
+}
@@ -0,0 +1,70 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+func TestMountSubdir(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "subdir_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Populate using a filesystem rooted at CIPHERDIR
+	ctx := context.Background()
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	var out fuse.EntryOut
+	if _, errno := rn.Mkdir(ctx, "sub", 0700, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	_, fh, _, errno := rn.Create(ctx, "file", syscall.O_RDWR, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(ctx)
+
+	rn2 := newTestFS(Args{Cipherdir: cipherdir})
+	if err = rn2.MountSubdir("file"); err != syscall.ENOTDIR {
+		t.Errorf("want ENOTDIR, got %v", err)
+	}
+	if err = rn2.MountSubdir("sub"); err != nil {
+		t.Fatal(err)
+	}
+	// "file" lives outside of "sub" and must not be visible
+	if _, errno = rn2.Lookup(ctx, "file", &out); errno != syscall.ENOENT {
+		t.Errorf("want ENOENT, got %v", errno)
+	}
+	// Files created in the subdir mount show up in "sub"
+	_, fh, _, errno = rn2.Create(ctx, "inner", syscall.O_RDWR, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(ctx)
+	subInode, errno := rn.Lookup(ctx, "sub", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	// Not mounted, so we have to attach the child ourselves
+	rn.AddChild("sub", subInode, false)
+	sub := subInode.Operations().(*Node)
+	if _, errno = sub.Lookup(ctx, "inner", &out); errno != 0 {
+		t.Errorf("inner not found in sub: %v", errno)
+	}
+}
@@ -0,0 +1,70 @@
+package fusefrontend
+
+// With "-syncdir", operations that change a directory fsync the ciphertext
+// directory before they report success, like "mount -o dirsync". Entries
+// that consist of several files are committed in an order that never leaves
+// a file without its metadata behind after a crash:
+//
+//  * gocryptfs.longname.*.name is durable before the entry it names is
+//    created, and the entry is gone before the .name file is deleted
+//  * gocryptfs.diriv is durable before Mkdir returns
+//  * gocryptfs.longtarget.* is durable before the symlink is created
+//
+// Leftover .name or long target files are harmless. "-fsck -repair" deletes
+// the .name files.
+
+import (
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// syncDir fsyncs the directory opened as "dirfd" with "-syncdir". "dirfd"
+// may be an O_PATH fd, which cannot be fsync'ed itself.
+// Errors are logged but not returned: the operation itself has succeeded.
+func (rn *RootNode) syncDir(dirfd int) {
+	rn.syncEntry(dirfd, ".")
+}
+
+// syncEntry fsyncs the file or directory "name" in "dirfd" with "-syncdir".
+//
+// Symlink-safe through Openat() with O_NOFOLLOW.
+func (rn *RootNode) syncEntry(dirfd int, name string) {
+	if !rn.args.SyncDir {
+		return
+	}
+	fd, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err == nil {
+		err = rn.retry("syncEntry", func() error {
+			return syscall.Fsync(fd)
+		})
+		syscall.Close(fd)
+	}
+	rn.logSyncError(err)
+}
+
+func (rn *RootNode) logSyncError(err error) {
+	if err == nil {
+		return
+	}
+	if rn.args.NetworkStorage && isFsyncUnsupported(err) {
+		rn.log.Debug.Printf("syncdir: ignoring %v", err)
+		return
+	}
+	tlog.Warn.Printf("syncdir: fsync failed: %v", err)
+}
+
+// writeLongName creates the .name file for "cName" in "dirfd" and, with
+// "-syncdir", makes it durable before the caller creates "cName".
+func (n *Node) writeLongName(dirfd int, cName string, name string) error {
+	err := n.nameTransformer().WriteLongNameAt(dirfd, cName, name)
+	if err != nil {
+		return err
+	}
+	rn := n.rootNode()
+	rn.syncEntry(dirfd, cName+nametransform.LongNameSuffix)
+	rn.syncDir(dirfd)
+	return nil
+}
@@ -0,0 +1,85 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// TestSyncDir runs the operations that fsync with "-syncdir" on long names.
+// A failed fsync, for example on an O_PATH fd, logs a warning, which panics
+// here.
+func TestSyncDir(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "syncdir_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlog.Warn.Wpanic = true
+	defer func() { tlog.Warn.Wpanic = false }()
+
+	rn := newTestFS(Args{Cipherdir: cipherdir, LongNames: true, SyncDir: true})
+	ctx := context.Background()
+	var out fuse.EntryOut
+	long := strings.Repeat("l", 200)
+	inode, errno := rn.Mkdir(ctx, "d"+long, 0700, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("d"+long, inode, false)
+	dir := inode.Operations().(*Node)
+	_, fh, _, errno := rn.Create(ctx, "f"+long, syscall.O_RDWR, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(ctx)
+	if _, errno = rn.Symlink(ctx, strings.Repeat("t", 3500), "s"+long, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno = rn.Mknod(ctx, "p"+long, syscall.S_IFIFO|0600, 0, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno = rn.Rename(ctx, "f"+long, dir, "g"+long, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno = rn.Rename(ctx, "s"+long, dir, "s"+long, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	for _, name := range []string{"g" + long, "s" + long} {
+		if errno = dir.Unlink(ctx, name); errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	if errno = rn.Unlink(ctx, "p"+long); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno = rn.Rmdir(ctx, "d"+long); errno != 0 {
+		t.Fatal(errno)
+	}
+	entries, err := ioutil.ReadDir(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != nametransform.DirIVFilename {
+			t.Errorf("leftover file %q", e.Name())
+		}
+	}
+}
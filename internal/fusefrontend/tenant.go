@@ -0,0 +1,124 @@
+package fusefrontend
+
+import (
+	"sync/atomic"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// Tenant is a top-level directory that is encrypted with a master key of
+// its own. Everything below it uses the keys of the tenant.
+type Tenant struct {
+	// Name is the plaintext name of the directory
+	Name string
+	// CName is the name of the backing directory in CIPHERDIR
+	CName string
+	// nameTransform and contentEnc are nil if the tenant is locked
+	nameTransform nametransform.NameTransformer
+	contentEnc    *contentenc.ContentEnc
+}
+
+// AddTenant makes the top-level directory "name" (backing directory "cName")
+// use the keys "c" and "n". Pass nil keys for a tenant that has not been
+// unlocked: the directory is listed, but cannot be accessed.
+// Must be called before the filesystem is mounted.
+func (rn *RootNode) AddTenant(name string, cName string, c *contentenc.ContentEnc, n nametransform.NameTransformer) {
+	rn.tenants = append(rn.tenants, &Tenant{
+		Name:          name,
+		CName:         cName,
+		nameTransform: n,
+		contentEnc:    c,
+	})
+}
+
+// tenantByName returns the index+1 of the tenant called "name" in
+// rn.tenants, or 0
+func (rn *RootNode) tenantByName(name string) uint32 {
+	for i, t := range rn.tenants {
+		if t.Name == name {
+			return uint32(i + 1)
+		}
+	}
+	return 0
+}
+
+// tenantByCName is tenantByName for the backing directory name
+func (rn *RootNode) tenantByCName(cName string) uint32 {
+	for i, t := range rn.tenants {
+		if t.CName == cName {
+			return uint32(i + 1)
+		}
+	}
+	return 0
+}
+
+// tenantAt resolves the top-level "name": it returns the index+1 of the
+// tenant and its backing name. Locked tenants, and everything that is not a
+// tenant if "-tenant" was used, give EACCES.
+func (rn *RootNode) tenantAt(name string) (idx uint32, cName string, errno syscall.Errno) {
+	idx = rn.tenantByName(name)
+	if idx == 0 {
+		if rn.args.TenantsOnly {
+			// The root keys are not known
+			return 0, "", syscall.EACCES
+		}
+		return 0, "", 0
+	}
+	t := rn.tenants[idx-1]
+	if t.contentEnc == nil {
+		return 0, "", syscall.EACCES
+	}
+	return idx, t.CName, 0
+}
+
+// tenant returns the index+1 of the tenant whose keys encrypt the entries
+// of directory "n". For other node types, that of the directory that
+// contains them. 0 means the keys of the root directory.
+func (n *Node) tenant() uint32 {
+	return atomic.LoadUint32(&n.tenantIdx)
+}
+
+func (n *Node) setTenant(idx uint32) {
+	atomic.StoreUint32(&n.tenantIdx, idx)
+}
+
+// nameTransformer returns the name encryption helper for the entries of "n"
+func (n *Node) nameTransformer() nametransform.NameTransformer {
+	rn := n.rootNode()
+	if idx := n.tenant(); idx != 0 {
+		return rn.tenants[idx-1].nameTransform
+	}
+	return rn.nameTransform
+}
+
+// contentEncoder returns the content encryption helper for the entries
+// of "n"
+func (n *Node) contentEncoder() *contentenc.ContentEnc {
+	rn := n.rootNode()
+	if idx := n.tenant(); idx != 0 {
+		return rn.tenants[idx-1].contentEnc
+	}
+	return rn.contentEnc
+}
+
+// keysUnknown returns true if "n" uses the keys of the root directory, which
+// are not known if only tenants have been unlocked ("-tenant")
+func (n *Node) keysUnknown() bool {
+	return n.tenant() == 0 && n.rootNode().args.TenantsOnly
+}
+
+// isTenantRoot returns true if "name" in directory "n" is the directory of
+// a tenant. These can only be created and deleted with "-add-tenant" and
+// "-remove-tenant".
+func (n *Node) isTenantRoot(name string) bool {
+	return n.IsRoot() && n.rootNode().tenantByName(name) != 0
+}
+
+// IsLockedTenant returns true if the top-level directory "name" belongs to a
+// tenant whose key is not known
+func (rn *RootNode) IsLockedTenant(name string) bool {
+	idx := rn.tenantByName(name)
+	return idx != 0 && rn.tenants[idx-1].contentEnc == nil
+}
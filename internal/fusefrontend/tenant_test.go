@@ -0,0 +1,145 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// listNames returns the names in directory "n", without "." and ".."
+func listNames(t *testing.T, n fs.NodeReaddirer) map[string]bool {
+	ds, errno := n.Readdir(context.Background())
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	names := map[string]bool{}
+	for ds.HasNext() {
+		e, _ := ds.Next()
+		if e.Name != "." && e.Name != ".." {
+			names[e.Name] = true
+		}
+	}
+	return names
+}
+
+func TestTenants(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "tenant_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	for _, dir := range []string{"", "alice.c", "bob.c"} {
+		if dir != "" {
+			if err := os.Mkdir(filepath.Join(cipherdir, dir), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dirfd, err := syscall.Open(filepath.Join(cipherdir, dir), syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = nametransform.WriteDirIVAt(dirfd)
+		syscall.Close(dirfd)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Alice has a key of her own, Bob is locked
+	key := make([]byte, cryptocore.KeyLen)
+	key[0] = 1
+	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
+	aliceEnc := contentenc.New(cCore, contentenc.DefaultBS, false)
+	aliceNames := nametransform.New(cCore.EMECipher, true, true)
+	ctx := context.Background()
+	var out fuse.EntryOut
+
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	rn.AddTenant("alice", "alice.c", aliceEnc, aliceNames)
+	rn.AddTenant("bob", "bob.c", nil, nil)
+	if !rn.IsLockedTenant("bob") || rn.IsLockedTenant("alice") || rn.IsLockedTenant("shared") {
+		t.Error("IsLockedTenant is wrong")
+	}
+	if _, errno := rn.Mkdir(ctx, "shared", 0700, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	names := listNames(t, rn)
+	if !names["alice"] || !names["bob"] || !names["shared"] || len(names) != 3 {
+		t.Errorf("wrong root listing: %v", names)
+	}
+	if _, errno := rn.Lookup(ctx, "bob", &out); errno != syscall.EACCES {
+		t.Errorf("locked tenant: want EACCES, got %v", errno)
+	}
+	if errno := rn.Rmdir(ctx, "alice"); errno != syscall.EPERM {
+		t.Errorf("rmdir tenant: want EPERM, got %v", errno)
+	}
+	aliceInode, errno := rn.Lookup(ctx, "alice", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("alice", aliceInode, false)
+	alice := aliceInode.Operations().(*Node)
+	_, fh, _, errno := alice.Create(ctx, "secret", syscall.O_RDWR, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	if _, errno = f.Write(ctx, []byte("hello"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.Release(ctx)
+	// The name is encrypted with the key of the tenant
+	dirfd, err := syscall.Open(filepath.Join(cipherdir, "alice.c"), syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv, err := nametransform.ReadDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cName := aliceNames.EncryptName("secret", iv)
+	if _, err := os.Stat(filepath.Join(cipherdir, "alice.c", cName)); err != nil {
+		t.Error(err)
+	}
+	if errno = alice.Rename(ctx, "secret", rn, "secret", 0); errno != syscall.EXDEV {
+		t.Errorf("rename out of tenant: want EXDEV, got %v", errno)
+	}
+	path, err := rn.DecryptPath(filepath.Join("alice.c", cName))
+	if err != nil || path != "alice/secret" {
+		t.Errorf("DecryptPath: %q, %v", path, err)
+	}
+
+	// Only the tenants can be accessed without the root keys
+	rn2 := newTestFS(Args{Cipherdir: cipherdir, TenantsOnly: true})
+	rn2.AddTenant("alice", "alice.c", aliceEnc, aliceNames)
+	rn2.AddTenant("bob", "bob.c", nil, nil)
+	names = listNames(t, rn2)
+	if !names["alice"] || !names["bob"] || len(names) != 2 {
+		t.Errorf("wrong root listing: %v", names)
+	}
+	if _, errno := rn2.Lookup(ctx, "shared", &out); errno != syscall.EACCES {
+		t.Errorf("root entry: want EACCES, got %v", errno)
+	}
+	if _, errno := rn2.Mkdir(ctx, "new", 0700, &out); errno != syscall.EACCES {
+		t.Errorf("mkdir in root: want EACCES, got %v", errno)
+	}
+	aliceInode, errno = rn2.Lookup(ctx, "alice", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn2.AddChild("alice", aliceInode, false)
+	names = listNames(t, aliceInode.Operations().(*Node))
+	if !names["secret"] || len(names) != 1 {
+		t.Errorf("wrong tenant listing: %v", names)
+	}
+}
@@ -0,0 +1,96 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/verifylog"
+)
+
+// TestVerifyLog corrupts the second block of a file and checks that reading
+// it fails with EIO and shows up in the "-verify-mount" report.
+func TestVerifyLog(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "verifylog_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := filepath.Join(cipherdir, "report")
+	vl, err := verifylog.Open(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rn := newTestFS(Args{Cipherdir: cipherdir, VerifyLog: vl})
+	ctx := context.Background()
+	var out fuse.EntryOut
+	inode, fh, _, errno := rn.Create(ctx, "file", syscall.O_RDWR, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("file", inode, false)
+	f := fh.(*File)
+	data := make([]byte, 3*contentenc.DefaultBS)
+	if _, errno = f.Write(ctx, data, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.Release(ctx)
+
+	cName, err := rn.EncryptPath("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backing, err := os.OpenFile(filepath.Join(cipherdir, cName), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := int64(contentenc.HeaderLen + f.contentEnc.CipherBS() + 100)
+	_, err = backing.WriteAt([]byte{0xff, 0xff}, off)
+	backing.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh, _, errno = inode.Operations().(*Node).Open(ctx, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f = fh.(*File)
+	buf := make([]byte, len(data))
+	if _, errno = f.Read(ctx, buf[:contentenc.DefaultBS], 0); errno != 0 {
+		t.Errorf("block 0: %v", errno)
+	}
+	if _, errno = f.Read(ctx, buf, 0); errno != syscall.EIO {
+		t.Errorf("want EIO, got %v", errno)
+	}
+	f.Release(ctx)
+	vl.Close()
+
+	got, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "corrupt: file: block 1: ") {
+		t.Errorf("block not reported:\n%s", got)
+	}
+	if !strings.Contains(string(got), "summary: file: blocks 1\n") {
+		t.Errorf("summary missing:\n%s", got)
+	}
+}
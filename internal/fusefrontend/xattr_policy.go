@@ -0,0 +1,84 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// XattrPolicy says how the xattrs of a namespace are stored in CIPHERDIR
+type XattrPolicy int
+
+const (
+	// XattrEncrypt encrypts name and value and stores them in the "user."
+	// namespace. This is what happens to all xattrs except ACLs by default.
+	XattrEncrypt XattrPolicy = iota
+	// XattrPassthrough stores the xattr as it is. SELinux labels and the
+	// security.NTACL of Samba need this.
+	XattrPassthrough
+	// XattrDeny rejects the xattrs of the namespace with EOPNOTSUPP
+	XattrDeny
+)
+
+var xattrPolicyNames = map[string]XattrPolicy{
+	"encrypt":     XattrEncrypt,
+	"passthrough": XattrPassthrough,
+	"deny":        XattrDeny,
+}
+
+// XattrPolicies maps the namespaces "security" and "trusted" to their
+// policy, "-xattr-policy". Namespaces that are not in the map get the
+// default of the frontend.
+type XattrPolicies map[string]XattrPolicy
+
+// ParseXattrPolicies parses a list like "security=passthrough,trusted=deny"
+func ParseXattrPolicies(s string) (XattrPolicies, error) {
+	p := XattrPolicies{}
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q: want NAMESPACE=POLICY", item)
+		}
+		if kv[0] != "security" && kv[0] != "trusted" {
+			return nil, fmt.Errorf("%q: namespace must be security or trusted", item)
+		}
+		policy, ok := xattrPolicyNames[kv[1]]
+		if !ok {
+			return nil, fmt.Errorf("%q: policy must be encrypt, passthrough or deny", item)
+		}
+		p[kv[0]] = policy
+	}
+	return p, nil
+}
+
+// Lookup returns the policy for the xattr "attr", or "def" if its
+// namespace has none
+func (p XattrPolicies) Lookup(attr string, def XattrPolicy) XattrPolicy {
+	i := strings.IndexByte(attr, '.')
+	if i < 0 {
+		return def
+	}
+	if policy, ok := p[attr[:i]]; ok {
+		return policy
+	}
+	return def
+}
+
+// EncryptXattrName transforms "user.foo" to "user.gocryptfs.a5sAd4XAa47f5as6dAf".
+// Reverse mode uses this to show xattrs the way forward mode stores them.
+func EncryptXattrName(nt nametransform.NameTransformer, attr string) (cAttr string) {
+	// xattr names are encrypted like file names, but with a fixed IV.
+	return xattrStorePrefix + nt.EncryptName(attr, xattrNameIV)
+}
+
+// DecryptXattrName is the inverse of EncryptXattrName
+func DecryptXattrName(nt nametransform.NameTransformer, cAttr string) (attr string, err error) {
+	// Reject anything that does not start with "user.gocryptfs."
+	if !strings.HasPrefix(cAttr, xattrStorePrefix) {
+		return "", syscall.EINVAL
+	}
+	// Strip "user.gocryptfs." prefix
+	return nt.DecryptName(cAttr[len(xattrStorePrefix):], xattrNameIV)
+}
@@ -40,3 +40,30 @@ func TestEncryptDecryptXattrName(t *testing.T) {
 		t.Fatalf("Decrypt mismatch: %v != %v", attr1, attr2)
 	}
 }
+
+func TestParseXattrPolicies(t *testing.T) {
+	p, err := ParseXattrPolicies("security=passthrough,trusted=deny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		attr string
+		want XattrPolicy
+	}{
+		{"security.selinux", XattrPassthrough},
+		{"security.NTACL", XattrPassthrough},
+		{"trusted.overlay.opaque", XattrDeny},
+		{"user.foo", XattrEncrypt},
+		{"securityfoo", XattrEncrypt},
+	}
+	for _, tc := range testCases {
+		if have := p.Lookup(tc.attr, XattrEncrypt); have != tc.want {
+			t.Errorf("%q: have policy %d, want %d", tc.attr, have, tc.want)
+		}
+	}
+	for _, s := range []string{"", "security", "user=deny", "security=plain"} {
+		if _, err := ParseXattrPolicies(s); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
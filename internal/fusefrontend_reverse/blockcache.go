@@ -0,0 +1,109 @@
+package fusefrontend_reverse
+
+import (
+	"container/list"
+	"sync"
+	"syscall"
+)
+
+// blockCacheBytes is the maximum amount of ciphertext held in the block cache
+const blockCacheBytes = 16 * 1024 * 1024
+
+// blockKey identifies a ciphertext block. The ciphertext depends on the file
+// ID, which is derived from the path, so the same inode can produce different
+// ciphertext when accessed through different paths.
+type blockKey struct {
+	dev     uint64
+	ino     uint64
+	id      [16]byte
+	blockNo uint64
+}
+
+// fileVersion identifies the version of the plaintext file a block was
+// encrypted from. The ctime catches changes even if the mtime has been reset.
+type fileVersion struct {
+	size  int64
+	mtime syscall.Timespec
+	ctime syscall.Timespec
+}
+
+type blockCacheEntry struct {
+	key  blockKey
+	ver  fileVersion
+	data []byte
+}
+
+// blockCache is a bounded LRU cache of recently produced ciphertext blocks.
+// Backup tools often read a file twice (checksum, then copy), which would
+// otherwise pay for the encryption twice.
+type blockCache struct {
+	sync.Mutex
+	// maxBlocks is the capacity of the cache
+	maxBlocks int
+	// lru has the most recently used entry at the front
+	lru     *list.List
+	entries map[blockKey]*list.Element
+}
+
+func newBlockCache(maxBlocks int) *blockCache {
+	return &blockCache{
+		maxBlocks: maxBlocks,
+		lru:       list.New(),
+		entries:   make(map[blockKey]*list.Element),
+	}
+}
+
+// getRange returns the concatenated ciphertext of "count" blocks starting at
+// key.blockNo, if all of them are cached for version "ver".
+func (c *blockCache) getRange(key blockKey, ver fileVersion, count int) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	var out []byte
+	for i := 0; i < count; i++ {
+		el := c.entries[key]
+		if el == nil {
+			return nil, false
+		}
+		e := el.Value.(*blockCacheEntry)
+		if e.ver != ver {
+			// The plaintext has changed, drop the stale entry
+			c.remove(el)
+			return nil, false
+		}
+		c.lru.MoveToFront(el)
+		out = append(out, e.data...)
+		key.blockNo++
+	}
+	return out, true
+}
+
+// put stores the ciphertext block "data", which must not be modified
+// afterwards.
+func (c *blockCache) put(key blockKey, ver fileVersion, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if el := c.entries[key]; el != nil {
+		e := el.Value.(*blockCacheEntry)
+		e.ver = ver
+		e.data = data
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&blockCacheEntry{key: key, ver: ver, data: data})
+	for c.lru.Len() > c.maxBlocks {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *blockCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*blockCacheEntry).key)
+}
+
+// clear drops all entries
+func (c *blockCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.lru.Init()
+	c.entries = make(map[blockKey]*list.Element)
+}
@@ -0,0 +1,46 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	c := newBlockCache(2)
+	k := blockKey{ino: 1}
+	v1 := fileVersion{size: 10}
+	c.put(k, v1, []byte("a"))
+	k2 := k
+	k2.blockNo = 1
+	c.put(k2, v1, []byte("b"))
+
+	out, ok := c.getRange(k, v1, 2)
+	if !ok || !bytes.Equal(out, []byte("ab")) {
+		t.Fatalf("getRange: %q %v", out, ok)
+	}
+	// Block 2 is missing
+	if _, ok := c.getRange(k, v1, 3); ok {
+		t.Error("incomplete range reported as cached")
+	}
+	// A changed file must not be served from the cache, and the stale
+	// entry is dropped
+	v2 := fileVersion{size: 10, ctime: syscall.Timespec{Sec: 1}}
+	if _, ok := c.getRange(k, v2, 1); ok {
+		t.Error("stale block returned")
+	}
+	if c.lru.Len() != 1 {
+		t.Errorf("stale entry not removed, len=%d", c.lru.Len())
+	}
+	// Capacity is enforced, least recently used goes first
+	k3 := k
+	k3.blockNo = 2
+	c.put(k, v2, []byte("A"))
+	c.put(k3, v2, []byte("C"))
+	if c.lru.Len() != 2 {
+		t.Errorf("capacity exceeded, len=%d", c.lru.Len())
+	}
+	if _, ok := c.getRange(k2, v1, 1); ok {
+		t.Error("least recently used block was not evicted")
+	}
+}
@@ -1,17 +1,23 @@
 package fusefrontend_reverse
 
 import (
+	"errors"
+	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 
+	"github.com/HorizonLiu/gocryptfs/ctlsock"
 	"github.com/HorizonLiu/gocryptfs/internal/ctlsocksrv"
 	"github.com/HorizonLiu/gocryptfs/internal/pathiv"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
 )
 
 // Verify that the interface is implemented.
 var _ ctlsocksrv.Interface = &RootNode{}
+var _ ctlsocksrv.TreeWalker = &RootNode{}
 
 // EncryptPath implements ctlsock.Backend.
 // This is used for the control socket and for the "-exclude" logic.
@@ -22,18 +28,111 @@ func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
 	cipherPath := ""
 	parts := strings.Split(plainPath, "/")
 	for _, part := range parts {
-		dirIV := pathiv.Derive(cipherPath, pathiv.PurposeDirIV)
-		encryptedPart := rn.nameTransform.EncryptName(part, dirIV)
-		if rn.args.LongNames && len(encryptedPart) > unix.NAME_MAX {
-			encryptedPart = rn.nameTransform.HashLongName(encryptedPart)
-		}
-		cipherPath = filepath.Join(cipherPath, encryptedPart)
+		cipherPath = filepath.Join(cipherPath, rn.encryptNameIn(cipherPath, part))
 	}
 	return cipherPath, nil
 }
 
+// encryptNameIn encrypts the name "pName" of an entry of the directory
+// "cipherDir"
+func (rn *RootNode) encryptNameIn(cipherDir string, pName string) string {
+	dirIV := pathiv.Derive(cipherDir, pathiv.PurposeDirIV)
+	cName := rn.nameTransform.EncryptName(pName, dirIV)
+	if rn.args.LongNames && len(cName) > unix.NAME_MAX {
+		cName = rn.nameTransform.HashLongName(cName)
+	}
+	return cName
+}
+
 // DecryptPath implements ctlsock.Backend
 func (rn *RootNode) DecryptPath(cipherPath string) (string, error) {
 	p, err := rn.decryptPath(cipherPath)
 	return p, err
 }
+
+// errTreeFull stops walkDir() when the maximum number of entries is reached
+var errTreeFull = errors.New("tree is full")
+
+// WalkTree implements ctlsocksrv.TreeWalker. Excluded files and, with
+// "-one-file-system", the contents of other filesystems are left out like in
+// Readdir().
+//
+// Symlink-safe through OpenDirNofollow() and Openat() with O_NOFOLLOW.
+func (rn *RootNode) WalkTree(plainDir string, max int) (tree []ctlsock.PathPair, truncated bool, err error) {
+	if rn.isExcludedPlain(plainDir) {
+		return nil, false, syscall.EPERM
+	}
+	cipherDir, err := rn.EncryptPath(plainDir)
+	if err != nil {
+		return nil, false, err
+	}
+	dirfd, err := syscallcompat.OpenDirNofollow(rn.args.Cipherdir, plainDir)
+	if err != nil {
+		return nil, false, err
+	}
+	// OpenDirNofollow returns an O_PATH fd that cannot be listed
+	fd, err := syscallcompat.Openat(dirfd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	syscall.Close(dirfd)
+	if err != nil {
+		return nil, false, err
+	}
+	err = rn.walkDir(fd, plainDir, cipherDir, max, &tree)
+	if err == errTreeFull {
+		return tree, true, nil
+	}
+	return tree, false, err
+}
+
+// walkDir appends the entries of the plaintext directory "fd" and its
+// subdirectories to "tree" and closes "fd".
+func (rn *RootNode) walkDir(fd int, plainDir string, cipherDir string, max int, tree *[]ctlsock.PathPair) error {
+	defer syscall.Close(fd)
+	if rn.isOtherFs(fd) {
+		return nil
+	}
+	entries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := ctlsock.PathPair{
+			Plain:  path.Join(plainDir, e.Name),
+			Cipher: path.Join(cipherDir, e.Name),
+		}
+		if rn.isExcludedPlain(p.Plain) {
+			continue
+		}
+		if !rn.args.PlaintextNames {
+			p.Cipher = path.Join(cipherDir, rn.encryptNameIn(cipherDir, e.Name))
+		}
+		if len(*tree) >= max {
+			return errTreeFull
+		}
+		*tree = append(*tree, p)
+		if e.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			continue
+		}
+		fd2, err := syscallcompat.Openat(fd, e.Name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		if err := rn.walkDir(fd2, p.Plain, p.Cipher, max, tree); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenFiles implements ctlsocksrv.OpenFilesLister. Returns the plaintext
+// paths of all open files.
+func (rn *RootNode) OpenFiles() []string {
+	return rn.openFiles.List()
+}
+
+// FlushCaches implements ctlsocksrv.CacheFlusher
+func (rn *RootNode) FlushCaches() {
+	rn.blockCache.clear()
+	if f, ok := rn.getExcluder().(*ignoreFiles); ok {
+		f.flush()
+	}
+}
@@ -0,0 +1,68 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/ctlsock"
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+)
+
+func TestWalkTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walktree_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"a/b", "c"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"a/b/f1", "a/f2", "a/excluded"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rn := &RootNode{
+		args:     fusefrontend.Args{Cipherdir: dir, PlaintextNames: true},
+		excluder: &IgnoreParserMock{toExclude: "a/excluded"},
+	}
+	tree, truncated, err := rn.WalkTree("", 100)
+	if err != nil || truncated {
+		t.Fatal(err, truncated)
+	}
+	var have []string
+	for _, p := range tree {
+		if p.Plain != p.Cipher {
+			t.Errorf("PlaintextNames: %q != %q", p.Plain, p.Cipher)
+		}
+		have = append(have, p.Plain)
+	}
+	sort.Strings(have)
+	want := []string{"a", "a/b", "a/b/f1", "a/f2", "c"}
+	if len(have) != len(want) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Fatalf("want %v, have %v", want, have)
+		}
+	}
+	// Subtree
+	tree, truncated, err = rn.WalkTree("a/b", 100)
+	if err != nil || truncated {
+		t.Fatal(err, truncated)
+	}
+	if len(tree) != 1 || tree[0] != (ctlsock.PathPair{Plain: "a/b/f1", Cipher: "a/b/f1"}) {
+		t.Errorf("wrong subtree: %v", tree)
+	}
+	// Limit
+	tree, truncated, err = rn.WalkTree("", 3)
+	if err != nil || !truncated || len(tree) != 3 {
+		t.Errorf("limit 3: err=%v truncated=%v tree=%v", err, truncated, tree)
+	}
+}
@@ -1,10 +1,7 @@
 package fusefrontend_reverse
 
 import (
-	"io/ioutil"
-	"log"
 	"os"
-	"strings"
 
 	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
 	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
@@ -14,50 +11,13 @@ import (
 )
 
 // prepareExcluder creates an object to check if paths are excluded
-// based on the patterns specified in the command line.
-func prepareExcluder(args fusefrontend.Args) *ignore.GitIgnore {
-	patterns := getExclusionPatterns(args)
-	if len(patterns) == 0 {
-		log.Panic(patterns)
-	}
-	excluder, err := ignore.CompileIgnoreLines(patterns...)
+// based on the patterns specified in the command line. Returns nil if there
+// are no patterns, for example if all filter rules are comments.
+func prepareExcluder(args fusefrontend.Args) ignore.IgnoreParser {
+	excluder, err := fusefrontend.CompileExcluder(args)
 	if err != nil {
-		tlog.Fatal.Printf("Error compiling exclusion rules: %v", err)
+		tlog.Fatal.Printf("%v", err)
 		os.Exit(exitcodes.ExcludeError)
 	}
 	return excluder
 }
-
-// getExclusionPatters prepares a list of patterns to be excluded.
-// Patterns passed in the -exclude command line option are prefixed
-// with a leading '/' to preserve backwards compatibility (before
-// wildcard matching was implemented, exclusions always were matched
-// against the full path).
-func getExclusionPatterns(args fusefrontend.Args) []string {
-	patterns := make([]string, len(args.Exclude)+len(args.ExcludeWildcard))
-	// add -exclude
-	for i, p := range args.Exclude {
-		patterns[i] = "/" + p
-	}
-	// add -exclude-wildcard
-	copy(patterns[len(args.Exclude):], args.ExcludeWildcard)
-	// add -exclude-from
-	for _, file := range args.ExcludeFrom {
-		lines, err := getLines(file)
-		if err != nil {
-			tlog.Fatal.Printf("Error reading exclusion patterns: %q", err)
-			os.Exit(exitcodes.ExcludeError)
-		}
-		patterns = append(patterns, lines...)
-	}
-	return patterns
-}
-
-// getLines reads a file and splits it into lines
-func getLines(file string) ([]string, error) {
-	buffer, err := ioutil.ReadFile(file)
-	if err != nil {
-		return nil, err
-	}
-	return strings.Split(string(buffer), "\n"), nil
-}
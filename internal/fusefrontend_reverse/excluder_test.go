@@ -1,75 +1,97 @@
 package fusefrontend_reverse
 
 import (
-	"io/ioutil"
-	"os"
-	"reflect"
 	"testing"
 
 	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
 )
 
-func TestShouldPrefixExcludeValuesWithSlash(t *testing.T) {
-	var args fusefrontend.Args
-	args.Exclude = []string{"file1", "dir1/file2.txt"}
-	args.ExcludeWildcard = []string{"*~", "build/*.o"}
-
-	expected := []string{"/file1", "/dir1/file2.txt", "*~", "build/*.o"}
-
-	patterns := getExclusionPatterns(args)
-	if !reflect.DeepEqual(patterns, expected) {
-		t.Errorf("expected %q, got %q", expected, patterns)
+func TestShouldReturnFalseIfThereAreNoExclusions(t *testing.T) {
+	var rfs RootNode
+	if rfs.isExcludedPlain("any/path") {
+		t.Error("Should not exclude any path if no exclusions were specified")
 	}
 }
 
-func TestShouldReadExcludePatternsFromFiles(t *testing.T) {
-	tmpfile1, err := ioutil.TempFile("", "excludetest")
-	if err != nil {
-		t.Fatal(err)
-	}
-	exclude1 := tmpfile1.Name()
-	defer os.Remove(exclude1)
-	defer tmpfile1.Close()
+func TestShouldCallIgnoreParserToCheckExclusion(t *testing.T) {
+	rfs, ignorerMock := createRFSWithMocks()
 
-	tmpfile2, err := ioutil.TempFile("", "excludetest")
-	if err != nil {
-		t.Fatal(err)
+	rfs.isExcludedPlain("some/path")
+	if ignorerMock.calledWith != "some/path" {
+		t.Error("Failed to call IgnoreParser")
 	}
-	exclude2 := tmpfile2.Name()
-	defer os.Remove(exclude2)
-	defer tmpfile2.Close()
-
-	tmpfile1.WriteString("file1.1\n")
-	tmpfile1.WriteString("file1.2\n")
-	tmpfile2.WriteString("file2.1\n")
-	tmpfile2.WriteString("file2.2\n")
+}
 
+func TestIncludeOverridesExclude(t *testing.T) {
 	var args fusefrontend.Args
-	args.ExcludeWildcard = []string{"cmdline1"}
-	args.ExcludeFrom = []string{exclude1, exclude2}
-
-	// An empty string is returned for the last empty line
-	// It's ignored when the patterns are actually compiled
-	expected := []string{"cmdline1", "file1.1", "file1.2", "", "file2.1", "file2.2", ""}
-
-	patterns := getExclusionPatterns(args)
-	if !reflect.DeepEqual(patterns, expected) {
-		t.Errorf("expected %q, got %q", expected, patterns)
+	args.ExcludeWildcard = []string{"*"}
+	args.Include = []string{"home/user/docs"}
+	excluder := prepareExcluder(args)
+	for path, want := range map[string]bool{
+		"home":                   false,
+		"home/user":              false,
+		"home/user/docs":         false,
+		"home/user/docs/a/b.txt": false,
+		"home/other":             true,
+		"home/user/music":        true,
+		"etc":                    true,
+	} {
+		if got := excluder.MatchesPath(path); got != want {
+			t.Errorf("%q: want excluded=%v, got %v", path, want, got)
+		}
 	}
 }
 
-func TestShouldReturnFalseIfThereAreNoExclusions(t *testing.T) {
-	var rfs RootNode
-	if rfs.isExcludedPlain("any/path") {
-		t.Error("Should not exclude any path if no exclusions were specified")
+func TestFilterRulesFirstMatchWins(t *testing.T) {
+	var args fusefrontend.Args
+	args.Filter = []string{
+		"# comment",
+		"- /src/*.o",
+		"+ /src/***",
+		"+ /doc",
+		"- *",
+	}
+	excluder := prepareExcluder(args)
+	for path, want := range map[string]bool{
+		"":            false,
+		"src":         false,
+		"src/a.c":     false,
+		"src/a.o":     true,
+		"src/sub/a.o": false,
+		"doc":         false,
+		// "+ /doc" does not match what is below it
+		"doc/a.txt": true,
+		"build":     true,
+		"build/a.o": true,
+	} {
+		if got := excluder.MatchesPath(path); got != want {
+			t.Errorf("%q: want excluded=%v, got %v", path, want, got)
+		}
 	}
 }
 
-func TestShouldCallIgnoreParserToCheckExclusion(t *testing.T) {
-	rfs, ignorerMock := createRFSWithMocks()
+func TestFilterRulesExcludedParent(t *testing.T) {
+	var args fusefrontend.Args
+	args.Filter = []string{"- /tmp", "+ *.txt"}
+	args.ExcludeWildcard = []string{"*.o"}
+	excluder := prepareExcluder(args)
+	for path, want := range map[string]bool{
+		"tmp/a.txt": true,
+		"a.txt":     false,
+		"a.o":       true,
+		"sub/b.o":   true,
+		"sub/b.c":   false,
+	} {
+		if got := excluder.MatchesPath(path); got != want {
+			t.Errorf("%q: want excluded=%v, got %v", path, want, got)
+		}
+	}
+}
 
-	rfs.isExcludedPlain("some/path")
-	if ignorerMock.calledWith != "some/path" {
-		t.Error("Failed to call IgnoreParser")
+func TestEmptyFilterRules(t *testing.T) {
+	var args fusefrontend.Args
+	args.Filter = []string{"# only a comment", ""}
+	if excluder := prepareExcluder(args); excluder != nil {
+		t.Errorf("want no excluder, got %#v", excluder)
 	}
 }
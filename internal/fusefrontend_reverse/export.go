@@ -0,0 +1,289 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/pathiv"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// exportBlocks is the number of blocks ExportEntry.Content encrypts at once
+const exportBlocks = 32
+
+// ExportEntry is a file, directory or symlink in the encrypted view, see
+// Export()
+type ExportEntry struct {
+	// Path is the relative ciphertext path
+	Path string
+	// Mode contains the file type and permission bits, like st_mode
+	Mode uint32
+	Uid  uint32
+	Gid  uint32
+	// Mtime is the modification time of the backing file
+	Mtime time.Time
+	// Size is the ciphertext size of regular files
+	Size int64
+	// Target is the encrypted target of symlinks
+	Target string
+	// Content returns the ciphertext of regular files. Only valid during the
+	// call to the Export() callback.
+	Content io.Reader
+}
+
+// exportItem is a directory entry, with its ciphertext name, that Export()
+// has to visit
+type exportItem struct {
+	cName string
+	pName string
+	// content is set for the virtual gocryptfs.diriv and
+	// gocryptfs.longname.*.name files
+	content []byte
+}
+
+// Export calls "fn" for each entry of the encrypted view, as a mount would
+// show it, without mounting. Directories are visited before their contents,
+// the entries of a directory in lexical order of their ciphertext names, so
+// the order is stable. Excluded files and, with "-one-file-system", the
+// contents of other filesystems are left out like in Readdir().
+//
+// Symlink-safe through OpenDirNofollow() and Openat() with O_NOFOLLOW.
+func (rn *RootNode) Export(fn func(e *ExportEntry) error) error {
+	dirfd, err := syscallcompat.OpenDirNofollow(rn.args.Cipherdir, "")
+	if err != nil {
+		return err
+	}
+	// OpenDirNofollow returns an O_PATH fd that cannot be listed
+	fd, err := syscallcompat.Openat(dirfd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	syscall.Close(dirfd)
+	if err != nil {
+		return err
+	}
+	return rn.exportDir(fd, "", "", fn)
+}
+
+// exportDir exports the contents of the plaintext directory "fd" and its
+// subdirectories and closes "fd".
+func (rn *RootNode) exportDir(fd int, pDir string, cDir string, fn func(e *ExportEntry) error) error {
+	defer syscall.Close(fd)
+	var dirSt syscall.Stat_t
+	if err := syscall.Fstat(fd, &dirSt); err != nil {
+		return err
+	}
+	var entries []string
+	if !rn.isOtherFs(fd) {
+		dirents, err := syscallcompat.Getdents(fd)
+		if err != nil {
+			return err
+		}
+		for _, e := range dirents {
+			if !rn.isExcludedPlain(filepath.Join(pDir, e.Name)) {
+				entries = append(entries, e.Name)
+			}
+		}
+	}
+	items := make([]exportItem, 0, len(entries)+1)
+	isRoot := pDir == ""
+	if rn.args.PlaintextNames {
+		for _, pName := range entries {
+			cName := pName
+			if isRoot && !rn.args.ConfigCustom {
+				if pName == configfile.ConfDefaultName {
+					// Shadowed by .gocryptfs.reverse.conf, see
+					// readdirPlaintextnames()
+					tlog.Warn.Printf("Export: skipping %q, it is shadowed by %q",
+						configfile.ConfDefaultName, configfile.ConfReverseName)
+					continue
+				} else if pName == configfile.ConfReverseName {
+					cName = configfile.ConfDefaultName
+				}
+			}
+			items = append(items, exportItem{cName: cName, pName: pName})
+		}
+	} else {
+		dirIV := pathiv.Derive(cDir, pathiv.PurposeDirIV)
+		items = append(items, exportItem{cName: nametransform.DirIVFilename, content: dirIV})
+		for _, pName := range entries {
+			// ".gocryptfs.reverse.conf" in the root directory is mapped to "gocryptfs.conf"
+			if isRoot && pName == configfile.ConfReverseName && !rn.args.ConfigCustom {
+				items = append(items, exportItem{cName: configfile.ConfDefaultName, pName: pName})
+				continue
+			}
+			cName := rn.nameTransform.EncryptName(pName, dirIV)
+			if len(cName) > unix.NAME_MAX {
+				cFullName := cName
+				cName = rn.nameTransform.HashLongName(cFullName)
+				items = append(items, exportItem{
+					cName:   cName + nametransform.LongNameSuffix,
+					pName:   pName,
+					content: []byte(cFullName),
+				})
+			}
+			items = append(items, exportItem{cName: cName, pName: pName})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].cName < items[j].cName })
+	for _, it := range items {
+		if err := rn.exportItem(fd, &dirSt, pDir, cDir, it, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportItem exports "it", an entry of the plaintext directory "fd" with the
+// attributes "dirSt" and the relative paths "pDir" and "cDir"
+func (rn *RootNode) exportItem(fd int, dirSt *syscall.Stat_t, pDir string, cDir string, it exportItem, fn func(e *ExportEntry) error) error {
+	cPath := filepath.Join(cDir, it.cName)
+	var st *syscall.Stat_t
+	if it.pName == "" {
+		// gocryptfs.diriv gets the attributes of the directory, see
+		// lookupDiriv()
+		st = dirSt
+	} else {
+		var err error
+		st, err = syscallcompat.Fstatat2(fd, it.pName, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			return err
+		}
+	}
+	mtime := statMtime(st)
+	e := &ExportEntry{
+		Path:  cPath,
+		Mode:  uint32(st.Mode),
+		Uid:   st.Uid,
+		Gid:   st.Gid,
+		Mtime: time.Unix(mtime.Unix()),
+	}
+	if rn.args.ForceOwner != nil {
+		e.Uid = rn.args.ForceOwner.Uid
+		e.Gid = rn.args.ForceOwner.Gid
+	}
+	if rn.args.ForcePerms != nil {
+		e.Mode = rn.args.ForcePerms.Apply(e.Mode)
+	}
+	if it.content != nil {
+		e.Mode = virtualFileMode
+		e.Size = int64(len(it.content))
+		e.Content = bytes.NewReader(it.content)
+		return fn(e)
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		if err := fn(e); err != nil {
+			return err
+		}
+		fd2, err := syscallcompat.Openat(fd, it.pName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		return rn.exportDir(fd2, filepath.Join(pDir, it.pName), cPath, fn)
+	case syscall.S_IFREG:
+		fd2, err := syscallcompat.Openat(fd, it.pName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		f := os.NewFile(uintptr(fd2), it.pName)
+		defer f.Close()
+		if cDir == "" && it.cName == configfile.ConfDefaultName && !rn.args.ConfigCustom {
+			// The config file is passed through unencrypted
+			e.Size = st.Size
+			e.Content = io.LimitReader(f, st.Size)
+			return fn(e)
+		}
+		e.Size = int64(rn.contentEnc.PlainSizeToCipherSize(uint64(st.Size)))
+		e.Content = rn.newExportReader(f, st, cPath)
+		return fn(e)
+	case syscall.S_IFLNK:
+		plainTarget, err := syscallcompat.Readlinkat(fd, it.pName)
+		if err != nil {
+			return err
+		}
+		// Same nonce as Readlink() on a mount uses, see readlink()
+		cTarget, errno := rn.encryptSymlinkTarget(plainTarget, filepath.Join(cPath, it.cName))
+		if errno != 0 {
+			return errno
+		}
+		e.Target = string(cTarget)
+		return fn(e)
+	default:
+		return fn(e)
+	}
+}
+
+// newExportReader returns a reader that produces the ciphertext of the
+// backing file "f" with the attributes "st", like File.Read(). If the file
+// shrinks while it is read, the reader returns io.ErrUnexpectedEOF. If it
+// grows, only the first st.Size bytes are encrypted.
+func (rn *RootNode) newExportReader(f *os.File, st *syscall.Stat_t, cPath string) io.Reader {
+	if st.Size == 0 {
+		// An empty file stays empty in encrypted form
+		return bytes.NewReader(nil)
+	}
+	// Each name of a hard-linked file is exported as a separate file with
+	// its own ciphertext
+	derivedIVs := pathiv.DeriveFile(cPath)
+	header := contentenc.FileHeader{
+		Version: contentenc.CurrentVersion,
+		ID:      derivedIVs.ID,
+	}
+	r := &exportReader{
+		file: &File{
+			fd:         f,
+			header:     header,
+			block0IV:   derivedIVs.Block0IV,
+			contentEnc: rn.contentEnc,
+		},
+		size: uint64(st.Size),
+	}
+	return io.MultiReader(bytes.NewReader(header.Pack()), r)
+}
+
+// exportReader encrypts the backing file of "file" block by block
+type exportReader struct {
+	file *File
+	// size is the plaintext size that is left to encrypt
+	size uint64
+	// blockNo is the next block to encrypt
+	blockNo uint64
+	// buf holds ciphertext that has not been read yet
+	buf []byte
+}
+
+func (r *exportReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.size == 0 {
+			return 0, io.EOF
+		}
+		bs := r.file.contentEnc.PlainBS()
+		length := exportBlocks * bs
+		if length > r.size {
+			length = r.size
+		}
+		plaintext := make([]byte, length)
+		n, err := r.file.fd.ReadAt(plaintext, int64(r.blockNo*bs))
+		if n < len(plaintext) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		r.buf = r.file.encryptBlocks(plaintext, r.blockNo, r.file.header.ID, r.file.block0IV)
+		r.blockNo += (length + bs - 1) / bs
+		r.size -= length
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,109 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+func TestExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("x"), 10000)
+	if err := ioutil.WriteFile(filepath.Join(dir, "f"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "d", strings.Repeat("l", 200)), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("f", filepath.Join(dir, "s")); err != nil {
+		t.Fatal(err)
+	}
+	cCore := cryptocore.New(make([]byte, cryptocore.KeyLen), cryptocore.BackendAESSIV, contentenc.DefaultIVBits, true, false)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false)
+	rn := NewRootNode(fusefrontend.Args{Cipherdir: dir}, cEnc, nametransform.New(cCore.EMECipher, true, false))
+
+	export := func() (paths []string, entries map[string]ExportEntry, contents map[string][]byte) {
+		entries = make(map[string]ExportEntry)
+		contents = make(map[string][]byte)
+		err := rn.Export(func(e *ExportEntry) error {
+			paths = append(paths, e.Path)
+			entries[e.Path] = *e
+			if e.Content != nil {
+				data, err := ioutil.ReadAll(e.Content)
+				if err != nil {
+					return err
+				}
+				contents[e.Path] = data
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	paths, entries, contents := export()
+	// Root gocryptfs.diriv, d, d/gocryptfs.diriv, the long name file and its
+	// .name file, f and s
+	if len(paths) != 7 {
+		t.Fatalf("wrong entries: %v", paths)
+	}
+	// Parents come first, siblings are sorted
+	for i := 1; i < len(paths); i++ {
+		if filepath.Dir(paths[i]) == filepath.Dir(paths[i-1]) && paths[i] < paths[i-1] {
+			t.Errorf("not sorted: %v", paths)
+		}
+	}
+	var fPath, sPath string
+	var longNames int
+	for p, e := range entries {
+		switch {
+		case nametransform.NameType(filepath.Base(p)) != nametransform.LongNameNone:
+			longNames++
+		case e.Mode&syscall.S_IFMT == syscall.S_IFLNK:
+			sPath = p
+		case e.Mode&syscall.S_IFMT == syscall.S_IFREG && filepath.Base(p) != nametransform.DirIVFilename:
+			fPath = p
+		}
+	}
+	if longNames != 2 {
+		t.Errorf("want a long name file and its .name file, have %v", paths)
+	}
+	// The file decrypts to its content
+	cData := contents[fPath]
+	if int64(len(cData)) != entries[fPath].Size {
+		t.Fatalf("size mismatch: %d != %d", len(cData), entries[fPath].Size)
+	}
+	h, err := contentenc.ParseHeader(cData[:contentenc.HeaderLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := cEnc.DecryptBlocks(cData[contentenc.HeaderLen:], 0, h.ID)
+	if err != nil || !bytes.Equal(plain, content) {
+		t.Errorf("decrypting the content failed: %v", err)
+	}
+	if entries[sPath].Target == "" {
+		t.Errorf("symlink target is empty")
+	}
+	// A second export is identical
+	paths2, _, contents2 := export()
+	if strings.Join(paths, ",") != strings.Join(paths2, ",") || !bytes.Equal(contents2[fPath], cData) {
+		t.Errorf("second export differs")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/openpaths"
 )
 
 type File struct {
@@ -21,6 +22,10 @@ type File struct {
 	block0IV []byte
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Cache of recently produced ciphertext blocks, shared by all files
+	blockCache *blockCache
+	// Registry of open files, shared by all files
+	openFiles *openpaths.Registry
 }
 
 // Read - FUSE call
@@ -66,6 +71,7 @@ func (f *File) Read(ctx context.Context, buf []byte, ioff int64) (resultData fus
 
 // Release - FUSE call, close file
 func (f *File) Release(context.Context) syscall.Errno {
+	f.openFiles.Unregister(f)
 	return fs.ToErrno(f.fd.Close())
 }
 
@@ -3,15 +3,13 @@ package fusefrontend_reverse
 import (
 	"bytes"
 	"io"
-	"sync"
+	"syscall"
 
 	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
 	"github.com/HorizonLiu/gocryptfs/internal/pathiv"
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
 )
 
-var inodeTable sync.Map
-
 // encryptBlocks - encrypt "plaintext" into a number of ciphertext blocks.
 // "plaintext" must already be block-aligned.
 func (rf *File) encryptBlocks(plaintext []byte, firstBlockNo uint64, fileID []byte, block0IV []byte) []byte {
@@ -34,19 +32,35 @@ func (rf *File) encryptBlocks(plaintext []byte, firstBlockNo uint64, fileID []by
 func (f *File) readBackingFile(off uint64, length uint64) (out []byte, err error) {
 	blocks := f.contentEnc.ExplodeCipherRange(off, length)
 
-	// Read the backing plaintext in one go
-	alignedOffset, alignedLength := contentenc.JointPlaintextRange(blocks)
-	plaintext := make([]byte, int(alignedLength))
-	n, err := f.fd.ReadAt(plaintext, int64(alignedOffset))
-	if err != nil && err != io.EOF {
-		tlog.Warn.Printf("readBackingFile: ReadAt: %s", err.Error())
-		return nil, err
+	// Try the block cache first
+	var key blockKey
+	var ver fileVersion
+	cacheable := false
+	if f.blockCache != nil {
+		key, ver, cacheable = f.blockCacheKey(blocks[0].BlockNo)
+	}
+	var ciphertext []byte
+	if cacheable {
+		ciphertext, _ = f.blockCache.getRange(key, ver, len(blocks))
 	}
-	// Truncate buffer down to actually read bytes
-	plaintext = plaintext[0:n]
+	if ciphertext == nil {
+		// Read the backing plaintext in one go
+		alignedOffset, alignedLength := contentenc.JointPlaintextRange(blocks)
+		plaintext := make([]byte, int(alignedLength))
+		n, err := f.fd.ReadAt(plaintext, int64(alignedOffset))
+		if err != nil && err != io.EOF {
+			tlog.Warn.Printf("readBackingFile: ReadAt: %s", err.Error())
+			return nil, err
+		}
+		// Truncate buffer down to actually read bytes
+		plaintext = plaintext[0:n]
 
-	// Encrypt blocks
-	ciphertext := f.encryptBlocks(plaintext, blocks[0].BlockNo, f.header.ID, f.block0IV)
+		// Encrypt blocks
+		ciphertext = f.encryptBlocks(plaintext, blocks[0].BlockNo, f.header.ID, f.block0IV)
+		if cacheable {
+			f.storeBlocks(key, ver, ciphertext)
+		}
+	}
 
 	// Crop down to the relevant part
 	lenHave := len(ciphertext)
@@ -60,3 +74,32 @@ func (f *File) readBackingFile(off uint64, length uint64) (out []byte, err error
 
 	return out, nil
 }
+
+// blockCacheKey returns the block cache key of block "blockNo" and the
+// current version of the backing file. ok is false if the file cannot be
+// stat'ed.
+func (f *File) blockCacheKey(blockNo uint64) (key blockKey, ver fileVersion, ok bool) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.fd.Fd()), &st); err != nil {
+		return key, ver, false
+	}
+	key = blockKey{dev: uint64(st.Dev), ino: st.Ino, blockNo: blockNo}
+	copy(key.id[:], f.header.ID)
+	ver = fileVersion{size: st.Size, mtime: statMtime(&st), ctime: statCtime(&st)}
+	return key, ver, true
+}
+
+// storeBlocks splits "ciphertext", which starts at block key.blockNo, into
+// blocks and stores them in the block cache.
+func (f *File) storeBlocks(key blockKey, ver fileVersion, ciphertext []byte) {
+	bs := int(f.contentEnc.CipherBS())
+	for len(ciphertext) > 0 {
+		n := bs
+		if n > len(ciphertext) {
+			n = len(ciphertext)
+		}
+		f.blockCache.put(key, ver, ciphertext[:n:n])
+		ciphertext = ciphertext[n:]
+		key.blockNo++
+	}
+}
@@ -0,0 +1,256 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Consistent view for backups ("freeze").
+//
+// Freeze walks the plaintext tree and reflinks every regular file that is
+// not excluded into a private staging directory below "-freeze-dir", which
+// must be on the same filesystem. Until the filesystem is thawed, the
+// attributes of these files are returned as they were at Freeze time, and
+// opening one of them reads the reflinked copy. Freeze is refused if
+// "-freeze-dir" is not set, if the backing filesystem does not support
+// reflinks (always on MacOS), or if there are more than maxPinned files.
+//
+// Each file is captured atomically, but the walk takes some time, so the
+// files are not all captured at the same instant.
+//
+// Directory listings are not frozen: files created during the freeze show
+// up with their live content, deleted files disappear.
+
+// maxPinned is the maximum number of files that can be frozen
+const maxPinned = 1 << 20
+
+type devIno struct {
+	dev uint64
+	ino uint64
+}
+
+// pinnedFile is a file captured by Freeze
+type pinnedFile struct {
+	// st holds the attributes at Freeze time
+	st syscall.Stat_t
+	// clone is the name of the reflinked copy in the staging directory
+	clone string
+}
+
+type freezeState struct {
+	sync.Mutex
+	frozen bool
+	// freezing is true while Freeze walks the tree
+	freezing bool
+	// stage is the staging directory holding the reflinked copies
+	stage string
+	// pinned holds all files captured by Freeze
+	pinned map[devIno]*pinnedFile
+}
+
+// Freeze makes the reverse view present a stable snapshot until Thaw() is
+// called. Called via the control socket.
+func (rn *RootNode) Freeze() error {
+	if rn.args.FreezeDir == "" {
+		tlog.Warn.Printf("Freeze: -freeze-dir is not set")
+		return syscall.EOPNOTSUPP
+	}
+	f := &rn.freeze
+	f.Lock()
+	if f.frozen || f.freezing {
+		f.Unlock()
+		return syscall.EBUSY
+	}
+	// The walk runs unlocked so lookups are not blocked
+	f.freezing = true
+	f.Unlock()
+	defer func() {
+		f.Lock()
+		f.freezing = false
+		f.Unlock()
+	}()
+	stage, err := ioutil.TempDir(rn.args.FreezeDir, "gocryptfs-freeze.")
+	if err != nil {
+		tlog.Warn.Printf("Freeze: %v", err)
+		return err
+	}
+	w := freezeWalker{rn: rn, pinned: make(map[devIno]*pinnedFile)}
+	w.stageFd, err = syscall.Open(stage, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err == nil {
+		err = w.walk("")
+		syscall.Close(w.stageFd)
+	}
+	if err != nil {
+		tlog.Warn.Printf("Freeze: %v", err)
+		os.RemoveAll(stage)
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.frozen = true
+	f.stage = stage
+	f.pinned = w.pinned
+	rn.log.Info.Printf("Freeze: reverse view frozen, %d files pinned", len(w.pinned))
+	return nil
+}
+
+// Thaw ends the freeze. Files that are open keep their frozen content until
+// they are closed.
+func (rn *RootNode) Thaw() error {
+	f := &rn.freeze
+	f.Lock()
+	defer f.Unlock()
+	if !f.frozen {
+		return syscall.EINVAL
+	}
+	if err := os.RemoveAll(f.stage); err != nil {
+		tlog.Warn.Printf("Thaw: %v", err)
+	}
+	f.frozen = false
+	f.stage = ""
+	f.pinned = nil
+	rn.log.Info.Printf("Thaw: reverse view thawed")
+	return nil
+}
+
+// freezeWalker captures the plaintext tree for Freeze()
+type freezeWalker struct {
+	rn      *RootNode
+	stageFd int
+	pinned  map[devIno]*pinnedFile
+}
+
+// walk captures the files in the relative plaintext directory "dir" and
+// below.
+//
+// Symlink-safe through OpenDirNofollow() and O_NOFOLLOW.
+func (w *freezeWalker) walk(dir string) error {
+	dirfd, err := syscallcompat.OpenDirNofollow(w.rn.args.Cipherdir, dir)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	if w.rn.isOtherFs(dirfd) {
+		return nil
+	}
+	entries, err := syscallcompat.Getdents(dirfd)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := path.Join(dir, e.Name)
+		if w.rn.isExcludedPlain(p) {
+			continue
+		}
+		switch e.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			err = w.walk(p)
+		case syscall.S_IFREG:
+			err = w.capture(dirfd, e.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capture reflinks the file "name" in "dirfd" into the staging directory.
+// Hard links are captured once.
+func (w *freezeWalker) capture(dirfd int, name string) error {
+	fd, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		if err == syscall.ENOENT {
+			// Deleted in the meantime
+			return nil
+		}
+		return err
+	}
+	defer syscall.Close(fd)
+	p := &pinnedFile{}
+	if err = syscall.Fstat(fd, &p.st); err != nil {
+		return err
+	}
+	if p.st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil
+	}
+	key := devIno{uint64(p.st.Dev), uint64(p.st.Ino)}
+	if w.pinned[key] != nil {
+		return nil
+	}
+	if len(w.pinned) >= maxPinned {
+		tlog.Warn.Printf("Freeze: more than %d files", maxPinned)
+		return syscall.E2BIG
+	}
+	p.clone = strconv.Itoa(len(w.pinned))
+	cloneFd, err := syscallcompat.Openat(w.stageFd, p.clone,
+		syscall.O_RDWR|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(cloneFd)
+	if err = syscallcompat.Reflink(cloneFd, fd); err != nil {
+		tlog.Warn.Printf("Freeze: cannot reflink %q into %q: %v. Both must be on the same filesystem, which must support reflinks.",
+			tlog.PlainName(name), w.rn.args.FreezeDir, err)
+		return err
+	}
+	// The file may have been written to between Fstat and Reflink. The size
+	// must match the copy.
+	var st syscall.Stat_t
+	if err = syscall.Fstat(cloneFd, &st); err != nil {
+		return err
+	}
+	p.st.Size = st.Size
+	p.st.Blocks = st.Blocks
+	w.pinned[key] = p
+	return nil
+}
+
+// pin replaces the attributes in "st" by the ones captured by Freeze if the
+// filesystem is frozen and the file has been captured.
+// Must be called before the inode number is translated.
+func (rn *RootNode) pin(st *syscall.Stat_t) {
+	f := &rn.freeze
+	f.Lock()
+	defer f.Unlock()
+	if !f.frozen {
+		return
+	}
+	if p := f.pinned[devIno{uint64(st.Dev), uint64(st.Ino)}]; p != nil {
+		*st = p.st
+	}
+}
+
+// openPinned opens the reflinked copy of the file with the attributes "st"
+// and replaces "st" by the pinned attributes. Returns nil if the filesystem
+// is not frozen or the file has not been captured.
+func (rn *RootNode) openPinned(st *syscall.Stat_t) (*os.File, error) {
+	f := &rn.freeze
+	f.Lock()
+	defer f.Unlock()
+	if !f.frozen {
+		return nil, nil
+	}
+	p := f.pinned[devIno{uint64(st.Dev), uint64(st.Ino)}]
+	if p == nil {
+		return nil, nil
+	}
+	stageFd, err := syscall.Open(f.stage, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(stageFd)
+	fd, err := syscallcompat.Openat(stageFd, p.clone, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	*st = p.st
+	return os.NewFile(uintptr(fd), "frozen"), nil
+}
@@ -0,0 +1,178 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+func newFreezeTest(t *testing.T) (rn *RootNode, plain string, freezeDir string) {
+	plain, err := ioutil.TempDir("", "freeze_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freezeDir, err = ioutil.TempDir("", "freeze_test_dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(plain)
+		os.RemoveAll(freezeDir)
+	})
+	rn = &RootNode{args: fusefrontend.Args{Cipherdir: plain, FreezeDir: freezeDir}, log: tlog.ProcessLoggers()}
+	return rn, plain, freezeDir
+}
+
+// reflinkSupported probes "dir" for reflink support
+func reflinkSupported(dir string) bool {
+	src, err := ioutil.TempFile(dir, "probe")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	src.WriteString("x")
+	dst, err := ioutil.TempFile(dir, "probe")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+	return syscallcompat.Reflink(int(dst.Fd()), int(src.Fd())) == nil
+}
+
+func TestFreezeRefused(t *testing.T) {
+	rn, plain, freezeDir := newFreezeTest(t)
+	rn.args.FreezeDir = ""
+	if err := rn.Freeze(); err != syscall.EOPNOTSUPP {
+		t.Errorf("Freeze without -freeze-dir: want EOPNOTSUPP, got %v", err)
+	}
+	if err := rn.Thaw(); err != syscall.EINVAL {
+		t.Errorf("Thaw() when not frozen: want EINVAL, got %v", err)
+	}
+	if reflinkSupported(plain) {
+		t.Skip("reflinks are supported")
+	}
+	rn.args.FreezeDir = freezeDir
+	if err := ioutil.WriteFile(filepath.Join(plain, "file"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := rn.Freeze(); err == nil {
+		t.Fatal("Freeze without reflink support should fail")
+	}
+	if rn.freeze.frozen {
+		t.Error("failed Freeze left the view frozen")
+	}
+	if entries, _ := ioutil.ReadDir(freezeDir); len(entries) != 0 {
+		t.Errorf("staging directory was not removed: %v", entries)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	rn, plain, freezeDir := newFreezeTest(t)
+	if !reflinkSupported(plain) {
+		t.Skip("reflinks are not supported")
+	}
+	path := filepath.Join(plain, "dir/file")
+	os.Mkdir(filepath.Dir(path), 0700)
+	if err := ioutil.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := rn.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rn.Freeze(); err != syscall.EBUSY {
+		t.Errorf("second Freeze(): want EBUSY, got %v", err)
+	}
+	// Changed after Freeze
+	if err := ioutil.WriteFile(path, []byte("new content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	live := st
+	rn.pin(&st)
+	if st.Size != 3 {
+		t.Errorf("pin() should return the frozen size 3, got %d", st.Size)
+	}
+	st = live
+	f, err := rn.openPinned(&st)
+	if err != nil || f == nil {
+		t.Fatalf("openPinned: %v", err)
+	}
+	content, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(content) != "old" || st.Size != 3 {
+		t.Errorf("frozen content %q, size %d", content, st.Size)
+	}
+	if err := rn.Thaw(); err != nil {
+		t.Fatal(err)
+	}
+	st = live
+	rn.pin(&st)
+	if st.Size != live.Size {
+		t.Errorf("pin() after Thaw() should not change the size, got %d", st.Size)
+	}
+	if entries, _ := ioutil.ReadDir(freezeDir); len(entries) != 0 {
+		t.Errorf("staging directory was not removed: %v", entries)
+	}
+}
+
+// TestOpenPinned checks the frozen view with a staging directory set up by
+// hand, which works without reflink support
+func TestOpenPinned(t *testing.T) {
+	rn, plain, freezeDir := newFreezeTest(t)
+	path := filepath.Join(plain, "file")
+	if err := ioutil.WriteFile(path, []byte("new content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(freezeDir, "0"), []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var live syscall.Stat_t
+	if err := syscall.Stat(path, &live); err != nil {
+		t.Fatal(err)
+	}
+	pinned := live
+	pinned.Size = 3
+	rn.freeze.frozen = true
+	rn.freeze.stage = freezeDir
+	rn.freeze.pinned = map[devIno]*pinnedFile{
+		{uint64(live.Dev), uint64(live.Ino)}: {st: pinned, clone: "0"},
+	}
+	st := live
+	rn.pin(&st)
+	if st.Size != 3 {
+		t.Errorf("pin() should return the frozen size 3, got %d", st.Size)
+	}
+	st = live
+	f, err := rn.openPinned(&st)
+	if err != nil || f == nil {
+		t.Fatalf("openPinned: %v", err)
+	}
+	content, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(content) != "old" || st.Size != 3 {
+		t.Errorf("frozen content %q, size %d", content, st.Size)
+	}
+	// Files created after Freeze are not affected
+	other := syscall.Stat_t{Dev: live.Dev, Ino: live.Ino + 1, Size: 300}
+	rn.pin(&other)
+	if f, err := rn.openPinned(&other); f != nil || err != nil || other.Size != 300 {
+		t.Errorf("unpinned file: f=%v err=%v size=%d", f, err, other.Size)
+	}
+	if err := rn.Thaw(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(freezeDir); !os.IsNotExist(err) {
+		t.Errorf("staging directory was not removed: %v", err)
+	}
+}
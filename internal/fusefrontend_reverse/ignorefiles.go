@@ -0,0 +1,188 @@
+package fusefrontend_reverse
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/sabhiram/go-gitignore"
+
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+const (
+	// IgnoreFileName is the name of the per-directory ignore files that are
+	// honored with "-ignorefiles"
+	IgnoreFileName = ".gocryptfsignore"
+	// ignoreFileTTL is how long a cached ignore file is used before checking
+	// it for changes
+	ignoreFileTTL = time.Second
+	// maxIgnoreFiles is the number of directories whose ignore file state is
+	// cached
+	maxIgnoreFiles = 4096
+)
+
+// ignoreFile is the cached state of the ignore file in one directory
+type ignoreFile struct {
+	// dir is the relative directory path
+	dir string
+	// mu serializes loading the file. Only this directory is blocked while
+	// it is read from disk.
+	mu sync.Mutex
+	// checked is when the file was last compared against the disk
+	checked time.Time
+	// ino, size and mtime identify the version of the file that "matcher"
+	// was compiled from. ino is zero if there is no ignore file.
+	ino   uint64
+	size  int64
+	mtime syscall.Timespec
+	// matcher is nil if there is no (valid) ignore file
+	matcher *ignore.GitIgnore
+}
+
+// ignoreFiles excludes paths that match a .gocryptfsignore file in one of
+// their parent directories. The patterns in an ignore file use gitignore
+// syntax and are relative to the directory the file is in. Paths excluded by
+// "parent" are excluded as well.
+//
+// A pattern cannot re-include a path that has been excluded by an ignore file
+// in a higher directory, or by "parent".
+type ignoreFiles struct {
+	// plaintext root directory
+	root string
+	// exclusions from the command line, may be nil
+	parent ignore.IgnoreParser
+	// mu protects lru and cache
+	mu sync.Mutex
+	// lru has the most recently used *ignoreFile at the front
+	lru *list.List
+	// cache is indexed by the relative directory path
+	cache map[string]*list.Element
+}
+
+func newIgnoreFiles(root string, parent ignore.IgnoreParser) *ignoreFiles {
+	return &ignoreFiles{
+		root:   root,
+		parent: parent,
+		lru:    list.New(),
+		cache:  make(map[string]*list.Element),
+	}
+}
+
+// MatchesPath implements ignore.IgnoreParser
+func (f *ignoreFiles) MatchesPath(relPath string) bool {
+	if f.parent != nil && f.parent.MatchesPath(relPath) {
+		return true
+	}
+	// Check the ignore files from the root down to the parent of relPath.
+	dir := ""
+	rest := relPath
+	for rest != "" {
+		if m := f.get(dir); m != nil && m.MatchesPath(rest) {
+			return true
+		}
+		i := strings.IndexByte(rest, '/')
+		if i < 0 {
+			break
+		}
+		dir = path.Join(dir, rest[:i])
+		rest = rest[i+1:]
+	}
+	return false
+}
+
+// flush drops the cached ignore files so they are re-read on the next access
+func (f *ignoreFiles) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lru.Init()
+	f.cache = make(map[string]*list.Element)
+}
+
+// get returns the matcher for the ignore file in the relative directory "dir",
+// or nil if there is none.
+func (f *ignoreFiles) get(dir string) *ignore.GitIgnore {
+	e := f.entry(dir)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Since(e.checked) < ignoreFileTTL {
+		return e.matcher
+	}
+	e.checked = time.Now()
+	f.load(dir, e)
+	return e.matcher
+}
+
+// entry returns the cache entry for "dir", creating it if needed. The least
+// recently used entry is evicted when the cache is full.
+func (f *ignoreFiles) entry(dir string) *ignoreFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if el := f.cache[dir]; el != nil {
+		f.lru.MoveToFront(el)
+		return el.Value.(*ignoreFile)
+	}
+	e := &ignoreFile{dir: dir}
+	f.cache[dir] = f.lru.PushFront(e)
+	if f.lru.Len() > maxIgnoreFiles {
+		oldest := f.lru.Back()
+		f.lru.Remove(oldest)
+		delete(f.cache, oldest.Value.(*ignoreFile).dir)
+	}
+	return e
+}
+
+// load (re-)reads the ignore file in "dir" into "e" if it has changed.
+// The caller must hold e.mu.
+//
+// Symlink-safe through OpenDirNofollow() and O_NOFOLLOW.
+func (f *ignoreFiles) load(dir string, e *ignoreFile) {
+	dirfd, err := syscallcompat.OpenDirNofollow(f.root, dir)
+	if err != nil {
+		e.ino = 0
+		e.matcher = nil
+		return
+	}
+	defer syscall.Close(dirfd)
+	st, err := syscallcompat.Fstatat2(dirfd, IgnoreFileName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		e.ino = 0
+		e.matcher = nil
+		return
+	}
+	mtime := statMtime(st)
+	if e.ino == uint64(st.Ino) && e.size == st.Size && e.mtime == mtime {
+		// unchanged
+		return
+	}
+	e.ino = uint64(st.Ino)
+	e.size = st.Size
+	e.mtime = mtime
+	e.matcher = nil
+	fd, err := syscallcompat.Openat(dirfd, IgnoreFileName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		tlog.Warn.Printf("ignorefiles: cannot open %q: %v", tlog.PlainName(path.Join(dir, IgnoreFileName)), err)
+		return
+	}
+	file := os.NewFile(uintptr(fd), IgnoreFileName)
+	content, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		tlog.Warn.Printf("ignorefiles: cannot read %q: %v", tlog.PlainName(path.Join(dir, IgnoreFileName)), err)
+		return
+	}
+	m, err := ignore.CompileIgnoreLines(strings.Split(string(content), "\n")...)
+	if err != nil {
+		tlog.Warn.Printf("ignorefiles: invalid %q: %v", tlog.PlainName(path.Join(dir, IgnoreFileName)), err)
+		return
+	}
+	e.matcher = m
+}
@@ -0,0 +1,72 @@
+package fusefrontend_reverse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIgnoreFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "ignorefiles_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "proj/build"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	write := func(rel string, content string) {
+		if err := ioutil.WriteFile(filepath.Join(root, rel), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(IgnoreFileName, "*.tmp\n")
+	write("proj/"+IgnoreFileName, "/build\n*.o\n!keep.o\n")
+
+	f := newIgnoreFiles(root, nil)
+	for path, want := range map[string]bool{
+		"a.tmp":            true,
+		"proj/x.tmp":       true,
+		"proj/build":       true,
+		"proj/build/a.txt": true,
+		"proj/src/a.o":     true,
+		"proj/keep.o":      false,
+		"build":            false,
+		"a.o":              false,
+		"proj/a.c":         false,
+	} {
+		if got := f.MatchesPath(path); got != want {
+			t.Errorf("%q: want excluded=%v, got %v", path, want, got)
+		}
+	}
+
+	// Changes are picked up after the TTL
+	write("proj/"+IgnoreFileName, "*.c\n")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(root, "proj", IgnoreFileName), future, future)
+	f.cache["proj"].Value.(*ignoreFile).checked = time.Time{}
+	if !f.MatchesPath("proj/a.c") || f.MatchesPath("proj/build") {
+		t.Error("changed ignore file was not reloaded")
+	}
+}
+
+func TestIgnoreFilesBounded(t *testing.T) {
+	root, err := ioutil.TempDir("", "ignorefiles_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	f := newIgnoreFiles(root, nil)
+	for i := 0; i < maxIgnoreFiles+10; i++ {
+		f.get(fmt.Sprintf("dir%d", i))
+	}
+	if len(f.cache) != maxIgnoreFiles || f.lru.Len() != maxIgnoreFiles {
+		t.Errorf("cache size: %d entries, %d in lru", len(f.cache), f.lru.Len())
+	}
+	if f.cache["dir0"] != nil || f.cache[fmt.Sprintf("dir%d", maxIgnoreFiles+9)] == nil {
+		t.Error("wrong entry was evicted")
+	}
+}
@@ -0,0 +1,13 @@
+package fusefrontend_reverse
+
+import (
+	"syscall"
+)
+
+func statMtime(st *syscall.Stat_t) syscall.Timespec {
+	return st.Mtimespec
+}
+
+func statCtime(st *syscall.Stat_t) syscall.Timespec {
+	return st.Ctimespec
+}
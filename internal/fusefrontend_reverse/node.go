@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -22,6 +23,13 @@ import (
 // in a `gocryptfs -reverse` mount.
 type Node struct {
 	fs.Inode
+	// cPath is the ciphertext path this node was first looked up through.
+	// All names of a hard-linked file share one node.
+	cPath string
+	// ivsLock protects ivs
+	ivsLock sync.Mutex
+	// ivs caches the derived IVs of a hard-linked file, see fileIVs()
+	ivs *pathiv.FileIVs
 }
 
 // Lookup - FUSE call for discovering a file.
@@ -51,8 +59,11 @@ func (n *Node) Lookup(ctx context.Context, cName string, out *fuse.EntryOut) (ch
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
+	if t == typeReal {
+		n.rootNode().pin(st)
+	}
 	// Create new inode and fill `out`
-	ch = n.newChild(ctx, st, out)
+	ch = n.newChild(ctx, st, filepath.Join(n.Path(), cName), out)
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
 	if t == typeReal {
 		n.translateSize(d.dirfd, cName, d.pName, &out.Attr)
@@ -75,8 +86,9 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 		return fs.ToErrno(err)
 	}
 
-	// Fix inode number
 	rn := n.rootNode()
+	rn.pin(st)
+	// Fix inode number
 	rn.inoMap.TranslateStat(st)
 	out.Attr.FromStat(st)
 
@@ -87,6 +99,9 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 	if rn.args.ForceOwner != nil {
 		out.Owner = *rn.args.ForceOwner
 	}
+	if rn.args.ForcePerms != nil {
+		out.Mode = rn.args.ForcePerms.Apply(out.Mode)
+	}
 	return 0
 }
 
@@ -136,41 +151,35 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		errno = syscall.EACCES
 		return
 	}
-	// See if we have that inode number already in the table
-	// (even if Nlink has dropped to 1)
-	var derivedIVs pathiv.FileIVs
-	v, found := inodeTable.Load(st.Ino)
-	if found {
-		tlog.Debug.Printf("ino%d: newFile: found in the inode table", st.Ino)
-		derivedIVs = v.(pathiv.FileIVs)
-	} else {
-		p := n.Path()
-		derivedIVs = pathiv.DeriveFile(p)
-		// Nlink > 1 means there is more than one path to this file.
-		// Store the derived values so we always return the same data,
-		// regardless of the path that is used to access the file.
-		// This means that the first path wins.
-		if st.Nlink > 1 {
-			v, found = inodeTable.LoadOrStore(st.Ino, derivedIVs)
-			if found {
-				// Another thread has stored a different value before we could.
-				derivedIVs = v.(pathiv.FileIVs)
-			} else {
-				tlog.Debug.Printf("ino%d: newFile: Nlink=%d, stored in the inode table", st.Ino, st.Nlink)
-			}
-		}
+	rn := n.rootNode()
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	frozen, err := rn.openPinned(&st)
+	if err != nil {
+		tlog.Warn.Printf("Open: cannot open frozen copy: %v", err)
+		file.Close()
+		errno = fs.ToErrno(err)
+		return
+	}
+	if frozen != nil {
+		file.Close()
+		file = frozen
 	}
+	derivedIVs := n.fileIVs(&st, rn.log)
 	header := contentenc.FileHeader{
 		Version: contentenc.CurrentVersion,
 		ID:      derivedIVs.ID,
 	}
-	fh = &File{
-		fd:         os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd)),
+	f := &File{
+		fd:         file,
 		header:     header,
 		block0IV:   derivedIVs.Block0IV,
-		contentEnc: n.rootNode().contentEnc,
+		contentEnc: rn.contentEnc,
+		blockCache: rn.blockCache,
+		openFiles:  &rn.openFiles,
 	}
-	return
+	pPath := d.pPath
+	rn.openFiles.Register(f, func() string { return pPath })
+	return f, 0, 0
 }
 
 // StatFs - FUSE call. Returns information about the filesystem.
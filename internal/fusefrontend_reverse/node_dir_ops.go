@@ -36,12 +36,14 @@ func (n *Node) Readdir(ctx context.Context) (stream fs.DirStream, errno syscall.
 		return nil, fs.ToErrno(err)
 	}
 	defer syscall.Close(fd)
-	entries, err = syscallcompat.Getdents(fd)
-	if err != nil {
-		return nil, fs.ToErrno(err)
-	}
-
 	rn := n.rootNode()
+	// "-one-file-system": mount points show up as empty directories
+	if !rn.isOtherFs(fd) {
+		entries, err = syscallcompat.Getdents(fd)
+		if err != nil {
+			return nil, fs.ToErrno(err)
+		}
+	}
 
 	// Filter out excluded entries
 	entries = rn.excludeDirEntries(d, entries)
@@ -13,6 +13,7 @@ import (
 	"github.com/HorizonLiu/gocryptfs/internal/configfile"
 	"github.com/HorizonLiu/gocryptfs/internal/pathiv"
 	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
 )
 
 const (
@@ -77,6 +78,10 @@ func (n *Node) prepareAtSyscall(child string) (d *dirfdPlus, errno syscall.Errno
 	dirfd, pPath, err := rn.openBackingDir(cPath)
 	if err != nil {
 		errno = fs.ToErrno(err)
+	} else if rn.isOtherFs(dirfd) {
+		// The parent directory is on a different filesystem
+		syscall.Close(dirfd)
+		errno = syscall.ENOENT
 	}
 	d = &dirfdPlus{
 		dirfd: dirfd,
@@ -90,7 +95,7 @@ func (n *Node) prepareAtSyscall(child string) (d *dirfdPlus, errno syscall.Errno
 
 // newChild attaches a new child inode to n.
 // The passed-in `st` will be modified to get a unique inode number.
-func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.EntryOut) *fs.Inode {
+func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, cPath string, out *fuse.EntryOut) *fs.Inode {
 	// Get unique inode number
 	rn := n.rootNode()
 	rn.inoMap.TranslateStat(st)
@@ -101,7 +106,7 @@ func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.Entry
 		Gen:  1,
 		Ino:  st.Ino,
 	}
-	node := &Node{}
+	node := &Node{cPath: cPath}
 	return n.NewInode(ctx, node, id)
 }
 
@@ -128,6 +133,10 @@ func (n *Node) lookupLongnameName(ctx context.Context, nameFile string, out *fus
 	defer syscall.Close(fd)
 	diriv := pathiv.Derive(d.cPath, pathiv.PurposeDirIV)
 	rn := n.rootNode()
+	if rn.isOtherFs(fd) {
+		errno = syscall.ENOENT
+		return
+	}
 	pName, cFullname, errno := rn.findLongnameParent(fd, diriv, nameFile)
 	if errno != 0 {
 		return
@@ -211,12 +220,16 @@ func (n *Node) readlink(dirfd int, cName string, pName string) (out []byte, errn
 		errno = fs.ToErrno(err)
 		return
 	}
-	rn := n.rootNode()
+	// Nonce is derived from the relative *ciphertext* path
+	return n.rootNode().encryptSymlinkTarget(plainTarget, filepath.Join(n.Path(), cName))
+}
+
+// encryptSymlinkTarget encrypts the symlink target "plainTarget". The nonce
+// is derived from the relative ciphertext path "p".
+func (rn *RootNode) encryptSymlinkTarget(plainTarget string, p string) (out []byte, errno syscall.Errno) {
 	if rn.args.PlaintextNames {
 		return []byte(plainTarget), 0
 	}
-	// Nonce is derived from the relative *ciphertext* path
-	p := filepath.Join(n.Path(), cName)
 	nonce := pathiv.Derive(p, pathiv.PurposeSymlinkIV)
 	// Symlinks are encrypted like file contents and base64-encoded
 	cBinTarget := rn.contentEnc.EncryptBlockNonce([]byte(plainTarget), 0, nil, nonce)
@@ -229,3 +242,27 @@ func (n *Node) readlink(dirfd int, cName string, pName string) (out []byte, errn
 	}
 	return []byte(cTarget), 0
 }
+
+// fileIVs returns the derived IVs of the backing file of "n" with the
+// attributes "st". The choice for hard-linked files is logged to "log".
+//
+// The IVs are derived from the ciphertext path. A hard-linked file has one
+// node for all of its names, and the kernel caches its content per node, so
+// all names must have the same ciphertext. For these, the path the node was
+// first looked up through is used, and the IVs are kept until the kernel
+// forgets the node, even if Nlink drops to 1. Which name wins can differ
+// between mounts.
+func (n *Node) fileIVs(st *syscall.Stat_t, log *tlog.Loggers) pathiv.FileIVs {
+	n.ivsLock.Lock()
+	defer n.ivsLock.Unlock()
+	if n.ivs != nil {
+		return *n.ivs
+	}
+	if st.Nlink <= 1 {
+		return pathiv.DeriveFile(n.Path())
+	}
+	ivs := pathiv.DeriveFile(n.cPath)
+	n.ivs = &ivs
+	log.Debug.Printf("ino%d: fileIVs: Nlink=%d, using %q", st.Ino, st.Nlink, tlog.CipherName(n.cPath))
+	return ivs
+}
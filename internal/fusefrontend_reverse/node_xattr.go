@@ -0,0 +1,97 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/pathiv"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+)
+
+// Reverse mode only shows the xattrs that "-xattr-policy" asks for. Other
+// xattrs, including all of the "user." namespace, stay hidden like they
+// always have been.
+const xattrDefault = fusefrontend.XattrDeny
+
+// plainPath returns the absolute plaintext path of "n"
+func (n *Node) plainPath() (string, syscall.Errno) {
+	d, errno := n.prepareAtSyscall("")
+	if errno != 0 {
+		return "", errno
+	}
+	syscall.Close(d.dirfd)
+	return filepath.Join(n.rootNode().args.Cipherdir, d.pPath), 0
+}
+
+// Getxattr - FUSE call. Encrypts the value if the namespace has the
+// "encrypt" policy, so that a forward mount on top of the ciphertext can
+// read it. The nonce is derived from the path, so the ciphertext is stable.
+func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	rn := n.rootNode()
+	pAttr := attr
+	policy := rn.args.XattrPolicies.Lookup(attr, xattrDefault)
+	if name, err := fusefrontend.DecryptXattrName(rn.nameTransform, attr); err == nil {
+		pAttr = name
+		policy = rn.args.XattrPolicies.Lookup(name, xattrDefault)
+		if policy != fusefrontend.XattrEncrypt {
+			return 0, syscall.ENODATA
+		}
+	} else if policy != fusefrontend.XattrPassthrough {
+		return 0, syscall.ENODATA
+	}
+	p, errno := n.plainPath()
+	if errno != 0 {
+		return 0, errno
+	}
+	data, err := syscallcompat.Lgetxattr(p, pAttr)
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	if policy == fusefrontend.XattrEncrypt && len(data) > 0 {
+		nonce := pathiv.Derive(n.Path()+"\000"+pAttr, pathiv.PurposeXattrIV)
+		data = rn.contentEnc.EncryptBlockNonce(data, 0, nil, nonce)
+	}
+	// Caller passes size zero to find out how large their buffer should be
+	if len(dest) == 0 {
+		return uint32(len(data)), 0
+	}
+	if len(dest) < len(data) {
+		return 0, syscall.ERANGE
+	}
+	return uint32(copy(dest, data)), 0
+}
+
+// Listxattr - FUSE call
+func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	rn := n.rootNode()
+	p, errno := n.plainPath()
+	if errno != 0 {
+		return 0, errno
+	}
+	names, err := syscallcompat.Llistxattr(p)
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	var buf bytes.Buffer
+	for _, name := range names {
+		switch rn.args.XattrPolicies.Lookup(name, xattrDefault) {
+		case fusefrontend.XattrPassthrough:
+			buf.WriteString(name + "\000")
+		case fusefrontend.XattrEncrypt:
+			buf.WriteString(fusefrontend.EncryptXattrName(rn.nameTransform, name) + "\000")
+		}
+	}
+	// Caller passes size zero to find out how large their buffer should be
+	if len(dest) == 0 {
+		return uint32(buf.Len()), 0
+	}
+	if buf.Len() > len(dest) {
+		return 0, syscall.ERANGE
+	}
+	return uint32(copy(dest, buf.Bytes())), 0
+}
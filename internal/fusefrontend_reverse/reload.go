@@ -0,0 +1,23 @@
+package fusefrontend_reverse
+
+import (
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+)
+
+// Reload replaces the exclusion rules with the ones from "args" and reads
+// the -exclude-from, -include-from and -filter-from files again. On error,
+// the old rules stay active. Entries the kernel has already cached stay
+// visible until the cache times out.
+func (rn *RootNode) Reload(args fusefrontend.Args) error {
+	excluder, err := fusefrontend.CompileExcluder(args)
+	if err != nil {
+		return err
+	}
+	if rn.args.IgnoreFiles {
+		excluder = newIgnoreFiles(rn.args.Cipherdir, excluder)
+	}
+	rn.excluderLock.Lock()
+	rn.excluder = excluder
+	rn.excluderLock.Unlock()
+	return nil
+}
@@ -1,9 +1,11 @@
 package fusefrontend_reverse
 
 import (
+	"context"
 	"log"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
@@ -17,6 +19,7 @@ import (
 	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
 	"github.com/HorizonLiu/gocryptfs/internal/inomap"
 	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/openpaths"
 	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
 
 	"github.com/sabhiram/go-gitignore"
@@ -31,11 +34,27 @@ type RootNode struct {
 	nameTransform nametransform.NameTransformer
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
-	// Tests whether a path is excluded (hidden) from the user. Used by -exclude.
-	excluder ignore.IgnoreParser
+	// Tests whether a path is excluded (hidden) from the user. Used by -exclude,
+	// -include and -filter. Replaced by Reload(), so access it through
+	// getExcluder().
+	excluder     ignore.IgnoreParser
+	excluderLock sync.RWMutex
 	// inoMap translates inode numbers from different devices to unique inode
 	// numbers.
 	inoMap *inomap.InoMap
+	// blockCache caches recently produced ciphertext blocks
+	blockCache *blockCache
+	// rootDev is the device number of Cipherdir. Only set with
+	// "-one-file-system".
+	rootDev uint64
+	// openFiles tracks the plaintext paths of open files for the control
+	// socket
+	openFiles openpaths.Registry
+	// freeze holds the pinned file attributes while the view is frozen
+	// via the control socket
+	freeze freezeState
+	// log are the Debug and Info loggers of this mount, see Args.Log
+	log *tlog.Loggers
 }
 
 // NewRootNode returns an encrypted FUSE overlay filesystem.
@@ -47,17 +66,34 @@ func NewRootNode(args fusefrontend.Args, c *contentenc.ContentEnc, n nametransfo
 		nameTransform: n,
 		contentEnc:    c,
 		inoMap:        inomap.New(),
+		log:           args.Log,
+		blockCache:    newBlockCache(blockCacheBytes / int(c.CipherBS())),
 	}
-	if len(args.Exclude) > 0 || len(args.ExcludeWildcard) > 0 || len(args.ExcludeFrom) > 0 {
+	if rn.log == nil {
+		rn.log = tlog.ProcessLoggers()
+	}
+	if len(args.Exclude) > 0 || len(args.ExcludeWildcard) > 0 || len(args.ExcludeFrom) > 0 ||
+		len(args.Include) > 0 || len(args.IncludeFrom) > 0 || len(args.Filter) > 0 || len(args.FilterFrom) > 0 {
 		rn.excluder = prepareExcluder(args)
 	}
+	if args.IgnoreFiles {
+		rn.excluder = newIgnoreFiles(args.Cipherdir, rn.excluder)
+	}
+	if args.OneFileSystem {
+		var st syscall.Stat_t
+		if err := syscall.Stat(args.Cipherdir, &st); err != nil {
+			tlog.Warn.Printf("-one-file-system: cannot stat %q: %v", args.Cipherdir, err)
+		} else {
+			rn.rootDev = uint64(st.Dev)
+		}
+	}
 	return rn
 }
 
 // You can pass either gocryptfs.longname.XYZ.name or gocryptfs.longname.XYZ.
 func (rn *RootNode) findLongnameParent(fd int, diriv []byte, longname string) (pName string, cFullName string, errno syscall.Errno) {
 	defer func() {
-		tlog.Debug.Printf("findLongnameParent: %d %x %q -> %q %q %d\n", fd, diriv, longname, pName, cFullName, errno)
+		rn.log.Debug.Printf("findLongnameParent: %d %x %q -> %q %q %d\n", fd, diriv, tlog.CipherName(longname), tlog.PlainName(pName), tlog.CipherName(cFullName), errno)
 	}()
 	if strings.HasSuffix(longname, nametransform.LongNameSuffix) {
 		longname = nametransform.RemoveLongNameSuffix(longname)
@@ -89,17 +125,48 @@ func (rn *RootNode) findLongnameParent(fd int, diriv []byte, longname string) (p
 	return
 }
 
+// ReleaseOpenFiles releases all open files. Used after the FUSE connection
+// was lost, because the kernel will not send Release for them anymore.
+func (rn *RootNode) ReleaseOpenFiles() {
+	for _, fh := range rn.openFiles.Handles() {
+		fh.(*File).Release(context.Background())
+	}
+}
+
 // isExcludedPlain finds out if the plaintext path "pPath" is
 // excluded (used when -exclude is passed by the user).
 func (rn *RootNode) isExcludedPlain(pPath string) bool {
-	return rn.excluder != nil && rn.excluder.MatchesPath(pPath)
+	excluder := rn.getExcluder()
+	return excluder != nil && excluder.MatchesPath(pPath)
+}
+
+// getExcluder returns the current excluder, nil if nothing is excluded
+func (rn *RootNode) getExcluder() ignore.IgnoreParser {
+	rn.excluderLock.RLock()
+	defer rn.excluderLock.RUnlock()
+	return rn.excluder
+}
+
+// isOtherFs returns true if "-one-file-system" is active and the directory
+// "dirfd" belongs to a different filesystem than Cipherdir. The contents of
+// such directories are hidden.
+func (rn *RootNode) isOtherFs(dirfd int) bool {
+	if !rn.args.OneFileSystem {
+		return false
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(dirfd, &st); err != nil {
+		tlog.Warn.Printf("isOtherFs: Fstat: %v", err)
+		return true
+	}
+	return uint64(st.Dev) != rn.rootDev
 }
 
 // excludeDirEntries filters out directory entries that are "-exclude"d.
 // pDir is the relative plaintext path to the directory these entries are
 // from. The entries should be plaintext files.
 func (rn *RootNode) excludeDirEntries(d *dirfdPlus, entries []fuse.DirEntry) (filtered []fuse.DirEntry) {
-	if rn.excluder == nil {
+	if rn.getExcluder() == nil {
 		return entries
 	}
 	filtered = make([]fuse.DirEntry, 0, len(entries))
@@ -0,0 +1,69 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/pathiv"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+func TestIsOtherFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isotherfs_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	var procSt syscall.Stat_t
+	if err := syscall.Stat("/proc", &procSt); err != nil || procSt.Dev == st.Dev {
+		t.Skip("need /proc on a different filesystem")
+	}
+	rn := &RootNode{
+		args:    fusefrontend.Args{OneFileSystem: true},
+		rootDev: uint64(st.Dev),
+	}
+	for _, tc := range []struct {
+		path  string
+		other bool
+	}{
+		{dir, false},
+		{"/proc", true},
+	} {
+		fd, err := syscall.Open(tc.path, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rn.isOtherFs(fd) != tc.other {
+			t.Errorf("%q: want isOtherFs=%v", tc.path, tc.other)
+		}
+		rn.args.OneFileSystem = false
+		if rn.isOtherFs(fd) {
+			t.Errorf("%q: isOtherFs must be false without -one-file-system", tc.path)
+		}
+		rn.args.OneFileSystem = true
+		syscall.Close(fd)
+	}
+}
+
+// TestFileIVsHardlink checks that a hard-linked file keeps the IVs of the
+// path it was first looked up through, even if Nlink drops to 1
+func TestFileIVsHardlink(t *testing.T) {
+	n := &Node{cPath: "dir/first"}
+	st := syscall.Stat_t{Nlink: 2}
+	ivs := n.fileIVs(&st, tlog.ProcessLoggers())
+	if !bytes.Equal(ivs.ID, pathiv.DeriveFile("dir/first").ID) {
+		t.Error("IVs not derived from the first path")
+	}
+	st.Nlink = 1
+	if !bytes.Equal(n.fileIVs(&st, tlog.ProcessLoggers()).ID, ivs.ID) {
+		t.Error("IVs changed when Nlink dropped to 1")
+	}
+}
@@ -66,7 +66,7 @@ func (rfs *RootNode) rDecryptName(cName string, dirIV []byte, pDir string) (pNam
 		// It makes no sense to decrypt a ".name" file. This is a virtual file
 		// that has no representation in the plaintext filesystem. ".name"
 		// files should have already been handled in virtualfile.go.
-		tlog.Warn.Printf("rDecryptName: cannot decrypt virtual file %q", cName)
+		tlog.Warn.Printf("rDecryptName: cannot decrypt virtual file %q", tlog.CipherName(cName))
 		return "", syscall.EINVAL
 	}
 	return pName, nil
@@ -102,7 +102,7 @@ func (rn *RootNode) decryptPath(cPath string) (string, error) {
 // friends.
 func (rn *RootNode) openBackingDir(cPath string) (dirfd int, pPath string, err error) {
 	defer func() {
-		tlog.Debug.Printf("openBackingDir %q -> %d %q %v\n", cPath, dirfd, pPath, err)
+		rn.log.Debug.Printf("openBackingDir %q -> %d %q %v\n", tlog.CipherName(cPath), dirfd, tlog.PlainName(pPath), err)
 	}()
 	dirfd = -1
 	pPath, err = rn.decryptPath(cPath)
@@ -0,0 +1,136 @@
+// Package idmap translates user and group IDs between the owners of the
+// files in CIPHERDIR ("host" IDs) and the owners shown in the mount
+// ("presented" IDs), "-idmap".
+//
+// The mapping file has one range per line, like /proc/PID/uid_map:
+//
+//	# TYPE HOST PRESENTED [COUNT]
+//	uid 100000 0 65536
+//	gid 100000 0 65536
+//	uid 1000 70000
+//
+// COUNT defaults to 1. Ranges of the same type must not overlap, neither on
+// the host nor on the presented side. IDs that are not covered by any range
+// are passed through unchanged.
+package idmap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// idRange maps host IDs [host, host+count) to [presented, presented+count)
+type idRange struct {
+	host, presented, count uint32
+}
+
+// table is a list of ranges that do not overlap
+type table []idRange
+
+// overlaps tells if [a, a+na) and [b, b+nb) overlap
+func overlaps(a uint32, b uint32, na uint32, nb uint32) bool {
+	return uint64(a) < uint64(b)+uint64(nb) && uint64(b) < uint64(a)+uint64(na)
+}
+
+// Map holds the uid and the gid table
+type Map struct {
+	uids, gids table
+}
+
+// Load reads the mapping file "path"
+func Load(path string) (*Map, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// Parse reads a mapping file from "r"
+func Parse(r io.Reader) (*Map, error) {
+	m := &Map{}
+	s := bufio.NewScanner(r)
+	for lineNo := 1; s.Scan(); lineNo++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: want \"uid|gid HOST PRESENTED [COUNT]\"", lineNo)
+		}
+		var nums [3]uint32
+		nums[2] = 1
+		for i, f := range fields[1:] {
+			n, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			nums[i] = uint32(n)
+		}
+		rg := idRange{host: nums[0], presented: nums[1], count: nums[2]}
+		if rg.count == 0 || uint64(rg.host)+uint64(rg.count) > 1<<32 ||
+			uint64(rg.presented)+uint64(rg.count) > 1<<32 {
+			return nil, fmt.Errorf("line %d: invalid range", lineNo)
+		}
+		var t *table
+		switch fields[0] {
+		case "uid":
+			t = &m.uids
+		case "gid":
+			t = &m.gids
+		default:
+			return nil, fmt.Errorf("line %d: unknown type %q", lineNo, fields[0])
+		}
+		for _, other := range *t {
+			if overlaps(rg.host, other.host, rg.count, other.count) ||
+				overlaps(rg.presented, other.presented, rg.count, other.count) {
+				return nil, fmt.Errorf("line %d: overlaps an earlier %s range", lineNo, fields[0])
+			}
+		}
+		*t = append(*t, rg)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (t table) toPresented(id uint32) uint32 {
+	for _, rg := range t {
+		if id >= rg.host && id-rg.host < rg.count {
+			return rg.presented + (id - rg.host)
+		}
+	}
+	return id
+}
+
+func (t table) toHost(id uint32) uint32 {
+	for _, rg := range t {
+		if id >= rg.presented && id-rg.presented < rg.count {
+			return rg.host + (id - rg.presented)
+		}
+	}
+	return id
+}
+
+// ToPresented maps the owner of a file in CIPHERDIR to the owner that the
+// mount shows
+func (m *Map) ToPresented(uid uint32, gid uint32) (uint32, uint32) {
+	return m.uids.toPresented(uid), m.gids.toPresented(gid)
+}
+
+// ToHost maps an owner as seen through the mount, like the caller of a
+// create or the argument of chown, to the owner in CIPHERDIR
+func (m *Map) ToHost(uid uint32, gid uint32) (uint32, uint32) {
+	return m.uids.toHost(uid), m.gids.toHost(gid)
+}
@@ -0,0 +1,52 @@
+package idmap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	m, err := Parse(strings.NewReader(`
+# shifted container IDs
+uid 100000 0 65536
+gid 100000 0 65536
+uid 1000 70000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		hostUID, hostGID, uid, gid uint32
+	}{
+		{100000, 100000, 0, 0},
+		{165535, 100005, 65535, 5},
+		{1000, 200000, 70000, 200000},
+		// Not covered: passed through
+		{200000, 200001, 200000, 200001},
+	}
+	for _, tc := range testCases {
+		if uid, gid := m.ToPresented(tc.hostUID, tc.hostGID); uid != tc.uid || gid != tc.gid {
+			t.Errorf("ToPresented(%d, %d) = %d, %d, want %d, %d", tc.hostUID, tc.hostGID, uid, gid, tc.uid, tc.gid)
+		}
+		if uid, gid := m.ToHost(tc.uid, tc.gid); uid != tc.hostUID || gid != tc.hostGID {
+			t.Errorf("ToHost(%d, %d) = %d, %d, want %d, %d", tc.uid, tc.gid, uid, gid, tc.hostUID, tc.hostGID)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{
+		"uid 1",
+		"uid 1 2 3 4",
+		"user 1 2",
+		"uid -1 2",
+		"uid 1 2 0",
+		"gid 4294967295 0 2",
+		"uid 1000 0 10\nuid 1005 100",
+		"uid 1000 0 10\nuid 2000 9",
+	} {
+		if _, err := Parse(strings.NewReader(s)); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Package journal records the intent of operations that change several
+// ciphertext objects, like a long name entry and its .name file, before they
+// start. After a crash, Replay() finds the operations that may have been cut
+// short and cleans up after them ("-journal").
+//
+// The journal only contains intents, no data. Replay() looks at the state of
+// the ciphertext directory and only repairs what is inconsistent, so an
+// intent whose operation has completed is harmless.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+)
+
+// FileName is the name of the journal in the root of CIPHERDIR
+const FileName = "gocryptfs.journal"
+
+// Op is the kind of operation an Intent announces
+type Op string
+
+const (
+	// OpLongName creates or deletes the entry Name, which has a long name,
+	// and its .name file
+	OpLongName Op = "longname"
+	// OpMkdir creates the directory Name and its gocryptfs.diriv
+	OpMkdir Op = "mkdir"
+	// OpRmdir moves the gocryptfs.diriv of directory Name to Tmp and
+	// deletes the directory
+	OpRmdir Op = "rmdir"
+)
+
+// Intent is one journal record
+type Intent struct {
+	Op Op
+	// Dir is the ciphertext path of the directory relative to CIPHERDIR,
+	// "" for the root
+	Dir string
+	// Name is the ciphertext name of the entry in Dir
+	Name string
+	// Tmp is the name in Dir that gocryptfs.diriv is moved to on OpRmdir
+	Tmp string `json:",omitempty"`
+}
+
+// Journal appends intents to the journal file
+type Journal struct {
+	mu sync.Mutex
+	f  *os.File
+	// root is CIPHERDIR with symlinks resolved, the prefix of the paths
+	// of directory fds
+	root string
+	// active is the number of operations that have begun, but not finished
+	active int
+}
+
+// Open opens the journal in "cipherdir" for appending, creating it with mode
+// 0600 if needed. Call Replay() before.
+func Open(cipherdir string) (*Journal, error) {
+	root, err := filepath.EvalSymlinks(cipherdir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(root, FileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE|syscall.O_CLOEXEC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{f: f, root: root}, nil
+}
+
+// BeginAt records "i" for the directory "dirfd", overwriting i.Dir, and
+// makes it durable. Call the returned function when the operation is
+// finished, successful or not.
+func (j *Journal) BeginAt(dirfd int, i Intent) (done func(), err error) {
+	p, err := syscallcompat.FdPath(dirfd)
+	if err != nil {
+		return nil, err
+	}
+	if p == j.root {
+		i.Dir = ""
+	} else if strings.HasPrefix(p, j.root+"/") {
+		i.Dir = p[len(j.root)+1:]
+	} else {
+		return nil, fmt.Errorf("%q is not in %q", p, j.root)
+	}
+	return j.Begin(i)
+}
+
+// Begin records "i" and makes it durable. Call the returned function when
+// the operation is finished, successful or not.
+func (j *Journal) Begin(i Intent) (done func(), err error) {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, '\n')
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// One write call per intent, so a crash cannot interleave two
+	if _, err = j.f.Write(b); err != nil {
+		return nil, err
+	}
+	if err = j.f.Sync(); err != nil {
+		return nil, err
+	}
+	j.active++
+	return j.done, nil
+}
+
+// done truncates the journal when no operation is running any more. The
+// truncate does not have to be durable: replaying finished intents does
+// nothing.
+func (j *Journal) done() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.active--
+	if j.active == 0 {
+		j.f.Truncate(0)
+	}
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	return j.f.Close()
+}
+
+// Replay repairs what the operations in the journal in "cipherdir" may have
+// left behind and empties the journal. It returns the number of intents
+// found. A missing journal is not an error. Problems with single intents are
+// returned in "warnings", they do not stop the replay.
+func Replay(cipherdir string) (n int, warnings []error, err error) {
+	path := filepath.Join(cipherdir, FileName)
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if os.IsNotExist(err) {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var i Intent
+		if err := json.Unmarshal(scanner.Bytes(), &i); err != nil {
+			// The last line may be incomplete after a crash. Its
+			// operation has not started.
+			warnings = append(warnings, fmt.Errorf("skipping record %q: %v", scanner.Text(), err))
+			continue
+		}
+		n++
+		if err := replay(cipherdir, i); err != nil {
+			warnings = append(warnings, fmt.Errorf("%s %q in %q: %v", i.Op, i.Name, i.Dir, err))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return n, warnings, err
+	}
+	if err := f.Truncate(0); err != nil {
+		return n, warnings, err
+	}
+	return n, warnings, f.Sync()
+}
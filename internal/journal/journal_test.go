@@ -0,0 +1,144 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	touch := func(path string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdir := func(path string) {
+		if err := os.Mkdir(filepath.Join(dir, path), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(path string) bool {
+		_, err := os.Lstat(filepath.Join(dir, path))
+		return err == nil
+	}
+	long1 := "gocryptfs.longname.aaaa"
+	long2 := "gocryptfs.longname.bbbb"
+	tmp1 := nametransform.DirIVFilename + rmdirInfix + "1"
+	tmp2 := nametransform.DirIVFilename + rmdirInfix + "2"
+	mkdir("sub")
+	// Created .name, but not the entry
+	touch("sub/" + long1 + nametransform.LongNameSuffix)
+	// Complete
+	touch("sub/" + long2)
+	touch("sub/" + long2 + nametransform.LongNameSuffix)
+	// Mkdir without gocryptfs.diriv, and complete
+	mkdir("d1")
+	mkdir("d2")
+	touch("d2/" + nametransform.DirIVFilename)
+	// Rmdir that moved gocryptfs.diriv out, and one that deleted the
+	// directory
+	mkdir("d3")
+	touch(tmp1)
+	touch(tmp2)
+
+	j, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Open(filepath.Join(dir, "sub"), syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{long1, long2} {
+		if _, err := j.BeginAt(fd, Intent{Op: OpLongName, Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	syscall.Close(fd)
+	for _, i := range []Intent{
+		{Op: OpMkdir, Name: "d1"},
+		{Op: OpMkdir, Name: "d2"},
+		{Op: OpRmdir, Name: "d3", Tmp: tmp1},
+		{Op: OpRmdir, Name: "d4", Tmp: tmp2},
+	} {
+		if _, err := j.Begin(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+
+	n, warnings, err := Replay(dir)
+	if err != nil || len(warnings) > 0 {
+		t.Fatal(err, warnings)
+	}
+	if n != 6 {
+		t.Errorf("want 6 records, got %d", n)
+	}
+	if exists("sub/" + long1 + nametransform.LongNameSuffix) {
+		t.Error("orphaned .name file was not deleted")
+	}
+	if !exists("sub/" + long2 + nametransform.LongNameSuffix) {
+		t.Error(".name file of an existing entry was deleted")
+	}
+	if exists("d1") || !exists("d2") {
+		t.Error("mkdir: wrong directory deleted")
+	}
+	if exists(tmp1) || !exists("d3/"+nametransform.DirIVFilename) {
+		t.Error("rmdir: gocryptfs.diriv was not moved back")
+	}
+	if exists(tmp2) {
+		t.Error("rmdir: temporary file was not deleted")
+	}
+	if st, err := os.Stat(filepath.Join(dir, FileName)); err != nil || st.Size() != 0 {
+		t.Errorf("journal was not emptied: %v", err)
+	}
+	// Nothing to do the second time
+	if n, _, err = Replay(dir); n != 0 || err != nil {
+		t.Errorf("second replay: n=%d err=%v", n, err)
+	}
+}
+
+func TestDone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	j, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	size := func() int64 {
+		st, err := os.Stat(filepath.Join(dir, FileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.Size()
+	}
+	done1, err := j.Begin(Intent{Op: OpMkdir, Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done2, err := j.Begin(Intent{Op: OpMkdir, Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done1()
+	if size() == 0 {
+		t.Error("journal emptied while an operation is running")
+	}
+	done2()
+	if size() != 0 {
+		t.Error("journal not emptied")
+	}
+}
@@ -0,0 +1,129 @@
+package journal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+)
+
+// rmdirInfix separates the marker file name and the random number in
+// Intent.Tmp, like in "gocryptfs.diriv.rmdir.1234"
+const rmdirInfix = ".rmdir."
+
+// replay repairs what the operation "i" may have left behind
+func replay(cipherdir string, i Intent) error {
+	if !validName(i.Name) || (i.Tmp != "" && !validName(i.Tmp)) {
+		return fmt.Errorf("invalid name")
+	}
+	dirfd, err := syscallcompat.OpenDirNofollow(cipherdir, i.Dir)
+	if err == syscall.ENOENT {
+		// The directory has been deleted since
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	switch i.Op {
+	case OpLongName:
+	case OpMkdir:
+		err = replayMkdir(dirfd, i.Name)
+	case OpRmdir:
+		err = replayRmdir(dirfd, i.Name, i.Tmp)
+	default:
+		return fmt.Errorf("unknown operation")
+	}
+	if err != nil {
+		return err
+	}
+	return replayLongName(dirfd, i.Name)
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// replayLongName deletes the .name file of "name" if "name" does not exist
+func replayLongName(dirfd int, name string) error {
+	if !nametransform.IsLongContent(name) {
+		return nil
+	}
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != syscall.ENOENT {
+		return err
+	}
+	err = syscallcompat.Unlinkat(dirfd, name+nametransform.LongNameSuffix, 0)
+	if err == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
+
+// replayMkdir deletes the directory "name" if it is empty. Its
+// gocryptfs.diriv has not been written.
+func replayMkdir(dirfd int, name string) error {
+	fd, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err == syscall.ENOENT || err == syscall.ENOTDIR {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	children, err := syscallcompat.Getdents(fd)
+	syscall.Close(fd)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(children) == 0 {
+		return syscallcompat.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+	}
+	for _, c := range children {
+		if c.Name == nametransform.DirIVFilename || c.Name == nametransform.DirPolicyFilename {
+			return nil
+		}
+	}
+	return fmt.Errorf("directory has no %s, but is not empty", nametransform.DirIVFilename)
+}
+
+// replayRmdir finishes an interrupted Rmdir: if the directory "name" is
+// gone, "tmp" is deleted. Otherwise, deleting it has failed and "tmp" is
+// moved back into it.
+func replayRmdir(dirfd int, name string, tmp string) error {
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, tmp, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err == syscall.ENOENT {
+		// Rmdir has not moved the marker file, or it has completed
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	idx := strings.Index(tmp, rmdirInfix)
+	if idx < 0 {
+		return fmt.Errorf("invalid temporary name %q", tmp)
+	}
+	marker := tmp[:idx]
+	if marker != nametransform.DirIVFilename && marker != nametransform.DirPolicyFilename {
+		return fmt.Errorf("invalid temporary name %q", tmp)
+	}
+	fd, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err == syscall.ENOENT {
+		return syscallcompat.Unlinkat(dirfd, tmp, 0)
+	}
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	err = syscallcompat.Fstatat(fd, marker, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err == nil {
+		return syscallcompat.Unlinkat(dirfd, tmp, 0)
+	}
+	return syscallcompat.Renameat(dirfd, tmp, fd, marker)
+}
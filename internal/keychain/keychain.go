@@ -0,0 +1,22 @@
+// Package keychain stores passwords in the login Keychain of macOS. It uses
+// the "security" command line tool, which keeps gocryptfs free of cgo.
+package keychain
+
+import (
+	"errors"
+	"strings"
+)
+
+// account is the account name of the items that Store creates. Lookup finds
+// items with any account name.
+const account = "gocryptfs"
+
+// ErrNotFound is returned by Lookup when there is no such item
+var ErrNotFound = errors.New("keychain: item not found")
+
+// quote quotes "s" for the command parser of "security -i"
+func quote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
@@ -0,0 +1,54 @@
+package keychain
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Supported tells if the Keychain is available on this platform
+const Supported = true
+
+// "security" exits with this code when the item does not exist
+// (errSecItemNotFound, -25300, truncated to eight bits)
+const exitNotFound = 44
+
+const security = "/usr/bin/security"
+
+// Lookup returns the password of the generic password item with the service
+// name "item". macOS may ask the user to allow the access.
+func Lookup(item string) ([]byte, error) {
+	cmd := exec.Command(security, "find-generic-password", "-s", item, "-w")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == exitNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("keychain: %s failed: %v", security, err)
+	}
+	return bytes.TrimSuffix(out, []byte("\n")), nil
+}
+
+// Store saves "password" in a new generic password item with the service
+// name "item". The command goes through stdin so that the password does not
+// show up in the process list.
+func Store(item string, password []byte) error {
+	if strings.ContainsAny(string(password), "\n\x00") {
+		return fmt.Errorf("keychain: the password contains a newline or NUL byte")
+	}
+	tlog.Debug.Printf("keychain: adding item %q", item)
+	cmd := exec.Command(security, "-i")
+	cmd.Stdin = strings.NewReader("add-generic-password -a " + quote(account) +
+		" -s " + quote(item) + " -l " + quote("gocryptfs: "+item) +
+		" -w " + quote(string(password)) + "\n")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("keychain: %s failed: %v", security, err)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !darwin
+// +build !darwin
+
+package keychain
+
+import (
+	"errors"
+)
+
+// Supported tells if the Keychain is available on this platform
+const Supported = false
+
+var errUnsupported = errors.New("keychain: only available on macOS")
+
+// Lookup is only implemented on macOS
+func Lookup(item string) ([]byte, error) {
+	return nil, errUnsupported
+}
+
+// Store is only implemented on macOS
+func Store(item string, password []byte) error {
+	return errUnsupported
+}
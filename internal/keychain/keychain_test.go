@@ -0,0 +1,19 @@
+package keychain
+
+import (
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"":        `""`,
+		"foo bar": `"foo bar"`,
+		`a"b`:     `"a\"b"`,
+		`c:\dir\`: `"c:\\dir\\"`,
+		`\"`:      `"\\\""`,
+	} {
+		if have := quote(in); have != want {
+			t.Errorf("quote(%q): want %s, have %s", in, want, have)
+		}
+	}
+}
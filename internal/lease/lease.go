@@ -0,0 +1,247 @@
+// Package lease serializes directory modifications between several machines
+// that mount the same CIPHERDIR from network storage (NFS, SMB) with
+// "-sharedstorage".
+//
+// Creating or deleting a file with a long name touches two directory entries
+// (the file and its gocryptfs.longname.*.name companion), and creating a
+// directory touches the directory and its gocryptfs.diriv. Without
+// coordination, two machines can interleave these steps and leave orphaned or
+// mismatched companions behind. A lease is a file called "gocryptfs.lease" in
+// the backing directory, created with O_EXCL, which is atomic on NFSv3+ and
+// SMB. Whoever manages to create it owns the directory until it deletes the
+// file again.
+//
+// While a lease is held, its owner increments a heartbeat counter in the
+// lease file every heartbeatInterval. A lease whose content has not changed
+// for StaleAfter belongs to a crashed machine and is broken. Only the local
+// clock of the observing machine is used for this, so clock skew between
+// the machines and the file server does not matter.
+package lease
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+const (
+	// Filename is the name of the lease file in the backing directory
+	Filename = "gocryptfs.lease"
+	// StaleAfter is how long the heartbeat of a lease must stay unchanged
+	// before the lease is considered abandoned.
+	StaleAfter = 30 * time.Second
+	// Timeout is how long Acquire waits for a lease held by someone else
+	Timeout = 2 * StaleAfter
+	// retryInterval is the initial sleep time between attempts
+	retryInterval = time.Millisecond
+	// maxLeaseSize limits how much of a lease file is read
+	maxLeaseSize = 256
+)
+
+// Shortened by the tests
+var (
+	staleAfter        = StaleAfter
+	timeout           = Timeout
+	heartbeatInterval = StaleAfter / 4
+)
+
+// IsLeaseFile returns true for the lease file and for stale leases that are
+// in the process of being broken. These files must not show up in directory
+// listings, and tools that walk the CIPHERDIR must skip them.
+func IsLeaseFile(name string) bool {
+	return strings.HasPrefix(name, Filename)
+}
+
+// Acquire takes the lease on the directory "dirfd". It waits for up to
+// Timeout if another machine (or another operation) holds it, and returns
+// EAGAIN if it is still held after that.
+//
+// The returned function releases the lease.
+func Acquire(dirfd int) (release func(), err error) {
+	hostname, _ := os.Hostname()
+	// The owner string identifies our lease. The rest is informational, for
+	// debugging.
+	owner := fmt.Sprintf("%s %d %016x ", hostname, os.Getpid(), cryptocore.RandUint64())
+	var o observer
+	sleep := retryInterval
+	deadline := time.Now().Add(timeout)
+	for {
+		fd, err := syscallcompat.Openat(dirfd, Filename,
+			syscall.O_RDWR|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0600)
+		if err == nil {
+			if err = writeHeartbeat(fd, owner, 0); err != nil {
+				syscall.Close(fd)
+				syscallcompat.Unlinkat(dirfd, Filename, 0)
+				return nil, err
+			}
+			return startHeartbeat(dirfd, fd, owner), nil
+		}
+		if err != syscall.EEXIST {
+			return nil, err
+		}
+		if o.stale(dirfd) && breakStale(dirfd, o.content) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			tlog.Warn.Printf("lease: timeout waiting for %s", Filename)
+			return nil, syscall.EAGAIN
+		}
+		backoff(&sleep)
+	}
+}
+
+// RemoveStale deletes a stale lease in "dirfd", if there is one. As
+// staleness can only be detected by watching the heartbeat, this waits for
+// up to Timeout if a lease exists.
+func RemoveStale(dirfd int) {
+	var o observer
+	sleep := retryInterval
+	deadline := time.Now().Add(timeout)
+	for {
+		if o.stale(dirfd) {
+			breakStale(dirfd, o.content)
+			return
+		}
+		if !o.seen || time.Now().After(deadline) {
+			// No lease, or one that is alive
+			return
+		}
+		backoff(&sleep)
+	}
+}
+
+func backoff(sleep *time.Duration) {
+	time.Sleep(*sleep)
+	if *sleep < 100*time.Millisecond {
+		*sleep *= 2
+	}
+}
+
+// writeHeartbeat overwrites the lease file "fd" with the heartbeat counter
+// "n". The content always has the same length. The fsync makes the new
+// content visible to other NFS clients.
+func writeHeartbeat(fd int, owner string, n uint64) error {
+	content := fmt.Sprintf("%s%020d\n", owner, n)
+	if _, err := syscall.Pwrite(fd, []byte(content), 0); err != nil {
+		return err
+	}
+	return syscall.Fsync(fd)
+}
+
+// startHeartbeat keeps the lease file "fd" fresh until the returned release
+// function is called.
+func startHeartbeat(dirfd int, fd int, owner string) (release func()) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(heartbeatInterval)
+		defer t.Stop()
+		for n := uint64(1); ; n++ {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				if err := writeHeartbeat(fd, owner, n); err != nil {
+					tlog.Warn.Printf("lease: heartbeat failed: %v", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		syscall.Close(fd)
+		releaseLease(dirfd, owner)
+	}
+}
+
+// readLease returns the content of the lease file "name" in "dirfd".
+func readLease(dirfd int, name string) ([]byte, error) {
+	fd, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	buf := make([]byte, maxLeaseSize)
+	n, err := syscall.Pread(fd, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// releaseLease deletes the lease file, but only if it is still the one we created.
+func releaseLease(dirfd int, owner string) {
+	content, err := readLease(dirfd, Filename)
+	if err != nil || !bytes.HasPrefix(content, []byte(owner)) {
+		tlog.Warn.Printf("lease: our lease was broken by someone else")
+		return
+	}
+	err = syscallcompat.Unlinkat(dirfd, Filename, 0)
+	if err != nil {
+		tlog.Warn.Printf("lease: release failed: %v", err)
+	}
+}
+
+// observer watches the heartbeat of a lease held by someone else.
+type observer struct {
+	// seen is true if the lease existed at the last check
+	seen bool
+	// content is the lease content at the last check
+	content []byte
+	// since is when the content was first seen, on the local monotonic clock
+	since time.Time
+}
+
+// stale checks the lease in "dirfd" and returns true if its content has not
+// changed for staleAfter.
+func (o *observer) stale(dirfd int) bool {
+	content, err := readLease(dirfd, Filename)
+	if err != nil {
+		o.seen = false
+		return false
+	}
+	if !o.seen || !bytes.Equal(content, o.content) {
+		o.seen = true
+		o.content = content
+		o.since = time.Now()
+		return false
+	}
+	return time.Since(o.since) > staleAfter
+}
+
+// breakStale removes the lease in "dirfd" if its content is still "content".
+// Returns true if a lease has been removed.
+//
+// Two machines may try to break the same stale lease at the same time, and
+// the slower one must not delete the fresh lease that the faster one created
+// in the meantime. So the lease is first renamed to a unique name, which is
+// atomic, and checked again. If it turns out to be a different one, it is
+// put back.
+func breakStale(dirfd int, content []byte) bool {
+	tmp := fmt.Sprintf("%s.stale.%d", Filename, cryptocore.RandUint64())
+	if err := syscallcompat.Renameat(dirfd, Filename, dirfd, tmp); err != nil {
+		// Someone else was faster
+		return false
+	}
+	c, err := readLease(dirfd, tmp)
+	if err == nil && !bytes.Equal(c, content) {
+		// We grabbed a fresh lease. Try to give it back. If a third party
+		// has created a lease in the meantime, the owner of the one we
+		// grabbed will notice on release.
+		syscallcompat.Linkat(dirfd, tmp, dirfd, Filename, 0)
+		syscallcompat.Unlinkat(dirfd, tmp, 0)
+		return false
+	}
+	tlog.Warn.Printf("lease: breaking stale %s", Filename)
+	syscallcompat.Unlinkat(dirfd, tmp, 0)
+	return true
+}
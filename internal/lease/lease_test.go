@@ -0,0 +1,123 @@
+package lease
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func openTestDir(t *testing.T) (string, int) {
+	dir, err := ioutil.TempDir("", "lease_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		syscall.Close(dirfd)
+		os.RemoveAll(dir)
+	})
+	return dir, dirfd
+}
+
+func TestAcquireRelease(t *testing.T) {
+	dir, dirfd := openTestDir(t)
+	release, err := Acquire(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, Filename)); err != nil {
+		t.Fatalf("lease file missing: %v", err)
+	}
+	// Second Acquire must wait until the first lease is released
+	done := make(chan struct{})
+	go func() {
+		release2, err := Acquire(dirfd)
+		if err != nil {
+			t.Error(err)
+		} else {
+			release2()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("second Acquire did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	<-done
+	if _, err := os.Stat(filepath.Join(dir, Filename)); !os.IsNotExist(err) {
+		t.Errorf("lease file not deleted: %v", err)
+	}
+}
+
+// shortTimes shortens the lease timeouts for the duration of the test
+func shortTimes(t *testing.T) {
+	staleAfter = 200 * time.Millisecond
+	timeout = time.Second
+	heartbeatInterval = 20 * time.Millisecond
+	t.Cleanup(func() {
+		staleAfter = StaleAfter
+		timeout = Timeout
+		heartbeatInterval = StaleAfter / 4
+	})
+}
+
+func TestBreakStale(t *testing.T) {
+	shortTimes(t)
+	dir, dirfd := openTestDir(t)
+	p := filepath.Join(dir, Filename)
+	// A lease whose heartbeat never changes. The mtime is in the future,
+	// which must not matter.
+	if err := ioutil.WriteFile(p, []byte("crashed 1 0 0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(p, future, future)
+	release, err := Acquire(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("leftover files: %v", entries)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	shortTimes(t)
+	dir, dirfd := openTestDir(t)
+	p := filepath.Join(dir, Filename)
+	// A live lease is kept alive by its heartbeat, even with an mtime
+	// far in the past
+	release, err := Acquire(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(p, past, past)
+	if _, err := Acquire(dirfd); err != syscall.EAGAIN {
+		t.Errorf("want EAGAIN, got %v", err)
+	}
+	RemoveStale(dirfd)
+	if _, err := os.Stat(p); err != nil {
+		t.Errorf("live lease was removed: %v", err)
+	}
+	release()
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("lease file not deleted: %v", err)
+	}
+}
+
+func TestIsLeaseFile(t *testing.T) {
+	if !IsLeaseFile(Filename) || !IsLeaseFile(Filename+".stale.123") || IsLeaseFile("gocryptfs.diriv") {
+		t.Fail()
+	}
+}
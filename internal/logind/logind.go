@@ -0,0 +1,187 @@
+// Package logind tells when the machine is about to sleep and when the
+// user session is locked, by listening to the D-Bus signals of
+// systemd-logind.
+package logind
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/dbus"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Event is something that logind has announced
+type Event int
+
+const (
+	// Sleep means the machine is about to suspend or hibernate. Sleep is
+	// delayed until the handler returns, at most for the InhibitDelayMaxSec
+	// of logind.conf (5 seconds by default).
+	Sleep Event = iota
+	// Resume means the machine has woken up
+	Resume
+	// Lock means the screen of our session is being locked
+	Lock
+	// Unlock means our session has been unlocked
+	Unlock
+)
+
+func (e Event) String() string {
+	switch e {
+	case Sleep:
+		return "sleep"
+	case Resume:
+		return "resume"
+	case Lock:
+		return "lock"
+	case Unlock:
+		return "unlock"
+	}
+	return "unknown"
+}
+
+const (
+	login1        = "org.freedesktop.login1"
+	login1Path    = "/org/freedesktop/login1"
+	login1Manager = "org.freedesktop.login1.Manager"
+	login1Session = "org.freedesktop.login1.Session"
+)
+
+// defaultSystemBus is where the system bus is if DBUS_SYSTEM_BUS_ADDRESS is
+// not set
+const defaultSystemBus = "unix:path=/run/dbus/system_bus_socket"
+
+// Watcher calls its handler for logind events
+type Watcher struct {
+	c       *dbus.Conn
+	handler func(Event)
+	why     string
+	// session is the object path of our session, or "" if we are not part
+	// of a session, like in a system service
+	session string
+	// inhibitFd is the delay inhibitor lock that makes logind wait for us
+	// before sleeping, or -1
+	inhibitFd int
+	// inhibitSerial is the serial of the pending Inhibit call, or 0
+	inhibitSerial uint32
+}
+
+// Watch connects to logind and calls "handler" for every Event. "why" is
+// the reason for delaying sleep that "systemd-inhibit --list" shows. The
+// handler runs on the goroutine that reads the bus, so the next event is
+// only delivered after it has returned.
+func Watch(why string, handler func(Event)) (*Watcher, error) {
+	addr := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	if addr == "" {
+		addr = defaultSystemBus
+	}
+	return watch(addr, why, handler)
+}
+
+func watch(addr string, why string, handler func(Event)) (*Watcher, error) {
+	c, err := dbus.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{c: c, handler: handler, why: why, inhibitFd: -1}
+	// Processes outside of a session, like system services, only get the
+	// sleep events
+	e := &dbus.Encoder{}
+	e.Uint32(uint32(os.Getpid()))
+	if m, err := c.Call(login1, login1Path, login1Manager, "GetSessionByPID", "u", e.B); err == nil && m.Sig == "o" {
+		w.session = m.BodyDecoder().String()
+	} else {
+		tlog.Debug.Printf("logind: not in a session: %v", err)
+	}
+	matches := []string{"type='signal',interface='" + login1Manager + "',member='PrepareForSleep'"}
+	if w.session != "" {
+		matches = append(matches, "type='signal',interface='"+login1Session+"',path='"+w.session+"'")
+	}
+	for _, match := range matches {
+		if err := c.AddMatch(match); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if err := w.inhibit(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	go w.loop()
+	return w, nil
+}
+
+// inhibit asks logind for a delay inhibitor lock. The reply is handled by
+// loop().
+func (w *Watcher) inhibit() error {
+	e := &dbus.Encoder{}
+	for _, s := range []string{"sleep", "gocryptfs", w.why, "delay"} {
+		e.String(s)
+	}
+	m := dbus.MethodCall(login1, login1Path, login1Manager, "Inhibit", "ssss", e.B)
+	err := w.c.Send(m)
+	w.inhibitSerial = m.Serial
+	return err
+}
+
+// releaseInhibitor lets logind go to sleep
+func (w *Watcher) releaseInhibitor() {
+	if w.inhibitFd >= 0 {
+		syscall.Close(w.inhibitFd)
+		w.inhibitFd = -1
+	}
+}
+
+// loop reads the bus until the connection is closed
+func (w *Watcher) loop() {
+	defer w.releaseInhibitor()
+	for {
+		m, err := w.c.Read()
+		if err != nil {
+			tlog.Debug.Printf("logind: %v", err)
+			return
+		}
+		w.handle(m)
+	}
+}
+
+func (w *Watcher) handle(m *dbus.Message) {
+	switch {
+	case m.ReplySerial != 0 && m.ReplySerial == w.inhibitSerial:
+		w.inhibitSerial = 0
+		if m.Type == dbus.TypeMethodReturn && m.Sig == "h" {
+			if i := int(m.BodyDecoder().Uint32()); i < len(m.Fds) {
+				w.releaseInhibitor()
+				w.inhibitFd = m.Fds[i]
+				m.Fds = append(m.Fds[:i], m.Fds[i+1:]...)
+			}
+		} else {
+			tlog.Warn.Printf("logind: cannot delay sleep: %s", m.ErrName)
+		}
+	case m.Type == dbus.TypeSignal && m.Interface == login1Manager && m.Member == "PrepareForSleep" && m.Sig == "b":
+		if m.BodyDecoder().Uint32() != 0 {
+			w.handler(Sleep)
+			w.releaseInhibitor()
+		} else {
+			// Take the lock again for the next time
+			if err := w.inhibit(); err != nil {
+				tlog.Warn.Printf("logind: %v", err)
+			}
+			w.handler(Resume)
+		}
+	case m.Type == dbus.TypeSignal && m.Interface == login1Session && m.Path == w.session:
+		switch m.Member {
+		case "Lock":
+			w.handler(Lock)
+		case "Unlock":
+			w.handler(Unlock)
+		}
+	}
+	dbus.CloseFds(m.Fds)
+}
+
+// Close disconnects from the bus
+func (w *Watcher) Close() error {
+	return w.c.Close()
+}
@@ -0,0 +1,139 @@
+package logind
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/dbus"
+)
+
+const testSession = "/org/freedesktop/login1/session/_31"
+
+// fakeBus accepts one connection and plays the bus and logind. After the
+// first Inhibit call, it sends a sleep, a lock of our and of another
+// session, and a resume. The read ends of the inhibitor pipes are sent to
+// "inhibitors".
+func fakeBus(t *testing.T, l *net.UnixListener, inhibitors chan<- *os.File) {
+	uc, err := l.AcceptUnix()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer uc.Close()
+	c, err := dbus.Accept(uc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	send := func(m *dbus.Message) {
+		if err := c.Send(m); err != nil {
+			t.Error(err)
+		}
+	}
+	signal := func(path, iface, member, sig string, body []byte) {
+		send(&dbus.Message{Type: dbus.TypeSignal, Path: path, Interface: iface, Member: member, Sig: sig, Body: body})
+	}
+	sleep := func(v uint32) {
+		e := &dbus.Encoder{}
+		e.Uint32(v)
+		signal(login1Path, login1Manager, "PrepareForSleep", "b", e.B)
+	}
+	inhibits := 0
+	for {
+		m, err := c.Read()
+		if err != nil {
+			return
+		}
+		reply := &dbus.Message{Type: dbus.TypeMethodReturn, ReplySerial: m.Serial}
+		fd := -1
+		e := &dbus.Encoder{}
+		switch m.Member {
+		case "Hello":
+			reply.Sig = "s"
+			e.String(":1.1")
+		case "GetSessionByPID":
+			reply.Sig = "o"
+			e.String(testSession)
+		case "Inhibit":
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			inhibitors <- r
+			reply.Sig = "h"
+			e.Uint32(0)
+			// Keep the write end out of the reach of the garbage collector
+			fd, err = syscall.Dup(int(w.Fd()))
+			w.Close()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		reply.Body = e.B
+		if fd >= 0 {
+			reply.Fds = []int{fd}
+		}
+		send(reply)
+		if fd >= 0 {
+			// Only the client holds the inhibitor now
+			syscall.Close(fd)
+		}
+		if m.Member == "Inhibit" {
+			inhibits++
+			if inhibits == 1 {
+				sleep(1)
+				signal("/org/freedesktop/login1/session/_32", login1Session, "Lock", "", nil)
+				signal(testSession, login1Session, "Lock", "", nil)
+				sleep(0)
+			}
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logind_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := dir + "/bus"
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	inhibitors := make(chan *os.File, 2)
+	go fakeBus(t, l, inhibitors)
+
+	events := make(chan Event, 10)
+	w, err := watch("unix:path="+sock, "test", func(e Event) { events <- e })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.session != testSession {
+		t.Errorf("session %q", w.session)
+	}
+	inhibitor := <-inhibitors
+	if e := <-events; e != Sleep {
+		t.Fatalf("first event: %v", e)
+	}
+	// The inhibitor is released after the handler has returned, which makes
+	// the read end of the pipe see EOF
+	if n, err := inhibitor.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("inhibitor has not been released: %d %v", n, err)
+	}
+	inhibitor.Close()
+	for _, want := range []Event{Lock, Resume} {
+		if e := <-events; e != want {
+			t.Errorf("want %v, have %v", want, e)
+		}
+	}
+	// A new inhibitor is taken after resume
+	(<-inhibitors).Close()
+}
@@ -32,19 +32,20 @@ func ReadDirIVAt(dirfd int) (iv []byte, err error) {
 	}
 	fd := os.NewFile(uintptr(fdRaw), DirIVFilename)
 	defer fd.Close()
-	return fdReadDirIV(fd)
+	return ReadDirIVFrom(fd)
 }
 
 // allZeroDirIV is preallocated to quickly check if the data read from disk is all zero
 var allZeroDirIV = make([]byte, DirIVLen)
 
-// fdReadDirIV reads and verifies the DirIV from an opened gocryptfs.diriv file.
-func fdReadDirIV(fd *os.File) (iv []byte, err error) {
+// ReadDirIVFrom reads and verifies the DirIV from an opened gocryptfs.diriv
+// file.
+func ReadDirIVFrom(r io.Reader) (iv []byte, err error) {
 	// We want to detect if the file is bigger than DirIVLen, so
 	// make the buffer 1 byte bigger than necessary.
 	iv = make([]byte, DirIVLen+1)
-	n, err := fd.Read(iv)
-	if err != nil && err != io.EOF {
+	n, err := io.ReadFull(r, iv)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return nil, fmt.Errorf("read failed: %v", err)
 	}
 	iv = iv[0:n]
@@ -96,10 +97,11 @@ func WriteDirIVAt(dirfd int) error {
 
 // encryptAndHashName encrypts "name" and hashes it to a longname if it is
 // too long.
-// Returns ENAMETOOLONG if "name" is longer than 255 bytes.
+// Returns ENAMETOOLONG if "name" is longer than 255 bytes, or the limit set
+// by SetNameMax().
 func (be *NameTransform) EncryptAndHashName(name string, iv []byte) (string, error) {
 	// Prevent the user from creating files longer than 255 chars.
-	if len(name) > NameMax {
+	if len(name) > be.nameMax {
 		return "", syscall.ENAMETOOLONG
 	}
 	cName := be.EncryptName(name, iv)
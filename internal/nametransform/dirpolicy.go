@@ -0,0 +1,84 @@
+package nametransform
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+const (
+	// DirPolicyFilename marks a directory whose contents are not (fully)
+	// encrypted. It takes the place of gocryptfs.diriv, and the policy
+	// applies to everything below the directory.
+	// Exported because we have to ignore this name in directory listing.
+	DirPolicyFilename = "gocryptfs.dirpolicy"
+	// DirPolicyPlaintextNames stores the names below the directory in
+	// plaintext. The file contents are still encrypted.
+	DirPolicyPlaintextNames = "plaintextnames"
+	// DirPolicyPassthrough stores names, symlink targets and file contents
+	// below the directory in plaintext.
+	DirPolicyPassthrough = "passthrough"
+	// maxDirPolicyLen is more than the longest valid policy, so that garbage
+	// is detected
+	maxDirPolicyLen = 64
+)
+
+// IsValidDirPolicy returns true if "policy" is one of the DirPolicy*
+// constants
+func IsValidDirPolicy(policy string) bool {
+	return policy == DirPolicyPlaintextNames || policy == DirPolicyPassthrough
+}
+
+// ReadDirPolicyAt reads "gocryptfs.dirpolicy" from the directory that is
+// opened as "dirfd". Returns ENOENT if the directory has no policy.
+// Retries on EINTR.
+func ReadDirPolicyAt(dirfd int) (policy string, err error) {
+	fdRaw, err := syscallcompat.Openat(dirfd, DirPolicyFilename,
+		syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", err
+	}
+	fd := os.NewFile(uintptr(fdRaw), DirPolicyFilename)
+	defer fd.Close()
+	buf := make([]byte, maxDirPolicyLen)
+	n, err := io.ReadFull(fd, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("read failed: %v", err)
+	}
+	policy = strings.TrimSuffix(string(buf[:n]), "\n")
+	if !IsValidDirPolicy(policy) {
+		return "", fmt.Errorf("unknown directory policy %q", policy)
+	}
+	return policy, nil
+}
+
+// WriteDirPolicyAt creates the "gocryptfs.dirpolicy" file in the directory
+// opened at "dirfd". On error we try to delete the incomplete file.
+func WriteDirPolicyAt(dirfd int, policy string) error {
+	if !IsValidDirPolicy(policy) {
+		return syscall.EINVAL
+	}
+	// Same permissions as gocryptfs.diriv, the policy never changes
+	fd, err := syscallcompat.Openat(dirfd, DirPolicyFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, dirivPerms)
+	if err != nil {
+		tlog.Warn.Printf("WriteDirPolicy: Openat: %v", err)
+		return err
+	}
+	f := os.NewFile(uintptr(fd), DirPolicyFilename)
+	_, err = f.Write([]byte(policy + "\n"))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		tlog.Warn.Printf("WriteDirPolicy: %v", err)
+		// Delete incomplete gocryptfs.dirpolicy file
+		syscallcompat.Unlinkat(dirfd, DirPolicyFilename, 0)
+		return err
+	}
+	return nil
+}
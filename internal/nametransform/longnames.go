@@ -1,7 +1,9 @@
 package nametransform
 
 import (
+	"crypto/aes"
 	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"os"
@@ -91,8 +93,9 @@ func ReadLongNameAt(dirfd int, cName string) (string, error) {
 		// fd runs out of scope here
 	}
 	defer f.Close()
-	// 256 (=255 padded to 16) bytes base64-encoded take 344 bytes: "AAAAAAA...AAA=="
-	lim := 344
+	// 1040 (=NameMaxLimit padded to 16) bytes base64-encoded take 1388
+	// bytes: "AAAAAAA...AAA=="
+	lim := base64.URLEncoding.EncodedLen(NameMaxLimit + aes.BlockSize)
 	// Allocate a bigger buffer so we see whether the file is too big
 	buf := make([]byte, lim+1)
 	n, err := f.ReadAt(buf, 0)
@@ -1,7 +1,14 @@
 package nametransform
 
 import (
+	"crypto/aes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
+
+	"github.com/HorizonLiu/eme"
 )
 
 func TestIsLongName(t *testing.T) {
@@ -28,3 +35,54 @@ func TestRemoveLongNameSuffix(t *testing.T) {
 		t.Error(".name suffix not removed")
 	}
 }
+
+func TestNameMax(t *testing.T) {
+	bc, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := New(eme.New(bc), true, true)
+	dir, err := ioutil.TempDir("", "longnames_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dirfd, err := syscall.Open(dir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	if err = WriteDirIVAt(dirfd); err != nil {
+		t.Fatal(err)
+	}
+	iv, err := ReadDirIVAt(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strings.Repeat("x", NameMaxLimit)
+	if _, err = n.EncryptAndHashName(name[:NameMax+1], iv); err != syscall.ENAMETOOLONG {
+		t.Errorf("default limit: want ENAMETOOLONG, got %v", err)
+	}
+	n.SetNameMax(NameMaxLimit)
+	if _, err = n.EncryptAndHashName(name+"x", iv); err != syscall.ENAMETOOLONG {
+		t.Errorf("over the limit: want ENAMETOOLONG, got %v", err)
+	}
+	cName, err := n.EncryptAndHashName(name, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsLongContent(cName) {
+		t.Fatalf("%q is not a long name", cName)
+	}
+	if err = n.WriteLongNameAt(dirfd, cName, name); err != nil {
+		t.Fatal(err)
+	}
+	cFull, err := ReadLongNameAt(dirfd, cName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := n.DecryptName(cFull, iv)
+	if err != nil || plain != name {
+		t.Errorf("decrypted %d bytes: %v", len(plain), err)
+	}
+}
@@ -0,0 +1,113 @@
+package nametransform
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+const (
+	// LongTargetPrefix starts the names of the files that store encrypted
+	// symlink targets that are too long for a symlink:
+	// gocryptfs.longtarget.[sha256]. The symlink points to that name
+	// instead, which cannot be mistaken for an encrypted target because
+	// base64 has no dots.
+	LongTargetPrefix = "gocryptfs.longtarget."
+	// MaxSymlinkTarget is the longest target Linux stores in a symlink.
+	// Encryption and base64 make a target about 4/3 longer, so plaintext
+	// targets over about 3000 bytes need a long target file.
+	MaxSymlinkTarget = 4095
+	// maxLongTarget is the size of the longest plaintext target,
+	// MaxSymlinkTarget, encrypted and base64-encoded, plus some slack
+	maxLongTarget = 8192
+)
+
+// IsLongTarget returns true if "cName" is a long target file, or if the
+// symlink target "cName" points to one.
+//
+// This function does not do any I/O.
+func IsLongTarget(cName string) bool {
+	return strings.HasPrefix(cName, LongTargetPrefix)
+}
+
+// LongTargetName returns the name of the long target file that stores the
+// encrypted target "cTarget". The nonce makes every encrypted target, and
+// so the name, unique.
+//
+// This function does not do any I/O.
+func LongTargetName(cTarget string) string {
+	hash := sha256.Sum256([]byte(cTarget))
+	return LongTargetPrefix + base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// ReadLongTargetAt reads the encrypted symlink target from the long target
+// file "name" in the directory opened as "dirfd".
+//
+// Symlink-safe through Openat().
+func ReadLongTargetAt(dirfd int, name string) (string, error) {
+	fd, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	// Allocate a bigger buffer so we see whether the file is too big
+	buf := make([]byte, maxLongTarget+1)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if n == 0 {
+		return "", fmt.Errorf("ReadLongTarget: empty file")
+	}
+	if n > maxLongTarget {
+		return "", fmt.Errorf("ReadLongTarget: size=%d > limit=%d", n, maxLongTarget)
+	}
+	return string(buf[:n]), nil
+}
+
+// WriteLongTargetAt writes the encrypted symlink target "cTarget" into its
+// long target file in the directory opened as "dirfd" and returns the name
+// of the file, which becomes the target of the symlink.
+//
+// Symlink-safe through Openat().
+func WriteLongTargetAt(dirfd int, cTarget string) (string, error) {
+	name := LongTargetName(cTarget)
+	fd, err := syscallcompat.Openat(dirfd, name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, namePerms)
+	if err != nil {
+		tlog.Warn.Printf("WriteLongTarget: Openat: %v", err)
+		return "", err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	_, err = f.Write([]byte(cTarget))
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		tlog.Warn.Printf("WriteLongTarget: %v", err)
+		syscallcompat.Unlinkat(dirfd, name, 0)
+		return "", err
+	}
+	return name, nil
+}
+
+// DeleteLongTargetAt deletes the long target file "name" in the directory
+// opened as "dirfd".
+//
+// This function is symlink-safe through the use of Unlinkat().
+func DeleteLongTargetAt(dirfd int, name string) error {
+	err := syscallcompat.Unlinkat(dirfd, name, 0)
+	if err != nil {
+		tlog.Warn.Printf("DeleteLongTarget: %v", err)
+	}
+	return err
+}
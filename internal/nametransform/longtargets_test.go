@@ -0,0 +1,46 @@
+package nametransform
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestLongTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "longtargets_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dirfd, err := syscall.Open(dir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	cTarget := strings.Repeat("A", 5000)
+	name, err := WriteLongTargetAt(dirfd, cTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsLongTarget(name) || name != LongTargetName(cTarget) {
+		t.Errorf("wrong name %q", name)
+	}
+	if NameType(name) != LongNameNone || IsLongTarget(cTarget) {
+		t.Error("long targets and other names are mixed up")
+	}
+	cTarget2, err := ReadLongTargetAt(dirfd, name)
+	if err != nil || cTarget2 != cTarget {
+		t.Errorf("read back %d bytes: %v", len(cTarget2), err)
+	}
+	if _, err = WriteLongTargetAt(dirfd, cTarget); err != syscall.EEXIST {
+		t.Errorf("want EEXIST, got %v", err)
+	}
+	if err = DeleteLongTargetAt(dirfd, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadLongTargetAt(dirfd, name); err != syscall.ENOENT {
+		t.Errorf("want ENOENT, got %v", err)
+	}
+}
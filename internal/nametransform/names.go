@@ -6,6 +6,7 @@ import (
 	"crypto/aes"
 	"encoding/base64"
 	"path/filepath"
+	"sync"
 	"syscall"
 
 	"github.com/HorizonLiu/eme"
@@ -14,8 +15,15 @@ import (
 )
 
 const (
-	// Like ext4, we allow at most 255 bytes for a file name.
+	// Like ext4, we allow at most 255 bytes for a file name, unless the
+	// filesystem was created with "-name-max".
 	NameMax = 255
+	// NameMaxLimit is the highest "-name-max". The kernel does not pass
+	// longer names to FUSE filesystems (FUSE_NAME_MAX).
+	NameMaxLimit = 1024
+	// BadnameSuffix is appended to the names that "-badname" lets through
+	// although they cannot be decrypted
+	BadnameSuffix = " GOCRYPTFS_BAD_NAME"
 )
 
 // NameTransformer is an interface used to transform filenames.
@@ -37,11 +45,15 @@ type NameTransformer interface {
 type NameTransform struct {
 	emeCipher *eme.EMECipher
 	longNames bool
+	// nameMax is the longest plaintext name in bytes
+	nameMax int
 	// B64 = either base64.URLEncoding or base64.RawURLEncoding, depending
 	// on the Raw64 feature flag
 	B64 *base64.Encoding
+	// badnameLock protects badnamePatterns, which "-reload-file" can change
+	badnameLock sync.RWMutex
 	// Patterns to bypass decryption
-	BadnamePatterns []string
+	badnamePatterns []string
 }
 
 // New returns a new NameTransform instance.
@@ -53,16 +65,41 @@ func New(e *eme.EMECipher, longNames bool, raw64 bool) *NameTransform {
 	return &NameTransform{
 		emeCipher: e,
 		longNames: longNames,
+		nameMax:   NameMax,
 		B64:       b64,
 	}
 }
 
+// SetNameMax raises the plaintext name limit to "nameMax" bytes. Encrypted
+// names longer than NameMax are always stored in longname files, so this
+// only makes sense with longNames enabled.
+func (n *NameTransform) SetNameMax(nameMax int) {
+	n.nameMax = nameMax
+}
+
+// SetEMECipher replaces the filename cipher. This is used to drop and restore
+// the key when the filesystem is locked and unlocked.
+func (n *NameTransform) SetEMECipher(e *eme.EMECipher) {
+	n.emeCipher = e
+}
+
+// SetBadnamePatterns sets the "-badname" patterns. They must have been
+// validated with filepath.Match.
+func (n *NameTransform) SetBadnamePatterns(patterns []string) {
+	n.badnameLock.Lock()
+	n.badnamePatterns = patterns
+	n.badnameLock.Unlock()
+}
+
 // DecryptName calls decryptName to try and decrypt a base64-encoded encrypted
 // filename "cipherName", and failing that checks if it can be bypassed
 func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error) {
 	res, err := n.decryptName(cipherName, iv)
 	if err != nil {
-		for _, pattern := range n.BadnamePatterns {
+		n.badnameLock.RLock()
+		patterns := n.badnamePatterns
+		n.badnameLock.RUnlock()
+		for _, pattern := range patterns {
 			match, err := filepath.Match(pattern, cipherName)
 			if err == nil && match { // Pattern should have been validated already
 				// Find longest decryptable substring
@@ -71,10 +108,10 @@ func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error
 				for charpos := len(cipherName) - 1; charpos >= nameMin; charpos-- {
 					res, err = n.decryptName(cipherName[:charpos], iv)
 					if err == nil {
-						return res + cipherName[charpos:] + " GOCRYPTFS_BAD_NAME", nil
+						return res + cipherName[charpos:] + BadnameSuffix, nil
 					}
 				}
-				return cipherName + " GOCRYPTFS_BAD_NAME", nil
+				return cipherName + BadnameSuffix, nil
 			}
 		}
 	}
@@ -93,7 +130,7 @@ func (n *NameTransform) decryptName(cipherName string, iv []byte) (string, error
 		return "", syscall.EBADMSG
 	}
 	if len(bin)%aes.BlockSize != 0 {
-		tlog.Debug.Printf("DecryptName %q: decoded length %d is not a multiple of 16", cipherName, len(bin))
+		tlog.Debug.Printf("DecryptName %q: decoded length %d is not a multiple of 16", tlog.CipherName(cipherName), len(bin))
 		return "", syscall.EBADMSG
 	}
 	bin = n.emeCipher.Decrypt(iv, bin)
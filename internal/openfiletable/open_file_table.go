@@ -7,22 +7,21 @@ package openfiletable
 import (
 	"sync"
 	"sync/atomic"
+	"syscall"
 
 	"github.com/HorizonLiu/gocryptfs/internal/inomap"
 )
 
+// Table is the open file table of one mounted filesystem. Every mount has its
+// own table so that the idle detection of one mount does not see the files of
+// another mount in the same process.
+//
 // wlock - serializes write accesses to each file (identified by inode number)
 // Writing partial blocks means we have to do read-modify-write cycles. We
 // really don't want concurrent writes there.
 // Concurrent full-block writes could actually be allowed, but are not to
 // keep the locking simple.
-var t table
-
-func init() {
-	t.entries = make(map[inomap.QIno]*Entry)
-}
-
-type table struct {
+type Table struct {
 	// writeOpCount counts entry.ContentLock.Lock() calls. As every operation that
 	// modifies a file should
 	// call it, this effectively serves as a write-operation counter.
@@ -36,8 +35,16 @@ type table struct {
 	entries map[inomap.QIno]*Entry
 }
 
+// New returns an empty open file table
+func New() *Table {
+	return &Table{entries: make(map[inomap.QIno]*Entry)}
+}
+
 // Entry is an entry in the open file table
 type Entry struct {
+	// writeOps counts the ContentLock.Lock() calls on this entry, see
+	// WriteOps(). Accessed atomically, first element for 64-bit alignment.
+	writeOps uint64
 	// Reference count. Protected by the table lock.
 	refCount int
 	// ContentLock protects on-disk content from concurrent writes. Every writer
@@ -48,17 +55,29 @@ type Entry struct {
 	// IDLock must be taken before reading or writing the ID field in this struct,
 	// unless you have an exclusive lock on ContentLock.
 	IDLock sync.Mutex
+	// Pending is set while a file handle keeps written data in memory that
+	// is not on disk yet. Protected by ContentLock.
+	Pending PendingWriter
+}
+
+// PendingWriter is implemented by file handles that buffer writes.
+type PendingWriter interface {
+	// FlushPending writes the buffered data to disk and resets
+	// Entry.Pending. The caller must hold ContentLock exclusively.
+	FlushPending() syscall.Errno
 }
 
 // Register creates an open file table entry for "qi" (or incrementes the
 // reference count if the entry already exists) and returns the entry.
-func Register(qi inomap.QIno) *Entry {
+func (t *Table) Register(qi inomap.QIno) *Entry {
 	t.Lock()
 	defer t.Unlock()
 
 	e := t.entries[qi]
 	if e == nil {
 		e = &Entry{}
+		e.ContentLock.writeOpCount = &t.writeOpCount
+		e.ContentLock.entryOps = &e.writeOps
 		t.entries[qi] = e
 	}
 	e.refCount++
@@ -67,7 +86,7 @@ func Register(qi inomap.QIno) *Entry {
 
 // Unregister decrements the reference count for "qi" and deletes the entry from
 // the open file table if the reference count reaches 0.
-func Unregister(qi inomap.QIno) {
+func (t *Table) Unregister(qi inomap.QIno) {
 	t.Lock()
 	defer t.Unlock()
 
@@ -78,25 +97,53 @@ func Unregister(qi inomap.QIno) {
 	}
 }
 
-// countingMutex incrementes t.writeLockCount on each Lock() call.
+// Lookup returns the entry for "qi", or nil if the file is not open.
+func (t *Table) Lookup(qi inomap.QIno) *Entry {
+	t.Lock()
+	defer t.Unlock()
+	return t.entries[qi]
+}
+
+// Entries returns all entries in the table
+func (t *Table) Entries() []*Entry {
+	t.Lock()
+	defer t.Unlock()
+	out := make([]*Entry, 0, len(t.entries))
+	for _, e := range t.entries {
+		out = append(out, e)
+	}
+	return out
+}
+
+// countingMutex incrementes the writeOpCount of its table and the write op
+// counter of its entry on each Lock() call.
 type countingMutex struct {
 	sync.RWMutex
+	writeOpCount *uint64
+	entryOps     *uint64
 }
 
 func (c *countingMutex) Lock() {
 	c.RWMutex.Lock()
-	atomic.AddUint64(&t.writeOpCount, 1)
+	atomic.AddUint64(c.writeOpCount, 1)
+	atomic.AddUint64(c.entryOps, 1)
+}
+
+// WriteOps is like Table.WriteOpCount, but only counts the write locks on
+// this entry
+func (e *Entry) WriteOps() uint64 {
+	return atomic.LoadUint64(&e.writeOps)
 }
 
 // WriteOpCount returns the write lock counter value. This value is incremented
 // each time writeLock.Lock() on a file table entry is called.
-func WriteOpCount() uint64 {
+func (t *Table) WriteOpCount() uint64 {
 	return atomic.LoadUint64(&t.writeOpCount)
 }
 
 // CountOpenFiles returns how many entries are currently in the table
 // in a threadsafe manner.
-func CountOpenFiles() int {
+func (t *Table) CountOpenFiles() int {
 	t.Lock()
 	defer t.Unlock()
 	return len(t.entries)
@@ -0,0 +1,31 @@
+package openfiletable
+
+import (
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/inomap"
+)
+
+// TestTablesAreIndependent checks that the tables of two mounts do not see
+// each other's files and write operations
+func TestTablesAreIndependent(t *testing.T) {
+	t1 := New()
+	t2 := New()
+	qi := inomap.NewQIno(1, 0, 2)
+	e := t1.Register(qi)
+	e.ContentLock.Lock()
+	e.ContentLock.Unlock()
+	if t1.CountOpenFiles() != 1 || t2.CountOpenFiles() != 0 {
+		t.Errorf("wrong open file counts: %d %d", t1.CountOpenFiles(), t2.CountOpenFiles())
+	}
+	if t1.WriteOpCount() != 1 || t2.WriteOpCount() != 0 {
+		t.Errorf("wrong write op counts: %d %d", t1.WriteOpCount(), t2.WriteOpCount())
+	}
+	if t2.Register(qi) == e {
+		t.Error("tables share entries")
+	}
+	t1.Unregister(qi)
+	if t1.CountOpenFiles() != 0 {
+		t.Errorf("entry not removed")
+	}
+}
@@ -0,0 +1,76 @@
+// Package openpaths keeps track of the plaintext paths of open files so they
+// can be listed through the control socket ("-ctlsock").
+package openpaths
+
+import (
+	"sort"
+	"sync"
+)
+
+// Registry maps open file handles to their paths. The zero value is ready to
+// use.
+type Registry struct {
+	sync.Mutex
+	// paths maps the file handle to a function returning its current path.
+	// A function is used because files can be renamed while they are open.
+	paths map[interface{}]func() string
+}
+
+// Register adds the file handle "fh". "path" is called when the list of
+// open files is requested.
+func (r *Registry) Register(fh interface{}, path func() string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.paths == nil {
+		r.paths = make(map[interface{}]func() string)
+	}
+	r.paths[fh] = path
+}
+
+// Unregister removes the file handle "fh". Unknown handles are ignored.
+func (r *Registry) Unregister(fh interface{}) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.paths, fh)
+}
+
+// Path returns the current path of "fh", or "" if it is not registered
+func (r *Registry) Path(fh interface{}) string {
+	r.Lock()
+	fn := r.paths[fh]
+	r.Unlock()
+	if fn == nil {
+		return ""
+	}
+	return fn()
+}
+
+// Handles returns all registered file handles in no particular order
+func (r *Registry) Handles() []interface{} {
+	r.Lock()
+	defer r.Unlock()
+	out := make([]interface{}, 0, len(r.paths))
+	for fh := range r.paths {
+		out = append(out, fh)
+	}
+	return out
+}
+
+// List returns the sorted paths of all open files. A file that is open
+// multiple times shows up multiple times.
+func (r *Registry) List() []string {
+	r.Lock()
+	fns := make([]func() string, 0, len(r.paths))
+	for _, fn := range r.paths {
+		fns = append(fns, fn)
+	}
+	r.Unlock()
+	// Call the path functions without holding the lock, they may take
+	// filesystem locks themselves.
+	out := make([]string, 0, len(fns))
+	for _, fn := range fns {
+		out = append(out, fn())
+	}
+	sort.Strings(out)
+	return out
+}
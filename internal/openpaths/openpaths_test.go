@@ -0,0 +1,37 @@
+package openpaths
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	var r Registry
+	if l := r.List(); len(l) != 0 {
+		t.Errorf("empty registry returned %v", l)
+	}
+	a, b, c := new(int), new(int), new(int)
+	name := "b"
+	r.Register(a, func() string { return "z" })
+	r.Register(b, func() string { return name })
+	r.Register(c, func() string { return "z" })
+	// Renames show up
+	name = "y"
+	if l := r.List(); !reflect.DeepEqual(l, []string{"y", "z", "z"}) {
+		t.Errorf("wrong list %v", l)
+	}
+	if p := r.Path(b); p != "y" {
+		t.Errorf("Path: want y, got %q", p)
+	}
+	r.Unregister(a)
+	r.Unregister(a)
+	if p := r.Path(a); p != "" {
+		t.Errorf("Path of unregistered handle: %q", p)
+	}
+	if h := r.Handles(); len(h) != 2 {
+		t.Errorf("want 2 handles, have %v", h)
+	}
+	if l := r.List(); !reflect.DeepEqual(l, []string{"y", "z"}) {
+		t.Errorf("wrong list %v", l)
+	}
+}
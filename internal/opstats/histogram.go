@@ -0,0 +1,86 @@
+package opstats
+
+import (
+	"math/bits"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/ctlsock"
+)
+
+// Latencies are counted in log-linear buckets, like in an HDR histogram:
+// below histSubBuckets microseconds, every microsecond has its own bucket.
+// Above, every power of two is split into histSubBuckets buckets of the same
+// width, so a bucket is at most 1/histSubBuckets wider than its lower bound.
+const (
+	histSubBits    = 2
+	histSubBuckets = 1 << histSubBits
+	// histBuckets reaches 2^27 microseconds (about two minutes). Slower
+	// operations are counted in the last bucket.
+	histBuckets = histSubBuckets + (27-histSubBits)*histSubBuckets
+)
+
+type histogram [histBuckets]uint64
+
+// histIndex returns the bucket for "dt"
+func histIndex(dt time.Duration) int {
+	us := uint64(dt / time.Microsecond)
+	if us < histSubBuckets {
+		return int(us)
+	}
+	shift := bits.Len64(us) - histSubBits - 1
+	i := histSubBuckets + shift*histSubBuckets + int(us>>uint(shift)) - histSubBuckets
+	if i >= histBuckets {
+		return histBuckets - 1
+	}
+	return i
+}
+
+// histUpper returns the exclusive upper bound of bucket "i"
+func histUpper(i int) time.Duration {
+	if i < histSubBuckets {
+		return time.Duration(i+1) * time.Microsecond
+	}
+	shift := uint((i - histSubBuckets) / histSubBuckets)
+	sub := uint64((i - histSubBuckets) % histSubBuckets)
+	return time.Duration((histSubBuckets+sub+1)<<shift) * time.Microsecond
+}
+
+func (h *histogram) add(dt time.Duration) {
+	h[histIndex(dt)]++
+}
+
+// export converts "h" to the control socket format. Percentiles are the upper
+// bound of the bucket they fall into, but not more than "max".
+func (h *histogram) export(count uint64, max time.Duration) ctlsock.LatencyHistogram {
+	out := ctlsock.LatencyHistogram{
+		Count: count,
+		MaxNs: uint64(max),
+	}
+	percentiles := []struct {
+		q   float64
+		dst *uint64
+	}{
+		{0.5, &out.P50Ns},
+		{0.9, &out.P90Ns},
+		{0.99, &out.P99Ns},
+		{0.999, &out.P999Ns},
+	}
+	var seen uint64
+	for i, n := range h {
+		if n == 0 {
+			continue
+		}
+		seen += n
+		upper := histUpper(i)
+		out.Buckets = append(out.Buckets, ctlsock.LatencyBucket{UpperNs: uint64(upper), Count: n})
+		if upper > max {
+			upper = max
+		}
+		for _, p := range percentiles {
+			if *p.dst == 0 && float64(seen) >= p.q*float64(count) {
+				*p.dst = uint64(upper)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,73 @@
+// Package opstats collects per-operation counters and latency histograms of
+// the FUSE server. They are reported through the control socket ("-ctlsock").
+package opstats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/ctlsock"
+)
+
+type opStat struct {
+	count uint64
+	total time.Duration
+	max   time.Duration
+	hist  histogram
+}
+
+// Stats implements the fuse.LatencyMap interface and can be passed to
+// fuse.Server.RecordLatencies().
+type Stats struct {
+	sync.Mutex
+	ops map[string]*opStat
+}
+
+// New returns an empty Stats object
+func New() *Stats {
+	return &Stats{ops: make(map[string]*opStat)}
+}
+
+// Add records one operation called "name" that took "dt".
+func (s *Stats) Add(name string, dt time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	o := s.ops[name]
+	if o == nil {
+		o = &opStat{}
+		s.ops[name] = o
+	}
+	o.count++
+	o.total += dt
+	if dt > o.max {
+		o.max = dt
+	}
+	o.hist.add(dt)
+}
+
+// Snapshot returns a copy of the current counters, indexed by operation name.
+func (s *Stats) Snapshot() map[string]ctlsock.OpStats {
+	s.Lock()
+	defer s.Unlock()
+	out := make(map[string]ctlsock.OpStats, len(s.ops))
+	for name, o := range s.ops {
+		out[name] = ctlsock.OpStats{
+			Count:   o.count,
+			TotalNs: uint64(o.total),
+			MaxNs:   uint64(o.max),
+		}
+	}
+	return out
+}
+
+// Latency returns the latency distribution of each operation, indexed by
+// operation name.
+func (s *Stats) Latency() map[string]ctlsock.LatencyHistogram {
+	s.Lock()
+	defer s.Unlock()
+	out := make(map[string]ctlsock.LatencyHistogram, len(s.ops))
+	for name, o := range s.ops {
+		out[name] = o.hist.export(o.count, o.max)
+	}
+	return out
+}
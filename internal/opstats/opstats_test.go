@@ -0,0 +1,65 @@
+package opstats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	s := New()
+	s.Add("READ", 2*time.Millisecond)
+	s.Add("READ", 4*time.Millisecond)
+	s.Add("WRITE", time.Millisecond)
+	snap := s.Snapshot()
+	if len(snap) != 2 {
+		t.Fatalf("want 2 entries, have %d", len(snap))
+	}
+	r := snap["READ"]
+	if r.Count != 2 || r.TotalNs != uint64(6*time.Millisecond) || r.MaxNs != uint64(4*time.Millisecond) {
+		t.Errorf("wrong READ stats: %+v", r)
+	}
+	// The snapshot must not change afterwards
+	s.Add("READ", time.Second)
+	if snap["READ"].Count != 2 {
+		t.Error("snapshot was modified")
+	}
+}
+
+func TestHistIndex(t *testing.T) {
+	// Every latency must fall into the bucket whose upper bound is above it,
+	// and not into a faster bucket
+	for _, dt := range []time.Duration{0, time.Microsecond, 3 * time.Microsecond,
+		4 * time.Microsecond, 9 * time.Microsecond, 1234 * time.Microsecond,
+		time.Second, time.Minute} {
+		i := histIndex(dt)
+		if dt >= histUpper(i) {
+			t.Errorf("%v: above upper bound %v of bucket %d", dt, histUpper(i), i)
+		}
+		if i > 0 && dt < histUpper(i-1) {
+			t.Errorf("%v: below upper bound %v of bucket %d", dt, histUpper(i-1), i-1)
+		}
+	}
+	if i := histIndex(time.Hour); i != histBuckets-1 {
+		t.Errorf("overflow went into bucket %d", i)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	s := New()
+	for i := 0; i < 99; i++ {
+		s.Add("READ", 100*time.Microsecond)
+	}
+	s.Add("READ", time.Second)
+	h := s.Latency()["READ"]
+	if h.Count != 100 || h.MaxNs != uint64(time.Second) || len(h.Buckets) != 2 {
+		t.Fatalf("wrong histogram: %+v", h)
+	}
+	// 100µs is in the bucket that ends at 112µs
+	if h.P50Ns != uint64(112*time.Microsecond) || h.P99Ns != h.P50Ns {
+		t.Errorf("wrong P50/P99: %+v", h)
+	}
+	// Not more than the maximum
+	if h.P999Ns != uint64(time.Second) {
+		t.Errorf("wrong P99.9: %+v", h)
+	}
+}
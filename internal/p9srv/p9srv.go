@@ -0,0 +1,899 @@
+//go:build go1.16
+// +build go1.16
+
+// Package p9srv serves the decrypted view of a CIPHERDIR over the 9P2000.L
+// protocol ("-serve-9p"), so that virtual machines can mount it with the
+// Linux v9fs client, without FUSE.
+//
+// It is built on the cryptfile package, which can only write whole files.
+// So files can be created, or truncated and rewritten, with sequential
+// writes, but not modified in place. Symlinks are not shown.
+package p9srv
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Server serves a CIPHERDIR to any number of connections
+type Server struct {
+	keys      *cryptfile.Keys
+	cipherdir string
+	fsys      fs.FS
+	readOnly  bool
+}
+
+// New returns a Server for "cipherdir" using "keys". With "readOnly", all
+// modifications are rejected.
+func New(keys *cryptfile.Keys, cipherdir string, readOnly bool) *Server {
+	return &Server{
+		keys:      keys,
+		cipherdir: cipherdir,
+		fsys:      keys.NewFS(cipherdir),
+		readOnly:  readOnly,
+	}
+}
+
+// maxMsize is the largest message size we agree to. The Linux client asks
+// for 512 KiB by default.
+const maxMsize = 512 * 1024
+
+// linuxErrno is an error that is sent to the client as-is
+type linuxErrno uint32
+
+func (e linuxErrno) Error() string {
+	return "errno " + strconv.Itoa(int(e))
+}
+
+var (
+	errBadFid      = linuxErrno(ebadf)
+	errUnsupported = linuxErrno(eopnotsupp)
+	errReadOnly    = linuxErrno(erofs)
+	errInvalid     = linuxErrno(einval)
+)
+
+// errnoMap translates errors to the Linux errno values. The order matters,
+// as a syscall.Errno also matches the fs.Err* values.
+var errnoMap = []struct {
+	err  error
+	code uint32
+}{
+	{syscall.ENOENT, enoent},
+	{syscall.EEXIST, eexist},
+	{syscall.ENOTEMPTY, enotempty},
+	{syscall.ENOTDIR, enotdir},
+	{syscall.EISDIR, eisdir},
+	{syscall.EACCES, eacces},
+	{syscall.EPERM, eperm},
+	{syscall.EINVAL, einval},
+	{syscall.ENOSPC, enospc},
+	{syscall.EROFS, erofs},
+	{syscall.ENAMETOOLONG, enametoolong},
+	{fs.ErrNotExist, enoent},
+	{fs.ErrExist, eexist},
+	{fs.ErrPermission, eacces},
+	{fs.ErrInvalid, einval},
+}
+
+// errno returns the Linux errno for "err"
+func errno(err error) uint32 {
+	var le linuxErrno
+	if errors.As(err, &le) {
+		return uint32(le)
+	}
+	for _, m := range errnoMap {
+		if errors.Is(err, m.err) {
+			return m.code
+		}
+	}
+	return eio
+}
+
+// session is the state of one connection
+type session struct {
+	s     *Server
+	msize uint32
+	fids  map[uint32]*fid
+	// writers are the files that are being written, by plaintext path
+	writers map[string]*writer
+}
+
+// fid is a file or directory the client refers to by number
+type fid struct {
+	// name is the plaintext path, "." for the root
+	name string
+	// opened is set by Tlopen and Tlcreate
+	opened bool
+	// file is set for files opened for reading
+	file fs.File
+	// writable is set for files opened for writing
+	writable bool
+	// w is the writer once the first write has arrived
+	w *writer
+	// dir are the entries of an open directory
+	dir []dirent
+}
+
+type dirent struct {
+	name string
+	fi   fs.FileInfo
+}
+
+// writer streams the data of sequential writes through a pipe to
+// cryptfile.ReplaceFile(), which runs in its own goroutine. The new content
+// shows up when the fid is clunked.
+type writer struct {
+	pw *io.PipeWriter
+	// off is where the next write must start
+	off uint64
+	// done gets the result of ReplaceFile()
+	done chan error
+}
+
+// ServeConn handles the requests on "conn" one after another until it is
+// closed, and closes it. It can be called concurrently for multiple
+// connections.
+func (s *Server) ServeConn(conn io.ReadWriteCloser) error {
+	ss := &session{s: s, msize: maxMsize}
+	ss.reset()
+	defer func() {
+		ss.reset()
+		conn.Close()
+	}()
+	for {
+		msg, err := readMessage(conn, ss.msize)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := conn.Write(ss.handle(msg)); err != nil {
+			return err
+		}
+	}
+}
+
+// readMessage reads one message of at most "msize" bytes
+func readMessage(r io.Reader, msize uint32) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := (&decoder{b: size[:]}).uint32()
+	if n < hdrSize || n > msize {
+		return nil, errors.New("invalid message size")
+	}
+	msg := make([]byte, n)
+	copy(msg, size[:])
+	if _, err := io.ReadFull(r, msg[4:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// reset clunks all fids. Unfinished writes are discarded.
+func (ss *session) reset() {
+	for _, f := range ss.fids {
+		if f.w != nil {
+			f.w.pw.CloseWithError(errors.New("session ended"))
+		}
+		ss.clunk(f)
+	}
+	ss.fids = make(map[uint32]*fid)
+	ss.writers = make(map[string]*writer)
+}
+
+// handle handles the message "msg" and returns the response
+func (ss *session) handle(msg []byte) []byte {
+	d := &decoder{b: msg[4:]}
+	typ, tag := d.uint8(), d.uint16()
+	resp, err := ss.handleRequest(typ, tag, d)
+	if err == nil && d.err != nil {
+		err = errInvalid
+	}
+	if err != nil {
+		tlog.Debug.Printf("9p: request type %d: %v", typ, err)
+		return newEncoder(rlerror, tag).uint32(errno(err)).finish()
+	}
+	if resp == nil {
+		// Empty response
+		resp = newEncoder(typ+1, tag)
+	}
+	return resp.finish()
+}
+
+// fid returns the fid "n"
+func (ss *session) fid(n uint32) (*fid, error) {
+	f, ok := ss.fids[n]
+	if !ok {
+		return nil, errBadFid
+	}
+	return f, nil
+}
+
+func (ss *session) handleRequest(typ uint8, tag uint16, d *decoder) (*encoder, error) {
+	s := ss.s
+	r := newEncoder(typ+1, tag)
+	switch typ {
+	case tversion:
+		msize, version := d.uint32(), d.string()
+		if msize <= ioHdrSize {
+			return nil, errInvalid
+		}
+		ss.msize = maxMsize
+		if msize < ss.msize {
+			ss.msize = msize
+		}
+		ss.reset()
+		if !strings.HasPrefix(version, "9P2000.L") {
+			version = "unknown"
+		} else {
+			version = "9P2000.L"
+		}
+		return r.uint32(ss.msize).string(version), nil
+	case tattach:
+		n, _, _, _ := d.uint32(), d.uint32(), d.string(), d.string()
+		if d.err != nil {
+			break
+		}
+		if _, ok := ss.fids[n]; ok {
+			return nil, errBadFid
+		}
+		fi, err := fs.Stat(s.fsys, ".")
+		if err != nil {
+			return nil, err
+		}
+		ss.fids[n] = &fid{name: "."}
+		return r.qid(qidOf(fi)), nil
+	case tflush:
+		// Requests are handled in order, so the old one has already been
+		// answered
+		return nil, nil
+	case twalk:
+		return ss.walk(r, d)
+	case tgetattr:
+		f, err := ss.fid(d.uint32())
+		if err != nil {
+			return nil, err
+		}
+		return ss.getattr(r, f)
+	case tsetattr:
+		n, valid, mode, _, _ := d.uint32(), d.uint32(), d.uint32(), d.uint32(), d.uint32()
+		size, atime, mtime := d.uint64(), timespec(d), timespec(d)
+		if d.err != nil {
+			break
+		}
+		f, err := ss.fid(n)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ss.setattr(f, valid, mode, size, atime, mtime)
+	case tstatfs:
+		if _, err := ss.fid(d.uint32()); err != nil {
+			return nil, err
+		}
+		return s.statfs(r)
+	case tlopen:
+		n, flags := d.uint32(), d.uint32()
+		f, err := ss.fid(n)
+		if err != nil {
+			return nil, err
+		}
+		return ss.lopen(r, f, flags)
+	case tlcreate:
+		n, name, flags, mode, _ := d.uint32(), d.string(), d.uint32(), d.uint32(), d.uint32()
+		if d.err != nil {
+			break
+		}
+		f, err := ss.fid(n)
+		if err != nil {
+			return nil, err
+		}
+		return ss.lcreate(r, f, name, flags, mode)
+	case tread:
+		n, off, count := d.uint32(), d.uint64(), d.uint32()
+		f, err := ss.fid(n)
+		if err != nil {
+			return nil, err
+		}
+		return ss.read(r, f, off, count)
+	case twrite:
+		n, off, data := d.uint32(), d.uint64(), d.data()
+		if d.err != nil {
+			break
+		}
+		f, err := ss.fid(n)
+		if err != nil {
+			return nil, err
+		}
+		if err := ss.write(f, off, data); err != nil {
+			return nil, err
+		}
+		return r.uint32(uint32(len(data))), nil
+	case treaddir:
+		n, off, count := d.uint32(), d.uint64(), d.uint32()
+		f, err := ss.fid(n)
+		if err != nil {
+			return nil, err
+		}
+		return ss.readdir(r, f, off, count)
+	case tfsync:
+		// Data is only written on clunk
+		_, err := ss.fid(d.uint32())
+		return nil, err
+	case tclunk, tremove:
+		n := d.uint32()
+		f, err := ss.fid(n)
+		if err != nil {
+			return nil, err
+		}
+		delete(ss.fids, n)
+		err = ss.clunk(f)
+		if typ == tremove && err == nil {
+			err = s.remove(f.name, nil)
+		}
+		return nil, err
+	case tmkdir:
+		n, name, mode, _ := d.uint32(), d.string(), d.uint32(), d.uint32()
+		if d.err != nil {
+			break
+		}
+		dir, err := ss.fid(n)
+		if err != nil {
+			return nil, err
+		}
+		return s.mkdir(r, dir.name, name, mode)
+	case trename:
+		n, dn, name := d.uint32(), d.uint32(), d.string()
+		if d.err != nil {
+			break
+		}
+		f, err := ss.fid(n)
+		if err != nil {
+			return nil, err
+		}
+		dir, err := ss.fid(dn)
+		if err != nil {
+			return nil, err
+		}
+		newName, err := child(dir.name, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.rename(f.name, newName); err != nil {
+			return nil, err
+		}
+		f.name = newName
+		return nil, nil
+	case trenameat:
+		on, oldName, nn, newName := d.uint32(), d.string(), d.uint32(), d.string()
+		if d.err != nil {
+			break
+		}
+		oldDir, err := ss.fid(on)
+		if err != nil {
+			return nil, err
+		}
+		newDir, err := ss.fid(nn)
+		if err != nil {
+			return nil, err
+		}
+		oldPath, err := child(oldDir.name, oldName)
+		if err != nil {
+			return nil, err
+		}
+		newPath, err := child(newDir.name, newName)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.rename(oldPath, newPath)
+	case tunlinkat:
+		n, name, flags := d.uint32(), d.string(), d.uint32()
+		if d.err != nil {
+			break
+		}
+		dir, err := ss.fid(n)
+		if err != nil {
+			return nil, err
+		}
+		p, err := child(dir.name, name)
+		if err != nil {
+			return nil, err
+		}
+		isDir := flags&atRemoveDir != 0
+		return nil, s.remove(p, &isDir)
+	case tlock:
+		// Locks are not enforced. Every fid of a session belongs to the
+		// same client, and its kernel takes care of local locking.
+		_, err := ss.fid(d.uint32())
+		if err != nil {
+			return nil, err
+		}
+		return r.uint8(0), nil
+	case tgetlock:
+		n, _, start, length, procID, clientID := d.uint32(), d.uint8(), d.uint64(), d.uint64(), d.uint32(), d.string()
+		if d.err != nil {
+			break
+		}
+		if _, err := ss.fid(n); err != nil {
+			return nil, err
+		}
+		return r.uint8(fUnlck).uint64(start).uint64(length).uint32(procID).string(clientID), nil
+	case treadlink:
+		// Symlinks are not shown, so nothing can be a symlink
+		return nil, errInvalid
+	default:
+		// Tauth, Tsymlink, Tmknod, Tlink, Txattrwalk, Txattrcreate and
+		// unknown requests
+		return nil, errUnsupported
+	}
+	// Incomplete request
+	return nil, errInvalid
+}
+
+// child returns the plaintext path of "name" in the directory "dir"
+func child(dir string, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", errInvalid
+	}
+	return path.Join(dir, name), nil
+}
+
+// timespec reads the sec[8] nsec[8] fields of Tsetattr
+func timespec(d *decoder) time.Time {
+	sec, nsec := d.uint64(), d.uint64()
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+// qidOf returns the qid of "fi". The path is the inode number of the
+// ciphertext file.
+func qidOf(fi fs.FileInfo) qid {
+	q := qid{typ: qtFile}
+	if fi.IsDir() {
+		q.typ = qtDir
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		q.path = uint64(st.Ino)
+	}
+	return q
+}
+
+func (ss *session) walk(r *encoder, d *decoder) (*encoder, error) {
+	n, newN, count := d.uint32(), d.uint32(), d.uint16()
+	var names []string
+	for i := uint16(0); i < count && d.err == nil; i++ {
+		names = append(names, d.string())
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	f, err := ss.fid(n)
+	if err != nil {
+		return nil, err
+	}
+	if f.opened {
+		return nil, errBadFid
+	}
+	if _, ok := ss.fids[newN]; ok && newN != n {
+		return nil, errBadFid
+	}
+	name := f.name
+	var qids []qid
+	for i, elem := range names {
+		var next string
+		if elem == ".." {
+			// ".." of the root is the root
+			next = path.Dir(name)
+		} else if next, err = child(name, elem); err != nil {
+			return nil, err
+		}
+		fi, err := fs.Stat(ss.s.fsys, next)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			break
+		}
+		qids = append(qids, qidOf(fi))
+		name = next
+	}
+	if len(qids) == len(names) {
+		ss.fids[newN] = &fid{name: name}
+	}
+	r.uint16(uint16(len(qids)))
+	for _, q := range qids {
+		r.qid(q)
+	}
+	return r, nil
+}
+
+// unixMode converts "m" to st_mode
+func unixMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m.IsDir() {
+		mode |= syscall.S_IFDIR
+	} else if m.IsRegular() {
+		mode |= syscall.S_IFREG
+	}
+	if m&fs.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+func (ss *session) getattr(r *encoder, f *fid) (*encoder, error) {
+	fi, err := fs.Stat(ss.s.fsys, f.name)
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(fi.Size())
+	if w := ss.writers[f.name]; w != nil {
+		size = w.off
+	}
+	var uid, gid uint32
+	nlink := uint64(1)
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		uid, gid, nlink = st.Uid, st.Gid, uint64(st.Nlink)
+	}
+	sec, nsec := uint64(fi.ModTime().Unix()), uint64(fi.ModTime().Nanosecond())
+	r.uint64(getattrBasic).qid(qidOf(fi)).uint32(unixMode(fi.Mode())).uint32(uid).uint32(gid)
+	r.uint64(nlink).uint64(0).uint64(size).uint64(4096).uint64((size + 511) / 512)
+	// atime, mtime and ctime are all reported as the mtime, btime as zero
+	for i := 0; i < 3; i++ {
+		r.uint64(sec).uint64(nsec)
+	}
+	// btime, gen and data_version
+	return r.uint64(0).uint64(0).uint64(0).uint64(0), nil
+}
+
+// setattr applies the permissions and times to "f". Sizes are only accepted
+// if they do not change anything, or truncate the file to zero, and
+// ownership cannot be changed.
+func (ss *session) setattr(f *fid, valid uint32, mode uint32, size uint64, atime time.Time, mtime time.Time) error {
+	s := ss.s
+	// A ctime change alone needs no action
+	if valid&^setattrCtime == 0 {
+		return nil
+	}
+	if s.readOnly {
+		return errReadOnly
+	}
+	if valid&(setattrUID|setattrGID) != 0 {
+		return linuxErrno(eperm)
+	}
+	if valid&setattrSize != 0 {
+		if err := ss.truncate(f.name, size); err != nil {
+			return err
+		}
+	}
+	if valid&setattrMode != 0 {
+		if err := s.keys.Chmod(s.cipherdir, f.name, os.FileMode(mode&0777)); err != nil {
+			return err
+		}
+	}
+	if valid&(setattrAtime|setattrMtime) != 0 {
+		now := time.Now()
+		if valid&setattrAtimeSet == 0 {
+			atime = now
+		}
+		if valid&setattrMtimeSet == 0 {
+			mtime = now
+		}
+		fi, err := fs.Stat(s.fsys, f.name)
+		if err != nil {
+			return err
+		}
+		// Only one of them may be passed
+		if valid&setattrAtime == 0 {
+			atime = fi.ModTime()
+		}
+		if valid&setattrMtime == 0 {
+			mtime = fi.ModTime()
+		}
+		if err := s.keys.Chtimes(s.cipherdir, f.name, atime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncate handles a size change of "name". The Linux client opens files
+// without O_TRUNC and truncates them afterwards, so truncating to zero has
+// to work.
+func (ss *session) truncate(name string, size uint64) error {
+	s := ss.s
+	if w := ss.writers[name]; w != nil {
+		if size == w.off || size == 0 && w.off == 0 {
+			return nil
+		}
+		return errUnsupported
+	}
+	fi, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return linuxErrno(eisdir)
+	}
+	switch {
+	case uint64(fi.Size()) == size:
+		return nil
+	case size == 0:
+		return s.keys.ReplaceFile(s.cipherdir, name, strings.NewReader(""), fi.Mode().Perm())
+	}
+	return errUnsupported
+}
+
+func (s *Server) statfs(r *encoder) (*encoder, error) {
+	var st syscall.Statfs_t
+	if cryptfile.StorageScheme(s.cipherdir) != "" {
+		// Remote storage has no usage numbers, report an empty filesystem
+		return r.uint32(v9fsMagic).uint32(4096).uint64(0).uint64(0).uint64(0).
+			uint64(0).uint64(0).uint64(0).uint32(255), nil
+	}
+	if err := syscall.Statfs(s.cipherdir, &st); err != nil {
+		return nil, err
+	}
+	return r.uint32(v9fsMagic).uint32(uint32(st.Bsize)).uint64(uint64(st.Blocks)).
+		uint64(uint64(st.Bfree)).uint64(uint64(st.Bavail)).uint64(uint64(st.Files)).
+		uint64(uint64(st.Ffree)).uint64(0).uint32(255), nil
+}
+
+// iounit is the most data a Tread or Twrite can carry
+func (ss *session) iounit() uint32 {
+	return ss.msize - ioHdrSize
+}
+
+func (ss *session) lopen(r *encoder, f *fid, flags uint32) (*encoder, error) {
+	s := ss.s
+	if f.opened {
+		return nil, errBadFid
+	}
+	fi, err := fs.Stat(s.fsys, f.name)
+	if err != nil {
+		return nil, err
+	}
+	acc := flags & oAccMode
+	if fi.IsDir() {
+		if acc != oRdonly {
+			return nil, linuxErrno(eisdir)
+		}
+		if f.dir, err = s.readDir(f.name, fi); err != nil {
+			return nil, err
+		}
+	} else {
+		if acc != oRdonly && s.readOnly {
+			return nil, errReadOnly
+		}
+		if acc != oWronly {
+			if f.file, err = s.fsys.Open(f.name); err != nil {
+				return nil, err
+			}
+		}
+		f.writable = acc == oWronly || acc == oRdwr
+	}
+	f.opened = true
+	return r.qid(qidOf(fi)).uint32(ss.iounit()), nil
+}
+
+// readDir returns the entries of the directory "name" with info "fi",
+// including "." and "..". Symlinks are left out, as they cannot be opened
+// through cryptfile.
+func (s *Server) readDir(name string, fi fs.FileInfo) ([]dirent, error) {
+	parent, err := fs.Stat(s.fsys, path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	dir := []dirent{{".", fi}, {"..", parent}}
+	for _, e := range entries {
+		if !e.IsDir() && !e.Type().IsRegular() {
+			continue
+		}
+		efi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		dir = append(dir, dirent{e.Name(), efi})
+	}
+	return dir, nil
+}
+
+func (ss *session) lcreate(r *encoder, dir *fid, name string, flags uint32, mode uint32) (*encoder, error) {
+	s := ss.s
+	if dir.opened {
+		return nil, errBadFid
+	}
+	if s.readOnly {
+		return nil, errReadOnly
+	}
+	p, err := child(dir.name, name)
+	if err != nil {
+		return nil, err
+	}
+	// Create the file right away, the client looks it up before writing
+	if err := s.keys.WriteFile(s.cipherdir, p, strings.NewReader(""), os.FileMode(mode&0777)); err != nil {
+		return nil, err
+	}
+	fi, err := fs.Stat(s.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	// The fid now refers to the new file
+	dir.name = p
+	dir.opened = true
+	dir.writable = true
+	if flags&oAccMode == oRdwr {
+		if dir.file, err = s.fsys.Open(p); err != nil {
+			return nil, err
+		}
+	}
+	return r.qid(qidOf(fi)).uint32(ss.iounit()), nil
+}
+
+func (ss *session) read(r *encoder, f *fid, off uint64, count uint32) (*encoder, error) {
+	if f.file == nil {
+		return nil, errBadFid
+	}
+	if max := ss.iounit(); count > max {
+		count = max
+	}
+	ra, ok := f.file.(io.ReaderAt)
+	if !ok {
+		return nil, errUnsupported
+	}
+	buf := make([]byte, count)
+	n, err := ra.ReadAt(buf, int64(off))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return r.data(buf[:n]), nil
+}
+
+// write appends "data" to the new content of "f". The first write must
+// start at offset zero of an empty file, and all others where the previous
+// one ended.
+func (ss *session) write(f *fid, off uint64, data []byte) error {
+	s := ss.s
+	if !f.writable {
+		return errBadFid
+	}
+	if f.w == nil {
+		if ss.writers[f.name] != nil {
+			// Another fid is already writing this file
+			return errUnsupported
+		}
+		fi, err := fs.Stat(s.fsys, f.name)
+		if err != nil {
+			return err
+		}
+		if off != 0 || fi.Size() != 0 {
+			return errUnsupported
+		}
+		pr, pw := io.Pipe()
+		w := &writer{pw: pw, done: make(chan error, 1)}
+		name := f.name
+		perm := fi.Mode().Perm()
+		go func() {
+			err := s.keys.ReplaceFile(s.cipherdir, name, pr, perm)
+			// Unblock writes if ReplaceFile failed early
+			pr.CloseWithError(err)
+			w.done <- err
+		}()
+		f.w = w
+		ss.writers[f.name] = w
+	}
+	if off != f.w.off {
+		return errUnsupported
+	}
+	if _, err := f.w.pw.Write(data); err != nil {
+		return err
+	}
+	f.w.off += uint64(len(data))
+	return nil
+}
+
+// clunk closes "f" and finishes its write
+func (ss *session) clunk(f *fid) error {
+	if f.file != nil {
+		f.file.Close()
+	}
+	if f.w == nil {
+		return nil
+	}
+	delete(ss.writers, f.name)
+	f.w.pw.Close()
+	return <-f.w.done
+}
+
+// direntSize is the size of an Rreaddir entry without the name:
+// qid[13] offset[8] type[1] name_len[2]
+const direntSize = qidSize + 8 + 1 + 2
+
+func (ss *session) readdir(r *encoder, f *fid, off uint64, count uint32) (*encoder, error) {
+	if f.dir == nil {
+		return nil, errBadFid
+	}
+	if max := ss.iounit(); count > max {
+		count = max
+	}
+	// The offset of an entry is the index of the next one
+	entries := &encoder{}
+	for i := off; i < uint64(len(f.dir)); i++ {
+		de := f.dir[i]
+		if uint32(len(entries.b)+direntSize+len(de.name)) > count {
+			break
+		}
+		typ := uint8(dtReg)
+		if de.fi.IsDir() {
+			typ = dtDir
+		}
+		entries.qid(qidOf(de.fi)).uint64(i + 1).uint8(typ).string(de.name)
+	}
+	return r.data(entries.b), nil
+}
+
+func (s *Server) mkdir(r *encoder, dir string, name string, mode uint32) (*encoder, error) {
+	if s.readOnly {
+		return nil, errReadOnly
+	}
+	p, err := child(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.keys.Mkdir(s.cipherdir, p, os.FileMode(mode&0777)); err != nil {
+		return nil, err
+	}
+	fi, err := fs.Stat(s.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	return r.qid(qidOf(fi)), nil
+}
+
+// remove deletes "name". If "isDir" is not nil, it must match the type.
+func (s *Server) remove(name string, isDir *bool) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	if name == "." {
+		return linuxErrno(ebusy)
+	}
+	fi, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		return err
+	}
+	if isDir != nil && fi.IsDir() != *isDir {
+		if *isDir {
+			return linuxErrno(enotdir)
+		}
+		return linuxErrno(eisdir)
+	}
+	return s.keys.Remove(s.cipherdir, name)
+}
+
+func (s *Server) rename(oldName string, newName string) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	return s.keys.Rename(s.cipherdir, oldName, newName)
+}
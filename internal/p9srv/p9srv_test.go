@@ -0,0 +1,220 @@
+//go:build go1.16
+// +build go1.16
+
+package p9srv
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// client talks to a Server over a net.Pipe
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	tag  uint16
+}
+
+// newTestClient creates a CIPHERDIR, starts a Server for it and returns a
+// client that has attached the root as fid 0
+func newTestClient(t *testing.T, readOnly bool) (*client, func()) {
+	dir, err := ioutil.TempDir("", "p9srv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := dir + "/gocryptfs.conf"
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(int(d.Fd()))
+	d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := cryptfile.Open(conf, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvConn, cliConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		New(k, dir, readOnly).ServeConn(srvConn)
+		close(done)
+	}()
+	c := &client{t: t, conn: cliConn}
+	d2 := c.ok(newEncoder(tversion, noTag).uint32(8192).string("9P2000.L"))
+	if msize, version := d2.uint32(), d2.string(); msize != 8192 || version != "9P2000.L" {
+		t.Fatalf("Rversion: msize %d, version %q", msize, version)
+	}
+	c.ok(c.request(tattach).uint32(0).uint32(^uint32(0)).string("user").string("").uint32(0))
+	return c, func() {
+		cliConn.Close()
+		<-done
+		k.Wipe()
+		os.RemoveAll(dir)
+	}
+}
+
+// request starts a request of type "typ" with a new tag
+func (c *client) request(typ uint8) *encoder {
+	c.tag++
+	return newEncoder(typ, c.tag)
+}
+
+// send sends a request and returns the type of the response and a decoder
+// positioned after the tag
+func (c *client) send(e *encoder) (uint8, *decoder) {
+	if _, err := c.conn.Write(e.finish()); err != nil {
+		c.t.Fatal(err)
+	}
+	msg, err := readMessage(c.conn, maxMsize)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	d := &decoder{b: msg[4:]}
+	typ := d.uint8()
+	d.uint16()
+	return typ, d
+}
+
+// ok sends a request that must succeed
+func (c *client) ok(e *encoder) *decoder {
+	req := e.b[4]
+	typ, d := c.send(e)
+	if typ == rlerror {
+		c.t.Fatalf("request type %d: errno %d", req, d.uint32())
+	}
+	if typ != req+1 {
+		c.t.Fatalf("request type %d: response type %d", req, typ)
+	}
+	return d
+}
+
+// errno sends a request that must fail and returns the errno
+func (c *client) errno(e *encoder) uint32 {
+	req := e.b[4]
+	typ, d := c.send(e)
+	if typ != rlerror {
+		c.t.Fatalf("request type %d: want Rlerror, have type %d", req, typ)
+	}
+	return d.uint32()
+}
+
+// walk clones fid 0 to "newfid" and walks it to "names"
+func (c *client) walk(newfid uint32, names ...string) *encoder {
+	e := c.request(twalk).uint32(0).uint32(newfid).uint16(uint16(len(names)))
+	for _, n := range names {
+		e.string(n)
+	}
+	return e
+}
+
+func Test9p(t *testing.T) {
+	c, cleanup := newTestClient(t, false)
+	defer cleanup()
+
+	d := c.ok(c.request(tmkdir).uint32(0).string("dir").uint32(0755).uint32(0))
+	if typ := d.uint8(); typ != qtDir {
+		t.Errorf("Rmkdir: qid type %#x", typ)
+	}
+	if e := c.errno(c.request(tmkdir).uint32(0).string("dir").uint32(0755).uint32(0)); e != eexist {
+		t.Errorf("Tmkdir of existing dir: errno %d", e)
+	}
+	// Create a file like the Linux client: Tlcreate, write, clunk
+	c.ok(c.walk(1, "dir"))
+	c.ok(c.request(tlcreate).uint32(1).string("f").uint32(oWronly).uint32(0600).uint32(0))
+	c.ok(c.walk(2, "dir", "f"))
+	for i, s := range []string{"hello ", "world"} {
+		c.ok(c.request(twrite).uint32(1).uint64(uint64(6 * i)).data([]byte(s)))
+	}
+	if e := c.errno(c.request(twrite).uint32(1).uint64(0).data([]byte("x"))); e != eopnotsupp {
+		t.Errorf("non-sequential Twrite: errno %d", e)
+	}
+	// The size of a file that is being written is the size written so far
+	d = c.ok(c.request(tgetattr).uint32(2).uint64(getattrBasic))
+	d.next(8 + qidSize + 4*3 + 8*2)
+	if size := d.uint64(); size != 11 {
+		t.Errorf("Rgetattr during write: size %d", size)
+	}
+	c.ok(c.request(tclunk).uint32(1))
+	c.ok(c.request(tclunk).uint32(2))
+
+	// A partial walk returns the qids up to the missing file
+	if n := c.ok(c.walk(1, "dir", "nothing")).uint16(); n != 1 {
+		t.Errorf("partial Twalk: %d qids", n)
+	}
+	if e := c.errno(c.walk(1, "nothing")); e != enoent {
+		t.Errorf("Twalk to missing file: errno %d", e)
+	}
+	c.ok(c.request(trenameat).uint32(0).string("dir").uint32(0).string("dir2"))
+	c.ok(c.walk(1, "dir2", "f"))
+	c.ok(c.request(tlopen).uint32(1).uint32(oRdonly))
+	d = c.ok(c.request(tread).uint32(1).uint64(6).uint32(100))
+	if data := string(d.data()); data != "world" {
+		t.Errorf("Rread: %q", data)
+	}
+	c.ok(c.request(tclunk).uint32(1))
+
+	// Rewrite the file like the Linux client does for "echo x > f"
+	c.ok(c.walk(1, "dir2", "f"))
+	c.ok(c.request(tlopen).uint32(1).uint32(oWronly))
+	if e := c.errno(c.request(twrite).uint32(1).uint64(0).data([]byte("x"))); e != eopnotsupp {
+		t.Errorf("Twrite without truncation: errno %d", e)
+	}
+	c.ok(c.request(tsetattr).uint32(1).uint32(setattrSize).uint32(0).uint32(0).uint32(0).
+		uint64(0).uint64(0).uint64(0).uint64(0).uint64(0))
+	c.ok(c.request(twrite).uint32(1).uint64(0).data([]byte("new")))
+	c.ok(c.request(tclunk).uint32(1))
+
+	c.ok(c.walk(1, "dir2"))
+	c.ok(c.request(tlopen).uint32(1).uint32(oRdonly))
+	d = c.ok(c.request(treaddir).uint32(1).uint64(0).uint32(4096))
+	d = &decoder{b: d.data()}
+	var names []string
+	for len(d.b) > 0 && d.err == nil {
+		d.next(qidSize + 8 + 1)
+		names = append(names, d.string())
+	}
+	if len(names) != 3 || names[2] != "f" {
+		t.Errorf("Rreaddir: %q", names)
+	}
+	c.ok(c.request(tclunk).uint32(1))
+
+	if e := c.errno(c.request(tunlinkat).uint32(0).string("dir2").uint32(atRemoveDir)); e != enotempty {
+		t.Errorf("Tunlinkat of non-empty dir: errno %d", e)
+	}
+	c.ok(c.walk(1, "dir2", "f"))
+	c.ok(c.request(tlopen).uint32(1).uint32(oRdonly))
+	d = c.ok(c.request(tread).uint32(1).uint64(0).uint32(100))
+	if data := string(d.data()); data != "new" {
+		t.Errorf("Rread after rewrite: %q", data)
+	}
+	c.ok(c.request(tremove).uint32(1))
+	c.ok(c.request(tunlinkat).uint32(0).string("dir2").uint32(atRemoveDir))
+	if e := c.errno(c.request(tsymlink).uint32(0).string("l").string("t").uint32(0)); e != eopnotsupp {
+		t.Errorf("Tsymlink: errno %d", e)
+	}
+}
+
+func Test9pReadOnly(t *testing.T) {
+	c, cleanup := newTestClient(t, true)
+	defer cleanup()
+	c.ok(c.request(tstatfs).uint32(0))
+	if e := c.errno(c.request(tlcreate).uint32(0).string("f").uint32(oWronly).uint32(0600).uint32(0)); e != erofs {
+		t.Errorf("Tlcreate: errno %d", e)
+	}
+	if e := c.errno(c.request(tmkdir).uint32(0).string("d").uint32(0755).uint32(0)); e != erofs {
+		t.Errorf("Tmkdir: errno %d", e)
+	}
+}
@@ -0,0 +1,239 @@
+package p9srv
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Request types of 9P2000.L. The response type is always the request type
+// plus one.
+// ( https://github.com/chaos/diod/blob/master/protocol.md )
+const (
+	tlerror      = 6
+	tstatfs      = 8
+	tlopen       = 12
+	tlcreate     = 14
+	tsymlink     = 16
+	tmknod       = 18
+	trename      = 20
+	treadlink    = 22
+	tgetattr     = 24
+	tsetattr     = 26
+	txattrwalk   = 30
+	txattrcreate = 32
+	treaddir     = 40
+	tfsync       = 50
+	tlock        = 52
+	tgetlock     = 54
+	tlink        = 70
+	tmkdir       = 72
+	trenameat    = 74
+	tunlinkat    = 76
+	tversion     = 100
+	tauth        = 102
+	tattach      = 104
+	tflush       = 108
+	twalk        = 110
+	tread        = 116
+	twrite       = 118
+	tclunk       = 120
+	tremove      = 122
+)
+
+// rlerror is the error response
+const rlerror = tlerror + 1
+
+// Linux errno values, which is what 9P2000.L sends, no matter which OS the
+// server runs on
+const (
+	eperm        = 1
+	enoent       = 2
+	eio          = 5
+	ebadf        = 9
+	eacces       = 13
+	ebusy        = 16
+	eexist       = 17
+	enotdir      = 20
+	eisdir       = 21
+	einval       = 22
+	enospc       = 28
+	erofs        = 30
+	enametoolong = 36
+	enotempty    = 39
+	eopnotsupp   = 95
+)
+
+// Flags of Tlopen and Tlcreate
+const (
+	oAccMode = 0x3
+	oRdonly  = 0x0
+	oWronly  = 0x1
+	oRdwr    = 0x2
+)
+
+// Valid bits of Tsetattr
+const (
+	setattrMode     = 0x1
+	setattrUID      = 0x2
+	setattrGID      = 0x4
+	setattrSize     = 0x8
+	setattrAtime    = 0x10
+	setattrMtime    = 0x20
+	setattrCtime    = 0x40
+	setattrAtimeSet = 0x80
+	setattrMtimeSet = 0x100
+)
+
+const (
+	// getattrBasic is the set of Rgetattr fields we fill in
+	getattrBasic = 0x7ff
+	// atRemoveDir is the Tunlinkat flag for directories
+	atRemoveDir = 0x200
+	// qid types
+	qtDir  = 0x80
+	qtFile = 0x0
+	// d_type values of Rreaddir
+	dtDir = 4
+	dtReg = 8
+	// noTag is the tag of Tversion
+	noTag = 0xffff
+	// fUnlck is the lock type Rgetlock returns for "no conflicting lock"
+	fUnlck = 2
+	// v9fsMagic is the filesystem type Rstatfs reports
+	v9fsMagic = 0x01021997
+)
+
+// hdrSize is the size of the message header: size[4] type[1] tag[2]
+const hdrSize = 7
+
+// ioHdrSize is the size of Twrite without the data: the header, fid[4]
+// offset[8] and count[4]
+const ioHdrSize = hdrSize + 4 + 8 + 4
+
+var errShortMessage = errors.New("message too short")
+
+// decoder reads the fields of a message. 9P is little-endian. The first
+// error sticks, and all later reads return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = errShortMessage
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) uint8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.uint16())))
+}
+
+// data reads the count[4] data[count] field of Twrite
+func (d *decoder) data() []byte {
+	return d.next(int(d.uint32()))
+}
+
+// qid identifies a file on the server
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+// qidSize is the encoded size of a qid
+const qidSize = 13
+
+// encoder builds a message. The size field is filled in by finish().
+type encoder struct {
+	b []byte
+}
+
+func newEncoder(typ uint8, tag uint16) *encoder {
+	e := &encoder{b: make([]byte, 4, 64)}
+	return e.uint8(typ).uint16(tag)
+}
+
+func (e *encoder) uint8(v uint8) *encoder {
+	e.b = append(e.b, v)
+	return e
+}
+
+func (e *encoder) uint16(v uint16) *encoder {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], v)
+	e.b = append(e.b, buf[:]...)
+	return e
+}
+
+func (e *encoder) uint32(v uint32) *encoder {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	e.b = append(e.b, buf[:]...)
+	return e
+}
+
+func (e *encoder) uint64(v uint64) *encoder {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	e.b = append(e.b, buf[:]...)
+	return e
+}
+
+func (e *encoder) string(v string) *encoder {
+	e.uint16(uint16(len(v)))
+	e.b = append(e.b, v...)
+	return e
+}
+
+// data writes the count[4] data[count] field of Rread
+func (e *encoder) data(v []byte) *encoder {
+	e.uint32(uint32(len(v)))
+	e.b = append(e.b, v...)
+	return e
+}
+
+func (e *encoder) qid(q qid) *encoder {
+	return e.uint8(q.typ).uint32(q.version).uint64(q.path)
+}
+
+// finish fills in the size and returns the message
+func (e *encoder) finish() []byte {
+	binary.LittleEndian.PutUint32(e.b, uint32(len(e.b)))
+	return e.b
+}
@@ -0,0 +1,218 @@
+// Package panicgate recovers from panics in FUSE request handlers
+// ("-supervise"). Without it, a panic in any request takes down the whole
+// process and leaves a dead "Transport endpoint is not connected" mount.
+package panicgate
+
+import (
+	"runtime/debug"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Gate wraps "raw" so that a panic in a request is logged, the request fails
+// with EIO, and "onPanic" is called. The state of the filesystem is unknown
+// after a panic, so "onPanic" should re-establish the mount.
+func Gate(raw fuse.RawFileSystem, onPanic func()) fuse.RawFileSystem {
+	return &gate{RawFileSystem: raw, onPanic: onPanic}
+}
+
+type gate struct {
+	fuse.RawFileSystem
+	onPanic func()
+}
+
+// catch must be deferred directly so that recover() works. "status" is set
+// to EIO on panic, it may be nil for operations without a return value.
+func (g *gate) catch(op string, status *fuse.Status) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	tlog.Warn.Printf("panicgate: %s panicked: %v\n%s", op, r, debug.Stack())
+	if status != nil {
+		*status = fuse.EIO
+	}
+	g.onPanic()
+}
+
+func (g *gate) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) (status fuse.Status) {
+	defer g.catch("Lookup", &status)
+	return g.RawFileSystem.Lookup(cancel, header, name, out)
+}
+
+func (g *gate) Forget(nodeid, nlookup uint64) {
+	defer g.catch("Forget", nil)
+	g.RawFileSystem.Forget(nodeid, nlookup)
+}
+
+func (g *gate) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) (status fuse.Status) {
+	defer g.catch("GetAttr", &status)
+	return g.RawFileSystem.GetAttr(cancel, input, out)
+}
+
+func (g *gate) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) (status fuse.Status) {
+	defer g.catch("SetAttr", &status)
+	return g.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (g *gate) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) (status fuse.Status) {
+	defer g.catch("Mknod", &status)
+	return g.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (g *gate) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) (status fuse.Status) {
+	defer g.catch("Mkdir", &status)
+	return g.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (g *gate) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) (status fuse.Status) {
+	defer g.catch("Unlink", &status)
+	return g.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (g *gate) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) (status fuse.Status) {
+	defer g.catch("Rmdir", &status)
+	return g.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (g *gate) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) (status fuse.Status) {
+	defer g.catch("Rename", &status)
+	return g.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (g *gate) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) (status fuse.Status) {
+	defer g.catch("Link", &status)
+	return g.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (g *gate) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) (status fuse.Status) {
+	defer g.catch("Symlink", &status)
+	return g.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (g *gate) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out []byte, status fuse.Status) {
+	defer g.catch("Readlink", &status)
+	return g.RawFileSystem.Readlink(cancel, header)
+}
+
+func (g *gate) Access(cancel <-chan struct{}, input *fuse.AccessIn) (status fuse.Status) {
+	defer g.catch("Access", &status)
+	return g.RawFileSystem.Access(cancel, input)
+}
+
+func (g *gate) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (sz uint32, status fuse.Status) {
+	defer g.catch("GetXAttr", &status)
+	return g.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+}
+
+func (g *gate) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (sz uint32, status fuse.Status) {
+	defer g.catch("ListXAttr", &status)
+	return g.RawFileSystem.ListXAttr(cancel, header, dest)
+}
+
+func (g *gate) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) (status fuse.Status) {
+	defer g.catch("SetXAttr", &status)
+	return g.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (g *gate) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) (status fuse.Status) {
+	defer g.catch("RemoveXAttr", &status)
+	return g.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (g *gate) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) (status fuse.Status) {
+	defer g.catch("Create", &status)
+	return g.RawFileSystem.Create(cancel, input, name, out)
+}
+
+func (g *gate) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) (status fuse.Status) {
+	defer g.catch("Open", &status)
+	return g.RawFileSystem.Open(cancel, input, out)
+}
+
+func (g *gate) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (res fuse.ReadResult, status fuse.Status) {
+	defer g.catch("Read", &status)
+	return g.RawFileSystem.Read(cancel, input, buf)
+}
+
+func (g *gate) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) (status fuse.Status) {
+	defer g.catch("Lseek", &status)
+	return g.RawFileSystem.Lseek(cancel, in, out)
+}
+
+func (g *gate) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) (status fuse.Status) {
+	defer g.catch("GetLk", &status)
+	return g.RawFileSystem.GetLk(cancel, input, out)
+}
+
+func (g *gate) SetLk(cancel <-chan struct{}, input *fuse.LkIn) (status fuse.Status) {
+	defer g.catch("SetLk", &status)
+	return g.RawFileSystem.SetLk(cancel, input)
+}
+
+func (g *gate) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) (status fuse.Status) {
+	defer g.catch("SetLkw", &status)
+	return g.RawFileSystem.SetLkw(cancel, input)
+}
+
+func (g *gate) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
+	defer g.catch("Release", nil)
+	g.RawFileSystem.Release(cancel, input)
+}
+
+func (g *gate) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (written uint32, status fuse.Status) {
+	defer g.catch("Write", &status)
+	return g.RawFileSystem.Write(cancel, input, data)
+}
+
+func (g *gate) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (written uint32, status fuse.Status) {
+	defer g.catch("CopyFileRange", &status)
+	return g.RawFileSystem.CopyFileRange(cancel, input)
+}
+
+func (g *gate) Flush(cancel <-chan struct{}, input *fuse.FlushIn) (status fuse.Status) {
+	defer g.catch("Flush", &status)
+	return g.RawFileSystem.Flush(cancel, input)
+}
+
+func (g *gate) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) (status fuse.Status) {
+	defer g.catch("Fsync", &status)
+	return g.RawFileSystem.Fsync(cancel, input)
+}
+
+func (g *gate) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) (status fuse.Status) {
+	defer g.catch("Fallocate", &status)
+	return g.RawFileSystem.Fallocate(cancel, input)
+}
+
+func (g *gate) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) (status fuse.Status) {
+	defer g.catch("OpenDir", &status)
+	return g.RawFileSystem.OpenDir(cancel, input, out)
+}
+
+func (g *gate) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) (status fuse.Status) {
+	defer g.catch("ReadDir", &status)
+	return g.RawFileSystem.ReadDir(cancel, input, out)
+}
+
+func (g *gate) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) (status fuse.Status) {
+	defer g.catch("ReadDirPlus", &status)
+	return g.RawFileSystem.ReadDirPlus(cancel, input, out)
+}
+
+func (g *gate) ReleaseDir(input *fuse.ReleaseIn) {
+	defer g.catch("ReleaseDir", nil)
+	g.RawFileSystem.ReleaseDir(input)
+}
+
+func (g *gate) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) (status fuse.Status) {
+	defer g.catch("FsyncDir", &status)
+	return g.RawFileSystem.FsyncDir(cancel, input)
+}
+
+func (g *gate) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) (status fuse.Status) {
+	defer g.catch("StatFs", &status)
+	return g.RawFileSystem.StatFs(cancel, input, out)
+}
@@ -0,0 +1,35 @@
+package panicgate
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type panicFS struct {
+	fuse.RawFileSystem
+}
+
+func (p *panicFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	panic("boom")
+}
+
+func (p *panicFS) Forget(nodeid, nlookup uint64) {
+	panic("boom")
+}
+
+func TestGate(t *testing.T) {
+	panics := 0
+	g := Gate(&panicFS{fuse.NewDefaultRawFileSystem()}, func() { panics++ })
+	if st := g.Lookup(nil, &fuse.InHeader{}, "x", &fuse.EntryOut{}); st != fuse.EIO {
+		t.Errorf("Lookup: want EIO, have %v", st)
+	}
+	g.Forget(1, 1)
+	if panics != 2 {
+		t.Errorf("want 2 panics, have %d", panics)
+	}
+	// Operations that do not panic are passed through
+	if st := g.Access(nil, &fuse.AccessIn{}); st != fuse.ENOSYS {
+		t.Errorf("Access: want ENOSYS, have %v", st)
+	}
+}
@@ -0,0 +1,247 @@
+// Package quota limits how many plaintext bytes the regular files below a
+// directory may hold, "-quota".
+//
+// The usage of each directory is counted when the filesystem is mounted and
+// then kept up to date. The optional state file, "-quota-state", stores the
+// usage at unmount, so that it does not have to be counted again:
+//
+//	{
+//		"Clean": true,
+//		"Used": {
+//			"home/alice": 1048576
+//		}
+//	}
+//
+// "Clean" is false while the filesystem is mounted. If the state file is
+// not clean on mount, the usage is counted again.
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Tree is a directory with a quota
+type Tree struct {
+	// Path is the plaintext path of the directory, relative to the root of
+	// the filesystem
+	Path string
+	// Limit is the number of plaintext bytes the files may hold
+	Limit uint64
+	// used is protected by Quota.mu
+	used uint64
+}
+
+// Quota holds the trees and their usage
+type Quota struct {
+	mu    sync.Mutex
+	trees []*Tree
+	// stateFile is the "-quota-state" file, or empty
+	stateFile string
+	// state is the usage from a clean state file, nil if it has to be
+	// counted
+	state map[string]uint64
+}
+
+// stateJSON is the content of the state file
+type stateJSON struct {
+	Clean bool
+	Used  map[string]uint64
+}
+
+// New loads the state file "stateFile", if any. A missing state file is
+// not an error.
+func New(stateFile string) (*Quota, error) {
+	q := &Quota{stateFile: stateFile}
+	if stateFile == "" {
+		return q, nil
+	}
+	js, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var s stateJSON
+	if err := json.Unmarshal(js, &s); err != nil {
+		return nil, fmt.Errorf("%s: %v", stateFile, err)
+	}
+	if s.Clean && s.Used != nil {
+		q.state = s.Used
+	}
+	return q, nil
+}
+
+// ParseSpec parses a "-quota" argument like "home/alice=10G". The path is
+// returned as given.
+func ParseSpec(spec string) (path string, limit uint64, err error) {
+	i := strings.LastIndex(spec, "=")
+	if i < 0 {
+		return "", 0, fmt.Errorf("%q: want DIR=SIZE", spec)
+	}
+	limit, err = ParseSize(spec[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("%q: %v", spec, err)
+	}
+	return spec[:i], limit, nil
+}
+
+// ParseSize parses a size in bytes with an optional K, M, G or T suffix,
+// which stand for powers of 1024
+func ParseSize(s string) (uint64, error) {
+	shift := uint(0)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		case 't', 'T':
+			shift = 40
+		}
+		if shift > 0 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > (1<<64-1)>>shift {
+		return 0, fmt.Errorf("size %q is too big", s)
+	}
+	return n << shift, nil
+}
+
+// Add adds the tree "path" with "limit". The root directory is "".
+func (q *Quota) Add(path string, limit uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, t := range q.trees {
+		if t.Path == path {
+			return fmt.Errorf("duplicate quota for %q", path)
+		}
+	}
+	q.trees = append(q.trees, &Tree{Path: path, Limit: limit})
+	return nil
+}
+
+// Trees returns all trees
+func (q *Quota) Trees() []*Tree {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]*Tree(nil), q.trees...)
+}
+
+// Saved returns the usage of "t" from a clean state file
+func (q *Quota) Saved(t *Tree) (used uint64, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	used, ok = q.state[t.Path]
+	return used, ok
+}
+
+// SetUsed sets the usage of "t" after it has been counted
+func (q *Quota) SetUsed(t *Tree, used uint64) {
+	q.mu.Lock()
+	t.used = used
+	q.mu.Unlock()
+}
+
+// Used returns the usage of "t"
+func (q *Quota) Used(t *Tree) uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return t.used
+}
+
+// Match returns the trees that contain the plaintext path "path". Trees
+// can be nested, so there may be more than one. Returns nil if there is
+// none.
+func (q *Quota) Match(path string) []*Tree {
+	var res []*Tree
+	for _, t := range q.trees {
+		if t.Path == "" || path == t.Path || strings.HasPrefix(path, t.Path+"/") {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// Charge adds "delta" bytes to the usage of all "trees". Growing fails
+// without changing anything if it would exceed the limit of any of them.
+// Shrinking always succeeds.
+func (q *Quota) Charge(trees []*Tree, delta int64) bool {
+	if len(trees) == 0 || delta == 0 {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if delta > 0 {
+		for _, t := range trees {
+			if t.used+uint64(delta) > t.Limit {
+				return false
+			}
+		}
+		for _, t := range trees {
+			t.used += uint64(delta)
+		}
+		return true
+	}
+	for _, t := range trees {
+		if t.used < uint64(-delta) {
+			// The backing files have been modified behind our back
+			t.used = 0
+		} else {
+			t.used -= uint64(-delta)
+		}
+	}
+	return true
+}
+
+// SameTrees returns true if "a" and "b", results of Match(), contain the
+// same trees. Entries cannot be renamed or hard-linked between different
+// trees, as their size would have to move along.
+func SameTrees(a []*Tree, b []*Tree) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	// Match() keeps the order of q.trees
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Save writes the usage to the state file, if there is one. "clean" must
+// only be set after unmount, when the usage cannot change anymore.
+func (q *Quota) Save(clean bool) error {
+	if q.stateFile == "" {
+		return nil
+	}
+	q.mu.Lock()
+	s := stateJSON{Clean: clean, Used: make(map[string]uint64, len(q.trees))}
+	for _, t := range q.trees {
+		s.Used[t.Path] = t.used
+	}
+	q.mu.Unlock()
+	js, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	// Replace the old file atomically
+	tmp := q.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(js, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.stateFile)
+}
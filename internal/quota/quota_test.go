@@ -0,0 +1,117 @@
+package quota
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSpec(t *testing.T) {
+	testCases := []struct {
+		spec  string
+		path  string
+		limit uint64
+	}{
+		{"home/alice=1000", "home/alice", 1000},
+		{"a=b=2k", "a=b", 2048},
+		{"x=10M", "x", 10 << 20},
+		{"x=3G", "x", 3 << 30},
+		{"=1T", "", 1 << 40},
+	}
+	for _, tc := range testCases {
+		path, limit, err := ParseSpec(tc.spec)
+		if err != nil || path != tc.path || limit != tc.limit {
+			t.Errorf("ParseSpec(%q) = %q, %d, %v", tc.spec, path, limit, err)
+		}
+	}
+	for _, spec := range []string{"x", "x=", "x=-1", "x=1.5G", "x=1X", "x=20000000000T"} {
+		if _, _, err := ParseSpec(spec); err == nil {
+			t.Errorf("%q was accepted", spec)
+		}
+	}
+}
+
+func TestCharge(t *testing.T) {
+	q, _ := New("")
+	q.Add("home", 100)
+	q.Add("home/alice", 50)
+	q.Add("other", 10)
+	if err := q.Add("other", 20); err == nil {
+		t.Error("duplicate quota was accepted")
+	}
+	alice := q.Match("home/alice/file")
+	if len(alice) != 2 {
+		t.Fatalf("wrong match: %v", alice)
+	}
+	bob := q.Match("home/bob")
+	if len(bob) != 1 || SameTrees(alice, bob) {
+		t.Fatalf("wrong match: %v", bob)
+	}
+	if q.Match("homework") != nil {
+		t.Error("prefix of a name matched")
+	}
+	if !q.Charge(alice, 50) {
+		t.Fatal("charge within the limit failed")
+	}
+	if q.Charge(alice, 1) {
+		t.Error("alice exceeded her limit")
+	}
+	if q.Charge(bob, 51) {
+		t.Error("home exceeded its limit")
+	}
+	if !q.Charge(bob, 50) {
+		t.Error("charge within the limit failed")
+	}
+	home := q.Trees()[0]
+	if used := q.Used(home); used != 100 {
+		t.Errorf("home: want 100, got %d", used)
+	}
+	q.Charge(alice, -80)
+	if used := q.Used(alice[1]); used != 0 {
+		t.Errorf("alice: want 0, got %d", used)
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state")
+	q, err := New(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Add("a", 100)
+	tree := q.Trees()[0]
+	if _, ok := q.Saved(tree); ok {
+		t.Error("missing state file has usage")
+	}
+	q.SetUsed(tree, 42)
+	// Mounted
+	if err = q.Save(false); err != nil {
+		t.Fatal(err)
+	}
+	q2, err := New(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q2.Add("a", 100)
+	if _, ok := q2.Saved(q2.Trees()[0]); ok {
+		t.Error("unclean state file was used")
+	}
+	// Unmounted
+	if err = q.Save(true); err != nil {
+		t.Fatal(err)
+	}
+	q3, err := New(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q3.Add("a", 100)
+	if used, ok := q3.Saved(q3.Trees()[0]); !ok || used != 42 {
+		t.Errorf("want 42, got %d, %v", used, ok)
+	}
+}
@@ -0,0 +1,254 @@
+package readpassword
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Purposes of a password request in extpass protocol 2
+const (
+	// PurposeUnlock asks for the password of an existing filesystem
+	PurposeUnlock = "unlock"
+	// PurposeNew asks for a new password. The extpass program should have
+	// the user type it twice.
+	PurposeNew = "new"
+)
+
+// ExtpassProtocol is the protocol spoken with -extpass programs, set by
+// "-extpass-protocol". Version 1 runs the program and reads the password
+// from the first line of its output. Version 2 additionally writes an
+// ExtpassRequest to its stdin and expects an extpassResponse on stdout.
+var ExtpassProtocol = 1
+
+// ExtpassVolume describes the filesystem to protocol 2 programs
+var ExtpassVolume struct {
+	Label     string
+	CipherDir string
+}
+
+// ExtpassTimeout is the time the -extpass program gets to answer, set by
+// "-extpass-timeout". The program is killed when it runs out. Zero means no
+// limit.
+var ExtpassTimeout time.Duration
+
+// ExtpassCleanEnv is set by "-extpass-clean-env". The program then only
+// gets the variables in extpassKeepEnv, and those describing the request.
+var ExtpassCleanEnv bool
+
+// extpassKeepEnv is what a graphical or terminal password prompt needs
+var extpassKeepEnv = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TERM", "LANG", "LANGUAGE",
+	"DISPLAY", "WAYLAND_DISPLAY", "XAUTHORITY", "XDG_RUNTIME_DIR",
+	"DBUS_SESSION_BUS_ADDRESS",
+}
+
+// maxResponseLen limits the protocol 2 response. The password may be escaped.
+const maxResponseLen = 16 * maxPasswordLen
+
+// ExtpassRequest is the JSON object that protocol 2 programs get on stdin,
+// followed by a newline
+type ExtpassRequest struct {
+	Version int    `json:"version"`
+	Purpose string `json:"purpose"`
+	// Attempt is 1 for the first request and counts up on retries
+	Attempt   int    `json:"attempt"`
+	Label     string `json:"label,omitempty"`
+	CipherDir string `json:"cipherdir,omitempty"`
+	// Error tells why the password of the previous attempt was not
+	// accepted, like "wrong-password"
+	Error string `json:"error,omitempty"`
+}
+
+// extpassResponse is what protocol 2 programs write to stdout. Either
+// Password or Error is set.
+type extpassResponse struct {
+	Password string `json:"password"`
+	// Error is "cancelled" if the user closed the dialog
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// ExtpassError is returned when a protocol 2 program reports an error
+type ExtpassError struct {
+	Code    string
+	Message string
+}
+
+func (e *ExtpassError) Error() string {
+	if e.Message == "" {
+		return "extpass: " + e.Code
+	}
+	return fmt.Sprintf("extpass: %s: %s", e.Code, e.Message)
+}
+
+// extpassV2 runs the "extpass" program with the protocol 2 request "req"
+func extpassV2(extpass []string, req ExtpassRequest) ([]byte, error) {
+	parts := extpassArgs(extpass)
+	req.Version = 2
+	req.Label = ExtpassVolume.Label
+	req.CipherDir = ExtpassVolume.CipherDir
+	in, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	tlog.Info.Printf("Asking extpass program %q for the %s password, attempt %d", parts[0], req.Purpose, req.Attempt)
+	out, err := runExtpass(parts, append(in, '\n'), req.Purpose, req.Attempt, func(r io.Reader) ([]byte, error) {
+		return ioutil.ReadAll(io.LimitReader(r, maxResponseLen))
+	})
+	defer wipe(out)
+	if err != nil {
+		return nil, err
+	}
+	var resp extpassResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("extpass: invalid response: %v", err)
+	}
+	if resp.Error != "" {
+		return nil, &ExtpassError{Code: resp.Error, Message: resp.Message}
+	}
+	if resp.Password == "" {
+		return nil, fmt.Errorf("extpass: password is empty")
+	}
+	if len(resp.Password) > maxPasswordLen {
+		return nil, fmt.Errorf("extpass: maximum password length of %d bytes exceeded", maxPasswordLen)
+	}
+	return []byte(resp.Password), nil
+}
+
+// Retry asks the protocol 2 "extpass" program for the password once more,
+// after the previous one was not accepted for the reason "reason".
+// Exits on errors.
+func Retry(extpass []string, attempt int, reason string) []byte {
+	p, err := extpassV2(extpass, ExtpassRequest{Purpose: PurposeUnlock, Attempt: attempt, Error: reason})
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	return p
+}
+
+// runExtpass runs the extpass command "parts" with "stdin" and returns what
+// "read" gets from its stdout. The command is killed after ExtpassTimeout,
+// and "read" is abandoned then, because children of the program may keep
+// stdout open.
+func runExtpass(parts []string, stdin []byte, purpose string, attempt int, read func(io.Reader) ([]byte, error)) ([]byte, error) {
+	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd.Env = extpassEnv(os.Environ(), purpose, attempt)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stderr = os.Stderr
+	pipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("extpass pipe setup failed: %v", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("extpass cmd start failed: %v", err)
+	}
+	var timeout <-chan time.Time
+	if ExtpassTimeout > 0 {
+		t := time.NewTimer(ExtpassTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	type result struct {
+		out []byte
+		err error
+	}
+	readDone := make(chan result, 1)
+	go func() {
+		out, err := read(pipe)
+		readDone <- result{out, err}
+	}()
+	var res result
+	select {
+	case res = <-readDone:
+	case <-timeout:
+		cmd.Process.Kill()
+		// Closes the pipe, so the reader exits as well
+		cmd.Wait()
+		return nil, fmt.Errorf("extpass program did not answer within %v and was killed", ExtpassTimeout)
+	}
+	pipe.Close()
+	waitDone := make(chan error, 1)
+	go func() {
+		waitDone <- cmd.Wait()
+	}()
+	select {
+	case err = <-waitDone:
+		if err != nil {
+			err = fmt.Errorf("extpass program returned an error: %v", err)
+		}
+	case <-timeout:
+		cmd.Process.Kill()
+		<-waitDone
+		err = fmt.Errorf("extpass program did not exit within %v and was killed", ExtpassTimeout)
+	}
+	if err == nil {
+		err = res.err
+	}
+	if err != nil {
+		wipe(res.out)
+		return nil, err
+	}
+	return res.out, nil
+}
+
+// extpassEnv returns the environment of the extpass program, built from
+// "environ". The GOCRYPTFS_* variables describe the request to protocol 1
+// programs, which get no JSON.
+func extpassEnv(environ []string, purpose string, attempt int) []string {
+	var env []string
+	for _, kv := range environ {
+		name := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name = kv[:i]
+		}
+		if strings.HasPrefix(name, "GOCRYPTFS_") {
+			continue
+		}
+		if ExtpassCleanEnv && !keepEnv(name) {
+			continue
+		}
+		env = append(env, kv)
+	}
+	if ExtpassVolume.Label != "" {
+		env = append(env, "GOCRYPTFS_VOLUME="+ExtpassVolume.Label)
+	}
+	if ExtpassVolume.CipherDir != "" {
+		env = append(env, "GOCRYPTFS_CIPHERDIR="+ExtpassVolume.CipherDir)
+	}
+	return append(env,
+		"GOCRYPTFS_PURPOSE="+purpose,
+		"GOCRYPTFS_ATTEMPT="+strconv.Itoa(attempt))
+}
+
+func keepEnv(name string) bool {
+	if strings.HasPrefix(name, "LC_") {
+		return true
+	}
+	for _, k := range extpassKeepEnv {
+		if name == k {
+			return true
+		}
+	}
+	return false
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -1,9 +1,14 @@
 package readpassword
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
 )
@@ -18,7 +23,7 @@ func TestMain(m *testing.M) {
 
 func TestExtpass(t *testing.T) {
 	p1 := "ads2q4tw41reg52"
-	p2 := string(readPasswordExtpass([]string{"echo " + p1}))
+	p2 := string(readPasswordExtpass([]string{"echo " + p1}, PurposeUnlock))
 	if p1 != p2 {
 		t.Errorf("p1=%q != p2=%q", p1, p2)
 	}
@@ -72,7 +77,7 @@ func TestTwiceExtpass(t *testing.T) {
 // https://talks.golang.org/2014/testing.slide#23 .
 func TestExtpassEmpty(t *testing.T) {
 	if os.Getenv("TEST_SLAVE") == "1" {
-		readPasswordExtpass([]string{"echo"})
+		readPasswordExtpass([]string{"echo"}, PurposeUnlock)
 		return
 	}
 	cmd := exec.Command(os.Args[0], "-test.run=TestExtpassEmpty$")
@@ -83,3 +88,93 @@ func TestExtpassEmpty(t *testing.T) {
 	}
 	t.Fatal("empty password should have failed")
 }
+
+func TestExtpassV2(t *testing.T) {
+	ExtpassProtocol = 2
+	ExtpassVolume.Label = "home"
+	defer func() { ExtpassProtocol = 1 }()
+	dir, err := ioutil.TempDir("", "extpass_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	reqFile := filepath.Join(dir, "req")
+	// Saves the request and answers with the password "foo"
+	extpass := []string{"sh", "-c", `read req; echo "$req" > ` + reqFile + `; echo '{"password":"foo"}'`}
+
+	if p := Twice(extpass, nil); string(p) != "foo" {
+		t.Errorf("Twice: %q", p)
+	}
+	var req ExtpassRequest
+	content, _ := ioutil.ReadFile(reqFile)
+	if err := json.Unmarshal(content, &req); err != nil {
+		t.Fatal(err)
+	}
+	want := ExtpassRequest{Version: 2, Purpose: PurposeNew, Attempt: 1, Label: "home"}
+	if req != want {
+		t.Errorf("want %+v, have %+v", want, req)
+	}
+
+	if p := Retry(extpass, 2, "wrong-password"); string(p) != "foo" {
+		t.Errorf("Retry: %q", p)
+	}
+	content, _ = ioutil.ReadFile(reqFile)
+	req = ExtpassRequest{}
+	json.Unmarshal(content, &req)
+	want = ExtpassRequest{Version: 2, Purpose: PurposeUnlock, Attempt: 2, Label: "home", Error: "wrong-password"}
+	if req != want {
+		t.Errorf("want %+v, have %+v", want, req)
+	}
+
+	_, err = Extpass([]string{"sh", "-c", `echo '{"error":"cancelled","message":"closed"}'`})
+	if e, ok := err.(*ExtpassError); !ok || e.Code != "cancelled" || e.Message != "closed" {
+		t.Errorf("cancelled: %v", err)
+	}
+	for _, out := range []string{"foo", `{"password":""}`} {
+		if _, err = Extpass([]string{"echo", out}); err == nil {
+			t.Errorf("%q was accepted", out)
+		}
+	}
+}
+
+func TestExtpassTimeout(t *testing.T) {
+	ExtpassTimeout = 200 * time.Millisecond
+	defer func() { ExtpassTimeout = 0 }()
+	// "sleep" outlives the killed shell and keeps stdout open. Its stderr is
+	// redirected, or "go test" would wait for it.
+	for _, script := range []string{"sleep 10 2>/dev/null; echo foo", "echo foo; sleep 10 2>/dev/null"} {
+		start := time.Now()
+		_, err := Extpass([]string{"sh", "-c", script})
+		if err == nil {
+			t.Errorf("%q: no error", script)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%q: took %v", script, d)
+		}
+	}
+	if p, err := Extpass([]string{"echo", "foo"}); err != nil || string(p) != "foo" {
+		t.Errorf("%q %v", p, err)
+	}
+}
+
+func TestExtpassEnv(t *testing.T) {
+	ExtpassVolume.Label = "home"
+	defer func() { ExtpassVolume.Label = "" }()
+	environ := []string{"PATH=/bin", "LC_ALL=C", "SECRET=x", "GOCRYPTFS_ATTEMPT=7"}
+	have := extpassEnv(environ, PurposeNew, 2)
+	want := []string{"PATH=/bin", "LC_ALL=C", "SECRET=x", "GOCRYPTFS_VOLUME=home", "GOCRYPTFS_PURPOSE=new", "GOCRYPTFS_ATTEMPT=2"}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %q", have)
+	}
+	ExtpassCleanEnv = true
+	defer func() { ExtpassCleanEnv = false }()
+	have = extpassEnv(environ, PurposeUnlock, 1)
+	want = []string{"PATH=/bin", "LC_ALL=C", "GOCRYPTFS_VOLUME=home", "GOCRYPTFS_PURPOSE=unlock", "GOCRYPTFS_ATTEMPT=1"}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("clean: have %q", have)
+	}
+	p, err := Extpass([]string{"sh", "-c", `echo "$GOCRYPTFS_VOLUME$SECRET"`})
+	if err != nil || string(p) != "home" {
+		t.Errorf("%q %v", p, err)
+	}
+}
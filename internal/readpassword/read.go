@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"strings"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -27,7 +26,7 @@ func Once(extpass []string, passfile []string, prompt string) []byte {
 		return readPassFileConcatenate(passfile)
 	}
 	if len(extpass) != 0 {
-		return readPasswordExtpass(extpass)
+		return readPasswordExtpass(extpass, PurposeUnlock)
 	}
 	if prompt == "" {
 		prompt = "Password"
@@ -45,7 +44,7 @@ func Twice(extpass []string, passfile []string) []byte {
 		return readPassFileConcatenate(passfile)
 	}
 	if len(extpass) != 0 {
-		return readPasswordExtpass(extpass)
+		return readPasswordExtpass(extpass, PurposeNew)
 	}
 	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
 		return readPasswordStdin("Password")
@@ -95,64 +94,90 @@ func readPasswordStdin(prompt string) []byte {
 }
 
 // readPasswordExtpass executes the "extpass" program and returns the first line
-// of the output.
+// of the output, or the password from the protocol 2 response. "purpose" is
+// PurposeUnlock or PurposeNew.
 // Exits on read error or empty result.
-func readPasswordExtpass(extpass []string) []byte {
-	var parts []string
-	if len(extpass) == 1 {
-		parts = strings.Split(extpass[0], " ")
+func readPasswordExtpass(extpass []string, purpose string) []byte {
+	var p []byte
+	var err error
+	if ExtpassProtocol == 2 {
+		p, err = extpassV2(extpass, ExtpassRequest{Purpose: purpose, Attempt: 1})
 	} else {
-		parts = extpass
+		p, err = extpassV1(extpass, purpose)
 	}
-	tlog.Info.Printf("Reading password from extpass program %q, arguments: %q\n", parts[0], parts[1:])
-	cmd := exec.Command(parts[0], parts[1:]...)
-	cmd.Stderr = os.Stderr
-	pipe, err := cmd.StdoutPipe()
 	if err != nil {
-		tlog.Fatal.Printf("extpass pipe setup failed: %v", err)
+		tlog.Fatal.Println(err)
 		os.Exit(exitcodes.ReadPassword)
 	}
-	err = cmd.Start()
-	if err != nil {
-		tlog.Fatal.Printf("extpass cmd start failed: %v", err)
-		os.Exit(exitcodes.ReadPassword)
+	return p
+}
+
+// Extpass is like readPasswordExtpass, but returns an error instead of
+// exiting. Used to ask for the password again while mounted.
+func Extpass(extpass []string) ([]byte, error) {
+	if ExtpassProtocol == 2 {
+		return extpassV2(extpass, ExtpassRequest{Purpose: PurposeUnlock, Attempt: 1})
 	}
-	p := readLineUnbuffered(pipe)
-	pipe.Close()
-	err = cmd.Wait()
+	return extpassV1(extpass, PurposeUnlock)
+}
+
+// extpassV1 runs the "extpass" program and returns the first line of its
+// output
+func extpassV1(extpass []string, purpose string) ([]byte, error) {
+	parts := extpassArgs(extpass)
+	tlog.Info.Printf("Reading password from extpass program %q, arguments: %q\n", parts[0], parts[1:])
+	p, err := runExtpass(parts, nil, purpose, 1, readLine)
 	if err != nil {
-		tlog.Fatal.Printf("extpass program returned an error: %v", err)
-		os.Exit(exitcodes.ReadPassword)
+		return nil, err
 	}
 	if len(p) == 0 {
-		tlog.Fatal.Println("extpass: password is empty")
-		os.Exit(exitcodes.ReadPassword)
+		return nil, fmt.Errorf("extpass: password is empty")
 	}
-	return p
+	return p, nil
+}
+
+// extpassArgs splits a single "-extpass" argument on spaces
+func extpassArgs(extpass []string) []string {
+	if len(extpass) == 1 {
+		return strings.Split(extpass[0], " ")
+	}
+	return extpass
 }
 
 // readLineUnbuffered reads single bytes from "r" util it gets "\n" or EOF.
 // The returned string does NOT contain the trailing "\n".
-func readLineUnbuffered(r io.Reader) (l []byte) {
+// Exits on read error.
+func readLineUnbuffered(r io.Reader) []byte {
+	l, err := readLine(r)
+	if err != nil {
+		tlog.Fatal.Printf("readLineUnbuffered: %v", err)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	return l
+}
+
+// readLine is like readLineUnbuffered, but returns an error instead of
+// exiting
+func readLine(r io.Reader) (l []byte, err error) {
 	b := make([]byte, 1)
 	for {
 		if len(l) > maxPasswordLen {
-			tlog.Fatal.Printf("fatal: maximum password length of %d bytes exceeded", maxPasswordLen)
-			os.Exit(exitcodes.ReadPassword)
+			wipe(l)
+			return nil, fmt.Errorf("maximum password length of %d bytes exceeded", maxPasswordLen)
 		}
 		n, err := r.Read(b)
 		if err == io.EOF {
-			return l
+			return l, nil
 		}
 		if err != nil {
-			tlog.Fatal.Printf("readLineUnbuffered: %v", err)
-			os.Exit(exitcodes.ReadPassword)
+			wipe(l)
+			return nil, err
 		}
 		if n == 0 {
 			continue
 		}
 		if b[0] == '\n' {
-			return l
+			return l, nil
 		}
 		l = append(l, b...)
 	}
@@ -0,0 +1,231 @@
+package s3storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// client sends requests to one bucket. It always uses path-style URLs
+// ("ENDPOINT/BUCKET/KEY"), which all S3-compatible servers understand.
+type client struct {
+	endpoint *url.URL
+	bucket   string
+	creds    credentials
+	http     *http.Client
+	// now is time.Now, except in tests
+	now func() time.Time
+}
+
+// objectInfo is what HEAD and LIST tell us about an object
+type objectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// listResult is the response of ListObjectsV2
+type listResult struct {
+	Contents              []objectInfo
+	CommonPrefixes        []struct{ Prefix string }
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// errorResponse is the XML body of an error response
+type errorResponse struct {
+	Code    string
+	Message string
+}
+
+// request sends a request for "key". "body" may be nil, "payloadHash" is
+// the hex SHA256 of the body.
+func (c *client) request(method string, key string, query url.Values, header http.Header,
+	body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket + "/" + key
+	u.RawPath = strings.TrimSuffix(c.endpoint.EscapedPath(), "/") + "/" +
+		uriEncode(c.bucket, true) + "/" + uriEncode(key, false)
+	u.RawQuery = query.Encode()
+	if body != nil && size == 0 {
+		// Otherwise, Go does not know the length and uses chunked encoding
+		body = http.NoBody
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	c.creds.sign(req, payloadHash, c.now())
+	return c.http.Do(req)
+}
+
+// errorFrom turns an unsuccessful response into an error and closes the
+// body. The status codes that have a filesystem equivalent become an
+// syscall.Errno.
+func errorFrom(resp *http.Response) error {
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return syscall.ENOENT
+	case http.StatusForbidden:
+		return syscall.EACCES
+	case http.StatusPreconditionFailed:
+		return syscall.EEXIST
+	}
+	var e errorResponse
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3: %s: %s: %s", resp.Status, e.Code, e.Message)
+	}
+	return fmt.Errorf("s3: %s", resp.Status)
+}
+
+// head returns the info of the object "key"
+func (c *client) head(key string) (objectInfo, error) {
+	resp, err := c.request("HEAD", key, nil, nil, nil, 0, emptyHash)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return objectInfo{}, errorFrom(resp)
+	}
+	resp.Body.Close()
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return objectInfo{Key: key, Size: resp.ContentLength, LastModified: mtime}, nil
+}
+
+// get reads up to "n" bytes of the object "key" starting at "off". Reading
+// beyond the end returns io.EOF.
+func (c *client) get(key string, off int64, n int) ([]byte, error) {
+	h := http.Header{}
+	h.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(n)-1))
+	resp, err := c.request("GET", key, nil, h, nil, 0, emptyHash)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, off); err != nil {
+			resp.Body.Close()
+			return nil, io.EOF
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return nil, io.EOF
+	default:
+		return nil, errorFrom(resp)
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(io.LimitReader(resp.Body, int64(n)))
+}
+
+// put uploads "body" as the object "key"
+func (c *client) put(key string, body io.Reader, size int64, payloadHash string) error {
+	if body == nil {
+		body = strings.NewReader("")
+	}
+	resp, err := c.request("PUT", key, nil, nil, body, size, payloadHash)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errorFrom(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// copy copies the object "src" to "dst" on the server
+func (c *client) copy(src string, dst string) error {
+	h := http.Header{}
+	h.Set("X-Amz-Copy-Source", "/"+uriEncode(c.bucket, true)+"/"+uriEncode(src, false))
+	resp, err := c.request("PUT", dst, nil, h, nil, 0, emptyHash)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errorFrom(resp)
+	}
+	defer resp.Body.Close()
+	// CopyObject can fail after it has sent "200 OK"
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var e errorResponse
+	if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3: copy %q: %s: %s", src, e.Code, e.Message)
+	}
+	return nil
+}
+
+// del deletes the object "key". Deleting a missing object is no error.
+func (c *client) del(key string) error {
+	resp, err := c.request("DELETE", key, nil, nil, nil, 0, emptyHash)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return errorFrom(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// list returns the objects whose key starts with "prefix". With a
+// "delimiter", keys that contain it after the prefix are grouped into
+// common prefixes. At most "max" objects are returned, or all for max=0.
+func (c *client) list(prefix string, delimiter string, max int) (*listResult, error) {
+	all := &listResult{}
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if delimiter != "" {
+			q.Set("delimiter", delimiter)
+		}
+		if max > 0 {
+			q.Set("max-keys", strconv.Itoa(max))
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		// ListObjectsV2 is a GET of the bucket itself
+		resp, err := c.request("GET", "", q, nil, nil, 0, emptyHash)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, errorFrom(resp)
+		}
+		var r listResult
+		err = xml.NewDecoder(resp.Body).Decode(&r)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		all.Contents = append(all.Contents, r.Contents...)
+		all.CommonPrefixes = append(all.CommonPrefixes, r.CommonPrefixes...)
+		if !r.IsTruncated || r.NextContinuationToken == "" ||
+			max > 0 && len(all.Contents)+len(all.CommonPrefixes) >= max {
+			return all, nil
+		}
+		token = r.NextContinuationToken
+	}
+}
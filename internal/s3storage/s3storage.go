@@ -0,0 +1,548 @@
+// Package s3storage stores the ciphertext of a gocryptfs filesystem in a
+// bucket of an S3-compatible object store. It implements cryptfile.Storage
+// for a CIPHERDIR of the form "s3://BUCKET/PREFIX".
+//
+// Every ciphertext file is one object with the key PREFIX/PATH. S3 has no
+// directories, so a directory is an empty marker object PREFIX/PATH/, and
+// also exists implicitly as long as there are objects below it. Permissions
+// and timestamps are not stored.
+//
+// S3 requests are slow, so the results of HEAD and LIST are cached for a
+// few seconds, and gocryptfs.diriv and gocryptfs.longname.*.name files,
+// which never change once written, are cached for as long as the process
+// runs. Changes made through this Storage drop the cache.
+package s3storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+const (
+	// statTTL is how long the results of HEAD and LIST are cached
+	statTTL = 10 * time.Second
+	// readAhead is how much a read fetches at least
+	readAhead = 1024 * 1024
+)
+
+// Storage is the cryptfile.Storage of a bucket
+type Storage struct {
+	c *client
+	// prefix is "" or ends with a slash
+	prefix string
+
+	cacheLock sync.Mutex
+	// stats caches Lstat results by name
+	stats map[string]statEntry
+	// immutable caches the content of small files that never change
+	immutable map[string][]byte
+}
+
+type statEntry struct {
+	fi      os.FileInfo
+	expires time.Time
+}
+
+// Open opens the storage for "cipherdir", which has the form
+// "s3://BUCKET/PREFIX". Credentials and endpoint come from the usual
+// environment variables of the AWS tools:
+//
+//	AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN,
+//	AWS_REGION (default us-east-1), AWS_ENDPOINT_URL (for non-AWS servers)
+func Open(cipherdir string) (cryptfile.Storage, error) {
+	u, err := url.Parse(cipherdir)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 location %q, want s3://BUCKET/PREFIX", cipherdir)
+	}
+	creds := credentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		region:       os.Getenv("AWS_REGION"),
+	}
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return nil, errors.New("s3: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	if creds.region == "" {
+		creds.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if creds.region == "" {
+		creds.region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://s3." + creds.region + ".amazonaws.com"
+	}
+	return newStorage(endpoint, u.Host, u.Path, creds)
+}
+
+// newStorage returns the Storage for the objects below "prefix" in "bucket"
+// on the server "endpoint"
+func newStorage(endpoint string, bucket string, prefix string, creds credentials) (*Storage, error) {
+	e, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if e.Scheme != "http" && e.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &Storage{
+		c: &client{
+			endpoint: e,
+			bucket:   bucket,
+			creds:    creds,
+			http:     http.DefaultClient,
+			now:      time.Now,
+		},
+		prefix:    prefix,
+		stats:     make(map[string]statEntry),
+		immutable: make(map[string][]byte),
+	}, nil
+}
+
+// key returns the object key of the file "name"
+func (s *Storage) key(name string) string {
+	return s.prefix + path.Clean(name)
+}
+
+// dirPrefix returns the key prefix of the objects in directory "name",
+// which is also the key of its marker object
+func (s *Storage) dirPrefix(name string) string {
+	name = path.Clean(name)
+	if name == "." {
+		return s.prefix
+	}
+	return s.prefix + name + "/"
+}
+
+// isImmutable tells if "name" is a file that never changes once written
+func isImmutable(name string) bool {
+	base := path.Base(name)
+	return base == nametransform.DirIVFilename || nametransform.NameType(base) == nametransform.LongNameFilename ||
+		nametransform.IsLongTarget(base)
+}
+
+// dropCache forgets all cached information after a change. Immutable files
+// are only dropped if they are deleted or renamed.
+func (s *Storage) dropCache(names ...string) {
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+	s.stats = make(map[string]statEntry)
+	for _, name := range names {
+		name = path.Clean(name)
+		for k := range s.immutable {
+			if k == name || strings.HasPrefix(k, name+"/") {
+				delete(s.immutable, k)
+			}
+		}
+	}
+}
+
+func (s *Storage) cacheStat(name string, fi os.FileInfo) {
+	s.cacheLock.Lock()
+	s.stats[path.Clean(name)] = statEntry{fi, time.Now().Add(statTTL)}
+	s.cacheLock.Unlock()
+}
+
+func (s *Storage) Lstat(name string) (os.FileInfo, error) {
+	fi, err := s.lstat(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return fi, nil
+}
+
+func (s *Storage) lstat(name string) (os.FileInfo, error) {
+	name = path.Clean(name)
+	if name == "." {
+		return &fileInfo{name: ".", dir: true}, nil
+	}
+	s.cacheLock.Lock()
+	e, ok := s.stats[name]
+	s.cacheLock.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.fi, nil
+	}
+	var fi os.FileInfo
+	oi, err := s.c.head(s.key(name))
+	if err == nil {
+		fi = &fileInfo{name: path.Base(name), size: oi.Size, mtime: oi.LastModified}
+	} else if err == syscall.ENOENT {
+		// A directory has a marker object or other objects below it
+		l, err := s.c.list(s.dirPrefix(name), "", 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(l.Contents) == 0 {
+			return nil, syscall.ENOENT
+		}
+		fi = &fileInfo{name: path.Base(name), dir: true}
+	} else {
+		return nil, err
+	}
+	s.cacheStat(name, fi)
+	return fi, nil
+}
+
+func (s *Storage) Open(name string) (cryptfile.StorageFile, error) {
+	fi, err := s.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	name = path.Clean(name)
+	f := &file{s: s, key: s.key(name), size: fi.Size()}
+	if !isImmutable(name) {
+		return f, nil
+	}
+	s.cacheLock.Lock()
+	content, ok := s.immutable[name]
+	s.cacheLock.Unlock()
+	if !ok {
+		content, err = ioutil.ReadAll(f)
+		if err != nil {
+			return nil, &os.PathError{Op: "read", Path: name, Err: err}
+		}
+		s.cacheLock.Lock()
+		s.immutable[name] = content
+		s.cacheLock.Unlock()
+	}
+	return &file{s: s, size: int64(len(content)), buf: content}, nil
+}
+
+func (s *Storage) ReadDir(name string) ([]os.FileInfo, error) {
+	dp := s.dirPrefix(name)
+	l, err := s.c.list(dp, "/", 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	var fis []os.FileInfo
+	for _, o := range l.Contents {
+		if o.Key == dp {
+			// The marker of the directory itself
+			continue
+		}
+		fi := &fileInfo{name: o.Key[len(dp):], size: o.Size, mtime: o.LastModified}
+		s.cacheStat(path.Join(name, fi.name), fi)
+		fis = append(fis, fi)
+	}
+	for _, p := range l.CommonPrefixes {
+		fi := &fileInfo{name: strings.TrimSuffix(p.Prefix[len(dp):], "/"), dir: true}
+		s.cacheStat(path.Join(name, fi.name), fi)
+		fis = append(fis, fi)
+	}
+	if len(fis) == 0 {
+		// Empty directories only exist through their marker
+		fi, err := s.Lstat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+		}
+	}
+	return fis, nil
+}
+
+// checkCreate checks that the parent of "name" is a directory and "name"
+// does not exist
+func (s *Storage) checkCreate(name string) error {
+	fi, err := s.lstat(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return syscall.ENOTDIR
+	}
+	if _, err := s.lstat(name); err == nil {
+		return syscall.EEXIST
+	} else if err != syscall.ENOENT {
+		return err
+	}
+	return nil
+}
+
+// Create spools the file to a local temporary file, and uploads it on
+// Close(). S3 objects can only be written as a whole.
+func (s *Storage) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	name = path.Clean(name)
+	if err := s.checkCreate(name); err != nil {
+		return nil, &os.PathError{Op: "create", Path: name, Err: err}
+	}
+	tmp, err := ioutil.TempFile("", "gocryptfs-s3-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmp.Name())
+	w := &upload{s: s, name: name, tmp: tmp, hash: sha256.New()}
+	w.w = io.MultiWriter(tmp, w.hash)
+	return w, nil
+}
+
+func (s *Storage) Mkdir(name string, perm os.FileMode) error {
+	name = path.Clean(name)
+	if err := s.checkCreate(name); err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	defer s.dropCache()
+	return s.c.put(s.dirPrefix(name), nil, 0, emptyHash)
+}
+
+func (s *Storage) Remove(name string) error {
+	name = path.Clean(name)
+	fi, err := s.lstat(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	defer s.dropCache(name)
+	if !fi.IsDir() {
+		return s.c.del(s.key(name))
+	}
+	if name == "." {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	empty, err := s.isEmptyDir(name)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	return s.c.del(s.dirPrefix(name))
+}
+
+// isEmptyDir tells if there are no objects in the directory "name" except
+// its marker
+func (s *Storage) isEmptyDir(name string) (bool, error) {
+	dp := s.dirPrefix(name)
+	l, err := s.c.list(dp, "", 2)
+	if err != nil {
+		return false, err
+	}
+	for _, o := range l.Contents {
+		if o.Key != dp {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Rename copies and deletes, as S3 cannot rename. Directories are renamed
+// object by object, so this is neither atomic nor fast for big directories.
+func (s *Storage) Rename(oldName string, newName string) error {
+	oldName, newName = path.Clean(oldName), path.Clean(newName)
+	if err := s.rename(oldName, newName); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+	return nil
+}
+
+func (s *Storage) rename(oldName string, newName string) error {
+	if oldName == newName {
+		return nil
+	}
+	oldFi, err := s.lstat(oldName)
+	if err != nil {
+		return err
+	}
+	parent, err := s.lstat(path.Dir(newName))
+	if err != nil {
+		return err
+	}
+	if !parent.IsDir() {
+		return syscall.ENOTDIR
+	}
+	defer s.dropCache(oldName, newName)
+	newFi, err := s.lstat(newName)
+	if err == nil {
+		// rename(2) replaces files by files and empty directories by
+		// directories
+		if oldFi.IsDir() != newFi.IsDir() {
+			if oldFi.IsDir() {
+				return syscall.ENOTDIR
+			}
+			return syscall.EISDIR
+		}
+		if newFi.IsDir() {
+			empty, err := s.isEmptyDir(newName)
+			if err != nil {
+				return err
+			}
+			if !empty {
+				return syscall.ENOTEMPTY
+			}
+		}
+	} else if err != syscall.ENOENT {
+		return err
+	}
+	if !oldFi.IsDir() {
+		if err := s.c.copy(s.key(oldName), s.key(newName)); err != nil {
+			return err
+		}
+		return s.c.del(s.key(oldName))
+	}
+	if strings.HasPrefix(newName, oldName+"/") {
+		return syscall.EINVAL
+	}
+	oldPrefix, newPrefix := s.dirPrefix(oldName), s.dirPrefix(newName)
+	l, err := s.c.list(oldPrefix, "", 0)
+	if err != nil {
+		return err
+	}
+	for _, o := range l.Contents {
+		if err := s.c.copy(o.Key, newPrefix+o.Key[len(oldPrefix):]); err != nil {
+			return err
+		}
+	}
+	for _, o := range l.Contents {
+		if err := s.c.del(o.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Chmod is a no-op, S3 does not store permissions
+func (s *Storage) Chmod(name string, perm os.FileMode) error {
+	_, err := s.Lstat(name)
+	return err
+}
+
+// Chtimes is a no-op, S3 sets the modification time itself
+func (s *Storage) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	_, err := s.Lstat(name)
+	return err
+}
+
+// upload is a file that is being created
+type upload struct {
+	s    *Storage
+	name string
+	tmp  *os.File
+	hash interface {
+		io.Writer
+		Sum([]byte) []byte
+	}
+	w    io.Writer
+	size int64
+}
+
+func (u *upload) Write(p []byte) (int, error) {
+	n, err := u.w.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+// Close uploads the file
+func (u *upload) Close() error {
+	defer u.tmp.Close()
+	if _, err := u.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	defer u.s.dropCache(u.name)
+	return u.s.c.put(u.s.key(u.name), u.tmp, u.size, hex.EncodeToString(u.hash.Sum(nil)))
+}
+
+// file is an object opened for reading. Reads are served from "buf", which
+// holds the object content starting at "bufOff". For immutable files, "buf"
+// is the whole content and "key" is empty.
+type file struct {
+	s    *Storage
+	key  string
+	size int64
+
+	lock   sync.Mutex
+	buf    []byte
+	bufOff int64
+	// off is the position of Read()
+	off int64
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= f.size {
+			return n, io.EOF
+		}
+		if pos < f.bufOff || pos >= f.bufOff+int64(len(f.buf)) {
+			if f.key == "" {
+				return n, io.EOF
+			}
+			want := len(p) - n
+			if want < readAhead {
+				want = readAhead
+			}
+			b, err := f.s.c.get(f.key, pos, want)
+			if err == io.EOF || err == nil && len(b) == 0 {
+				// The object has shrunk since we have opened it
+				return n, io.EOF
+			} else if err != nil {
+				return n, err
+			}
+			f.buf, f.bufOff = b, pos
+		}
+		n += copy(p[n:], f.buf[pos-f.bufOff:])
+	}
+	return n, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+// fileInfo implements os.FileInfo for objects
+type fileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
@@ -0,0 +1,291 @@
+package s3storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// fakeS3 is an in-memory S3 server with a single bucket "bucket". It
+// returns at most two keys per LIST page to exercise continuation.
+type fakeS3 struct {
+	sync.Mutex
+	objects  map[string][]byte
+	requests int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests++
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=id/") {
+		http.Error(w, "unsigned", http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/bucket/") {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch {
+	case r.Method == "GET" && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r)
+	case r.Method == "HEAD" || r.Method == "GET":
+		b, ok := f.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(b))
+	case r.Method == "PUT":
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			b, ok := f.objects[strings.TrimPrefix(src, "/bucket/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			f.objects[key] = b
+			io.WriteString(w, "<CopyObjectResult></CopyObjectResult>")
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = b
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix, delim, token := q.Get("prefix"), q.Get("delimiter"), q.Get("continuation-token")
+	max, _ := strconv.Atoi(q.Get("max-keys"))
+	if max == 0 || max > 2 {
+		max = 2
+	}
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			if i := strings.Index(k[len(prefix):], delim); delim != "" && i >= 0 {
+				k = k[:len(prefix)+i+1]
+			}
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var r2 listResult
+	for i, k := range keys {
+		if k <= token || i > 0 && k == keys[i-1] {
+			continue
+		}
+		if len(r2.Contents)+len(r2.CommonPrefixes) == max {
+			r2.IsTruncated = true
+			break
+		}
+		if delim != "" && strings.HasSuffix(k, delim) && k != prefix {
+			r2.CommonPrefixes = append(r2.CommonPrefixes, struct{ Prefix string }{k})
+		} else {
+			r2.Contents = append(r2.Contents, objectInfo{Key: k, Size: int64(len(f.objects[k]))})
+		}
+		r2.NextContinuationToken = k
+	}
+	if !r2.IsTruncated {
+		r2.NextContinuationToken = ""
+	}
+	xml.NewEncoder(w).Encode(r2)
+}
+
+func newTestStorage(t *testing.T) (*Storage, *fakeS3, func()) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	s, err := newStorage(srv.URL, "bucket", "/prefix/", credentials{accessKey: "id", secretKey: "secret", region: "us-east-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake, srv.Close
+}
+
+func create(t *testing.T, s *Storage, name string, content string) {
+	w, err := s.Create(name, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, content)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	s, fake, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	if err := s.Mkdir("d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Mkdir("x/y", 0700); !os.IsNotExist(err) {
+		t.Errorf("Mkdir without parent: %v", err)
+	}
+	create(t, s, "d/f", "hello world")
+	create(t, s, "d/empty", "")
+	if _, err := s.Create("d/f", 0600); !os.IsExist(err) {
+		t.Errorf("Create of existing file: %v", err)
+	}
+	if _, ok := fake.objects["prefix/d/f"]; !ok {
+		t.Errorf("object keys: %v", fake.objects)
+	}
+
+	fi, err := s.Lstat("d/f")
+	if err != nil || fi.IsDir() || fi.Size() != 11 {
+		t.Errorf("Lstat: %v %v", fi, err)
+	}
+	f, err := s.Open("d/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if n, err := f.ReadAt(buf, 6); n != 5 || err != nil || string(buf) != "world" {
+		t.Errorf("ReadAt: %d %v %q", n, err, buf)
+	}
+	if n, err := f.ReadAt(buf, 8); n != 3 || err != io.EOF {
+		t.Errorf("ReadAt at the end: %d %v", n, err)
+	}
+	f.Close()
+
+	if err := s.Mkdir("d/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		create(t, s, "d/sub/f"+strconv.Itoa(i), "")
+	}
+	fis, err := s.ReadDir("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "empty f sub" {
+		t.Errorf("ReadDir: %q", names)
+	}
+	if err := s.Remove("d/sub"); err == nil || !strings.Contains(err.Error(), syscall.ENOTEMPTY.Error()) {
+		t.Errorf("Remove of non-empty dir: %v", err)
+	}
+
+	if err := s.Rename("d", "e"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Lstat("d/f"); !os.IsNotExist(err) {
+		t.Errorf("Lstat after rename: %v", err)
+	}
+	if fis, err := s.ReadDir("e/sub"); err != nil || len(fis) != 3 {
+		t.Errorf("ReadDir after rename: %v %v", fis, err)
+	}
+	if err := s.Rename("e/f", "e/sub"); err == nil {
+		t.Errorf("Rename of file onto dir succeeded")
+	}
+	if err := s.Remove("e/empty"); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.Lstat("e/empty"); !os.IsNotExist(err) {
+		t.Errorf("Lstat after Remove: %v", err)
+	}
+}
+
+// TestCache checks that immutable files are only downloaded once
+func TestCache(t *testing.T) {
+	s, fake, cleanup := newTestStorage(t)
+	defer cleanup()
+	create(t, s, nametransform.DirIVFilename, "0123456789abcdef")
+	var n int
+	for i := 0; i < 3; i++ {
+		f, err := s.Open(nametransform.DirIVFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(f)
+		if err != nil || string(b) != "0123456789abcdef" {
+			t.Fatalf("read: %q %v", b, err)
+		}
+		if i == 0 {
+			n = fake.requests
+		}
+	}
+	if fake.requests != n {
+		t.Errorf("%d requests for cached reads", fake.requests-n)
+	}
+}
+
+// TestCryptfile uses a bucket as CIPHERDIR through the cryptfile API
+func TestCryptfile(t *testing.T) {
+	s, _, cleanup := newTestStorage(t)
+	defer cleanup()
+	cryptfile.RegisterStorage("s3test", func(string) (cryptfile.Storage, error) {
+		return s, nil
+	})
+	const cipherdir = "s3test://bucket/prefix"
+
+	tmp, err := ioutil.TempDir("", "s3storage_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	err = configfile.Create(tmp+"/gocryptfs.conf", []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ioutil.ReadFile(tmp + "/gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	create(t, s, configfile.ConfDefaultName, string(conf))
+	create(t, s, nametransform.DirIVFilename, string(cryptocore.RandBytes(nametransform.DirIVLen)))
+
+	k, err := cryptfile.Open(cipherdir+"/"+configfile.ConfDefaultName, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Wipe()
+	if err := k.Mkdir(cipherdir, "dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("x"), 10000)
+	if err := k.WriteFile(cipherdir, "dir/file", bytes.NewReader(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Rename(cipherdir, "dir", "dir2"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := k.OpenFile(cipherdir, "dir2/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(b, content) {
+		t.Errorf("OpenFile: %d bytes, %v", len(b), err)
+	}
+	if err := k.Remove(cipherdir, "dir2/file"); err != nil {
+		t.Error(err)
+	}
+}
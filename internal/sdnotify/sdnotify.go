@@ -0,0 +1,99 @@
+// Package sdnotify implements the parts of the systemd service protocol
+// gocryptfs uses: readiness notification (sd_notify(3)), the watchdog, and
+// socket activation (sd_listen_fds(3)). Everything is a no-op when we are not
+// started by systemd.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// Notify sends "state", like "READY=1", to the service manager. Returns nil
+// if $NOTIFY_SOCKET is not set.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		// Abstract socket
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns how often "WATCHDOG=1" must be sent, which is
+// half of the timeout set by systemd. Returns 0 if the watchdog is not
+// enabled for our process.
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// Watchdog sends "WATCHDOG=1" every "interval" as long as "alive" returns
+// true, until "done" is closed. Run it in a new goroutine.
+func Watchdog(interval time.Duration, alive func() bool, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		if alive() {
+			Notify("WATCHDOG=1")
+		}
+	}
+}
+
+// ListenFile returns the socket passed by systemd that is called "name"
+// (FileDescriptorName= in systemd.socket(5)), or the only socket if they
+// have no names. Returns nil if there is none. The file descriptor is
+// marked close-on-exec.
+func ListenFile(name string) *os.File {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+	for i := 0; i < n; i++ {
+		if len(names) == n && names[i] != name {
+			continue
+		}
+		if len(names) != n && n != 1 {
+			// Unnamed, and we cannot tell them apart
+			return nil
+		}
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		return os.NewFile(uintptr(fd), name)
+	}
+	return nil
+}
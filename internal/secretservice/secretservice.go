@@ -0,0 +1,187 @@
+// Package secretservice reads passwords from the FreeDesktop Secret Service
+// (GNOME Keyring, KeePassXC, KWallet), like "secret-tool lookup" does.
+// ( https://specifications.freedesktop.org/secret-service/ )
+package secretservice
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/HorizonLiu/gocryptfs/internal/dbus"
+)
+
+const (
+	service       = "org.freedesktop.secrets"
+	servicePath   = "/org/freedesktop/secrets"
+	ifaceService  = "org.freedesktop.Secret.Service"
+	ifaceItem     = "org.freedesktop.Secret.Item"
+	ifaceSession  = "org.freedesktop.Secret.Session"
+	ifacePrompt   = "org.freedesktop.Secret.Prompt"
+	noPrompt      = "/"
+	algorithmNone = "plain"
+)
+
+// ParseAttributes parses a list like "service=gocryptfs,account=home"
+func ParseAttributes(s string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%q: want ATTRIBUTE=VALUE", item)
+		}
+		attrs[kv[0]] = kv[1]
+	}
+	return attrs, nil
+}
+
+// Lookup returns the secret of an item that has all the attributes in
+// "attrs". A locked item is unlocked first, which usually makes the keyring
+// ask the user for its password.
+func Lookup(attrs map[string]string) ([]byte, error) {
+	addr := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	if addr == "" {
+		addr = fmt.Sprintf("unix:path=/run/user/%d/bus", os.Getuid())
+	}
+	return lookup(addr, attrs)
+}
+
+func lookup(addr string, attrs map[string]string) ([]byte, error) {
+	c, err := dbus.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	// The secret is not encrypted on the way. It only passes through the
+	// session bus socket, which is private to the user.
+	e := &dbus.Encoder{}
+	e.String(algorithmNone)
+	e.Signature("s")
+	e.String("")
+	m, err := c.Call(service, servicePath, ifaceService, "OpenSession", "sv", e.B)
+	if err != nil {
+		return nil, err
+	}
+	d := m.BodyDecoder()
+	if sig := d.Signature(); sig != "s" {
+		return nil, fmt.Errorf("secret service: unexpected OpenSession output %q", sig)
+	}
+	_ = d.String() // output, empty for "plain"
+	session := d.String()
+	if d.Err() != nil {
+		return nil, d.Err()
+	}
+	defer c.Call(service, session, ifaceSession, "Close", "", nil)
+
+	item, err := search(c, attrs)
+	if err != nil {
+		return nil, err
+	}
+	e = &dbus.Encoder{}
+	e.String(session)
+	m, err = c.Call(service, item, ifaceItem, "GetSecret", "o", e.B)
+	if err != nil {
+		return nil, err
+	}
+	// (oayays): session, parameters, value, content type
+	d = m.BodyDecoder()
+	d.Align(8)
+	_ = d.String()
+	d.Bytes()
+	secret := d.Bytes()
+	if d.Err() != nil {
+		return nil, d.Err()
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("secret service: the secret is empty")
+	}
+	return secret, nil
+}
+
+// search returns the object path of an item that matches "attrs". Unlocked
+// items are preferred.
+func search(c *dbus.Conn, attrs map[string]string) (string, error) {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	e := &dbus.Encoder{}
+	e.Array(8, func() {
+		for _, k := range keys {
+			e.Align(8)
+			e.String(k)
+			e.String(attrs[k])
+		}
+	})
+	m, err := c.Call(service, servicePath, ifaceService, "SearchItems", "a{ss}", e.B)
+	if err != nil {
+		return "", err
+	}
+	d := m.BodyDecoder()
+	unlocked := d.Strings()
+	locked := d.Strings()
+	if d.Err() != nil {
+		return "", d.Err()
+	}
+	if len(unlocked) > 0 {
+		return unlocked[0], nil
+	}
+	if len(locked) == 0 {
+		return "", fmt.Errorf("secret service: no item has the attributes %v", attrs)
+	}
+	return locked[0], unlock(c, locked[0])
+}
+
+// unlock unlocks "item" and waits until the user has answered the prompt,
+// if there is one
+func unlock(c *dbus.Conn, item string) error {
+	e := &dbus.Encoder{}
+	e.Array(4, func() {
+		e.String(item)
+	})
+	m, err := c.Call(service, servicePath, ifaceService, "Unlock", "ao", e.B)
+	if err != nil {
+		return err
+	}
+	d := m.BodyDecoder()
+	d.Strings()
+	prompt := d.String()
+	if d.Err() != nil {
+		return d.Err()
+	}
+	if prompt == noPrompt {
+		return nil
+	}
+	if err := c.AddMatch("type='signal',interface='" + ifacePrompt + "',member='Completed',path='" + prompt + "'"); err != nil {
+		return err
+	}
+	// No parent window
+	e = &dbus.Encoder{}
+	e.String("")
+	call := dbus.MethodCall(service, prompt, ifacePrompt, "Prompt", "s", e.B)
+	if err := c.Send(call); err != nil {
+		return err
+	}
+	for {
+		m, err := c.Read()
+		if err != nil {
+			return err
+		}
+		dbus.CloseFds(m.Fds)
+		m.Fds = nil
+		switch {
+		case m.ReplySerial == call.Serial:
+			if err := m.AsError(); err != nil {
+				return err
+			}
+		case m.Type == dbus.TypeSignal && m.Path == prompt && m.Member == "Completed":
+			if dismissed := m.BodyDecoder().Uint32(); dismissed != 0 {
+				return errors.New("secret service: the unlock prompt was dismissed")
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package secretservice
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/internal/dbus"
+)
+
+const (
+	testSession = "/org/freedesktop/secrets/session/1"
+	testItem    = "/org/freedesktop/secrets/collection/login/1"
+	testPrompt  = "/org/freedesktop/secrets/prompt/1"
+)
+
+// fakeService accepts one connection and plays the bus and a keyring with
+// one locked item that needs a prompt to be unlocked
+func fakeService(t *testing.T, l *net.UnixListener, want map[string]string) {
+	uc, err := l.AcceptUnix()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer uc.Close()
+	c, err := dbus.Accept(uc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for {
+		m, err := c.Read()
+		if err != nil {
+			return
+		}
+		reply := &dbus.Message{Type: dbus.TypeMethodReturn, ReplySerial: m.Serial}
+		e := &dbus.Encoder{}
+		d := m.BodyDecoder()
+		switch m.Member {
+		case "Hello":
+			reply.Sig = "s"
+			e.String(":1.1")
+		case "OpenSession":
+			if alg := d.String(); alg != "plain" {
+				t.Errorf("algorithm %q", alg)
+			}
+			reply.Sig = "vo"
+			e.Signature("s")
+			e.String("")
+			e.String(testSession)
+		case "SearchItems":
+			attrs := map[string]string{}
+			d.Array(8, func() {
+				d.Align(8)
+				k := d.String()
+				attrs[k] = d.String()
+			})
+			if !reflect.DeepEqual(attrs, want) {
+				t.Errorf("attributes %v", attrs)
+			}
+			reply.Sig = "aoao"
+			e.Array(4, func() {})
+			e.Array(4, func() { e.String(testItem) })
+		case "Unlock":
+			reply.Sig = "aoo"
+			e.Array(4, func() {})
+			e.String(testPrompt)
+		case "Prompt":
+			// The signal comes after the reply, see below
+		case "GetSecret":
+			if m.Path != testItem {
+				t.Errorf("GetSecret on %q", m.Path)
+			}
+			if s := d.String(); s != testSession {
+				t.Errorf("GetSecret with session %q", s)
+			}
+			reply.Sig = "(oayays)"
+			e.String(testSession)
+			e.Bytes(nil)
+			e.Bytes([]byte("test"))
+			e.String("text/plain")
+		}
+		reply.Body = e.B
+		if err := c.Send(reply); err != nil {
+			t.Error(err)
+		}
+		if m.Member == "Prompt" {
+			e := &dbus.Encoder{}
+			e.Uint32(0)
+			e.Signature("ao")
+			e.Array(4, func() { e.String(testItem) })
+			c.Send(&dbus.Message{Type: dbus.TypeSignal, Path: testPrompt, Interface: ifacePrompt,
+				Member: "Completed", Sig: "bv", Body: e.B})
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretservice_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := dir + "/bus"
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	attrs, err := ParseAttributes("service=gocryptfs,account=home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fakeService(t, l, attrs)
+	secret, err := lookup("unix:path="+sock, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret) != "test" {
+		t.Errorf("secret %q", secret)
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	for _, s := range []string{"", "a", "=b", "a=b,"} {
+		if _, err := ParseAttributes(s); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
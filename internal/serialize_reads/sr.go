@@ -141,10 +141,15 @@ func (sr *serializerState) unblockOne() (empty bool) {
 
 var serializer serializerState
 
+var initOnce sync.Once
+
 // InitSerializer sets up the internal serializer state and starts the event loop.
-// Called by fusefrontend.NewFS.
+// Called by fusefrontend.NewFS. All mounts in the process share the
+// serializer, so only the first call does anything.
 func InitSerializer() {
-	serializer.input = make(chan *submission)
-	serializer.q = make([]*submission, 10)
-	go serializer.eventLoop()
+	initOnce.Do(func() {
+		serializer.input = make(chan *submission)
+		serializer.q = make([]*submission, 10)
+		go serializer.eventLoop()
+	})
 }
@@ -0,0 +1,208 @@
+package sftpsrv
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Packet types of SFTP version 3
+// ( https://tools.ietf.org/html/draft-ietf-secsh-filexfer-02 )
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpSetstat  = 9
+	fxpFsetstat = 10
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpReadlink = 19
+	fxpSymlink  = 20
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+	fxpExtended = 200
+)
+
+// Status codes
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+// Flags of the ATTRS structure
+const (
+	attrSize        = 0x1
+	attrUIDGID      = 0x2
+	attrPermissions = 0x4
+	attrACModTime   = 0x8
+	attrExtended    = 0x80000000
+)
+
+// Flags of SSH_FXP_OPEN
+const (
+	openRead   = 0x1
+	openWrite  = 0x2
+	openAppend = 0x4
+	openCreat  = 0x8
+	openTrunc  = 0x10
+	openExcl   = 0x20
+)
+
+// maxPacket is the largest packet we accept. Clients send at most 32 KiB of
+// data per SSH_FXP_WRITE by default, and must support 34000 bytes.
+const maxPacket = 256 * 1024
+
+var errShortPacket = errors.New("packet too short")
+
+// decoder reads the fields of a packet. The first error sticks, and all
+// later reads return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 4 {
+		d.err = errShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	hi := d.uint32()
+	lo := d.uint32()
+	return uint64(hi)<<32 | uint64(lo)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if d.err != nil {
+		return nil
+	}
+	if uint32(len(d.b)) < n {
+		d.err = errShortPacket
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// fileAttrs is the ATTRS structure
+type fileAttrs struct {
+	flags uint32
+	size  uint64
+	uid   uint32
+	gid   uint32
+	perm  uint32
+	atime uint32
+	mtime uint32
+}
+
+func (d *decoder) attrs() (a fileAttrs) {
+	a.flags = d.uint32()
+	if a.flags&attrSize != 0 {
+		a.size = d.uint64()
+	}
+	if a.flags&attrUIDGID != 0 {
+		a.uid = d.uint32()
+		a.gid = d.uint32()
+	}
+	if a.flags&attrPermissions != 0 {
+		a.perm = d.uint32()
+	}
+	if a.flags&attrACModTime != 0 {
+		a.atime = d.uint32()
+		a.mtime = d.uint32()
+	}
+	if a.flags&attrExtended != 0 {
+		// We do not support any extended attributes, skip them
+		n := d.uint32()
+		for i := uint32(0); i < n && d.err == nil; i++ {
+			d.bytes()
+			d.bytes()
+		}
+	}
+	return a
+}
+
+// encoder builds a packet. The length field is filled in by finish().
+type encoder struct {
+	b []byte
+}
+
+func newEncoder(typ byte) *encoder {
+	return &encoder{b: []byte{0, 0, 0, 0, typ}}
+}
+
+func (e *encoder) uint32(v uint32) *encoder {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	e.b = append(e.b, buf[:]...)
+	return e
+}
+
+func (e *encoder) uint64(v uint64) *encoder {
+	return e.uint32(uint32(v >> 32)).uint32(uint32(v))
+}
+
+func (e *encoder) bytes(v []byte) *encoder {
+	e.uint32(uint32(len(v)))
+	e.b = append(e.b, v...)
+	return e
+}
+
+func (e *encoder) string(v string) *encoder {
+	return e.bytes([]byte(v))
+}
+
+func (e *encoder) attrs(a fileAttrs) *encoder {
+	e.uint32(a.flags)
+	if a.flags&attrSize != 0 {
+		e.uint64(a.size)
+	}
+	if a.flags&attrUIDGID != 0 {
+		e.uint32(a.uid).uint32(a.gid)
+	}
+	if a.flags&attrPermissions != 0 {
+		e.uint32(a.perm)
+	}
+	if a.flags&attrACModTime != 0 {
+		e.uint32(a.atime).uint32(a.mtime)
+	}
+	return e
+}
+
+// finish fills in the length and returns the packet
+func (e *encoder) finish() []byte {
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+	return e.b
+}
@@ -0,0 +1,672 @@
+//go:build go1.16
+// +build go1.16
+
+// Package sftpsrv speaks the server side of the SFTP protocol (version 3)
+// for the decrypted view of a CIPHERDIR ("-sftp-server"), without FUSE.
+//
+// It is meant to run as an OpenSSH subsystem, so every SSH connection gets
+// its own process. It is built on the cryptfile package, which can only
+// write whole files. So files can be created or overwritten, with
+// sequential writes, but not modified in place. Symlinks are not shown.
+package sftpsrv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Server serves one SFTP session
+type Server struct {
+	keys      *cryptfile.Keys
+	cipherdir string
+	fsys      fs.FS
+	readOnly  bool
+	handles   map[string]handle
+	// nextHandle is the number of the next handle
+	nextHandle uint64
+}
+
+// New returns a Server for "cipherdir" using "keys". With "readOnly", all
+// modifications are rejected.
+func New(keys *cryptfile.Keys, cipherdir string, readOnly bool) *Server {
+	return &Server{
+		keys:      keys,
+		cipherdir: cipherdir,
+		fsys:      keys.NewFS(cipherdir),
+		readOnly:  readOnly,
+		handles:   make(map[string]handle),
+	}
+}
+
+// statusError is an error that is sent to the client with a specific status
+// code
+type statusError struct {
+	code uint32
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+var (
+	errUnsupported = &statusError{fxOpUnsupported, "operation not supported"}
+	errReadOnly    = &statusError{fxPermissionDenied, "read-only"}
+	errBadHandle   = &statusError{fxFailure, "invalid handle"}
+	errBadPath     = &statusError{fxNoSuchFile, "invalid path"}
+	// errAborted is passed to unfinished writes when the session ends
+	errAborted = errors.New("session ended")
+)
+
+// Serve reads requests from "r" and writes the responses to "w" until "r"
+// is closed. Requests are handled one after another, in order.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	defer s.closeAll()
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		n := (&decoder{b: hdr[:]}).uint32()
+		if n == 0 || n > maxPacket {
+			return fmt.Errorf("invalid packet length %d", n)
+		}
+		pkt := make([]byte, n)
+		if _, err := io.ReadFull(r, pkt); err != nil {
+			return err
+		}
+		resp := s.handlePacket(pkt)
+		if _, err := w.Write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// handlePacket handles the request packet "pkt" (without the length) and
+// returns the response packet
+func (s *Server) handlePacket(pkt []byte) []byte {
+	typ := pkt[0]
+	d := &decoder{b: pkt[1:]}
+	if typ == fxpInit {
+		// We ignore the client version and its extensions, version 3 is
+		// what everybody speaks
+		return newEncoder(fxpVersion).uint32(3).finish()
+	}
+	id := d.uint32()
+	resp, err := s.handleRequest(typ, id, d)
+	if err == nil && d.err != nil {
+		err = &statusError{fxBadMessage, d.err.Error()}
+	}
+	if err != nil {
+		tlog.Debug.Printf("sftp: request type %d: %v", typ, err)
+		return statusPacket(id, err)
+	}
+	if resp == nil {
+		return statusPacket(id, nil)
+	}
+	return resp
+}
+
+// statusPacket returns the SSH_FXP_STATUS packet for "err", which is OK for
+// nil
+func statusPacket(id uint32, err error) []byte {
+	code := uint32(fxOK)
+	msg := "OK"
+	var se *statusError
+	switch {
+	case err == nil:
+	case errors.As(err, &se):
+		code, msg = se.code, se.msg
+	case err == io.EOF:
+		code, msg = fxEOF, "EOF"
+	case errors.Is(err, fs.ErrNotExist):
+		code, msg = fxNoSuchFile, "no such file"
+	case errors.Is(err, fs.ErrPermission):
+		code, msg = fxPermissionDenied, "permission denied"
+	default:
+		code, msg = fxFailure, err.Error()
+	}
+	return newEncoder(fxpStatus).uint32(id).uint32(code).string(msg).string("").finish()
+}
+
+func (s *Server) handleRequest(typ byte, id uint32, d *decoder) ([]byte, error) {
+	switch typ {
+	case fxpOpen:
+		name, pflags, a := d.string(), d.uint32(), d.attrs()
+		if d.err != nil {
+			break
+		}
+		return s.open(id, name, pflags, a)
+	case fxpClose:
+		return nil, s.closeHandle(d.string())
+	case fxpRead:
+		h, off, n := d.string(), d.uint64(), d.uint32()
+		return s.read(id, h, off, n)
+	case fxpWrite:
+		h, off, data := d.string(), d.uint64(), d.bytes()
+		if d.err != nil {
+			break
+		}
+		return nil, s.write(h, off, data)
+	case fxpLstat, fxpStat:
+		name, err := s.plainName(d.string())
+		if err != nil {
+			return nil, err
+		}
+		fi, err := fs.Stat(s.fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		return newEncoder(fxpAttrs).uint32(id).attrs(infoAttrs(fi)).finish(), nil
+	case fxpFstat:
+		return s.fstat(id, d.string())
+	case fxpSetstat:
+		p, a := d.string(), d.attrs()
+		if d.err != nil {
+			break
+		}
+		name, err := s.plainName(p)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.setstat(name, a)
+	case fxpFsetstat:
+		hs, a := d.string(), d.attrs()
+		if d.err != nil {
+			break
+		}
+		return nil, s.fsetstat(hs, a)
+	case fxpOpendir:
+		return s.opendir(id, d.string())
+	case fxpReaddir:
+		return s.readdir(id, d.string())
+	case fxpRemove:
+		return nil, s.remove(d.string(), false)
+	case fxpRmdir:
+		return nil, s.remove(d.string(), true)
+	case fxpMkdir:
+		p, a := d.string(), d.attrs()
+		if d.err != nil {
+			break
+		}
+		return nil, s.mkdir(p, a)
+	case fxpRealpath:
+		name, err := s.plainName(d.string())
+		if err != nil {
+			return nil, err
+		}
+		p := "/"
+		if name != "." {
+			p += name
+		}
+		return newEncoder(fxpName).uint32(id).uint32(1).string(p).string(p).attrs(fileAttrs{}).finish(), nil
+	case fxpRename:
+		oldPath, newPath := d.string(), d.string()
+		if d.err != nil {
+			break
+		}
+		return nil, s.rename(oldPath, newPath)
+	default:
+		// SSH_FXP_READLINK, SSH_FXP_SYMLINK, SSH_FXP_EXTENDED and unknown
+		// requests
+		return nil, errUnsupported
+	}
+	// Incomplete request
+	return nil, &statusError{fxBadMessage, d.err.Error()}
+}
+
+// plainName converts the SFTP path "p" to a path for fs.FS. The root is ".".
+// Relative paths are relative to the root.
+func (s *Server) plainName(p string) (string, error) {
+	name := strings.Trim(path.Clean("/"+p), "/")
+	if name == "" {
+		return ".", nil
+	}
+	if !fs.ValidPath(name) {
+		return "", errBadPath
+	}
+	return name, nil
+}
+
+// unixMode converts "m" to the st_mode format that SFTP uses
+func unixMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m.IsDir() {
+		mode |= syscall.S_IFDIR
+	} else if m.IsRegular() {
+		mode |= syscall.S_IFREG
+	}
+	if m&fs.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+// infoAttrs returns the ATTRS of "fi"
+func infoAttrs(fi fs.FileInfo) fileAttrs {
+	a := fileAttrs{
+		flags: attrSize | attrPermissions | attrACModTime,
+		size:  uint64(fi.Size()),
+		perm:  unixMode(fi.Mode()),
+		mtime: uint32(fi.ModTime().Unix()),
+	}
+	a.atime = a.mtime
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		a.flags |= attrUIDGID
+		a.uid = st.Uid
+		a.gid = st.Gid
+	}
+	return a
+}
+
+// longName returns the "ls -l" line for "fi" that SSH_FXP_NAME carries
+func longName(fi fs.FileInfo) string {
+	a := infoAttrs(fi)
+	return fmt.Sprintf("%s %4d %-8d %-8d %8d %s %s", fi.Mode(), 1, a.uid, a.gid,
+		fi.Size(), fi.ModTime().Format("Jan _2 15:04"), fi.Name())
+}
+
+// handle is an open file or directory
+type handle interface {
+	close() error
+}
+
+// addHandle stores "h" and returns its handle string
+func (s *Server) addHandle(h handle) string {
+	hs := strconv.FormatUint(s.nextHandle, 10)
+	s.nextHandle++
+	s.handles[hs] = h
+	return hs
+}
+
+func (s *Server) closeHandle(hs string) error {
+	h, ok := s.handles[hs]
+	if !ok {
+		return errBadHandle
+	}
+	delete(s.handles, hs)
+	return h.close()
+}
+
+// closeAll closes all handles. Unfinished writes are discarded.
+func (s *Server) closeAll() {
+	for hs, h := range s.handles {
+		if wh, ok := h.(*writeHandle); ok {
+			wh.pw.CloseWithError(errAborted)
+		}
+		h.close()
+		delete(s.handles, hs)
+	}
+}
+
+// readHandle is a file opened for reading
+type readHandle struct {
+	name string
+	f    fs.File
+}
+
+func (h *readHandle) close() error {
+	return h.f.Close()
+}
+
+// writeHandle is a file opened for writing. The data goes through a pipe to
+// cryptfile.ReplaceFile(), which runs in its own goroutine, and the file
+// shows up when the handle is closed.
+type writeHandle struct {
+	s    *Server
+	name string
+	pw   *io.PipeWriter
+	// off is where the next write must start
+	off uint64
+	// done gets the result of ReplaceFile()
+	done chan error
+	// attrs are applied after the file has been written
+	attrs fileAttrs
+}
+
+func (h *writeHandle) close() error {
+	h.pw.Close()
+	if err := <-h.done; err != nil {
+		return err
+	}
+	return h.s.setstat(h.name, h.attrs)
+}
+
+// dirHandle is an open directory
+type dirHandle struct {
+	name string
+	// entries that have not been sent yet
+	entries []fs.DirEntry
+}
+
+func (h *dirHandle) close() error {
+	return nil
+}
+
+func (s *Server) open(id uint32, p string, pflags uint32, a fileAttrs) ([]byte, error) {
+	name, err := s.plainName(p)
+	if err != nil {
+		return nil, err
+	}
+	var h handle
+	if pflags&openWrite == 0 {
+		h, err = s.openRead(name)
+	} else {
+		h, err = s.openWrite(name, pflags, a)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newEncoder(fxpHandle).uint32(id).string(s.addHandle(h)).finish(), nil
+}
+
+func (s *Server) openRead(name string) (handle, error) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err != nil || fi.IsDir() {
+		f.Close()
+		return nil, &statusError{fxFailure, "not a regular file"}
+	}
+	return &readHandle{name: name, f: f}, nil
+}
+
+func (s *Server) openWrite(name string, pflags uint32, a fileAttrs) (handle, error) {
+	if s.readOnly {
+		return nil, errReadOnly
+	}
+	if pflags&(openRead|openAppend) != 0 {
+		return nil, &statusError{fxOpUnsupported, "files can only be opened for reading or for writing from the start"}
+	}
+	fi, err := fs.Stat(s.fsys, name)
+	exists := err == nil
+	switch {
+	case exists && pflags&openExcl != 0:
+		return nil, &statusError{fxFailure, "file exists"}
+	case exists && fi.IsDir():
+		return nil, &statusError{fxFailure, "is a directory"}
+	case exists && pflags&openTrunc == 0:
+		return nil, &statusError{fxOpUnsupported, "existing files can only be overwritten (SSH_FXF_TRUNC)"}
+	case !exists && pflags&openCreat == 0:
+		return nil, fs.ErrNotExist
+	case !exists && !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+	if fi, err := fs.Stat(s.fsys, path.Dir(name)); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, &statusError{fxNoSuchFile, "parent is not a directory"}
+	}
+	perm := os.FileMode(0666)
+	if a.flags&attrPermissions != 0 {
+		perm = os.FileMode(a.perm & 0777)
+		// Already applied when the file is created
+		a.flags &^= attrPermissions
+	}
+	pr, pw := io.Pipe()
+	h := &writeHandle{s: s, name: name, pw: pw, done: make(chan error, 1), attrs: a}
+	go func() {
+		err := s.keys.ReplaceFile(s.cipherdir, name, pr, perm)
+		// Unblock writes if ReplaceFile failed early
+		pr.CloseWithError(err)
+		h.done <- err
+	}()
+	return h, nil
+}
+
+// maxRead is the most data we return for one SSH_FXP_READ. Clients usually
+// ask for 32 KiB.
+const maxRead = 64 * 1024
+
+func (s *Server) read(id uint32, hs string, off uint64, n uint32) ([]byte, error) {
+	h, ok := s.handles[hs].(*readHandle)
+	if !ok {
+		return nil, errBadHandle
+	}
+	if n > maxRead {
+		n = maxRead
+	}
+	ra, ok := h.f.(io.ReaderAt)
+	if !ok {
+		return nil, errUnsupported
+	}
+	buf := make([]byte, n)
+	m, err := ra.ReadAt(buf, int64(off))
+	if m == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	return newEncoder(fxpData).uint32(id).bytes(buf[:m]).finish(), nil
+}
+
+func (s *Server) write(hs string, off uint64, data []byte) error {
+	h, ok := s.handles[hs].(*writeHandle)
+	if !ok {
+		return errBadHandle
+	}
+	if off != h.off {
+		return &statusError{fxOpUnsupported, "only sequential writes are supported"}
+	}
+	if _, err := h.pw.Write(data); err != nil {
+		return err
+	}
+	h.off += uint64(len(data))
+	return nil
+}
+
+func (s *Server) fstat(id uint32, hs string) ([]byte, error) {
+	var a fileAttrs
+	switch h := s.handles[hs].(type) {
+	case *readHandle:
+		fi, err := h.f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		a = infoAttrs(fi)
+	case *writeHandle:
+		a = fileAttrs{flags: attrSize, size: h.off}
+	case *dirHandle:
+		fi, err := fs.Stat(s.fsys, h.name)
+		if err != nil {
+			return nil, err
+		}
+		a = infoAttrs(fi)
+	default:
+		return nil, errBadHandle
+	}
+	return newEncoder(fxpAttrs).uint32(id).attrs(a).finish(), nil
+}
+
+// setstat applies the permissions and times in "a" to "name". Sizes are
+// only accepted if they do not change anything, and ownership cannot be
+// changed.
+func (s *Server) setstat(name string, a fileAttrs) error {
+	if a.flags == 0 {
+		return nil
+	}
+	if s.readOnly {
+		return errReadOnly
+	}
+	if a.flags&attrSize != 0 {
+		fi, err := fs.Stat(s.fsys, name)
+		if err != nil {
+			return err
+		}
+		if uint64(fi.Size()) != a.size {
+			return &statusError{fxOpUnsupported, "files cannot be truncated"}
+		}
+	}
+	if a.flags&attrUIDGID != 0 {
+		return &statusError{fxOpUnsupported, "ownership cannot be changed"}
+	}
+	if a.flags&attrPermissions != 0 {
+		if err := s.keys.Chmod(s.cipherdir, name, os.FileMode(a.perm&0777)); err != nil {
+			return err
+		}
+	}
+	if a.flags&attrACModTime != 0 {
+		atime := time.Unix(int64(a.atime), 0)
+		mtime := time.Unix(int64(a.mtime), 0)
+		if err := s.keys.Chtimes(s.cipherdir, name, atime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) fsetstat(hs string, a fileAttrs) error {
+	switch h := s.handles[hs].(type) {
+	case *readHandle:
+		return s.setstat(h.name, a)
+	case *writeHandle:
+		if s.readOnly {
+			return errReadOnly
+		}
+		// The file does not exist yet, remember the attributes for close
+		if a.flags&attrSize != 0 && a.size != h.off {
+			return &statusError{fxOpUnsupported, "files cannot be truncated"}
+		}
+		a.flags &^= attrSize
+		if a.flags&attrPermissions != 0 {
+			h.attrs.perm = a.perm
+		}
+		if a.flags&attrACModTime != 0 {
+			h.attrs.atime, h.attrs.mtime = a.atime, a.mtime
+		}
+		if a.flags&attrUIDGID != 0 {
+			return &statusError{fxOpUnsupported, "ownership cannot be changed"}
+		}
+		h.attrs.flags |= a.flags
+		return nil
+	case *dirHandle:
+		return s.setstat(h.name, a)
+	}
+	return errBadHandle
+}
+
+func (s *Server) opendir(id uint32, p string) ([]byte, error) {
+	name, err := s.plainName(p)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	h := &dirHandle{name: name}
+	for _, e := range entries {
+		// Symlinks cannot be opened through cryptfile
+		if e.IsDir() || e.Type().IsRegular() {
+			h.entries = append(h.entries, e)
+		}
+	}
+	return newEncoder(fxpHandle).uint32(id).string(s.addHandle(h)).finish(), nil
+}
+
+// readdirBatch is the number of entries per SSH_FXP_NAME response
+const readdirBatch = 100
+
+func (s *Server) readdir(id uint32, hs string) ([]byte, error) {
+	h, ok := s.handles[hs].(*dirHandle)
+	if !ok {
+		return nil, errBadHandle
+	}
+	if len(h.entries) == 0 {
+		return nil, io.EOF
+	}
+	batch := h.entries
+	if len(batch) > readdirBatch {
+		batch = batch[:readdirBatch]
+	}
+	h.entries = h.entries[len(batch):]
+	e := newEncoder(fxpName).uint32(id).uint32(uint32(len(batch)))
+	for _, de := range batch {
+		fi, err := de.Info()
+		if err != nil {
+			return nil, err
+		}
+		e.string(fi.Name()).string(longName(fi)).attrs(infoAttrs(fi))
+	}
+	return e.finish(), nil
+}
+
+// remove deletes a file, or an empty directory if "dir" is set
+func (s *Server) remove(p string, dir bool) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	name, err := s.plainName(p)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return errReadOnly
+	}
+	fi, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() != dir {
+		if dir {
+			return &statusError{fxFailure, "not a directory"}
+		}
+		return &statusError{fxFailure, "is a directory"}
+	}
+	return s.keys.Remove(s.cipherdir, name)
+}
+
+func (s *Server) mkdir(p string, a fileAttrs) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	name, err := s.plainName(p)
+	if err != nil {
+		return err
+	}
+	perm := os.FileMode(0777)
+	if a.flags&attrPermissions != 0 {
+		perm = os.FileMode(a.perm & 0777)
+	}
+	return s.keys.Mkdir(s.cipherdir, name, perm)
+}
+
+func (s *Server) rename(oldPath string, newPath string) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	oldName, err := s.plainName(oldPath)
+	if err != nil {
+		return err
+	}
+	newName, err := s.plainName(newPath)
+	if err != nil {
+		return err
+	}
+	// SFTP version 3 does not overwrite
+	if _, err := fs.Stat(s.fsys, newName); err == nil {
+		return &statusError{fxFailure, "target exists"}
+	}
+	return s.keys.Rename(s.cipherdir, oldName, newName)
+}
@@ -0,0 +1,196 @@
+//go:build go1.16
+// +build go1.16
+
+package sftpsrv
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+)
+
+// client talks to a Server through pipes
+type client struct {
+	t  *testing.T
+	w  *io.PipeWriter
+	r  *io.PipeReader
+	id uint32
+}
+
+// newTestClient creates a CIPHERDIR, starts a Server for it and returns a
+// client that has completed the handshake
+func newTestClient(t *testing.T, readOnly bool) (*client, func()) {
+	dir, err := ioutil.TempDir("", "sftpsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := dir + "/gocryptfs.conf"
+	err = configfile.Create(conf, []byte("test"), false, 10, "test", false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(int(d.Fd()))
+	d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := cryptfile.Open(conf, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		New(k, dir, readOnly).Serve(reqR, respW)
+		respW.Close()
+		close(done)
+	}()
+	c := &client{t: t, w: reqW, r: respR}
+	if typ, d := c.send(newEncoder(fxpInit).uint32(3)); typ != fxpVersion || d.uint32() != 3 {
+		t.Fatalf("handshake failed: type %d", typ)
+	}
+	return c, func() {
+		reqW.Close()
+		<-done
+		k.Wipe()
+		os.RemoveAll(dir)
+	}
+}
+
+// send sends a request and returns the type of the response and a decoder
+// positioned after the type (or after the id for requests that have one)
+func (c *client) send(e *encoder) (byte, *decoder) {
+	if _, err := c.w.Write(e.finish()); err != nil {
+		c.t.Fatal(err)
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	pkt := make([]byte, (&decoder{b: hdr[:]}).uint32())
+	if _, err := io.ReadFull(c.r, pkt); err != nil {
+		c.t.Fatal(err)
+	}
+	d := &decoder{b: pkt[1:]}
+	if pkt[0] != fxpVersion {
+		if id := d.uint32(); id != c.id {
+			c.t.Fatalf("want id %d, have %d", c.id, id)
+		}
+	}
+	return pkt[0], d
+}
+
+// request starts a request of type "typ" with a new id
+func (c *client) request(typ byte) *encoder {
+	c.id++
+	return newEncoder(typ).uint32(c.id)
+}
+
+// status sends a request that is answered with SSH_FXP_STATUS and returns
+// the status code
+func (c *client) status(e *encoder) uint32 {
+	typ, d := c.send(e)
+	if typ != fxpStatus {
+		c.t.Fatalf("want SSH_FXP_STATUS, have type %d", typ)
+	}
+	return d.uint32()
+}
+
+// handle sends a request that is answered with SSH_FXP_HANDLE
+func (c *client) handle(e *encoder) string {
+	typ, d := c.send(e)
+	if typ != fxpHandle {
+		c.t.Fatalf("want SSH_FXP_HANDLE, have type %d, status %d", typ, d.uint32())
+	}
+	return d.string()
+}
+
+func TestSftp(t *testing.T) {
+	c, cleanup := newTestClient(t, false)
+	defer cleanup()
+
+	if code := c.status(c.request(fxpMkdir).string("/dir").attrs(fileAttrs{})); code != fxOK {
+		t.Fatalf("MKDIR: status %d", code)
+	}
+	if code := c.status(c.request(fxpMkdir).string("/dir").attrs(fileAttrs{})); code != fxFailure {
+		t.Errorf("MKDIR of existing dir: status %d", code)
+	}
+	perm := fileAttrs{flags: attrPermissions, perm: 0600}
+	h := c.handle(c.request(fxpOpen).string("/dir/f").uint32(openWrite | openCreat | openTrunc).attrs(perm))
+	for i, s := range []string{"hello ", "world"} {
+		if code := c.status(c.request(fxpWrite).string(h).uint64(uint64(6 * i)).string(s)); code != fxOK {
+			t.Fatalf("WRITE: status %d", code)
+		}
+	}
+	if code := c.status(c.request(fxpWrite).string(h).uint64(0).string("x")); code != fxOpUnsupported {
+		t.Errorf("non-sequential WRITE: status %d", code)
+	}
+	if code := c.status(c.request(fxpClose).string(h)); code != fxOK {
+		t.Fatalf("CLOSE: status %d", code)
+	}
+	if code := c.status(c.request(fxpRename).string("/dir/f").string("dir/g")); code != fxOK {
+		t.Fatalf("RENAME: status %d", code)
+	}
+
+	h = c.handle(c.request(fxpOpen).string("/dir/g").uint32(openRead).attrs(fileAttrs{}))
+	typ, d := c.send(c.request(fxpRead).string(h).uint64(6).uint32(100))
+	if have := d.string(); typ != fxpData || have != "world" {
+		t.Errorf("READ: type %d, data %q", typ, have)
+	}
+	if code := c.status(c.request(fxpRead).string(h).uint64(11).uint32(100)); code != fxEOF {
+		t.Errorf("READ at the end: status %d", code)
+	}
+	typ, d = c.send(c.request(fxpFstat).string(h))
+	if a := d.attrs(); typ != fxpAttrs || a.size != 11 || a.perm&0777 != 0600 {
+		t.Errorf("FSTAT: type %d, size %d, perm %o", typ, a.size, a.perm)
+	}
+	c.status(c.request(fxpClose).string(h))
+
+	h = c.handle(c.request(fxpOpendir).string("/dir"))
+	typ, d = c.send(c.request(fxpReaddir).string(h))
+	if n, name := d.uint32(), d.string(); typ != fxpName || n != 1 || name != "g" {
+		t.Errorf("READDIR: type %d, %d entries, first %q", typ, n, name)
+	}
+	if code := c.status(c.request(fxpReaddir).string(h)); code != fxEOF {
+		t.Errorf("READDIR at the end: status %d", code)
+	}
+	c.status(c.request(fxpClose).string(h))
+
+	if code := c.status(c.request(fxpRmdir).string("/dir")); code != fxFailure {
+		t.Errorf("RMDIR of non-empty dir: status %d", code)
+	}
+	if code := c.status(c.request(fxpRemove).string("/dir/g")); code != fxOK {
+		t.Errorf("REMOVE: status %d", code)
+	}
+	if code := c.status(c.request(fxpStat).string("/dir/g")); code != fxNoSuchFile {
+		t.Errorf("STAT after REMOVE: status %d", code)
+	}
+	if code := c.status(c.request(fxpSymlink).string("/a").string("/b")); code != fxOpUnsupported {
+		t.Errorf("SYMLINK: status %d", code)
+	}
+}
+
+func TestSftpReadOnly(t *testing.T) {
+	c, cleanup := newTestClient(t, true)
+	defer cleanup()
+	typ, d := c.send(c.request(fxpRealpath).string("."))
+	if n, name := d.uint32(), d.string(); typ != fxpName || n != 1 || name != "/" {
+		t.Errorf("REALPATH: type %d, %d names, first %q", typ, n, name)
+	}
+	if code := c.status(c.request(fxpOpen).string("/f").uint32(openWrite | openCreat).attrs(fileAttrs{})); code != fxPermissionDenied {
+		t.Errorf("OPEN for writing: status %d", code)
+	}
+	if code := c.status(c.request(fxpMkdir).string("/d").attrs(fileAttrs{})); code != fxPermissionDenied {
+		t.Errorf("MKDIR: status %d", code)
+	}
+}
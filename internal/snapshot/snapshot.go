@@ -0,0 +1,306 @@
+// Package snapshot creates and lists point-in-time copies of a CIPHERDIR.
+//
+// A snapshot is a complete copy of the encrypted directory tree, including
+// gocryptfs.conf, so it can be mounted like any other CIPHERDIR. Snapshots are
+// stored next to the CIPHERDIR, in "CIPHERDIR.snapshots/NAME".
+//
+// Regular files are reflinked (FICLONE) when the backing filesystem supports
+// it (Btrfs, XFS), which makes the snapshot copy-on-write and cheap. Otherwise,
+// the file content is copied. Linking to the original files is not an option
+// because gocryptfs modifies files in place, which would change the snapshot
+// as well. Files that are hard-linked to each other in CIPHERDIR are
+// hard-linked to each other in the snapshot.
+//
+// Create copies whatever is in CIPHERDIR. If the CIPHERDIR is mounted, the
+// caller has to freeze the mount for the duration of the copy (see
+// IsMounted).
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+)
+
+const (
+	// dirSuffix is appended to the CIPHERDIR path to get the snapshot directory
+	dirSuffix = ".snapshots"
+	// tmpSuffix marks a snapshot that is still being created
+	tmpSuffix = ".tmp"
+	// NameFormat is the time format used for automatically generated snapshot
+	// names
+	NameFormat = "2006-01-02T15-04-05"
+)
+
+// Info describes an existing snapshot
+type Info struct {
+	// Name of the snapshot
+	Name string
+	// Created is the time the snapshot was created
+	Created time.Time
+}
+
+// Dir returns the directory that stores the snapshots of "cipherdir".
+func Dir(cipherdir string) string {
+	return filepath.Clean(cipherdir) + dirSuffix
+}
+
+// checkName makes sure that "name" can be used as a directory name inside
+// the snapshot directory.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") ||
+		strings.HasSuffix(name, tmpSuffix) {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return nil
+}
+
+// Path returns the path to the existing snapshot "name" of "cipherdir".
+func Path(cipherdir string, name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	p := filepath.Join(Dir(cipherdir), name)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%q is not a directory", p)
+	}
+	return p, nil
+}
+
+// Create copies "cipherdir" into a new snapshot called "name" and returns the
+// path to the snapshot. If "name" is empty, the current time is used as the
+// name.
+//
+// The copy is first written to a temporary directory and renamed into place
+// when complete, so an interrupted Create never leaves a half-written
+// snapshot behind under the final name.
+func Create(cipherdir string, name string) (string, error) {
+	cipherdir = filepath.Clean(cipherdir)
+	if name == "" {
+		name = time.Now().Format(NameFormat)
+	}
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	snapDir := Dir(cipherdir)
+	if err := os.MkdirAll(snapDir, 0700); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(snapDir, name)
+	if _, err := os.Lstat(dst); err == nil {
+		return "", fmt.Errorf("snapshot %q already exists", name)
+	}
+	tmp := dst + tmpSuffix
+	// Leftover from an earlier, interrupted run
+	os.RemoveAll(tmp)
+	if err := copyTree(cipherdir, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return dst, nil
+}
+
+// List returns the snapshots of "cipherdir", oldest first.
+func List(cipherdir string) ([]Info, error) {
+	entries, err := ioutil.ReadDir(Dir(cipherdir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []Info
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasSuffix(e.Name(), tmpSuffix) {
+			continue
+		}
+		out = append(out, Info{Name: e.Name(), Created: e.ModTime()})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Created.Equal(out[j].Created) {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Created.Before(out[j].Created)
+	})
+	return out, nil
+}
+
+// copyTree recursively copies the directory "src" to "dst", which must not
+// exist yet. Regular files are reflinked if possible.
+func copyTree(src string, dst string) error {
+	// Directory permissions and mtimes are restored after all entries have
+	// been created, deepest first: creating entries updates the mtime, and
+	// a read-only directory could not be filled.
+	type dirAttrs struct {
+		path  string
+		perm  os.FileMode
+		mtime time.Time
+	}
+	var dirs []dirAttrs
+	// Copies of files with more than one link, by inode
+	type devIno struct {
+		dev uint64
+		ino uint64
+	}
+	links := make(map[devIno]string)
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		mode := fi.Mode()
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("%q: cannot get file attributes", path)
+		}
+		if !mode.IsDir() && st.Nlink > 1 {
+			key := devIno{uint64(st.Dev), uint64(st.Ino)}
+			if first, ok := links[key]; ok {
+				return os.Link(first, target)
+			}
+			links[key] = target
+		}
+		switch {
+		case mode.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirAttrs{target, mode.Perm(), fi.ModTime()})
+			return nil
+		case mode.IsRegular():
+			if err := copyFile(path, target, mode.Perm()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			// Device nodes, fifos and sockets carry no data and are
+			// recreated. Device nodes need root.
+			if err := syscall.Mknod(target, uint32(st.Mode), int(st.Rdev)); err != nil {
+				return &os.PathError{Op: "mknod", Path: target, Err: err}
+			}
+			return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].perm); err != nil {
+			return err
+		}
+		// The snapshot root keeps its own mtime, which is the creation time
+		// reported by List.
+		if i > 0 {
+			os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime)
+		}
+	}
+	return nil
+}
+
+// copyFile creates "dst" as a copy of "src". It tries a reflink first and
+// falls back to copying the data.
+func copyFile(src string, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Make sure we can write to the file even if "perm" does not allow it.
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = syscallcompat.Reflink(int(out.Fd()), int(in.Fd()))
+	if err != nil {
+		if err != syscall.EOPNOTSUPP && err != syscall.EXDEV && err != syscall.EINVAL &&
+			err != syscall.ENOTTY && err != syscall.ENOSYS {
+			out.Close()
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err = out.Chmod(perm); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// IsMounted returns true if "cipherdir" is mounted by gocryptfs, according to
+// /proc/self/mountinfo. This is the source shown by "mount", unless
+// "-fsname" was used. Always returns false if mountinfo is not available,
+// like on macOS.
+func IsMounted(cipherdir string) bool {
+	cipherdir, err := filepath.Abs(cipherdir)
+	if err != nil {
+		return false
+	}
+	content, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		// The fields after the " - " separator are fstype, source and
+		// super options
+		parts := strings.SplitN(line, " - ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		f := strings.Fields(parts[1])
+		if len(f) < 2 || !strings.HasPrefix(f[0], "fuse.gocryptfs") {
+			continue
+		}
+		if unescapeMountinfo(f[1]) == cipherdir {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeMountinfo decodes the octal escapes (like "\040" for a space) in a
+// mountinfo field
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			var c byte
+			if _, err := fmt.Sscanf(s[i+1:i+4], "%03o", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
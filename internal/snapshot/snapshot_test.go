@@ -0,0 +1,117 @@
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCreateList(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "snapshot_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cipherdir := filepath.Join(tmp, "cipher")
+	if err = os.MkdirAll(filepath.Join(cipherdir, "dir1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(cipherdir, "dir1", "file1"), []byte("foo"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("dir1/file1", filepath.Join(cipherdir, "link1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Link(filepath.Join(cipherdir, "dir1", "file1"), filepath.Join(cipherdir, "hardlink1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Mkfifo(filepath.Join(cipherdir, "fifo1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Empty list before the first snapshot
+	l, err := List(cipherdir)
+	if err != nil || len(l) != 0 {
+		t.Fatalf("List: %v %v", l, err)
+	}
+	p, err := Create(cipherdir, "snap1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != filepath.Join(tmp, "cipher.snapshots", "snap1") {
+		t.Errorf("wrong path %q", p)
+	}
+	// Modifying the original must not change the snapshot
+	if err = os.Chmod(filepath.Join(cipherdir, "dir1", "file1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(cipherdir, "dir1", "file1"), []byte("bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(p, "dir1", "file1"))
+	if err != nil || string(content) != "foo" {
+		t.Errorf("snapshot content: %q %v", content, err)
+	}
+	fi, err := os.Stat(filepath.Join(p, "dir1", "file1"))
+	if err != nil || fi.Mode().Perm() != 0400 {
+		t.Errorf("snapshot file mode: %v %v", fi, err)
+	}
+	link, err := os.Readlink(filepath.Join(p, "link1"))
+	if err != nil || link != "dir1/file1" {
+		t.Errorf("snapshot symlink: %q %v", link, err)
+	}
+	// Hard links stay hard links
+	fi1, err1 := os.Stat(filepath.Join(p, "dir1", "file1"))
+	fi2, err2 := os.Stat(filepath.Join(p, "hardlink1"))
+	if err1 != nil || err2 != nil || !os.SameFile(fi1, fi2) {
+		t.Errorf("snapshot hard link: %v %v", err1, err2)
+	}
+	if fi, err := os.Lstat(filepath.Join(p, "fifo1")); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("snapshot fifo: %v %v", fi, err)
+	}
+	// Duplicate names are rejected
+	if _, err = Create(cipherdir, "snap1"); err == nil {
+		t.Error("duplicate snapshot name should have failed")
+	}
+	l, err = List(cipherdir)
+	if err != nil || len(l) != 1 || l[0].Name != "snap1" {
+		t.Errorf("List: %v %v", l, err)
+	}
+	if _, err = Path(cipherdir, "snap1"); err != nil {
+		t.Error(err)
+	}
+	if _, err = Path(cipherdir, "nonexisting"); err == nil {
+		t.Error("Path should have failed for nonexisting snapshot")
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	for _, n := range []string{"", ".", "..", "a/b", "foo.tmp"} {
+		if checkName(n) == nil {
+			t.Errorf("name %q should be rejected", n)
+		}
+	}
+	if err := checkName("2021-01-01T00-00-00"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnescapeMountinfo(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want string
+	}{
+		{`/tmp/a\040b\134c`, `/tmp/a b\c`},
+		{`/tmp/x\`, `/tmp/x\`},
+		// Escape in the last four bytes
+		{`/tmp/x\040`, `/tmp/x `},
+		{`\011`, "\t"},
+		{`/tmp/x\04`, `/tmp/x\04`},
+	}
+	for _, tc := range testCases {
+		if u := unescapeMountinfo(tc.in); u != tc.want {
+			t.Errorf("%q: want %q, have %q", tc.in, tc.want, u)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package syscallcompat
 
 import (
+	"bytes"
 	"log"
 	"path/filepath"
 	"runtime"
@@ -24,6 +25,9 @@ const (
 	// RENAME_NOREPLACE is only defined on Linux
 	RENAME_NOREPLACE = 0
 
+	// RENAME_EXCHANGE is only defined on Linux
+	RENAME_EXCHANGE = 0
+
 	// KAUTH_UID_NONE and KAUTH_GID_NONE are special values to
 	// revert permissions to the process credentials.
 	KAUTH_UID_NONE = ^uint32(0) - 100
@@ -228,3 +232,28 @@ func GetdentsSpecial(fd int) (entries []fuse.DirEntry, entriesSpecial []fuse.Dir
 func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags uint) (err error) {
 	return unix.Renameat(olddirfd, oldpath, newdirfd, newpath)
 }
+
+// Reflink is not implemented on Darwin.
+func Reflink(dstFd int, srcFd int) error {
+	return syscall.EOPNOTSUPP
+}
+
+// FdPath returns the path of the file or directory that "fd" refers to,
+// with all symlinks resolved.
+func FdPath(fd int) (string, error) {
+	// MAXPATHLEN
+	buf := make([]byte, 1024)
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), unix.F_GETPATH, uintptr(unsafe.Pointer(&buf[0])))
+	if errno != 0 {
+		return "", errno
+	}
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	return string(buf), nil
+}
+
+// SetMountNoexec is not implemented on Darwin.
+func SetMountNoexec(mountpoint string, noexec bool) error {
+	return syscall.EOPNOTSUPP
+}
@@ -4,6 +4,7 @@ package syscallcompat
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"runtime"
 	"strconv"
 	"strings"
@@ -30,6 +31,12 @@ const (
 
 	// RENAME_NOREPLACE is only defined on Linux
 	RENAME_NOREPLACE = unix.RENAME_NOREPLACE
+
+	// RENAME_EXCHANGE is only defined on Linux
+	RENAME_EXCHANGE = unix.RENAME_EXCHANGE
+
+	// FICLONE from linux/fs.h. Not defined in our version of x/sys/unix.
+	_FICLONE = 0x40049409
 )
 
 var preallocWarn sync.Once
@@ -264,3 +271,48 @@ func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags
 	})
 	return err
 }
+
+// Reflink makes "dstFd" share the data blocks of "srcFd" (FICLONE ioctl).
+// Only supported by some filesystems, like Btrfs and XFS.
+func Reflink(dstFd int, srcFd int) error {
+	return unix.IoctlSetInt(dstFd, _FICLONE, srcFd)
+}
+
+// FdPath returns the path of the file or directory that "fd" refers to,
+// with all symlinks resolved.
+func FdPath(fd int) (string, error) {
+	return os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+}
+
+// Per-mount flags as reported by statfs(2) in Statfs_t.Flags (ST_*), and
+// the mount(2) flags that set them (MS_*)
+var mountFlags = []struct{ st, ms uintptr }{
+	{0x1, unix.MS_RDONLY},
+	{0x2, unix.MS_NOSUID},
+	{0x4, unix.MS_NODEV},
+	{0x8, unix.MS_NOEXEC},
+	{0x400, unix.MS_NOATIME},
+	{0x800, unix.MS_NODIRATIME},
+	{0x1000, unix.MS_RELATIME},
+}
+
+// SetMountNoexec sets or clears the "noexec" flag of the mount at
+// "mountpoint", keeping its other per-mount flags. Needs CAP_SYS_ADMIN.
+func SetMountNoexec(mountpoint string, noexec bool) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(mountpoint, &st); err != nil {
+		return err
+	}
+	flags := uintptr(unix.MS_REMOUNT | unix.MS_BIND)
+	for _, f := range mountFlags {
+		if uintptr(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	if noexec {
+		flags |= unix.MS_NOEXEC
+	} else {
+		flags &^= unix.MS_NOEXEC
+	}
+	return unix.Mount("", mountpoint, "", flags, "")
+}
@@ -0,0 +1,228 @@
+// Package tarstream writes an encrypted directory tree to a tar stream and
+// extracts it again.
+//
+// Entries are written in a stable order: directories before their contents,
+// the entries of a directory sorted by name. Exporting an unchanged tree twice
+// gives the same stream, which keeps incremental off-site copies small. Only
+// directories, regular files and symlinks are supported. Ownership is stored
+// as numeric uid and gid.
+package tarstream
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Entry is a file, directory or symlink that is written to the stream
+type Entry struct {
+	// Path is the path relative to the root of the tree
+	Path string
+	// Mode contains the file type and permission bits, like st_mode
+	Mode uint32
+	Uid  uint32
+	Gid  uint32
+	// Mtime is the modification time
+	Mtime time.Time
+	// Size is the size of regular files
+	Size int64
+	// Target is the target of symlinks
+	Target string
+	// Content supplies the Size bytes of regular files
+	Content io.Reader
+}
+
+// Writer writes Entries to a tar stream
+type Writer struct {
+	tw *tar.Writer
+	// Count is the number of entries written so far
+	Count int
+}
+
+// NewWriter returns a Writer that writes to "w"
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{tw: tar.NewWriter(w)}
+}
+
+// Add writes "e" to the stream. Device nodes, fifos and sockets carry no
+// data and are skipped with a warning.
+func (w *Writer) Add(e *Entry) error {
+	h := &tar.Header{
+		Name:    e.Path,
+		Mode:    int64(e.Mode & 07777),
+		Uid:     int(e.Uid),
+		Gid:     int(e.Gid),
+		ModTime: e.Mtime,
+	}
+	switch e.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		h.Typeflag = tar.TypeDir
+		h.Name += "/"
+	case syscall.S_IFREG:
+		h.Typeflag = tar.TypeReg
+		h.Size = e.Size
+	case syscall.S_IFLNK:
+		h.Typeflag = tar.TypeSymlink
+		h.Linkname = e.Target
+	default:
+		tlog.Warn.Printf("tarstream: skipping special file %q", e.Path)
+		return nil
+	}
+	if err := w.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	if h.Typeflag == tar.TypeReg {
+		if _, err := io.CopyN(w.tw, e.Content, e.Size); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("%q: file shrank while reading it", e.Path)
+			}
+			return err
+		}
+	}
+	w.Count++
+	return nil
+}
+
+// AddDir writes the contents of the directory "dir", recursively, to the
+// stream. Symlinks are not followed.
+func (w *Writer) AddDir(dir string) error {
+	// filepath.Walk visits the entries of a directory sorted by name
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("%q: cannot get file attributes", path)
+		}
+		e := &Entry{
+			Path:  rel,
+			Mode:  uint32(st.Mode),
+			Uid:   st.Uid,
+			Gid:   st.Gid,
+			Mtime: fi.ModTime(),
+			Size:  fi.Size(),
+		}
+		switch {
+		case fi.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			e.Content = f
+		case fi.Mode()&os.ModeSymlink != 0:
+			if e.Target, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		return w.Add(e)
+	})
+}
+
+// Close writes the end of the stream. It does not close the underlying
+// io.Writer.
+func (w *Writer) Close() error {
+	return w.tw.Close()
+}
+
+// Extract extracts the tar stream "r" into the existing, empty directory
+// "dir" and returns the number of extracted entries. Entries must not leave
+// "dir" and their parent directories must come first in the stream, so
+// symlinks from the stream are never followed. Ownership is only restored
+// when running as root.
+func Extract(r io.Reader, dir string) (count int, err error) {
+	// Directory permissions and mtimes are restored after all entries have
+	// been created, deepest first: creating entries updates the mtime, and
+	// a read-only directory could not be filled.
+	type dirAttrs struct {
+		path  string
+		perm  os.FileMode
+		mtime time.Time
+	}
+	var dirs []dirAttrs
+	isDir := map[string]bool{".": true}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return count, err
+		}
+		name := filepath.Clean(h.Name)
+		if filepath.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			return count, fmt.Errorf("invalid path %q", h.Name)
+		}
+		if !isDir[filepath.Dir(name)] {
+			return count, fmt.Errorf("%q: parent directory is missing from the stream", h.Name)
+		}
+		target := filepath.Join(dir, name)
+		perm := os.FileMode(h.Mode).Perm()
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0700); err != nil {
+				return count, err
+			}
+			isDir[name] = true
+			dirs = append(dirs, dirAttrs{target, perm, h.ModTime})
+		case tar.TypeReg:
+			if err := extractFile(tr, target, perm); err != nil {
+				return count, err
+			}
+			if err := os.Chtimes(target, h.ModTime, h.ModTime); err != nil {
+				return count, err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(h.Linkname, target); err != nil {
+				return count, err
+			}
+		default:
+			tlog.Warn.Printf("tarstream: skipping unsupported entry %q (type %q)", h.Name, h.Typeflag)
+			continue
+		}
+		if os.Geteuid() == 0 {
+			if err := os.Lchown(target, h.Uid, h.Gid); err != nil {
+				return count, err
+			}
+		}
+		count++
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].perm); err != nil {
+			return count, err
+		}
+		if err := os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// extractFile creates the regular file "path" with the content from "r"
+func extractFile(r io.Reader, path string, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,104 @@
+package tarstream
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoundtrip(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarstream_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	if err = os.MkdirAll(filepath.Join(src, "d1", "d2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"b", "a", "d1/f", "d1/d2/g"} {
+		if err = ioutil.WriteFile(filepath.Join(src, f), []byte(f), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Symlink("a", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chmod(filepath.Join(src, "d1"), 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(src, "d1"), 0700)
+
+	export := func() []byte {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		if err := w.AddDir(src); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if w.Count != 7 {
+			t.Errorf("want 7 entries, have %d", w.Count)
+		}
+		return buf.Bytes()
+	}
+	stream := export()
+	if !bytes.Equal(stream, export()) {
+		t.Error("exporting twice gave different streams")
+	}
+
+	dst := filepath.Join(tmp, "dst")
+	if err = os.Mkdir(dst, 0700); err != nil {
+		t.Fatal(err)
+	}
+	n, err := Extract(bytes.NewReader(stream), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(dst, "d1"), 0700)
+	if n != 7 {
+		t.Errorf("want 7 entries, have %d", n)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dst, "d1/d2/g"))
+	if err != nil || string(content) != "d1/d2/g" {
+		t.Errorf("wrong content %q: %v", content, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "a" {
+		t.Errorf("wrong symlink target %q: %v", target, err)
+	}
+	fi, err := os.Stat(filepath.Join(dst, "d1"))
+	if err != nil || fi.Mode().Perm() != 0500 {
+		t.Errorf("wrong directory permissions: %v %v", fi.Mode(), err)
+	}
+}
+
+func TestExtractUnsafe(t *testing.T) {
+	for _, tc := range [][]tar.Header{
+		{{Name: "../evil", Typeflag: tar.TypeReg}},
+		{{Name: "/evil", Typeflag: tar.TypeReg}},
+		// Writing through a symlink from the stream
+		{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/tmp"}, {Name: "link/evil", Typeflag: tar.TypeReg}},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for i := range tc {
+			tc[i].Mode = 0600
+			if err := tw.WriteHeader(&tc[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tw.Close()
+		dir, err := ioutil.TempDir("", "tarstream_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Extract(&buf, dir); err == nil {
+			t.Errorf("%q: should have failed", tc[len(tc)-1].Name)
+		}
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,126 @@
+// Package throttle limits the bandwidth and the number of read and write
+// operations of a mount, "-max-read-mbps", "-max-write-mbps",
+// "-max-read-iops" and "-max-write-iops".
+package throttle
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// MB is the unit of the bandwidth limits
+const MB = 1000 * 1000
+
+// Limits holds the maximum rates. Zero means unlimited.
+type Limits struct {
+	// ReadBytes and WriteBytes are in bytes per second
+	ReadBytes, WriteBytes float64
+	// ReadOps and WriteOps are in operations per second
+	ReadOps, WriteOps float64
+}
+
+// Enabled tells if any limit is set
+func (l Limits) Enabled() bool {
+	return l.ReadBytes > 0 || l.WriteBytes > 0 || l.ReadOps > 0 || l.WriteOps > 0
+}
+
+// bucket is a token bucket that holds up to one second worth of tokens.
+// A request that is larger than that goes into debt, so that the average
+// rate holds for any request size.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newBucket returns nil for rate 0. A nil bucket does not limit anything.
+func newBucket(rate float64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: rate, tokens: rate}
+}
+
+// reserve takes "n" tokens at time "now" and returns how long the caller
+// has to wait until they have been refilled
+func (b *bucket) reserve(n float64, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// wait blocks until "n" tokens are available. Returns false if "cancel"
+// was closed before.
+func (b *bucket) wait(n float64, cancel <-chan struct{}) bool {
+	if b == nil {
+		return true
+	}
+	d := b.reserve(n, time.Now())
+	if d == 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// Gate wraps "raw" so that reads and writes stay below "limits". Requests
+// over the limit are delayed, not rejected. All other operations are passed
+// through.
+func Gate(raw fuse.RawFileSystem, limits Limits) fuse.RawFileSystem {
+	return &gate{
+		RawFileSystem: raw,
+		readBytes:     newBucket(limits.ReadBytes),
+		writeBytes:    newBucket(limits.WriteBytes),
+		readOps:       newBucket(limits.ReadOps),
+		writeOps:      newBucket(limits.WriteOps),
+	}
+}
+
+type gate struct {
+	fuse.RawFileSystem
+	readBytes, writeBytes, readOps, writeOps *bucket
+}
+
+func (g *gate) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	if !g.readOps.wait(1, cancel) || !g.readBytes.wait(float64(input.Size), cancel) {
+		return nil, fuse.EINTR
+	}
+	return g.RawFileSystem.Read(cancel, input, buf)
+}
+
+func (g *gate) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	if !g.writeOps.wait(1, cancel) || !g.writeBytes.wait(float64(len(data)), cancel) {
+		return 0, fuse.EINTR
+	}
+	return g.RawFileSystem.Write(cancel, input, data)
+}
+
+// CopyFileRange reads and writes, so it counts against both limits
+func (g *gate) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	n := float64(input.Len)
+	if !g.readOps.wait(1, cancel) || !g.readBytes.wait(n, cancel) ||
+		!g.writeOps.wait(1, cancel) || !g.writeBytes.wait(n, cancel) {
+		return 0, fuse.EINTR
+	}
+	return g.RawFileSystem.CopyFileRange(cancel, input)
+}
@@ -0,0 +1,47 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	b := newBucket(1000)
+	now := time.Unix(1000, 0)
+	// The first second worth of tokens is available at once
+	if d := b.reserve(1000, now); d != 0 {
+		t.Errorf("burst: waiting %v", d)
+	}
+	if d := b.reserve(500, now); d != 500*time.Millisecond {
+		t.Errorf("empty bucket: waiting %v", d)
+	}
+	// Half a second later, the debt has been paid off
+	now = now.Add(500 * time.Millisecond)
+	if d := b.reserve(100, now); d != 100*time.Millisecond {
+		t.Errorf("after refill: waiting %v", d)
+	}
+	// Large requests go into debt instead of blocking forever
+	now = now.Add(time.Hour)
+	if d := b.reserve(3000, now); d != 2*time.Second {
+		t.Errorf("large request: waiting %v", d)
+	}
+}
+
+func TestNilBucket(t *testing.T) {
+	var b *bucket = newBucket(0)
+	if !b.wait(1e12, nil) {
+		t.Error("unlimited bucket blocked")
+	}
+}
+
+func TestWaitCancel(t *testing.T) {
+	b := newBucket(1)
+	cancel := make(chan struct{})
+	close(cancel)
+	if !b.wait(1, cancel) {
+		t.Error("first token was not available")
+	}
+	if b.wait(1, cancel) {
+		t.Error("wait was not canceled")
+	}
+}
@@ -0,0 +1,92 @@
+package tlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// jsonOutput is set by SwitchToJSON()
+var jsonOutput bool
+
+// Fields are additional keys of a log record, like "op", "errno" or
+// "duration". Errors are converted to their message, syscall.Errno to its
+// number.
+type Fields map[string]interface{}
+
+// text formats the fields as " key=value" pairs, sorted by key
+func (f Fields) text() string {
+	if len(f) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, f[k])
+	}
+	return b.String()
+}
+
+// SwitchToJSON makes all loggers write one JSON object per message, like
+//
+//	{"level":"warn","msg":"...","time":"2021-05-08T15:16:21.123Z"}
+//
+// Called for "-log-format=json". The messages of the go-fuse library,
+// which uses the default log.Logger, are converted as well.
+func SwitchToJSON() {
+	jsonOutput = true
+	for _, l := range []*toggledLogger{Debug, Info, Warn, Fatal} {
+		// No colors
+		l.prefix = ""
+		l.postfix = ""
+	}
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(&stdlogWriter{out: os.Stderr})
+}
+
+// jsonRecord returns the JSON object for one message
+func jsonRecord(level string, msg string, f Fields) string {
+	rec := make(map[string]interface{}, len(f)+3)
+	for k, v := range f {
+		switch e := v.(type) {
+		case syscall.Errno:
+			v = int(e)
+		case error:
+			v = e.Error()
+		}
+		rec[k] = v
+	}
+	rec["level"] = level
+	rec["msg"] = msg
+	rec["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	b, err := json.Marshal(rec)
+	if err != nil {
+		// Cannot happen for the types we log, but don't lose the message
+		b, _ = json.Marshal(map[string]string{"level": level, "msg": msg, "error": err.Error()})
+	}
+	return string(b)
+}
+
+// stdlogWriter converts the output of the default log.Logger to JSON records
+type stdlogWriter struct {
+	out io.Writer
+}
+
+func (w *stdlogWriter) Write(p []byte) (int, error) {
+	rec := jsonRecord("warn", trimNewline(string(p)), Fields{"source": "go-fuse"})
+	if _, err := io.WriteString(w.out, rec+"\n"); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -1,5 +1,14 @@
 // Package tlog is a "toggled logger" that can be enabled and disabled and
 // provides coloring.
+//
+// The loggers are process-wide. Several filesystems mounted in one process
+// through the library API share their output, including the syslog, JSON
+// and redaction settings. Only the gocryptfs command changes these settings,
+// and only before the filesystem is mounted or on SIGHUP.
+//
+// The file system operations of a mount log through its own Loggers, which
+// are enabled and disabled separately. Everything else, like the crypto and
+// name transform packages, uses the process-wide Debug and Info loggers.
 package tlog
 
 import (
@@ -53,6 +62,10 @@ type toggledLogger struct {
 	// Private prefix and postfix are used for coloring
 	prefix  string
 	postfix string
+	// level is reported in JSON records, see SwitchToJSON()
+	level string
+	// parent writes the messages of the loggers in Loggers
+	parent *toggledLogger
 
 	Logger *log.Logger
 }
@@ -69,21 +82,36 @@ func trimNewline(msg string) string {
 }
 
 func (l *toggledLogger) Printf(format string, v ...interface{}) {
+	l.PrintfWith(nil, format, v...)
+}
+
+func (l *toggledLogger) Println(v ...interface{}) {
 	if !l.Enabled {
 		return
 	}
-	msg := trimNewline(fmt.Sprintf(format, v...))
-	l.Logger.Printf(l.prefix + msg + l.postfix)
-	if l.Wpanic {
-		l.Logger.Panic(wpanicMsg + msg)
-	}
+	l.output(trimNewline(fmt.Sprint(v...)), nil)
 }
-func (l *toggledLogger) Println(v ...interface{}) {
+
+// PrintfWith is Printf with additional fields. They become separate keys
+// of the JSON record, or are appended as "key=value" to the text message.
+func (l *toggledLogger) PrintfWith(f Fields, format string, v ...interface{}) {
 	if !l.Enabled {
 		return
 	}
-	msg := trimNewline(fmt.Sprint(v...))
-	l.Logger.Println(l.prefix + msg + l.postfix)
+	l.output(trimNewline(fmt.Sprintf(format, v...)), f)
+}
+
+// output writes one message
+func (l *toggledLogger) output(msg string, f Fields) {
+	if l.parent != nil {
+		l.parent.output(msg, f)
+		return
+	}
+	if jsonOutput {
+		l.Logger.Print(jsonRecord(l.level, msg, f))
+	} else {
+		l.Logger.Print(l.prefix + msg + f.text() + l.postfix)
+	}
 	if l.Wpanic {
 		l.Logger.Panic(wpanicMsg + msg)
 	}
@@ -116,25 +144,51 @@ func init() {
 
 	Debug = &toggledLogger{
 		Logger: log.New(os.Stdout, "", 0),
+		level:  "debug",
 	}
 	Info = &toggledLogger{
 		Enabled: true,
 		Logger:  log.New(os.Stdout, "", 0),
+		level:   "info",
 	}
 	Warn = &toggledLogger{
 		Enabled: true,
 		Logger:  log.New(os.Stderr, "", 0),
 		prefix:  ColorYellow,
 		postfix: ColorReset,
+		level:   "warn",
 	}
 	Fatal = &toggledLogger{
 		Enabled: true,
 		Logger:  log.New(os.Stderr, "", 0),
 		prefix:  ColorRed,
 		postfix: ColorReset,
+		level:   "fatal",
+	}
+}
+
+// Loggers are the Debug and Info loggers of one mounted filesystem. They
+// write through the process-wide loggers, but are enabled and disabled
+// separately.
+type Loggers struct {
+	Debug *toggledLogger
+	Info  *toggledLogger
+}
+
+// NewLoggers returns Loggers with Debug and Info enabled as requested.
+func NewLoggers(debug bool, info bool) *Loggers {
+	return &Loggers{
+		Debug: &toggledLogger{Enabled: debug, parent: Debug},
+		Info:  &toggledLogger{Enabled: info, parent: Info},
 	}
 }
 
+// ProcessLoggers returns the process-wide Debug and Info loggers as
+// Loggers. Used by the gocryptfs command, which mounts only one filesystem.
+func ProcessLoggers() *Loggers {
+	return &Loggers{Debug: Debug, Info: Info}
+}
+
 // SwitchToSyslog redirects the output of this logger to syslog.
 // p = facility | severity
 func (l *toggledLogger) SwitchToSyslog(p syslog.Priority) {
@@ -156,6 +210,8 @@ func SwitchLoggerToSyslog() {
 	w, err := syslog.New(p, ProgramName)
 	if err != nil {
 		Warn.Printf("SwitchLoggerToSyslog: %v", err)
+	} else if jsonOutput {
+		log.SetOutput(&stdlogWriter{out: w})
 	} else {
 		log.SetPrefix("go-fuse: ")
 		// Disable printing the timestamp, syslog already provides that
@@ -0,0 +1,79 @@
+package tlog
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Redaction levels for "-log-redact"
+const (
+	// RedactOff logs all file names as they are
+	RedactOff = iota
+	// RedactPaths replaces plaintext file names and paths by a hash
+	RedactPaths
+	// RedactFull replaces ciphertext file names and paths by a hash as well
+	RedactFull
+)
+
+// redactLevel is set by SetRedact()
+var redactLevel = RedactOff
+
+// redactKey makes the hashes unpredictable, so short names cannot be
+// guessed. It is random, so hashes are only comparable within one process.
+var redactKey []byte
+
+// SetRedact sets the redaction level, one of RedactOff, RedactPaths and
+// RedactFull. Called for "-log-redact" before anything is logged.
+func SetRedact(level int) {
+	redactLevel = level
+	if level != RedactOff && redactKey == nil {
+		redactKey = make([]byte, 32)
+		if _, err := rand.Read(redactKey); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// ParseRedact parses the "-log-redact" value "off", "paths" or "full"
+func ParseRedact(s string) (int, error) {
+	switch s {
+	case "off":
+		return RedactOff, nil
+	case "paths":
+		return RedactPaths, nil
+	case "full":
+		return RedactFull, nil
+	}
+	return 0, fmt.Errorf("invalid -log-redact value %q, must be off, paths or full", s)
+}
+
+// PlainName wraps a plaintext file name or path that is passed to a logger.
+// It is replaced by a hash if "-log-redact" is "paths" or "full".
+type PlainName string
+
+func (p PlainName) String() string {
+	return redact(string(p), RedactPaths)
+}
+
+// CipherName wraps a ciphertext file name or path that is passed to a
+// logger. It is replaced by a hash if "-log-redact" is "full".
+type CipherName string
+
+func (c CipherName) String() string {
+	return redact(string(c), RedactFull)
+}
+
+// redact returns "name" unchanged if the redaction level is below "level",
+// otherwise a hash like "<redacted:1f2e3d4c5b6a7988>". The same name always
+// gives the same hash, so log messages can still be correlated.
+func redact(name string, level int) string {
+	if redactLevel < level || name == "" {
+		return name
+	}
+	h := hmac.New(sha256.New, redactKey)
+	h.Write([]byte(name))
+	return "<redacted:" + hex.EncodeToString(h.Sum(nil)[:8]) + ">"
+}
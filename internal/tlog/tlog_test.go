@@ -1,6 +1,12 @@
 package tlog
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -24,3 +30,72 @@ func TestTrimNewline(t *testing.T) {
 		}
 	}
 }
+
+func TestJSONRecord(t *testing.T) {
+	rec := jsonRecord("warn", "line 1\nline 2", Fields{"op": "READ", "errno": syscall.EIO, "err": errors.New("boom")})
+	if strings.Contains(rec, "\n") {
+		t.Errorf("record must be a single line: %q", rec)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(rec), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["level"] != "warn" || m["msg"] != "line 1\nline 2" || m["op"] != "READ" ||
+		m["errno"] != float64(syscall.EIO) || m["err"] != "boom" {
+		t.Errorf("wrong record: %s", rec)
+	}
+}
+
+func TestFieldsText(t *testing.T) {
+	if s := (Fields{"b": 2, "a": "x"}).text(); s != " a=x b=2" {
+		t.Errorf("have %q", s)
+	}
+	if s := Fields(nil).text(); s != "" {
+		t.Errorf("have %q", s)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	defer SetRedact(RedactOff)
+	name := "secret.txt"
+	if s := fmt.Sprintf("%q %s", PlainName(name), CipherName(name)); s != `"secret.txt" secret.txt` {
+		t.Errorf("off: %s", s)
+	}
+	SetRedact(RedactPaths)
+	p := fmt.Sprintf("%s", PlainName(name))
+	if strings.Contains(p, name) || !strings.HasPrefix(p, "<redacted:") {
+		t.Errorf("paths: %s", p)
+	}
+	if p2 := fmt.Sprint(PlainName(name)); p2 != p {
+		t.Errorf("hash is not stable: %s != %s", p, p2)
+	}
+	if c := fmt.Sprint(CipherName(name)); c != name {
+		t.Errorf("paths: cipher name should not be redacted: %s", c)
+	}
+	SetRedact(RedactFull)
+	if c := fmt.Sprint(CipherName(name)); c != p {
+		t.Errorf("full: %s", c)
+	}
+	if _, err := ParseRedact("bogus"); err == nil {
+		t.Error("ParseRedact should fail")
+	}
+}
+
+func TestLoggers(t *testing.T) {
+	var buf bytes.Buffer
+	oldOut := Info.Logger.Writer()
+	oldEnabled := Info.Enabled
+	Info.Logger.SetOutput(&buf)
+	Info.Enabled = false
+	defer func() {
+		Info.Logger.SetOutput(oldOut)
+		Info.Enabled = oldEnabled
+	}()
+	a := NewLoggers(false, true)
+	b := NewLoggers(false, false)
+	a.Info.Printf("from a")
+	b.Info.Printf("from b")
+	if s := buf.String(); !strings.Contains(s, "from a") || strings.Contains(s, "from b") {
+		t.Errorf("wrong output: %q", s)
+	}
+}
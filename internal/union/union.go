@@ -0,0 +1,608 @@
+// Package union merges several gocryptfs filesystems ("branches") into one
+// tree, like a simple overlay filesystem.
+//
+// Branches are ordered by precedence. If a path exists in several branches,
+// the first branch wins, and directories are merged. Only the first branch
+// is written to: creating a file or directory anywhere in the tree creates it
+// in the first branch, and files from other branches are copied up to the
+// first branch before they are modified. Deleting or renaming files that
+// exist in a lower branch is not supported (there are no whiteouts) and
+// returns EROFS and EXDEV, respectively.
+//
+// The branches are ordinary go-fuse node trees (usually fusefrontend
+// RootNodes) that are never mounted themselves. The union nodes resolve
+// their path in each branch on demand and delegate the operation. The
+// branch inodes are attached to the branch trees so that their Path() works,
+// and the trees are pruned when they grow beyond maxBranchNodes.
+package union
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// maxBranchNodes is the number of inodes that may be attached to the branch
+// trees before they are pruned
+const maxBranchNodes = 10000
+
+// Node is a file or directory in the union tree.
+type Node struct {
+	fs.Inode
+}
+
+// RootNode is the root of the union tree.
+type RootNode struct {
+	Node
+	// branches holds the root inodes of the branches, highest precedence
+	// first.
+	branches []*fs.Inode
+	// treeLock is read-locked by operations that use the branch trees and
+	// write-locked while the trees are pruned
+	treeLock sync.RWMutex
+	// attached counts the inodes attached to the branch trees since the
+	// last pruning
+	attached int64
+}
+
+// NewRootNode returns a union of "branches", highest precedence first.
+// New files are created in branches[0].
+func NewRootNode(branches []fs.InodeEmbedder) *RootNode {
+	rn := &RootNode{}
+	for _, b := range branches {
+		// Initialize the go-fuse inode tree of the branch without mounting it
+		fs.NewNodeFS(b, &fs.Options{})
+		rn.branches = append(rn.branches, b.EmbeddedInode())
+	}
+	return rn
+}
+
+// Top returns the root of the writable branch.
+func (rn *RootNode) Top() fs.InodeEmbedder {
+	return rn.branches[0].Operations()
+}
+
+// toNode casts a generic fs.InodeEmbedder into *Node. Also handles *RootNode
+// by return rn.Node.
+func toNode(op fs.InodeEmbedder) *Node {
+	if r, ok := op.(*RootNode); ok {
+		return &r.Node
+	}
+	return op.(*Node)
+}
+
+// rootNode returns the union RootNode.
+func (n *Node) rootNode() *RootNode {
+	return n.Root().Operations().(*RootNode)
+}
+
+// relPath returns the path of "name" inside this directory, relative to the
+// root of the union.
+func (n *Node) relPath(name string) string {
+	return path.Join(n.Path(n.Root()), name)
+}
+
+// lockTrees read-locks the branch trees for the duration of an operation and
+// returns the unlock function. Prunes the trees first if they have grown too
+// big, which makes the next operations look up the paths again.
+func (rn *RootNode) lockTrees() func() {
+	if atomic.LoadInt64(&rn.attached) > maxBranchNodes {
+		rn.treeLock.Lock()
+		if atomic.LoadInt64(&rn.attached) > maxBranchNodes {
+			tlog.Debug.Printf("union: pruning branch trees")
+			for _, b := range rn.branches {
+				for name := range b.Children() {
+					b.RmChild(name)
+				}
+			}
+			atomic.StoreInt64(&rn.attached, 0)
+		}
+		rn.treeLock.Unlock()
+	}
+	rn.treeLock.RLock()
+	return rn.treeLock.RUnlock
+}
+
+// attach adds "ch" as "name" to the branch directory "parent"
+func (rn *RootNode) attach(parent *fs.Inode, name string, ch *fs.Inode) {
+	parent.AddChild(name, ch, true)
+	atomic.AddInt64(&rn.attached, 1)
+}
+
+// branchNode returns the inode for relative path "relPath" in branch "i".
+// Returns ENOENT if the path does not exist in the branch.
+func (rn *RootNode) branchNode(ctx context.Context, i int, relPath string) (*fs.Inode, syscall.Errno) {
+	cur := rn.branches[i]
+	if relPath == "" || relPath == "." {
+		return cur, 0
+	}
+	for _, name := range strings.Split(relPath, "/") {
+		if ch := cur.GetChild(name); ch != nil {
+			cur = ch
+			continue
+		}
+		l, ok := cur.Operations().(fs.NodeLookuper)
+		if !ok {
+			return nil, syscall.ENOENT
+		}
+		var out fuse.EntryOut
+		ch, errno := l.Lookup(ctx, name, &out)
+		if errno != 0 {
+			return nil, errno
+		}
+		// Attach the child so that its Path() works
+		rn.attach(cur, name, ch)
+		cur = ch
+	}
+	return cur, 0
+}
+
+// find returns the branch index and inode of the highest-precedence branch
+// that has "relPath".
+func (rn *RootNode) find(ctx context.Context, relPath string) (int, *fs.Inode, syscall.Errno) {
+	for i := range rn.branches {
+		in, errno := rn.branchNode(ctx, i, relPath)
+		if errno == 0 {
+			return i, in, 0
+		}
+		if errno != syscall.ENOENT {
+			return -1, nil, errno
+		}
+	}
+	return -1, nil, syscall.ENOENT
+}
+
+// inLowerBranch returns true if "relPath" exists in any branch except the
+// first one.
+func (rn *RootNode) inLowerBranch(ctx context.Context, relPath string) bool {
+	for i := 1; i < len(rn.branches); i++ {
+		if _, errno := rn.branchNode(ctx, i, relPath); errno == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// forget drops "relPath" from the cached inode tree of branch "i" after it
+// has been deleted or renamed.
+func (rn *RootNode) forget(i int, relPath string) {
+	parent, errno := rn.branchNode(context.Background(), i, path.Dir(relPath))
+	if errno != 0 {
+		return
+	}
+	parent.RmChild(path.Base(relPath))
+}
+
+// newChild creates a union inode for an entry whose attributes are in "out".
+// Inode numbers of different branches may collide, so we let go-fuse
+// assign unique ones.
+func (n *Node) newChild(ctx context.Context, out *fuse.EntryOut) *fs.Inode {
+	out.Ino = 0
+	id := fs.StableAttr{
+		Mode: out.Attr.Mode & syscall.S_IFMT,
+	}
+	return n.NewInode(ctx, &Node{}, id)
+}
+
+// getattr fills "out" with the attributes of branch inode "in".
+func getattr(ctx context.Context, in *fs.Inode, out *fuse.AttrOut) syscall.Errno {
+	g, ok := in.Operations().(fs.NodeGetattrer)
+	if !ok {
+		return syscall.ENOSYS
+	}
+	errno := g.Getattr(ctx, nil, out)
+	out.Ino = 0
+	return errno
+}
+
+// Lookup - FUSE call for discovering a file.
+func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	rn := n.rootNode()
+	defer rn.lockTrees()()
+	_, in, errno := rn.find(ctx, n.relPath(name))
+	if errno != 0 {
+		return nil, errno
+	}
+	var a fuse.AttrOut
+	if errno = getattr(ctx, in, &a); errno != 0 {
+		return nil, errno
+	}
+	out.Attr = a.Attr
+	return n.newChild(ctx, out), 0
+}
+
+// Getattr - FUSE call for stat()ing a file.
+func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	// The file handle belongs to the branch the file was opened in
+	if fg, ok := f.(fs.FileGetattrer); ok {
+		errno := fg.Getattr(ctx, out)
+		out.Ino = 0
+		return errno
+	}
+	rn := n.rootNode()
+	defer rn.lockTrees()()
+	_, in, errno := rn.find(ctx, n.relPath(""))
+	if errno != 0 {
+		return errno
+	}
+	return getattr(ctx, in, out)
+}
+
+// Setattr - FUSE call for chmod, truncate, utimens etc.
+// Files from lower branches are copied up first.
+func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if fset, ok := f.(fs.FileSetattrer); ok {
+		errno := fset.Setattr(ctx, in, out)
+		out.Ino = 0
+		return errno
+	}
+	rn := n.rootNode()
+	defer rn.lockTrees()()
+	top, errno := rn.copyUp(ctx, n.relPath(""))
+	if errno != 0 {
+		return errno
+	}
+	s, ok := top.Operations().(fs.NodeSetattrer)
+	if !ok {
+		return syscall.ENOSYS
+	}
+	errno = s.Setattr(ctx, nil, in, out)
+	out.Ino = 0
+	return errno
+}
+
+// Readlink - FUSE call.
+func (n *Node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	defer n.rootNode().lockTrees()()
+	_, in, errno := n.rootNode().find(ctx, n.relPath(""))
+	if errno != 0 {
+		return nil, errno
+	}
+	r, ok := in.Operations().(fs.NodeReadlinker)
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+	return r.Readlink(ctx)
+}
+
+// Open - FUSE call. Files from lower branches are copied up first if they
+// are opened for writing.
+func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	rn := n.rootNode()
+	defer rn.lockTrees()()
+	relPath := n.relPath("")
+	var in *fs.Inode
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		in, errno = rn.copyUp(ctx, relPath)
+	} else {
+		_, in, errno = rn.find(ctx, relPath)
+	}
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	o, ok := in.Operations().(fs.NodeOpener)
+	if !ok {
+		return nil, 0, syscall.ENOSYS
+	}
+	return o.Open(ctx, flags)
+}
+
+// Readdir - FUSE call. Merges the directory contents of all branches.
+func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	rn := n.rootNode()
+	defer rn.lockTrees()()
+	relPath := n.relPath("")
+	seen := make(map[string]bool)
+	var entries []fuse.DirEntry
+	found := false
+	for i := range rn.branches {
+		in, errno := rn.branchNode(ctx, i, relPath)
+		if errno != 0 || !in.IsDir() {
+			continue
+		}
+		r, ok := in.Operations().(fs.NodeReaddirer)
+		if !ok {
+			continue
+		}
+		ds, errno := r.Readdir(ctx)
+		if errno != 0 {
+			return nil, errno
+		}
+		found = true
+		for ds.HasNext() {
+			e, errno := ds.Next()
+			if errno != 0 {
+				ds.Close()
+				return nil, errno
+			}
+			if seen[e.Name] {
+				continue
+			}
+			seen[e.Name] = true
+			e.Ino = 0
+			entries = append(entries, e)
+		}
+		ds.Close()
+	}
+	if !found {
+		return nil, syscall.ENOENT
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+// Statfs - FUSE call. Reports the writable branch.
+func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	s, ok := n.rootNode().Top().(fs.NodeStatfser)
+	if !ok {
+		return syscall.ENOSYS
+	}
+	return s.Statfs(ctx, out)
+}
+
+// topParent makes sure this directory exists in the writable branch and
+// returns it there.
+func (n *Node) topParent(ctx context.Context) (*fs.Inode, syscall.Errno) {
+	return n.rootNode().copyUp(ctx, n.relPath(""))
+}
+
+// Create - FUSE call. Creates the file in the writable branch.
+func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	defer n.rootNode().lockTrees()()
+	parent, errno := n.topParent(ctx)
+	if errno != 0 {
+		return
+	}
+	c, ok := parent.Operations().(fs.NodeCreater)
+	if !ok {
+		return nil, nil, 0, syscall.EROFS
+	}
+	ch, fh, fuseFlags, errno := c.Create(ctx, name, flags, mode, out)
+	if errno != 0 {
+		return
+	}
+	n.rootNode().attach(parent, name, ch)
+	return n.newChild(ctx, out), fh, fuseFlags, 0
+}
+
+// Mkdir - FUSE call. Creates the directory in the writable branch.
+func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	defer n.rootNode().lockTrees()()
+	parent, errno := n.topParent(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	m, ok := parent.Operations().(fs.NodeMkdirer)
+	if !ok {
+		return nil, syscall.EROFS
+	}
+	ch, errno := m.Mkdir(ctx, name, mode, out)
+	if errno != 0 {
+		return nil, errno
+	}
+	n.rootNode().attach(parent, name, ch)
+	return n.newChild(ctx, out), 0
+}
+
+// Symlink - FUSE call. Creates the symlink in the writable branch.
+func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	defer n.rootNode().lockTrees()()
+	parent, errno := n.topParent(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	s, ok := parent.Operations().(fs.NodeSymlinker)
+	if !ok {
+		return nil, syscall.EROFS
+	}
+	ch, errno := s.Symlink(ctx, target, name, out)
+	if errno != 0 {
+		return nil, errno
+	}
+	n.rootNode().attach(parent, name, ch)
+	return n.newChild(ctx, out), 0
+}
+
+// Unlink - FUSE call. Only files that exist exclusively in the writable
+// branch can be deleted.
+func (n *Node) Unlink(ctx context.Context, name string) syscall.Errno {
+	return n.remove(ctx, name, false)
+}
+
+// Rmdir - FUSE call. Only directories that exist exclusively in the
+// writable branch can be deleted.
+func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return n.remove(ctx, name, true)
+}
+
+func (n *Node) remove(ctx context.Context, name string, dir bool) syscall.Errno {
+	rn := n.rootNode()
+	defer rn.lockTrees()()
+	relPath := n.relPath(name)
+	if rn.inLowerBranch(ctx, relPath) {
+		return syscall.EROFS
+	}
+	parent, errno := rn.branchNode(ctx, 0, n.relPath(""))
+	if errno != 0 {
+		return errno
+	}
+	if dir {
+		r, ok := parent.Operations().(fs.NodeRmdirer)
+		if !ok {
+			return syscall.EROFS
+		}
+		errno = r.Rmdir(ctx, name)
+	} else {
+		u, ok := parent.Operations().(fs.NodeUnlinker)
+		if !ok {
+			return syscall.EROFS
+		}
+		errno = u.Unlink(ctx, name)
+	}
+	if errno == 0 {
+		rn.forget(0, relPath)
+	}
+	return errno
+}
+
+// Rename - FUSE call. Only files that exist exclusively in the writable
+// branch can be renamed. For other files, we return EXDEV, which makes
+// mv(1) fall back to copy & delete. RENAME_NOREPLACE and RENAME_EXCHANGE
+// are passed to the writable branch.
+func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	rn := n.rootNode()
+	defer rn.lockTrees()()
+	oldPath := n.relPath(name)
+	n2 := toNode(newParent)
+	if rn.inLowerBranch(ctx, oldPath) {
+		return syscall.EXDEV
+	}
+	newPath := n2.relPath(newName)
+	if rn.inLowerBranch(ctx, newPath) {
+		if flags&syscallcompat.RENAME_NOREPLACE != 0 {
+			return syscall.EEXIST
+		}
+		// Overwriting or exchanging a lower-branch file would make it
+		// reappear after the next delete
+		return syscall.EXDEV
+	}
+	parent, errno := rn.branchNode(ctx, 0, n.relPath(""))
+	if errno != 0 {
+		return errno
+	}
+	parent2, errno := n2.topParent(ctx)
+	if errno != 0 {
+		return errno
+	}
+	r, ok := parent.Operations().(fs.NodeRenamer)
+	if !ok {
+		return syscall.EROFS
+	}
+	errno = r.Rename(ctx, name, parent2.Operations(), newName, flags)
+	if errno == 0 {
+		rn.forget(0, oldPath)
+		rn.forget(0, newPath)
+	}
+	return errno
+}
+
+// copyUp makes sure that "relPath" exists in the writable branch by copying
+// it (and its parent directories) from the highest-precedence branch that has
+// it. Returns the inode in the writable branch.
+func (rn *RootNode) copyUp(ctx context.Context, relPath string) (*fs.Inode, syscall.Errno) {
+	i, in, errno := rn.find(ctx, relPath)
+	if errno != 0 {
+		return nil, errno
+	}
+	if i == 0 {
+		return in, 0
+	}
+	parent, errno := rn.copyUp(ctx, path.Dir(relPath))
+	if errno != 0 {
+		return nil, errno
+	}
+	var a fuse.AttrOut
+	if errno = getattr(ctx, in, &a); errno != 0 {
+		return nil, errno
+	}
+	name := path.Base(relPath)
+	mode := a.Attr.Mode
+	tlog.Debug.Printf("union: copying up %q from branch %d", tlog.PlainName(relPath), i)
+	var out fuse.EntryOut
+	var ch *fs.Inode
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		m, ok := parent.Operations().(fs.NodeMkdirer)
+		if !ok {
+			return nil, syscall.EROFS
+		}
+		ch, errno = m.Mkdir(ctx, name, mode&07777, &out)
+	case syscall.S_IFLNK:
+		r, ok := in.Operations().(fs.NodeReadlinker)
+		s, ok2 := parent.Operations().(fs.NodeSymlinker)
+		if !ok || !ok2 {
+			return nil, syscall.EROFS
+		}
+		var target []byte
+		target, errno = r.Readlink(ctx)
+		if errno != 0 {
+			return nil, errno
+		}
+		ch, errno = s.Symlink(ctx, string(target), name, &out)
+	case syscall.S_IFREG:
+		ch, errno = copyUpFile(ctx, in, parent, name, mode&07777)
+	default:
+		return nil, syscall.EROFS
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	rn.attach(parent, name, ch)
+	return ch, 0
+}
+
+// copyUpFile copies the content of regular file "in" to a new file "name" in
+// directory "parent". If the copy fails, the incomplete file is deleted, as
+// it would hide the intact file in the lower branch.
+func copyUpFile(ctx context.Context, in *fs.Inode, parent *fs.Inode, name string, mode uint32) (ch *fs.Inode, errno syscall.Errno) {
+	o, ok := in.Operations().(fs.NodeOpener)
+	c, ok2 := parent.Operations().(fs.NodeCreater)
+	u, ok3 := parent.Operations().(fs.NodeUnlinker)
+	if !ok || !ok2 || !ok3 {
+		return nil, syscall.EROFS
+	}
+	src, _, errno := o.Open(ctx, syscall.O_RDONLY)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer src.(fs.FileReleaser).Release(ctx)
+	var out fuse.EntryOut
+	ch, dst, _, errno := c.Create(ctx, name, syscall.O_RDWR|syscall.O_EXCL, mode, &out)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer func() {
+		if errno2 := dst.(fs.FileReleaser).Release(ctx); errno == 0 {
+			errno = errno2
+		}
+		if errno != 0 {
+			tlog.Warn.Printf("union: copying up %q failed: %v", tlog.PlainName(name), errno)
+			u.Unlink(ctx, name)
+			ch = nil
+		}
+	}()
+	r := src.(fs.FileReader)
+	w := dst.(fs.FileWriter)
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	var off int64
+	for {
+		res, errno := r.Read(ctx, buf, off)
+		if errno != 0 {
+			return nil, errno
+		}
+		data, status := res.Bytes(buf)
+		if !status.Ok() {
+			return nil, syscall.EIO
+		}
+		if len(data) == 0 {
+			break
+		}
+		n, errno := w.Write(ctx, data, off)
+		if errno != 0 {
+			return nil, errno
+		}
+		if int(n) != len(data) {
+			return nil, syscall.EIO
+		}
+		off += int64(len(data))
+	}
+	return ch, 0
+}
@@ -0,0 +1,156 @@
+package union
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/syscallcompat"
+)
+
+// newBranch returns a fusefrontend RootNode with plaintext names on top
+// of a new temporary directory.
+func newBranch(t *testing.T) (*fusefrontend.RootNode, string) {
+	dir, err := ioutil.TempDir("", "union_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false)
+	n := nametransform.New(cCore.EMECipher, true, true)
+	args := fusefrontend.Args{Cipherdir: dir, PlaintextNames: true}
+	return fusefrontend.NewRootNode(args, cEnc, n), dir
+}
+
+func create(t *testing.T, parent fs.NodeCreater, name string, content string) {
+	ctx := context.Background()
+	var out fuse.EntryOut
+	_, fh, _, errno := parent.Create(ctx, name, syscall.O_RDWR, 0600, &out)
+	if errno != 0 {
+		t.Fatalf("Create %q: %v", name, errno)
+	}
+	if _, errno = fh.(fs.FileWriter).Write(ctx, []byte(content), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(fs.FileReleaser).Release(ctx)
+}
+
+func TestUnion(t *testing.T) {
+	ctx := context.Background()
+	top, topDir := newBranch(t)
+	defer os.RemoveAll(topDir)
+	lower, lowerDir := newBranch(t)
+	defer os.RemoveAll(lowerDir)
+
+	rn := NewRootNode([]fs.InodeEmbedder{top, lower})
+	fs.NewNodeFS(rn, &fs.Options{})
+
+	create(t, top, "both", "top")
+	create(t, lower, "both", "lower!")
+	create(t, lower, "lower", "lower")
+
+	// Merged listing without duplicates
+	ds, errno := rn.Readdir(ctx)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	names := map[string]int{}
+	for ds.HasNext() {
+		e, _ := ds.Next()
+		names[e.Name]++
+	}
+	delete(names, ".")
+	delete(names, "..")
+	if len(names) != 2 || names["both"] != 1 || names["lower"] != 1 {
+		t.Errorf("wrong listing: %v", names)
+	}
+	// Top branch has precedence
+	var out fuse.EntryOut
+	if _, errno = rn.Lookup(ctx, "both", &out); errno != 0 || out.Size != 3 {
+		t.Errorf("Lookup both: size=%d errno=%v", out.Size, errno)
+	}
+	// Deleting a lower-branch file is not supported
+	if errno = rn.Unlink(ctx, "lower"); errno != syscall.EROFS {
+		t.Errorf("want EROFS, got %v", errno)
+	}
+	// Opening for writing copies up
+	ch, errno := rn.Lookup(ctx, "lower", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("lower", ch, true)
+	fh, _, errno := ch.Operations().(*Node).Open(ctx, syscall.O_RDWR)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(fs.FileReleaser).Release(ctx)
+	if _, errno = top.Lookup(ctx, "lower", &out); errno != 0 || out.Size != 5 {
+		t.Errorf("copy-up failed: size=%d errno=%v", out.Size, errno)
+	}
+	// New files go to the top branch
+	create(t, rn, "new", "new")
+	if _, err := os.Stat(filepath.Join(topDir, "new")); err != nil {
+		t.Error(err)
+	}
+	// ... and can be deleted again
+	if errno = rn.Unlink(ctx, "new"); errno != 0 {
+		t.Error(errno)
+	}
+}
+
+func TestCopyUpFailure(t *testing.T) {
+	ctx := context.Background()
+	top, topDir := newBranch(t)
+	defer os.RemoveAll(topDir)
+	lower, lowerDir := newBranch(t)
+	defer os.RemoveAll(lowerDir)
+
+	rn := NewRootNode([]fs.InodeEmbedder{top, lower})
+	fs.NewNodeFS(rn, &fs.Options{})
+	create(t, lower, "lower", "lower")
+	// A file that cannot be decrypted
+	if err := ioutil.WriteFile(filepath.Join(lowerDir, "bad"), make([]byte, 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var out fuse.EntryOut
+	ch, errno := rn.Lookup(ctx, "bad", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("bad", ch, true)
+	if _, _, errno = ch.Operations().(*Node).Open(ctx, syscall.O_RDWR); errno == 0 {
+		t.Fatal("copy-up of a corrupt file should have failed")
+	}
+	// The incomplete copy must not hide the lower file
+	if _, err := os.Stat(filepath.Join(topDir, "bad")); !os.IsNotExist(err) {
+		t.Errorf("incomplete copy was left behind: %v", err)
+	}
+	// Renaming onto a lower-branch file with RENAME_NOREPLACE
+	create(t, rn, "new", "new")
+	if errno = rn.Rename(ctx, "new", rn, "lower", syscallcompat.RENAME_NOREPLACE); errno != syscall.EEXIST {
+		t.Errorf("RENAME_NOREPLACE: want EEXIST, got %v", errno)
+	}
+	// Pruning empties the branch trees
+	if len(rn.branches[1].Children()) == 0 {
+		t.Fatal("lower branch tree should not be empty")
+	}
+	rn.attached = maxBranchNodes + 1
+	rn.lockTrees()()
+	if len(rn.branches[0].Children()) != 0 || len(rn.branches[1].Children()) != 0 {
+		t.Error("branch trees were not pruned")
+	}
+	if _, errno = rn.Lookup(ctx, "lower", &out); errno != 0 {
+		t.Errorf("Lookup after pruning: %v", errno)
+	}
+}
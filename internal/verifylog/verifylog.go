@@ -0,0 +1,141 @@
+// Package verifylog writes the "-verify-mount" report: every file header or
+// block that fails authentication while the filesystem is read, and a summary
+// at unmount.
+package verifylog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// Log collects corrupt files and writes them to the report file
+type Log struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+	// headers is the set of files with a corrupt header
+	headers map[string]bool
+	// blocks is the set of corrupt blocks per file
+	blocks map[string]map[uint64]bool
+	// failed is set after the first write error, so the warning is printed
+	// only once
+	failed bool
+}
+
+// Open creates the report file "path" with mode 0600, truncating it if it
+// exists.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE|syscall.O_CLOEXEC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{
+		w:       f,
+		headers: make(map[string]bool),
+		blocks:  make(map[string]map[uint64]bool),
+	}, nil
+}
+
+// Header records that the file header of "path" failed to decrypt.
+// Repeated reports for the same file are only written once.
+func (l *Log) Header(path string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.headers[path] {
+		return
+	}
+	l.headers[path] = true
+	l.printf("corrupt: %s: header: %v\n", path, err)
+}
+
+// Block records that block "blockNo" of "path" failed to decrypt.
+// Repeated reports for the same block are only written once.
+func (l *Log) Block(path string, blockNo uint64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.blocks[path]
+	if b == nil {
+		b = make(map[uint64]bool)
+		l.blocks[path] = b
+	}
+	if b[blockNo] {
+		return
+	}
+	b[blockNo] = true
+	l.printf("corrupt: %s: block %d: %v\n", path, blockNo, err)
+}
+
+func (l *Log) printf(format string, a ...interface{}) {
+	_, err := fmt.Fprintf(l.w, format, a...)
+	if err != nil && !l.failed {
+		tlog.Warn.Printf("verify-mount: cannot write report: %v", err)
+	}
+	l.failed = err != nil
+}
+
+// Close writes the summary and closes the report file. The summary is also
+// logged.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	paths := make([]string, 0, len(l.blocks)+len(l.headers))
+	for p := range l.headers {
+		paths = append(paths, p)
+	}
+	nBlocks := 0
+	for p, b := range l.blocks {
+		if !l.headers[p] {
+			paths = append(paths, p)
+		}
+		nBlocks += len(b)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		l.printf("summary: %s:%s\n", p, l.describe(p))
+	}
+	summary := fmt.Sprintf("verify-mount summary: %d corrupt files, %d corrupt blocks", len(paths), nBlocks)
+	l.printf("%s\n", summary)
+	if len(paths) > 0 {
+		tlog.Warn.Printf("%s", summary)
+	} else {
+		tlog.Info.Printf("%s", summary)
+	}
+	return l.w.Close()
+}
+
+// describe returns " header" and/or the corrupt block ranges of "path" like
+// " blocks 3 5-7"
+func (l *Log) describe(path string) string {
+	var out string
+	if l.headers[path] {
+		out = " header"
+	}
+	b := l.blocks[path]
+	if len(b) == 0 {
+		return out
+	}
+	nos := make([]uint64, 0, len(b))
+	for no := range b {
+		nos = append(nos, no)
+	}
+	sort.Slice(nos, func(i, j int) bool { return nos[i] < nos[j] })
+	out += " blocks"
+	for i := 0; i < len(nos); {
+		j := i
+		for j+1 < len(nos) && nos[j+1] == nos[j]+1 {
+			j++
+		}
+		if i == j {
+			out += fmt.Sprintf(" %d", nos[i])
+		} else {
+			out += fmt.Sprintf(" %d-%d", nos[i], nos[j])
+		}
+		i = j + 1
+	}
+	return out
+}
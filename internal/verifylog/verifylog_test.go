@@ -0,0 +1,53 @@
+package verifylog
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verifylog_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/report"
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errAuth := errors.New("message authentication failed")
+	for _, no := range []uint64{7, 3, 5, 6, 5} {
+		l.Block("a/b", no, errAuth)
+	}
+	l.Header("c", errAuth)
+	l.Header("c", errAuth)
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, want 0600", st.Mode())
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `corrupt: a/b: block 7: message authentication failed
+corrupt: a/b: block 3: message authentication failed
+corrupt: a/b: block 5: message authentication failed
+corrupt: a/b: block 6: message authentication failed
+corrupt: c: header: message authentication failed
+summary: a/b: blocks 3 5-7
+summary: c: header
+verify-mount summary: 2 corrupt files, 4 corrupt blocks
+`
+	if string(got) != want {
+		t.Errorf("wrong report:\n%s", got)
+	}
+}
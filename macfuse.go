@@ -0,0 +1,34 @@
+package gocryptfs
+
+import (
+	"os"
+)
+
+// Where the FUSE implementations for MacOS install themselves. go-fuse looks
+// for the mount helpers of macFUSE and its predecessor osxfuse. FUSE-T
+// replaces the kernel extension by a local NFS server and is only usable
+// through its libfuse replacement, which go-fuse does not use.
+const (
+	macfuseLoad = "/Library/Filesystems/macfuse.fs/Contents/Resources/load_macfuse"
+	osxfuseLoad = "/Library/Filesystems/osxfuse.fs/Contents/Resources/load_osxfuse"
+	fuseTLib    = "/usr/local/lib/libfuse-t.dylib"
+)
+
+// macFuseHint returns advice for when mounting failed on MacOS, depending on
+// which FUSE implementation is installed.
+func macFuseHint() string {
+	exists := func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil
+	}
+	switch {
+	case exists(macfuseLoad):
+		return "Maybe you should run: " + macfuseLoad +
+			" . Also check that the macFUSE system extension is allowed in System Settings -> Privacy & Security."
+	case exists(osxfuseLoad):
+		return "Maybe you should run: " + osxfuseLoad
+	case exists(fuseTLib):
+		return "FUSE-T is installed, but gocryptfs needs macFUSE. Please install macFUSE from https://osxfuse.github.io/"
+	}
+	return "No FUSE implementation found. Please install macFUSE from https://osxfuse.github.io/"
+}
@@ -4,6 +4,7 @@
 package gocryptfs
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -14,10 +15,14 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/audit"
 	"github.com/HorizonLiu/gocryptfs/internal/configfile"
 	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
 	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
 	"github.com/HorizonLiu/gocryptfs/internal/fido2"
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/idmap"
 	"github.com/HorizonLiu/gocryptfs/internal/readpassword"
 	"github.com/HorizonLiu/gocryptfs/internal/speed"
 	"github.com/HorizonLiu/gocryptfs/internal/stupidgcm"
@@ -40,7 +45,15 @@ var raceDetector bool
 // or gets via the `-masterkey` or `-zerokey` command line options, if specified.
 func loadConfig(args *argContainer, password string) (masterkey []byte, cf *configfile.ConfFile, err error) {
 	// First check if the file can be read at all.
-	cf, err = configfile.Load(args.config)
+	if cryptfile.StorageScheme(args.config) != "" {
+		var js []byte
+		js, err = cryptfile.ReadStorageFile(args.config)
+		if err == nil {
+			cf, err = configfile.Parse(args.config, js)
+		}
+	} else {
+		cf, err = configfile.Load(args.config)
+	}
 	if err != nil {
 		tlog.Fatal.Printf("Cannot open config file: %v", err)
 		return nil, nil, err
@@ -64,9 +77,34 @@ func loadConfig(args *argContainer, password string) (masterkey []byte, cf *conf
 
 		// 重写密码读取方式，直接从参数中传入
 		pw = []byte(password)
+		if args._passwordProvider != nil {
+			pw, err = args._passwordProvider.GetPassword(context.Background(), 1)
+			if err != nil {
+				tlog.Fatal.Printf("Cannot get password: %v", err)
+				return nil, nil, exitcodes.NewErr(err.Error(), exitcodes.ReadPassword)
+			}
+		} else if password == "" && (!args.extpass.Empty() || len(args.passfile) != 0) {
+			// No password from the API. Used by the mount helper and fstab.
+			pw = readpassword.Once([]string(args.extpass), []string(args.passfile), "")
+		}
 	}
 	tlog.Info.Println("Decrypting master key")
 	masterkey, err = cf.DecryptMasterKey(pw)
+	// Extpass protocol 2 programs can tell the user that the password was
+	// wrong and ask again
+	if readpassword.ExtpassProtocol == 2 && !args.extpass.Empty() && password == "" && args._passwordProvider == nil {
+		const maxAttempts = 3
+		for attempt := 2; attempt <= maxAttempts; attempt++ {
+			if e, ok := err.(exitcodes.Err); !ok || e.Code() != exitcodes.PasswordIncorrect {
+				break
+			}
+			for i := range pw {
+				pw[i] = 0
+			}
+			pw = readpassword.Retry(args.extpass, attempt, "wrong-password")
+			masterkey, err = cf.DecryptMasterKey(pw)
+		}
+	}
 	for i := range pw {
 		pw[i] = 0
 	}
@@ -78,6 +116,21 @@ func loadConfig(args *argContainer, password string) (masterkey []byte, cf *conf
 	return masterkey, cf, nil
 }
 
+// openKeys loads the config file like loadConfig and returns the keys for
+// the cryptfile package. Calls os.Exit on errors.
+func openKeys(args *argContainer, password string) *cryptfile.Keys {
+	masterkey, _, err := loadConfig(args, password)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	keys, err := cryptfile.OpenMasterKey(args.config, masterkey)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	return keys
+}
+
 // changePassword - change the password of config file "filename"
 // Does not return (calls os.Exit both on success and on error).
 func changePassword(args *argContainer, password string) {
@@ -98,6 +151,10 @@ func changePassword(args *argContainer, password string) {
 		}
 		tlog.Info.Println("Please enter your new password.")
 		newPw := readpassword.Twice([]string(args.extpass), []string(args.passfile))
+		if confFile.IsDuressPassword(newPw) {
+			tlog.Fatal.Printf("The new password must differ from the duress password.")
+			os.Exit(exitcodes.Usage)
+		}
 		logN := confFile.ScryptObject.LogN()
 		if args._explicitScryptn {
 			logN = args.scryptn
@@ -133,6 +190,41 @@ func changePassword(args *argContainer, password string) {
 	tlog.Info.Printf(tlog.ColorGreen + "Password changed." + tlog.ColorReset)
 }
 
+// setDuressPassword - given a config file, set or replace the duress
+// password. Unlocking with the duress password destroys the master key.
+func setDuressPassword(args *argContainer, password string) {
+	masterkey, confFile, err := loadConfig(args, password)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		tlog.Fatal.Printf("A duress password is not supported on FIDO2-enabled filesystems.")
+		os.Exit(exitcodes.Usage)
+	}
+	tlog.Info.Println("Please enter the duress password.")
+	duressPw := readpassword.Twice([]string(args.extpass), []string(args.passfile))
+	logN := confFile.ScryptObject.LogN()
+	if args._explicitScryptn {
+		logN = args.scryptn
+	}
+	err = confFile.SetDuressPassword(duressPw, logN)
+	for i := range duressPw {
+		duressPw[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if err := confFile.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen + "Duress password set." + tlog.ColorReset)
+}
+
 // printVersion prints a version string like this:
 // gocryptfs v1.7-32-gcf99cfd; go-fuse v1.0.0-174-g22a9cb9; 2019-05-12 go1.12 linux/amd64
 func printVersion() {
@@ -153,7 +245,9 @@ func printVersion() {
 		runtime.GOOS, runtime.GOARCH)
 }
 
-func doMain(cmd []string, password string) {
+// doMain runs gocryptfs with the command line "cmd". The password is taken
+// from "provider" if it is not nil, from "password" otherwise.
+func doMain(cmd []string, password string, provider PasswordProvider) {
 	mxp := runtime.GOMAXPROCS(0)
 	if mxp < 4 && os.Getenv("GOMAXPROCS") == "" {
 		// On a 2-core machine, setting maxprocs to 4 gives 10% better performance.
@@ -171,17 +265,39 @@ func doMain(cmd []string, password string) {
 	// Parse all command-line options (i.e. arguments starting with "-")
 	// into "args". Path arguments are parsed below.
 	args := parseCliOptsDiy(cmd)
+	args._passwordProvider = provider
+	if provider == nil {
+		args._passwordProvider = args._passwordFrom
+	}
+	// "-pam-helper" starts the mount as the user, so it must not fork here
+	if args.pamHelper {
+		os.Exit(pamHelper(&args))
+	}
 	// Fork a child into the background if "-fg" is not set AND we are mounting
 	// a filesystem. The child will do all the work.
 	// 若不传入-fg参数，或者执行mount操作，将会fork子进程去执行
-	fmt.Println(args.fg, flagSet.NArg())
-	if !args.fg && flagSet.NArg() == 2 {
-		ret := forkChild()
+	if !args.fg && args._flagSet.NArg() == 2 {
+		ret := forkChild(args._argv)
 		os.Exit(ret)
 	}
+	// "-masterkey=KEY": the child has been started, hide the key from "ps".
+	// args.masterkey gets a copy first, it shares the memory of os.Args.
+	if args.masterkey != "" && args.masterkey != "stdin" && args.masterkeyFd < 0 {
+		args.masterkey = string([]byte(args.masterkey))
+		wipeArgvMasterkey()
+	}
 	if args.debug {
 		tlog.Debug.Enabled = true
 	}
+	readpassword.ExtpassProtocol = args.extpassProtocol
+	readpassword.ExtpassTimeout = args.extpassTimeout
+	readpassword.ExtpassCleanEnv = args.extpassCleanEnv
+	// "-export-tar", "-cat" and "-sftp-server" write their data to stdout,
+	// so everything else has to go to stderr
+	if args.exportTar || args.cat != "" || args.sftpServer {
+		tlog.Debug.Logger.SetOutput(os.Stderr)
+		tlog.Info.Logger.SetOutput(os.Stderr)
+	}
 	// "-v"
 	if args.version {
 		tlog.Debug.Printf("openssl=%v\n", args.openssl)
@@ -191,7 +307,7 @@ func doMain(cmd []string, password string) {
 	}
 	// "-hh"
 	if args.hh {
-		helpLong()
+		helpLong(args._flagSet)
 		os.Exit(0)
 	}
 	// "-speed"
@@ -204,9 +320,17 @@ func doMain(cmd []string, password string) {
 		tlog.Warn.Wpanic = true
 		tlog.Debug.Printf("Panicking on warnings")
 	}
+	// "-dbus-service" mounts the filesystems its clients ask for
+	if args.dbusService {
+		os.Exit(serveDBus(&args))
+	}
+	// "-csi-endpoint" mounts the volumes the kubelet asks for
+	if args.csiEndpoint != "" {
+		os.Exit(csiDriver(&args))
+	}
 	// Every operation below requires CIPHERDIR. Exit if we don't have it.
-	if flagSet.NArg() == 0 {
-		if flagSet.NFlag() == 0 {
+	if args._flagSet.NArg() == 0 {
+		if args._flagSet.NFlag() == 0 {
 			// Naked call to "gocryptfs". Just print the help text.
 			helpShort()
 		} else {
@@ -216,12 +340,32 @@ func doMain(cmd []string, password string) {
 		}
 		os.Exit(exitcodes.Usage)
 	}
-	// Check that CIPHERDIR exists
-	args.cipherdir, _ = filepath.Abs(flagSet.Arg(0))
-	err = isDir(args.cipherdir)
-	if err != nil {
-		tlog.Fatal.Printf("Invalid cipherdir: %v", err)
-		os.Exit(exitcodes.CipherDir)
+	// Check that CIPHERDIR exists. Remote storage like "s3://..." only
+	// works with the operations that go through cryptfile, and is checked
+	// when it is opened.
+	if cryptfile.StorageScheme(args._flagSet.Arg(0)) != "" {
+		args.cipherdir = args._flagSet.Arg(0)
+		if args.cat == "" && args.put == "" && args.serveWebdav == "" && !args.sftpServer && args.serve9p == "" && !args.diff {
+			tlog.Fatal.Printf("Remote CIPHERDIR %q only works with -cat, -put, -serve-webdav, -sftp-server, -serve-9p and -diff",
+				args.cipherdir)
+			os.Exit(exitcodes.Usage)
+		}
+	} else {
+		args.cipherdir, _ = filepath.Abs(args._flagSet.Arg(0))
+		err = isDir(args.cipherdir)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid cipherdir: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+	}
+	// "-snapshot mount" mounts a snapshot instead of CIPHERDIR
+	if args.snapshot == "mount" {
+		snapshotMountDir(&args)
+	}
+	readpassword.ExtpassVolume.CipherDir = args.cipherdir
+	readpassword.ExtpassVolume.Label = args.volname
+	if args.volname == "" {
+		readpassword.ExtpassVolume.Label = filepath.Base(args.cipherdir)
 	}
 	// "-q"
 	if args.quiet {
@@ -231,9 +375,32 @@ func doMain(cmd []string, password string) {
 	if args.reverse {
 		args.aessiv = true
 	} else {
-		if args.exclude != nil {
-			tlog.Fatal.Printf("-exclude only works in reverse mode")
-			os.Exit(exitcodes.ExcludeError)
+		if args.freezeDir != "" {
+			tlog.Fatal.Printf("-freeze-dir only works in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-audit-log"
+	if args.auditLog != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("-audit-log only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.auditLog != audit.Syslog {
+			args.auditLog, _ = filepath.Abs(args.auditLog)
+		}
+	}
+	// "-verify-mount"
+	if args.verifyMount != "" {
+		args.verifyMount, _ = filepath.Abs(args.verifyMount)
+	}
+	// "-freeze-dir"
+	if args.freezeDir != "" {
+		args.freezeDir, _ = filepath.Abs(args.freezeDir)
+		// The copies would show up in the reverse view
+		if args.freezeDir == args.cipherdir || strings.HasPrefix(args.freezeDir, args.cipherdir+"/") {
+			tlog.Fatal.Printf("-freeze-dir must not be inside the plaintext directory")
+			os.Exit(exitcodes.Usage)
 		}
 	}
 	// "-config"
@@ -247,6 +414,8 @@ func doMain(cmd []string, password string) {
 		args._configCustom = true
 	} else if args.reverse {
 		args.config = filepath.Join(args.cipherdir, configfile.ConfReverseName)
+	} else if cryptfile.StorageScheme(args.cipherdir) != "" {
+		args.config = args.cipherdir + "/" + configfile.ConfDefaultName
 	} else {
 		args.config = filepath.Join(args.cipherdir, configfile.ConfDefaultName)
 	}
@@ -270,6 +439,32 @@ func doMain(cmd []string, password string) {
 		}
 		args._forceOwner = &fuse.Owner{Uid: uint32(uidNum), Gid: uint32(gidNum)}
 	}
+	// "-force_perms"
+	if args.force_perms != "" {
+		permPieces := strings.SplitN(args.force_perms, ":", 2)
+		if len(permPieces) != 2 {
+			tlog.Fatal.Printf("force_perms must be in form FILEMODE:DIRMODE")
+			os.Exit(exitcodes.Usage)
+		}
+		var perms [2]uint32
+		for i, p := range permPieces {
+			v, err := strconv.ParseUint(p, 8, 32)
+			if err != nil || v > 07777 {
+				tlog.Fatal.Printf("force_perms: Unable to parse %q as octal mode", p)
+				os.Exit(exitcodes.Usage)
+			}
+			perms[i] = uint32(v)
+		}
+		args._forcePerms = &fusefrontend.ForcePerms{File: perms[0], Dir: perms[1]}
+	}
+	// "-idmap"
+	if args.idmap != "" {
+		args._idMap, err = idmap.Load(args.idmap)
+		if err != nil {
+			tlog.Fatal.Printf("-idmap: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	// "-cpuprofile"
 	if args.cpuprofile != "" {
 		onExitFunc := setupCpuprofile(args.cpuprofile)
@@ -298,10 +493,10 @@ func doMain(cmd []string, password string) {
 	nOps := countOpFlags(&args)
 	if nOps == 0 {
 		// Default operation: mount.
-		if flagSet.NArg() != 2 {
-			prettyArgs := prettyArgs()
+		if args._flagSet.NArg() != 2 {
+			prettyArgs := prettyArgs(args._argv)
 			tlog.Info.Printf("Wrong number of arguments (have %d, want 2). You passed: %s",
-				flagSet.NArg(), prettyArgs)
+				args._flagSet.NArg(), prettyArgs)
 			tlog.Fatal.Printf("Usage: %s [OPTIONS] CIPHERDIR MOUNTPOINT [-o COMMA-SEPARATED-OPTIONS]", tlog.ProgramName)
 			os.Exit(exitcodes.Usage)
 		}
@@ -310,17 +505,25 @@ func doMain(cmd []string, password string) {
 		return
 	}
 	if nOps > 1 {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck is allowed")
+		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -duress-passwd, -add-tenant, -remove-tenant, -fsck, -verify, -snapshot, -export-tar, -import-tar, -cat, -put, -du, -diff, -serve-webdav, -sftp-server, -serve-9p is allowed")
 		os.Exit(exitcodes.Usage)
 	}
-	if flagSet.NArg() != 1 {
-		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck take exactly one argument, %d given",
-			flagSet.NArg())
+	// "-diff" is the only action with two arguments
+	if args.diff {
+		if args._flagSet.NArg() != 2 {
+			tlog.Fatal.Printf("-diff takes exactly two arguments, DIR_A and DIR_B, %d given", args._flagSet.NArg())
+			os.Exit(exitcodes.Usage)
+		}
+		os.Exit(diffDirs(&args, password))
+	}
+	if args._flagSet.NArg() != 1 {
+		tlog.Fatal.Printf("The options -info, -init, -passwd, -duress-passwd, -add-tenant, -remove-tenant, -fsck, -verify, -snapshot, -export-tar, -import-tar, -cat, -put, -du, -serve-webdav, -sftp-server, -serve-9p take exactly one argument, %d given",
+			args._flagSet.NArg())
 		os.Exit(exitcodes.Usage)
 	}
 	// "-info"
 	if args.info {
-		info(args.config)
+		info(&args, password)
 		os.Exit(0)
 	}
 	// "-init"
@@ -333,11 +536,81 @@ func doMain(cmd []string, password string) {
 		changePassword(&args, password)
 		os.Exit(0)
 	}
+	// "-duress-passwd"
+	if args.duressPasswd {
+		setDuressPassword(&args, password)
+		os.Exit(0)
+	}
+	// "-add-tenant"
+	if args.addTenant != "" {
+		addTenant(&args, password)
+		os.Exit(0)
+	}
+	// "-remove-tenant"
+	if args.removeTenant != "" {
+		removeTenant(&args, password)
+		os.Exit(0)
+	}
 	// "-fsck"
 	if args.fsck {
 		code := fsck(&args, password)
 		os.Exit(code)
 	}
+	// "-verify"
+	if args.verify {
+		code := verify(&args, password)
+		os.Exit(code)
+	}
+	// "-export-tar"
+	if args.exportTar {
+		code := exportTar(&args, password)
+		os.Exit(code)
+	}
+	// "-import-tar"
+	if args.importTar {
+		code := importTar(&args)
+		os.Exit(code)
+	}
+	// "-cat"
+	if args.cat != "" {
+		code := catFile(&args, password)
+		os.Exit(code)
+	}
+	// "-put"
+	if args.put != "" {
+		code := putFile(&args, password)
+		os.Exit(code)
+	}
+	// "-serve-webdav"
+	if args.serveWebdav != "" {
+		code := serveWebdav(&args, password)
+		os.Exit(code)
+	}
+	// "-sftp-server"
+	if args.sftpServer {
+		code := sftpServer(&args, password)
+		os.Exit(code)
+	}
+	// "-serve-9p"
+	if args.serve9p != "" {
+		code := serve9p(&args, password)
+		os.Exit(code)
+	}
+	// "-du"
+	if args.du {
+		code := du(&args, password)
+		os.Exit(code)
+	}
+	// "-snapshot create"
+	if args.snapshot == "create" {
+		snapshotCreate(&args)
+		os.Exit(0)
+	}
+	// "-snapshot list"
+	if args.snapshot == "list" {
+		snapshotList(&args)
+		os.Exit(0)
+	}
 }
 
 // 原有main函数入口
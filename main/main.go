@@ -1,8 +1,17 @@
 package main
 
-import "github.com/HorizonLiu/gocryptfs"
+import (
+	"os"
+
+	"github.com/HorizonLiu/gocryptfs"
+)
 
 func main() {
+	// Installed as /sbin/mount.gocryptfs
+	if gocryptfs.IsMountHelper(os.Args[0]) {
+		gocryptfs.MountHelperMain(os.Args)
+		return
+	}
 	var clientCmd = []string{"gocryptfs", "-fg", "-zerokey", "-nosyslog", "-ro", "cipher", "plain"}
 	var fsPwd = "123456"
 	gocryptfs.GoCryptAPI(clientCmd, fsPwd)
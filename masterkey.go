@@ -2,8 +2,12 @@ package gocryptfs
 
 import (
 	"encoding/hex"
+	"io"
+	"io/ioutil"
 	"os"
+	"reflect"
 	"strings"
+	"unsafe"
 
 	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
 	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
@@ -29,6 +33,8 @@ func unhexMasterKey(masterkey string, fromStdin bool) []byte {
 		tlog.Info.Printf(tlog.ColorYellow +
 			"THE MASTER KEY IS VISIBLE VIA \"ps ax\" AND MAY BE STORED IN YOUR SHELL HISTORY!\n" +
 			"ONLY USE THIS MODE FOR EMERGENCIES" + tlog.ColorReset)
+		tlog.Warn.Printf("Passing the master key on the command line is deprecated, " +
+			"use -masterkey=stdin or -masterkey-fd instead")
 	}
 	return key
 }
@@ -37,6 +43,10 @@ func unhexMasterKey(masterkey string, fromStdin bool) []byte {
 // masterkey from the source the user wanted (string on the command line, stdin, all-zero),
 // and returns it in binary. Returns nil if no masterkey source was specified.
 func handleArgsMasterkey(args *argContainer) (masterkey []byte) {
+	// "-masterkey-fd=3"
+	if args.masterkeyFd >= 0 {
+		return readMasterkeyFd(args.masterkeyFd)
+	}
 	// "-masterkey=stdin"
 	if args.masterkey == "stdin" {
 		in := string(readpassword.Once(nil, nil, "Masterkey"))
@@ -58,3 +68,56 @@ func handleArgsMasterkey(args *argContainer) (masterkey []byte) {
 	// the config file.
 	return nil
 }
+
+// readMasterkeyFd reads the hex-encoded master key from the file descriptor
+// "fd" and closes it. Calls os.Exit on failure.
+func readMasterkeyFd(fd int) []byte {
+	f := os.NewFile(uintptr(fd), "masterkey-fd")
+	in, err := ioutil.ReadAll(io.LimitReader(f, 1024))
+	f.Close()
+	if err != nil {
+		tlog.Fatal.Printf("Could not read master key from fd %d: %v", fd, err)
+		os.Exit(exitcodes.MasterKey)
+	}
+	return unhexMasterKey(strings.TrimSpace(string(in)), true)
+}
+
+// wipeArgvMasterkey overwrites master keys on the command line with "x".
+// The strings in os.Args point to the memory that the kernel shows in
+// /proc/PID/cmdline, so "ps" does not see the key afterwards. Other strings
+// that share the memory, like args.masterkey, are overwritten as well.
+// Only doMain() calls it, library code does not own os.Args.
+func wipeArgvMasterkey() {
+	wipeNext := false
+	for _, a := range os.Args {
+		start, end := -1, len(a)
+		if wipeNext {
+			start = 0
+		} else if i := strings.Index(a, "masterkey="); i >= 0 {
+			// "-masterkey=KEY" or "-o masterkey=KEY,ro"
+			start = i + len("masterkey=")
+			if j := strings.IndexByte(a[start:], ','); j >= 0 {
+				end = start + j
+			}
+		}
+		wipeNext = a == "-masterkey" || a == "--masterkey"
+		if start < 0 || a[start:end] == "stdin" {
+			continue
+		}
+		wipeString(a[start:end])
+	}
+}
+
+// wipeString overwrites the memory of "s". Only use it on strings that
+// are not in read-only memory, like those in os.Args.
+func wipeString(s string) {
+	var b []byte
+	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
+	bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	bh.Data = sh.Data
+	bh.Len = sh.Len
+	bh.Cap = sh.Len
+	for i := range b {
+		b[i] = 'x'
+	}
+}
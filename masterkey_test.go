@@ -0,0 +1,74 @@
+package gocryptfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestWipeArgvMasterkey(t *testing.T) {
+	key := "6f717d8b-6b5f8e8a"
+	// os.Args of a real process point to writable memory, string literals
+	// do not
+	heap := func(s string) string { return string([]byte(s)) }
+	osArgs := os.Args
+	defer func() { os.Args = osArgs }()
+	os.Args = []string{"gocryptfs", heap("-masterkey=" + key), heap("-masterkey"), heap(key),
+		heap("-masterkey=stdin"), "-o", heap("ro,masterkey=" + key + ",allow_other"), "-masterkey-fd", "3"}
+	masterkey := os.Args[1][len("-masterkey="):]
+	wipeArgvMasterkey()
+	x := "xxxxxxxxxxxxxxxxx"
+	want := []string{"gocryptfs", "-masterkey=" + x, "-masterkey", x,
+		"-masterkey=stdin", "-o", "ro,masterkey=" + x + ",allow_other", "-masterkey-fd", "3"}
+	if !reflect.DeepEqual(os.Args, want) {
+		t.Errorf("have %q", os.Args)
+	}
+	if masterkey != x {
+		t.Errorf("shared string not wiped: %q", masterkey)
+	}
+}
+
+// TestWipeArgvMasterkeyCmdline checks that the key is gone from
+// /proc/PID/cmdline. It runs the test binary again with a key on the
+// command line.
+func TestWipeArgvMasterkeyCmdline(t *testing.T) {
+	const key = "6f717d8b-6b5f8e8a"
+	if os.Getenv("WIPE_ARGV_HELPER") == "1" {
+		wipeArgvMasterkey()
+		cmdline, err := ioutil.ReadFile("/proc/self/cmdline")
+		if err != nil {
+			t.Skip(err)
+		}
+		if bytes.Contains(cmdline, []byte(key)) {
+			t.Fatalf("key is still in %q", cmdline)
+		}
+		if !bytes.Contains(cmdline, []byte("-masterkey=xxxxxxxxxxxxxxxxx")) {
+			t.Fatalf("key has not been overwritten: %q", cmdline)
+		}
+		return
+	}
+	if _, err := os.Stat("/proc/self/cmdline"); err != nil {
+		t.Skip(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWipeArgvMasterkeyCmdline$", "--", "-masterkey="+key)
+	cmd.Env = append(os.Environ(), "WIPE_ARGV_HELPER=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("%v: %s", err, out)
+	}
+}
+
+func TestReadMasterkeyFd(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString("00000000-00000000-00000000-00000000-00000000-00000000-00000000-00000001\n")
+	w.Close()
+	key := readMasterkeyFd(int(r.Fd()))
+	if len(key) != 32 || key[31] != 1 {
+		t.Errorf("%x", key)
+	}
+}
@@ -2,15 +2,16 @@ package gocryptfs
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"log/syslog"
 	"math"
 	"net"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path"
 	"path/filepath"
 	"runtime"
@@ -25,6 +26,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/HorizonLiu/gocryptfs/internal/audit"
 	"github.com/HorizonLiu/gocryptfs/internal/configfile"
 	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
 	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
@@ -32,9 +34,15 @@ import (
 	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
 	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
 	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/HorizonLiu/gocryptfs/internal/journal"
 	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
-	"github.com/HorizonLiu/gocryptfs/internal/openfiletable"
+	"github.com/HorizonLiu/gocryptfs/internal/opstats"
+	"github.com/HorizonLiu/gocryptfs/internal/panicgate"
+	"github.com/HorizonLiu/gocryptfs/internal/quota"
+	"github.com/HorizonLiu/gocryptfs/internal/sdnotify"
+	"github.com/HorizonLiu/gocryptfs/internal/throttle"
 	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+	"github.com/HorizonLiu/gocryptfs/internal/verifylog"
 )
 
 // AfterUnmount is called after the filesystem has been unmounted.
@@ -48,7 +56,7 @@ type AfterUnmounter interface {
 func doMount(args *argContainer, password string) {
 	// Check mountpoint
 	var err error
-	args.mountpoint, err = filepath.Abs(flagSet.Arg(1))
+	args.mountpoint, err = filepath.Abs(args._flagSet.Arg(1))
 	if err != nil {
 		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
 		os.Exit(exitcodes.MountPoint)
@@ -90,7 +98,14 @@ func doMount(args *argContainer, password string) {
 		// This messes up the delete-on-close logic in the unix socket object.
 		args.ctlsock, _ = filepath.Abs(args.ctlsock)
 		var sock net.Listener
-		sock, err = net.Listen("unix", args.ctlsock)
+		if f := sdnotify.ListenFile("ctlsock"); f != nil {
+			// Socket activation. systemd owns the socket file.
+			tlog.Info.Printf("ctlsock: using socket passed by systemd")
+			sock, err = net.FileListener(f)
+			f.Close()
+		} else {
+			sock, err = net.Listen("unix", args.ctlsock)
+		}
 		if err != nil {
 			tlog.Fatal.Printf("ctlsock: %v", err)
 			os.Exit(exitcodes.CtlSock)
@@ -104,6 +119,96 @@ func doMount(args *argContainer, password string) {
 			}
 		}()
 	}
+	if args.ctlhttp != "" {
+		var l net.Listener
+		l, err = net.Listen("tcp", args.ctlhttp)
+		if err != nil {
+			tlog.Fatal.Printf("ctlhttp: %v", err)
+			os.Exit(exitcodes.CtlSock)
+		}
+		if args.ctlhttpCert != "" {
+			var cert tls.Certificate
+			cert, err = tls.LoadX509KeyPair(args.ctlhttpCert, args.ctlhttpKey)
+			if err != nil {
+				l.Close()
+				tlog.Fatal.Printf("ctlhttp: %v", err)
+				os.Exit(exitcodes.CtlSock)
+			}
+			l = tls.NewListener(l, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+			})
+		} else if addr, ok := l.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+			// The token would be sent in the clear
+			l.Close()
+			tlog.Fatal.Printf("ctlhttp: refusing to listen on non-loopback address %v without -ctlhttp-cert", addr)
+			os.Exit(exitcodes.CtlSock)
+		}
+		args._ctlhttpListener = l
+	}
+	if args.debugAddr != "" {
+		args._debugListener = listenDebug(args.debugAddr)
+	}
+	if args.auditLog != "" {
+		// Writing to the log would be audited, and deadlock
+		if args.auditLog == args.mountpoint || strings.HasPrefix(args.auditLog, args.mountpoint+"/") {
+			tlog.Fatal.Printf("-audit-log must not be inside the mountpoint")
+			os.Exit(exitcodes.Usage)
+		}
+		// Stays open as long as the filesystem is mounted
+		args._audit, err = audit.Open(args.auditLog)
+		if err != nil {
+			tlog.Fatal.Printf("audit-log: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.verifyMount != "" {
+		if args.verifyMount == args.mountpoint || strings.HasPrefix(args.verifyMount, args.mountpoint+"/") {
+			tlog.Fatal.Printf("-verify-mount must not be inside the mountpoint")
+			os.Exit(exitcodes.Usage)
+		}
+		args._verifyLog, err = verifylog.Open(args.verifyMount)
+		if err != nil {
+			tlog.Fatal.Printf("verify-mount: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-quota"
+	if len(args.quota) > 0 {
+		args._quota, err = quota.New(args.quotaState)
+		if err != nil {
+			tlog.Fatal.Printf("-quota-state: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		for _, spec := range args.quota {
+			path, limit, err := quota.ParseSpec(spec)
+			if err == nil {
+				clean := ctlsocksrv.SanitizePath(path)
+				if clean == "" && strings.Trim(path, "/.") != "" {
+					err = fmt.Errorf("invalid path %q", path)
+				} else {
+					err = args._quota.Add(clean, limit)
+				}
+			}
+			if err != nil {
+				tlog.Fatal.Printf("-quota: %v", err)
+				os.Exit(exitcodes.Usage)
+			}
+		}
+	}
+	if args._ctlsockFd != nil || args._ctlhttpListener != nil || args._debugListener != nil {
+		args._opStats = opstats.New()
+	}
+	if args._ctlsockFd != nil || args._ctlhttpListener != nil {
+		if args.ctlsockTokenFile != "" {
+			args._ctlsockToken = readCtlsockToken(args.ctlsockTokenFile)
+		}
+	}
+	// Network filesystems often do not support fallocate, or emulate it by
+	// writing zeros
+	if args.networkStorage {
+		args.noprealloc = true
+	}
 	// Preallocation on Btrfs is broken ( https://github.com/HorizonLiu/gocryptfs/issues/395 )
 	// and slow ( https://github.com/HorizonLiu/gocryptfs/issues/63 ).
 	if !args.noprealloc {
@@ -125,8 +230,26 @@ func doMount(args *argContainer, password string) {
 	fs, wipeKeys := initFuseFrontend(args, password)
 	// Try to wipe secret keys from memory after unmount
 	defer wipeKeys()
+	// The filesystem of the main CIPHERDIR, even if it becomes part of a
+	// union below
+	topFs := fs
+	// "-union"
+	wipeUnion := func() {}
+	if !args.union.Empty() {
+		fs, wipeUnion = initUnion(args, fs, password)
+		defer wipeUnion()
+	}
+	// "-supervise"
+	if args.supervise {
+		args._supervisor = newSupervisor(args, fs)
+	}
 	// Initialize go-fuse FUSE server
-	srv := initGoFuse(fs, args)
+	fuseSrv := initGoFuse(fs, args)
+	var srv fuseServer = fuseSrv
+	if args._supervisor != nil {
+		args._supervisor.start(fuseSrv)
+		srv = args._supervisor
+	}
 	if x, ok := fs.(AfterUnmounter); ok {
 		defer x.AfterUnmount()
 	}
@@ -161,16 +284,24 @@ func doMount(args *argContainer, password string) {
 		// Send SIGUSR1 to our parent
 		sendUsr1(args.notifypid)
 	}
+	// Type=notify systemd services
+	if err = sdnotify.Notify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid())); err != nil {
+		tlog.Warn.Printf("sd_notify: %v", err)
+	}
+	if interval := sdnotify.WatchdogInterval(); interval > 0 {
+		done := make(chan struct{})
+		go func() {
+			srv.Wait()
+			close(done)
+		}()
+		go sdnotify.Watchdog(interval, func() bool { return mountAlive(args.mountpoint, interval) }, done)
+	}
 	// Increase the open file limit to 4096. This is not essential, so do it after
 	// we have switched to syslog and don't bother the user with warnings.
 	setOpenFileLimit()
-	// Wait for SIGINT in the background and unmount ourselves if we get it.
-	// This prevents a dangling "Transport endpoint is not connected"
-	// mountpoint if the user hits CTRL-C.
-
-	fmt.Println("关闭handleSigint()")
-	//fmt.Println("============handleSigint: 监听信号，若监听到执行umount并退出进程=============")
-	//handleSigint(srv, args.mountpoint)
+	// No SIGINT handler is installed: the process may hold several mounts
+	// and must not exit when one of them is interrupted. The embedding
+	// program unmounts on signals itself.
 
 	// Return memory that was allocated for scrypt (64M by default!) and other
 	// stuff that is no longer needed to the OS
@@ -179,8 +310,73 @@ func doMount(args *argContainer, password string) {
 	fmt.Println("==============args.idle:", args.idle, ".if args.idle>0, Auto-unmount after specified idle duration (ignored in reverse mode).==========================")
 	if args.idle > 0 && !args.reverse {
 		// Not being in reverse mode means we always have a forward file system.
-		fwdFs := fs.(*fusefrontend.RootNode)
-		go idleMonitor(args.idle, fwdFs, srv, args.mountpoint)
+		fwdFs := topFs.(*fusefrontend.RootNode)
+		go idleMonitor(args.idle, args.idlelock, fwdFs, srv, args.mountpoint, nil, nil)
+	}
+	// "-debug-addr"
+	if args._debugListener != nil {
+		go serveDebug(args._debugListener, topFs, args._opStats)
+		go func() {
+			srv.Wait()
+			args._debugListener.Close()
+		}()
+	}
+	// "-parentpid"
+	if args.parentpid > 0 {
+		go watchParent(args.parentpid, srv, args.mountpoint, func() {
+			wipeKeys()
+			wipeUnion()
+		})
+	}
+	// "-reload-file"
+	if args._reloader != nil {
+		go args._reloader.handleSIGHUP(srv)
+	}
+	// "-on-suspend"
+	if args.onSuspend != "" {
+		watchSuspend(args, topFs, srv)
+	}
+	// "-sharedstorage-poll"
+	if args.sharedstorage && args.sharedstoragePoll > 0 && !args.reverse {
+		fwdFs := topFs.(*fusefrontend.RootNode)
+		done := make(chan struct{})
+		go func() {
+			srv.Wait()
+			close(done)
+		}()
+		go fwdFs.PollSharedStorage(args.sharedstoragePoll, done)
+	}
+	// "-watch-cipherdir". The kernel can only be notified once the
+	// filesystem is mounted.
+	if args.watchCipherdir {
+		fwdFs := topFs.(*fusefrontend.RootNode)
+		fwdFs.StartWatch()
+		go func() {
+			srv.Wait()
+			fwdFs.StopWatch()
+		}()
+	}
+	// "-ctlhttp": doMount returns while the filesystem is still mounted
+	if args._ctlhttpListener != nil {
+		go func() {
+			srv.Wait()
+			args._ctlhttpListener.Close()
+		}()
+	}
+	if args._journal != nil {
+		go func() {
+			srv.Wait()
+			args._journal.Close()
+		}()
+	}
+	// "-verify-mount": write the summary at unmount
+	if args._verifyLog != nil {
+		go func() {
+			srv.Wait()
+			if err := args._verifyLog.Close(); err != nil {
+				tlog.Warn.Printf("verify-mount: %v", err)
+			}
+		}()
 	}
 	// Wait for unmount.
 	// 关闭等待
@@ -193,9 +389,13 @@ func doMount(args *argContainer, password string) {
 // https://github.com/vgough/encfs/blob/1974b417af189a41ffae4c6feb011d2a0498e437/encfs/main.cpp#L851
 // idleMonitor is a function to be run as a thread that checks for
 // filesystem idleness and unmounts if we've been idle for long enough.
+// With "lock" set, it wipes the keys ("-idlelock") instead of unmounting.
+// It returns after unmounting, calling "onUnmount" if it is not nil, or when
+// "done" is closed.
 const checksDuringTimeoutPeriod = 4
 
-func idleMonitor(idleTimeout time.Duration, fs *fusefrontend.RootNode, srv *fuse.Server, mountpoint string) {
+func idleMonitor(idleTimeout time.Duration, lock bool, fs *fusefrontend.RootNode, srv fuseServer, mountpoint string,
+	done <-chan struct{}, onUnmount func()) {
 	// sleepNs is the sleep time between checks, in nanoseconds.
 	sleepNs := contentenc.MinUint64(
 		uint64(idleTimeout/checksDuringTimeoutPeriod),
@@ -206,10 +406,18 @@ func idleMonitor(idleTimeout time.Duration, fs *fusefrontend.RootNode, srv *fuse
 		return time.Duration(sleepNs * uint64(idleCount))
 	}
 	for {
+		if lock && fs.IsLocked() {
+			// Nothing to do until the user unlocks the filesystem
+			idleCount = 0
+			if !sleepOrDone(time.Duration(sleepNs), done) {
+				return
+			}
+			continue
+		}
 		// Atomically check whether the flag is 0 and reset it to 1 if so.
 		isIdle := !atomic.CompareAndSwapUint32(&fs.IsIdle, 0, 1)
 		// Any form of current or recent access resets the idle counter.
-		openFileCount := openfiletable.CountOpenFiles()
+		openFileCount := fs.CountActiveOpenFiles()
 		if !isIdle || openFileCount > 0 {
 			idleCount = 0
 		} else {
@@ -218,7 +426,11 @@ func idleMonitor(idleTimeout time.Duration, fs *fusefrontend.RootNode, srv *fuse
 		tlog.Debug.Printf(
 			"idleMonitor: idle for %v (idleCount = %d, isIdle = %t, open = %d)",
 			idleTime(), idleCount, isIdle, openFileCount)
-		if idleCount > 0 && idleCount%timeoutCycles == 0 {
+		if lock && idleCount > 0 && idleCount%timeoutCycles == 0 {
+			tlog.Info.Printf("idleMonitor: filesystem idle; locking: %s", mountpoint)
+			fs.Lock()
+			idleCount = 0
+		} else if idleCount > 0 && idleCount%timeoutCycles == 0 {
 			tlog.Info.Printf("idleMonitor: filesystem idle; unmounting: %s", mountpoint)
 			err := srv.Unmount()
 			if err != nil {
@@ -228,12 +440,66 @@ func idleMonitor(idleTimeout time.Duration, fs *fusefrontend.RootNode, srv *fuse
 				// unmounted.
 				tlog.Info.Printf("idleMonitor: unmount failed: %v. Resetting idle time.", err)
 				idleCount = 0
+			} else {
+				if onUnmount != nil {
+					onUnmount()
+				}
+				return
 			}
 		}
-		time.Sleep(time.Duration(sleepNs))
+		if !sleepOrDone(time.Duration(sleepNs), done) {
+			return
+		}
 	}
 }
 
+// sleepOrDone sleeps for "d". Returns false if "done" was closed in the
+// meantime. A nil "done" is never closed.
+func sleepOrDone(d time.Duration, done <-chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// mountAlive returns true if stat() on "mountpoint" is answered within
+// "timeout", which it is not if the FUSE server hangs.
+func mountAlive(mountpoint string, timeout time.Duration) bool {
+	ch := make(chan error, 1)
+	go func() {
+		var st syscall.Stat_t
+		ch <- syscall.Stat(mountpoint, &st)
+	}()
+	select {
+	case err := <-ch:
+		return err == nil
+	case <-time.After(timeout):
+		tlog.Warn.Printf("watchdog: stat %q timed out", mountpoint)
+		return false
+	}
+}
+
+// readCtlsockToken reads the control socket token from "-ctlsock-token-file".
+// Surrounding whitespace, like the trailing newline, is ignored.
+// On error, it calls os.Exit and does not return.
+func readCtlsockToken(file string) string {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		tlog.Fatal.Printf("ctlsock: cannot read token: %v", err)
+		os.Exit(exitcodes.CtlSock)
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		tlog.Fatal.Printf("ctlsock: token file %q is empty", file)
+		os.Exit(exitcodes.CtlSock)
+	}
+	return token
+}
+
 // setOpenFileLimit tries to increase the open file limit to 4096 (the default hard
 // limit on Linux).
 func setOpenFileLimit() {
@@ -261,6 +527,13 @@ func initFuseFrontend(args *argContainer, password string) (rootNode fs.InodeEmb
 	var confFile *configfile.ConfFile
 	// Get the masterkey from the command line if it was specified
 	masterkey := handleArgsMasterkey(args)
+	// "-tenant": only the keys of the tenants are known. The root directory
+	// gets a random throwaway key, fusefrontend refuses all access to it.
+	var tenantKeys map[string][]byte
+	if masterkey == nil && len(args.tenant) > 0 {
+		confFile, tenantKeys = loadTenantKeys(args, password)
+		masterkey = cryptocore.RandBytes(cryptocore.KeyLen)
+	}
 	// Otherwise, load masterkey from config file (normal operation).
 	// Prompts the user for the password.
 	if masterkey == nil {
@@ -270,6 +543,12 @@ func initFuseFrontend(args *argContainer, password string) (rootNode fs.InodeEmb
 				// Close the socket file (which also deletes it)
 				args._ctlsockFd.Close()
 			}
+			if args._ctlhttpListener != nil {
+				args._ctlhttpListener.Close()
+			}
+			if args._debugListener != nil {
+				args._debugListener.Close()
+			}
 			exitcodes.Exit(err)
 		}
 	}
@@ -294,23 +573,51 @@ func initFuseFrontend(args *argContainer, password string) (rootNode fs.InodeEmb
 		ConfigCustom:    args._configCustom,
 		NoPrealloc:      args.noprealloc,
 		SerializeReads:  args.serialize_reads,
+		Readahead:       args.readahead,
+		CoalesceWrites:  args.coalesceWrites,
+		FDCache:         args.fdCache,
 		ForceDecode:     args.forcedecode,
 		ForceOwner:      args._forceOwner,
+		ForcePerms:      args._forcePerms,
+		IDMap:           args._idMap,
+		XattrPolicies:   args._xattrPolicies,
 		Exclude:         args.exclude,
 		ExcludeWildcard: args.excludeWildcard,
 		ExcludeFrom:     args.excludeFrom,
+		Include:         args.include,
+		IncludeFrom:     args.includeFrom,
+		Filter:          args.filter,
+		FilterFrom:      args.filterFrom,
+		IgnoreFiles:     args.ignorefiles,
+		OneFileSystem:   args.one_file_system,
+		FreezeDir:       args.freezeDir,
 		Suid:            args.suid,
 		KernelCache:     args.kernel_cache,
 		SharedStorage:   args.sharedstorage,
+		NetworkStorage:  args.networkStorage,
+		StatfsRaw:       args.statfs == "raw",
+		Audit:           args._audit,
+		VerifyLog:       args._verifyLog,
+		Quota:           args._quota,
+		WatchCipherdir:  args.watchCipherdir,
+		SyncDir:         args.syncdir,
+		IdleIgnore:      args.idleIgnore,
+		TenantsOnly:     len(args.tenant) > 0,
 	}
 	// confFile is nil when "-zerokey" or "-masterkey" was used
 	if confFile != nil {
 		// Settings from the config file override command line args
 		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+		frontendArgs.DirPolicies = confFile.IsFeatureFlagSet(configfile.FlagDirPolicy)
+		frontendArgs.NameMax = confFile.PlainNameMax()
 		args.raw64 = confFile.IsFeatureFlagSet(configfile.FlagRaw64)
 		args.hkdf = confFile.IsFeatureFlagSet(configfile.FlagHKDF)
 		if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
 			cryptoBackend = cryptocore.BackendAESSIV
+			if args.forcedecode {
+				tlog.Fatal.Printf("-forcedecode does not work with AES-SIV filesystems")
+				os.Exit(exitcodes.Usage)
+			}
 		} else if args.reverse {
 			tlog.Fatal.Printf("AES-SIV is required by reverse mode, but not enabled in the config file")
 			os.Exit(exitcodes.Usage)
@@ -321,23 +628,49 @@ func initFuseFrontend(args *argContainer, password string) (rootNode fs.InodeEmb
 	if args.allow_other && os.Getuid() == 0 {
 		frontendArgs.PreserveOwner = true
 	}
+	// Clean up after operations that a crash has interrupted, also if
+	// "-journal" is off now
+	if !args.reverse {
+		replayJournal(args)
+	}
+	if args.journal {
+		if frontendArgs.PlaintextNames {
+			tlog.Fatal.Printf("-journal does not work with plaintext names")
+			os.Exit(exitcodes.Usage)
+		}
+		frontendArgs.Journal, err = journal.Open(args.cipherdir)
+		if err != nil {
+			tlog.Fatal.Printf("journal: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+		args._journal = frontendArgs.Journal
+	}
 	jsonBytes, _ := json.MarshalIndent(frontendArgs, "", "\t")
 	tlog.Debug.Printf("frontendArgs: %s", string(jsonBytes))
 
 	// Init crypto backend
 	cCore := cryptocore.New(masterkey, cryptoBackend, contentenc.DefaultIVBits, args.hkdf, args.forcedecode)
 	cEnc := contentenc.New(cCore, contentenc.DefaultBS, args.forcedecode)
+	cEnc.SetWorkers(args.cryptoWorkers)
 	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, args.raw64)
+	if frontendArgs.NameMax > 0 {
+		nameTransform.SetNameMax(frontendArgs.NameMax)
+	}
 	// Init badname patterns
-	nameTransform.BadnamePatterns = make([]string, 0)
-	for _, pattern := range args.badname {
-		_, err := filepath.Match(pattern, "") // Make sure pattern is valid
-		if err != nil {
-			tlog.Fatal.Printf("-badname: invalid pattern %q supplied", pattern)
+	if err := checkBadnamePatterns(args.badname); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Usage)
+	}
+	nameTransform.SetBadnamePatterns(args.badname)
+	// "-idlelock" and "-on-suspend lock" unlock with the password, so they
+	// need the config file, and check that it still has this master key
+	var lockKeys *idleLockKeys
+	if args.idlelock || args.onSuspend == "lock" {
+		if confFile == nil {
+			tlog.Fatal.Printf("-idlelock and -on-suspend lock need a config file")
 			os.Exit(exitcodes.Usage)
-		} else {
-			nameTransform.BadnamePatterns = append(nameTransform.BadnamePatterns, pattern)
 		}
+		lockKeys = newIdleLockKeys(args, masterkey, cCore, nameTransform)
 	}
 	// After the crypto backend is initialized,
 	// we can purge the master key from memory.
@@ -346,26 +679,132 @@ func initFuseFrontend(args *argContainer, password string) (rootNode fs.InodeEmb
 	}
 	masterkey = nil
 	// Spawn fusefrontend
+	wipeTenants := func() {}
 	if args.reverse {
 		if cryptoBackend != cryptocore.BackendAESSIV {
 			log.Panic("reverse mode must use AES-SIV, everything else is insecure")
 		}
 		rootNode = fusefrontend_reverse.NewRootNode(frontendArgs, cEnc, nameTransform)
 	} else {
-		rootNode = fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+		rn := fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+		if confFile != nil && confFile.IsFeatureFlagSet(configfile.FlagMultiTenant) {
+			wipeTenants = addTenants(rn, args, confFile, tenantKeys, cryptoBackend, frontendArgs.LongNames)
+		}
+		// "-subdir"
+		if args.subdir != "" {
+			subdir := ctlsocksrv.SanitizePath(args.subdir)
+			if subdir == "" {
+				tlog.Fatal.Printf("-subdir: invalid path %q", args.subdir)
+				os.Exit(exitcodes.Usage)
+			}
+			err = rn.MountSubdir(subdir)
+			if err != nil {
+				tlog.Fatal.Printf("-subdir: cannot use %q: %v", subdir, err)
+				os.Exit(exitcodes.CipherDir)
+			}
+		}
+		// "-quota". The paths are relative to the mounted directory.
+		if args._quota != nil {
+			if err := rn.CountQuotas(); err != nil {
+				tlog.Fatal.Printf("-quota: %v", err)
+				os.Exit(exitcodes.CipherDir)
+			}
+			// Counted again if we crash before AfterUnmount() marks the
+			// state file clean
+			if err := args._quota.Save(false); err != nil {
+				tlog.Fatal.Printf("-quota-state: %v", err)
+				os.Exit(exitcodes.Usage)
+			}
+		}
+		// "-idlelock" and "-on-suspend lock"
+		if lockKeys != nil {
+			rn.SetKeyManager(lockKeys)
+		}
+		rootNode = rn
+	}
+	r := &reloader{
+		args:          args,
+		frontendArgs:  frontendArgs,
+		nameTransform: nameTransform,
+		rootNode:      rootNode.(reloadable),
+	}
+	// "-reload-file"
+	if args.reloadFile != "" {
+		if err := r.reload(); err != nil {
+			tlog.Fatal.Printf("-reload-file: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		args._reloader = r
 	}
 	// We have opened the socket early so that we cannot fail here after
 	// asking the user for the password
-	if args._ctlsockFd != nil {
-		go ctlsocksrv.Serve(args._ctlsockFd, rootNode.(ctlsocksrv.Interface))
+	if args._ctlsockFd != nil || args._ctlhttpListener != nil {
+		info := ctlsocksrv.MountInfo{
+			Stats:     args._opStats,
+			Options:   args._passedFlags,
+			Token:     args._ctlsockToken,
+			AllowUIDs: args._ctlsockUIDs,
+			Reload:    r.reload,
+		}
+		var ck *configKeys
+		if confFile != nil {
+			ck = &configKeys{args: args}
+		}
+		// Password changes need a password-protected config file
+		if ck != nil && !confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+			info.Config = ck
+		}
+		// Directory policies are a forward mode feature. The feature flag
+		// is set on first use.
+		if rn, ok := rootNode.(*fusefrontend.RootNode); ok {
+			info.SetDirPolicy = func(path string, policy string) error {
+				return rn.SetDirPolicy(path, policy, ck.enableDirPolicies)
+			}
+		}
+		info.Remount = func(opts ctlsocksrv.RemountOptions) error {
+			return remount(args, rootNode, opts)
+		}
+		if args._ctlsockFd != nil {
+			go ctlsocksrv.Serve(args._ctlsockFd, rootNode.(ctlsocksrv.Interface), info)
+		}
+		if args._ctlhttpListener != nil {
+			go ctlsocksrv.ServeHTTPAPI(args._ctlhttpListener, rootNode.(ctlsocksrv.Interface), info)
+		}
+	}
+	return rootNode, func() {
+		cCore.Wipe()
+		wipeTenants()
 	}
-	return rootNode, func() { cCore.Wipe() }
 }
 
 // initGoFuse calls into go-fuse to mount `rootNode` on `args.mountpoint`.
 // The mountpoint is ready to use when the functions returns.
 // On error, it calls os.Exit and does not return.
 func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
+	srv, err := newFuseServer(rootNode, args)
+	if err != nil {
+		tlog.Fatal.Printf("fs.GoCryptAPI failed: %s", strings.TrimSpace(err.Error()))
+		if runtime.GOOS == "darwin" {
+			tlog.Info.Printf("%s", macFuseHint())
+		}
+		os.Exit(exitcodes.FuseNewServer)
+	}
+
+	// All FUSE file and directory create calls carry explicit permission
+	// information. We need an unrestricted umask to create the files and
+	// directories with the requested permissions.
+	syscall.Umask(0000)
+
+	return srv
+}
+
+// networkStorageCacheTimeout is how long the kernel caches attributes and
+// directory entries with "-network-storage"
+const networkStorageCacheTimeout = 10 * time.Second
+
+// newFuseServer mounts `rootNode` on `args.mountpoint` and starts serving
+// requests. The mountpoint is ready to use when the functions returns.
+func newFuseServer(rootNode fs.InodeEmbedder, args *argContainer) (*fuse.Server, error) {
 	var fuseOpts *fs.Options
 	sec := time.Second
 	if args.sharedstorage {
@@ -376,6 +815,15 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 		fuseOpts = &fs.Options{
 			FirstAutomaticIno: 1000,
 		}
+	} else if args.networkStorage {
+		// Every stat() is a round trip to the server, so cache longer.
+		// Nobody else is supposed to change the backing storage.
+		networkSec := networkStorageCacheTimeout
+		fuseOpts = &fs.Options{
+			NegativeTimeout: &networkSec,
+			AttrTimeout:     &networkSec,
+			EntryTimeout:    &networkSec,
+		}
 	} else {
 		fuseOpts = &fs.Options{
 			// These options are to be compatible with libfuse defaults,
@@ -437,11 +885,17 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 	if args.reverse {
 		mOpts.Name += "-reverse"
 	}
-	// Add a volume name if running osxfuse. Otherwise the Finder will show it as
-	// something like "osxfuse Volume 0 (gocryptfs)".
+	// Add a volume name if running macFUSE. Otherwise the Finder will show it as
+	// something like "macFUSE Volume 0 (gocryptfs)".
 	if runtime.GOOS == "darwin" {
-		volname := strings.Replace(path.Base(args.mountpoint), ",", "_", -1)
+		volname := path.Base(args.mountpoint)
+		if args.volname != "" {
+			volname = args.volname
+		}
+		volname = strings.Replace(volname, ",", "_", -1)
 		mOpts.Options = append(mOpts.Options, "volname="+volname)
+	} else if args.volname != "" {
+		tlog.Warn.Printf("Warning: -volname is only supported on MacOS, ignoring it")
 	}
 	// The kernel enforces read-only operation, we just have to pass "ro".
 	// Reverse mounts are always read-only.
@@ -474,21 +928,44 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 		tlog.Debug.Printf("Adding -ko mount options: %v", parts)
 		mOpts.Options = append(mOpts.Options, parts...)
 	}
-	srv, err := fs.Mount(args.mountpoint, rootNode, fuseOpts)
-	if err != nil {
-		tlog.Fatal.Printf("fs.GoCryptAPI failed: %s", strings.TrimSpace(err.Error()))
-		if runtime.GOOS == "darwin" {
-			tlog.Info.Printf("Maybe you should run: /Library/Filesystems/osxfuse.fs/Contents/Resources/load_osxfuse")
+	rawFS := fs.NewNodeFS(rootNode, fuseOpts)
+	// "-max-read-mbps" and friends. Innermost, so that requests that the
+	// other gates reject do not use up the budget.
+	limits := throttle.Limits{
+		ReadBytes:  args.maxReadMBps * throttle.MB,
+		WriteBytes: args.maxWriteMBps * throttle.MB,
+		ReadOps:    float64(args.maxReadIOPS),
+		WriteOps:   float64(args.maxWriteIOPS),
+	}
+	if limits.Enabled() {
+		rawFS = throttle.Gate(rawFS, limits)
+	}
+	if rn, ok := rootNode.(*fusefrontend.RootNode); ok {
+		// "-snapshot create" freezes the filesystem via the control socket
+		rawFS = rn.FreezeGate(rawFS)
+	}
+	if len(args.idleIgnore) > 0 && !args.reverse {
+		// "-idle-ignore" needs the calling process of every request
+		rawFS = rootNode.(*fusefrontend.RootNode).IdleGate(rawFS)
+	}
+	if args.idlelock || args.onSuspend == "lock" {
+		// "-idlelock" and "-on-suspend lock" are only allowed in forward mode
+		rawFS = rootNode.(*fusefrontend.RootNode).LockGate(rawFS)
+	}
+	if args._supervisor != nil {
+		// Outermost, so that panics in the other wrappers are caught too
+		rawFS = panicgate.Gate(rawFS, args._supervisor.onPanic)
+	}
+	srv, err := fuse.NewServer(rawFS, args.mountpoint, &fuseOpts.MountOptions)
+	if err == nil {
+		// "-ctlsock" reports the operation counters
+		if args._opStats != nil {
+			srv.RecordLatencies(args._opStats)
 		}
-		os.Exit(exitcodes.FuseNewServer)
+		go srv.Serve()
+		err = srv.WaitMount()
 	}
-
-	// All FUSE file and directory create calls carry explicit permission
-	// information. We need an unrestricted umask to create the files and
-	// directories with the requested permissions.
-	syscall.Umask(0000)
-
-	return srv
+	return srv, err
 }
 
 // haveFusermount2 finds out if the "fusermount" binary is from libfuse 2.x.
@@ -514,32 +991,53 @@ func haveFusermount2() bool {
 	return false
 }
 
-func handleSigint(srv *fuse.Server, mountpoint string) {
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
-	signal.Notify(ch, syscall.SIGTERM)
-	go func() {
-		<-ch
-		fmt.Println("接收到SIGTERM或syscall.SIGINT信号，执行umount，并退出进程")
-		unmount(srv, mountpoint)
-		os.Exit(exitcodes.SigInt)
-	}()
+// unmountLazy calls srv.Unmount(), and if that fails, calls
+// "fusermount -u -z" (lazy unmount). Returns an error if the lazy unmount
+// fails, or if the first attempt fails on MacOS.
+func unmountLazy(srv *fuse.Server, mountpoint string) error {
+	err := srv.Unmount()
+	if err == nil {
+		return nil
+	}
+	tlog.Warn.Printf("unmount: srv.Unmount returned %v", err)
+	if runtime.GOOS != "linux" {
+		// MacOSX does not support lazy unmount
+		return err
+	}
+	tlog.Info.Printf("Trying lazy unmount")
+	return fusermountLazy(mountpoint)
 }
 
-// unmount() calls srv.Unmount(), and if that fails, calls "fusermount -u -z"
-// (lazy unmount).
-func unmount(srv *fuse.Server, mountpoint string) {
-	fmt.Println("执行umount")
-	err := srv.Unmount()
+// fusermountLazy detaches "mountpoint" with "fusermount -u -z". Works even
+// if the FUSE server is gone. Linux only.
+func fusermountLazy(mountpoint string) error {
+	out, err := exec.Command("fusermount", "-u", "-z", mountpoint).CombinedOutput()
 	if err != nil {
-		tlog.Warn.Printf("unmount: srv.Unmount returned %v", err)
-		if runtime.GOOS == "linux" {
-			// MacOSX does not support lazy unmount
-			tlog.Info.Printf("Trying lazy unmount")
-			cmd := exec.Command("fusermount", "-u", "-z", mountpoint)
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			cmd.Run()
+		return fmt.Errorf("fusermount -u -z: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// replayJournal replays the "-journal" left behind by a crash. Read-only
+// mounts only warn about it.
+func replayJournal(args *argContainer) {
+	if args.ro {
+		st, err := os.Stat(filepath.Join(args.cipherdir, journal.FileName))
+		if err == nil && st.Size() > 0 {
+			tlog.Warn.Printf("journal: %s has records of interrupted operations, mount read-write to replay them",
+				journal.FileName)
 		}
+		return
+	}
+	n, warnings, err := journal.Replay(args.cipherdir)
+	for _, w := range warnings {
+		tlog.Warn.Printf("journal: %v", w)
+	}
+	if err != nil {
+		tlog.Warn.Printf("journal: replay failed: %v", err)
+		return
+	}
+	if n > 0 {
+		tlog.Info.Printf("journal: replayed %d records of interrupted operations", n)
 	}
 }
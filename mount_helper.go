@@ -0,0 +1,153 @@
+package gocryptfs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// mount(8) runs "/sbin/mount.TYPE" for "-t TYPE" and mount.fuse(8) runs
+// "mount.fuse.TYPE" for "-t fuse.TYPE". We act as the mount helper if we are
+// called by one of these names.
+var mountHelperNames = []string{"mount.gocryptfs", "mount.fuse.gocryptfs"}
+
+// askPassword is the program used to ask for the password if the fstab
+// entry does not say where to get it from
+const askPassword = "systemd-ask-password"
+
+// lookPath is exec.LookPath, replaced in tests
+var lookPath = exec.LookPath
+
+// IsMountHelper returns true if "argv0" is one of the names gocryptfs is
+// installed under as a mount(8) helper.
+func IsMountHelper(argv0 string) bool {
+	base := filepath.Base(argv0)
+	for _, n := range mountHelperNames {
+		if base == n {
+			return true
+		}
+	}
+	return false
+}
+
+// MountHelperMain is the main function of the mount(8) helper. "argv" is
+// the command line passed by mount(8):
+//
+//	mount.gocryptfs CIPHERDIR MOUNTPOINT [-sfnv] [-o OPTIONS]
+//
+// Calls os.Exit on errors.
+func MountHelperMain(argv []string) {
+	cmd, err := mountHelperArgs(argv, os.Getenv("CREDENTIALS_DIRECTORY"))
+	if err != nil {
+		tlog.Fatal.Printf("%s: %v", filepath.Base(argv[0]), err)
+		os.Exit(exitcodes.Usage)
+	}
+	if cmd == nil {
+		// "mount -f": do everything except the actual mount
+		os.Exit(0)
+	}
+	doMain(cmd, "", nil)
+}
+
+// mountHelperArgs translates the mount(8) helper command line "argv" into a
+// gocryptfs command line. Returns nil if there is nothing to do ("-f").
+// Testcases in TestMountHelperArgs().
+//
+// The fstab options are passed on as gocryptfs options, except
+//
+//   - options that only mean something to mount(8) or systemd, like "noauto",
+//     "_netdev" and "x-systemd.automount", are dropped
+//   - "credential=NAME" reads the password from the systemd credential NAME
+//     (see "LoadCredential=" in systemd.exec(5))
+//   - if no password source is given, the password is asked for with
+//     systemd-ask-password(1)
+func mountHelperArgs(argv []string, credDir string) ([]string, error) {
+	// forkChild() runs us again with the translated command line, which
+	// starts with "-fg"
+	if len(argv) > 1 && strings.HasPrefix(argv[1], "-") {
+		return argv, nil
+	}
+	var paths, opts []string
+	fake := false
+	for i := 1; i < len(argv); i++ {
+		a := argv[i]
+		switch {
+		case a == "-o" || a == "-t" || a == "-N":
+			if i+1 >= len(argv) {
+				return nil, fmt.Errorf("%s requires an argument", a)
+			}
+			i++
+			if a == "-o" {
+				opts = append(opts, strings.Split(argv[i], ",")...)
+			}
+		case strings.HasPrefix(a, "-o"):
+			opts = append(opts, strings.Split(a[2:], ",")...)
+		case a == "-f":
+			fake = true
+		case a == "-s" || a == "-n" || a == "-v":
+			// Sloppy, no mtab, verbose: nothing to do for us
+		case strings.HasPrefix(a, "-"):
+			return nil, fmt.Errorf("unknown option %q", a)
+		default:
+			paths = append(paths, a)
+		}
+	}
+	if len(paths) != 2 {
+		return nil, fmt.Errorf("usage: %s CIPHERDIR MOUNTPOINT [-o OPTIONS]", filepath.Base(argv[0]))
+	}
+	out := []string{argv[0]}
+	havePassword := false
+	for _, o := range opts {
+		name := strings.SplitN(o, "=", 2)[0]
+		switch {
+		case o == "":
+			continue
+		case isMountOnlyOption(o):
+			continue
+		case name == "credential":
+			if credDir == "" {
+				return nil, fmt.Errorf("%q: CREDENTIALS_DIRECTORY is not set", o)
+			}
+			cred := o[len(name)+1:]
+			if cred == "" || strings.Contains(cred, "/") {
+				return nil, fmt.Errorf("%q: invalid credential name", o)
+			}
+			out = append(out, "-passfile="+filepath.Join(credDir, cred))
+			havePassword = true
+			continue
+		case name == "passfile" || name == "extpass" || name == "masterkey" ||
+			name == "zerokey" || name == "fido2" || name == "init" || name == "passwd":
+			havePassword = true
+		}
+		out = append(out, "-"+o)
+	}
+	if fake {
+		return nil, nil
+	}
+	if !havePassword {
+		if _, err := lookPath(askPassword); err != nil {
+			return nil, fmt.Errorf("no password source. Use the passfile= or credential= option, or install %s", askPassword)
+		}
+		// Multiple -extpass are not split on spaces
+		out = append(out, "-extpass", askPassword,
+			"-extpass", "--id=gocryptfs:"+paths[1],
+			"-extpass", "Password for "+paths[0]+":")
+	}
+	return append(out, paths...), nil
+}
+
+// isMountOnlyOption returns true for fstab options that are meant for
+// mount(8) or systemd, not for gocryptfs
+func isMountOnlyOption(o string) bool {
+	switch o {
+	case "defaults", "auto", "noauto", "user", "nouser", "users", "owner",
+		"group", "_netdev", "rw", "nofail":
+		return true
+	}
+	return strings.HasPrefix(o, "x-") || strings.HasPrefix(o, "comment=")
+}
@@ -0,0 +1,81 @@
+package gocryptfs
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// TestMountHelperArgs checks the translation of the mount(8) helper command
+// line
+func TestMountHelperArgs(t *testing.T) {
+	oldLookPath := lookPath
+	defer func() { lookPath = oldLookPath }()
+	lookPath = func(file string) (string, error) { return "/bin/" + file, nil }
+	ask := []string{"-extpass", askPassword, "-extpass", "--id=gocryptfs:/m", "-extpass", "Password for /c:"}
+	testcases := []testcase{
+		{
+			i: []string{"mount.gocryptfs", "/c", "/m"},
+			o: append(append([]string{"mount.gocryptfs"}, ask...), "/c", "/m"),
+		},
+		{
+			i: []string{"mount.gocryptfs", "/c", "/m", "-o", "rw,noauto,x-systemd.automount,_netdev,allow_other,passfile=/p"},
+			o: []string{"mount.gocryptfs", "-allow_other", "-passfile=/p", "/c", "/m"},
+		},
+		{
+			i: []string{"mount.gocryptfs", "/c", "/m", "-n", "-s", "-oro,credential=pw"},
+			o: []string{"mount.gocryptfs", "-ro", "-passfile=/run/credentials/x/pw", "/c", "/m"},
+		},
+		// Fake mount
+		{
+			i: []string{"mount.gocryptfs", "/c", "/m", "-f", "-o", "passfile=/p"},
+			o: nil,
+		},
+		// Already translated by the parent, see forkChild()
+		{
+			i: []string{"mount.gocryptfs", "-fg", "-notifypid=1", "/c", "/m"},
+			o: []string{"mount.gocryptfs", "-fg", "-notifypid=1", "/c", "/m"},
+		},
+		{
+			i: []string{"mount.gocryptfs", "/c"},
+			e: true,
+		},
+		{
+			i: []string{"mount.gocryptfs", "/c", "/m", "-o", "credential=../pw"},
+			e: true,
+		},
+		{
+			i: []string{"mount.gocryptfs", "/c", "/m", "-x"},
+			e: true,
+		},
+	}
+	for _, tc := range testcases {
+		o, err := mountHelperArgs(tc.i, "/run/credentials/x")
+		if (err != nil) != tc.e {
+			t.Errorf("%v: unexpected error %v", tc.i, err)
+			continue
+		}
+		if !tc.e && !reflect.DeepEqual(o, tc.o) {
+			t.Errorf("%v:\nwant %q\nhave %q", tc.i, tc.o, o)
+		}
+	}
+	// No password source
+	lookPath = func(file string) (string, error) { return "", errors.New("not found") }
+	if _, err := mountHelperArgs([]string{"mount.gocryptfs", "/c", "/m"}, ""); err == nil {
+		t.Error("should fail without a password source")
+	}
+	if _, err := mountHelperArgs([]string{"mount.gocryptfs", "/c", "/m", "-o", "credential=pw"}, ""); err == nil {
+		t.Error("credential= should fail without CREDENTIALS_DIRECTORY")
+	}
+}
+
+func TestIsMountHelper(t *testing.T) {
+	for _, n := range []string{"/sbin/mount.gocryptfs", "mount.fuse.gocryptfs"} {
+		if !IsMountHelper(n) {
+			t.Errorf("%q should be a mount helper", n)
+		}
+	}
+	if IsMountHelper("/usr/bin/gocryptfs") {
+		t.Error("gocryptfs is not a mount helper")
+	}
+}
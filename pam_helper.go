@@ -0,0 +1,221 @@
+package gocryptfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/snapshot"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// pamStateDir holds the session counters of "-pam-helper", one file per uid.
+// It is a variable for the tests.
+var pamStateDir = "/run/gocryptfs-pam"
+
+// pamHelper implements "-pam-helper", which is run by pam_exec(8) as root:
+//
+//	auth          optional pam_exec.so expose_authtok /usr/bin/gocryptfs -pam-helper ...
+//	session       optional pam_exec.so /usr/bin/gocryptfs -pam-helper ...
+//
+// In the "auth" phase, pam_exec passes the login password on stdin, and the
+// CIPHERDIR of the user is mounted with it, as the user. "open_session" and
+// "close_session" count the sessions of the user, and the last logout
+// unmounts. "%u" and "%h" in the command line are replaced with the user
+// name and the home directory. Returns the exit code.
+func pamHelper(args *argContainer) int {
+	if !args.extpass.Empty() || len(args.passfile) != 0 || args.passwordFrom != "" || args.masterkey != "" {
+		tlog.Fatal.Printf("-pam-helper gets the password from pam_exec and cannot be combined with -extpass, -passfile, -password-from or -masterkey")
+		return exitcodes.Usage
+	}
+	pamType := os.Getenv("PAM_TYPE")
+	pamUser := os.Getenv("PAM_USER")
+	if pamType == "" || pamUser == "" {
+		tlog.Fatal.Printf("-pam-helper: PAM_TYPE or PAM_USER is not set. Run it from pam_exec.")
+		return exitcodes.Usage
+	}
+	u, err := user.Lookup(pamUser)
+	if err != nil {
+		tlog.Fatal.Printf("-pam-helper: %v", err)
+		return exitcodes.Usage
+	}
+	if args._flagSet.NArg() != 2 {
+		tlog.Fatal.Printf("-pam-helper: CIPHERDIR and MOUNTPOINT are required")
+		return exitcodes.Usage
+	}
+	argv := pamMountArgs(args._argv, u)
+	r := pamReplacer(u)
+	cipherdir := r.Replace(args._flagSet.Arg(0))
+	mountpoint := r.Replace(args._flagSet.Arg(1))
+	switch pamType {
+	case "auth":
+		if snapshot.IsMounted(cipherdir) {
+			return 0
+		}
+		password, err := readAuthtok(os.Stdin)
+		if err != nil {
+			tlog.Fatal.Printf("-pam-helper: %v", err)
+			return exitcodes.ReadPassword
+		}
+		return pamMount(argv, u, password)
+	case "open_session":
+		n, err := pamCountSessions(u.Uid, 1)
+		if err != nil {
+			tlog.Warn.Printf("-pam-helper: %v", err)
+		}
+		tlog.Debug.Printf("-pam-helper: %d sessions of %s", n, pamUser)
+		if !snapshot.IsMounted(cipherdir) {
+			tlog.Warn.Printf("-pam-helper: %s is not mounted. Is the auth line missing?", cipherdir)
+		}
+	case "close_session":
+		n, err := pamCountSessions(u.Uid, -1)
+		if err != nil {
+			tlog.Warn.Printf("-pam-helper: %v", err)
+			return 0
+		}
+		if n > 0 || !snapshot.IsMounted(cipherdir) {
+			return 0
+		}
+		tlog.Info.Printf("-pam-helper: last session of %s closed, unmounting %s", pamUser, mountpoint)
+		if err := syscall.Unmount(mountpoint, 0); err != nil {
+			// Processes of the user that outlive the session
+			if err := detachStale(mountpoint); err != nil {
+				tlog.Warn.Printf("-pam-helper: cannot unmount %s: %v", mountpoint, err)
+			}
+		}
+	}
+	return 0
+}
+
+// pamMountArgs returns the command line for mounting: "argv" without
+// "-pam-helper", with "%u", "%h" and "%%" expanded
+func pamMountArgs(argv []string, u *user.User) []string {
+	r := pamReplacer(u)
+	var out []string
+	for i, a := range argv {
+		switch strings.TrimPrefix(a, "-") {
+		case "-pam-helper", "pam-helper", "-pam-helper=true", "pam-helper=true":
+			continue
+		}
+		if i > 0 {
+			a = r.Replace(a)
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+func pamReplacer(u *user.User) *strings.Replacer {
+	return strings.NewReplacer("%u", u.Username, "%h", u.HomeDir, "%%", "%")
+}
+
+// readAuthtok reads the password that pam_exec writes to stdin with
+// "expose_authtok". It is followed by a NUL byte.
+func readAuthtok(r io.Reader) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, 4096))
+	if err != nil {
+		return nil, err
+	}
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	buf = bytes.TrimSuffix(buf, []byte("\n"))
+	if len(buf) == 0 || bytes.IndexByte(buf, '\n') >= 0 {
+		return nil, fmt.Errorf("no usable password on stdin. Is expose_authtok missing?")
+	}
+	return buf, nil
+}
+
+// pamMount runs "argv" as user "u", with "password" on stdin, and waits
+// until the filesystem is mounted
+func pamMount(argv []string, u *user.User, password []byte) int {
+	uid, err1 := strconv.ParseUint(u.Uid, 10, 32)
+	gid, err2 := strconv.ParseUint(u.Gid, 10, 32)
+	if err1 != nil || err2 != nil {
+		tlog.Fatal.Printf("-pam-helper: non-numeric uid %q or gid %q", u.Uid, u.Gid)
+		return exitcodes.Usage
+	}
+	var groups []uint32
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+				groups = append(groups, uint32(g))
+			}
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		exe = argv[0]
+	}
+	cmdArgs := append([]string{"-passfile", "/dev/stdin"}, argv[1:]...)
+	cmd := exec.Command(exe, cmdArgs...)
+	cmd.Args[0] = argv[0]
+	cmd.Dir = "/"
+	cmd.Env = []string{
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"LOGNAME=" + u.Username,
+		"PATH=/usr/sbin:/usr/bin:/sbin:/bin",
+	}
+	// "argv" does not contain the defaults from GOCRYPTFS_OPTS
+	if opts, ok := os.LookupEnv(envOptsName); ok {
+		cmd.Env = append(cmd.Env, envOptsName+"="+opts)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups},
+	}
+	cmd.Stdin = bytes.NewReader(append(password, '\n'))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	tlog.Debug.Printf("-pam-helper: running %v as uid %d", cmd.Args, uid)
+	if err := cmd.Run(); err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			return exiterr.ExitCode()
+		}
+		tlog.Fatal.Printf("-pam-helper: %v", err)
+		return exitcodes.ForkChild
+	}
+	return 0
+}
+
+// pamCountSessions adds "delta" to the session counter of "uid" and returns
+// the new value
+func pamCountSessions(uid string, delta int) (int, error) {
+	if err := os.MkdirAll(pamStateDir, 0700); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(filepath.Join(pamStateDir, uid), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, err
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	// An unreadable counter is reset
+	n, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+	n += delta
+	if n < 0 {
+		n = 0
+	}
+	if err := f.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(n)+"\n"), 0); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
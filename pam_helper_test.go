@@ -0,0 +1,67 @@
+package gocryptfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPamMountArgs(t *testing.T) {
+	u := &user.User{Username: "alice", HomeDir: "/home/alice"}
+	have := pamMountArgs([]string{"gocryptfs", "-pam-helper", "-nonempty", "-config", "/etc/%u.conf",
+		"/home/.%u.crypt", "%h", "100%%"}, u)
+	want := []string{"gocryptfs", "-nonempty", "-config", "/etc/alice.conf",
+		"/home/.alice.crypt", "/home/alice", "100%"}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	have = pamMountArgs([]string{"gocryptfs", "--pam-helper=true", "a", "b"}, u)
+	if !reflect.DeepEqual(have, []string{"gocryptfs", "a", "b"}) {
+		t.Errorf("--pam-helper=true was not removed: %v", have)
+	}
+}
+
+func TestReadAuthtok(t *testing.T) {
+	for in, want := range map[string]string{
+		"secret\x00":   "secret",
+		"secret":       "secret",
+		"secret\n":     "secret",
+		"sec ret\x00x": "sec ret",
+	} {
+		have, err := readAuthtok(strings.NewReader(in))
+		if err != nil || !bytes.Equal(have, []byte(want)) {
+			t.Errorf("%q: have %q, %v", in, have, err)
+		}
+	}
+	for _, in := range []string{"", "\x00", "a\nb"} {
+		if _, err := readAuthtok(strings.NewReader(in)); err == nil {
+			t.Errorf("%q was accepted", in)
+		}
+	}
+}
+
+func TestPamCountSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pam_helper_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := pamStateDir
+	pamStateDir = dir + "/state"
+	defer func() { pamStateDir = oldDir }()
+	for i, step := range []struct{ delta, want int }{
+		{1, 1}, {1, 2}, {-1, 1}, {-1, 0}, {-1, 0}, {1, 1},
+	} {
+		n, err := pamCountSessions("1000", step.delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != step.want {
+			t.Errorf("step %d: want %d, have %d", i, step.want, n)
+		}
+	}
+}
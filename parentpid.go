@@ -0,0 +1,101 @@
+package gocryptfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// parentPollInterval is how often "-parentpid" checks whether the watched
+// process is still alive
+const parentPollInterval = time.Second
+
+// watchParent implements "-parentpid". When process "pid" exits, it
+// unmounts "srv" and calls "wipeKeys" once the FUSE server has stopped.
+// It also returns when the filesystem is unmounted otherwise.
+func watchParent(pid int, srv fuseServer, mountpoint string, wipeKeys func()) {
+	done := make(chan struct{})
+	go func() {
+		srv.Wait()
+		close(done)
+	}()
+	// PIDs are reused. Remembering the start time tells a new process with
+	// the same PID apart.
+	start := processStartTime(pid)
+	for processAlive(pid, start) {
+		if !sleepOrDone(parentPollInterval, done) {
+			return
+		}
+	}
+	tlog.Info.Printf("-parentpid: process %d exited; unmounting %s", pid, mountpoint)
+	if err := srv.Unmount(); err != nil {
+		tlog.Warn.Printf("-parentpid: unmount failed: %v", err)
+		if runtime.GOOS != "linux" {
+			return
+		}
+		// Nobody is left to retry, so detach the mountpoint. The
+		// FUSE server stops when the last open file is closed.
+		tlog.Info.Printf("Trying lazy unmount")
+		if err := fusermountLazy(mountpoint); err != nil {
+			tlog.Warn.Printf("-parentpid: %v", err)
+			return
+		}
+	}
+	<-done
+	wipeKeys()
+}
+
+// processAlive returns true if process "pid" exists, has not become a
+// zombie, and still has the start time "start". An empty "start" is not
+// checked.
+func processAlive(pid int, start string) bool {
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return false
+	}
+	stat, err := readProcStat(pid)
+	if err != nil {
+		// No /proc (MacOS), or the process has just exited
+		return runtime.GOOS != "linux"
+	}
+	// An exited process stays a zombie until it is reaped
+	if stat[0] == "Z" {
+		return false
+	}
+	return start == "" || stat[19] == start
+}
+
+// processStartTime returns the start time of process "pid" from
+// /proc/PID/stat, or an empty string if it cannot be read.
+func processStartTime(pid int) string {
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return ""
+	}
+	return stat[19]
+}
+
+// readProcStat returns the fields of /proc/PID/stat that follow the process
+// name, starting with the state. See proc(5).
+func readProcStat(pid int) ([]string, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// The process name is in parentheses and may itself contain spaces
+	// and parentheses
+	s := string(content)
+	i := strings.LastIndexByte(s, ')')
+	if i < 0 {
+		return nil, fmt.Errorf("/proc/%d/stat: cannot parse %q", pid, s)
+	}
+	fields := strings.Fields(s[i+1:])
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("/proc/%d/stat: only %d fields", pid, len(fields))
+	}
+	return fields, nil
+}
@@ -0,0 +1,54 @@
+package gocryptfs
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestProcessAlive(t *testing.T) {
+	pid := os.Getpid()
+	start := processStartTime(pid)
+	if !processAlive(pid, start) {
+		t.Error("own process is not alive")
+	}
+	if start != "" && processAlive(pid, start+"0") {
+		t.Error("start time was not checked")
+	}
+	cmd := exec.Command("true")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	child := cmd.Process.Pid
+	cmd.Wait()
+	if processAlive(child, "") {
+		t.Errorf("exited process %d is alive", child)
+	}
+}
+
+type fakeServer struct {
+	unmounted chan struct{}
+}
+
+func (s *fakeServer) Unmount() error {
+	close(s.unmounted)
+	return nil
+}
+
+func (s *fakeServer) Wait() {
+	<-s.unmounted
+}
+
+func TestWatchParent(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	srv := &fakeServer{unmounted: make(chan struct{})}
+	wiped := make(chan struct{})
+	go watchParent(cmd.Process.Pid, srv, "/mnt", func() { close(wiped) })
+	cmd.Process.Kill()
+	// Leave a zombie behind: watchParent must not wait until it is reaped
+	<-wiped
+	cmd.Wait()
+}
@@ -0,0 +1,90 @@
+package gocryptfs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/HorizonLiu/gocryptfs/internal/keychain"
+	"github.com/HorizonLiu/gocryptfs/internal/secretservice"
+)
+
+// PasswordProvider supplies the password of a filesystem. It lets
+// applications get the password from their own secret store instead of
+// through "-extpass" or "-passfile".
+type PasswordProvider interface {
+	// GetPassword returns the password. "attempt" is 1 on the first call and
+	// is incremented every time the previous password was wrong. The
+	// returned slice is overwritten with zeros after use.
+	GetPassword(ctx context.Context, attempt int) ([]byte, error)
+}
+
+// PasswordFunc adapts an ordinary function to the PasswordProvider interface
+type PasswordFunc func(ctx context.Context, attempt int) ([]byte, error)
+
+// GetPassword calls f(ctx, attempt)
+func (f PasswordFunc) GetPassword(ctx context.Context, attempt int) ([]byte, error) {
+	return f(ctx, attempt)
+}
+
+// StaticPassword returns a PasswordProvider that always returns "password"
+func StaticPassword(password string) PasswordProvider {
+	return PasswordFunc(func(ctx context.Context, attempt int) ([]byte, error) {
+		return []byte(password), nil
+	})
+}
+
+// SecretServicePassword returns a PasswordProvider that looks up the item
+// with the attributes "attrs" in the FreeDesktop Secret Service (GNOME
+// Keyring, KeePassXC, KWallet) of the session bus, like
+// "secret-tool lookup ATTRIBUTE VALUE ..." does.
+func SecretServicePassword(attrs map[string]string) PasswordProvider {
+	return PasswordFunc(func(ctx context.Context, attempt int) ([]byte, error) {
+		return secretservice.Lookup(attrs)
+	})
+}
+
+// passwordStore is a password source that can also save the password of a
+// new filesystem
+type passwordStore interface {
+	PasswordProvider
+	StorePassword(password []byte) error
+}
+
+// keychainPassword is the "-password-from keychain:ITEM" source. The string
+// is the service name of the item.
+type keychainPassword string
+
+// GetPassword implements PasswordProvider
+func (k keychainPassword) GetPassword(ctx context.Context, attempt int) ([]byte, error) {
+	return keychain.Lookup(string(k))
+}
+
+// StorePassword implements passwordStore
+func (k keychainPassword) StorePassword(password []byte) error {
+	return keychain.Store(string(k), password)
+}
+
+// parsePasswordFrom parses the argument of "-password-from", which is
+// "secret-service:ATTRIBUTE=VALUE,..." or, on macOS, "keychain:ITEM"
+func parsePasswordFrom(s string) (PasswordProvider, error) {
+	const prefix = "secret-service:"
+	if strings.HasPrefix(s, "keychain:") {
+		if !keychain.Supported {
+			return nil, fmt.Errorf("the Keychain is only available on macOS")
+		}
+		item := strings.TrimPrefix(s, "keychain:")
+		if item == "" {
+			return nil, fmt.Errorf("keychain: missing item name")
+		}
+		return keychainPassword(item), nil
+	}
+	if !strings.HasPrefix(s, prefix) {
+		return nil, fmt.Errorf("unknown password source %q, want %sATTRIBUTE=VALUE,... or keychain:ITEM", s, prefix)
+	}
+	attrs, err := secretservice.ParseAttributes(strings.TrimPrefix(s, prefix))
+	if err != nil {
+		return nil, err
+	}
+	return SecretServicePassword(attrs), nil
+}
@@ -0,0 +1,302 @@
+package gocryptfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// profilesPath returns the location of the option profiles,
+// ~/.config/gocryptfs/profiles.toml
+func profilesPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gocryptfs", "profiles.toml"), nil
+}
+
+// findProfile returns the value of "-profile" in "args", or "" if it is not
+// set. The command line has to be searched before it is parsed, because the
+// options of the profile go before those on the command line.
+func findProfile(args []string) (name string, err error) {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			break
+		}
+		switch {
+		case a == "-profile" || a == "--profile":
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("flag needs an argument: %s", a)
+			}
+			i++
+			name = args[i]
+		case strings.HasPrefix(a, "-profile=") || strings.HasPrefix(a, "--profile="):
+			name = a[strings.IndexByte(a, '=')+1:]
+		}
+	}
+	return name, nil
+}
+
+// loadProfile returns the options of profile "name" from "path" as flags
+func loadProfile(path string, name string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := parseProfiles(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	p, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: there is no profile %q", path, name)
+	}
+	return p, nil
+}
+
+// parseProfiles parses a profiles.toml file. Every table is a profile, and
+// every key in it an option:
+//
+//	[fast-nas]
+//	fsname = "nas"               ->  -fsname=nas
+//	allow_other = true           ->  -allow_other
+//	kernel_cache = false         ->  -kernel_cache=false
+//	readahead = 512              ->  -readahead=512
+//	exclude = ["*.tmp", ".cache"]  ->  -exclude=*.tmp -exclude=.cache
+//
+// Only this subset of TOML is understood. The result maps profile names to
+// their options as flags.
+func parseProfiles(data []byte) (map[string][]string, error) {
+	p := &profileParser{data: data, line: 1}
+	profiles := make(map[string][]string)
+	var current string
+	for {
+		p.skipBlank(true)
+		if p.eof() {
+			return profiles, nil
+		}
+		if p.peek() == '[' {
+			p.pos++
+			p.skipBlank(false)
+			name, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			p.skipBlank(false)
+			if p.eof() || p.peek() != ']' {
+				return nil, p.errorf("expected \"]\" after the profile name")
+			}
+			p.pos++
+			if _, ok := profiles[name]; ok {
+				return nil, p.errorf("profile %q is defined twice", name)
+			}
+			profiles[name] = []string{}
+			current = name
+		} else {
+			key, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			if current == "" {
+				return nil, p.errorf("option %q is outside of a [profile] section", key)
+			}
+			if key == "profile" {
+				return nil, p.errorf("profiles cannot include other profiles")
+			}
+			p.skipBlank(false)
+			if p.eof() || p.peek() != '=' {
+				return nil, p.errorf("expected \"=\" after %q", key)
+			}
+			p.pos++
+			p.skipBlank(false)
+			vals, err := p.value(true)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range vals {
+				flag := "-" + key
+				if v != "true" {
+					flag += "=" + v
+				}
+				profiles[current] = append(profiles[current], flag)
+			}
+		}
+		p.skipBlank(false)
+		if !p.eof() && p.peek() != '\n' {
+			return nil, p.errorf("unexpected %q at the end of the line", p.peek())
+		}
+	}
+}
+
+// profileParser reads a profiles.toml file byte by byte
+type profileParser struct {
+	data []byte
+	pos  int
+	line int
+}
+
+func (p *profileParser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *profileParser) peek() byte {
+	return p.data[p.pos]
+}
+
+func (p *profileParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%d: %s", p.line, fmt.Sprintf(format, a...))
+}
+
+// skipBlank skips spaces, tabs and comments, and also line breaks if
+// "newlines" is set
+func (p *profileParser) skipBlank(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		case c == '\n' && newlines:
+			p.line++
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// key reads a bare or a quoted key
+func (p *profileParser) key() (string, error) {
+	if !p.eof() && (p.peek() == '"' || p.peek() == '\'') {
+		return p.str()
+	}
+	start := p.pos
+	for !p.eof() && isBareKeyChar(p.peek()) {
+		p.pos++
+	}
+	if p.pos == start {
+		if p.eof() {
+			return "", p.errorf("unexpected end of file")
+		}
+		return "", p.errorf("unexpected %q", p.peek())
+	}
+	return string(p.data[start:p.pos]), nil
+}
+
+// value reads a string, a boolean, a number or, if "array" is set, an
+// array of those
+func (p *profileParser) value(array bool) ([]string, error) {
+	if p.eof() {
+		return nil, p.errorf("value missing")
+	}
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		s, err := p.str()
+		return []string{s}, err
+	case c == '[' && array:
+		p.pos++
+		var vals []string
+		for {
+			p.skipBlank(true)
+			if p.eof() {
+				return nil, p.errorf("unterminated array")
+			}
+			if p.peek() == ']' {
+				p.pos++
+				return vals, nil
+			}
+			v, err := p.value(false)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, v...)
+			p.skipBlank(true)
+			if !p.eof() && p.peek() == ',' {
+				p.pos++
+			} else if p.eof() || p.peek() != ']' {
+				return nil, p.errorf("expected \",\" or \"]\" in array")
+			}
+		}
+	}
+	start := p.pos
+	for !p.eof() && (isBareKeyChar(p.peek()) || p.peek() == '.' || p.peek() == '+') {
+		p.pos++
+	}
+	v := string(p.data[start:p.pos])
+	if v == "true" || v == "false" {
+		return []string{v}, nil
+	}
+	if _, err := strconv.ParseFloat(strings.Replace(v, "_", "", -1), 64); err != nil || v == "" {
+		return nil, p.errorf("invalid value %q. Strings need quotes.", v)
+	}
+	return []string{strings.Replace(v, "_", "", -1)}, nil
+}
+
+// str reads a basic string in double quotes or a literal string in single
+// quotes
+func (p *profileParser) str() (string, error) {
+	quote := p.peek()
+	p.pos++
+	var sb strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.peek()
+		p.pos++
+		if c == quote {
+			return sb.String(), nil
+		}
+		if c != '\\' || quote == '\'' {
+			sb.WriteByte(c)
+			continue
+		}
+		if p.eof() {
+			return "", p.errorf("unterminated string")
+		}
+		e := p.peek()
+		p.pos++
+		switch e {
+		case '"', '\\':
+			sb.WriteByte(e)
+		case 'b':
+			sb.WriteByte('\b')
+		case 't':
+			sb.WriteByte('\t')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'u', 'U':
+			n := 4
+			if e == 'U' {
+				n = 8
+			}
+			if p.pos+n > len(p.data) {
+				return "", p.errorf("invalid escape sequence")
+			}
+			r, err := strconv.ParseUint(string(p.data[p.pos:p.pos+n]), 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) {
+				return "", p.errorf("invalid escape sequence")
+			}
+			p.pos += n
+			sb.WriteRune(rune(r))
+		default:
+			return "", p.errorf("invalid escape sequence \"\\%c\"", e)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package gocryptfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProfiles(t *testing.T) {
+	data := `# Options for my volumes
+[paranoid]
+idle = "5m"   # short
+kernel_cache = false
+longnamemax = 1_00
+
+["fast-nas"]
+allow_other = true
+fsname = 'nas\x'
+volname = "a \"b\" ä"
+exclude = [
+	"*.tmp", # editors
+	".cache",
+]
+`
+	have, err := parseProfiles([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"paranoid": {"-idle=5m", "-kernel_cache=false", "-longnamemax=100"},
+		"fast-nas": {"-allow_other", `-fsname=nas\x`, `-volname=a "b" ä`, "-exclude=*.tmp", "-exclude=.cache"},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %q", have)
+	}
+	for _, bad := range []string{
+		"idle = \"5m\"\n",
+		"[a]\nidle = 5m\n",
+		"[a]\nfsname = \"x\n",
+		"[a]\n[a]\n",
+		"[a]\nprofile = \"b\"\n",
+		"[a]\nx = 1 y = 2\n",
+		"[a]\nexclude = [\"a\" \"b\"]\n",
+		"[a\n",
+	} {
+		if _, err := parseProfiles([]byte(bad)); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+	_, err = parseProfiles([]byte("[a]\nx = 1\n\n  y\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "4: ") {
+		t.Errorf("wrong line number: %v", err)
+	}
+}
+
+// TestProfileOpts checks that the options of a profile go between
+// GOCRYPTFS_OPTS and the command line
+func TestProfileOpts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// ~/Library/Application Support on macOS
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	defer os.Setenv("HOME", home)
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+	path, err := profilesPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Dir(path), 0700)
+	err = ioutil.WriteFile(path, []byte("[nas]\nfsname = \"nas\"\nidle = \"1h\"\nro = true\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(envOptsName, "fsname=env,i=1m,allow_other")
+	defer os.Unsetenv(envOptsName)
+	a := parseCliOptsDiy([]string{"gocryptfs", "-fsname", "cli", "/a", "/b", "-o", "profile=nas"})
+	if a.fsname != "cli" || a.idle != time.Hour || !a.ro || !a.allow_other || a.profile != "nas" {
+		t.Errorf("fsname=%q idle=%v ro=%v allow_other=%v", a.fsname, a.idle, a.ro, a.allow_other)
+	}
+	if a._flagSet.NArg() != 2 {
+		t.Errorf("args: %q", a._flagSet.Args())
+	}
+}
@@ -0,0 +1,121 @@
+package gocryptfs
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	fscklib "github.com/HorizonLiu/gocryptfs/fsck"
+)
+
+// progressLine prints the progress of "-verify" and "-fsck" to stderr once
+// a second
+type progressLine struct {
+	// prefix is the name of the action, like "verify"
+	prefix string
+	// total is the plaintext size of all files. Zero while it is unknown.
+	total int64
+	start time.Time
+	mu    sync.Mutex
+	last  fscklib.Progress
+	// base is the number of bytes that had been done when the action was
+	// resumed
+	base int64
+	done chan struct{}
+	// printed is set once a progress line has been printed
+	printed bool
+	// stopped is closed when printLoop() has returned
+	stopped chan struct{}
+}
+
+func newProgressLine(prefix string, total int64) *progressLine {
+	p := &progressLine{
+		prefix:  prefix,
+		total:   total,
+		start:   time.Now(),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go p.printLoop()
+	return p
+}
+
+// update is the fscklib.Options.Progress callback
+func (p *progressLine) update(pr fscklib.Progress) {
+	p.mu.Lock()
+	p.last = pr
+	p.mu.Unlock()
+}
+
+// setTotal sets the plaintext size of all files, if it has been counted
+// in the background
+func (p *progressLine) setTotal(total int64) {
+	p.mu.Lock()
+	p.total = total
+	p.mu.Unlock()
+}
+
+// resumeAt tells that "pr" had already been done when the action was
+// resumed, so that it is not included in the rate the ETA is based on
+func (p *progressLine) resumeAt(pr fscklib.Progress) {
+	p.mu.Lock()
+	p.last = pr
+	p.base = pr.Bytes
+	p.mu.Unlock()
+}
+
+func (p *progressLine) printLoop() {
+	defer close(p.stopped)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		}
+		p.mu.Lock()
+		pr := p.last
+		total := p.total
+		base := p.base
+		p.mu.Unlock()
+		line := fmt.Sprintf("%s: %d entries, %s", p.prefix, pr.Checked, formatBytes(pr.Bytes))
+		if total > 0 {
+			line += " of " + formatBytes(total)
+		}
+		if total > 0 && pr.Bytes > base {
+			elapsed := time.Since(p.start)
+			eta := time.Duration(float64(elapsed) * float64(total-pr.Bytes) / float64(pr.Bytes-base))
+			if eta < 0 {
+				eta = 0
+			}
+			line += fmt.Sprintf(" (%d%%), ETA %v", pr.Bytes*100/total, eta.Round(time.Second))
+		}
+		fmt.Fprintf(os.Stderr, "\r%-79s", line)
+		p.printed = true
+	}
+}
+
+// stop stops printing and clears the progress line
+func (p *progressLine) stop() {
+	close(p.done)
+	<-p.stopped
+	if p.printed {
+		fmt.Fprintf(os.Stderr, "\r%79s\r", "")
+	}
+}
+
+// formatBytes formats "n" using binary prefixes, like "1.5 GiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
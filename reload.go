@@ -0,0 +1,178 @@
+package gocryptfs
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// reloadable is implemented by the root nodes of both frontends
+type reloadable interface {
+	Reload(args fusefrontend.Args) error
+}
+
+// reloader re-applies the options that can change while mounted. They are
+// read from "-reload-file" on top of the command line, on SIGHUP and on the
+// "Reload" ctlsock command.
+type reloader struct {
+	// mu serializes reloads
+	mu sync.Mutex
+	// args holds the command line, which is never modified
+	args          *argContainer
+	frontendArgs  fusefrontend.Args
+	nameTransform *nametransform.NameTransform
+	rootNode      reloadable
+}
+
+// reloadOptions are the options that "-reload-file" can contain
+type reloadOptions struct {
+	debug, quiet                                   bool
+	badname, exclude, excludeWildcard, excludeFrom multipleStrings
+	include, includeFrom, filter, filterFrom       multipleStrings
+	fdCache, readahead                             int
+}
+
+// parseReloadFile parses the contents of a "-reload-file". It has the same
+// syntax as the command line, with line breaks as separators and "#"
+// starting a comment line. List options are appended to the ones in "o",
+// all others replace them.
+func parseReloadFile(data []byte, o *reloadOptions) error {
+	var fields []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields = append(fields, strings.Fields(line)...)
+	}
+	flagSet := flag.NewFlagSet("reload-file", flag.ContinueOnError)
+	flagSet.SetOutput(ioutil.Discard)
+	flagSet.BoolVar(&o.debug, "d", o.debug, "")
+	flagSet.BoolVar(&o.debug, "debug", o.debug, "")
+	flagSet.BoolVar(&o.quiet, "q", o.quiet, "")
+	flagSet.BoolVar(&o.quiet, "quiet", o.quiet, "")
+	flagSet.Var(&o.badname, "badname", "")
+	flagSet.Var(&o.exclude, "e", "")
+	flagSet.Var(&o.exclude, "exclude", "")
+	flagSet.Var(&o.excludeWildcard, "ew", "")
+	flagSet.Var(&o.excludeWildcard, "exclude-wildcard", "")
+	flagSet.Var(&o.excludeFrom, "exclude-from", "")
+	flagSet.Var(&o.include, "include", "")
+	flagSet.Var(&o.includeFrom, "include-from", "")
+	flagSet.Var(&o.filter, "filter", "")
+	flagSet.Var(&o.filterFrom, "filter-from", "")
+	flagSet.IntVar(&o.fdCache, "fd-cache", o.fdCache, "")
+	flagSet.IntVar(&o.readahead, "readahead", o.readahead, "")
+	if err := flagSet.Parse(fields); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", flagSet.Arg(0))
+	}
+	if err := checkBadnamePatterns(o.badname); err != nil {
+		return err
+	}
+	if o.fdCache < 0 {
+		return fmt.Errorf("-fd-cache must not be negative")
+	}
+	if o.readahead < 0 || o.readahead > maxReadahead {
+		return fmt.Errorf("-readahead must be between 0 and %d", maxReadahead)
+	}
+	return nil
+}
+
+// reload reads "-reload-file" again and applies it. Without "-reload-file",
+// only the -exclude-from, -include-from and -filter-from files are read
+// again. Nothing is changed if there is an error.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a := r.args
+	o := reloadOptions{
+		debug:           a.debug,
+		quiet:           a.quiet,
+		badname:         append(multipleStrings{}, a.badname...),
+		exclude:         append(multipleStrings{}, a.exclude...),
+		excludeWildcard: append(multipleStrings{}, a.excludeWildcard...),
+		excludeFrom:     append(multipleStrings{}, a.excludeFrom...),
+		include:         append(multipleStrings{}, a.include...),
+		includeFrom:     append(multipleStrings{}, a.includeFrom...),
+		filter:          append(multipleStrings{}, a.filter...),
+		filterFrom:      append(multipleStrings{}, a.filterFrom...),
+		fdCache:         a.fdCache,
+		readahead:       a.readahead,
+	}
+	if a.reloadFile != "" {
+		data, err := ioutil.ReadFile(a.reloadFile)
+		if err != nil {
+			return err
+		}
+		if err := parseReloadFile(data, &o); err != nil {
+			return fmt.Errorf("%s: %v", a.reloadFile, err)
+		}
+	}
+	fa := r.frontendArgs
+	fa.Exclude = o.exclude
+	fa.ExcludeWildcard = o.excludeWildcard
+	fa.ExcludeFrom = o.excludeFrom
+	fa.Include = o.include
+	fa.IncludeFrom = o.includeFrom
+	fa.Filter = o.filter
+	fa.FilterFrom = o.filterFrom
+	fa.FDCache = o.fdCache
+	fa.Readahead = o.readahead
+	if err := r.rootNode.Reload(fa); err != nil {
+		return err
+	}
+	r.nameTransform.SetBadnamePatterns(o.badname)
+	tlog.Debug.Enabled = o.debug
+	tlog.Info.Enabled = !o.quiet
+	return nil
+}
+
+// handleSIGHUP calls reload() on SIGHUP until "srv" is unmounted
+func (r *reloader) handleSIGHUP(srv fuseServer) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	done := make(chan struct{})
+	go func() {
+		srv.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-ch:
+			if err := r.reload(); err != nil {
+				tlog.Warn.Printf("SIGHUP: reload failed: %v", err)
+				continue
+			}
+			tlog.Info.Printf("SIGHUP: reloaded %s", r.args.reloadFile)
+		case <-done:
+			return
+		}
+	}
+}
+
+// checkBadnamePatterns makes sure that all "-badname" patterns are valid
+func checkBadnamePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("-badname: invalid pattern %q supplied", pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package gocryptfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseReloadFile(t *testing.T) {
+	o := reloadOptions{
+		quiet:     true,
+		badname:   multipleStrings{"*.bak"},
+		readahead: 8,
+	}
+	err := parseReloadFile([]byte(`
+# comment
+-debug -quiet=false
+-badname *.tmp
+-exclude-wildcard *.o
+-readahead 0
+`), &o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := reloadOptions{
+		debug:           true,
+		badname:         multipleStrings{"*.bak", "*.tmp"},
+		excludeWildcard: multipleStrings{"*.o"},
+	}
+	if !reflect.DeepEqual(o, want) {
+		t.Errorf("want %+v, have %+v", want, o)
+	}
+	for _, s := range []string{
+		"-passfile foo",
+		"-badname [",
+		"-readahead 5000",
+		"-fd-cache -1",
+		"-debug foo",
+	} {
+		var o reloadOptions
+		if err := parseReloadFile([]byte(s), &o); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
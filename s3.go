@@ -0,0 +1,11 @@
+package gocryptfs
+
+import (
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/s3storage"
+)
+
+// Allow "s3://BUCKET/PREFIX" as CIPHERDIR
+func init() {
+	cryptfile.RegisterStorage("s3", s3storage.Open)
+}
@@ -0,0 +1,80 @@
+//go:build go1.16
+// +build go1.16
+
+package gocryptfs
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/p9srv"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// serve9p serves the decrypted view of CIPHERDIR over 9P2000.L on the
+// address "-serve-9p ADDR" until it gets SIGINT or SIGTERM.
+// ADDR is a TCP address, or "unix:PATH" for a unix socket.
+// This is called when you pass "-serve-9p".
+func serve9p(args *argContainer, password string) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-serve-9p is not supported in reverse mode")
+		return exitcodes.Usage
+	}
+	network, addr := "tcp", args.serve9p
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		tlog.Fatal.Printf("-serve-9p: %v", err)
+		return exitcodes.Other
+	}
+	defer l.Close()
+	if network == "unix" {
+		// Only the owner may connect
+		if err := os.Chmod(addr, 0600); err != nil {
+			tlog.Fatal.Printf("-serve-9p: %v", err)
+			return exitcodes.Other
+		}
+	} else if tcpAddr, ok := l.Addr().(*net.TCPAddr); ok && !tcpAddr.IP.IsLoopback() {
+		// 9P has neither authentication nor encryption. Anybody who can
+		// reach the port could read and write the files.
+		tlog.Fatal.Printf("-serve-9p: refusing to listen on non-loopback address %v", tcpAddr)
+		return exitcodes.Usage
+	}
+	keys := openKeys(args, password)
+	defer keys.Wipe()
+	srv := p9srv.New(keys, args.cipherdir, args.ro)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-ch
+		tlog.Info.Printf("-serve-9p: got %v, shutting down", sig)
+		close(stopped)
+		// Also removes the unix socket
+		l.Close()
+	}()
+	tlog.Info.Printf("Serving %s over 9P on %s", args.cipherdir, l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-stopped:
+				return 0
+			default:
+			}
+			tlog.Fatal.Printf("-serve-9p: %v", err)
+			return exitcodes.Other
+		}
+		go func() {
+			if err := srv.ServeConn(conn); err != nil {
+				tlog.Warn.Printf("-serve-9p: %v", err)
+			}
+		}()
+	}
+}
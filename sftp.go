@@ -0,0 +1,33 @@
+//go:build go1.16
+// +build go1.16
+
+package gocryptfs
+
+import (
+	"os"
+
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/sftpsrv"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// sftpServer speaks SFTP on stdin and stdout until the client disconnects.
+// It is meant to be started by sshd as a subsystem.
+// This is called when you pass "-sftp-server".
+func sftpServer(args *argContainer, password string) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-sftp-server is not supported in reverse mode")
+		return exitcodes.Usage
+	}
+	if args.masterkey == "stdin" {
+		tlog.Fatal.Printf("-sftp-server uses stdin for the SFTP protocol and cannot be combined with -masterkey=stdin")
+		return exitcodes.Usage
+	}
+	keys := openKeys(args, password)
+	defer keys.Wipe()
+	if err := sftpsrv.New(keys, args.cipherdir, args.ro).Serve(os.Stdin, os.Stdout); err != nil {
+		tlog.Fatal.Printf("-sftp-server: %v", err)
+		return exitcodes.Other
+	}
+	return 0
+}
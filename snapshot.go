@@ -0,0 +1,116 @@
+package gocryptfs
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/ctlsock"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/snapshot"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// snapshotRenewInterval is how often the freeze is renewed while the snapshot
+// is copied. The mount thaws by itself after a minute without renewal.
+const snapshotRenewInterval = 20 * time.Second
+
+// snapshotCreate creates a new snapshot of args.cipherdir. If "-ctlsock" is
+// given, the mount behind it is frozen while the snapshot is copied. A
+// mounted CIPHERDIR without "-ctlsock" is refused, as the copy would not be
+// consistent.
+// This is called when you pass "-snapshot create".
+func snapshotCreate(args *argContainer) {
+	var c *ctlsock.CtlSock
+	req := ctlsock.RequestStruct{Freeze: true}
+	if args.ctlsock != "" {
+		if args.ctlsockTokenFile != "" {
+			req.Token = readCtlsockToken(args.ctlsockTokenFile)
+		}
+		var err error
+		c, err = ctlsock.New(args.ctlsock)
+		if err == nil {
+			_, err = c.Query(&req)
+		}
+		if err != nil {
+			tlog.Fatal.Printf("Cannot freeze the filesystem via %q: %v", args.ctlsock, err)
+			os.Exit(exitcodes.Snapshot)
+		}
+		defer c.Close()
+		tlog.Info.Printf("Filesystem frozen, writes are blocked until the snapshot is complete")
+	} else if snapshot.IsMounted(args.cipherdir) {
+		tlog.Fatal.Printf("%q is mounted. Pass the -ctlsock of the mount so that it can be "+
+			"frozen while the snapshot is taken.", args.cipherdir)
+		os.Exit(exitcodes.Snapshot)
+	}
+	stop := make(chan struct{})
+	renewed := make(chan error, 1)
+	if c != nil {
+		go func() {
+			t := time.NewTicker(snapshotRenewInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-stop:
+					renewed <- nil
+					return
+				case <-t.C:
+					if _, err := c.Query(&req); err != nil {
+						renewed <- err
+						return
+					}
+				}
+			}
+		}()
+	}
+	path, err := snapshot.Create(args.cipherdir, args.snapshotName)
+	if c != nil {
+		close(stop)
+		if renewErr := <-renewed; renewErr != nil && err == nil {
+			err = fmt.Errorf("renewing the freeze failed: %v", renewErr)
+		}
+		req.Freeze = false
+		req.Thaw = true
+		// Thaw fails if the freeze has timed out, which means that the
+		// snapshot may be inconsistent
+		if _, thawErr := c.Query(&req); thawErr != nil && err == nil {
+			err = fmt.Errorf("thawing the filesystem failed: %v", thawErr)
+		}
+		if err != nil && path != "" {
+			os.RemoveAll(path)
+		}
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Creating snapshot failed: %v", err)
+		os.Exit(exitcodes.Snapshot)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Snapshot created at %q"+tlog.ColorReset, path)
+}
+
+// snapshotList prints the snapshots of args.cipherdir, oldest first.
+// This is called when you pass "-snapshot list".
+func snapshotList(args *argContainer) {
+	list, err := snapshot.List(args.cipherdir)
+	if err != nil {
+		tlog.Fatal.Printf("Listing snapshots failed: %v", err)
+		os.Exit(exitcodes.Snapshot)
+	}
+	for _, s := range list {
+		fmt.Printf("%s\t%s\n", s.Name, s.Created.Format("2006-01-02 15:04:05"))
+	}
+}
+
+// snapshotMountDir replaces args.cipherdir with the path of the snapshot named
+// in "-snapshot-name" and forces a read-only mount.
+// This is called when you pass "-snapshot mount".
+func snapshotMountDir(args *argContainer) {
+	path, err := snapshot.Path(args.cipherdir, args.snapshotName)
+	if err != nil {
+		tlog.Fatal.Printf("Invalid snapshot: %v", err)
+		os.Exit(exitcodes.Snapshot)
+	}
+	tlog.Info.Printf("Mounting snapshot %q read-only", path)
+	args.cipherdir = path
+	args.ro = true
+	args.rw = false
+}
@@ -0,0 +1,204 @@
+package gocryptfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// fuseServer is what the helpers that run next to a mount (-idle,
+// -on-suspend, -reload-file, the systemd watchdog) need from the FUSE server.
+// *fuse.Server implements it, and so does the supervisor of "-supervise",
+// which keeps working across reconnects.
+type fuseServer interface {
+	Unmount() error
+	Wait()
+}
+
+// superviseRetries is how often the supervisor tries to mount again before
+// it gives up. The delay doubles after each attempt, starting at one second.
+const superviseRetries = 5
+
+// openFileReleaser is implemented by the root nodes of both frontends
+type openFileReleaser interface {
+	ReleaseOpenFiles()
+}
+
+// supervisor implements "-supervise". When a request handler panics or the
+// FUSE connection is aborted, it mounts the same root node again, with the
+// keys that are still in memory, instead of leaving a dead mountpoint
+// behind.
+type supervisor struct {
+	args     *argContainer
+	rootNode fs.InodeEmbedder
+	// done is closed when the supervisor stops
+	done chan struct{}
+	// mu protects the fields below
+	mu  sync.Mutex
+	srv *fuse.Server
+	// dev is the device number of the current mount, for aborting the
+	// connection
+	dev uint64
+	// unmounting is set by Unmount(), so that the end of the connection is
+	// not taken for a failure
+	unmounting bool
+	// panicked is set when a request handler panicked
+	panicked bool
+}
+
+func newSupervisor(args *argContainer, rootNode fs.InodeEmbedder) *supervisor {
+	return &supervisor{
+		args:     args,
+		rootNode: rootNode,
+		done:     make(chan struct{}),
+	}
+}
+
+// start watches "srv" and the servers that replace it
+func (s *supervisor) start(srv *fuse.Server) {
+	s.srv = srv
+	s.dev = mountDev(s.args.mountpoint)
+	go s.run()
+}
+
+// Unmount implements fuseServer
+func (s *supervisor) Unmount() error {
+	s.mu.Lock()
+	s.unmounting = true
+	srv := s.srv
+	s.mu.Unlock()
+	err := srv.Unmount()
+	if err != nil {
+		s.mu.Lock()
+		s.unmounting = false
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Wait implements fuseServer. Returns when the filesystem has been unmounted
+// for good.
+func (s *supervisor) Wait() {
+	<-s.done
+}
+
+// onPanic is called by panicgate. The state of the go-fuse bridge is unknown
+// after a panic, so the connection is aborted and run() mounts again.
+func (s *supervisor) onPanic() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.panicked || s.unmounting {
+		return
+	}
+	s.panicked = true
+	// We are called from a request handler, which has to return first
+	go abortConnection(s.dev, s.args.mountpoint)
+}
+
+func (s *supervisor) run() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		srv := s.srv
+		s.mu.Unlock()
+		srv.Wait()
+		s.mu.Lock()
+		unmounting, panicked := s.unmounting, s.panicked
+		s.panicked = false
+		s.mu.Unlock()
+		if unmounting {
+			return
+		}
+		if !panicked && !connectionLost(s.args.mountpoint) {
+			// Unmounted from the outside, for example with "fusermount -u"
+			return
+		}
+		tlog.Warn.Printf("-supervise: FUSE connection of %s lost, mounting again", s.args.mountpoint)
+		if !s.remount() {
+			return
+		}
+	}
+}
+
+// remount detaches the dead mount and mounts the root node again
+func (s *supervisor) remount() bool {
+	mountpoint := s.args.mountpoint
+	if err := detachStale(mountpoint); err != nil {
+		tlog.Warn.Printf("-supervise: %v", err)
+	}
+	// The old connection will not release its files
+	if r, ok := s.rootNode.(openFileReleaser); ok {
+		r.ReleaseOpenFiles()
+	}
+	delay := time.Second
+	for i := 0; i < superviseRetries; i++ {
+		srv, err := newFuseServer(s.rootNode, s.args)
+		if err == nil {
+			s.mu.Lock()
+			s.srv = srv
+			s.dev = mountDev(mountpoint)
+			s.mu.Unlock()
+			tlog.Info.Printf("-supervise: %s is mounted again", mountpoint)
+			return true
+		}
+		tlog.Warn.Printf("-supervise: mount failed: %v", err)
+		if i < superviseRetries-1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	tlog.Fatal.Printf("-supervise: giving up on %s", mountpoint)
+	return false
+}
+
+// connectionLost tells if "mountpoint" is a FUSE mount whose server is gone
+// ("Transport endpoint is not connected")
+func connectionLost(mountpoint string) bool {
+	var st syscall.Stat_t
+	err := syscall.Stat(mountpoint, &st)
+	return err == syscall.ENOTCONN || err == syscall.ECONNABORTED
+}
+
+// mountDev returns the device number of the filesystem mounted on
+// "mountpoint", or zero on error
+func mountDev(mountpoint string) uint64 {
+	var st syscall.Stat_t
+	if err := syscall.Stat(mountpoint, &st); err != nil {
+		tlog.Warn.Printf("-supervise: stat %q: %v", mountpoint, err)
+		return 0
+	}
+	return uint64(st.Dev)
+}
+
+// abortConnection aborts the FUSE connection of the device "dev" via the
+// fusectl filesystem. All pending requests fail and the server stops.
+// Falls back to a lazy unmount if fusectl is not available.
+func abortConnection(dev uint64, mountpoint string) {
+	abort := fmt.Sprintf("/sys/fs/fuse/connections/%d/abort", unix.Minor(dev))
+	err := ioutil.WriteFile(abort, []byte("1"), 0)
+	if err == nil {
+		return
+	}
+	tlog.Warn.Printf("-supervise: cannot abort the connection: %v", err)
+	if err := detachStale(mountpoint); err != nil {
+		tlog.Warn.Printf("-supervise: %v", err)
+	}
+}
+
+// detachStale unmounts "mountpoint" without talking to the FUSE server
+func detachStale(mountpoint string) error {
+	if runtime.GOOS == "linux" {
+		return fusermountLazy(mountpoint)
+	}
+	return syscall.Unmount(mountpoint, 0)
+}
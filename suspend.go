@@ -0,0 +1,67 @@
+package gocryptfs
+
+import (
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/logind"
+	"github.com/HorizonLiu/gocryptfs/internal/readpassword"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// watchSuspend implements "-on-suspend". Before the machine sleeps or the
+// session is locked, it wipes the keys ("lock") or unmounts ("unmount").
+// With "lock" and -extpass, the password is asked for again on resume.
+// Otherwise, the filesystem stays locked until it is unlocked via -ctlsock.
+func watchSuspend(args *argContainer, topFs fs.InodeEmbedder, srv fuseServer) {
+	// The handler can run before Watch() has returned
+	watcher := make(chan *logind.Watcher, 1)
+	handler := func(e logind.Event) {
+		tlog.Debug.Printf("-on-suspend: %v", e)
+		switch e {
+		case logind.Sleep, logind.Lock:
+			if args.onSuspend == "lock" {
+				// "-on-suspend lock" is only allowed in forward mode
+				topFs.(*fusefrontend.RootNode).Lock()
+				return
+			}
+			tlog.Info.Printf("-on-suspend: unmounting %s", args.mountpoint)
+			if err := srv.Unmount(); err != nil {
+				tlog.Warn.Printf("-on-suspend: unmount failed: %v", err)
+				return
+			}
+			// We are called on the goroutine that reads the bus, so
+			// closing must not wait for it
+			go func() {
+				(<-watcher).Close()
+			}()
+		case logind.Resume, logind.Unlock:
+			if args.onSuspend == "lock" && !args.extpass.Empty() {
+				// Do not block the bus while the user types
+				go unlockExtpass(args, topFs.(*fusefrontend.RootNode))
+			}
+		}
+	}
+	w, err := logind.Watch("Wipe the gocryptfs keys from memory", handler)
+	if err != nil {
+		tlog.Warn.Printf("-on-suspend: cannot connect to logind: %v", err)
+		return
+	}
+	watcher <- w
+}
+
+// unlockExtpass unlocks "rn" with a password from -extpass
+func unlockExtpass(args *argContainer, rn *fusefrontend.RootNode) {
+	if !rn.IsLocked() {
+		return
+	}
+	pw, err := readpassword.Extpass(args.extpass)
+	if err != nil {
+		tlog.Warn.Printf("-on-suspend: %v. Unlock via -ctlsock.", err)
+		return
+	}
+	rn.Unlock(string(pw))
+	for i := range pw {
+		pw[i] = 0
+	}
+}
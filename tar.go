@@ -0,0 +1,80 @@
+package gocryptfs
+
+import (
+	"os"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/HorizonLiu/gocryptfs/internal/tarstream"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// exportTar writes CIPHERDIR, or in reverse mode the encrypted view of it, as
+// a tar stream to stdout. Nothing is mounted, and forward mode does not need
+// the password.
+// This is called when you pass "-export-tar".
+func exportTar(args *argContainer, password string) int {
+	if terminal.IsTerminal(int(os.Stdout.Fd())) {
+		tlog.Fatal.Printf("Refusing to write a tar stream to a terminal, please redirect stdout")
+		return exitcodes.Usage
+	}
+	w := tarstream.NewWriter(os.Stdout)
+	var err error
+	if args.reverse {
+		rootNode, wipeKeys := initFuseFrontend(args, password)
+		defer wipeKeys()
+		rn := rootNode.(*fusefrontend_reverse.RootNode)
+		err = rn.Export(func(e *fusefrontend_reverse.ExportEntry) error {
+			// Both structs have the same fields
+			te := tarstream.Entry(*e)
+			return w.Add(&te)
+		})
+	} else {
+		if args._configCustom {
+			tlog.Warn.Printf("The config file %q is outside of CIPHERDIR and will not be exported", args.config)
+		}
+		tlog.Info.Printf("Exporting %q. Files that are modified during the export may be "+
+			"captured in an intermediate state.", args.cipherdir)
+		err = w.AddDir(args.cipherdir)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Exporting tar stream failed: %v", err)
+		return exitcodes.Tar
+	}
+	tlog.Info.Printf("Exported %d entries", w.Count)
+	return 0
+}
+
+// importTar extracts a tar stream from stdin into the empty directory
+// CIPHERDIR. The result is a forward-mode CIPHERDIR, also if the stream was
+// created with "-export-tar -reverse". The password is not needed.
+// This is called when you pass "-import-tar".
+func importTar(args *argContainer) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-import-tar creates a forward-mode CIPHERDIR and cannot be used with -reverse")
+		return exitcodes.Usage
+	}
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		tlog.Fatal.Printf("Refusing to read a tar stream from a terminal, please redirect stdin")
+		return exitcodes.Usage
+	}
+	if err := isEmptyDir(args.cipherdir); err != nil {
+		tlog.Fatal.Printf("Invalid cipherdir: %v", err)
+		return exitcodes.CipherDir
+	}
+	n, err := tarstream.Extract(os.Stdin, args.cipherdir)
+	if err != nil {
+		tlog.Fatal.Printf("Importing tar stream failed after %d entries: %v", n, err)
+		return exitcodes.Tar
+	}
+	if _, err := os.Stat(args.config); err != nil {
+		tlog.Warn.Printf("No config file found at %q. You will need -config or -masterkey to mount.", args.config)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Imported %d entries into %q"+tlog.ColorReset, n, args.cipherdir)
+	return 0
+}
@@ -0,0 +1,206 @@
+package gocryptfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/HorizonLiu/gocryptfs/cryptfile"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/contentenc"
+	"github.com/HorizonLiu/gocryptfs/internal/cryptocore"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/fusefrontend"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/readpassword"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// addTenant - create the top-level directory "args.addTenant", encrypted
+// with a fresh master key that is protected by a password of its own.
+// Does not return (calls os.Exit both on success and on error).
+func addTenant(args *argContainer, password string) {
+	name := args.addTenant
+	masterkey, confFile, err := loadConfig(args, password)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	if confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		tlog.Fatal.Printf("-add-tenant is not supported on plaintextnames filesystems.")
+		os.Exit(exitcodes.Usage)
+	}
+	if confFile.Tenant(name) != nil {
+		tlog.Fatal.Printf("-add-tenant: tenant %q already exists", name)
+		os.Exit(exitcodes.Usage)
+	}
+	// The backing directory is named like any other top-level directory, so
+	// the tenant is visible to whoever knows the root password.
+	// cryptfile.Keys refuses filesystems that already have tenants, so the
+	// name is encrypted here.
+	iv, err := cryptfile.ReadDirIV(args.cipherdir)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot read the root directory IV: %v", err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	backend := cryptocore.BackendGoGCM
+	if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		backend = cryptocore.BackendAESSIV
+	}
+	cCore := cryptocore.New(masterkey, backend, contentenc.DefaultIVBits,
+		confFile.IsFeatureFlagSet(configfile.FlagHKDF), false)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	nameTransform := nametransform.New(cCore.EMECipher, true,
+		confFile.IsFeatureFlagSet(configfile.FlagRaw64))
+	nameTransform.SetNameMax(confFile.PlainNameMax())
+	cName, err := nameTransform.EncryptAndHashName(name, iv)
+	cCore.Wipe()
+	if err != nil {
+		tlog.Fatal.Printf("Invalid tenant name %q: %v", name, err)
+		os.Exit(exitcodes.Usage)
+	}
+	if nametransform.IsLongContent(cName) {
+		tlog.Fatal.Printf("Tenant name %q is too long", name)
+		os.Exit(exitcodes.Usage)
+	}
+	tlog.Info.Printf("Please enter the password for tenant %q.", name)
+	pw := readpassword.Twice([]string(args.extpass), []string(args.passfile))
+	logN := confFile.ScryptObject.LogN()
+	if args._explicitScryptn {
+		logN = args.scryptn
+	}
+	key := cryptocore.RandBytes(cryptocore.KeyLen)
+	err = confFile.AddTenant(name, cName, key, pw, logN)
+	for i := range pw {
+		pw[i] = 0
+	}
+	for i := range key {
+		key[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-add-tenant: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	dir := filepath.Join(args.cipherdir, cName)
+	if err = os.Mkdir(dir, 0700); err != nil {
+		if os.IsExist(err) {
+			tlog.Fatal.Printf("-add-tenant: the directory %q already exists", name)
+		} else {
+			tlog.Fatal.Printf("-add-tenant: %v", err)
+		}
+		os.Exit(exitcodes.CipherDir)
+	}
+	if err = writeRootDirIV(dir); err != nil {
+		os.RemoveAll(dir)
+		tlog.Fatal.Printf("-add-tenant: %v", err)
+		os.Exit(exitcodes.Init)
+	}
+	if err = confFile.WriteFile(); err != nil {
+		os.RemoveAll(dir)
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Tenant %q added."+tlog.ColorReset, name)
+}
+
+// removeTenant - delete the key slot of tenant "args.removeTenant". Needs
+// the root password.
+// Does not return (calls os.Exit both on success and on error).
+func removeTenant(args *argContainer, password string) {
+	name := args.removeTenant
+	masterkey, confFile, err := loadConfig(args, password)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	t := confFile.Tenant(name)
+	if t == nil {
+		tlog.Fatal.Printf("-remove-tenant: tenant %q does not exist", name)
+		os.Exit(exitcodes.Usage)
+	}
+	dir := filepath.Join(args.cipherdir, t.Dir)
+	confFile.RemoveTenant(name)
+	if err = confFile.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Tenant %q removed."+tlog.ColorReset, name)
+	tlog.Info.Printf(tlog.ColorGrey+
+		"Its files cannot be decrypted any more. Delete %q to free the space."+
+		tlog.ColorReset, dir)
+}
+
+// loadTenantKeys loads the config file and decrypts the master keys of the
+// tenants passed with "-tenant". Asks for one password per tenant.
+// Calls os.Exit on errors.
+func loadTenantKeys(args *argContainer, password string) (*configfile.ConfFile, map[string][]byte) {
+	confFile, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	keys := map[string][]byte{}
+	for _, name := range args.tenant {
+		if confFile.Tenant(name) == nil {
+			tlog.Fatal.Printf("-tenant: tenant %q does not exist", name)
+			os.Exit(exitcodes.Usage)
+		}
+		pw := []byte(password)
+		if args._passwordProvider != nil {
+			pw, err = args._passwordProvider.GetPassword(context.Background(), 1)
+			if err != nil {
+				tlog.Fatal.Printf("Cannot get password: %v", err)
+				os.Exit(exitcodes.ReadPassword)
+			}
+		} else if password == "" {
+			pw = readpassword.Once([]string(args.extpass), []string(args.passfile),
+				fmt.Sprintf("Password for tenant %q", name))
+		}
+		tlog.Info.Printf("Decrypting the master key of tenant %q", name)
+		keys[name], err = confFile.DecryptTenantKey(name, pw)
+		for i := range pw {
+			pw[i] = 0
+		}
+		if err != nil {
+			tlog.Fatal.Println(err)
+			exitcodes.Exit(err)
+		}
+	}
+	return confFile, keys
+}
+
+// addTenants registers the tenants of "confFile" with "rn". Those whose key
+// is in "tenantKeys" are unlocked, the others are listed, but cannot be
+// accessed. The keys are wiped from "tenantKeys". Returns a function that
+// wipes the keys from the crypto backends.
+func addTenants(rn *fusefrontend.RootNode, args *argContainer, confFile *configfile.ConfFile,
+	tenantKeys map[string][]byte, backend cryptocore.AEADTypeEnum, longNames bool) (wipe func()) {
+	var cores []*cryptocore.CryptoCore
+	for _, t := range confFile.Tenants {
+		key := tenantKeys[t.Name]
+		if key == nil {
+			rn.AddTenant(t.Name, t.Dir, nil, nil)
+			continue
+		}
+		cCore := cryptocore.New(key, backend, contentenc.DefaultIVBits, args.hkdf, args.forcedecode)
+		cEnc := contentenc.New(cCore, contentenc.DefaultBS, args.forcedecode)
+		cEnc.SetWorkers(args.cryptoWorkers)
+		nameTransform := nametransform.New(cCore.EMECipher, longNames, args.raw64)
+		nameTransform.SetNameMax(confFile.PlainNameMax())
+		nameTransform.SetBadnamePatterns(args.badname)
+		rn.AddTenant(t.Name, t.Dir, cEnc, nameTransform)
+		cores = append(cores, cCore)
+		for i := range key {
+			key[i] = 0
+		}
+	}
+	return func() {
+		for _, c := range cores {
+			c.Wipe()
+		}
+	}
+}
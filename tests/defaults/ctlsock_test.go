@@ -96,3 +96,103 @@ func TestCtlSockDecryptCrash(t *testing.T) {
 	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
 	defer test_helpers.UnmountPanic(pDir)
 }
+
+// TestCtlSockIntrospection tests the Stats, Latency, OpenFiles, FlushCaches
+// and MountOptions requests.
+func TestCtlSockIntrospection(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	f, err := os.Create(pDir + "/open_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	req := ctlsock.RequestStruct{
+		Stats:        true,
+		Latency:      true,
+		OpenFiles:    true,
+		FlushCaches:  true,
+		MountOptions: true,
+	}
+	response := test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo != 0 {
+		t.Fatalf("got an error reply: %+v", response)
+	}
+	if response.Stats["CREATE"].Count == 0 {
+		t.Errorf("CREATE was not counted: %v", response.Stats)
+	}
+	if h := response.Latency["CREATE"]; h.Count == 0 || len(h.Buckets) == 0 {
+		t.Errorf("CREATE latency is missing: %+v", h)
+	}
+	if len(response.OpenFiles) != 1 || response.OpenFiles[0] != "open_file" {
+		t.Errorf("wrong open files: %v", response.OpenFiles)
+	}
+	found := false
+	for _, o := range response.MountOptions {
+		if o == "extpass=***" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("extpass missing or not hidden: %v", response.MountOptions)
+	}
+	// Cannot be combined with other commands
+	req.EncryptPath = "foo"
+	response = test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo == 0 {
+		t.Errorf("combined request should have failed: %+v", response)
+	}
+}
+
+// TestCtlSockTree tests the EncryptPaths, DecryptPaths and EncryptTree
+// requests.
+func TestCtlSockTree(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+
+	paths := []string{"a", "a/b", "a/b/" + test_helpers.X255, "c"}
+	if err := os.MkdirAll(pDir+"/a/b/"+test_helpers.X255, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(pDir+"/c", 0700); err != nil {
+		t.Fatal(err)
+	}
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPaths: paths})
+	if len(resp.Results) != len(paths) {
+		t.Fatalf("%+v", resp)
+	}
+	var cPaths []string
+	for _, r := range resp.Results {
+		if r.ErrNo != 0 {
+			t.Fatalf("%+v", r)
+		}
+		cPaths = append(cPaths, r.Result)
+	}
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{DecryptPaths: cPaths})
+	for i, r := range resp.Results {
+		if r.Result != paths[i] {
+			t.Errorf("want %q, have %+v", paths[i], r)
+		}
+	}
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptTree: "/"})
+	if len(resp.Tree) != len(paths) {
+		t.Fatalf("want %d entries, have %+v", len(paths), resp)
+	}
+	for _, p := range resp.Tree {
+		found := false
+		for i := range paths {
+			if p.Plain == paths[i] && p.Cipher == cPaths[i] {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("unexpected tree entry %+v", p)
+		}
+	}
+}
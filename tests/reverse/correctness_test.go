@@ -295,3 +295,52 @@ func TestSeekData(t *testing.T) {
 	}
 	f.Close()
 }
+
+// TestHardlinks checks that all names of a hard-linked plaintext file have the
+// same inode number and ciphertext in the reverse view.
+func TestHardlinks(t *testing.T) {
+	mnt, err := ioutil.TempDir(test_helpers.TmpDir, "reverse_mnt_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := mnt + ".sock"
+	test_helpers.MountOrFatal(t, dirA, mnt, "-reverse", "-extpass", "echo test", "-ctlsock="+sock)
+	defer test_helpers.UnmountPanic(mnt)
+
+	name1 := "TestHardlinks1"
+	name2 := "TestHardlinks2"
+	if err := ioutil.WriteFile(dirA+"/"+name1, []byte("hello hardlinks"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(dirA+"/"+name1, dirA+"/"+name2); err != nil {
+		t.Fatal(err)
+	}
+	var content [][]byte
+	var ino []uint64
+	for _, name := range []string{name1, name2} {
+		resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: name})
+		if resp.ErrNo != 0 {
+			t.Fatalf("Encrypt %q: ErrNo=%d ErrText=%s", name, resp.ErrNo, resp.ErrText)
+		}
+		cPath := mnt + "/" + resp.Result
+		var st syscall.Stat_t
+		if err := syscall.Stat(cPath, &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Nlink != 2 {
+			t.Errorf("%q: want Nlink=2, have %d", name, st.Nlink)
+		}
+		ino = append(ino, uint64(st.Ino))
+		c, err := ioutil.ReadFile(cPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = append(content, c)
+	}
+	if ino[0] != ino[1] {
+		t.Errorf("inode numbers differ: %d != %d", ino[0], ino[1])
+	}
+	if !bytes.Equal(content[0], content[1]) {
+		t.Error("ciphertext differs")
+	}
+}
@@ -0,0 +1,59 @@
+package gocryptfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/readpassword"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+	"github.com/HorizonLiu/gocryptfs/internal/union"
+)
+
+// initUnion initializes the additional CIPHERDIRs passed via "-union" and
+// merges them with "top" (the filesystem of the main CIPHERDIR) into one
+// union filesystem. "top" has the highest precedence and is the only
+// branch that is written to, followed by the "-union" CIPHERDIRs in the
+// order they were passed.
+//
+// Every CIPHERDIR is unlocked using its own gocryptfs.conf. The n-th
+// "-union-passfile" supplies the password of the n-th "-union" CIPHERDIR,
+// the others use the password of the main CIPHERDIR (or the same
+// "-masterkey").
+// Calls os.Exit on errors.
+func initUnion(args *argContainer, top fs.InodeEmbedder, password string) (rootNode fs.InodeEmbedder, wipeKeys func()) {
+	branches := []fs.InodeEmbedder{top}
+	var wipers []func()
+	for i, dir := range args.union {
+		dir, _ = filepath.Abs(dir)
+		if err := isDir(dir); err != nil {
+			tlog.Fatal.Printf("-union: invalid cipherdir: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+		branchArgs := *args
+		branchArgs.cipherdir = dir
+		branchArgs.config = filepath.Join(dir, configfile.ConfDefaultName)
+		branchArgs._configCustom = false
+		// The control socket only serves the main CIPHERDIR
+		branchArgs._ctlsockFd = nil
+		branchArgs._ctlhttpListener = nil
+		branchPassword := password
+		if i < len(args.unionPassfile) {
+			branchPassword = string(readpassword.Once(nil, []string{args.unionPassfile[i]}, ""))
+			branchArgs._passwordProvider = nil
+		}
+		tlog.Info.Printf("Adding union branch %q", dir)
+		b, w := initFuseFrontend(&branchArgs, branchPassword)
+		branches = append(branches, b)
+		wipers = append(wipers, w)
+	}
+	wipeKeys = func() {
+		for _, w := range wipers {
+			w()
+		}
+	}
+	return union.NewRootNode(branches), wipeKeys
+}
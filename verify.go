@@ -0,0 +1,147 @@
+package gocryptfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	fscklib "github.com/HorizonLiu/gocryptfs/fsck"
+	"github.com/HorizonLiu/gocryptfs/internal/configfile"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/lease"
+	"github.com/HorizonLiu/gocryptfs/internal/nametransform"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// plaintextSize returns the plaintext size of all regular files in
+// "cipherdir". "plainSize" converts the ciphertext size of a file.
+func plaintextSize(cipherdir string, plainSize func(int64) int64, plaintextNames bool) (total int64) {
+	filepath.Walk(cipherdir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		name := fi.Name()
+		if name == configfile.ConfDefaultName ||
+			(!plaintextNames && (name == nametransform.DirIVFilename ||
+				lease.IsLeaseFile(name) ||
+				nametransform.NameType(name) == nametransform.LongNameFilename ||
+				nametransform.IsLongTarget(name))) {
+			return nil
+		}
+		total += plainSize(fi.Size())
+		return nil
+	})
+	return total
+}
+
+// verify handles "gocryptfs -verify". Unlike "-fsck", it does not mount the
+// filesystem but decrypts and authenticates every block of every file
+// directly.
+func verify(args *argContainer, password string) (exitcode int) {
+	if args.reverse {
+		tlog.Fatal.Printf("Running -verify with -reverse is not supported")
+		os.Exit(exitcodes.Usage)
+	}
+	// The human-readable output goes to stderr if stdout gets the JSON report
+	out := os.Stdout
+	if args.verifyJSON == "-" {
+		out = os.Stderr
+		tlog.Info.Enabled = false
+	}
+	keys := openKeys(args, password)
+	defer keys.Wipe()
+	workers := args.verifyWorkers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	opts := fscklib.Options{Workers: workers}
+	var progress *progressLine
+	if !args.quiet {
+		progress = newProgressLine("verify", plaintextSize(args.cipherdir, keys.PlainSize, keys.PlaintextNames()))
+		opts.Progress = progress.update
+	}
+	// Handle SIGINT & SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(ch)
+	go func() {
+		select {
+		case <-ch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	start := time.Now()
+	report, err := fscklib.Check(ctx, args.cipherdir, keys, opts)
+	if progress != nil {
+		progress.stop()
+	}
+	if report == nil {
+		tlog.Fatal.Printf("verify: %v", err)
+		return exitcodes.CipherDir
+	}
+	for _, e := range report.Errors {
+		fmt.Fprintf(out, "verify: corrupt: %v", e)
+		if len(e.CorruptBlocks) > 0 {
+			fmt.Fprintf(out, ", blocks")
+			for _, r := range e.CorruptBlocks {
+				if r.First == r.Last {
+					fmt.Fprintf(out, " %d", r.First)
+				} else {
+					fmt.Fprintf(out, " %d-%d", r.First, r.Last)
+				}
+			}
+		}
+		fmt.Fprintf(out, "\n")
+	}
+	for _, o := range report.OrphanedLongNames {
+		fmt.Fprintf(out, "verify: orphaned long name file %q\n", o)
+	}
+	for _, s := range report.Skipped {
+		fmt.Fprintf(out, "verify: skipped %q: permission denied\n", s)
+	}
+	if args.verifyJSON != "" {
+		if err := writeVerifyJSON(args.verifyJSON, report); err != nil {
+			tlog.Fatal.Printf("verify: writing JSON report: %v", err)
+			return exitcodes.Other
+		}
+	}
+	if err != nil {
+		tlog.Info.Printf("verify: aborted")
+		return exitcodes.Other
+	}
+	if report.OK() {
+		tlog.Info.Printf("verify summary: no problems found in %d files, %d dirs, %d symlinks (%v)",
+			report.Files, report.Dirs, report.Symlinks, time.Since(start).Round(time.Second))
+		return 0
+	}
+	if len(report.Skipped) > 0 {
+		tlog.Warn.Printf("verify: re-run this program as root to check all files!")
+	}
+	fmt.Fprintf(out, "verify summary: %d corrupt entries, %d orphaned long names, %d entries skipped\n",
+		len(report.Errors), len(report.OrphanedLongNames), len(report.Skipped))
+	return exitcodes.FsckErrors
+}
+
+// writeVerifyJSON writes "report" to "path", or to stdout if "path" is "-"
+func writeVerifyJSON(path string, report *fscklib.Report) error {
+	js, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(js)
+		return err
+	}
+	return ioutil.WriteFile(path, js, 0600)
+}
@@ -0,0 +1,105 @@
+//go:build go1.16
+// +build go1.16
+
+package gocryptfs
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/HorizonLiu/gocryptfs/internal/davsrv"
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// serveWebdav serves the decrypted view of CIPHERDIR over WebDAV on the
+// address "-serve-webdav ADDR" until it gets SIGINT or SIGTERM.
+// This is called when you pass "-serve-webdav".
+func serveWebdav(args *argContainer, password string) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-serve-webdav is not supported in reverse mode")
+		return exitcodes.Usage
+	}
+	var user, pass string
+	if args.webdavAuth != "" {
+		var err error
+		user, pass, err = readWebdavAuth(args.webdavAuth)
+		if err != nil {
+			tlog.Fatal.Printf("-webdav-auth: %v", err)
+			return exitcodes.Usage
+		}
+	}
+	l, err := net.Listen("tcp", args.serveWebdav)
+	if err != nil {
+		tlog.Fatal.Printf("-serve-webdav: %v", err)
+		return exitcodes.Other
+	}
+	defer l.Close()
+	if addr, ok := l.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+		// Anybody who can reach the port could read the files, or sniff
+		// the password
+		if user == "" || args.webdavCert == "" {
+			tlog.Fatal.Printf("-serve-webdav: refusing to listen on non-loopback address %v without -webdav-auth and -webdav-cert", addr)
+			return exitcodes.Usage
+		}
+	}
+	if args.webdavCert != "" {
+		cert, err := tls.LoadX509KeyPair(args.webdavCert, args.webdavKey)
+		if err != nil {
+			tlog.Fatal.Printf("-serve-webdav: %v", err)
+			return exitcodes.Other
+		}
+		l = tls.NewListener(l, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+	}
+	keys := openKeys(args, password)
+	defer keys.Wipe()
+	h := davsrv.New(keys, args.cipherdir, args.ro)
+	if user != "" {
+		h.SetBasicAuth(user, pass)
+	}
+	srv := &http.Server{
+		Handler: h,
+		// No ReadTimeout and WriteTimeout, uploads and downloads of large
+		// files take as long as they take
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		tlog.Info.Printf("-serve-webdav: got %v, shutting down", sig)
+		srv.Close()
+	}()
+	tlog.Info.Printf("Serving %s over WebDAV on %s", args.cipherdir, l.Addr())
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		tlog.Fatal.Printf("-serve-webdav: %v", err)
+		return exitcodes.Other
+	}
+	return 0
+}
+
+// readWebdavAuth reads the "user:password" line of "file"
+func readWebdavAuth(file string) (user string, password string, err error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", "", err
+	}
+	line := strings.TrimRight(string(content), "\r\n")
+	i := strings.IndexByte(line, ':')
+	if i <= 0 || i == len(line)-1 || strings.ContainsAny(line, "\r\n") {
+		return "", "", errors.New(`want a single line "user:password"`)
+	}
+	return line[:i], line[i+1:], nil
+}
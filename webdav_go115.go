@@ -0,0 +1,15 @@
+//go:build !go1.16
+// +build !go1.16
+
+package gocryptfs
+
+import (
+	"github.com/HorizonLiu/gocryptfs/internal/exitcodes"
+	"github.com/HorizonLiu/gocryptfs/internal/tlog"
+)
+
+// serveWebdav needs io/fs, which is new in Go 1.16
+func serveWebdav(args *argContainer, password string) int {
+	tlog.Fatal.Printf("-serve-webdav needs gocryptfs built with Go 1.16 or later")
+	return exitcodes.Usage
+}